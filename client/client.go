@@ -0,0 +1,1033 @@
+// Package client is a Go client for the key-value store HTTP API.
+//
+//	c, err := client.New("http://localhost:8080", client.WithAPIKey("secret"))
+//	rev, err := c.Put(ctx, "greeting", "hello", client.WithTTL(time.Minute))
+//	entry, err := c.Get(ctx, "greeting")
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/gorilla/cluster"
+)
+
+var ErrorNoSuchKey = errors.New("No such key")
+
+var ErrorRevisionMismatch = errors.New("Revision mismatch")
+
+var ErrorKeyExists = errors.New("Key already exists")
+
+// ErrorRevisionRequired is returned by a Put to an existing key without
+// IfRevision when the server rejects conflicting writes.
+var ErrorRevisionRequired = errors.New("Revision required")
+
+// ErrorQuotaExceeded is returned, wrapped with the server's message, by
+// a write that would take a bucket past its quota.
+var ErrorQuotaExceeded = errors.New("Quota exceeded")
+
+// ErrorCursorExpired is returned by a List or Range continuing a snapshot
+// scan the server no longer holds; the scan has to start over.
+var ErrorCursorExpired = errors.New("Cursor expired")
+
+// Error is returned for responses with an unexpected status code.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("kvs: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+type Entry struct {
+	Key      string    `json:"key"`
+	Value    string    `json:"value"`
+	Revision uint64    `json:"revision"`
+	Modified time.Time `json:"-"` // Время записи версии, с точностью до секунды; нулевое - неизвестно
+}
+
+type Client struct {
+	baseURL *url.URL
+	http    *http.Client
+	token   string // Ключ API или JWT
+	timeout time.Duration
+	retries int
+	backoff time.Duration
+	ring    *cluster.Ring // Маршрутизация ключей по узлам; nil - всё на baseURL
+	session *Session      // Маркеры read-your-writes; nil - без сеанса
+
+	admin    *url.URL // Служебные маршруты; nil - на baseURL
+	adminRaw string
+}
+
+type Option func(*Client)
+
+// WithHTTPClient sets the underlying HTTP client, e.g. for custom TLS.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.http = hc }
+}
+
+// WithAPIKey authenticates every request with an API key or JWT, sent as
+// a bearer token.
+func WithAPIKey(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// WithTimeout bounds every call except Watch. The default is 10 seconds.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) { c.timeout = d }
+}
+
+// WithRetries retries failed calls up to n times, waiting backoff before
+// the first retry and doubling it after each one. Network errors, 429 and
+// 5xx responses are retried. The default is 2 retries after 100ms.
+func WithRetries(n int, backoff time.Duration) Option {
+	return func(c *Client) { c.retries, c.backoff = n, backoff }
+}
+
+// WithAdminURL sends Snapshot, Restore, Compact, Stats, Reload and
+// VerifyLog to the admin listener of the server at adminURL, which they
+// need unless the server serves them on its API address.
+func WithAdminURL(adminURL string) Option {
+	return func(c *Client) { c.adminRaw = adminURL }
+}
+
+// New returns a client for the server at baseURL.
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := parseServerURL(baseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		baseURL: u,
+		http:    http.DefaultClient,
+		timeout: 10 * time.Second,
+		retries: 2,
+		backoff: 100 * time.Millisecond,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if c.adminRaw != "" {
+		if c.admin, err = parseServerURL(c.adminRaw); err != nil {
+			return nil, err
+		}
+	}
+
+	c.http = withClusterRedirects(c.http)
+
+	return c, nil
+}
+
+func parseServerURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server URL: %w", err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid server URL %q: scheme must be http or https", raw)
+	}
+
+	return u, nil
+}
+
+// Get returns the value and revision of key, or ErrorNoSuchKey.
+func (c *Client) Get(ctx context.Context, key string) (Entry, error) {
+	return c.get(ctx, key, nil, nil)
+}
+
+// GetRevision returns the given revision of key if the server still keeps
+// it in the key's history, or ErrorNoSuchKey.
+func (c *Client) GetRevision(ctx context.Context, key string, revision uint64) (Entry, error) {
+	return c.get(ctx, key, url.Values{"rev": {strconv.FormatUint(revision, 10)}}, nil)
+}
+
+// GetIfChanged returns the value of key unless its revision is still the
+// given one, which the server confirms without sending the value again;
+// changed is false in that case.
+func (c *Client) GetIfChanged(ctx context.Context, key string, revision uint64) (entry Entry, changed bool, err error) {
+	entry, err = c.get(ctx, key, nil, http.Header{"If-None-Match": {formatETag(revision)}})
+	if isStatus(err, http.StatusNotModified) {
+		return Entry{Key: key, Revision: revision}, false, nil
+	}
+
+	return entry, err == nil, err
+}
+
+// GetTransformed returns a value the server derives from the value of key
+// with the given transform: "sha256", "base64" or "jsonpath:$.field".
+func (c *Client) GetTransformed(ctx context.Context, key, transform string) (Entry, error) {
+	return c.get(ctx, key, url.Values{"transform": {transform}}, nil)
+}
+
+func (c *Client) get(ctx context.Context, key string, query url.Values, header http.Header) (Entry, error) {
+	resp, err := c.do(ctx, http.MethodGet, keyPath(key), query, header, nil)
+	if err != nil {
+		return Entry{}, err
+	}
+	defer resp.Body.Close()
+
+	value, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	revision, _ := parseETag(resp.Header.Get("ETag"))
+	modified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+
+	return Entry{Key: key, Value: string(value), Revision: revision, Modified: modified}, nil
+}
+
+// GetMany returns the values of the keys that exist and the keys that do
+// not, read in one request.
+func (c *Client) GetMany(ctx context.Context, keys []string) (values map[string]string, missing []string, err error) {
+	body, err := json.Marshal(map[string][]string{"keys": keys})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := c.do(ctx, http.MethodPost, "/v1/mget", nil, nil, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Values  map[string]string `json:"values"`
+		Missing []string          `json:"missing"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+
+	return result.Values, result.Missing, err
+}
+
+// History returns the revisions of key the server keeps, oldest first and
+// ending with the current one, or ErrorNoSuchKey.
+func (c *Client) History(ctx context.Context, key string) ([]Entry, error) {
+	resp, err := c.do(ctx, http.MethodGet, keyPath(key)+"/history", nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var entries []Entry
+	err = json.NewDecoder(resp.Body).Decode(&entries)
+
+	return entries, err
+}
+
+// KeyMeta describes a key without its value. The times are nil when the
+// server does not know them.
+type KeyMeta struct {
+	Key         string     `json:"key"`
+	Revision    uint64     `json:"revision"`
+	Size        int        `json:"size"`
+	ContentType string     `json:"content_type,omitempty"`
+	Created     *time.Time `json:"created_at,omitempty"`
+	Updated     *time.Time `json:"updated_at,omitempty"`
+	Expires     *time.Time `json:"expires_at,omitempty"`
+}
+
+// Meta returns the metadata of key, or ErrorNoSuchKey.
+func (c *Client) Meta(ctx context.Context, key string) (KeyMeta, error) {
+	var meta KeyMeta
+
+	resp, err := c.do(ctx, http.MethodGet, keyPath(key)+"/meta", nil, nil, nil)
+	if err != nil {
+		return meta, err
+	}
+	defer resp.Body.Close()
+
+	err = json.NewDecoder(resp.Body).Decode(&meta)
+
+	return meta, err
+}
+
+type putOptions struct {
+	ttl         time.Duration
+	ifRevision  *uint64
+	ifMatch     string // "*" или пусто
+	ifNoneMatch string // "*" или пусто
+	contentType string
+}
+
+type PutOption func(*putOptions)
+
+// WithTTL makes the key expire after ttl.
+func WithTTL(ttl time.Duration) PutOption {
+	return func(o *putOptions) { o.ttl = ttl }
+}
+
+// IfRevision writes only if the key still has the given revision; 0 means
+// the key must not exist. Otherwise Put fails with ErrorRevisionMismatch.
+func IfRevision(revision uint64) PutOption {
+	return func(o *putOptions) { o.ifRevision = &revision }
+}
+
+// IfAbsent writes only if the key does not exist. Otherwise Put fails with
+// ErrorKeyExists.
+func IfAbsent() PutOption {
+	return func(o *putOptions) { o.ifNoneMatch = "*" }
+}
+
+// IfPresent writes only if the key exists. Otherwise Put fails with
+// ErrorNoSuchKey.
+func IfPresent() PutOption {
+	return func(o *putOptions) { o.ifMatch = "*" }
+}
+
+// WithContentType records the media type of the value, which the server
+// returns as the Content-Type of GET responses.
+func WithContentType(contentType string) PutOption {
+	return func(o *putOptions) { o.contentType = contentType }
+}
+
+// Put stores value under key and returns the key's new revision.
+func (c *Client) Put(ctx context.Context, key, value string, opts ...PutOption) (uint64, error) {
+	var o putOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	query := url.Values{}
+	if o.ttl > 0 {
+		query.Set("ttl", o.ttl.String())
+	}
+
+	header := http.Header{}
+	if o.ifRevision != nil {
+		header.Set("If-Match", formatETag(*o.ifRevision))
+	}
+	if o.ifMatch != "" {
+		header.Set("If-Match", o.ifMatch)
+	}
+	if o.ifNoneMatch != "" {
+		header.Set("If-None-Match", o.ifNoneMatch)
+	}
+	if o.contentType != "" {
+		header.Set("Content-Type", o.contentType)
+	}
+
+	resp, err := c.do(ctx, http.MethodPut, keyPath(key), query, header, []byte(value))
+
+	var e *Error
+	if errors.As(err, &e) && e.StatusCode == http.StatusConflict && o.ifNoneMatch != "" {
+		return 0, ErrorKeyExists
+	}
+
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	revision, _ := parseETag(resp.Header.Get("ETag"))
+
+	return revision, nil
+}
+
+// Increment atomically adds by to the integer value of key, creating it
+// at 0 if absent, and returns the new value.
+func (c *Client) Increment(ctx context.Context, key string, by int64) (int64, error) {
+	query := url.Values{"by": {strconv.FormatInt(by, 10)}}
+
+	// Повтор после потерянного ответа прибавил бы by дважды.
+	resp, err := c.doOnce(ctx, http.MethodPost, keyPath(key)+"/incr", query, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// Append atomically appends data to the value of key, creating it if
+// absent, and returns the new length of the value.
+func (c *Client) Append(ctx context.Context, key string, data []byte) (int, error) {
+	// Повтор после потерянного ответа добавил бы data дважды.
+	resp, err := c.doOnce(ctx, http.MethodPost, keyPath(key)+"/append", nil, nil, data)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(body)))
+}
+
+// Delete removes key, or fails with ErrorNoSuchKey.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	resp, err := c.do(ctx, http.MethodDelete, keyPath(key), nil, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+// DeletePrefix removes every key starting with prefix, which must not be
+// empty, and returns how many there were.
+func (c *Client) DeletePrefix(ctx context.Context, prefix string) (int, error) {
+	return c.deleteKeys(ctx, url.Values{"prefix": {prefix}})
+}
+
+// DeletePattern removes every key matching a glob pattern, as in
+// WatchPattern, and returns how many there were.
+func (c *Client) DeletePattern(ctx context.Context, pattern string) (int, error) {
+	return c.deleteKeys(ctx, url.Values{"pattern": {pattern}})
+}
+
+func (c *Client) deleteKeys(ctx context.Context, query url.Values) (int, error) {
+	resp, err := c.do(ctx, http.MethodDelete, "/v1/keys", query, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Deleted int `json:"deleted"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+
+	return result.Deleted, err
+}
+
+// Undelete brings back a key removed while the server keeps tombstones
+// and returns its new revision, or fails with ErrorNoSuchKey if nothing
+// can be restored.
+func (c *Client) Undelete(ctx context.Context, key string) (uint64, error) {
+	resp, err := c.do(ctx, http.MethodPost, keyPath(key)+"/undelete", nil, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	revision, _ := parseETag(resp.Header.Get("ETag"))
+
+	return revision, nil
+}
+
+type ListOptions struct {
+	Prefix   string
+	Cursor   string // NextCursor предыдущей страницы
+	Limit    int    // 0: значение сервера по умолчанию
+	Values   bool   // Возвращать значения вместе с ключами
+	Snapshot bool   // Только для первой страницы: просмотр копии на момент запроса
+}
+
+type ListPage struct {
+	Entries    []Entry // Value и Revision заполнены, только если Values
+	NextCursor string  // Пустая строка: страниц больше нет
+}
+
+// List returns one page of keys in lexicographic order.
+func (c *Client) List(ctx context.Context, opts ListOptions) (ListPage, error) {
+	query := url.Values{}
+	if opts.Prefix != "" {
+		query.Set("prefix", opts.Prefix)
+	}
+	if opts.Cursor != "" {
+		query.Set("cursor", opts.Cursor)
+	}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Values {
+		query.Set("values", "true")
+	}
+	if opts.Snapshot {
+		query.Set("snapshot", "true")
+	}
+
+	return c.listPage(ctx, "/v1/keys", query, opts.Values)
+}
+
+type RangeOptions struct {
+	Start    string // Первый ключ диапазона; пустая строка - с начала
+	End      string // Ключ после диапазона; пустая строка - до конца
+	Cursor   string // NextCursor предыдущей страницы
+	Limit    int    // 0: значение сервера по умолчанию
+	Values   bool   // Возвращать значения вместе с ключами
+	Snapshot bool   // Только для первой страницы: просмотр копии на момент запроса
+}
+
+// Range returns one page of the keys from Start up to, but not including,
+// End in lexicographic order.
+func (c *Client) Range(ctx context.Context, opts RangeOptions) (ListPage, error) {
+	query := url.Values{}
+	if opts.Start != "" {
+		query.Set("start", opts.Start)
+	}
+	if opts.End != "" {
+		query.Set("end", opts.End)
+	}
+	if opts.Cursor != "" {
+		query.Set("cursor", opts.Cursor)
+	}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Values {
+		query.Set("values", "true")
+	}
+	if opts.Snapshot {
+		query.Set("snapshot", "true")
+	}
+
+	return c.listPage(ctx, "/v1/range", query, opts.Values)
+}
+
+type LookupOptions struct {
+	Cursor string // NextCursor предыдущей страницы
+	Limit  int    // 0: значение сервера по умолчанию
+	Values bool   // Возвращать значения вместе с ключами
+}
+
+// Lookup returns one page of the keys whose JSON value has the indexed
+// field equal to value, in lexicographic order.
+func (c *Client) Lookup(ctx context.Context, field, value string, opts LookupOptions) (ListPage, error) {
+	query := url.Values{"value": {value}}
+	if opts.Cursor != "" {
+		query.Set("cursor", opts.Cursor)
+	}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Values {
+		query.Set("values", "true")
+	}
+
+	return c.listPage(ctx, "/v1/index/"+url.PathEscape(field), query, opts.Values)
+}
+
+func (c *Client) listPage(ctx context.Context, path string, query url.Values, values bool) (ListPage, error) {
+	resp, err := c.do(ctx, http.MethodGet, path, query, nil, nil)
+	if isStatus(err, http.StatusGone) {
+		return ListPage{}, ErrorCursorExpired
+	}
+
+	if err != nil {
+		return ListPage{}, err
+	}
+	defer resp.Body.Close()
+
+	page := ListPage{NextCursor: resp.Header.Get("X-Next-Cursor")}
+
+	if values {
+		err = json.NewDecoder(resp.Body).Decode(&page.Entries)
+		return page, err
+	}
+
+	var keys []string
+	if err := json.NewDecoder(resp.Body).Decode(&keys); err != nil {
+		return page, err
+	}
+
+	page.Entries = make([]Entry, len(keys))
+	for i, key := range keys {
+		page.Entries[i] = Entry{Key: key}
+	}
+
+	return page, nil
+}
+
+// Snapshot writes a snapshot of the whole store to w in the format
+// accepted by Restore.
+func (c *Client) Snapshot(ctx context.Context, w io.Writer) error {
+	resp, err := c.do(ctx, http.MethodGet, "/v1/snapshot", nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(w, resp.Body)
+
+	return err
+}
+
+// Restore replaces the whole store with a snapshot read from r.
+func (c *Client) Restore(ctx context.Context, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(ctx, http.MethodPost, "/v1/restore", nil, nil, data)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+// BulkOptions select the format of Export and Import, "jsonl" (the
+// default) or "csv". Prefix limits Export to the keys starting with it;
+// Replace makes Import replace the whole store instead of merging into it.
+type BulkOptions struct {
+	Format  string
+	Prefix  string
+	Replace bool
+}
+
+// ImportResult counts the records an Import applied and, when replacing,
+// the keys it removed.
+type ImportResult struct {
+	Imported int `json:"imported"`
+	Removed  int `json:"removed"`
+}
+
+// Export writes the live keys to w as JSON Lines or CSV records in the
+// format accepted by Import.
+func (c *Client) Export(ctx context.Context, w io.Writer, opts BulkOptions) error {
+	query := url.Values{}
+	if opts.Format != "" {
+		query.Set("format", opts.Format)
+	}
+	if opts.Prefix != "" {
+		query.Set("prefix", opts.Prefix)
+	}
+
+	resp, err := c.do(ctx, http.MethodGet, "/v1/export", query, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(w, resp.Body)
+
+	return err
+}
+
+// Import loads the records read from r into the store.
+func (c *Client) Import(ctx context.Context, r io.Reader, opts BulkOptions) (ImportResult, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return ImportResult{}, err
+	}
+
+	query := url.Values{}
+	if opts.Format != "" {
+		query.Set("format", opts.Format)
+	}
+	if opts.Replace {
+		query.Set("mode", "replace")
+	}
+
+	resp, err := c.do(ctx, http.MethodPost, "/v1/import", query, nil, data)
+	if err != nil {
+		return ImportResult{}, err
+	}
+	defer resp.Body.Close()
+
+	var result ImportResult
+	err = json.NewDecoder(resp.Body).Decode(&result)
+
+	return result, err
+}
+
+// Compact asks the server to compact its transaction log now.
+func (c *Client) Compact(ctx context.Context) error {
+	resp, err := c.do(ctx, http.MethodPost, "/v1/compact", nil, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+// Reload makes the server read its configuration again and apply the
+// settings that can change while it runs.
+func (c *Client) Reload(ctx context.Context) error {
+	resp, err := c.do(ctx, http.MethodPost, "/v1/reload", nil, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+// LogReport is the result of a transaction log check, as reported by
+// /v1/verify-log.
+type LogReport struct {
+	OK            bool              `json:"ok"`
+	Files         []LogFileReport   `json:"files"`
+	Events        uint64            `json:"events"`
+	EventTypes    map[string]uint64 `json:"event_types"` // По типам: "put", "delete", ...
+	Keys          int               `json:"distinct_keys"`
+	FirstSequence uint64            `json:"first_sequence"`
+	LastSequence  uint64            `json:"last_sequence"`
+}
+
+// LogFileReport describes one file of the log: a segment or the active
+// file, which comes last.
+type LogFileReport struct {
+	File       string         `json:"file"`
+	Bytes      int64          `json:"bytes"`
+	Events     uint64         `json:"events"`
+	Corruption *LogCorruption `json:"corruption"` // nil, если файл цел
+}
+
+// LogCorruption locates the first corrupt record of a file.
+type LogCorruption struct {
+	Offset    int64  `json:"offset"`
+	Discarded int64  `json:"discarded_bytes"`
+	Error     string `json:"error"`
+}
+
+// VerifyLog asks the server to check its transaction log.
+func (c *Client) VerifyLog(ctx context.Context) (LogReport, error) {
+	var report LogReport
+
+	resp, err := c.do(ctx, http.MethodGet, "/v1/verify-log", nil, nil, nil)
+	if err != nil {
+		return report, err
+	}
+	defer resp.Body.Close()
+
+	err = json.NewDecoder(resp.Body).Decode(&report)
+
+	return report, err
+}
+
+// MigrationStatus is the progress of a backend migration, as reported by
+// /v1/migration.
+type MigrationStatus struct {
+	Store          string `json:"store"`           // Целевое хранилище; пусто, если не переносится
+	TransactionLog string `json:"transaction_log"` // Целевой журнал; пусто, если не переносится
+	CutOver        bool   `json:"cut_over"`
+	Copied         int64  `json:"copied_keys"`
+	Failures       uint64 `json:"failures"`
+	LastError      string `json:"last_error"`
+}
+
+// Migration returns the progress of the backend migration of the server.
+func (c *Client) Migration(ctx context.Context) (MigrationStatus, error) {
+	return c.migration(ctx, http.MethodGet, "/v1/migration")
+}
+
+// Cutover makes the server read from the store it is migrating to.
+func (c *Client) Cutover(ctx context.Context) (MigrationStatus, error) {
+	return c.migration(ctx, http.MethodPost, "/v1/migration/cutover")
+}
+
+func (c *Client) migration(ctx context.Context, method, path string) (MigrationStatus, error) {
+	var status MigrationStatus
+
+	resp, err := c.do(ctx, method, path, nil, nil, nil)
+	if err != nil {
+		return status, err
+	}
+	defer resp.Body.Close()
+
+	err = json.NewDecoder(resp.Body).Decode(&status)
+
+	return status, err
+}
+
+// BucketUsage is the usage and quota of a bucket, the keys starting with
+// its prefix. A zero maximum is not enforced.
+type BucketUsage struct {
+	Prefix   string `json:"prefix"`
+	Keys     int    `json:"keys"`
+	Bytes    int64  `json:"bytes"` // Байт ключей и значений
+	MaxKeys  int    `json:"max_keys"`
+	MaxBytes int64  `json:"max_bytes"`
+}
+
+// Usage returns the usage of the buckets with a quota that the caller may
+// read.
+func (c *Client) Usage(ctx context.Context) ([]BucketUsage, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/v1/usage", nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var usage struct {
+		Buckets []BucketUsage `json:"buckets"`
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&usage)
+
+	return usage.Buckets, err
+}
+
+// Stats describes the state of the server, as reported by /v1/stats.
+type Stats struct {
+	Keys          int               `json:"keys"`
+	ValueBytes    int64             `json:"value_bytes"`
+	LastSequence  uint64            `json:"last_sequence"`
+	UptimeSeconds int64             `json:"uptime_seconds"`
+	LogBytes      int64             `json:"log_bytes"` // 0, если журнал не сообщает размер
+	EventsPerSec  float64           `json:"events_per_sec"`
+	Operations    map[string]uint64 `json:"operations"`
+
+	Replication *ReplicationStats `json:"replication"` // nil, если сервер не реплика
+}
+
+// ReplicationStats describes how far a replica is behind its primary.
+type ReplicationStats struct {
+	Primary    string  `json:"primary"`
+	Connected  bool    `json:"connected"`
+	Sequence   uint64  `json:"sequence"`
+	LagEvents  uint64  `json:"lag_events"`
+	LagSeconds float64 `json:"lag_seconds"`
+}
+
+// Stats returns the server statistics.
+func (c *Client) Stats(ctx context.Context) (Stats, error) {
+	var stats Stats
+
+	resp, err := c.do(ctx, http.MethodGet, "/v1/stats", nil, nil, nil)
+	if err != nil {
+		return stats, err
+	}
+	defer resp.Body.Close()
+
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+
+	return stats, err
+}
+
+// Ready returns the server readiness checks. ready is false while the
+// server replays its transaction log or when a check fails.
+func (c *Client) Ready(ctx context.Context) (checks map[string]string, ready bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	resp, err := c.send(ctx, http.MethodGet, "/readyz", nil, nil, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusServiceUnavailable {
+		return nil, false, checkStatus(resp)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&checks)
+
+	return checks, resp.StatusCode == http.StatusOK, err
+}
+
+// doOnce sends a request that is not safe to retry.
+func (c *Client) doOnce(ctx context.Context, method, path string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+
+	resp, err := c.send(ctx, method, path, query, header, body)
+	if err == nil {
+		err = checkStatus(resp)
+	}
+
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+
+	return resp, nil
+}
+
+// do sends a request, retrying as configured, and returns the response
+// if it has a 2xx status. body is resent on every attempt. Writes that
+// may be retried carry an Idempotency-Key, so that a server remembering
+// keys applies them once even if a response was lost; while the first
+// attempt is still being served retries get 409 and are retried again.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+
+	keyed := method != http.MethodGet && c.retries > 0 && header.Get("Idempotency-Key") == ""
+	if keyed {
+		header = withIdempotencyKey(header)
+	}
+
+	backoff := c.backoff
+
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(ctx, method, path, query, header, body)
+
+		retry := attempt < c.retries && ctx.Err() == nil
+		if err == nil {
+			retry = retry && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 ||
+				keyed && resp.StatusCode == http.StatusConflict)
+		}
+
+		if !retry {
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+
+			if err := checkStatus(resp); err != nil {
+				cancel()
+				return nil, err
+			}
+
+			resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+			return resp, nil
+		}
+
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			cancel()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// withIdempotencyKey returns a copy of header with a random
+// Idempotency-Key.
+func withIdempotencyKey(header http.Header) http.Header {
+	var id [16]byte
+	rand.Read(id[:])
+
+	header = header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Idempotency-Key", hex.EncodeToString(id[:]))
+
+	return header
+}
+
+func (c *Client) send(ctx context.Context, method, path string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := c.nodeURL(path).JoinPath(path)
+	u.RawQuery = query.Encode()
+
+	for redirects := 0; ; redirects++ {
+		var reader io.Reader
+		if body != nil {
+			reader = bytes.NewReader(body)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, method, u.String(), reader)
+		if err != nil {
+			return nil, err
+		}
+
+		for name, values := range header {
+			req.Header[name] = values
+		}
+
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+
+		if c.session != nil {
+			if token := c.session.Token(); token != "" {
+				req.Header.Set(sessionHeader, token)
+			}
+		}
+
+		resp, err := c.http.Do(req)
+		if err == nil && c.session != nil {
+			c.session.observe(resp)
+		}
+
+		if err != nil || redirects == maxClusterRedirects {
+			return resp, err
+		}
+
+		location, moved, err := followCluster(resp)
+		if err != nil {
+			return nil, err
+		}
+
+		if !moved {
+			return resp, nil
+		}
+
+		u = location // Ключ принадлежит другому узлу
+	}
+}
+
+// checkStatus maps error responses to errors and closes their body.
+func checkStatus(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	defer resp.Body.Close()
+
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return ErrorNoSuchKey
+	case http.StatusPreconditionFailed:
+		return ErrorRevisionMismatch
+	case http.StatusPreconditionRequired:
+		return ErrorRevisionRequired
+	case http.StatusForbidden:
+		if detail, ok := strings.CutPrefix(strings.TrimSpace(string(message)), "Quota exceeded: "); ok {
+			return fmt.Errorf("%w: %s", ErrorQuotaExceeded, detail)
+		}
+		fallthrough
+	default:
+		return &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+	}
+}
+
+// cancelBody releases the call's context once the body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+
+	return err
+}
+
+func keyPath(key string) string {
+	return "/v1/key/" + url.PathEscape(key)
+}
+
+func formatETag(revision uint64) string {
+	return `"` + strconv.FormatUint(revision, 10) + `"`
+}
+
+func parseETag(tag string) (uint64, bool) {
+	tag = strings.TrimSpace(tag)
+	if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+		return 0, false
+	}
+
+	revision, err := strconv.ParseUint(tag[1:len(tag)-1], 10, 64)
+
+	return revision, err == nil
+}
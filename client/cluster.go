@@ -0,0 +1,137 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"example.com/gorilla/cluster"
+)
+
+// clusterNodeHeader names the owner of a key in the redirects of servers
+// in cluster mode.
+const clusterNodeHeader = "X-Cluster-Node"
+
+const maxClusterRedirects = 3
+
+// WithCluster sends the requests for a single key straight to the node
+// that owns it on ring, which must be built from the same nodes and
+// virtual node count as the servers'. Other requests go to the server
+// given to New. Without this option the client still follows the
+// redirects of servers in cluster mode, one extra round trip each.
+func WithCluster(ring *cluster.Ring) Option {
+	return func(c *Client) { c.ring = ring }
+}
+
+// ClusterInfo describes the cluster of a server, as reported by
+// /v1/cluster.
+type ClusterInfo struct {
+	Node  string         `json:"node"` // ID опрошенного узла
+	Nodes []cluster.Node `json:"nodes"`
+}
+
+// Cluster returns the nodes of the server's cluster, e.g. to build the
+// ring for WithCluster. It fails with ErrorNoSuchKey if the server is not
+// in cluster mode.
+func (c *Client) Cluster(ctx context.Context) (ClusterInfo, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/v1/cluster", nil, nil, nil)
+	if err != nil {
+		return ClusterInfo{}, err
+	}
+	defer resp.Body.Close()
+
+	var info ClusterInfo
+	err = json.NewDecoder(resp.Body).Decode(&info)
+
+	return info, err
+}
+
+// adminPaths lists the paths served on the admin listener.
+var adminPaths = map[string]bool{
+	"/v1/snapshot":   true,
+	"/v1/restore":    true,
+	"/v1/compact":    true,
+	"/v1/stats":      true,
+	"/v1/reload":     true,
+	"/v1/verify-log": true,
+
+	"/v1/migration":         true,
+	"/v1/migration/cutover": true,
+}
+
+// nodeURL returns the base URL of the node that serves path: the admin
+// listener for admin paths, if it is known, or else the owner of its key
+// or lock on the ring, if there is one.
+func (c *Client) nodeURL(path string) *url.URL {
+	if c.admin != nil && adminPaths[path] {
+		return c.admin
+	}
+
+	if c.ring == nil {
+		return c.baseURL
+	}
+
+	for _, prefix := range []string{"/v1/key/", "/v1/watch/", "/v1/lock/"} {
+		if rest, ok := strings.CutPrefix(path, prefix); ok {
+			segment, _, _ := strings.Cut(rest, "/")
+
+			key, err := url.PathUnescape(segment)
+			if err != nil {
+				break
+			}
+
+			if u, err := url.Parse(c.ring.Owner(key).URL); err == nil {
+				return u
+			}
+		}
+	}
+
+	return c.baseURL
+}
+
+// followCluster returns the target of a cluster redirect, if resp is one.
+func followCluster(resp *http.Response) (*url.URL, bool, error) {
+	if resp.StatusCode != http.StatusTemporaryRedirect || resp.Header.Get(clusterNodeHeader) == "" {
+		return nil, false, nil
+	}
+
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	location, err := resp.Location()
+	if err != nil {
+		return nil, false, err
+	}
+
+	return location, true, nil
+}
+
+// withClusterRedirects returns a copy of hc that leaves cluster redirects
+// to send, which keeps the credentials when it follows them; net/http
+// drops the Authorization header on redirects to another host.
+func withClusterRedirects(hc *http.Client) *http.Client {
+	copied := *hc
+	check := hc.CheckRedirect
+
+	copied.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if req.Response != nil && req.Response.Header.Get(clusterNodeHeader) != "" {
+			return http.ErrUseLastResponse
+		}
+
+		if check != nil {
+			return check(req, via)
+		}
+
+		if len(via) >= 10 { // Как в net/http по умолчанию
+			return errors.New("stopped after 10 redirects")
+		}
+
+		return nil
+	}
+
+	return &copied
+}
@@ -0,0 +1,36 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var ErrorEventsGone = errors.New("Events are no longer available")
+
+// LogEvent is one event of the server's transaction log.
+type LogEvent struct {
+	Sequence uint64     `json:"sequence,omitempty"`
+	Type     string     `json:"type"` // "put", "delete", "expire", "increment", "txn", ...
+	Key      string     `json:"key,omitempty"`
+	Value    string     `json:"value,omitempty"`
+	Revision uint64     `json:"revision,omitempty"`
+	Until    *time.Time `json:"until,omitempty"` // Для "expire" и "tombstone"
+	Ops      []LogEvent `json:"ops,omitempty"`   // Записи транзакции
+}
+
+// Events streams the events logged after sequence number since, then
+// follows new ones until ctx is cancelled or the server ends the stream.
+// To resume, call it again with the Sequence of the last event handled.
+// It returns ErrorEventsGone if the server no longer holds those events.
+func (c *Client) Events(ctx context.Context, since uint64) (<-chan LogEvent, error) {
+	events, err := stream[LogEvent](ctx, c, "/v1/events", url.Values{"since": {strconv.FormatUint(since, 10)}})
+	if isStatus(err, http.StatusGone) {
+		return nil, ErrorEventsGone
+	}
+
+	return events, err
+}
@@ -0,0 +1,112 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var ErrorLockHeld = errors.New("Lock is held by another lease")
+
+var ErrorLeaseLost = errors.New("Lease has expired or been released")
+
+// Lease is a lock held by this client. FencingToken grows with every
+// acquisition, so resources guarded by the lock can reject the writes of
+// a holder that has lost it to another.
+type Lease struct {
+	Name         string        `json:"name"`
+	ID           string        `json:"lease"`
+	FencingToken uint64        `json:"fencing_token"`
+	Expires      time.Time     `json:"-"` // По часам клиента
+	TTL          time.Duration `json:"-"` // Выданный срок аренды
+}
+
+// Lock acquires the named lock for ttl, or the server's default if ttl
+// is 0, and fails with ErrorLockHeld while another lease holds it.
+func (c *Client) Lock(ctx context.Context, name string, ttl time.Duration) (Lease, error) {
+	lease, err := c.lease(ctx, http.MethodPost, lockPath(name), lockQuery("", ttl), ttl)
+	if isStatus(err, http.StatusLocked) {
+		return Lease{}, ErrorLockHeld
+	}
+
+	return lease, err
+}
+
+// Renew extends lease to ttl from now, or the server's default if ttl is
+// 0, and fails with ErrorLeaseLost if it has already run out.
+func (c *Client) Renew(ctx context.Context, lease Lease, ttl time.Duration) (Lease, error) {
+	renewed, err := c.lease(ctx, http.MethodPost, lockPath(lease.Name)+"/renew", lockQuery(lease.ID, ttl), ttl)
+	if isStatus(err, http.StatusGone) {
+		return Lease{}, ErrorLeaseLost
+	}
+
+	return renewed, err
+}
+
+// Unlock releases lease, or fails with ErrorLeaseLost if it has already
+// run out.
+func (c *Client) Unlock(ctx context.Context, lease Lease) error {
+	resp, err := c.do(ctx, http.MethodDelete, lockPath(lease.Name), lockQuery(lease.ID, 0), nil, nil)
+	if isStatus(err, http.StatusGone) {
+		return ErrorLeaseLost
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+// lease requests a lease for ttl, 0 meaning the server's default.
+func (c *Client) lease(ctx context.Context, method, path string, query url.Values, ttl time.Duration) (Lease, error) {
+	start := time.Now()
+
+	resp, err := c.do(ctx, method, path, query, nil, nil)
+	if err != nil {
+		return Lease{}, err
+	}
+	defer resp.Body.Close()
+
+	var reply struct {
+		Lease
+		TTL int64 `json:"ttl"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return Lease{}, err
+	}
+
+	lease := reply.Lease
+	if lease.TTL = ttl; ttl == 0 {
+		lease.TTL = time.Duration(reply.TTL) * time.Second // Округлено сервером вверх до секунд
+	}
+	lease.Expires = start.Add(lease.TTL) // Отсчёт от отправки запроса
+
+	return lease, nil
+}
+
+func lockQuery(id string, ttl time.Duration) url.Values {
+	query := url.Values{}
+	if id != "" {
+		query.Set("lease", id)
+	}
+	if ttl > 0 {
+		query.Set("ttl", ttl.String())
+	}
+
+	return query
+}
+
+func lockPath(name string) string {
+	return "/v1/lock/" + url.PathEscape(name)
+}
+
+// isStatus reports whether err is an unexpected response with status.
+func isStatus(err error, status int) bool {
+	var e *Error
+	return errors.As(err, &e) && e.StatusCode == status
+}
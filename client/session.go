@@ -0,0 +1,67 @@
+package client
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const sessionHeader = "X-Session-Token"
+
+// Session gives the clients sharing it read-your-writes consistency: a
+// client writing to the primary records in it the session token of every
+// write, and a client reading from a replica sends the last one, so that
+// the replica answers only once it has applied those writes. A replica
+// that does not catch up in time answers 503, which WithRetries retries.
+type Session struct {
+	mu    sync.Mutex
+	token string
+}
+
+func NewSession() *Session {
+	return &Session{}
+}
+
+// WithSession makes the client send and record the session tokens of s.
+func WithSession(s *Session) Option {
+	return func(c *Client) { c.session = s }
+}
+
+// Token returns the last session token recorded, or "" before any write.
+func (s *Session) Token() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.token
+}
+
+// observe records the token of a response, unless it is behind the one
+// already recorded.
+func (s *Session) observe(resp *http.Response) {
+	token := resp.Header.Get(sessionHeader)
+	if token == "" {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	epoch, sequence, ok := parseSessionToken(token)
+	last, lastSequence, _ := parseSessionToken(s.token)
+
+	if ok && (epoch != last || sequence > lastSequence) { // Другая эпоха - первичный сервер перезапущен
+		s.token = token
+	}
+}
+
+func parseSessionToken(token string) (epoch string, sequence uint64, ok bool) {
+	epoch, seq, ok := strings.Cut(token, ":")
+	if !ok {
+		return "", 0, false
+	}
+
+	sequence, err := strconv.ParseUint(seq, 10, 64)
+
+	return epoch, sequence, err == nil
+}
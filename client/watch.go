@@ -0,0 +1,118 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type Event struct {
+	Type    string     `json:"type"` // "put", "delete", "expire" или "evict"
+	Key     string     `json:"key"`
+	Value   string     `json:"value,omitempty"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+type WatchOption func(url.Values)
+
+// OnlyTypes streams only the events of the given types: "put", "delete",
+// "expire" or "evict".
+func OnlyTypes(types ...string) WatchOption {
+	return func(q url.Values) { q.Set("types", strings.Join(types, ",")) }
+}
+
+// OnlyChanges leaves out the puts that do not change the value of their
+// key.
+func OnlyChanges() WatchOption {
+	return func(q url.Values) { q.Set("changed", "true") }
+}
+
+// Watch streams changes of key until ctx is cancelled or the server ends
+// the stream; the returned channel is then closed.
+func (c *Client) Watch(ctx context.Context, key string, opts ...WatchOption) (<-chan Event, error) {
+	return c.watch(ctx, "/v1/watch/"+url.PathEscape(key), url.Values{}, opts)
+}
+
+// WatchPrefix streams changes of every key starting with prefix.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, opts ...WatchOption) (<-chan Event, error) {
+	return c.watch(ctx, "/v1/watch", url.Values{"prefix": {prefix}}, opts)
+}
+
+// WatchPattern streams changes of every key matching a Redis-style glob
+// pattern such as "user:*" or "session:??".
+func (c *Client) WatchPattern(ctx context.Context, pattern string, opts ...WatchOption) (<-chan Event, error) {
+	return c.watch(ctx, "/v1/watch", url.Values{"pattern": {pattern}}, opts)
+}
+
+func (c *Client) watch(ctx context.Context, path string, query url.Values, opts []WatchOption) (<-chan Event, error) {
+	for _, opt := range opts {
+		opt(query)
+	}
+
+	return stream[Event](ctx, c, path, query)
+}
+
+// stream decodes the JSON data of the Server-Sent Events that the server
+// sends at path.
+func stream[T any](ctx context.Context, c *Client, path string, query url.Values) (<-chan T, error) {
+	header := http.Header{"Accept": {"text/event-stream"}}
+
+	// Поток не ограничен по времени, поэтому c.timeout здесь не действует.
+	resp, err := c.send(ctx, http.MethodGet, path, query, header, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkStatus(resp); err != nil {
+		return nil, err
+	}
+
+	events := make(chan T)
+
+	go func() {
+		defer close(events)
+		defer resp.Body.Close()
+
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+		var data strings.Builder
+
+		for scanner.Scan() {
+			line := scanner.Text()
+
+			switch {
+			case line == "": // Конец события
+				if data.Len() == 0 {
+					continue
+				}
+
+				var e T
+				err := json.Unmarshal([]byte(data.String()), &e)
+				data.Reset()
+
+				if err != nil {
+					return
+				}
+
+				select {
+				case events <- e:
+				case <-ctx.Done():
+					return
+				}
+
+			case strings.HasPrefix(line, "data:"):
+				if data.Len() > 0 {
+					data.WriteByte('\n')
+				}
+				data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+			}
+		}
+	}()
+
+	return events, nil
+}
@@ -0,0 +1,143 @@
+// Package cluster assigns keys to the nodes of a kvs cluster by consistent
+// hashing. Every node and client configured with the same nodes computes
+// the same owner for a key, so independent servers can each serve a slice
+// of the keyspace and adding or removing a node moves only the keys of
+// that slice.
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultVirtualNodes is the number of points each node gets on the ring
+// when none is configured.
+const DefaultVirtualNodes = 128
+
+var ErrorNoNodes = errors.New("Cluster has no nodes")
+
+type Node struct {
+	ID  string `json:"id"`
+	URL string `json:"url"` // Базовый URL HTTP API узла
+}
+
+type point struct {
+	hash uint64
+	node int // Индекс в Ring.nodes
+}
+
+// Ring maps keys to nodes. It is immutable and safe for concurrent use.
+type Ring struct {
+	nodes  []Node
+	points []point // Отсортированы по hash
+}
+
+// New builds the ring of nodes, each placed at virtualNodes points.
+func New(nodes []Node, virtualNodes int) (*Ring, error) {
+	if len(nodes) == 0 {
+		return nil, ErrorNoNodes
+	}
+
+	if virtualNodes < 1 {
+		return nil, fmt.Errorf("virtual nodes must be at least 1")
+	}
+
+	r := &Ring{nodes: make([]Node, len(nodes))}
+	seen := make(map[string]bool, len(nodes))
+
+	for i, node := range nodes {
+		if node.ID == "" || strings.ContainsAny(node.ID, "=,") {
+			return nil, fmt.Errorf("invalid node ID %q", node.ID)
+		}
+
+		if seen[node.ID] {
+			return nil, fmt.Errorf("duplicate node ID %q", node.ID)
+		}
+		seen[node.ID] = true
+
+		u, err := url.Parse(node.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid URL %q of node %s", node.URL, node.ID)
+		}
+
+		node.URL = strings.TrimSuffix(node.URL, "/")
+		r.nodes[i] = node
+
+		for v := 0; v < virtualNodes; v++ {
+			r.points = append(r.points, point{hash: hash(node.ID + "#" + strconv.Itoa(v)), node: i})
+		}
+	}
+
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash != r.points[j].hash {
+			return r.points[i].hash < r.points[j].hash
+		}
+		return r.nodes[r.points[i].node].ID < r.nodes[r.points[j].node].ID // Совпадения хешей решаются одинаково везде
+	})
+
+	return r, nil
+}
+
+// ParseNodes parses node specifications of the form "id=url".
+func ParseNodes(specs []string) ([]Node, error) {
+	nodes := make([]Node, 0, len(specs))
+
+	for _, spec := range specs {
+		id, u, ok := strings.Cut(strings.TrimSpace(spec), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid cluster node %q: expected id=url", spec)
+		}
+
+		nodes = append(nodes, Node{ID: strings.TrimSpace(id), URL: strings.TrimSpace(u)})
+	}
+
+	return nodes, nil
+}
+
+// Owner returns the node that owns key: the first one clockwise from the
+// key's hash.
+func (r *Ring) Owner(key string) Node {
+	h := hash(key)
+
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0 // Замкнуть кольцо
+	}
+
+	return r.nodes[r.points[i].node]
+}
+
+// Node returns the node with the given ID.
+func (r *Ring) Node(id string) (Node, bool) {
+	for _, node := range r.nodes {
+		if node.ID == id {
+			return node, true
+		}
+	}
+
+	return Node{}, false
+}
+
+// Nodes returns the nodes of the ring in the order they were given.
+func (r *Ring) Nodes() []Node {
+	return append([]Node(nil), r.nodes...)
+}
+
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+
+	x := h.Sum64() // Перемешать биты: у FNV близкие строки дают близкие хеши
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+
+	return x
+}
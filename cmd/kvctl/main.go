@@ -0,0 +1,591 @@
+// Command kvctl manages a running key-value store over its HTTP API.
+//
+//	kvctl [-server URL] [-admin URL] [-api-key KEY] <command> [arguments]
+//
+// Commands:
+//
+//	get [-rev N] KEY            print the value of KEY, or its revision N
+//	history KEY                 print the kept revisions of KEY with their values
+//	mget KEY...                 print the keys that exist with their values
+//	put [-ttl D] KEY [VALUE]    store VALUE, or standard input, under KEY
+//	delete KEY                  remove KEY
+//	undelete KEY                restore KEY after a delete, while the server keeps it
+//	purge [-pattern] PREFIX     remove every key starting with PREFIX, or matching a glob
+//	keys [-prefix P] [-values] [-snapshot]
+//	                            list every key, one per line
+//	snapshot [FILE]             write a snapshot to FILE or standard output
+//	restore [FILE]              replace the store with a snapshot
+//	export [-format F] [-prefix P] [FILE]
+//	                            write the keys as JSON Lines or CSV
+//	import [-format F] [-replace] [FILE]
+//	                            merge keys from JSON Lines or CSV, or replace the store
+//	compact                     compact the transaction log
+//	reload                      make the server reload its configuration
+//	stats                       show readiness checks and server statistics
+//	migration [cutover]         show the backend migration, or cut reads over to it
+//
+// Snapshot, restore, compact, reload, stats and migration go to the admin
+// listener given by -admin.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"time"
+
+	"example.com/gorilla/client"
+)
+
+type command struct {
+	usage string
+	run   func(ctx context.Context, c *client.Client, args []string) error
+}
+
+var commands = map[string]command{
+	"get":        {"get [-rev N] KEY", get},
+	"history":    {"history KEY", history},
+	"mget":       {"mget KEY...", mget},
+	"put":        {"put [-ttl D] KEY [VALUE]", put},
+	"delete":     {"delete KEY", del},
+	"undelete":   {"undelete KEY", undelete},
+	"purge":      {"purge [-pattern] PREFIX", purge},
+	"keys":       {"keys [-prefix P] [-values] [-snapshot]", keys},
+	"snapshot":   {"snapshot [FILE]", snapshot},
+	"restore":    {"restore [FILE]", restore},
+	"export":     {"export [-format F] [-prefix P] [FILE]", export},
+	"import":     {"import [-format F] [-replace] [FILE]", importFile},
+	"compact":    {"compact", compact},
+	"reload":     {"reload", reload},
+	"stats":      {"stats", stats},
+	"usage":      {"usage", bucketUsage},
+	"verify-log": {"verify-log", verifyLog},
+	"migration":  {"migration [cutover]", migrate},
+}
+
+var errUsage = errors.New("usage")
+
+func main() {
+	server := flag.String("server", envOr("KVS_SERVER", "http://localhost:8080"), "server URL (KVS_SERVER)")
+	admin := flag.String("admin", envOr("KVS_ADMIN_SERVER", "http://localhost:9090"), "admin listener URL, empty if the server has none (KVS_ADMIN_SERVER)")
+	apiKey := flag.String("api-key", os.Getenv("KVS_API_KEY"), "API key or JWT (KVS_API_KEY)")
+	timeout := flag.Duration("timeout", 30*time.Second, "timeout of each request")
+
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "kvctl: unknown command %q\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	opts := []client.Option{client.WithAPIKey(*apiKey), client.WithTimeout(*timeout)}
+	if *admin != "" {
+		opts = append(opts, client.WithAdminURL(*admin))
+	}
+
+	c, err := client.New(*server, opts...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "kvctl:", err)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	err = cmd.run(ctx, c, flag.Args()[1:])
+	if errors.Is(err, errUsage) {
+		fmt.Fprintln(os.Stderr, "usage: kvctl", cmd.usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "kvctl:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: kvctl [flags] <command> [arguments]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	for _, name := range []string{"get", "history", "mget", "put", "delete", "undelete", "purge", "keys", "snapshot", "restore", "export", "import", "compact", "reload", "stats", "usage", "verify-log", "migration"} {
+		fmt.Fprintln(os.Stderr, "  "+commands[name].usage)
+	}
+	fmt.Fprintln(os.Stderr, "\nflags:")
+	flag.PrintDefaults()
+}
+
+func envOr(name, fallback string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+
+	return fallback
+}
+
+func get(ctx context.Context, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("get", flag.ContinueOnError)
+	rev := fs.Uint64("rev", 0, "read this revision from the key's history")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return errUsage
+	}
+
+	var entry client.Entry
+	var err error
+	if *rev > 0 {
+		entry, err = c.GetRevision(ctx, fs.Arg(0), *rev)
+	} else {
+		entry, err = c.Get(ctx, fs.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(os.Stdout, entry.Value)
+
+	return err
+}
+
+func history(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	entries, err := c.History(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		fmt.Printf("%d\t%s\n", e.Revision, e.Value)
+	}
+
+	return nil
+}
+
+func mget(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	values, missing, err := c.GetMany(ctx, args)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range args {
+		if value, ok := values[key]; ok {
+			fmt.Printf("%s\t%s\n", key, value)
+			delete(values, key) // Повторы печатаются один раз
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("no such keys: %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+func put(ctx context.Context, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("put", flag.ContinueOnError)
+	ttl := fs.Duration("ttl", 0, "expire the key after this long")
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+
+	args = fs.Args()
+	if len(args) < 1 || len(args) > 2 {
+		return errUsage
+	}
+
+	var value string
+	if len(args) == 2 {
+		value = args[1]
+	} else {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		value = string(data)
+	}
+
+	var opts []client.PutOption
+	if *ttl > 0 {
+		opts = append(opts, client.WithTTL(*ttl))
+	}
+
+	revision, err := c.Put(ctx, args[0], value, opts...)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "revision %d\n", revision)
+
+	return nil
+}
+
+func del(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	return c.Delete(ctx, args[0])
+}
+
+func purge(ctx context.Context, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("purge", flag.ContinueOnError)
+	pattern := fs.Bool("pattern", false, "treat the argument as a glob pattern")
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+
+	var n int
+	var err error
+
+	if *pattern {
+		n, err = c.DeletePattern(ctx, fs.Arg(0))
+	} else {
+		n, err = c.DeletePrefix(ctx, fs.Arg(0))
+	}
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "deleted %d keys\n", n)
+
+	return nil
+}
+
+func undelete(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	revision, err := c.Undelete(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "revision %d\n", revision)
+
+	return nil
+}
+
+func keys(ctx context.Context, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("keys", flag.ContinueOnError)
+	prefix := fs.String("prefix", "", "only keys starting with this prefix")
+	values := fs.Bool("values", false, "print values after a tab")
+	snapshot := fs.Bool("snapshot", false, "list the keys as they are when the listing starts")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return errUsage
+	}
+
+	opts := client.ListOptions{Prefix: *prefix, Values: *values, Limit: 1000, Snapshot: *snapshot}
+
+	for {
+		page, err := c.List(ctx, opts)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range page.Entries {
+			if *values {
+				fmt.Printf("%s\t%s\n", e.Key, e.Value)
+			} else {
+				fmt.Println(e.Key)
+			}
+		}
+
+		if page.NextCursor == "" {
+			return nil
+		}
+		opts.Cursor = page.NextCursor
+	}
+}
+
+func snapshot(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+
+	if len(args) == 0 || args[0] == "-" {
+		return c.Snapshot(ctx, os.Stdout)
+	}
+
+	file, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+
+	if err := c.Snapshot(ctx, file); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+func restore(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+
+	if len(args) == 0 || args[0] == "-" {
+		return c.Restore(ctx, os.Stdin)
+	}
+
+	file, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return c.Restore(ctx, file)
+}
+
+func export(ctx context.Context, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := fs.String("format", "jsonl", `"jsonl" or "csv"`)
+	prefix := fs.String("prefix", "", "only keys starting with this prefix")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 1 {
+		return errUsage
+	}
+
+	opts := client.BulkOptions{Format: *format, Prefix: *prefix}
+
+	if fs.NArg() == 0 || fs.Arg(0) == "-" {
+		return c.Export(ctx, os.Stdout, opts)
+	}
+
+	file, err := os.Create(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if err := c.Export(ctx, file, opts); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+func importFile(ctx context.Context, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := fs.String("format", "", `"jsonl" or "csv"; guessed from the file extension by default`)
+	replace := fs.Bool("replace", false, "replace the whole store instead of merging")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 1 {
+		return errUsage
+	}
+
+	opts := client.BulkOptions{Format: *format, Replace: *replace}
+
+	input := os.Stdin
+	if fs.NArg() == 1 && fs.Arg(0) != "-" {
+		file, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		input = file
+		if opts.Format == "" && strings.HasSuffix(strings.ToLower(file.Name()), ".csv") {
+			opts.Format = "csv"
+		}
+	}
+
+	result, err := c.Import(ctx, input, opts)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "imported %d keys, removed %d\n", result.Imported, result.Removed)
+
+	return nil
+}
+
+func compact(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+
+	return c.Compact(ctx)
+}
+
+func reload(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+
+	return c.Reload(ctx)
+}
+
+func migrate(ctx context.Context, c *client.Client, args []string) error {
+	get := c.Migration
+	switch {
+	case len(args) == 1 && args[0] == "cutover":
+		get = c.Cutover
+	case len(args) != 0:
+		return errUsage
+	}
+
+	status, err := get(ctx)
+	if err != nil {
+		return err
+	}
+
+	if status.Store != "" {
+		fmt.Printf("store\t%s\n", status.Store)
+	}
+	if status.TransactionLog != "" {
+		fmt.Printf("transaction log\t%s\n", status.TransactionLog)
+	}
+
+	fmt.Printf("copied keys\t%d\n", status.Copied)
+	fmt.Printf("failures\t%d\n", status.Failures)
+	fmt.Printf("cut over\t%t\n", status.CutOver)
+
+	if status.LastError != "" {
+		fmt.Printf("last error\t%s\n", status.LastError)
+	}
+
+	return nil
+}
+
+func verifyLog(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+
+	report, err := c.VerifyLog(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range report.Files {
+		if f.Corruption == nil {
+			fmt.Printf("%s\t%d events, %d bytes\n", f.File, f.Events, f.Bytes)
+			continue
+		}
+
+		fmt.Printf("%s\t%d events, corrupt at offset %d (%d bytes discarded): %s\n", f.File, f.Events, f.Corruption.Offset, f.Corruption.Discarded, f.Corruption.Error)
+	}
+
+	fmt.Printf("events\t%d\n", report.Events)
+
+	names := make([]string, 0, len(report.EventTypes))
+	for name := range report.EventTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Printf("%s events\t%d\n", name, report.EventTypes[name])
+	}
+
+	fmt.Printf("distinct keys\t%d\n", report.Keys)
+	fmt.Printf("sequences\t%d-%d\n", report.FirstSequence, report.LastSequence)
+
+	if !report.OK {
+		return errors.New("transaction log is corrupt")
+	}
+
+	return nil
+}
+
+func bucketUsage(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+
+	buckets, err := c.Usage(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, b := range buckets {
+		fmt.Printf("%q\t%s keys, %s bytes\n", b.Prefix, quota(int64(b.Keys), int64(b.MaxKeys)), quota(b.Bytes, b.MaxBytes))
+	}
+
+	return nil
+}
+
+// quota formats a usage against its bound, if it has one.
+func quota(used, limit int64) string {
+	if limit == 0 {
+		return fmt.Sprint(used)
+	}
+
+	return fmt.Sprintf("%d of %d", used, limit)
+}
+
+func stats(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+
+	checks, ready, err := c.Ready(ctx)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("ready\t%t\n", ready)
+	for name, result := range checks {
+		fmt.Printf("%s\t%s\n", strings.ReplaceAll(name, "_", " "), result)
+	}
+
+	if !ready {
+		return nil
+	}
+
+	st, err := c.Stats(ctx)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("keys\t%d\n", st.Keys)
+	fmt.Printf("value bytes\t%d\n", st.ValueBytes)
+	fmt.Printf("last sequence\t%d\n", st.LastSequence)
+	fmt.Printf("uptime\t%s\n", time.Duration(st.UptimeSeconds)*time.Second)
+	if st.LogBytes > 0 {
+		fmt.Printf("log bytes\t%d\n", st.LogBytes)
+	}
+	fmt.Printf("events/sec\t%.2f\n", st.EventsPerSec)
+
+	if r := st.Replication; r != nil {
+		fmt.Printf("replicating\t%s\n", r.Primary)
+		fmt.Printf("replication connected\t%t\n", r.Connected)
+		fmt.Printf("replication lag\t%d events, %.1fs\n", r.LagEvents, r.LagSeconds)
+	}
+
+	names := make([]string, 0, len(st.Operations))
+	for name := range st.Operations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Printf("%s requests\t%d\n", strings.ReplaceAll(name, "_", " "), st.Operations[name])
+	}
+
+	return nil
+}
@@ -0,0 +1,12 @@
+// Command server runs the key-value store server.
+package main
+
+import (
+	"os"
+
+	"example.com/gorilla/httpapi"
+)
+
+func main() {
+	httpapi.Main(os.Args[1:])
+}
@@ -0,0 +1,50 @@
+// Package httpapi runs the key-value store server: the HTTP API and the
+// admin listener, with the RESP, memcached and gRPC listeners, replication
+// and the cluster when they are configured.
+//
+//	func main() {
+//		httpapi.Main(os.Args[1:])
+//	}
+//
+// A program that sets its configuration and signals up itself builds the
+// server with New and runs it until its context is done:
+//
+//	s, err := httpapi.New(c)
+//	err = s.Run(ctx)
+//
+// The server keeps its state in the process: there is one per process.
+package httpapi
+
+import "example.com/gorilla/internal/kvs"
+
+type (
+	Config = kvs.Config
+	Server = kvs.Server
+)
+
+var ErrorServerExists = kvs.ErrorServerExists
+
+// Main runs the server with the command line arguments, without the name
+// of the program, until SIGINT or SIGTERM. It exits the process if the
+// server cannot start or stop cleanly.
+func Main(args []string) {
+	kvs.Main(args)
+}
+
+// LoadConfig resolves the configuration from defaults, the config file,
+// the environment and args, in that order of precedence.
+func LoadConfig(args []string) (*Config, error) {
+	return kvs.LoadConfig(args)
+}
+
+// DefaultConfig returns the configuration the server starts with when
+// nothing is set.
+func DefaultConfig() *Config {
+	return kvs.DefaultConfig()
+}
+
+// New builds the server of c, or returns ErrorServerExists if the process
+// already has one.
+func New(c *Config) (*Server, error) {
+	return kvs.NewServer(c)
+}
@@ -0,0 +1,400 @@
+package kvs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * Access control lists.
+ *
+ * With ACLs enabled, every request is also checked against the
+ * permissions its principal holds on key prefixes: read, write, delete
+ * and admin, which implies the other three. The ACL of a principal is the
+ * value of the key "_acl:<name>", a JSON array of rules such as
+ * [{"prefix": "orders/", "permissions": ["read", "write"]}], and the rules
+ * of "_acl:*" apply to every principal. A key may be used when a rule
+ * whose prefix starts it grants the permission. Requests on many keys
+ * need it on a prefix of them all: listings and prefix watches on their
+ * prefix, ranges on the common prefix of their bounds, and streams,
+ * snapshots and index lookups on the whole keyspace. Writing the ACL keys
+ * and the administrative endpoints need admin. The principals configured
+ * as ACL admins hold admin on everything, so that the first ACLs can be
+ * written.
+ *
+ * The ACLs are reloaded from the store when their keys change, and every
+ * aclRefreshInterval for the writes that are not published, such as those
+ * a replica applies. An ACL that is not valid is logged and grants
+ * nothing. REST and RESP requests are checked; the memcached listener has
+ * no authentication and cannot be enabled with them.
+ */
+const (
+	aclPrefix          = "_acl:"          // Ключи ACL: _acl:<принципал>
+	aclEveryone        = "*"              // ACL, действующий для всех принципалов
+	aclRefreshInterval = 10 * time.Second // Перечитывание ACL без событий об изменении
+	aclPageSize        = 1000
+)
+
+type aclPermission uint8
+
+const (
+	aclRead aclPermission = 1 << iota
+	aclWrite
+	aclDelete
+	aclAdmin
+)
+
+var aclPermissionNames = map[string]aclPermission{
+	"read":   aclRead,
+	"write":  aclWrite,
+	"delete": aclDelete,
+	"admin":  aclAdmin,
+}
+
+// aclRule is one rule of an ACL as stored.
+type aclRule struct {
+	Prefix      string   `json:"prefix"`
+	Permissions []string `json:"permissions"`
+}
+
+type aclGrant struct {
+	prefix  string
+	granted aclPermission
+}
+
+// aclCheck is a permission a request needs on every key starting with
+// prefix.
+type aclCheck struct {
+	permission aclPermission
+	prefix     string
+}
+
+var acl *ACL
+
+type ACL struct {
+	admins map[string]bool
+
+	mu     sync.RWMutex
+	grants map[string][]aclGrant // Принципал -> права
+
+	changed chan struct{}
+}
+
+func newACL(c ACLConfig) *ACL {
+	a := &ACL{admins: make(map[string]bool, len(c.Admins)), changed: make(chan struct{}, 1)}
+
+	for _, name := range c.Admins {
+		a.admins[name] = true
+	}
+
+	return a
+}
+
+// parseACL parses the JSON rules of an ACL.
+func parseACL(value string) ([]aclGrant, error) {
+	var rules []aclRule
+	if err := json.Unmarshal([]byte(value), &rules); err != nil {
+		return nil, err
+	}
+
+	grants := make([]aclGrant, len(rules))
+	for i, rule := range rules {
+		grants[i].prefix = rule.Prefix
+
+		for _, name := range rule.Permissions {
+			permission, ok := aclPermissionNames[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown permission %q", name)
+			}
+			grants[i].granted |= permission
+		}
+	}
+
+	return grants, nil
+}
+
+// load reads the ACLs from the store.
+func (a *ACL) load(ctx context.Context) error {
+	grants := make(map[string][]aclGrant)
+
+	for after := ""; ; {
+		entries, more, err := store.List(ctx, aclPrefix, after, aclPageSize)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range entries {
+			principal := strings.TrimPrefix(e.Key, aclPrefix)
+
+			g, err := parseACL(e.Value)
+			if err != nil {
+				slog.Warn("ignoring invalid ACL", "key", e.Key, "error", err)
+				continue
+			}
+
+			grants[principal] = g
+		}
+
+		if !more {
+			break
+		}
+		after = entries[len(entries)-1].Key
+	}
+
+	a.mu.Lock()
+	a.grants = grants
+	a.mu.Unlock()
+
+	return nil
+}
+
+// run reloads the ACLs whenever they may have changed.
+func (a *ACL) run(ctx context.Context) {
+	broker.Listen(func(e ChangeEvent) {
+		if strings.HasPrefix(e.Key, aclPrefix) {
+			select {
+			case a.changed <- struct{}{}:
+			default: // Перезагрузка уже запрошена
+			}
+		}
+	})
+
+	ticker := time.NewTicker(aclRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-a.changed:
+		case <-ticker.C:
+		}
+
+		if err := a.load(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("failed to load ACLs", "error", err)
+		}
+	}
+}
+
+// allows reports whether p holds permission on every key starting with
+// prefix.
+func (a *ACL) allows(p Principal, permission aclPermission, prefix string) bool {
+	if a.admins[p.Name] {
+		return true
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	for _, grants := range [][]aclGrant{a.grants[p.Name], a.grants[aclEveryone]} {
+		for _, g := range grants {
+			if strings.HasPrefix(prefix, g.prefix) && (g.granted&aclAdmin != 0 || g.granted&permission == permission) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Middleware rejects with 403 the requests the ACL of their principal
+// does not allow.
+func (a *ACL) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, _ := PrincipalFrom(r.Context())
+
+		for _, check := range requestChecks(r) {
+			if !a.allows(p, check.permission, check.prefix) {
+				http.Error(w, fmt.Sprintf("%s on %q", ErrorForbidden.Error(), check.prefix), http.StatusForbidden)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// keyCheck returns the check for permission on key. Changing an ACL needs
+// admin.
+func keyCheck(permission aclPermission, key string) aclCheck {
+	key = normalizeKey(key) // Ключи тела запроса ещё не нормализованы
+
+	if permission != aclRead && strings.HasPrefix(key, aclPrefix) {
+		permission = aclAdmin
+	}
+
+	return aclCheck{permission, key}
+}
+
+// prefixCheck returns the check for permission on the keys starting with
+// prefix. Changing ACLs needs admin.
+func prefixCheck(permission aclPermission, prefix string) aclCheck {
+	if permission != aclRead && (strings.HasPrefix(prefix, aclPrefix) || strings.HasPrefix(aclPrefix, prefix)) {
+		permission = aclAdmin
+	}
+
+	return aclCheck{permission, prefix}
+}
+
+// batchCheck returns the check for one operation of a batch or
+// transaction.
+func batchCheck(op BatchOp) aclCheck {
+	switch op.Op {
+	case BatchPut:
+		return keyCheck(aclWrite, op.Key)
+	case BatchDelete:
+		return keyCheck(aclDelete, op.Key)
+	default:
+		return keyCheck(aclRead, op.Key)
+	}
+}
+
+// commonPrefix returns the prefix of every key from start up to end.
+func commonPrefix(start, end string) string {
+	if end == "" {
+		return ""
+	}
+
+	n := 0
+	for n < len(start) && n < len(end) && start[n] == end[n] {
+		n++
+	}
+
+	return start[:n]
+}
+
+// requestChecks returns the checks a request must pass, by its route.
+func requestChecks(r *http.Request) []aclCheck {
+	route := currentRoute(r)
+	if route == nil {
+		return nil
+	}
+
+	vars, query := pathVars(r), r.URL.Query()
+
+	prefix := query.Get("prefix")
+	if pattern := query.Get("pattern"); pattern != "" {
+		prefix = globPrefix(pattern)
+	}
+
+	switch route.name {
+	case "get", "v2_get", "ttl", "meta", "history", "watch":
+		return []aclCheck{keyCheck(aclRead, vars["key"])}
+	case "put", "v2_put", "incr", "append", "undelete":
+		return []aclCheck{keyCheck(aclWrite, vars["key"])}
+	case "delete", "v2_delete", "unschedule": // Отмена удаления по расписанию проверяется как удаление
+		return []aclCheck{keyCheck(aclDelete, vars["key"])}
+	case "rename":
+		return []aclCheck{keyCheck(aclRead, vars["key"]), keyCheck(aclDelete, vars["key"]), keyCheck(aclWrite, destinationKey(r))}
+	case "copy":
+		return []aclCheck{keyCheck(aclRead, vars["key"]), keyCheck(aclWrite, destinationKey(r))}
+	case "lock", "unlock", "renew_lock": // Имя замка проверяется как ключ
+		return []aclCheck{keyCheck(aclWrite, vars["name"])}
+	case "lock_info":
+		return []aclCheck{keyCheck(aclRead, vars["name"])}
+	case "list", "export", "watch_prefix":
+		return []aclCheck{prefixCheck(aclRead, prefix)}
+	case "delete_keys":
+		return []aclCheck{prefixCheck(aclDelete, prefix)}
+	case "range":
+		return []aclCheck{prefixCheck(aclRead, commonPrefix(query.Get("start"), query.Get("end")))}
+	case "dir":
+		return []aclCheck{prefixCheck(aclRead, dirPath(r))}
+	case "index", "snapshot", "events", "replication", "replication_snapshot", "hotkeys", "schedule", "stats", "cluster":
+		return []aclCheck{prefixCheck(aclRead, "")}
+	case "restore", "import", "compact", "reload", "pprof", "expvar", "goroutines", "verify_log", "audit", "migration", "migration_cutover", "slowlog":
+		return []aclCheck{{aclAdmin, ""}}
+	case "read_only":
+		if r.Method != http.MethodGet {
+			return []aclCheck{{aclAdmin, ""}}
+		}
+	case "mget", "batch", "txn":
+		return bodyChecks(r, route.name)
+	case "usage":
+		return nil // usageHandler оставляет только префиксы, которые principal может читать
+	}
+
+	return nil
+}
+
+// bodyChecks returns the checks of the keys named in the body of a
+// multi-key request, leaving the body to the handler. A body that does
+// not decode needs none, since the handler rejects it.
+func bodyChecks(r *http.Request, name string) []aclCheck {
+	data, err := io.ReadAll(io.LimitReader(r.Body, config.Limits.MaxBodyBytes+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(data), r.Body), r.Body}
+
+	if err != nil {
+		return nil
+	}
+
+	var checks []aclCheck
+	decoder := json.NewDecoder(bytes.NewReader(data))
+
+	switch name {
+	case "mget":
+		var req mgetRequest
+		if decoder.Decode(&req) == nil {
+			for _, key := range req.Keys {
+				checks = append(checks, keyCheck(aclRead, key))
+			}
+		}
+
+	case "batch":
+		var ops []BatchOp
+		if decoder.Decode(&ops) == nil {
+			for _, op := range ops {
+				checks = append(checks, batchCheck(op))
+			}
+		}
+
+	case "txn":
+		var t Txn
+		if decoder.Decode(&t) == nil {
+			for _, c := range t.Compare {
+				checks = append(checks, keyCheck(aclRead, c.Key))
+			}
+
+			for _, op := range append(t.Success, t.Failure...) {
+				checks = append(checks, batchCheck(op))
+			}
+		}
+	}
+
+	return checks
+}
+
+// respChecks returns the checks a RESP command must pass.
+func respChecks(name string, cmd respCommand, args []string) []aclCheck {
+	if name == "KEYS" {
+		return []aclCheck{prefixCheck(aclRead, globPrefix(args[1]))}
+	}
+
+	keys := commandKeys(cmd, args)
+
+	permission := aclRead
+	switch {
+	case name == "DEL":
+		permission = aclDelete
+	case cmd.write:
+		permission = aclWrite
+	}
+
+	checks := make([]aclCheck, len(keys))
+	for i, key := range keys {
+		checks[i] = keyCheck(permission, key)
+	}
+
+	return checks
+}
@@ -0,0 +1,192 @@
+package kvs
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"os/signal"
+	"runtime"
+	rpprof "runtime/pprof"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/**
+ * Admin listener.
+ *
+ * The operational endpoints - statistics, snapshots and restores,
+ * compaction, the read-only switch, configuration reload, the audit log,
+ * the pprof profiles under /debug/pprof/, the expvar variables under
+ * /debug/vars and the goroutine dump of /debug/goroutines - are served on
+ * a separate listener, bound to localhost by default, and answer 404 on
+ * the public one; the data API answers 404 on the admin listener in turn.
+ * Both share the middleware, credentials and TLS settings. Replicas fetch
+ * the snapshot of their primary from /v1/replication/snapshot on the
+ * public listener instead. With no admin address configured, everything
+ * is served on the public listener as before.
+ */
+type adminListenerKey struct{}
+
+// adminRoutes lists the routes served on the admin listener.
+var adminRoutes = map[string]bool{
+	"snapshot":   true,
+	"restore":    true,
+	"compact":    true,
+	"read_only":  true,
+	"stats":      true,
+	"hotkeys":    true,
+	"slowlog":    true,
+	"reload":     true,
+	"audit":      true,
+	"pprof":      true,
+	"expvar":     true,
+	"goroutines": true,
+	"verify_log": true,
+
+	"migration":         true,
+	"migration_cutover": true,
+
+	"schedule":   true,
+	"unschedule": true,
+}
+
+// onAdminListener marks the requests it serves as received by the admin
+// listener.
+func onAdminListener(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminListenerKey{}, true)))
+	})
+}
+
+// separateAdmin answers 404 to admin routes requested on the public
+// listener and to the other routes requested on the admin listener.
+func separateAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		admin, _ := r.Context().Value(adminListenerKey{}).(bool)
+
+		if route := currentRoute(r); config.Admin.Listen != "" && route != nil && adminRoutes[route.name] != admin {
+			http.NotFound(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// pprofHandler serves the runtime profiles under /debug/pprof/.
+func pprofHandler(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimPrefix(r.URL.Path, "/debug/pprof/") {
+	case "cmdline":
+		pprof.Cmdline(w, r)
+	case "profile":
+		pprof.Profile(w, r)
+	case "symbol":
+		pprof.Symbol(w, r)
+	case "trace":
+		pprof.Trace(w, r)
+	default:
+		pprof.Index(w, r) // Список профилей и профили по имени
+	}
+}
+
+// goroutinesHandler serves GET /debug/goroutines: the stacks of all
+// goroutines, or with ?debug=1 one stack per group of identical ones and
+// their count, which makes leaks stand out.
+func goroutinesHandler(w http.ResponseWriter, r *http.Request) {
+	debug := 2
+	if r.URL.Query().Get("debug") == "1" {
+		debug = 1
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rpprof.Lookup("goroutine").WriteTo(w, debug)
+}
+
+// publishVars publishes the counters of the server on /debug/vars, along
+// with the command line and memory statistics expvar always reports.
+func publishVars() {
+	expvar.Publish("goroutines", expvar.Func(func() any { return runtime.NumGoroutine() }))
+	expvar.Publish("watchers", expvar.Func(func() any { return broker.Subscribers() }))
+	expvar.Publish("operations", expvar.Func(func() any { return operations.counts() }))
+	expvar.Publish("log_write_failures", expvar.Func(func() any { return logHealth.failures.Load() }))
+	expvar.Publish("uptime_seconds", expvar.Func(func() any { return int64(time.Since(startTime).Seconds()) }))
+	expvar.Publish("log_queue", expvar.Func(func() any {
+		depth, _ := logQueue()
+		return depth // Событий ждёт записи в журнал
+	}))
+	expvar.Publish("log_queue_rejections", expvar.Func(func() any {
+		return logQueueRejections.Load()
+	}))
+}
+
+// reloadConfig resolves the configuration again and applies the settings
+// that can change while the server runs: the log level, the credentials
+// of the authentication providers, the rate limits, the lock leases and
+// the default TTL of keys put over HTTP. All of them are checked before
+// any is applied, and the store is left as it is. The other settings take
+// effect on the next restart. It fails only on an invalid configuration.
+func reloadConfig() error {
+	c, err := LoadConfig(args)
+	if err != nil {
+		return err
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		return fmt.Errorf("invalid log level %q", c.Log.Level)
+	}
+
+	if c.Auth.enabled() != (auth != nil) {
+		return errors.New("authentication cannot be enabled or disabled without a restart")
+	}
+
+	fresh, err := newAuthenticator(c.Auth)
+	if err != nil {
+		return fmt.Errorf("invalid authentication configuration: %w", err)
+	}
+
+	limits, err := newRateLimits(c.RateLimit)
+	if err != nil {
+		return fmt.Errorf("invalid rate limit configuration: %w", err)
+	}
+
+	logLevel.Set(level)
+	if auth != nil {
+		auth.replace(fresh)
+	}
+	limiter.limits.Store(limits)
+	current.Store(c)
+
+	slog.Info("configuration reloaded", "log_level", level.String(), "api_keys", len(c.Auth.APIKeys))
+
+	return nil
+}
+
+// reloadHandler serves POST /v1/reload. It answers 400 with the reason
+// to an invalid configuration, which leaves the running one in place.
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if err := reloadConfig(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// reloadOnSignal reloads the configuration on every SIGHUP.
+func reloadOnSignal() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		if err := reloadConfig(); err != nil {
+			slog.Error("configuration reload failed", "error", err)
+		}
+	}
+}
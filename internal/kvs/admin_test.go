@@ -0,0 +1,41 @@
+package kvs
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReloadConfig(t *testing.T) {
+	defer func(a []string, c *Config, l *RateLimiter) { args, limiter = a, l; current.Store(c) }(args, current.Load(), limiter)
+
+	limiter, _ = newRateLimiter(RateLimitConfig{})
+	current.Store(DefaultConfig())
+
+	args = []string{"-store-default-ttl=-1s"}
+
+	w := httptest.NewRecorder()
+	reloadHandler(w, httptest.NewRequest(http.MethodPost, "/v1/reload", nil))
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("reload of an invalid configuration answered %d, want 400", w.Code)
+	}
+
+	if ttl := current.Load().Store.DefaultTTL; ttl != 0 {
+		t.Fatalf("default ttl is %v after a refused reload, want it unchanged", ttl)
+	}
+
+	args = []string{"-store-default-ttl=1h"}
+
+	w = httptest.NewRecorder()
+	reloadHandler(w, httptest.NewRequest(http.MethodPost, "/v1/reload", nil))
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("reload answered %d (%s), want 204", w.Code, w.Body)
+	}
+
+	if ttl := current.Load().Store.DefaultTTL; ttl != time.Hour {
+		t.Fatalf("default ttl is %v after the reload, want 1h", ttl)
+	}
+}
@@ -0,0 +1,333 @@
+package kvs
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/**
+ * Audit log.
+ *
+ * With an audit file configured, every request that may change data is
+ * recorded once it has been served, as one JSON line appended to the
+ * file: when, by which principal, from which IP address, the operation
+ * and its key, and whether it succeeded. That covers the HTTP requests
+ * that need write permission and the RESP write commands; HTTP requests
+ * refused for lack of permission are recorded as well, unauthenticated
+ * ones are not, as they carry no principal. The file is only appended to. Once it
+ * reaches MaxSize bytes it is renamed to the next numbered file
+ * (audit.000001.log, ...) and a new one started, and beyond MaxFiles the
+ * oldest files are removed.
+ *
+ * GET /v1/audit on the admin listener returns the records as JSON Lines,
+ * oldest first, filtered by ?since= and ?until= (RFC 3339), ?principal=,
+ * ?key= and ?operation=, up to ?limit= of them.
+ */
+const auditQueryLimit = 1000 // Записей в ответе, если limit не задан
+
+var audit *AuditLog
+
+// auditRecord is one line of the audit log.
+type auditRecord struct {
+	Time      time.Time `json:"time"`
+	Principal string    `json:"principal,omitempty"`
+	Remote    string    `json:"remote"` // IP-адрес клиента
+	RequestID string    `json:"request_id,omitempty"`
+	Protocol  string    `json:"protocol"`  // "http" или "resp"
+	Operation string    `json:"operation"` // Имя маршрута или команда RESP
+	Keys      []string  `json:"keys,omitempty"`
+	Prefix    string    `json:"prefix,omitempty"`
+	Status    int       `json:"status,omitempty"` // Код ответа HTTP
+	OK        bool      `json:"ok"`
+}
+
+type AuditLog struct {
+	filename string
+	maxSize  int64
+	maxFiles int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// OpenAuditLog opens the audit log for appending, creating it if needed.
+func OpenAuditLog(c AuditConfig) (*AuditLog, error) {
+	a := &AuditLog{filename: c.File, maxSize: c.MaxSize, maxFiles: c.MaxFiles}
+
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func (a *AuditLog) open() error {
+	file, err := os.OpenFile(a.filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot open audit log: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("cannot open audit log: %w", err)
+	}
+
+	a.file, a.size = file, info.Size()
+
+	return nil
+}
+
+// Record appends rec to the log. A failure is logged, not returned: the
+// request has already been served.
+func (a *AuditLog) Record(rec auditRecord) {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			slog.Error("audit log rotation failed", "error", err)
+		}
+	}
+
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+
+	if err != nil {
+		slog.Error("audit log write failed", "error", err, "operation", rec.Operation)
+	}
+}
+
+// rotate renames the file to the next numbered one and starts a new one,
+// removing the oldest beyond maxFiles; a.mu must be held.
+func (a *AuditLog) rotate() error {
+	segments, last, err := listSegments(a.filename)
+	if err != nil {
+		return err
+	}
+
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(a.filename, segmentName(a.filename, last+1)); err != nil {
+		return err
+	}
+
+	if a.maxFiles > 0 {
+		segments = append(segments, segmentName(a.filename, last+1))
+		for len(segments) > a.maxFiles {
+			if err := os.Remove(segments[0]); err != nil && !os.IsNotExist(err) {
+				slog.Warn("failed to remove old audit log", "file", segments[0], "error", err)
+			}
+			segments = segments[1:]
+		}
+	}
+
+	return a.open()
+}
+
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.file.Close()
+}
+
+// remoteIP returns the IP address of a host:port address.
+func remoteIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	return host
+}
+
+// Middleware records the HTTP requests that need write permission.
+func (a *AuditLog) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requiredPermission(r) < PermReadWrite {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		rec := auditRecord{
+			Time:      time.Now().UTC(),
+			Remote:    remoteIP(r.RemoteAddr),
+			RequestID: RequestIDFrom(r.Context()),
+			Protocol:  "http",
+			Operation: r.Method,
+			Prefix:    r.URL.Query().Get("prefix"),
+			Status:    recorder.status,
+			OK:        recorder.status < http.StatusBadRequest,
+		}
+
+		if p, ok := PrincipalFrom(r.Context()); ok {
+			rec.Principal = p.Name
+		}
+
+		if route := currentRoute(r); route != nil && route.name != "" {
+			rec.Operation = route.name
+		}
+
+		vars := pathVars(r)
+		if key, ok := vars["key"]; ok {
+			rec.Keys = []string{key}
+		} else if name, ok := vars["name"]; ok {
+			rec.Keys = []string{name}
+		}
+
+		a.Record(rec)
+	})
+}
+
+// recordRESP records a RESP write command.
+func (a *AuditLog) recordRESP(c *respConn, name string, keys []string, ok bool) {
+	a.Record(auditRecord{
+		Time:      time.Now().UTC(),
+		Principal: c.principal.Name,
+		Remote:    remoteIP(c.remote),
+		Protocol:  "resp",
+		Operation: name,
+		Keys:      keys,
+		OK:        ok,
+	})
+}
+
+// auditFilter selects the records returned by GET /v1/audit.
+type auditFilter struct {
+	since, until time.Time
+	principal    string
+	key          string
+	operation    string
+}
+
+func (f auditFilter) match(rec auditRecord) bool {
+	if rec.Time.Before(f.since) || (!f.until.IsZero() && !rec.Time.Before(f.until)) {
+		return false
+	}
+
+	if (f.principal != "" && rec.Principal != f.principal) || (f.operation != "" && rec.Operation != f.operation) {
+		return false
+	}
+
+	if f.key == "" {
+		return true
+	}
+
+	for _, key := range rec.Keys {
+		if key == f.key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// auditHandler serves GET /v1/audit?since=&until=&principal=&key=&operation=&limit=.
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if audit == nil {
+		http.Error(w, "Audit log is not enabled", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := auditFilter{principal: query.Get("principal"), key: query.Get("key"), operation: query.Get("operation")}
+
+	for name, t := range map[string]*time.Time{"since": &filter.since, "until": &filter.until} {
+		if raw := query.Get(name); raw != "" {
+			var err error
+			if *t, err = time.Parse(time.RFC3339, raw); err != nil {
+				http.Error(w, "Invalid "+name+": want an RFC 3339 time", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	limit := auditQueryLimit
+	if raw := query.Get("limit"); raw != "" {
+		var err error
+		if limit, err = strconv.Atoi(raw); err != nil || limit < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	segments, _, err := listSegments(audit.filename)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+
+	buffered := bufio.NewWriter(w)
+	defer buffered.Flush()
+
+	for _, filename := range append(segments, audit.filename) {
+		if limit, err = readAuditFile(filename, filter, limit, buffered); err != nil {
+			slog.Warn("audit log read failed", "file", filename, "error", err)
+			return
+		}
+
+		if limit == 0 {
+			return
+		}
+	}
+}
+
+// readAuditFile writes the matching records of one file to w, up to
+// limit of them, and returns how many more may follow.
+func readAuditFile(filename string, filter auditFilter, limit int, w io.Writer) (int, error) {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return limit, nil // Удалён ротацией
+	}
+
+	if err != nil {
+		return limit, err
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+
+	for scanner.Scan() && limit > 0 {
+		var rec auditRecord
+		if json.Unmarshal(scanner.Bytes(), &rec) != nil || !filter.match(rec) {
+			continue // Недописанная строка в конце файла
+		}
+
+		if _, err := fmt.Fprintf(w, "%s\n", scanner.Bytes()); err != nil {
+			return limit, err
+		}
+		limit--
+	}
+
+	return limit, scanner.Err()
+}
@@ -0,0 +1,408 @@
+package kvs
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/**
+ * Authentication.
+ *
+ * Clients present a static API key (in X-API-Key or as a bearer token), a
+ * bearer JWT, or a user name and password with HTTP Basic authentication.
+ * The configured providers are asked in turn: API keys, HS256 JWTs signed
+ * with a shared secret, OIDC tokens from an identity provider, a user file
+ * and an LDAP directory. Safe methods need read permission, everything
+ * else needs write permission, and the endpoints that replace the data or
+ * change how the server runs need admin permission. API keys are kept as
+ * SHA-256 digests and compared in constant time. When no provider is
+ * configured, authentication is disabled.
+ */
+type Permission int
+
+const (
+	PermRead Permission = iota + 1
+	PermReadWrite
+	PermAdmin // Запись и администрирование: restore, reload, compact, read-only
+)
+
+type Principal struct {
+	Name       string
+	Permission Permission
+}
+
+// Credentials are what a client presents: a token, or a user name and a
+// password.
+type Credentials struct {
+	Token    string // Ключ API или токен bearer
+	User     string
+	Password string
+}
+
+// AuthProvider identifies callers by their credentials. It returns
+// ErrorUnauthenticated for credentials it does not recognize, so that the
+// next provider can try them.
+type AuthProvider interface {
+	Authenticate(ctx context.Context, c Credentials) (Principal, error)
+}
+
+type Authenticator struct {
+	providers atomic.Pointer[authProviders] // Заменяются при перезагрузке настроек
+}
+
+type authProviders struct {
+	list      []AuthProvider
+	passwords bool // Есть провайдер паролей: предлагать Basic
+}
+
+var auth *Authenticator
+
+var ErrorUnauthenticated = errors.New("Authentication required")
+
+var ErrorForbidden = errors.New("Permission denied")
+
+type principalKey struct{}
+
+// PrincipalFrom returns the authenticated caller stored in ctx by the
+// auth middleware.
+func PrincipalFrom(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// newAuthenticator builds an Authenticator from the configured providers.
+// It returns nil when none is configured.
+func newAuthenticator(c AuthConfig) (*Authenticator, error) {
+	a := &authProviders{}
+
+	if len(c.APIKeys) > 0 {
+		keys, err := parseAPIKeys(c.APIKeys)
+		if err != nil {
+			return nil, err
+		}
+		a.list = append(a.list, keys)
+	}
+
+	if c.JWTSecret != "" {
+		a.list = append(a.list, hs256Provider([]byte(c.JWTSecret)))
+	}
+
+	if c.OIDC.Issuer != "" {
+		a.list = append(a.list, newOIDCProvider(c.OIDC))
+	}
+
+	if c.UsersFile != "" {
+		users, err := loadUserFile(c.UsersFile)
+		if err != nil {
+			return nil, err
+		}
+		a.list = append(a.list, users)
+		a.passwords = true
+	}
+
+	if c.LDAP.URL != "" {
+		ldap, err := newLDAPProvider(c.LDAP)
+		if err != nil {
+			return nil, err
+		}
+		a.list = append(a.list, ldap)
+		a.passwords = true
+	}
+
+	if len(a.list) == 0 {
+		return nil, nil
+	}
+
+	auth := &Authenticator{}
+	auth.providers.Store(a)
+
+	return auth, nil
+}
+
+// replace switches a to the providers of fresh.
+func (a *Authenticator) replace(fresh *Authenticator) {
+	a.providers.Store(fresh.providers.Load())
+}
+
+// enabled reports whether any authentication provider is configured.
+func (c AuthConfig) enabled() bool {
+	return len(c.APIKeys) > 0 || c.JWTSecret != "" || c.OIDC.Issuer != "" || c.UsersFile != "" || c.LDAP.URL != ""
+}
+
+// apiKeys are the static API keys with their owners.
+type apiKeys []apiKey
+
+type apiKey struct {
+	digest    [sha256.Size]byte // Ключ хранится только как SHA-256
+	principal Principal
+}
+
+// parseAPIKeys parses "name:key:ro|rw|admin" API key entries.
+func parseAPIKeys(entries []string) (apiKeys, error) {
+	keys := make(apiKeys, 0, len(entries))
+
+	for _, entry := range entries {
+		fields := strings.Split(entry, ":")
+		if len(fields) != 3 || fields[0] == "" || fields[1] == "" {
+			return nil, fmt.Errorf("invalid API key entry %q", entry)
+		}
+
+		perm, err := parsePermission(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid API key entry %q: %w", entry, err)
+		}
+
+		keys = append(keys, apiKey{digest: sha256.Sum256([]byte(fields[1])), principal: Principal{Name: fields[0], Permission: perm}})
+	}
+
+	return keys, nil
+}
+
+// Authenticate compares the digest of the token with that of every key,
+// in constant time, so that the time taken tells nothing of the keys.
+func (k apiKeys) Authenticate(ctx context.Context, c Credentials) (Principal, error) {
+	if c.Token == "" {
+		return Principal{}, ErrorUnauthenticated
+	}
+
+	digest := sha256.Sum256([]byte(c.Token))
+
+	var found *Principal
+	for i := range k {
+		if subtle.ConstantTimeCompare(digest[:], k[i].digest[:]) == 1 && found == nil {
+			found = &k[i].principal
+		}
+	}
+
+	if found == nil {
+		return Principal{}, ErrorUnauthenticated
+	}
+
+	return *found, nil
+}
+
+func parsePermission(s string) (Permission, error) {
+	switch s {
+	case "ro":
+		return PermRead, nil
+	case "rw":
+		return PermReadWrite, nil
+	case "admin":
+		return PermAdmin, nil
+	default:
+		return 0, fmt.Errorf("unknown permission %q", s)
+	}
+}
+
+// readEndpoints lists the POST endpoints that only read, taking their
+// arguments in the body.
+var readEndpoints = map[string]bool{
+	"/v1/mget": true,
+}
+
+// adminEndpoints lists the endpoints that need admin permission to
+// change anything: they replace the data or change how the server runs.
+var adminEndpoints = map[string]bool{
+	"/v1/restore":   true,
+	"/v1/read-only": true,
+	"/v1/reload":    true,
+	"/v1/compact":   true,
+}
+
+// requiredPermission maps the request method to the permission it needs.
+func requiredPermission(r *http.Request) Permission {
+	if r.Method == http.MethodPost && readEndpoints[r.URL.Path] {
+		return PermRead
+	}
+
+	safe := r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions
+	if !safe && adminEndpoints[r.URL.Path] {
+		return PermAdmin
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return PermRead
+	default:
+		return PermReadWrite
+	}
+}
+
+// Authenticate identifies the caller of r.
+func (a *Authenticator) Authenticate(r *http.Request) (Principal, error) {
+	if token := r.Header.Get("X-API-Key"); token != "" {
+		return a.authenticate(r.Context(), Credentials{Token: token})
+	}
+
+	if user, password, ok := r.BasicAuth(); ok {
+		return a.authenticate(r.Context(), Credentials{User: user, Password: password})
+	}
+
+	scheme, credentials, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") || credentials == "" {
+		return Principal{}, ErrorUnauthenticated
+	}
+
+	return a.authenticate(r.Context(), Credentials{Token: strings.TrimSpace(credentials)})
+}
+
+// AuthenticateToken identifies the holder of an API key or JWT.
+func (a *Authenticator) AuthenticateToken(ctx context.Context, token string) (Principal, error) {
+	return a.authenticate(ctx, Credentials{Token: token})
+}
+
+// AuthenticatePassword identifies a user by name and password.
+func (a *Authenticator) AuthenticatePassword(ctx context.Context, user, password string) (Principal, error) {
+	return a.authenticate(ctx, Credentials{User: user, Password: password})
+}
+
+// authenticate asks the providers in turn. A provider that fails for
+// another reason than unrecognized credentials is logged and skipped.
+func (a *Authenticator) authenticate(ctx context.Context, c Credentials) (Principal, error) {
+	for _, provider := range a.providers.Load().list {
+		p, err := provider.Authenticate(ctx, c)
+		if err == nil {
+			return p, nil
+		}
+
+		if !errors.Is(err, ErrorUnauthenticated) {
+			slog.Warn("authentication provider failed", "provider", fmt.Sprintf("%T", provider), "error", err)
+		}
+	}
+
+	return Principal{}, ErrorUnauthenticated
+}
+
+type jwtClaims struct {
+	Subject   string `json:"sub"`
+	ExpiresAt int64  `json:"exp"`
+	NotBefore int64  `json:"nbf"`
+	Scope     string `json:"scope"` // "read", "read write" или "admin"
+}
+
+// valid reports whether the token is within its exp and nbf claims.
+func (c jwtClaims) valid(now time.Time) bool {
+	if c.ExpiresAt != 0 && now.Unix() >= c.ExpiresAt {
+		return false
+	}
+
+	return c.NotBefore == 0 || now.Unix() >= c.NotBefore
+}
+
+// scopePermission derives the caller's permission from the scopes granted
+// by a token: the highest of those it names.
+func scopePermission(scopes []string, read, write, admin string) Permission {
+	var perm Permission
+
+	for _, scope := range scopes {
+		switch scope {
+		case admin:
+			perm = PermAdmin
+		case write:
+			perm = max(perm, PermReadWrite)
+		case read:
+			perm = max(perm, PermRead)
+		}
+	}
+
+	return perm
+}
+
+// hs256Provider verifies JWTs signed with a shared HS256 secret.
+type hs256Provider []byte
+
+func (secret hs256Provider) Authenticate(ctx context.Context, c Credentials) (Principal, error) {
+	if strings.Count(c.Token, ".") != 2 {
+		return Principal{}, ErrorUnauthenticated
+	}
+
+	return secret.verify(c.Token, time.Now())
+}
+
+// verify checks an HS256 token signature and its exp/nbf claims and
+// derives the caller's permission from the scope claim.
+func (secret hs256Provider) verify(token string, now time.Time) (Principal, error) {
+	parts := strings.Split(token, ".")
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+
+	if err := decodeJWTPart(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return Principal{}, ErrorUnauthenticated
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Principal{}, ErrorUnauthenticated
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return Principal{}, ErrorUnauthenticated
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return Principal{}, ErrorUnauthenticated
+	}
+
+	if !claims.valid(now) {
+		return Principal{}, ErrorUnauthenticated
+	}
+
+	return Principal{Name: "jwt:" + claims.Subject, Permission: scopePermission(strings.Fields(claims.Scope), "read", "write", "admin")}, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// Middleware rejects unauthenticated requests with 401 and passes the
+// caller on in the request context; requirePermission then checks it.
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := a.Authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="kvs"`)
+			if a.providers.Load().passwords {
+				w.Header().Add("WWW-Authenticate", `Basic realm="kvs", charset="UTF-8"`)
+			}
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	})
+}
+
+// requirePermission rejects with 403 the requests the authenticated
+// caller is not permitted to make.
+func requirePermission(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p, _ := PrincipalFrom(r.Context()); p.Permission < requiredPermission(r) {
+			http.Error(w, ErrorForbidden.Error(), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
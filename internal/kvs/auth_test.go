@@ -0,0 +1,179 @@
+package kvs
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// signHS256 returns a JWT of claims signed with secret.
+func signHS256(t *testing.T, secret string, claims jwtClaims) string {
+	t.Helper()
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestAPIKeys(t *testing.T) {
+	keys, err := parseAPIKeys([]string{"reader:k1:ro", "writer:k2:rw", "root:k3:admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		token string
+		want  Principal
+	}{
+		{"k1", Principal{Name: "reader", Permission: PermRead}},
+		{"k2", Principal{Name: "writer", Permission: PermReadWrite}},
+		{"k3", Principal{Name: "root", Permission: PermAdmin}},
+	}
+
+	for _, tt := range tests {
+		if p, err := keys.Authenticate(context.Background(), Credentials{Token: tt.token}); err != nil || p != tt.want {
+			t.Errorf("key %s authenticates %+v (%v), want %+v", tt.token, p, err, tt.want)
+		}
+	}
+
+	for _, token := range []string{"", "k", "k11", "K1"} {
+		if _, err := keys.Authenticate(context.Background(), Credentials{Token: token}); !errors.Is(err, ErrorUnauthenticated) {
+			t.Errorf("key %q authenticated (%v)", token, err)
+		}
+	}
+
+	if _, err := parseAPIKeys([]string{"root:k:superuser"}); err == nil {
+		t.Error("unknown permission accepted")
+	}
+}
+
+func TestHS256Provider(t *testing.T) {
+	secret := hs256Provider("secret")
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		claims jwtClaims
+		want   Permission
+	}{
+		{"read", jwtClaims{Subject: "a", Scope: "read"}, PermRead},
+		{"write", jwtClaims{Subject: "a", Scope: "read write"}, PermReadWrite},
+		{"admin", jwtClaims{Subject: "a", Scope: "write admin"}, PermAdmin},
+	}
+
+	for _, tt := range tests {
+		p, err := secret.verify(signHS256(t, "secret", tt.claims), now)
+		if err != nil || p.Permission != tt.want || p.Name != "jwt:a" {
+			t.Errorf("%s token authenticates %+v (%v), want permission %d", tt.name, p, err, tt.want)
+		}
+	}
+
+	expired := signHS256(t, "secret", jwtClaims{Subject: "a", Scope: "read", ExpiresAt: now.Add(-time.Minute).Unix()})
+	if _, err := secret.verify(expired, now); !errors.Is(err, ErrorUnauthenticated) {
+		t.Errorf("expired token authenticated (%v)", err)
+	}
+
+	forged := signHS256(t, "other", jwtClaims{Subject: "a", Scope: "admin"})
+	if _, err := secret.verify(forged, now); !errors.Is(err, ErrorUnauthenticated) {
+		t.Errorf("token signed with another secret authenticated (%v)", err)
+	}
+}
+
+func TestUserFile(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("pw"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "users")
+	content := "# users\nreader:" + string(hash) + "\nroot:" + string(hash) + ":admin\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := loadUserFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p, err := users.Authenticate(context.Background(), Credentials{User: "reader", Password: "pw"}); err != nil || p.Permission != PermRead {
+		t.Errorf("reader authenticates %+v (%v), want read permission", p, err)
+	}
+
+	if p, err := users.Authenticate(context.Background(), Credentials{User: "root", Password: "pw"}); err != nil || p.Permission != PermAdmin {
+		t.Errorf("root authenticates %+v (%v), want admin permission", p, err)
+	}
+
+	if _, err := users.Authenticate(context.Background(), Credentials{User: "root", Password: "wrong"}); !errors.Is(err, ErrorUnauthenticated) {
+		t.Errorf("wrong password authenticated (%v)", err)
+	}
+}
+
+func TestAuthenticatorProviders(t *testing.T) {
+	a, err := newAuthenticator(AuthConfig{APIKeys: []string{"writer:key:rw"}, JWTSecret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/v1/key/a", nil)
+	r.Header.Set("X-API-Key", "key")
+
+	if p, err := a.Authenticate(r); err != nil || p.Name != "writer" {
+		t.Errorf("API key authenticates %+v (%v), want writer", p, err)
+	}
+
+	r = httptest.NewRequest("GET", "/v1/key/a", nil)
+	r.Header.Set("Authorization", "Bearer "+signHS256(t, "secret", jwtClaims{Subject: "b", Scope: "read"}))
+
+	if p, err := a.Authenticate(r); err != nil || p.Name != "jwt:b" {
+		t.Errorf("JWT authenticates %+v (%v), want jwt:b", p, err)
+	}
+
+	r = httptest.NewRequest("GET", "/v1/key/a", nil)
+	r.Header.Set("Authorization", "Bearer unknown")
+
+	if _, err := a.Authenticate(r); !errors.Is(err, ErrorUnauthenticated) {
+		t.Errorf("unknown token authenticated (%v)", err)
+	}
+}
+
+func TestRequiredPermission(t *testing.T) {
+	tests := []struct {
+		method string
+		target string
+		want   Permission
+	}{
+		{"GET", "/v1/key/a", PermRead},
+		{"POST", "/v1/mget", PermRead},
+		{"PUT", "/v1/key/a", PermReadWrite},
+		{"GET", "/v1/read-only", PermRead},
+		{"PUT", "/v1/read-only", PermAdmin},
+		{"POST", "/v1/restore", PermAdmin},
+		{"POST", "/v1/reload", PermAdmin},
+		{"POST", "/v1/compact", PermAdmin},
+	}
+
+	for _, tt := range tests {
+		if got := requiredPermission(httptest.NewRequest(tt.method, tt.target, nil)); got != tt.want {
+			t.Errorf("%s %s needs permission %d, want %d", tt.method, tt.target, got, tt.want)
+		}
+	}
+}
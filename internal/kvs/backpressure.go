@@ -0,0 +1,120 @@
+package kvs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+/**
+ * Transaction log backpressure.
+ *
+ * The loggers queue the events they are given for the goroutine writing
+ * them, in a channel of transaction_log.queue.size events (for the file
+ * log at least a batch). The writes of the protocol front ends take one of
+ * as many slots before they change anything and give it back once they
+ * have queued their events, so no more of them wait on the queue at once
+ * than it holds. A write that finds every slot taken, the log falling
+ * behind a slow disk or database, is handled by the queue policy: "block"
+ * waits for a slot, for at most queue.timeout if it is set, and "reject"
+ * fails at once. A write that gets no slot is refused with 503 and
+ * Retry-After rather than holding its handler. /v1/stats and /debug/vars
+ * report the depth of the queue and the writes refused.
+ */
+type QueuePolicy struct {
+	Size    int           `yaml:"size"`    // Событий в канале логгера
+	Policy  string        `yaml:"policy"`  // "block" или "reject"
+	Timeout time.Duration `yaml:"timeout"` // Только для block; 0 ждёт без ограничения
+}
+
+func (p QueuePolicy) Validate() error {
+	if p.Size < 1 || p.Timeout < 0 {
+		return fmt.Errorf("queue size must be at least 1 and timeout must not be negative")
+	}
+
+	if p.Policy != "block" && p.Policy != "reject" {
+		return fmt.Errorf(`queue policy must be "block" or "reject"`)
+	}
+
+	return nil
+}
+
+var ErrorLogBackpressure = errors.New("Transaction log is falling behind, try again later")
+
+var logQueueRejections atomic.Uint64 // Записей отклонено из-за полной очереди с запуска
+
+// LogQueue is implemented by transaction loggers that queue their events.
+type LogQueue interface {
+	Queue() (depth, capacity int)
+}
+
+// logQueue returns the depth and capacity of the queue of the logger, or
+// zeros if it has none.
+func logQueue() (depth, capacity int) {
+	if q, ok := unwrapLogger(logger).(LogQueue); ok {
+		return q.Queue()
+	}
+
+	return 0, 0
+}
+
+// writeSlots are the slots of the writes admitted to the queue of the
+// logger; nil, before the log is started, admits every write.
+var writeSlots chan struct{}
+
+// admitWrite takes a slot for a write, waiting for one as the queue policy
+// allows, and fails with ErrorLogBackpressure if it gets none. The write
+// gives the slot back with release once it has queued its events.
+func admitWrite(ctx context.Context) (release func(), err error) {
+	slots := writeSlots
+	if slots == nil {
+		return func() {}, nil
+	}
+
+	release = func() { <-slots }
+
+	select {
+	case slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	c := config.TransactionLog.Queue
+
+	if c.Policy == "block" {
+		defer timePhase(ctx, "log_queue")()
+
+		var timeout <-chan time.Time
+		if c.Timeout > 0 {
+			timer := time.NewTimer(c.Timeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case slots <- struct{}{}:
+			return release, nil
+		case <-timeout:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	logQueueRejections.Add(1)
+
+	return nil, ErrorLogBackpressure
+}
+
+func (l *FileTransactionLogger) Queue() (int, int) {
+	return len(l.events), cap(l.events)
+}
+
+func (l *PostgresTransactionLogger) Queue() (int, int) {
+	return len(l.events), cap(l.events)
+}
+
+func (l *S3TransactionLogger) Queue() (int, int) {
+	return len(l.events), cap(l.events)
+}
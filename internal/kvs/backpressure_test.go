@@ -0,0 +1,30 @@
+package kvs
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestAdmitWrite(t *testing.T) {
+	defer func(s chan struct{}, c *Config) { writeSlots, config = s, c }(writeSlots, config)
+
+	config = DefaultConfig()
+	config.TransactionLog.Queue.Policy = "reject"
+	writeSlots = make(chan struct{}, 1)
+
+	release, err := admitWrite(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := admitWrite(context.Background()); !errors.Is(err, ErrorLogBackpressure) {
+		t.Fatalf("second write admitted with every slot taken (%v)", err)
+	}
+
+	release()
+
+	if _, err := admitWrite(context.Background()); err != nil {
+		t.Fatalf("write refused after the slot was given back: %v", err)
+	}
+}
@@ -0,0 +1,203 @@
+//go:build badger
+
+package kvs
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/dgraph-io/badger/v4/options"
+)
+
+/**
+ * Badger database.
+ *
+ * A log-structured database in a directory, or in memory only: values
+ * longer than the value threshold go to the value log, apart from the
+ * keys, which keeps the LSM tree small under heavy writes. The buckets are
+ * key prefixes. Transactions that conflict with a concurrent one are
+ * retried, and the value log is garbage-collected periodically. Built only
+ * with the badger tag: go build -tags badger.
+ */
+type badgerDB struct {
+	db *badger.DB
+
+	stop chan struct{} // Закрывается при закрытии базы
+	wg   sync.WaitGroup
+}
+
+type badgerTx struct {
+	txn *badger.Txn
+}
+
+var badgerCompression = map[string]options.CompressionType{
+	"none":   options.None,
+	"snappy": options.Snappy,
+	"zstd":   options.ZSTD,
+}
+
+// OpenBadgerStore opens or creates the Badger database in the directory
+// path, or in memory, and returns the store on it.
+func OpenBadgerStore(path string, c BadgerConfig, compressAbove, historyDepth int, checksums bool) (*KVStore, error) {
+	if c.InMemory {
+		path = ""
+	}
+
+	opts := badger.DefaultOptions(path).
+		WithInMemory(c.InMemory).
+		WithSyncWrites(!c.InMemory).
+		WithCompression(badgerCompression[c.Compression]).
+		WithValueThreshold(c.ValueThreshold).
+		WithLogger(nil)
+
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store %s: %w", path, err)
+	}
+
+	d := &badgerDB{db: db, stop: make(chan struct{})}
+
+	s, err := NewKVStore(d, compressAbove, historyDepth, checksums)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open store %s: %w", path, err)
+	}
+
+	if c.GCInterval > 0 && !c.InMemory {
+		d.wg.Add(1)
+		go d.collectGarbage(c.GCInterval, c.GCDiscardRatio)
+	}
+
+	return s, nil
+}
+
+// collectGarbage rewrites the value log files with at least discardRatio
+// of stale values every interval, until the database is closed.
+func (d *badgerDB) collectGarbage(interval time.Duration, discardRatio float64) {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+		}
+
+		var err error
+		for err == nil { // Файл за вызов, пока есть что переписать
+			err = d.db.RunValueLogGC(discardRatio)
+		}
+
+		if !errors.Is(err, badger.ErrNoRewrite) && !errors.Is(err, badger.ErrRejected) {
+			slog.Error("value log garbage collection failed", "error", err)
+		}
+	}
+}
+
+func (d *badgerDB) View(fn func(tx kvTx) error) error {
+	return d.db.View(func(txn *badger.Txn) error { return fn(badgerTx{txn}) })
+}
+
+func (d *badgerDB) Update(fn func(tx kvTx) error) error {
+	for {
+		err := d.db.Update(func(txn *badger.Txn) error { return fn(badgerTx{txn}) })
+		if !errors.Is(err, badger.ErrConflict) {
+			return err
+		}
+	}
+}
+
+func (d *badgerDB) Close() error {
+	close(d.stop)
+	d.wg.Wait()
+
+	return d.db.Close()
+}
+
+// badgerKey prefixes key with its bucket.
+func badgerKey(bucket, key []byte) []byte {
+	k := make([]byte, 0, len(bucket)+1+len(key))
+	k = append(append(k, bucket...), 0)
+
+	return append(k, key...)
+}
+
+func (t badgerTx) Get(bucket, key []byte) ([]byte, error) {
+	item, err := t.txn.Get(badgerKey(bucket, key))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return item.ValueCopy(nil)
+}
+
+func (t badgerTx) Put(bucket, key, value []byte) error {
+	return t.txn.Set(badgerKey(bucket, key), value)
+}
+
+func (t badgerTx) Delete(bucket, key []byte) error {
+	return t.txn.Delete(badgerKey(bucket, key))
+}
+
+// Clear deletes the keys of the bucket one by one: a bucket too large for
+// one transaction fails with badger.ErrTxnTooBig.
+func (t badgerTx) Clear(bucket []byte) error {
+	var keys [][]byte
+
+	err := t.Scan(bucket, nil, nil, func(k, v []byte) error {
+		keys = append(keys, append([]byte(nil), k...))
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		if err := t.Delete(bucket, k); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t badgerTx) Scan(bucket, prefix, from []byte, fn func(k, v []byte) error) error {
+	if from == nil {
+		from = prefix
+	}
+
+	it := t.txn.NewIterator(badger.IteratorOptions{Prefix: badgerKey(bucket, nil)})
+	defer it.Close()
+
+	full := badgerKey(bucket, prefix)
+	skip := len(bucket) + 1
+
+	for it.Seek(badgerKey(bucket, from)); it.ValidForPrefix(full); it.Next() {
+		item := it.Item()
+
+		v, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(item.Key()[skip:], v); errors.Is(err, errStopScan) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
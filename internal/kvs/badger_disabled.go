@@ -0,0 +1,11 @@
+//go:build !badger
+
+package kvs
+
+import "errors"
+
+// OpenBadgerStore fails in builds without the badger tag, which leave the
+// Badger module out.
+func OpenBadgerStore(path string, c BadgerConfig, compressAbove, historyDepth int, checksums bool) (Store, error) {
+	return nil, errors.New("the badger store backend is not built in; build with -tags badger")
+}
@@ -0,0 +1,212 @@
+package kvs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+/**
+ * Batch operations.
+ */
+
+const (
+	BatchGet    = "get"
+	BatchPut    = "put"
+	BatchDelete = "delete"
+)
+
+type BatchOp struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+
+	contentType string    // Тип значения записи; задаётся только загрузкой по gRPC
+	deadline    time.Time // Срок действия записи; нулевой - без срока
+}
+
+// BatchResult reports the outcome of one BatchOp. OK is false for a get or
+// delete of a missing key.
+type BatchResult struct {
+	Op       string `json:"op"`
+	Key      string `json:"key"`
+	OK       bool   `json:"ok"`
+	Value    string `json:"value,omitempty"`
+	Revision uint64 `json:"revision,omitempty"`
+}
+
+func validateBatch(ops []BatchOp) error {
+	if len(ops) == 0 || len(ops) > config.Limits.BatchMaxOps {
+		return fmt.Errorf("batch must contain 1 to %d operations", config.Limits.BatchMaxOps)
+	}
+
+	return validateOps(ops)
+}
+
+// batchKeys returns the keys ops act on.
+func batchKeys(ops []BatchOp) []string {
+	keys := make([]string, len(ops))
+	for i, op := range ops {
+		keys[i] = op.Key
+	}
+
+	return keys
+}
+
+// validateOps normalizes the keys of the operations and checks the op, key
+// and value of every one.
+func validateOps(ops []BatchOp) error {
+	for i, op := range ops {
+		switch op.Op {
+		case BatchGet, BatchPut, BatchDelete:
+		default:
+			return fmt.Errorf("operation %d: unknown op %q", i, op.Op)
+		}
+
+		ops[i].Key = normalizeKey(op.Key)
+
+		if op.Op == BatchPut {
+			if err := validateKey(ops[i].Key); err != nil {
+				return fmt.Errorf("operation %d: %w", i, err)
+			}
+		} else if len(ops[i].Key) > config.Limits.MaxKeyBytes {
+			return fmt.Errorf("operation %d: %w", i, ErrorKeyTooLong)
+		}
+
+		if int64(len(op.Value)) > config.Limits.MaxValueBytes {
+			return fmt.Errorf("operation %d: %w", i, ErrorValueTooLarge)
+		}
+	}
+
+	return nil
+}
+
+// batchHandler serves POST /v1/batch. The body is a JSON array of
+// operations, applied atomically and in order; the response is a JSON
+// array with one result per operation.
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	var ops []BatchOp
+
+	durable, err := syncWrite(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tooLarge := limitBody(w, r, config.Limits.MaxBodyBytes)
+	defer r.Body.Close()
+
+	if err = json.NewDecoder(r.Body).Decode(&ops); err != nil {
+		if tooLarge() {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		http.Error(w, "Invalid batch: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err = validateBatch(ops); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrorKeyTooLong) || errors.Is(err, ErrorValueTooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	if misdirected(w, batchKeys(ops)...) {
+		return
+	}
+
+	results, err := store.Batch(loggedOps(r.Context()), ops)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	if recordTxn(ops, results) && durable {
+		if err := logger.Sync(r.Context()); err != nil {
+			serverError(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+type mgetRequest struct {
+	Keys []string `json:"keys"`
+}
+
+// mgetResponse maps the keys found to their values and lists the rest.
+type mgetResponse struct {
+	Values  map[string]string `json:"values"`
+	Missing []string          `json:"missing"`
+}
+
+// mgetHandler serves POST /v1/mget. The keys are read together, as one
+// batch of gets, so the response reflects a single point in time. The
+// request only reads, so it needs no write permission.
+func mgetHandler(w http.ResponseWriter, r *http.Request) {
+	var req mgetRequest
+
+	tooLarge := limitBody(w, r, config.Limits.MaxBodyBytes)
+	defer r.Body.Close()
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if tooLarge() {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var ops []BatchOp
+
+	seen := make(map[string]bool, len(req.Keys))
+	for _, key := range req.Keys {
+		if !seen[key] { // Повторы читаются один раз
+			seen[key] = true
+			ops = append(ops, BatchOp{Op: BatchGet, Key: key})
+		}
+	}
+
+	if err := validateBatch(ops); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrorKeyTooLong) {
+			status = http.StatusRequestEntityTooLarge
+		}
+
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	if misdirected(w, batchKeys(ops)...) {
+		return
+	}
+
+	results, err := store.Batch(r.Context(), ops)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	resp := mgetResponse{Values: make(map[string]string), Missing: []string{}}
+	for _, result := range results {
+		if result.OK {
+			resp.Values[result.Key] = result.Value
+		} else {
+			resp.Missing = append(resp.Missing, result.Key)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
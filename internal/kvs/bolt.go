@@ -0,0 +1,107 @@
+//go:build bbolt
+
+package kvs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+/**
+ * bbolt database.
+ *
+ * A single file with a bucket per kvBuckets entry; every update commits
+ * with an fsync. Built only with the bbolt tag: go build -tags bbolt.
+ */
+type boltDB struct {
+	db *bolt.DB
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+// OpenBoltStore opens or creates the bbolt database at path and returns
+// the store on it.
+func OpenBoltStore(path string, compressAbove, historyDepth int, checksums bool) (*KVStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second}) // Файл занят другим процессом
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range kvBuckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	var s *KVStore
+	if err == nil {
+		s, err = NewKVStore(boltDB{db}, compressAbove, historyDepth, checksums)
+	}
+
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open store %s: %w", path, err)
+	}
+
+	return s, nil
+}
+
+func (d boltDB) View(fn func(tx kvTx) error) error {
+	return d.db.View(func(tx *bolt.Tx) error { return fn(boltTx{tx}) })
+}
+
+func (d boltDB) Update(fn func(tx kvTx) error) error {
+	return d.db.Update(func(tx *bolt.Tx) error { return fn(boltTx{tx}) })
+}
+
+func (d boltDB) Close() error {
+	return d.db.Close()
+}
+
+func (t boltTx) Get(bucket, key []byte) ([]byte, error) {
+	return t.tx.Bucket(bucket).Get(key), nil
+}
+
+func (t boltTx) Put(bucket, key, value []byte) error {
+	return t.tx.Bucket(bucket).Put(key, value)
+}
+
+func (t boltTx) Delete(bucket, key []byte) error {
+	return t.tx.Bucket(bucket).Delete(key)
+}
+
+func (t boltTx) Clear(bucket []byte) error {
+	if err := t.tx.DeleteBucket(bucket); err != nil {
+		return err
+	}
+
+	_, err := t.tx.CreateBucketIfNotExists(bucket)
+
+	return err
+}
+
+func (t boltTx) Scan(bucket, prefix, from []byte, fn func(k, v []byte) error) error {
+	if from == nil {
+		from = prefix
+	}
+
+	c := t.tx.Bucket(bucket).Cursor()
+	for k, v := c.Seek(from); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if err := fn(k, v); errors.Is(err, errStopScan) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !bbolt
+
+package kvs
+
+import "errors"
+
+// OpenBoltStore fails in builds without the bbolt tag, which leave the
+// bbolt module out.
+func OpenBoltStore(path string, compressAbove, historyDepth int, checksums bool) (Store, error) {
+	return nil, errors.New("the bbolt store backend is not built in; build with -tags bbolt")
+}
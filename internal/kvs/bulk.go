@@ -0,0 +1,443 @@
+package kvs
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+/**
+ * Bulk import and export.
+ *
+ * GET /v1/export streams the live keys, optionally under a prefix, and
+ * POST /v1/import loads keys from the request body, either merged into
+ * the store as ordinary PUTs or replacing its whole contents. Both speak
+ * JSON Lines, one bulkRecord per line, or CSV with a header row naming
+ * the key, value, ttl, content_type and encoding columns; only key and
+ * value are required. Unlike snapshots, records carry no revisions and
+ * expirations are relative, so files can be produced by other systems,
+ * e.g. from a Redis dump. Values that are not valid UTF-8 are exported
+ * base64-encoded with encoding "base64".
+ *
+ * Exports also carry the created_at and updated_at metadata of the keys,
+ * for reference; imports ignore them, since an imported key is
+ * written anew.
+ */
+const importProgressEvery = 10000 // Записей между сообщениями о ходе импорта
+
+var ErrorUnsupportedFormat = errors.New(`Unsupported format; use "jsonl" or "csv"`)
+
+var csvColumns = []string{"key", "value", "ttl", "content_type", "encoding", "created_at", "updated_at"}
+
+type bulkRecord struct {
+	Key         string `json:"key"`
+	Value       string `json:"value"`
+	TTL         int64  `json:"ttl,omitempty"` // Секунды до истечения; 0 без срока
+	ContentType string `json:"content_type,omitempty"`
+	Encoding    string `json:"encoding,omitempty"` // "base64", если значение не UTF-8
+
+	Created *time.Time `json:"created_at,omitempty"` // Только при экспорте
+	Updated *time.Time `json:"updated_at,omitempty"`
+}
+
+// bulkFormat returns the format named by the format query parameter.
+func bulkFormat(r *http.Request) (string, error) {
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "jsonl":
+		return "jsonl", nil
+	case "csv":
+		return format, nil
+	default:
+		return "", ErrorUnsupportedFormat
+	}
+}
+
+// newBulkRecord builds the record of a live entry.
+func newBulkRecord(e Entry) bulkRecord {
+	record := bulkRecord{
+		Key:         e.Key,
+		Value:       e.Value,
+		ContentType: e.ContentType,
+		Created:     optionalTime(e.Created),
+		Updated:     optionalTime(e.Modified),
+	}
+
+	if !utf8.ValidString(record.Value) {
+		record.Value, record.Encoding = base64.StdEncoding.EncodeToString([]byte(e.Value)), "base64"
+	}
+
+	if !e.Expires.IsZero() {
+		record.TTL = ttlSeconds(time.Until(e.Expires))
+	}
+
+	return record
+}
+
+// decode validates the record and returns its value, content type and
+// time to live.
+func (b bulkRecord) decode() (value, contentType string, ttl time.Duration, err error) {
+	switch {
+	case b.Key == "":
+		return "", "", 0, fmt.Errorf("missing key")
+	case b.TTL < 0:
+		return "", "", 0, fmt.Errorf("negative ttl")
+	}
+
+	if err := validateKey(b.Key); err != nil {
+		return "", "", 0, err
+	}
+
+	switch b.Encoding {
+	case "":
+		value = b.Value
+	case "base64":
+		data, err := base64.StdEncoding.DecodeString(b.Value)
+		if err != nil {
+			return "", "", 0, fmt.Errorf("invalid base64 value: %w", err)
+		}
+		value = string(data)
+	default:
+		return "", "", 0, fmt.Errorf("unknown encoding %q", b.Encoding)
+	}
+
+	if int64(len(value)) > config.Limits.MaxValueBytes {
+		return "", "", 0, ErrorValueTooLarge
+	}
+
+	if contentType, err = parseContentType(b.ContentType); err != nil {
+		return "", "", 0, err
+	}
+
+	return value, contentType, time.Duration(b.TTL) * time.Second, nil
+}
+
+// bulkReader returns a function reading the next record of r in format,
+// or io.EOF after the last one.
+func bulkReader(r io.Reader, format string) (func() (bulkRecord, error), error) {
+	if format == "jsonl" {
+		decoder := json.NewDecoder(r)
+
+		return func() (record bulkRecord, err error) {
+			err = decoder.Decode(&record)
+			return record, err
+		}, nil
+	}
+
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1 // Проверяется ниже
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV header: %w", err)
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	for _, name := range csvColumns[:2] {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("invalid CSV header: no %s column", name)
+		}
+	}
+
+	return func() (record bulkRecord, err error) {
+		fields, err := reader.Read()
+		if err != nil {
+			return record, err
+		}
+
+		if len(fields) != len(header) {
+			return record, fmt.Errorf("expected %d fields, got %d", len(header), len(fields))
+		}
+
+		field := func(name string) string {
+			if i, ok := columns[name]; ok {
+				return fields[i]
+			}
+			return ""
+		}
+
+		record = bulkRecord{Key: field("key"), Value: field("value"), ContentType: field("content_type"), Encoding: field("encoding")}
+
+		if ttl := field("ttl"); ttl != "" {
+			if record.TTL, err = strconv.ParseInt(ttl, 10, 64); err != nil {
+				return record, fmt.Errorf("invalid ttl %q", ttl)
+			}
+		}
+
+		return record, nil
+	}, nil
+}
+
+// csvTime formats an optional time of an exported record.
+func csvTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+
+	return t.Format(time.RFC3339Nano)
+}
+
+// exportHandler serves GET /v1/export?format=&prefix=, streaming the live
+// keys in key order.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	format, err := bulkFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entries, err := store.Snapshot(r.Context())
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	prefix := r.URL.Query().Get("prefix")
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="kvs-export.`+format+`"`)
+
+	buffered := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buffered)
+	writer := csv.NewWriter(buffered)
+
+	if format == "csv" {
+		writer.Write(csvColumns)
+	}
+
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Key, prefix) {
+			continue
+		}
+
+		record := newBulkRecord(e)
+
+		if format == "csv" {
+			ttl := ""
+			if record.TTL > 0 {
+				ttl = strconv.FormatInt(record.TTL, 10)
+			}
+			err = writer.Write([]string{record.Key, record.Value, ttl, record.ContentType, record.Encoding,
+				csvTime(record.Created), csvTime(record.Updated)})
+		} else {
+			err = encoder.Encode(record)
+		}
+
+		if err != nil {
+			return // Клиент отключился
+		}
+	}
+
+	writer.Flush()
+	buffered.Flush()
+}
+
+// importHandler serves POST /v1/import?format=&mode=. In the default
+// "merge" mode every record is applied as a PUT as soon as it is read, so
+// the records before an invalid one stay imported; in "replace" mode the
+// whole body is read first and then replaces the contents of the store,
+// as a restore does.
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	durable, err := syncWrite(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	format, err := bulkFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = "merge"
+	}
+
+	if mode != "merge" && mode != "replace" {
+		http.Error(w, `Invalid mode; use "merge" or "replace"`, http.StatusBadRequest)
+		return
+	}
+
+	tooLarge := limitBody(w, r, config.Limits.MaxBodyBytes)
+	defer r.Body.Close()
+
+	body, err := decodeContent(r.Body, r.Header.Get("Content-Encoding"))
+	if errors.Is(err, ErrorUnsupportedEncoding) {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	next, err := bulkReader(body, format)
+	if err != nil && tooLarge() {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var entries []Entry // Только в режиме replace
+	imported := 0
+	now := time.Now()
+
+	for {
+		record, err := next()
+		if err == io.EOF {
+			break
+		}
+
+		var value, contentType string
+		var ttl time.Duration
+		if err == nil {
+			record.Key = normalizeKey(record.Key)
+			value, contentType, ttl, err = record.decode()
+		}
+
+		if err != nil && tooLarge() {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid record %d: %v", imported+1, err), http.StatusBadRequest)
+			return
+		}
+
+		if misdirected(w, record.Key) {
+			return
+		}
+
+		if mode == "merge" {
+			deadline := expiry(ttl)
+			ctx := loggedPut(r.Context(), record.Key, value, contentType, deadline)
+
+			if _, err := store.Put(ctx, record.Key, value); err != nil {
+				serverError(w, err)
+				return
+			}
+
+			recordPut(ctx, record.Key, value, contentType, deadline)
+		} else {
+			entry := Entry{Key: record.Key, Value: value, Revision: 1, ContentType: contentType}
+			if ttl > 0 {
+				entry.Expires = now.Add(ttl)
+			}
+			entries = append(entries, entry)
+		}
+
+		if imported++; imported%importProgressEvery == 0 {
+			slog.Info("import progress", "mode", mode, "records", imported)
+		}
+	}
+
+	var removed []string
+	if mode == "replace" {
+		if removed, err = store.ReplaceAll(loggedReplace(r.Context()), entries); err != nil {
+			serverError(w, err)
+			return
+		}
+
+		recordReplaceAll(removed, entries)
+	}
+
+	if durable {
+		if err := logger.Sync(r.Context()); err != nil {
+			serverError(w, err)
+			return
+		}
+	}
+
+	slog.Info("import finished", "mode", mode, "records", imported, "removed", len(removed))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"imported": imported, "removed": len(removed)})
+}
+
+/**
+ * Bulk delete.
+ *
+ * DELETE /v1/keys?prefix= removes every key starting with a non-empty
+ * prefix and DELETE /v1/keys?pattern= every key matching a glob pattern,
+ * at once: no reader sees some of them gone and others not, and the
+ * deletes are logged as one transaction so that replay applies all or
+ * none of them. Like the deletes of batches they are final, even with
+ * soft delete enabled. In cluster mode only the keys of the node the
+ * request is sent to are removed.
+ */
+func keysDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+
+	durable, err := syncWrite(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	match := func(k string) bool { return strings.HasPrefix(k, prefix) }
+
+	if pattern, ok := query["pattern"]; ok {
+		if prefix != "" || len(pattern) != 1 {
+			http.Error(w, "Give either one pattern or a prefix", http.StatusBadRequest)
+			return
+		}
+
+		prefix := globPrefix(pattern[0])
+		match = func(k string) bool { return strings.HasPrefix(k, prefix) && matchGlob(pattern[0], k) }
+	} else if prefix == "" {
+		http.Error(w, "Missing prefix", http.StatusBadRequest) // Пустой префикс удалил бы всё
+		return
+	}
+
+	removed, err := store.DeleteMatching(loggedOps(r.Context()), match)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	if len(removed) > 0 {
+		for _, key := range removed {
+			broker.Publish(ChangeEvent{Type: "delete", Key: key})
+		}
+
+		if durable {
+			if err := logger.Sync(r.Context()); err != nil {
+				serverError(w, err)
+				return
+			}
+		}
+	}
+
+	slog.Info("keys deleted", "prefix", prefix, "pattern", query.Get("pattern"), "removed", len(removed))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"deleted": len(removed)})
+}
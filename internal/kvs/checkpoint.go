@@ -0,0 +1,248 @@
+package kvs
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/**
+ * File Transaction log snapshots.
+ *
+ * With Interval or Events set, the state is snapshotted in the background:
+ * the logger closes the active file as a segment, the store is written
+ * with writeSnapshot to a temporary file that is fsynced and renamed over
+ * the snapshot file, and the segments up to the one just closed, whose
+ * events the snapshot holds, are deleted. On startup the snapshot is
+ * loaded into the store and only the events logged after its sequence are
+ * replayed, so recovery reads the live data once instead of the whole
+ * history of the log.
+ *
+ * The log then continues the snapshot: compaction keeps the deletes of
+ * keys it may hold, and sequence numbers go on from its sequence even
+ * when no event was logged after it. The pending scheduled operations are
+ * logged again after the checkpoint, since their events go with the
+ * segments. Tombstones and the history of keys are not part of a snapshot
+ * and do not survive a restart that loads one.
+ */
+const snapshotPoll = time.Second // Как часто проверяется число событий после снимка
+
+// SnapshotPolicy decides when the file logger's state is snapshotted. A
+// zero field disables the corresponding trigger.
+type SnapshotPolicy struct {
+	File     string        `yaml:"file"`     // Пустой: рядом с файлом журнала, с расширением .snapshot
+	Interval time.Duration `yaml:"interval"` // Периодичность снимков
+	Events   uint64        `yaml:"events"`   // Число событий с последнего снимка
+}
+
+func (p SnapshotPolicy) enabled() bool {
+	return p.Interval > 0 || p.Events > 0
+}
+
+// snapshotPath returns the file the snapshots of the log are kept in.
+func snapshotPath(c TransactionLogConfig) string {
+	if c.Snapshot.File != "" {
+		return c.Snapshot.File
+	}
+
+	return strings.TrimSuffix(c.File, filepath.Ext(c.File)) + ".snapshot"
+}
+
+// checkpoint is the position of the log at which a snapshot is taken.
+type checkpoint struct {
+	sequence uint64 // Последнее событие до нового сегмента
+	segment  int    // Последний сегмент с событиями до sequence
+	err      error
+}
+
+// Checkpoint closes the active file as a segment, so that the events up
+// to the returned sequence are all in the segments up to the returned one.
+func (l *FileTransactionLogger) Checkpoint() (uint64, int, error) {
+	reply := make(chan checkpoint, 1)
+
+	select {
+	case l.checkpoints <- reply:
+	case <-l.stopped:
+		return 0, 0, ErrorLoggerStopped
+	}
+
+	c := <-reply
+	return c.sequence, c.segment, c.err
+}
+
+// checkpoint is run by the logger goroutine between event writes.
+func (l *FileTransactionLogger) checkpoint() checkpoint {
+	if _, err := l.closeSegment(); err != nil {
+		return checkpoint{err: err}
+	}
+
+	return checkpoint{sequence: atomic.LoadUint64(&l.lastSequence), segment: l.segment}
+}
+
+// resume makes the sequence numbers go on from the snapshot once the log
+// has been read, even if it holds no event after it.
+func (l *FileTransactionLogger) resume() {
+	if floor := l.floor.Load(); atomic.LoadUint64(&l.lastSequence) < floor {
+		atomic.StoreUint64(&l.lastSequence, floor)
+	}
+}
+
+// loadLogSnapshot loads the snapshot of l at filename, if there is one,
+// into s and returns its sequence.
+func loadLogSnapshot(l *FileTransactionLogger, s Store, filename string) (uint64, error) {
+	file, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer file.Close()
+
+	started := time.Now()
+
+	header, entries, err := readSnapshot(bufio.NewReader(file), l.sealer)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	if _, err := s.ReplaceAll(context.Background(), entries); err != nil {
+		return 0, err
+	}
+
+	l.floor.Store(header.Sequence)
+
+	slog.Info("snapshot loaded",
+		"file", filename, "sequence", header.Sequence, "keys", len(entries), "created", header.Created, "duration", time.Since(started).String())
+
+	return header.Sequence, nil
+}
+
+// runSnapshots snapshots s, the state of the file logger l, as p
+// requires, until ctx is done. relog, if not nil, logs again the pending
+// scheduled operations after each checkpoint and returns how many.
+func runSnapshots(ctx context.Context, l *FileTransactionLogger, s Store, p SnapshotPolicy, filename string, relog func() int) {
+	var schedule <-chan time.Time
+	if p.Interval > 0 {
+		ticker := time.NewTicker(p.Interval)
+		defer ticker.Stop()
+		schedule = ticker.C
+	}
+
+	var poll <-chan time.Time
+	if p.Events > 0 {
+		ticker := time.NewTicker(snapshotPoll)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+
+	base := l.floor.Load() // Последнее событие, учтённое снимком
+
+	for {
+		select {
+		case <-schedule:
+		case <-poll:
+			if l.LastSequence()-base < p.Events {
+				continue
+			}
+		case <-ctx.Done():
+			return
+		}
+
+		if l.LastSequence() == base {
+			continue // Нет событий после снимка
+		}
+
+		relogged, err := takeLogSnapshot(ctx, l, s, filename, relog)
+		if err != nil {
+			slog.Error("snapshot failed", "file", filename, "error", err)
+			continue
+		}
+
+		base = l.floor.Load() + uint64(relogged) // Повторно записанные операции не требуют нового снимка
+	}
+}
+
+// takeLogSnapshot writes a snapshot of s to filename and deletes the
+// segments of the log l it makes redundant. It returns how many pending
+// scheduled operations relog logged again after the snapshot.
+func takeLogSnapshot(ctx context.Context, l *FileTransactionLogger, s Store, filename string, relog func() int) (int, error) {
+	started := time.Now()
+
+	sequence, segment, err := l.Checkpoint()
+	if err != nil {
+		return 0, err
+	}
+
+	relogged := 0
+	if relog != nil {
+		relogged = relog() // После контрольной точки: переживают удаление сегментов
+	}
+
+	// Хранилище уже содержит все события до sequence: они записываются в
+	// журнал после применения.
+	entries, err := s.Snapshot(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := writeSnapshotFile(filename, sequence, entries, l.sealer); err != nil {
+		return 0, err
+	}
+
+	l.floor.Store(sequence)
+
+	removed := 0
+	for n := 1; n <= segment; n++ {
+		err := os.Remove(segmentName(l.filename, n))
+		if err == nil {
+			removed++
+		} else if !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("failed to remove snapshotted segment", "segment", segmentName(l.filename, n), "error", err)
+		}
+	}
+
+	if err := syncDir(filepath.Dir(l.filename)); err != nil {
+		slog.Warn("failed to sync transaction log directory", "error", err)
+	}
+
+	slog.Info("snapshot written",
+		"file", filename, "sequence", sequence, "keys", len(entries), "removed_segments", removed, "duration", time.Since(started).String())
+
+	return relogged, nil
+}
+
+// writeSnapshotFile atomically replaces filename with a snapshot of
+// entries at sequence, sealed with s if it is not nil.
+func writeSnapshotFile(filename string, sequence uint64, entries []Entry, s *Sealer) error {
+	tmp, err := os.OpenFile(filename+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := writeSnapshot(tmp, sequence, entries, s); err != nil {
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(filename))
+}
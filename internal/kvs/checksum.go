@@ -0,0 +1,198 @@
+package kvs
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync/atomic"
+)
+
+/**
+ * Value checksums.
+ *
+ * With store checksums enabled, the stores keep the SHA-256 digest of
+ * every value they are given, taken before compression and, in the
+ * bbolt, Badger and SQLite backends, kept in the record on disk. GetEntry
+ * checks the value it reads against it and fails with ErrorValueChecksum
+ * when memory or the disk has corrupted it; GET reports the digest in
+ * X-Content-SHA256, so clients can check the value too.
+ *
+ * GET repairs a mismatch from the file transaction log: once the events
+ * logged so far are on disk, the value the key was last written with is
+ * read back from the snapshot and the log, and replaces the corrupt one
+ * if it is of the same revision and has the kept digest. Otherwise, or
+ * with another log backend, GET fails with 500.
+ */
+var ErrorValueChecksum = errors.New("Value checksum mismatch")
+
+var checksumMismatches, checksumRepairs atomic.Uint64
+
+// RepairableStore is implemented by the stores that keep value checksums.
+type RepairableStore interface {
+	// Repair replaces the value of key with value if the key is at
+	// revision and value has the checksum kept with it; the deadline,
+	// content type and times of the key are kept.
+	Repair(ctx context.Context, key, value string, revision uint64) error
+}
+
+// checksum returns the digest of value.
+func checksum(value string) *[sha256.Size]byte {
+	sum := sha256.Sum256([]byte(value))
+	return &sum
+}
+
+// verifyChecksum checks value against the digest sum kept with it; a nil
+// sum passes.
+func verifyChecksum(key, value string, sum *[sha256.Size]byte) error {
+	if sum != nil && sha256.Sum256([]byte(value)) != *sum {
+		return fmt.Errorf("%w: %s", ErrorValueChecksum, key)
+	}
+
+	return nil
+}
+
+// formatChecksum renders sum in hex for Entry.Checksum, or "" if it is nil.
+func formatChecksum(sum *[sha256.Size]byte) string {
+	if sum == nil {
+		return ""
+	}
+
+	return hex.EncodeToString(sum[:])
+}
+
+// verifiedEntry reads the entry of key like store.GetEntry, repairing its
+// value from the transaction log if it fails its checksum.
+func verifiedEntry(ctx context.Context, key string) (Entry, error) {
+	return repairedEntry(ctx, store, logger, snapshotPath(config.TransactionLog), key)
+}
+
+// repairedEntry reads the entry of key in s, repairing its value from the
+// log l, whose snapshot is at snapshot, if it fails its checksum.
+func repairedEntry(ctx context.Context, s Store, l TransactionLogger, snapshot, key string) (Entry, error) {
+	entry, err := s.GetEntry(ctx, key)
+	if !errors.Is(err, ErrorValueChecksum) {
+		return entry, err
+	}
+
+	checksumMismatches.Add(1)
+
+	if rerr := repairFromLog(ctx, s, l, snapshot, key); rerr != nil {
+		slog.Error("value checksum mismatch", "key", key, "repair_error", rerr)
+		return Entry{}, err
+	}
+
+	checksumRepairs.Add(1)
+	slog.Warn("value checksum mismatch repaired from the transaction log", "key", key)
+
+	return s.GetEntry(ctx, key)
+}
+
+// repairFromLog replaces the value of key in s with the one it was last
+// written with in the file transaction log l.
+func repairFromLog(ctx context.Context, s Store, l TransactionLogger, snapshot, key string) error {
+	rs, ok := unwrapStore(s).(RepairableStore)
+	if !ok {
+		return errors.New("the store keeps no checksums")
+	}
+
+	fl, ok := unwrapLogger(l).(*FileTransactionLogger)
+	if !ok {
+		return errors.New("repair needs the file transaction log")
+	}
+
+	if err := l.Sync(ctx); err != nil {
+		return err
+	}
+
+	entry, found, err := loggedEntry(fl, snapshot, key)
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		return fmt.Errorf("%w: %s", ErrorNoSuchKey, key)
+	}
+
+	return rs.Repair(ctx, key, entry.Value, entry.Revision)
+}
+
+// loggedEntry returns the value and revision key was last written with in
+// the snapshot at filename and the log of l, or false if the key is not in
+// them.
+func loggedEntry(l *FileTransactionLogger, filename, key string) (entry Entry, found bool, err error) {
+	for {
+		before, berr := os.Stat(filename)
+
+		var sequence uint64
+		if entry, found, sequence, err = snapshotEntry(filename, key, l.sealer); err != nil {
+			return Entry{}, false, err
+		}
+
+		_, err = verifyLog(l.filename, l.sealer, true, func(e Event) {
+			if e.Sequence <= sequence {
+				return // Уже в снимке
+			}
+
+			ops := []Event{e}
+			if e.EventType == EventTxn {
+				ops, _ = decodeTxnEvents(e.Value) // Проверено verifyLog
+			}
+
+			for _, op := range ops {
+				if op.Key != key {
+					continue
+				}
+
+				switch op.EventType {
+				case EventPut, EventIncrement:
+					entry, found = Entry{Key: key, Value: op.Value, Revision: op.Revision}, true
+				case EventDelete, EventTombstone, EventExpired:
+					found = false
+				}
+			}
+		})
+
+		if err != nil {
+			return Entry{}, false, err
+		}
+
+		after, aerr := os.Stat(filename)
+		if (berr != nil && aerr != nil) || (berr == nil && aerr == nil && os.SameFile(before, after)) {
+			return entry, found, nil
+		}
+		// Снимок заменён, а сегменты до него удалены: прочитать заново
+	}
+}
+
+// snapshotEntry returns the entry of key in the snapshot at filename, if
+// there is one, and the sequence of the snapshot, which s decrypts.
+func snapshotEntry(filename, key string, s *Sealer) (Entry, bool, uint64, error) {
+	file, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return Entry{}, false, 0, nil
+	}
+
+	if err != nil {
+		return Entry{}, false, 0, err
+	}
+
+	defer file.Close()
+
+	header, entries, err := readSnapshot(bufio.NewReader(file), s)
+	if err != nil {
+		return Entry{}, false, 0, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	for _, e := range entries {
+		if e.Key == key {
+			return e, true, header.Sequence, nil
+		}
+	}
+
+	return Entry{}, false, header.Sequence, nil
+}
@@ -0,0 +1,147 @@
+package kvs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"example.com/gorilla/cluster"
+)
+
+/**
+ * Cluster mode.
+ *
+ * With cluster nodes configured, each server owns the keys the consistent
+ * hash ring of the cluster package assigns to its node ID and nothing
+ * else; the servers share no data. Requests for a single key owned by
+ * another node are answered with 307 Temporary Redirect to the same path
+ * on the owner, which is named in the X-Cluster-Node header, so clients
+ * retry there as Redis clients do on MOVED. Multi-key requests that touch
+ * a foreign key are refused with 421 Misdirected Request instead, since
+ * they cannot be split. Listings, snapshots, exports and prefix watches
+ * only cover the keys of the node that serves them.
+ */
+const clusterNodeHeader = "X-Cluster-Node"
+
+var ring *cluster.Ring // nil, если кластер не настроен
+
+var localNode cluster.Node
+
+// newRing builds the hash ring of the configured nodes and checks that
+// it contains this node.
+func (c ClusterConfig) newRing() (*cluster.Ring, error) {
+	nodes, err := cluster.ParseNodes(c.Nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := cluster.New(nodes, c.VirtualNodes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cluster: %w", err)
+	}
+
+	if _, ok := r.Node(c.NodeID); !ok {
+		return nil, fmt.Errorf("cluster node ID %q is not among the cluster nodes", c.NodeID)
+	}
+
+	return r, nil
+}
+
+// initializeCluster sets up cluster mode if nodes are configured.
+func initializeCluster(c ClusterConfig) error {
+	if len(c.Nodes) == 0 {
+		return nil
+	}
+
+	r, err := c.newRing()
+	if err != nil {
+		return err
+	}
+
+	ring = r
+	localNode, _ = r.Node(c.NodeID)
+
+	return nil
+}
+
+// foreignOwner returns the owner of the first of keys that belongs to
+// another node.
+func foreignOwner(keys ...string) (cluster.Node, bool) {
+	if ring == nil {
+		return cluster.Node{}, false
+	}
+
+	for _, key := range keys {
+		if owner := ring.Owner(key); owner.ID != localNode.ID {
+			return owner, true
+		}
+	}
+
+	return cluster.Node{}, false
+}
+
+// misdirected answers 421 and returns true if one of keys belongs to
+// another node.
+func misdirected(w http.ResponseWriter, keys ...string) bool {
+	owner, ok := foreignOwner(keys...)
+	if !ok {
+		return false
+	}
+
+	w.Header().Set(clusterNodeHeader, owner.ID)
+	http.Error(w, fmt.Sprintf("Keys belong to other cluster nodes, %s among them", owner.ID), http.StatusMisdirectedRequest)
+
+	return true
+}
+
+// clusterRedirect redirects requests for a key, or a lock, owned by
+// another node to that node.
+func clusterRedirect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := pathVars(r)
+
+		key, ok := vars["key"]
+		if !ok {
+			key, ok = vars["name"] // Замок живёт на узле, которому принадлежит его имя
+		}
+
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		owner, foreign := foreignOwner(key)
+		if !foreign {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set(clusterNodeHeader, owner.ID)
+		http.Redirect(w, r, owner.URL+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	})
+}
+
+type clusterInfo struct {
+	Node  string         `json:"node"`
+	Nodes []cluster.Node `json:"nodes"`
+	Owner *cluster.Node  `json:"owner,omitempty"` // Только при ?key=
+}
+
+// clusterHandler serves GET /v1/cluster?key=: the ID of this node, every
+// node of the cluster and, for a given key, the node that owns it.
+func clusterHandler(w http.ResponseWriter, r *http.Request) {
+	if ring == nil {
+		http.Error(w, "Cluster mode is not enabled", http.StatusNotFound)
+		return
+	}
+
+	info := clusterInfo{Node: localNode.ID, Nodes: ring.Nodes()}
+
+	if key := r.URL.Query().Get("key"); key != "" {
+		owner := ring.Owner(key)
+		info.Owner = &owner
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
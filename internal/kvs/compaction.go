@@ -0,0 +1,446 @@
+package kvs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/**
+ * File Transaction log compaction.
+ *
+ * Compaction rewrites the log so that it holds only the events still needed
+ * to rebuild the current state: the latest PUT of every live key and the
+ * EXPIRE that follows it, and the pending scheduled operations. Retained
+ * events keep their original sequence numbers, so replay integrity checks
+ * still hold. When the last events are dropped, an EventSequence marker
+ * with the sequence number of the last one ends the compacted log, so that
+ * lastSequence does not go back when it is replayed after a restart.
+ */
+
+// CompactionPolicy decides when the file logger compacts its log. A zero
+// field disables the corresponding trigger.
+type CompactionPolicy struct {
+	MaxSize   int64         `yaml:"max_size"`   // Размер файла журнала в байтах
+	MaxEvents uint64        `yaml:"max_events"` // Число событий с момента последнего сжатия
+	Interval  time.Duration `yaml:"interval"`   // Периодичность сжатия по расписанию
+}
+
+// compactionState tracks log growth between compactions.
+type compactionState struct {
+	size        int64  // Текущий размер файла журнала
+	sizeTrigger int64  // Размер, при котором запускается сжатие
+	events      uint64 // Событий записано с последнего сжатия
+}
+
+func (p CompactionPolicy) due(s compactionState) bool {
+	if p.MaxSize > 0 && s.size >= s.sizeTrigger {
+		return true
+	}
+
+	return p.MaxEvents > 0 && s.events >= p.MaxEvents
+}
+
+// reset is called after the log has been compacted to size bytes. The size
+// trigger is raised to twice the compacted size so that a log whose live
+// data alone exceeds MaxSize is not rewritten after every event.
+func (p CompactionPolicy) reset(size int64) compactionState {
+	trigger := p.MaxSize
+	if 2*size > trigger {
+		trigger = 2 * size
+	}
+
+	return compactionState{size: size, sizeTrigger: trigger}
+}
+
+// Compactor is implemented by transaction loggers that can compact their
+// log on demand.
+type Compactor interface {
+	Compact() error
+}
+
+// compactHandler serves POST /v1/compact.
+func compactHandler(w http.ResponseWriter, r *http.Request) {
+	c, ok := unwrapLogger(logger).(Compactor)
+	if !ok {
+		http.Error(w, "Transaction log backend does not support compaction", http.StatusNotImplemented)
+		return
+	}
+
+	if err := c.Compact(); err != nil {
+		serverError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Compact rewrites the log immediately. It is serialized with event writes
+// by the logger goroutine, so Run must have been called.
+func (l *FileTransactionLogger) Compact() error {
+	reply := make(chan error)
+	l.compactions <- reply
+
+	return <-reply
+}
+
+// compact is run by the logger goroutine between event writes.
+func (l *FileTransactionLogger) compact() error {
+	started := time.Now()
+	before := l.compaction.size
+
+	if err := compactLogFile(l.filename, l.sealer, l.segment > 0 || l.floor.Load() > 0); err != nil {
+		return fmt.Errorf("transaction log compaction failed: %w", err)
+	}
+
+	file, err := os.OpenFile(l.filename, os.O_RDWR|os.O_APPEND, 0755)
+	if err != nil {
+		return fmt.Errorf("cannot reopen compacted transaction log: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("cannot stat compacted transaction log: %w", err)
+	}
+
+	l.file.Close()
+	l.file = file
+	l.compaction = l.policy.reset(info.Size())
+	l.unsynced = 0 // Сжатый журнал записан с fsync
+
+	slog.Info("compacted transaction log",
+		"file", l.filename, "before", before, "after", info.Size(), "duration", time.Since(started))
+
+	return nil
+}
+
+// compactLogFile folds the log at filename into the latest state and
+// atomically replaces it with a log holding only the surviving events. A
+// partial compaction is for a segment replayed after earlier ones.
+func compactLogFile(filename string, s *Sealer, partial bool) error {
+	events, err := foldLogFile(filename, s, partial)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.OpenFile(filename+".compact", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	writer := bufio.NewWriter(tmp)
+	writer.WriteString(s.logHeader() + "\n")
+
+	for _, e := range events {
+		if _, err := writer.WriteString(encodeEvent(s.sealEvent(e))); err != nil {
+			return err
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(filename))
+}
+
+// foldLogFile replays the log at filename and returns the events needed to
+// rebuild its final state, as folded by logFolder.
+func foldLogFile(filename string, s *Sealer, partial bool) ([]Event, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	folder := newLogFolder(partial)
+	reader := bufio.NewReader(file)
+
+	if header, err := reader.ReadString('\n'); err != nil || header != s.logHeader()+"\n" {
+		return nil, fmt.Errorf("unrecognized transaction log format")
+	}
+
+	for {
+		record, err := readRecord(reader)
+		if err == io.EOF && record == "" {
+			break
+		}
+
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		e, err := decodeEvent(record)
+		if err == nil {
+			e, err = s.openEvent(e)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("input parse error: %w", err)
+		}
+
+		if err := folder.add(e); err != nil {
+			return nil, err
+		}
+	}
+
+	return folder.events(), nil
+}
+
+// logFolder reduces a stream of events to those needed to rebuild its
+// final state. A partial folder folds a log segment that is replayed after
+// earlier ones, so it also keeps the events that act on keys written in
+// those: deletes, as tombstones, and expirations, content types,
+// increments and soft deletes of keys the segment does not put. Soft
+// deletes are kept with the value they remove until their tombstone runs
+// out.
+type logFolder struct {
+	state     map[string]*keyState
+	readOnly  *Event           // Последнее переключение режима только для чтения
+	schedules map[string]Event // Последнее событие расписания каждого ключа
+	last      uint64           // Порядковый номер последнего события
+	partial   bool
+}
+
+func newLogFolder(partial bool) *logFolder {
+	return &logFolder{state: make(map[string]*keyState), schedules: make(map[string]Event), partial: partial}
+}
+
+func (f *logFolder) add(e Event) error {
+	f.last = max(f.last, e.Sequence)
+
+	if e.EventType == EventSequence {
+		return nil
+	}
+
+	if e.EventType == EventReadOnly {
+		f.readOnly = &e
+		return nil
+	}
+
+	if e.EventType == EventSchedule {
+		f.schedules[e.Key] = e // Не зависит от состояния ключа
+		return nil
+	}
+
+	ops := []Event{e}
+	if e.EventType == EventTxn {
+		txn, err := inflateEvent(e)
+		if err != nil {
+			return err
+		}
+
+		if ops, err = decodeTxnEvents(txn.Value); err != nil {
+			return err
+		}
+
+		for i := range ops {
+			ops[i].Sequence = e.Sequence // Записи транзакции делят её номер
+		}
+	}
+
+	for _, e := range ops {
+		f.fold(e)
+	}
+
+	return nil
+}
+
+// events returns the folded events ordered by sequence number, followed by
+// an EventSequence marker if the last event added was dropped. Keys whose
+// deadline has already passed are dropped, or become tombstones in a
+// partial folder.
+func (f *logFolder) events() []Event {
+	now := time.Now()
+	events := make([]Event, 0, len(f.state))
+
+	for key, s := range f.state {
+		if s.tombstone != nil {
+			nanos, err := strconv.ParseInt(s.tombstone.Value, 10, 64)
+			if err == nil && !now.Before(time.Unix(0, nanos)) {
+				if f.partial {
+					events = append(events, Event{Sequence: s.tombstone.Sequence, EventType: EventDelete, Key: key})
+				}
+				continue // Ключ уже нельзя восстановить
+			}
+		}
+
+		if s.expire != nil {
+			nanos, err := strconv.ParseInt(s.expire.Value, 10, 64)
+			if err == nil && !now.Before(time.Unix(0, nanos)) {
+				if f.partial { // Ключ мог быть записан в предыдущем сегменте
+					events = append(events, Event{Sequence: s.expire.Sequence, EventType: EventDelete, Key: key})
+				}
+				continue // Ключ уже истёк
+			}
+		}
+
+		if s.put.EventType != 0 {
+			events = append(events, s.put)
+		}
+		if s.expire != nil {
+			events = append(events, *s.expire)
+		}
+		if s.contentType != nil {
+			events = append(events, *s.contentType)
+		}
+		if s.tombstone != nil {
+			events = append(events, *s.tombstone)
+		}
+	}
+
+	if f.readOnly != nil && (f.partial || f.readOnly.Value == "true") {
+		events = append(events, *f.readOnly)
+	}
+
+	for _, e := range f.schedules {
+		if f.partial || e.Value != "" { // Отмена нужна, только если операция может быть в предыдущем сегменте
+			events = append(events, e)
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool { return events[i].Sequence < events[j].Sequence })
+
+	if n := len(events); f.last > 0 && (n == 0 || events[n-1].Sequence < f.last) {
+		events = append(events, Event{Sequence: f.last, EventType: EventSequence})
+	}
+
+	return regroupTxns(events)
+}
+
+// keyState is the folded state of one key. put holds the event that writes
+// its value: a PUT or, in a partial folder, a DELETE tombstone, an
+// increment of a value from an earlier segment, the expiration of a key
+// from an earlier segment, or nothing at all. tombstone is the soft delete
+// that removed the key since, if any.
+type keyState struct {
+	put         Event
+	expire      *Event
+	contentType *Event
+	tombstone   *Event
+}
+
+// fold applies one event to the per-key state.
+func (f *logFolder) fold(e Event) {
+	s, ok := f.state[e.Key]
+
+	switch e.EventType {
+	case EventPut:
+		f.state[e.Key] = &keyState{put: e}
+	case EventDelete:
+		if f.partial {
+			f.state[e.Key] = &keyState{put: e}
+		} else {
+			delete(f.state, e.Key)
+		}
+	case EventIncrement:
+		switch {
+		case ok && s.put.EventType != EventDelete && s.put.EventType != 0 && e.Revision != 1:
+			s.put.Value, s.put.Revision, s.put.compressed = e.Value, e.Revision, e.compressed // Срок действия и тип сохраняются
+		case f.partial && e.Revision != 1: // Значение из предыдущего сегмента
+			if !ok {
+				s = &keyState{}
+				f.state[e.Key] = s
+			}
+			s.put = e
+		default:
+			e.EventType = EventPut
+			f.state[e.Key] = &keyState{put: e}
+		}
+	case EventExpired:
+		if (ok && s.put.EventType != 0) || !f.partial {
+			return // Срок учтён в events(), либо ключ записан заново
+		}
+
+		if !ok {
+			s = &keyState{}
+			f.state[e.Key] = s
+		}
+		s.put = e // Ключ из предыдущего сегмента; решается при воспроизведении
+	case EventTombstone:
+		if !ok {
+			if !f.partial {
+				return
+			}
+			s = &keyState{}
+			f.state[e.Key] = s
+		}
+
+		event := e
+		s.tombstone = &event
+	case EventExpire, EventContentType:
+		if !ok {
+			if !f.partial {
+				return
+			}
+			s = &keyState{}
+			f.state[e.Key] = s
+		}
+
+		event := e
+		if e.EventType == EventExpire {
+			s.expire = &event
+		} else {
+			s.contentType = &event
+		}
+	}
+}
+
+// regroupTxns merges surviving writes that came from the same transaction,
+// and so share a sequence number, back into one EventTxn.
+func regroupTxns(events []Event) []Event {
+	grouped := events[:0]
+
+	for i := 0; i < len(events); {
+		j := i + 1
+		for j < len(events) && events[j].Sequence == events[i].Sequence {
+			j++
+		}
+
+		if j-i == 1 {
+			grouped = append(grouped, events[i])
+		} else {
+			grouped = append(grouped, Event{
+				Sequence:  events[i].Sequence,
+				EventType: EventTxn,
+				Value:     encodeTxnEvents(events[i:j]),
+			})
+		}
+
+		i = j
+	}
+
+	return grouped
+}
+
+// syncDir fsyncs a directory so that a rename inside it is durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	defer d.Close()
+
+	return d.Sync()
+}
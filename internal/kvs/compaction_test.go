@@ -0,0 +1,127 @@
+package kvs
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+// openTestLog opens a file logger on filename with compaction and
+// rotation disabled.
+func openTestLog(t *testing.T, filename string) *FileTransactionLogger {
+	t.Helper()
+
+	l, err := NewFileTransactionLogger(filename, FileLogOptions{Fsync: FsyncPolicy{Mode: FsyncAlways}, Batch: BatchPolicy{MaxEvents: 1}, Strict: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return l.(*FileTransactionLogger)
+}
+
+// replayTestLog reads every event of l back.
+func replayTestLog(t *testing.T, l *FileTransactionLogger) []Event {
+	t.Helper()
+
+	var replayed []Event
+
+	events, errs := l.ReadEvents()
+	for e := range events {
+		replayed = append(replayed, e)
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	return replayed
+}
+
+func TestCompactionKeepsLastSequence(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "transaction.log")
+
+	l := openTestLog(t, filename)
+	replayTestLog(t, l)
+	l.Run()
+
+	l.WritePut("a", "1", 1)
+	l.WritePut("b", "1", 1)
+	l.WriteDelete("b")
+
+	if err := l.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	l = openTestLog(t, filename)
+	defer l.Close()
+
+	replayed := replayTestLog(t, l)
+
+	if len(replayed) != 1 || replayed[0].Key != "a" || replayed[0].Sequence != 1 {
+		t.Fatalf("replayed %+v, want the put of a at 1", replayed)
+	}
+
+	if got := l.LastSequence(); got != 3 {
+		t.Fatalf("LastSequence after compaction = %d, want 3", got)
+	}
+}
+
+func TestLogFolderMarksDroppedTail(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []Event
+		want   []EventType
+	}{
+		{"kept tail", []Event{
+			{Sequence: 1, EventType: EventPut, Key: "a"},
+			{Sequence: 2, EventType: EventPut, Key: "b"},
+		}, []EventType{EventPut, EventPut}},
+		{"dropped tail", []Event{
+			{Sequence: 1, EventType: EventPut, Key: "a"},
+			{Sequence: 2, EventType: EventPut, Key: "b"},
+			{Sequence: 3, EventType: EventDelete, Key: "b"},
+		}, []EventType{EventPut, EventSequence}},
+		{"compacted again", []Event{
+			{Sequence: 1, EventType: EventPut, Key: "a"},
+			{Sequence: 3, EventType: EventSequence},
+		}, []EventType{EventPut, EventSequence}},
+		{"everything dropped", []Event{
+			{Sequence: 1, EventType: EventPut, Key: "a"},
+			{Sequence: 2, EventType: EventDelete, Key: "a"},
+		}, []EventType{EventSequence}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newLogFolder(false)
+			for _, e := range tt.events {
+				if err := f.add(e); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			events := f.events()
+			if len(events) != len(tt.want) {
+				t.Fatalf("got %+v, want types %v", events, tt.want)
+			}
+
+			for i, e := range events {
+				if e.EventType != tt.want[i] {
+					t.Fatalf("event %d is of type %d, want %d", i, e.EventType, tt.want[i])
+				}
+			}
+
+			if last := tt.events[len(tt.events)-1].Sequence; events[len(events)-1].Sequence != last {
+				t.Fatalf("folded log ends at %d, want %d", events[len(events)-1].Sequence, last)
+			}
+		})
+	}
+}
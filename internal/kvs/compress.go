@@ -0,0 +1,142 @@
+package kvs
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+/**
+ * Compression.
+ *
+ * Clients may send PUT bodies with Content-Encoding gzip or deflate and
+ * get values of at least minEncodedValue bytes compressed on GET when
+ * their Accept-Encoding allows it. Independently, values above a
+ * configured threshold can be kept deflate-compressed in memory and in
+ * the transaction logs, where such a value is flagged in its record; the
+ * text formats marked it by a compressedPrefix before its base64 field. A
+ * value is only stored compressed when that actually makes it smaller.
+ */
+const (
+	minEncodedValue  = 1024 // Меньшие значения почти не выигрывают от сжатия
+	compressedPrefix = "~"  // Не входит в алфавит base64
+)
+
+var ErrorUnsupportedEncoding = errors.New("Unsupported Content-Encoding")
+
+// deflateValue compresses value, reporting false when the result would
+// not be smaller.
+func deflateValue(value string) (string, bool) {
+	var buf bytes.Buffer
+
+	w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	io.WriteString(w, value)
+	w.Close()
+
+	if buf.Len() >= len(value) {
+		return value, false
+	}
+
+	return buf.String(), true
+}
+
+func inflateValue(compressed string) (string, error) {
+	value, err := io.ReadAll(flate.NewReader(strings.NewReader(compressed)))
+	if err != nil {
+		return "", fmt.Errorf("failed to decompress value: %w", err)
+	}
+
+	return string(value), nil
+}
+
+// compressEvent compresses the value of e if it is at least threshold
+// bytes long; a zero threshold disables compression.
+func compressEvent(e Event, threshold int) Event {
+	if threshold <= 0 || len(e.Value) < threshold || e.compressed {
+		return e
+	}
+
+	e.Value, e.compressed = deflateValue(e.Value)
+
+	return e
+}
+
+// inflateEvent reverses compressEvent.
+func inflateEvent(e Event) (Event, error) {
+	if !e.compressed {
+		return e, nil
+	}
+
+	value, err := inflateValue(e.Value)
+	if err != nil {
+		return e, err
+	}
+
+	e.Value, e.compressed = value, false
+
+	return e, nil
+}
+
+// decodeContent returns a reader of body decoded as the Content-Encoding
+// header says.
+func decodeContent(body io.Reader, encoding string) (io.Reader, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(body)
+	case "deflate": // В HTTP это поток zlib
+		return zlib.NewReader(body)
+	default:
+		return nil, fmt.Errorf("%w %q", ErrorUnsupportedEncoding, encoding)
+	}
+}
+
+// acceptedEncoding picks gzip or deflate if the Accept-Encoding header
+// allows one, gzip first, and returns "" otherwise.
+func acceptedEncoding(header string) string {
+	accepted := make(map[string]bool)
+
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+
+		q := 1.0
+		if name, value, ok := strings.Cut(params, "="); ok && strings.TrimSpace(name) == "q" {
+			q, _ = strconv.ParseFloat(strings.TrimSpace(value), 64) // Ошибка разбора даёт 0
+		}
+
+		accepted[coding] = q > 0
+	}
+
+	for _, coding := range []string{"gzip", "deflate"} {
+		if ok, listed := accepted[coding]; ok || (!listed && accepted["*"]) {
+			return coding
+		}
+	}
+
+	return ""
+}
+
+// encodeContent compresses value with an encoding from acceptedEncoding.
+func encodeContent(encoding, value string) string {
+	var buf bytes.Buffer
+
+	var w io.WriteCloser
+	if encoding == "gzip" {
+		w = gzip.NewWriter(&buf)
+	} else {
+		w = zlib.NewWriter(&buf)
+	}
+
+	io.WriteString(w, value)
+	w.Close()
+
+	return buf.String()
+}
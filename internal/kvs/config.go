@@ -0,0 +1,1177 @@
+package kvs
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"example.com/gorilla/cluster"
+)
+
+/**
+ * Configuration.
+ *
+ * Settings are resolved in increasing order of precedence: built-in
+ * defaults, the YAML file given by -config (or KVS_CONFIG), environment
+ * variables and command-line flags. Every setting has a flag; the table
+ * in bindSettings maps it to its environment variable.
+ */
+type Config struct {
+	Listen          string        `yaml:"listen"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	RequestTimeout  time.Duration `yaml:"request_timeout"` // 0: без ограничения
+	ReadOnly        bool          `yaml:"read_only"`       // Запуститься в режиме только для чтения
+
+	ServeDuringReplay bool `yaml:"serve_during_replay"` // Отвечать на чтение ключей, пока журнал воспроизводится
+
+	VerifyLog bool `yaml:"-"` // Проверить журнал и выйти, не запуская сервер
+	RepairLog bool `yaml:"-"` // При проверке усечь повреждённый журнал
+
+	HTTP           HTTPConfig           `yaml:"http"`
+	CORS           CORSConfig           `yaml:"cors"`
+	Admin          AdminConfig          `yaml:"admin"`
+	Store          StoreConfig          `yaml:"store"`
+	TransactionLog TransactionLogConfig `yaml:"transaction_log"`
+	Auth           AuthConfig           `yaml:"auth"`
+	TLS            TLSConfig            `yaml:"tls"`
+	Limits         LimitsConfig         `yaml:"limits"`
+	Keys           KeysConfig           `yaml:"keys"`
+	RateLimit      RateLimitConfig      `yaml:"rate_limit"`
+	Idempotency    IdempotencyConfig    `yaml:"idempotency"`
+	Locks          LocksConfig          `yaml:"locks"`
+	Watch          WatchConfig          `yaml:"watch"`
+	HotKeys        HotKeysConfig        `yaml:"hot_keys"`
+	Webhooks       WebhooksConfig       `yaml:"webhooks"`
+	Audit          AuditConfig          `yaml:"audit"`
+	RESP           RESPConfig           `yaml:"resp"`
+	Memcached      MemcachedConfig      `yaml:"memcached"`
+	GRPC           GRPCConfig           `yaml:"grpc"`
+	Log            LogConfig            `yaml:"log"`
+	Tracing        TracingConfig        `yaml:"tracing"`
+	SlowLog        SlowLogConfig        `yaml:"slow_log"`
+	Replication    ReplicationConfig    `yaml:"replication"`
+	Cluster        ClusterConfig        `yaml:"cluster"`
+	Migration      MigrationConfig      `yaml:"migration"`
+}
+
+type StoreConfig struct {
+	Backend      string        `yaml:"backend"` // "memory", "bbolt", "badger" или "sqlite"
+	Path         string        `yaml:"path"`    // Файл базы bbolt или SQLite, каталог базы Badger
+	Shards       int           `yaml:"shards"`
+	ReapInterval time.Duration `yaml:"reap_interval"`
+
+	CompressThreshold int `yaml:"compress_threshold"` // Сжимать значения не короче; 0 отключает сжатие
+	HistoryDepth      int `yaml:"history_depth"`      // Сколько предыдущих версий ключа хранить; 0 отключает историю
+
+	Checksums bool `yaml:"checksums"` // Хранить SHA-256 значений и проверять их при чтении
+
+	TombstoneRetention time.Duration `yaml:"tombstone_retention"` // Сколько удалённый ключ можно восстановить; 0 удаляет сразу
+
+	DefaultTTL time.Duration `yaml:"default_ttl"` // Срок жизни ключей, записанных PUT без ttl; 0 - бессрочно
+
+	Conflicts string `yaml:"conflicts"` // "overwrite" или "reject" - PUT в существующий ключ без версии в If-Match
+
+	// Режим кэша: при превышении любого из ограничений вытесняются
+	// давно не использованные ключи. Нулевое значение отключает ограничение.
+	MaxKeys      int   `yaml:"max_keys"`
+	MaxBytes     int64 `yaml:"max_bytes"`
+	LogEvictions bool  `yaml:"log_evictions"` // Записывать вытеснения в журнал как DELETE
+
+	MaxMemory    int64  `yaml:"max_memory"`    // Примерная память ключей; 0 отключает ограничение
+	MemoryPolicy string `yaml:"memory_policy"` // "reject" или "evict" при достижении max_memory
+
+	Indexes []string `yaml:"indexes"` // Поля значений JSON для поиска ключей, например "user.email"
+
+	Quotas []string `yaml:"quotas"` // Квоты корзин "префикс:ключей:байт"; 0 - без ограничения
+
+	Upstream UpstreamConfig `yaml:"upstream"` // Кэш перед более медленным хранилищем
+
+	Badger BadgerConfig `yaml:"badger"`
+}
+
+type BadgerConfig struct {
+	InMemory       bool          `yaml:"in_memory"`        // Без файлов; содержимое восстанавливается из журнала
+	Compression    string        `yaml:"compression"`      // "none", "snappy" или "zstd"
+	ValueThreshold int64         `yaml:"value_threshold"`  // Значения длиннее хранятся в журнале значений
+	GCInterval     time.Duration `yaml:"gc_interval"`      // Период сборки мусора журнала значений; 0 отключает
+	GCDiscardRatio float64       `yaml:"gc_discard_ratio"` // Доля устаревших значений, при которой файл переписывается
+}
+
+type TransactionLogConfig struct {
+	Backend    string           `yaml:"backend"`    // "file", "postgres", "s3", "kafka", "nats" или "none"
+	Durability string           `yaml:"durability"` // "async" или "sync"
+	Strict     bool             `yaml:"strict"`     // Ошибка вместо усечения повреждённого журнала
+	File       string           `yaml:"file"`
+	Compaction CompactionPolicy `yaml:"compaction"`
+	Rotation   RotationPolicy   `yaml:"rotation"`
+	Snapshot   SnapshotPolicy   `yaml:"snapshot"`
+	Fsync      FsyncPolicy      `yaml:"fsync"`
+	Batch      BatchPolicy      `yaml:"batch"`
+	Queue      QueuePolicy      `yaml:"queue"`
+	Encryption EncryptionConfig `yaml:"encryption"`
+	Postgres   PostgresConfig   `yaml:"postgres"`
+	S3         S3Config         `yaml:"s3"`
+	Kafka      KafkaConfig      `yaml:"kafka"`
+	NATS       NATSConfig       `yaml:"nats"`
+
+	CompressThreshold int `yaml:"compress_threshold"` // Только для file, s3, kafka и nats; 0 отключает сжатие
+}
+
+// EncryptionConfig names the source of the base64-encoded AES-256 key for
+// the file, S3, Kafka and NATS logs and snapshots; at most one may be set.
+type EncryptionConfig struct {
+	Key        string `yaml:"key"`
+	KeyFile    string `yaml:"key_file"`
+	KeyCommand string `yaml:"key_command"` // Печатает ключ, например получив его из KMS
+}
+
+type PostgresConfig struct {
+	Host     string `yaml:"host"`
+	DBName   string `yaml:"dbname"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	SSLMode  string `yaml:"sslmode"`
+}
+
+type S3Config struct {
+	Endpoint  string `yaml:"endpoint"` // S3 или совместимое хранилище, например MinIO
+	Region    string `yaml:"region"`
+	Bucket    string `yaml:"bucket"`
+	Prefix    string `yaml:"prefix"`
+	AccessKey string `yaml:"access_key"` // По умолчанию AWS_ACCESS_KEY_ID
+	SecretKey string `yaml:"secret_key"` // По умолчанию AWS_SECRET_ACCESS_KEY
+
+	SegmentInterval time.Duration `yaml:"segment_interval"` // Как часто выгружаются накопленные события
+	CompactSegments int           `yaml:"compact_segments"` // Сжимать после стольких сегментов; 0 отключает
+}
+
+// KafkaConfig names the topic whose first partition holds the log.
+type KafkaConfig struct {
+	Brokers    []string `yaml:"brokers"`
+	Topic      string   `yaml:"topic"`
+	OffsetFile string   `yaml:"offset_file"` // Конец раздела при остановке; пустой - воспроизводить с начала
+}
+
+// NATSConfig names the JetStream stream and the subject that hold the log.
+type NATSConfig struct {
+	URL         string `yaml:"url"`
+	Stream      string `yaml:"stream"`
+	Subject     string `yaml:"subject"`
+	Replicas    int    `yaml:"replicas"`    // Копий потока в кластере JetStream
+	Credentials string `yaml:"credentials"` // Файл .creds; пустой - без аутентификации
+}
+
+type AuthConfig struct {
+	APIKeys   []string   `yaml:"api_keys"` // Записи вида "name:key:ro|rw|admin"
+	JWTSecret string     `yaml:"jwt_secret"`
+	UsersFile string     `yaml:"users_file"` // Строки "name:bcrypt-hash[:ro|rw|admin]", как у htpasswd -B
+	OIDC      OIDCConfig `yaml:"oidc"`
+	LDAP      LDAPConfig `yaml:"ldap"`
+	ACL       ACLConfig  `yaml:"acl"`
+}
+
+// OIDCConfig accepts the tokens an OpenID Connect identity provider
+// issues; an empty issuer disables it.
+type OIDCConfig struct {
+	Issuer     string `yaml:"issuer"`      // URL издателя, по нему находятся ключи подписи
+	Audience   string `yaml:"audience"`    // Ожидаемое значение aud, обычно client ID
+	ScopeClaim string `yaml:"scope_claim"` // Заявка со списком прав, строкой или массивом
+	ReadScope  string `yaml:"read_scope"`
+	WriteScope string `yaml:"write_scope"`
+	AdminScope string `yaml:"admin_scope"`
+}
+
+// ACLConfig enables the access control lists stored under the _acl:
+// keys.
+type ACLConfig struct {
+	Enabled bool     `yaml:"enabled"`
+	Admins  []string `yaml:"admins"` // Принципалы с правом admin на всё, для первой настройки ACL
+}
+
+// LDAPConfig checks user names and passwords by binding to an LDAP
+// directory; an empty URL disables it.
+type LDAPConfig struct {
+	URL        string `yaml:"url"`         // ldap:// или ldaps://
+	UserDN     string `yaml:"user_dn"`     // Шаблон DN пользователя, %s заменяется на имя
+	WriteGroup string `yaml:"write_group"` // DN группы с правом записи; пустой - запись разрешена всем
+	AdminGroup string `yaml:"admin_group"` // DN группы с правом admin; пустой - admin нет ни у кого
+}
+
+// AuditConfig enables the audit log of the requests that change data.
+type AuditConfig struct {
+	File     string `yaml:"file"`      // Пустой - журнал аудита отключён
+	MaxSize  int64  `yaml:"max_size"`  // Размер файла в байтах, после которого начинается новый; 0 - без ротации
+	MaxFiles int    `yaml:"max_files"` // Хранимых старых файлов; 0 - хранить все
+}
+
+// HTTPConfig bounds the connections of the HTTP server; a zero timeout or
+// limit disables it.
+type HTTPConfig struct {
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout"`  // Весь запрос вместе с телом
+	WriteTimeout      time.Duration `yaml:"write_timeout"` // От конца заголовков запроса до конца ответа
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`  // Простой соединения между запросами
+	MaxHeaderBytes    int           `yaml:"max_header_bytes"`
+	MaxConnections    int           `yaml:"max_connections"` // Открытых соединений одновременно
+}
+
+// CORSConfig lets browsers call the API from other origins; an empty
+// origin list disables cross-origin requests.
+type CORSConfig struct {
+	AllowedOrigins   []string      `yaml:"allowed_origins"` // "scheme://host[:port]" или "*" - любой
+	AllowedMethods   []string      `yaml:"allowed_methods"`
+	AllowedHeaders   []string      `yaml:"allowed_headers"` // Заголовки запроса; "*" - любые
+	ExposedHeaders   []string      `yaml:"exposed_headers"` // Заголовки ответа, доступные скриптам
+	AllowCredentials bool          `yaml:"allow_credentials"`
+	MaxAge           time.Duration `yaml:"max_age"` // Сколько браузер помнит ответ на preflight
+}
+
+type AdminConfig struct {
+	Listen string `yaml:"listen"` // Пустой адрес оставляет служебные маршруты на основном
+}
+
+type TLSConfig struct {
+	CertFile      string   `yaml:"cert_file"`
+	KeyFile       string   `yaml:"key_file"`
+	AutocertHosts []string `yaml:"autocert_hosts"`
+	AutocertCache string   `yaml:"autocert_cache"`
+	ClientCAFile  string   `yaml:"client_ca_file"`
+}
+
+type LimitsConfig struct {
+	ListDefault   int   `yaml:"list_default"`
+	ListMax       int   `yaml:"list_max"`
+	BatchMaxOps   int   `yaml:"batch_max_ops"`
+	MaxKeyBytes   int   `yaml:"max_key_bytes"`
+	MaxValueBytes int64 `yaml:"max_value_bytes"`
+	MaxBodyBytes  int64 `yaml:"max_body_bytes"` // Тела batch и restore
+
+	CursorMaxKeys int           `yaml:"cursor_max_keys"` // Ключей в копии для ?snapshot=true
+	MaxCursors    int           `yaml:"max_cursors"`     // Копий, хранимых одновременно
+	CursorTTL     time.Duration `yaml:"cursor_ttl"`      // Время жизни копии без запросов
+}
+
+// RateLimitConfig sets token bucket limits in requests per second; a zero
+// rate disables the limit and a zero burst allows one second's worth.
+type RateLimitConfig struct {
+	GlobalRate  float64  `yaml:"global_rate"`
+	GlobalBurst int      `yaml:"global_burst"`
+	ClientRate  float64  `yaml:"client_rate"` // На ключ API или IP-адрес
+	ClientBurst int      `yaml:"client_burst"`
+	Endpoints   []string `yaml:"endpoints"` // Записи вида "/v1/batch:rate:burst", на клиента
+}
+
+type IdempotencyConfig struct {
+	Window  time.Duration `yaml:"window"`   // Сколько помнить ключи; 0 отключает Idempotency-Key
+	MaxKeys int           `yaml:"max_keys"` // Самые старые ключи забываются при превышении
+}
+
+type LocksConfig struct {
+	DefaultTTL time.Duration `yaml:"default_ttl"` // Аренда без ?ttl=
+	MaxTTL     time.Duration `yaml:"max_ttl"`
+}
+
+type RESPConfig struct {
+	Listen string `yaml:"listen"` // Пустой адрес отключает протокол Redis
+}
+
+type MemcachedConfig struct {
+	Listen string `yaml:"listen"` // Пустой адрес отключает протокол memcached
+}
+
+type GRPCConfig struct {
+	Listen     string `yaml:"listen"`     // Пустой адрес отключает gRPC; нужна сборка с тегом grpc
+	Reflection bool   `yaml:"reflection"` // Отражение сервисов для grpcurl и подобных
+}
+
+type LogConfig struct {
+	Level  string `yaml:"level"`  // "debug", "info", "warn" или "error"
+	Format string `yaml:"format"` // "json" или "text"
+}
+
+type TracingConfig struct {
+	Endpoint    string  `yaml:"endpoint"` // OTLP/HTTP, например http://localhost:4318/v1/traces
+	ServiceName string  `yaml:"service_name"`
+	SampleRatio float64 `yaml:"sample_ratio"` // Доля трассировок, начатых этим сервером
+}
+
+type SlowLogConfig struct {
+	Threshold time.Duration `yaml:"threshold"` // Записывать запросы дольше; 0 отключает
+	Entries   int           `yaml:"entries"`   // Сколько последних записей хранить
+}
+
+type ReplicationConfig struct {
+	Primary      string `yaml:"primary"`       // URL первичного сервера; пустой - сервер не реплика
+	APIKey       string `yaml:"api_key"`       // Ключ с правом чтения на первичном сервере
+	BufferEvents int    `yaml:"buffer_events"` // Событий хранится для отставших реплик
+
+	SessionWait time.Duration `yaml:"session_wait"` // Сколько реплика ждёт события из X-Session-Token
+}
+
+type ClusterConfig struct {
+	NodeID       string   `yaml:"node_id"`       // ID этого узла среди Nodes
+	Nodes        []string `yaml:"nodes"`         // "id=url" всех узлов; пустой список отключает кластер
+	VirtualNodes int      `yaml:"virtual_nodes"` // Точек на кольце у каждого узла
+}
+
+type WatchConfig struct {
+	BufferSize int           `yaml:"buffer_size"`
+	KeepAlive  time.Duration `yaml:"keep_alive"`
+}
+
+type HotKeysConfig struct {
+	Tracked int           `yaml:"tracked"` // Самых частых ключей хранить по имени; 0 отключает учёт
+	Decay   time.Duration `yaml:"decay"`   // Период, за который счётчики уменьшаются вдвое; 0 - никогда
+}
+
+type WebhooksConfig struct {
+	Targets    []string      `yaml:"targets"` // Записи вида "prefix=url"; пустой список отключает
+	Secret     string        `yaml:"secret"`  // Ключ подписи HMAC-SHA256; пустой - без подписи
+	Timeout    time.Duration `yaml:"timeout"`
+	Retries    int           `yaml:"retries"`     // Повторов после первой неудачной попытки
+	Backoff    time.Duration `yaml:"backoff"`     // Пауза перед первым повтором; удваивается
+	MaxBackoff time.Duration `yaml:"max_backoff"` // Предел паузы между повторами
+	QueueSize  int           `yaml:"queue_size"`  // При переполнении очереди цели события отбрасываются
+
+	Events      []string `yaml:"events"`       // Типы событий: "put", "delete", "expire", "evict"; пустой список - все
+	ChangedOnly bool     `yaml:"changed_only"` // Пропускать PUT, не изменившие значение
+}
+
+func DefaultConfig() *Config {
+	c := &Config{
+		Listen:          ":8080",
+		ShutdownTimeout: 10 * time.Second,
+		RequestTimeout:  30 * time.Second,
+		HTTP: HTTPConfig{
+			ReadHeaderTimeout: 10 * time.Second,
+			ReadTimeout:       time.Minute,
+			WriteTimeout:      time.Minute,
+			IdleTimeout:       2 * time.Minute,
+			MaxHeaderBytes:    1 << 20,
+		},
+		CORS: CORSConfig{
+			AllowedMethods: []string{"GET", "HEAD", "PUT", "POST", "DELETE"},
+			AllowedHeaders: []string{"Authorization", "Content-Type", "X-API-Key", "If-Match", "If-None-Match", "Idempotency-Key", "X-Request-ID", "X-Durability", "Last-Event-ID", "X-Session-Token"},
+			ExposedHeaders: []string{"ETag", "Last-Modified", "Retry-After", "X-Request-ID", "X-Next-Cursor", "X-TTL", "X-Created", "X-Content-SHA256", "Idempotent-Replayed", "X-Session-Token"},
+			MaxAge:         10 * time.Minute,
+		},
+		Admin: AdminConfig{
+			Listen: "localhost:9090",
+		},
+		Store: StoreConfig{
+			Backend:      "memory",
+			Path:         "kvs.db",
+			Shards:       32,
+			ReapInterval: time.Second,
+			Conflicts:    "overwrite",
+			MemoryPolicy: "reject",
+			Upstream: UpstreamConfig{
+				TTL:     5 * time.Minute,
+				Timeout: 5 * time.Second,
+			},
+			Badger: BadgerConfig{
+				Compression:    "snappy",
+				ValueThreshold: 1024,
+				GCInterval:     5 * time.Minute,
+				GCDiscardRatio: 0.5,
+			},
+		},
+		TransactionLog: TransactionLogConfig{
+			Backend:    "file",
+			Durability: "async",
+			File:       "transaction.log",
+			Fsync: FsyncPolicy{
+				Mode:     FsyncNever,
+				Events:   100,
+				Interval: time.Second,
+			},
+			Batch: BatchPolicy{
+				MaxEvents: 256,
+			},
+			Queue: QueuePolicy{
+				Size:   16,
+				Policy: "block",
+			},
+			Postgres: PostgresConfig{
+				Host:    "localhost",
+				DBName:  "kvs",
+				User:    "postgres",
+				SSLMode: "disable",
+			},
+			S3: S3Config{
+				Endpoint:        "https://s3.amazonaws.com",
+				Region:          "us-east-1",
+				Prefix:          "kvs/",
+				SegmentInterval: 5 * time.Second,
+				CompactSegments: 100,
+			},
+			NATS: NATSConfig{
+				URL:      "nats://127.0.0.1:4222",
+				Stream:   "KVS",
+				Subject:  "kvs.log",
+				Replicas: 1,
+			},
+		},
+		Auth: AuthConfig{
+			OIDC: OIDCConfig{
+				ScopeClaim: "scope",
+				ReadScope:  "read",
+				WriteScope: "write",
+				AdminScope: "admin",
+			},
+		},
+		TLS: TLSConfig{
+			AutocertCache: "certs",
+		},
+		Limits: LimitsConfig{
+			ListDefault:   100,
+			ListMax:       1000,
+			BatchMaxOps:   1000,
+			MaxKeyBytes:   1024,
+			MaxValueBytes: 1 << 20,
+			MaxBodyBytes:  64 << 20,
+			CursorMaxKeys: 100000,
+			MaxCursors:    100,
+			CursorTTL:     5 * time.Minute,
+		},
+		Keys: KeysConfig{
+			Printable:       true,
+			RejectTraversal: true,
+		},
+		Idempotency: IdempotencyConfig{
+			Window:  24 * time.Hour,
+			MaxKeys: 10000,
+		},
+		Locks: LocksConfig{
+			DefaultTTL: 30 * time.Second,
+			MaxTTL:     10 * time.Minute,
+		},
+		Watch: WatchConfig{
+			BufferSize: 64,
+			KeepAlive:  15 * time.Second,
+		},
+		HotKeys: HotKeysConfig{
+			Tracked: 100,
+			Decay:   time.Minute,
+		},
+		Webhooks: WebhooksConfig{
+			Timeout:    5 * time.Second,
+			Retries:    5,
+			Backoff:    time.Second,
+			MaxBackoff: time.Minute,
+			QueueSize:  1000,
+		},
+		Audit: AuditConfig{
+			MaxSize:  100 << 20,
+			MaxFiles: 10,
+		},
+		GRPC: GRPCConfig{
+			Reflection: true,
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "json",
+		},
+		Tracing: TracingConfig{
+			ServiceName: "kvs",
+			SampleRatio: 1,
+		},
+		SlowLog: SlowLogConfig{
+			Entries: 128,
+		},
+		Replication: ReplicationConfig{
+			BufferEvents: 10000,
+			SessionWait:  time.Second,
+		},
+		Cluster: ClusterConfig{
+			VirtualNodes: cluster.DefaultVirtualNodes,
+		},
+	}
+
+	// Целевые бэкенды по умолчанию настроены как основные, но выключены.
+	c.Migration.Store, c.Migration.TransactionLog = c.Store, c.TransactionLog
+	c.Migration.Store.Backend, c.Migration.TransactionLog.Backend = "", ""
+
+	return c
+}
+
+// setting ties a command-line flag to its environment variable.
+type setting struct {
+	flag string
+	env  string
+}
+
+// bindSettings registers a flag for every field of c on fs and returns
+// the flag-to-environment mapping.
+func (c *Config) bindSettings(fs *flag.FlagSet) []setting {
+	var settings []setting
+
+	str := func(p *string, name, env, usage string) {
+		fs.StringVar(p, name, *p, usage)
+		settings = append(settings, setting{name, env})
+	}
+	integer := func(p *int, name, env, usage string) {
+		fs.IntVar(p, name, *p, usage)
+		settings = append(settings, setting{name, env})
+	}
+	duration := func(p *time.Duration, name, env, usage string) {
+		fs.DurationVar(p, name, *p, usage)
+		settings = append(settings, setting{name, env})
+	}
+	list := func(p *[]string, name, env, usage string) {
+		fs.Var((*listValue)(p), name, usage)
+		settings = append(settings, setting{name, env})
+	}
+
+	str(&c.Listen, "listen", "KVS_LISTEN", "HTTP listen address")
+	duration(&c.ShutdownTimeout, "shutdown-timeout", "KVS_SHUTDOWN_TIMEOUT", "time allowed for in-flight requests on shutdown")
+	duration(&c.RequestTimeout, "request-timeout", "KVS_REQUEST_TIMEOUT", "time allowed for one request, watch streams and snapshots excepted; 0 disables")
+	fs.BoolVar(&c.ReadOnly, "read-only", c.ReadOnly, "start in read-only mode, rejecting writes")
+	settings = append(settings, setting{"read-only", "KVS_READ_ONLY"})
+	fs.BoolVar(&c.VerifyLog, "verify-log", c.VerifyLog, "check the transaction log file, print a report and exit without starting the server")
+	settings = append(settings, setting{"verify-log", "KVS_VERIFY_LOG"})
+	fs.BoolVar(&c.RepairLog, "verify-log-repair", c.RepairLog, "with -verify-log, truncate the log file at its first corrupt event")
+	settings = append(settings, setting{"verify-log-repair", "KVS_VERIFY_LOG_REPAIR"})
+
+	duration(&c.HTTP.ReadHeaderTimeout, "http-read-header-timeout", "KVS_HTTP_READ_HEADER_TIMEOUT", "time allowed to read request headers; 0 disables")
+	duration(&c.HTTP.ReadTimeout, "http-read-timeout", "KVS_HTTP_READ_TIMEOUT", "time allowed to read a whole request, streaming routes excepted; 0 disables")
+	duration(&c.HTTP.WriteTimeout, "http-write-timeout", "KVS_HTTP_WRITE_TIMEOUT", "time allowed to write a response, streaming routes excepted; 0 disables")
+	duration(&c.HTTP.IdleTimeout, "http-idle-timeout", "KVS_HTTP_IDLE_TIMEOUT", "how long idle keep-alive connections stay open; 0 uses the read timeout")
+	integer(&c.HTTP.MaxHeaderBytes, "http-max-header-bytes", "KVS_HTTP_MAX_HEADER_BYTES", "maximum size of request headers in bytes")
+	integer(&c.HTTP.MaxConnections, "http-max-connections", "KVS_HTTP_MAX_CONNECTIONS", "open connections accepted at a time; 0 disables the limit")
+
+	list(&c.CORS.AllowedOrigins, "cors-allowed-origins", "KVS_CORS_ALLOWED_ORIGINS", `comma-separated origins browsers may call the API from, or "*"; empty disables CORS`)
+	list(&c.CORS.AllowedMethods, "cors-allowed-methods", "KVS_CORS_ALLOWED_METHODS", "comma-separated methods allowed in cross-origin requests")
+	list(&c.CORS.AllowedHeaders, "cors-allowed-headers", "KVS_CORS_ALLOWED_HEADERS", `comma-separated request headers allowed in cross-origin requests, or "*"`)
+	list(&c.CORS.ExposedHeaders, "cors-exposed-headers", "KVS_CORS_EXPOSED_HEADERS", "comma-separated response headers cross-origin scripts may read")
+	fs.BoolVar(&c.CORS.AllowCredentials, "cors-allow-credentials", c.CORS.AllowCredentials, "allow cross-origin requests to carry credentials")
+	settings = append(settings, setting{"cors-allow-credentials", "KVS_CORS_ALLOW_CREDENTIALS"})
+	duration(&c.CORS.MaxAge, "cors-max-age", "KVS_CORS_MAX_AGE", "how long browsers may cache a preflight response")
+	fs.BoolVar(&c.ServeDuringReplay, "serve-during-replay", c.ServeDuringReplay, "serve reads of keys while the transaction log is replayed, from a partially rebuilt store")
+	settings = append(settings, setting{"serve-during-replay", "KVS_SERVE_DURING_REPLAY"})
+
+	str(&c.Admin.Listen, "admin-listen", "KVS_ADMIN_LISTEN", "listen address of the stats, snapshot, compaction, read-only, reload and pprof endpoints; empty serves them on the HTTP listen address")
+
+	str(&c.Store.Backend, "store-backend", "STORE_BACKEND", `store backend: "memory", "bbolt", "badger" or "sqlite"`)
+	str(&c.Store.Path, "store-path", "STORE_PATH", "database file of the bbolt and sqlite store backends, or directory of the badger one")
+	integer(&c.Store.Shards, "store-shards", "STORE_SHARDS", "number of in-memory store shards")
+	duration(&c.Store.ReapInterval, "store-reap-interval", "STORE_REAP_INTERVAL", "how often expired keys are evicted")
+	integer(&c.Store.CompressThreshold, "store-compress-threshold", "STORE_COMPRESS_THRESHOLD", "keep values of at least this many bytes compressed in memory; 0 disables")
+	integer(&c.Store.HistoryDepth, "store-history", "STORE_HISTORY", "previous revisions of each key kept for GET ?rev=N and the history listing; 0 disables")
+	fs.BoolVar(&c.Store.Checksums, "store-checksums", c.Store.Checksums, "keep the SHA-256 of every value, check it on reads and repair a mismatch from the transaction log")
+	settings = append(settings, setting{"store-checksums", "STORE_CHECKSUMS"})
+	duration(&c.Store.TombstoneRetention, "store-tombstone-retention", "STORE_TOMBSTONE_RETENTION", "how long deleted keys can be undeleted; 0 deletes them for good at once")
+	duration(&c.Store.DefaultTTL, "store-default-ttl", "STORE_DEFAULT_TTL", "time to live of keys put over HTTP without a ttl; 0 keeps them")
+	integer(&c.Store.MaxKeys, "store-max-keys", "STORE_MAX_KEYS", "evict least recently used keys beyond this many; 0 disables")
+	fs.Int64Var(&c.Store.MaxBytes, "store-max-bytes", c.Store.MaxBytes, "evict least recently used keys beyond this many key and value bytes; 0 disables")
+	settings = append(settings, setting{"store-max-bytes", "STORE_MAX_BYTES"})
+	fs.Int64Var(&c.Store.MaxMemory, "store-max-memory", c.Store.MaxMemory, "approximate memory the keys may take, overhead included; 0 disables")
+	settings = append(settings, setting{"store-max-memory", "STORE_MAX_MEMORY"})
+	str(&c.Store.Conflicts, "store-conflicts", "STORE_CONFLICTS", `PUT to an existing key without a revision in If-Match: "overwrite" it, the last writer winning, or "reject" it with 428`)
+	str(&c.Store.MemoryPolicy, "store-memory-policy", "STORE_MEMORY_POLICY", `at the max memory: "reject" writes with 507 or "evict" least recently used keys`)
+	list(&c.Store.Quotas, "store-quotas", "STORE_QUOTAS", `comma-separated bucket quotas "prefix:max_keys:max_bytes", e.g. "team-a/:10000:104857600"; 0 disables a bound`)
+	list(&c.Store.Indexes, "store-indexes", "STORE_INDEXES", `comma-separated dotted fields of JSON values to look keys up by, e.g. "user.email"`)
+	fs.BoolVar(&c.Store.LogEvictions, "store-log-evictions", c.Store.LogEvictions, "record evictions in the transaction log")
+	settings = append(settings, setting{"store-log-evictions", "STORE_LOG_EVICTIONS"})
+	str(&c.Store.Upstream.URL, "store-upstream-url", "STORE_UPSTREAM_URL", `URL prefix of the keys of an upstream key-value HTTP API to cache, e.g. "http://db:8080/v1/key/"; empty disables`)
+	str(&c.Store.Upstream.APIKey, "store-upstream-api-key", "STORE_UPSTREAM_API_KEY", "bearer token of the requests to the upstream")
+	duration(&c.Store.Upstream.TTL, "store-upstream-ttl", "STORE_UPSTREAM_TTL", "how long keys read from the upstream are cached, at most; 0 keeps them until evicted")
+	duration(&c.Store.Upstream.Timeout, "store-upstream-timeout", "STORE_UPSTREAM_TIMEOUT", "time limit of a request to the upstream")
+
+	fs.BoolVar(&c.Store.Badger.InMemory, "store-badger-in-memory", c.Store.Badger.InMemory, "keep the badger store in memory only, rebuilt from the transaction log at startup")
+	settings = append(settings, setting{"store-badger-in-memory", "STORE_BADGER_IN_MEMORY"})
+	str(&c.Store.Badger.Compression, "store-badger-compression", "STORE_BADGER_COMPRESSION", `badger block compression: "none", "snappy" or "zstd"`)
+	fs.Int64Var(&c.Store.Badger.ValueThreshold, "store-badger-value-threshold", c.Store.Badger.ValueThreshold, "values longer than this many bytes go to the badger value log")
+	settings = append(settings, setting{"store-badger-value-threshold", "STORE_BADGER_VALUE_THRESHOLD"})
+	duration(&c.Store.Badger.GCInterval, "store-badger-gc-interval", "STORE_BADGER_GC_INTERVAL", "how often the badger value log is garbage-collected; 0 disables")
+	fs.Float64Var(&c.Store.Badger.GCDiscardRatio, "store-badger-gc-discard-ratio", c.Store.Badger.GCDiscardRatio, "fraction of stale values at which a badger value log file is rewritten")
+	settings = append(settings, setting{"store-badger-gc-discard-ratio", "STORE_BADGER_GC_DISCARD_RATIO"})
+
+	str(&c.TransactionLog.Backend, "tlog-backend", "TLOG_BACKEND", `transaction log backend: "file", "postgres", "s3", "kafka", "nats" or "none"`)
+	str(&c.TransactionLog.Durability, "tlog-durability", "TLOG_DURABILITY", `acknowledge writes "async" or after fsync ("sync"); X-Durability overrides it per request`)
+	fs.BoolVar(&c.TransactionLog.Strict, "strict", c.TransactionLog.Strict, "refuse to start with a corrupt log file instead of truncating it at the first corrupt event")
+	settings = append(settings, setting{"strict", "TLOG_STRICT"})
+	str(&c.TransactionLog.File, "tlog-file", "TLOG_FILE", "transaction log file path")
+	integer(&c.TransactionLog.CompressThreshold, "tlog-compress-threshold", "TLOG_COMPRESS_THRESHOLD", "compress logged values of at least this many bytes; 0 disables")
+	fs.Int64Var(&c.TransactionLog.Compaction.MaxSize, "tlog-compact-size", c.TransactionLog.Compaction.MaxSize, "compact the log file when it reaches this many bytes")
+	settings = append(settings, setting{"tlog-compact-size", "TLOG_COMPACT_SIZE"})
+	fs.Uint64Var(&c.TransactionLog.Compaction.MaxEvents, "tlog-compact-events", c.TransactionLog.Compaction.MaxEvents, "compact the log file after this many events")
+	settings = append(settings, setting{"tlog-compact-events", "TLOG_COMPACT_EVENTS"})
+	duration(&c.TransactionLog.Compaction.Interval, "tlog-compact-interval", "TLOG_COMPACT_INTERVAL", "compact the log file on this schedule")
+	fs.Int64Var(&c.TransactionLog.Rotation.MaxSize, "tlog-rotate-size", c.TransactionLog.Rotation.MaxSize, "start a new log segment when the log file reaches this many bytes; 0 disables")
+	settings = append(settings, setting{"tlog-rotate-size", "TLOG_ROTATE_SIZE"})
+	duration(&c.TransactionLog.Rotation.Interval, "tlog-rotate-interval", "TLOG_ROTATE_INTERVAL", "start a new log segment on this schedule; 0 disables")
+	str(&c.TransactionLog.Snapshot.File, "tlog-snapshot-file", "TLOG_SNAPSHOT_FILE", "snapshot file replacing the log before it; empty is the log file path with the .snapshot extension")
+	duration(&c.TransactionLog.Snapshot.Interval, "tlog-snapshot-interval", "TLOG_SNAPSHOT_INTERVAL", "snapshot the store and drop the log segments it holds on this schedule; 0 disables")
+	fs.Uint64Var(&c.TransactionLog.Snapshot.Events, "tlog-snapshot-events", c.TransactionLog.Snapshot.Events, "snapshot the store after this many events; 0 disables")
+	settings = append(settings, setting{"tlog-snapshot-events", "TLOG_SNAPSHOT_EVENTS"})
+	str(&c.TransactionLog.Fsync.Mode, "tlog-fsync", "TLOG_FSYNC", `fsync the log file "always", every N "events", every "interval" or "never"`)
+	fs.Uint64Var(&c.TransactionLog.Fsync.Events, "tlog-fsync-events", c.TransactionLog.Fsync.Events, `events between fsyncs in "events" mode`)
+	settings = append(settings, setting{"tlog-fsync-events", "TLOG_FSYNC_EVENTS"})
+	duration(&c.TransactionLog.Fsync.Interval, "tlog-fsync-interval", "TLOG_FSYNC_INTERVAL", `time between fsyncs in "interval" mode`)
+	duration(&c.TransactionLog.Batch.Window, "tlog-batch-window", "TLOG_BATCH_WINDOW", "time to wait for more events to write and fsync together; 0 only groups queued events")
+	integer(&c.TransactionLog.Batch.MaxEvents, "tlog-batch-max-events", "TLOG_BATCH_MAX_EVENTS", "most events written and fsynced together")
+	integer(&c.TransactionLog.Queue.Size, "tlog-queue-size", "TLOG_QUEUE_SIZE", "events queued for the logger; the file log queues at least a batch")
+	str(&c.TransactionLog.Queue.Policy, "tlog-queue-policy", "TLOG_QUEUE_POLICY", `when the log queue is full, "block" writes or "reject" them with 503`)
+	duration(&c.TransactionLog.Queue.Timeout, "tlog-queue-timeout", "TLOG_QUEUE_TIMEOUT", `longest a write blocks for room in the log queue before 503; 0 waits indefinitely`)
+	str(&c.TransactionLog.Encryption.Key, "tlog-encryption-key", "TLOG_ENCRYPTION_KEY", "base64 AES-256 key encrypting the log file and snapshots")
+	str(&c.TransactionLog.Encryption.KeyFile, "tlog-encryption-key-file", "TLOG_ENCRYPTION_KEY_FILE", "file holding the base64 encryption key")
+	str(&c.TransactionLog.Encryption.KeyCommand, "tlog-encryption-key-command", "TLOG_ENCRYPTION_KEY_COMMAND", "shell command printing the base64 encryption key")
+	str(&c.TransactionLog.Postgres.Host, "tlog-db-host", "TLOG_DB_HOST", "Postgres host")
+	str(&c.TransactionLog.Postgres.DBName, "tlog-db-name", "TLOG_DB_NAME", "Postgres database name")
+	str(&c.TransactionLog.Postgres.User, "tlog-db-user", "TLOG_DB_USER", "Postgres user")
+	str(&c.TransactionLog.Postgres.Password, "tlog-db-password", "TLOG_DB_PASSWORD", "Postgres password")
+	str(&c.TransactionLog.Postgres.SSLMode, "tlog-db-sslmode", "TLOG_DB_SSLMODE", "Postgres sslmode")
+	str(&c.TransactionLog.S3.Endpoint, "tlog-s3-endpoint", "TLOG_S3_ENDPOINT", "S3-compatible endpoint URL")
+	str(&c.TransactionLog.S3.Region, "tlog-s3-region", "TLOG_S3_REGION", "S3 region")
+	str(&c.TransactionLog.S3.Bucket, "tlog-s3-bucket", "TLOG_S3_BUCKET", "S3 bucket holding the log segments")
+	str(&c.TransactionLog.S3.Prefix, "tlog-s3-prefix", "TLOG_S3_PREFIX", "key prefix of the log segments")
+	str(&c.TransactionLog.S3.AccessKey, "tlog-s3-access-key", "TLOG_S3_ACCESS_KEY", "S3 access key ID")
+	str(&c.TransactionLog.S3.SecretKey, "tlog-s3-secret-key", "TLOG_S3_SECRET_KEY", "S3 secret access key")
+	duration(&c.TransactionLog.S3.SegmentInterval, "tlog-s3-segment-interval", "TLOG_S3_SEGMENT_INTERVAL", "how often buffered events are uploaded as a segment")
+	integer(&c.TransactionLog.S3.CompactSegments, "tlog-s3-compact-segments", "TLOG_S3_COMPACT_SEGMENTS", "fold the segments into one after this many uploads; 0 disables")
+	list(&c.TransactionLog.Kafka.Brokers, "tlog-kafka-brokers", "TLOG_KAFKA_BROKERS", "comma-separated host:port Kafka brokers")
+	str(&c.TransactionLog.Kafka.Topic, "tlog-kafka-topic", "TLOG_KAFKA_TOPIC", "Kafka topic whose first partition holds the log")
+	str(&c.TransactionLog.Kafka.OffsetFile, "tlog-kafka-offset-file", "TLOG_KAFKA_OFFSET_FILE", "file recording the end of the Kafka log at shutdown, for a persistent store to resume replay from; empty replays from the beginning")
+	str(&c.TransactionLog.NATS.URL, "tlog-nats-url", "TLOG_NATS_URL", "comma-separated NATS server URLs")
+	str(&c.TransactionLog.NATS.Stream, "tlog-nats-stream", "TLOG_NATS_STREAM", "JetStream stream holding the log, created if missing")
+	str(&c.TransactionLog.NATS.Subject, "tlog-nats-subject", "TLOG_NATS_SUBJECT", "subject the events are published to")
+	integer(&c.TransactionLog.NATS.Replicas, "tlog-nats-replicas", "TLOG_NATS_REPLICAS", "replicas of the stream in the JetStream cluster")
+	str(&c.TransactionLog.NATS.Credentials, "tlog-nats-credentials", "TLOG_NATS_CREDENTIALS", "NATS credentials file")
+
+	list(&c.Auth.APIKeys, "auth-api-keys", "AUTH_API_KEYS", `comma-separated "name:key:ro|rw|admin" API keys`)
+	str(&c.Auth.JWTSecret, "auth-jwt-secret", "AUTH_JWT_SECRET", "HS256 secret for JWT bearer tokens")
+	str(&c.Auth.UsersFile, "auth-users-file", "AUTH_USERS_FILE", `file of "name:bcrypt-hash[:ro|rw|admin]" users for HTTP Basic authentication`)
+	str(&c.Auth.OIDC.Issuer, "auth-oidc-issuer", "AUTH_OIDC_ISSUER", "OpenID Connect issuer URL whose tokens are accepted")
+	str(&c.Auth.OIDC.Audience, "auth-oidc-audience", "AUTH_OIDC_AUDIENCE", "audience required in OIDC tokens; empty accepts any")
+	str(&c.Auth.OIDC.ScopeClaim, "auth-oidc-scope-claim", "AUTH_OIDC_SCOPE_CLAIM", "OIDC token claim listing the granted scopes")
+	str(&c.Auth.OIDC.ReadScope, "auth-oidc-read-scope", "AUTH_OIDC_READ_SCOPE", "OIDC scope granting read permission")
+	str(&c.Auth.OIDC.WriteScope, "auth-oidc-write-scope", "AUTH_OIDC_WRITE_SCOPE", "OIDC scope granting write permission")
+	str(&c.Auth.OIDC.AdminScope, "auth-oidc-admin-scope", "AUTH_OIDC_ADMIN_SCOPE", "OIDC scope granting admin permission")
+	str(&c.Auth.LDAP.URL, "auth-ldap-url", "AUTH_LDAP_URL", "LDAP server checking HTTP Basic passwords")
+	str(&c.Auth.LDAP.UserDN, "auth-ldap-user-dn", "AUTH_LDAP_USER_DN", `DN template of LDAP users, such as "uid=%s,ou=people,dc=example,dc=com"`)
+	str(&c.Auth.LDAP.WriteGroup, "auth-ldap-write-group", "AUTH_LDAP_WRITE_GROUP", "DN of the LDAP group whose members may write; empty lets every user write")
+	str(&c.Auth.LDAP.AdminGroup, "auth-ldap-admin-group", "AUTH_LDAP_ADMIN_GROUP", "DN of the LDAP group whose members have admin permission")
+	fs.BoolVar(&c.Auth.ACL.Enabled, "auth-acl", c.Auth.ACL.Enabled, "check requests against the per-prefix ACLs stored under the _acl: keys")
+	settings = append(settings, setting{"auth-acl", "AUTH_ACL"})
+	list(&c.Auth.ACL.Admins, "auth-acl-admins", "AUTH_ACL_ADMINS", "comma-separated principals holding every permission regardless of the ACLs")
+
+	str(&c.TLS.CertFile, "tls-cert-file", "TLS_CERT_FILE", "TLS certificate file")
+	str(&c.TLS.KeyFile, "tls-key-file", "TLS_KEY_FILE", "TLS private key file")
+	list(&c.TLS.AutocertHosts, "tls-autocert-hosts", "TLS_AUTOCERT_HOSTS", "comma-separated hosts to obtain Let's Encrypt certificates for")
+	str(&c.TLS.AutocertCache, "tls-autocert-cache", "TLS_AUTOCERT_CACHE", "directory for cached Let's Encrypt certificates")
+	str(&c.TLS.ClientCAFile, "tls-client-ca-file", "TLS_CLIENT_CA_FILE", "require client certificates signed by these CAs")
+
+	integer(&c.Limits.ListDefault, "list-default-limit", "KVS_LIST_DEFAULT_LIMIT", "default page size of the keys listing")
+	integer(&c.Limits.ListMax, "list-max-limit", "KVS_LIST_MAX_LIMIT", "maximum page size of the keys listing")
+	integer(&c.Limits.BatchMaxOps, "batch-max-ops", "KVS_BATCH_MAX_OPS", "maximum operations in one batch request")
+	integer(&c.Limits.MaxKeyBytes, "max-key-bytes", "KVS_MAX_KEY_BYTES", "maximum key length in bytes")
+	fs.Int64Var(&c.Limits.MaxValueBytes, "max-value-bytes", c.Limits.MaxValueBytes, "maximum value size in bytes")
+	settings = append(settings, setting{"max-value-bytes", "KVS_MAX_VALUE_BYTES"})
+	fs.Int64Var(&c.Limits.MaxBodyBytes, "max-body-bytes", c.Limits.MaxBodyBytes, "maximum batch and restore request body size in bytes")
+	settings = append(settings, setting{"max-body-bytes", "KVS_MAX_BODY_BYTES"})
+	integer(&c.Limits.CursorMaxKeys, "cursor-max-keys", "KVS_CURSOR_MAX_KEYS", "most keys a listing may have to be scanned with ?snapshot=true")
+	integer(&c.Limits.MaxCursors, "max-cursors", "KVS_MAX_CURSORS", "most snapshot scans kept at once")
+	duration(&c.Limits.CursorTTL, "cursor-ttl", "KVS_CURSOR_TTL", "time a snapshot scan is kept without a page being read")
+
+	str(&c.Keys.Pattern, "key-pattern", "KVS_KEY_PATTERN", `regular expression written keys must match as a whole, e.g. "[a-z0-9/_.-]+"; empty allows any`)
+	fs.BoolVar(&c.Keys.Printable, "key-printable", c.Keys.Printable, "refuse to write keys that are not UTF-8 or contain control characters")
+	settings = append(settings, setting{"key-printable", "KVS_KEY_PRINTABLE"})
+	fs.BoolVar(&c.Keys.RejectTraversal, "key-reject-traversal", c.Keys.RejectTraversal, `refuse to write keys with a "." or ".." segment between slashes`)
+	settings = append(settings, setting{"key-reject-traversal", "KVS_KEY_REJECT_TRAVERSAL"})
+	fs.BoolVar(&c.Keys.Lowercase, "key-lowercase", c.Keys.Lowercase, "lowercase the keys, prefixes and bounds of every request")
+	settings = append(settings, setting{"key-lowercase", "KVS_KEY_LOWERCASE"})
+	fs.BoolVar(&c.Keys.Trim, "key-trim", c.Keys.Trim, "trim the spaces around the keys of every request")
+	settings = append(settings, setting{"key-trim", "KVS_KEY_TRIM"})
+
+	fs.Float64Var(&c.RateLimit.GlobalRate, "rate-limit-global", c.RateLimit.GlobalRate, "requests per second allowed across all clients; 0 disables")
+	settings = append(settings, setting{"rate-limit-global", "KVS_RATE_LIMIT_GLOBAL"})
+	integer(&c.RateLimit.GlobalBurst, "rate-limit-global-burst", "KVS_RATE_LIMIT_GLOBAL_BURST", "burst size of the global rate limit")
+	fs.Float64Var(&c.RateLimit.ClientRate, "rate-limit-client", c.RateLimit.ClientRate, "requests per second allowed per API key or IP address; 0 disables")
+	settings = append(settings, setting{"rate-limit-client", "KVS_RATE_LIMIT_CLIENT"})
+	integer(&c.RateLimit.ClientBurst, "rate-limit-client-burst", "KVS_RATE_LIMIT_CLIENT_BURST", "burst size of the per-client rate limit")
+	list(&c.RateLimit.Endpoints, "rate-limit-endpoints", "KVS_RATE_LIMIT_ENDPOINTS", `comma-separated per-client "path:rate:burst" endpoint limits`)
+
+	duration(&c.Idempotency.Window, "idempotency-window", "KVS_IDEMPOTENCY_WINDOW", "how long Idempotency-Key responses are remembered; 0 disables")
+	integer(&c.Idempotency.MaxKeys, "idempotency-max-keys", "KVS_IDEMPOTENCY_MAX_KEYS", "idempotency keys remembered before the oldest are forgotten")
+
+	duration(&c.Locks.DefaultTTL, "lock-default-ttl", "KVS_LOCK_DEFAULT_TTL", "lease of locks acquired without a ttl")
+	duration(&c.Locks.MaxTTL, "lock-max-ttl", "KVS_LOCK_MAX_TTL", "longest lease a lock can be acquired or renewed for")
+
+	integer(&c.Watch.BufferSize, "watch-buffer-size", "KVS_WATCH_BUFFER_SIZE", "events queued per watcher before it is dropped")
+	duration(&c.Watch.KeepAlive, "watch-keep-alive", "KVS_WATCH_KEEP_ALIVE", "keep-alive interval of watch streams")
+	integer(&c.HotKeys.Tracked, "hot-keys-tracked", "KVS_HOT_KEYS_TRACKED", "hottest keys kept by name for /v1/stats/hotkeys; 0 disables access counting")
+	duration(&c.HotKeys.Decay, "hot-keys-decay", "KVS_HOT_KEYS_DECAY", "how often the key access counts halve; 0 never")
+	list(&c.Webhooks.Targets, "webhook-targets", "KVS_WEBHOOK_TARGETS", `comma-separated "prefix=url" targets POSTed the changes of keys with the prefix`)
+	str(&c.Webhooks.Secret, "webhook-secret", "KVS_WEBHOOK_SECRET", "key signing webhook bodies with HMAC-SHA256; empty disables signing")
+	duration(&c.Webhooks.Timeout, "webhook-timeout", "KVS_WEBHOOK_TIMEOUT", "time allowed for one webhook delivery")
+	integer(&c.Webhooks.Retries, "webhook-retries", "KVS_WEBHOOK_RETRIES", "retries of a failed webhook delivery before it is dropped")
+	duration(&c.Webhooks.Backoff, "webhook-backoff", "KVS_WEBHOOK_BACKOFF", "pause before the first webhook retry, doubled on each one")
+	duration(&c.Webhooks.MaxBackoff, "webhook-max-backoff", "KVS_WEBHOOK_MAX_BACKOFF", "longest pause between webhook retries")
+	integer(&c.Webhooks.QueueSize, "webhook-queue-size", "KVS_WEBHOOK_QUEUE_SIZE", "changes queued per webhook target before new ones are dropped")
+	list(&c.Webhooks.Events, "webhook-events", "KVS_WEBHOOK_EVENTS", `comma-separated types of the changes sent to webhooks: "put", "delete", "expire", "evict"; empty sends all`)
+	fs.BoolVar(&c.Webhooks.ChangedOnly, "webhook-changed-only", c.Webhooks.ChangedOnly, "leave out of webhooks the puts that do not change the value of their key")
+	settings = append(settings, setting{"webhook-changed-only", "KVS_WEBHOOK_CHANGED_ONLY"})
+
+	str(&c.Audit.File, "audit-file", "KVS_AUDIT_FILE", "append-only audit log of the requests that change data; empty disables it")
+	fs.Int64Var(&c.Audit.MaxSize, "audit-max-size", c.Audit.MaxSize, "size in bytes at which a new audit log file is started; 0 disables rotation")
+	settings = append(settings, setting{"audit-max-size", "KVS_AUDIT_MAX_SIZE"})
+	integer(&c.Audit.MaxFiles, "audit-max-files", "KVS_AUDIT_MAX_FILES", "rotated audit log files kept; 0 keeps all")
+
+	str(&c.RESP.Listen, "resp-listen", "KVS_RESP_LISTEN", "Redis protocol listen address; empty disables it")
+	str(&c.Memcached.Listen, "memcached-listen", "KVS_MEMCACHED_LISTEN", "memcached text protocol listen address; empty disables it")
+	str(&c.GRPC.Listen, "grpc-listen", "KVS_GRPC_LISTEN", "gRPC listen address, in builds with the grpc tag; empty disables it")
+	fs.BoolVar(&c.GRPC.Reflection, "grpc-reflection", c.GRPC.Reflection, "serve gRPC server reflection, for tools such as grpcurl")
+	settings = append(settings, setting{"grpc-reflection", "KVS_GRPC_REFLECTION"})
+
+	str(&c.Log.Level, "log-level", "KVS_LOG_LEVEL", `log level: "debug", "info", "warn" or "error"`)
+	str(&c.Log.Format, "log-format", "KVS_LOG_FORMAT", `log format: "json" or "text"`)
+
+	str(&c.Tracing.Endpoint, "trace-endpoint", "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "OTLP/HTTP traces endpoint; empty disables tracing")
+	str(&c.Tracing.ServiceName, "trace-service-name", "OTEL_SERVICE_NAME", "service name reported in traces")
+	fs.Float64Var(&c.Tracing.SampleRatio, "trace-sample-ratio", c.Tracing.SampleRatio, "fraction of new traces that are sampled")
+	settings = append(settings, setting{"trace-sample-ratio", "KVS_TRACE_SAMPLE_RATIO"})
+	duration(&c.SlowLog.Threshold, "slow-log-threshold", "KVS_SLOW_LOG_THRESHOLD", "record the requests and commands taking longer, with the time of their phases, for /v1/slowlog; 0 disables")
+	integer(&c.SlowLog.Entries, "slow-log-entries", "KVS_SLOW_LOG_ENTRIES", "slow requests kept, the oldest forgotten first")
+
+	str(&c.Replication.Primary, "replicate-from", "KVS_REPLICATE_FROM", "URL of the primary server to replicate; empty runs as a primary")
+	str(&c.Replication.APIKey, "replication-api-key", "KVS_REPLICATION_API_KEY", "API key or JWT presented to the primary")
+	integer(&c.Replication.BufferEvents, "replication-buffer", "KVS_REPLICATION_BUFFER", "recent events kept for replicas that fall behind")
+	duration(&c.Replication.SessionWait, "replication-session-wait", "KVS_REPLICATION_SESSION_WAIT", "how long a replica waits to catch up with the X-Session-Token of a request before refusing it")
+
+	str(&c.Cluster.NodeID, "cluster-node-id", "KVS_CLUSTER_NODE_ID", "ID of this node among the cluster nodes")
+	list(&c.Cluster.Nodes, "cluster-nodes", "KVS_CLUSTER_NODES", `comma-separated "id=url" cluster nodes, this one included; empty disables clustering`)
+	integer(&c.Cluster.VirtualNodes, "cluster-virtual-nodes", "KVS_CLUSTER_VIRTUAL_NODES", "points of each node on the consistent hash ring")
+
+	str(&c.Migration.Store.Backend, "migration-store-backend", "MIGRATION_STORE_BACKEND", `store backend to migrate to, "bbolt", "badger" or "sqlite", written alongside the store; empty disables`)
+	str(&c.Migration.Store.Path, "migration-store-path", "MIGRATION_STORE_PATH", "database file or directory of the store migrated to")
+	str(&c.Migration.TransactionLog.Backend, "migration-tlog-backend", "MIGRATION_TLOG_BACKEND", `transaction log backend to migrate to, "file", "postgres", "s3", "kafka" or "nats", written alongside the log; empty disables`)
+	str(&c.Migration.TransactionLog.File, "migration-tlog-file", "MIGRATION_TLOG_FILE", "transaction log file migrated to")
+
+	return settings
+}
+
+// LoadConfig resolves the configuration from defaults, the config file,
+// the environment and args, in that order of precedence.
+func LoadConfig(args []string) (*Config, error) {
+	c := DefaultConfig()
+
+	fs := flag.NewFlagSet("kvs", flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("KVS_CONFIG"), "path to a YAML config file")
+	settings := c.bindSettings(fs)
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// Флаги применяются последними, поэтому запоминаем заданные явно.
+	explicit := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = f.Value.String() })
+
+	if *path != "" {
+		data, err := os.ReadFile(*path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %w", err)
+		}
+
+		if err := yaml.Unmarshal(data, c); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %w", *path, err)
+		}
+	}
+
+	for _, s := range settings {
+		if value, ok := os.LookupEnv(s.env); ok {
+			if err := fs.Set(s.flag, value); err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", s.env, err)
+			}
+		}
+	}
+
+	for name, value := range explicit {
+		if name == "config" {
+			continue
+		}
+
+		if err := fs.Set(name, value); err != nil {
+			return nil, fmt.Errorf("invalid -%s: %w", name, err)
+		}
+	}
+
+	return c, c.Validate()
+}
+
+func (c *Config) Validate() error {
+	var errs []string
+
+	if c.RequestTimeout < 0 {
+		errs = append(errs, "request timeout must not be negative")
+	}
+
+	if h := c.HTTP; h.ReadHeaderTimeout < 0 || h.ReadTimeout < 0 || h.WriteTimeout < 0 || h.IdleTimeout < 0 {
+		errs = append(errs, "http timeouts must not be negative")
+	}
+
+	if c.HTTP.MaxHeaderBytes < 0 || c.HTTP.MaxConnections < 0 {
+		errs = append(errs, "http header size and connection limits must not be negative")
+	}
+
+	if w := c.HTTP.WriteTimeout; w > 0 && c.RequestTimeout >= w {
+		errs = append(errs, "http write timeout must be longer than the request timeout, or the timeout response cannot be written")
+	}
+
+	if c.RepairLog && !c.VerifyLog {
+		errs = append(errs, "-verify-log-repair requires -verify-log")
+	}
+
+	if c.Admin.Listen != "" && c.Admin.Listen == c.Listen {
+		errs = append(errs, "the admin listen address must differ from the HTTP listen address")
+	}
+
+	if c.Store.Shards < 1 {
+		errs = append(errs, "store shards must be at least 1")
+	}
+
+	if c.Store.ReapInterval <= 0 {
+		errs = append(errs, "store reap interval must be positive")
+	}
+
+	if c.Store.MaxKeys < 0 || c.Store.MaxBytes < 0 || c.Store.MaxMemory < 0 {
+		errs = append(errs, "store max keys, max bytes and max memory must not be negative")
+	}
+
+	if m := c.Store.Conflicts; m != "overwrite" && m != "reject" {
+		errs = append(errs, `store conflicts must be "overwrite" or "reject"`)
+	}
+
+	if p := c.Store.MemoryPolicy; p != "reject" && p != "evict" {
+		errs = append(errs, `store memory policy must be "reject" or "evict"`)
+	}
+
+	indexes := make(map[string]bool, len(c.Store.Indexes))
+	for _, field := range c.Store.Indexes {
+		if !validIndexField(field) {
+			errs = append(errs, fmt.Sprintf("store index %q must be dotted field names without / ? #", field))
+		} else if indexes[field] {
+			errs = append(errs, fmt.Sprintf("store index %q is listed twice", field))
+		}
+
+		indexes[field] = true
+	}
+
+	buckets := make(map[string]bool, len(c.Store.Quotas))
+	for _, entry := range c.Store.Quotas {
+		if b, err := parseQuota(entry); err != nil {
+			errs = append(errs, err.Error())
+		} else if buckets[b.prefix] {
+			errs = append(errs, fmt.Sprintf("store quota of bucket %q is listed twice", b.prefix))
+		} else {
+			buckets[b.prefix] = true
+		}
+	}
+
+	if b := c.Store.Backend; b == "bbolt" || b == "badger" || b == "sqlite" {
+		if c.Store.Path == "" && !(b == "badger" && c.Store.Badger.InMemory) {
+			errs = append(errs, "the bbolt, badger and sqlite store backends need a path")
+		}
+
+		if c.Store.MaxKeys > 0 || c.Store.MaxBytes > 0 || c.Store.MaxMemory > 0 {
+			errs = append(errs, "store max keys, max bytes and max memory require the memory store backend")
+		}
+	}
+
+	if bg := c.Store.Badger; c.Store.Backend == "badger" {
+		if z := bg.Compression; z != "none" && z != "snappy" && z != "zstd" {
+			errs = append(errs, `badger compression must be "none", "snappy" or "zstd"`)
+		}
+
+		if bg.ValueThreshold < 0 || bg.GCInterval < 0 {
+			errs = append(errs, "badger value threshold and gc interval must not be negative")
+		}
+
+		if bg.GCInterval > 0 && (bg.GCDiscardRatio <= 0 || bg.GCDiscardRatio >= 1) {
+			errs = append(errs, "badger gc discard ratio must be between 0 and 1")
+		}
+	}
+
+	if b := c.Store.Backend; c.TransactionLog.Backend == "none" && b != "bbolt" && b != "sqlite" && (b != "badger" || c.Store.Badger.InMemory) {
+		errs = append(errs, `the "none" transaction log backend requires a persistent store backend`)
+	}
+
+	if c.Store.CompressThreshold < 0 {
+		errs = append(errs, "store compress threshold must not be negative")
+	}
+
+	if c.Store.HistoryDepth < 0 {
+		errs = append(errs, "store history depth must not be negative")
+	}
+
+	if c.Store.TombstoneRetention < 0 {
+		errs = append(errs, "store tombstone retention must not be negative")
+	}
+
+	if c.Store.DefaultTTL < 0 {
+		errs = append(errs, "store default ttl must not be negative")
+	}
+
+	if u := c.Store.Upstream; u.URL != "" {
+		if !strings.HasPrefix(u.URL, "http://") && !strings.HasPrefix(u.URL, "https://") {
+			errs = append(errs, "the store upstream must be an http or https URL")
+		}
+
+		if u.TTL < 0 || u.Timeout < 0 {
+			errs = append(errs, "store upstream ttl and timeout must not be negative")
+		}
+	}
+
+	if d := c.TransactionLog.Durability; d != "async" && d != "sync" {
+		errs = append(errs, `transaction log durability must be "async" or "sync"`)
+	}
+
+	if t := c.TransactionLog.CompressThreshold; t != 0 {
+		if t < 0 {
+			errs = append(errs, "transaction log compress threshold must not be negative")
+		}
+
+		if b := c.TransactionLog.Backend; b != "file" && b != "s3" && b != "kafka" && b != "nats" {
+			errs = append(errs, "transaction log compression requires the file, s3, kafka or nats backend")
+		}
+	}
+
+	if e := c.TransactionLog.Encryption; e != (EncryptionConfig{}) {
+		sources := 0
+		for _, s := range []string{e.Key, e.KeyFile, e.KeyCommand} {
+			if s != "" {
+				sources++
+			}
+		}
+
+		if sources > 1 {
+			errs = append(errs, "only one encryption key source may be set")
+		}
+
+		if b := c.TransactionLog.Backend; b != "file" && b != "s3" && b != "kafka" && b != "nats" {
+			errs = append(errs, "transaction log encryption requires the file, s3, kafka or nats backend")
+		}
+	}
+
+	if s3 := c.TransactionLog.S3; c.TransactionLog.Backend == "s3" {
+		if s3.Bucket == "" {
+			errs = append(errs, "the s3 backend needs a bucket")
+		}
+
+		if s3.SegmentInterval <= 0 || s3.CompactSegments < 0 {
+			errs = append(errs, "s3 segment interval must be positive and compact segments not negative")
+		}
+	}
+
+	if k := c.TransactionLog.Kafka; c.TransactionLog.Backend == "kafka" && (len(k.Brokers) == 0 || k.Topic == "") {
+		errs = append(errs, "the kafka backend needs brokers and a topic")
+	}
+
+	if n := c.TransactionLog.NATS; c.TransactionLog.Backend == "nats" {
+		if n.URL == "" || n.Stream == "" || n.Subject == "" {
+			errs = append(errs, "the nats backend needs a URL, a stream and a subject")
+		}
+
+		if n.Replicas < 1 || n.Replicas > 5 {
+			errs = append(errs, "nats stream replicas must be between 1 and 5")
+		}
+	}
+
+	if r := c.TransactionLog.Rotation; r.MaxSize < 0 || r.Interval < 0 {
+		errs = append(errs, "log rotation size and interval must not be negative")
+	}
+
+	if p := c.TransactionLog.Snapshot; p.Interval < 0 {
+		errs = append(errs, "log snapshot interval must not be negative")
+	} else if p.enabled() {
+		if c.TransactionLog.Backend != "file" {
+			errs = append(errs, "log snapshots require the file transaction log backend")
+		}
+
+		if b := c.Store.Backend; b == "bbolt" || b == "badger" || b == "sqlite" {
+			errs = append(errs, "log snapshots require the memory store backend")
+		}
+	}
+
+	if err := c.TransactionLog.Fsync.Validate(); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if err := c.TransactionLog.Queue.Validate(); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if c.Limits.ListDefault < 1 || c.Limits.ListMax < c.Limits.ListDefault {
+		errs = append(errs, "list limits must satisfy 1 <= default <= max")
+	}
+
+	if c.Limits.CursorMaxKeys < 1 || c.Limits.MaxCursors < 1 || c.Limits.CursorTTL <= 0 {
+		errs = append(errs, "cursor max keys, max cursors and cursor ttl must be positive")
+	}
+
+	if c.Limits.BatchMaxOps < 1 {
+		errs = append(errs, "batch max ops must be at least 1")
+	}
+
+	if c.Limits.MaxKeyBytes < 1 || c.Limits.MaxValueBytes < 1 || c.Limits.MaxBodyBytes < 1 {
+		errs = append(errs, "key, value and body size limits must be positive")
+	}
+
+	if _, err := c.Keys.compile(); err != nil {
+		errs = append(errs, "invalid key pattern: "+err.Error())
+	}
+
+	for _, origin := range c.CORS.AllowedOrigins {
+		if origin != corsWildcard && !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://") {
+			errs = append(errs, fmt.Sprintf("invalid CORS origin %q: want scheme://host[:port] or *", origin))
+		}
+	}
+
+	if len(c.CORS.AllowedOrigins) > 0 && len(c.CORS.AllowedMethods) == 0 {
+		errs = append(errs, "CORS needs at least one allowed method")
+	}
+
+	if c.CORS.MaxAge < 0 {
+		errs = append(errs, "CORS max age must not be negative")
+	}
+
+	if rl := c.RateLimit; rl.GlobalRate < 0 || rl.ClientRate < 0 || rl.GlobalBurst < 0 || rl.ClientBurst < 0 {
+		errs = append(errs, "rate limits and bursts must not be negative")
+	}
+
+	for _, entry := range c.RateLimit.Endpoints {
+		if _, _, err := parseEndpointLimit(entry); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if c.Idempotency.Window < 0 || c.Idempotency.MaxKeys < 1 {
+		errs = append(errs, "idempotency window must not be negative and max keys must be at least 1")
+	}
+
+	if c.Locks.DefaultTTL <= 0 || c.Locks.DefaultTTL > c.Locks.MaxTTL {
+		errs = append(errs, "lock default ttl must be positive and not exceed the max ttl")
+	}
+
+	if c.Watch.BufferSize < 1 || c.Watch.KeepAlive <= 0 {
+		errs = append(errs, "watch buffer size and keep-alive must be positive")
+	}
+
+	if c.HotKeys.Tracked < 0 || c.HotKeys.Decay < 0 {
+		errs = append(errs, "hot keys tracked and decay must not be negative")
+	}
+
+	if wh := c.Webhooks; len(wh.Targets) > 0 {
+		if wh.Timeout <= 0 || wh.Backoff <= 0 || wh.MaxBackoff < wh.Backoff {
+			errs = append(errs, "webhook timeout and backoff must be positive, and max backoff at least the backoff")
+		}
+
+		if wh.Retries < 0 || wh.QueueSize < 1 {
+			errs = append(errs, "webhook retries must not be negative and the queue size must be at least 1")
+		}
+	}
+
+	if r := c.Tracing.SampleRatio; r < 0 || r > 1 {
+		errs = append(errs, "trace sample ratio must be between 0 and 1")
+	}
+
+	if c.SlowLog.Threshold < 0 || c.SlowLog.Entries < 1 {
+		errs = append(errs, "slow log threshold must not be negative and entries must be at least 1")
+	}
+
+	if c.Replication.BufferEvents < 1 {
+		errs = append(errs, "replication buffer must be at least 1")
+	}
+
+	if c.Replication.SessionWait < 0 {
+		errs = append(errs, "replication session wait must not be negative")
+	}
+
+	if p := c.Replication.Primary; p != "" && !strings.HasPrefix(p, "http://") && !strings.HasPrefix(p, "https://") {
+		errs = append(errs, "the primary to replicate must be an http or https URL")
+	}
+
+	if i := c.Auth.OIDC.Issuer; i != "" && !strings.HasPrefix(i, "https://") && !strings.HasPrefix(i, "http://") {
+		errs = append(errs, "the OIDC issuer must be an http or https URL")
+	}
+
+	if c.Auth.LDAP.URL != "" && strings.Count(c.Auth.LDAP.UserDN, "%s") != 1 {
+		errs = append(errs, "the LDAP user DN must contain %s once, for the user name")
+	}
+
+	if c.Audit.MaxSize < 0 || c.Audit.MaxFiles < 0 {
+		errs = append(errs, "audit log max size and max files must not be negative")
+	}
+
+	if c.Auth.ACL.Enabled && !c.Auth.enabled() {
+		errs = append(errs, "ACLs need an authentication provider")
+	}
+
+	if c.Memcached.Listen != "" && c.Auth.enabled() {
+		errs = append(errs, "the memcached listener has no authentication and cannot be enabled together with it")
+	}
+
+	if len(c.Cluster.Nodes) > 0 {
+		if _, err := c.Cluster.newRing(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if m := c.Migration.Store; m.Backend != "" {
+		if m.Backend != "bbolt" && m.Backend != "badger" && m.Backend != "sqlite" {
+			errs = append(errs, `the store to migrate to must be "bbolt", "badger" or "sqlite"`)
+		}
+
+		if m.Path == "" || (m.Path == c.Store.Path && c.Store.Backend != "memory") {
+			errs = append(errs, "the store to migrate to needs a path of its own")
+		}
+
+		if c.Store.MaxKeys > 0 || c.Store.MaxBytes > 0 || c.Store.MaxMemory > 0 {
+			errs = append(errs, "a store that evicts keys cannot be migrated")
+		}
+	}
+
+	if m := c.Migration.TransactionLog; m.Backend != "" {
+		switch m.Backend {
+		case "file", "postgres", "s3", "kafka", "nats":
+		default:
+			errs = append(errs, `the transaction log to migrate to must be "file", "postgres", "s3", "kafka" or "nats"`)
+		}
+
+		if m.Backend == "file" && c.TransactionLog.Backend == "file" && m.File == c.TransactionLog.File {
+			errs = append(errs, "the transaction log to migrate to needs a file of its own")
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// listValue is a flag.Value for comma-separated lists. Setting it
+// replaces the whole list.
+type listValue []string
+
+func (l *listValue) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listValue) Set(s string) error {
+	*l = nil
+
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,164 @@
+package kvs
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/**
+ * Cross-origin requests.
+ *
+ * With allowed origins configured, browsers may call the API from pages
+ * served elsewhere. A request whose Origin is allowed gets it back in
+ * Access-Control-Allow-Origin, together with the response headers scripts
+ * may read. Preflight OPTIONS requests to the /v1 and /v2 routes are
+ * answered here, ahead of authentication, since browsers send them
+ * without credentials: with 204 and the allowed methods and headers if
+ * the origin, the method and every requested header are allowed, with
+ * 403 otherwise. The origin "*" allows any; with credentials allowed the
+ * origin of the request is echoed instead, as browsers require.
+ */
+const corsWildcard = "*"
+
+type corsPolicy struct {
+	origins     map[string]bool
+	anyOrigin   bool
+	methods     map[string]bool
+	headers     map[string]bool
+	anyHeader   bool
+	credentials bool
+
+	allowMethods  string // Значения заголовков ответа
+	allowHeaders  string
+	exposeHeaders string
+	maxAge        string
+}
+
+func newCORSPolicy(c CORSConfig) *corsPolicy {
+	p := &corsPolicy{
+		origins:       make(map[string]bool, len(c.AllowedOrigins)),
+		methods:       make(map[string]bool, len(c.AllowedMethods)),
+		headers:       make(map[string]bool, len(c.AllowedHeaders)),
+		credentials:   c.AllowCredentials,
+		allowMethods:  strings.Join(c.AllowedMethods, ", "),
+		allowHeaders:  strings.Join(c.AllowedHeaders, ", "),
+		exposeHeaders: strings.Join(c.ExposedHeaders, ", "),
+	}
+
+	for _, origin := range c.AllowedOrigins {
+		p.anyOrigin = p.anyOrigin || origin == corsWildcard
+		p.origins[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+	}
+
+	for _, method := range c.AllowedMethods {
+		p.methods[strings.ToUpper(method)] = true
+	}
+
+	for _, header := range c.AllowedHeaders {
+		p.anyHeader = p.anyHeader || header == corsWildcard
+		p.headers[http.CanonicalHeaderKey(header)] = true
+	}
+
+	if c.MaxAge > 0 {
+		p.maxAge = strconv.Itoa(int(c.MaxAge.Seconds()))
+	}
+
+	return p
+}
+
+func (p *corsPolicy) originAllowed(origin string) bool {
+	return p.anyOrigin || p.origins[strings.ToLower(origin)]
+}
+
+// headersAllowed reports whether every header of an
+// Access-Control-Request-Headers list is allowed.
+func (p *corsPolicy) headersAllowed(requested string) bool {
+	if p.anyHeader {
+		return true
+	}
+
+	for _, header := range strings.Split(requested, ",") {
+		if header = strings.TrimSpace(header); header != "" && !p.headers[http.CanonicalHeaderKey(header)] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// allowOrigin sets the headers granting origin access to the response.
+func (p *corsPolicy) allowOrigin(h http.Header, origin string) {
+	if p.anyOrigin && !p.credentials {
+		h.Set("Access-Control-Allow-Origin", corsWildcard)
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+
+	if p.credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// isPreflight reports whether r is a CORS preflight request to the API.
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Origin") != "" && r.Header.Get("Access-Control-Request-Method") != "" &&
+		(strings.HasPrefix(r.URL.Path, "/v1/") || strings.HasPrefix(r.URL.Path, "/v2/"))
+}
+
+// withCORS answers preflight requests and marks the responses to allowed
+// origins; without allowed origins it returns next unchanged.
+func withCORS(c CORSConfig, next http.Handler) http.Handler {
+	if len(c.AllowedOrigins) == 0 {
+		return next
+	}
+
+	p := newCORSPolicy(c)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+
+		if isPreflight(r) {
+			h := w.Header()
+			h.Add("Vary", "Origin")
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+
+			method := r.Header.Get("Access-Control-Request-Method")
+			if !p.originAllowed(origin) || !p.methods[strings.ToUpper(method)] || !p.headersAllowed(r.Header.Get("Access-Control-Request-Headers")) {
+				http.Error(w, "CORS request not allowed", http.StatusForbidden)
+				return
+			}
+
+			p.allowOrigin(h, origin)
+			h.Set("Access-Control-Allow-Methods", p.allowMethods)
+
+			if requested := r.Header.Get("Access-Control-Request-Headers"); p.anyHeader && requested != "" {
+				h.Set("Access-Control-Allow-Headers", requested) // "*" не действует вместе с учётными данными
+			} else if p.allowHeaders != "" {
+				h.Set("Access-Control-Allow-Headers", p.allowHeaders)
+			}
+
+			if p.maxAge != "" {
+				h.Set("Access-Control-Max-Age", p.maxAge)
+			}
+
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if !p.anyOrigin || p.credentials {
+			w.Header().Add("Vary", "Origin") // Ответ зависит от источника
+		}
+
+		if origin != "" && p.originAllowed(origin) {
+			p.allowOrigin(w.Header(), origin)
+
+			if p.exposeHeaders != "" {
+				w.Header().Set("Access-Control-Expose-Headers", p.exposeHeaders)
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
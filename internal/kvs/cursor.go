@@ -0,0 +1,177 @@
+package kvs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * Listing cursors.
+ *
+ * GET /v1/keys and /v1/range page by key: the cursor is the last key of a
+ * page and the next page starts after it, so a key that exists throughout
+ * a scan is returned exactly once and in order, whatever is written
+ * meanwhile. Keys created or deleted during the scan may or may not be
+ * returned, and every page shows the values as they are when it is read.
+ * A cursor outside the prefix or range of the request is refused.
+ *
+ * With ?snapshot=true on its first page, a scan is instead served from a
+ * copy of the keys and values of the listing taken at once, and returns
+ * exactly the keys that existed then, with their values at the time. The
+ * copy is kept in memory, for listings of at most limits.cursor_max_keys
+ * keys, and its cursors, "<id>.<offset>", are only valid for the same
+ * listing: the copy is forgotten once its last page is served, after
+ * limits.cursor_ttl without a page, or when the server restarts, and the
+ * cursor then gets 410. At most limits.max_cursors copies are kept.
+ */
+var (
+	ErrorCursorExpired  = errors.New("Cursor expired")
+	ErrorCursorListing  = errors.New("Cursor belongs to another listing")
+	ErrorTooManyCursors = errors.New("Too many open snapshot cursors")
+	ErrorListingTooLong = errors.New("Listing too long for a snapshot cursor")
+)
+
+type snapshotCursor struct {
+	listing string  // Путь и границы списка
+	entries []Entry // Ключи в лексикографическом порядке со значениями
+	expires time.Time
+}
+
+type cursorRegistry struct {
+	mu      sync.Mutex
+	cursors map[string]*snapshotCursor
+}
+
+var cursors = cursorRegistry{cursors: make(map[string]*snapshotCursor)}
+
+// open keeps entries for a snapshot scan of listing and returns its id.
+func (c *cursorRegistry) open(listing string, entries []Entry, now time.Time) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for id, cursor := range c.cursors {
+		if !now.Before(cursor.expires) {
+			delete(c.cursors, id)
+		}
+	}
+
+	if len(c.cursors) >= config.Limits.MaxCursors {
+		return "", ErrorTooManyCursors
+	}
+
+	var b [16]byte
+	rand.Read(b[:])
+	id := hex.EncodeToString(b[:])
+
+	c.cursors[id] = &snapshotCursor{listing: listing, entries: entries, expires: now.Add(config.Limits.CursorTTL)}
+
+	return id, nil
+}
+
+// page returns the entries of the scan id from offset on, at most limit
+// of them, and whether more remain. The scan is forgotten after its last
+// page.
+func (c *cursorRegistry) page(id, listing string, offset, limit int, now time.Time) ([]Entry, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cursor, ok := c.cursors[id]
+	if !ok || !now.Before(cursor.expires) {
+		delete(c.cursors, id)
+		return nil, false, ErrorCursorExpired
+	}
+
+	if cursor.listing != listing || offset > len(cursor.entries) {
+		return nil, false, ErrorCursorListing
+	}
+
+	end := min(offset+limit, len(cursor.entries))
+	if end == len(cursor.entries) {
+		delete(c.cursors, id)
+	} else {
+		cursor.expires = now.Add(config.Limits.CursorTTL)
+	}
+
+	return cursor.entries[offset:end], end < len(cursor.entries), nil
+}
+
+// parseSnapshotCursor splits a snapshot cursor into the id of its scan
+// and the offset of its page. Keyset cursors, in base64url, have no dot.
+func parseSnapshotCursor(raw string) (id string, offset int, ok bool) {
+	id, rest, ok := strings.Cut(raw, ".")
+	if !ok {
+		return "", 0, false
+	}
+
+	offset, err := strconv.Atoi(rest)
+	if err != nil || offset < 0 {
+		return "", -1, true // Ни один просмотр не примет такой курсор
+	}
+
+	return id, offset, true
+}
+
+// serveSnapshotPage serves the request if it starts or continues a
+// snapshot scan of listing, load copying at most max entries of it, and
+// reports whether it did.
+func serveSnapshotPage(w http.ResponseWriter, r *http.Request, listing string, load func(max int) ([]Entry, bool, error)) bool {
+	query := r.URL.Query()
+	raw := query.Get("cursor")
+
+	id, offset, ok := parseSnapshotCursor(raw)
+	if start, _ := strconv.ParseBool(query.Get("snapshot")); !ok && !(start && raw == "") {
+		return false
+	}
+
+	limit, err := pageLimit(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return true
+	}
+
+	now := time.Now()
+
+	if !ok {
+		entries, more, err := load(config.Limits.CursorMaxKeys)
+		if err != nil {
+			serverError(w, err)
+			return true
+		}
+
+		if more {
+			http.Error(w, fmt.Sprintf("%s: more than %d keys", ErrorListingTooLong.Error(), config.Limits.CursorMaxKeys), http.StatusBadRequest)
+			return true
+		}
+
+		if id, err = cursors.open(listing, entries, now); err != nil {
+			w.Header().Set("Retry-After", strconv.Itoa(int(config.Limits.CursorTTL.Seconds())))
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return true
+		}
+	}
+
+	entries, more, err := cursors.page(id, listing, offset, limit, now)
+	switch {
+	case errors.Is(err, ErrorCursorExpired):
+		http.Error(w, err.Error(), http.StatusGone)
+		return true
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return true
+	}
+
+	if more {
+		w.Header().Set("X-Next-Cursor", id+"."+strconv.Itoa(offset+len(entries)))
+	}
+
+	writeListPage(w, query, entries, false)
+
+	return true
+}
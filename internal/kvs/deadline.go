@@ -0,0 +1,92 @@
+package kvs
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+)
+
+/**
+ * Request deadlines.
+ *
+ * Handlers pass the request context to the store and the transaction
+ * logger, so that work is abandoned once the client has gone away, and
+ * every request except the streaming ones must complete within the
+ * request timeout. A change that has reached the store is always logged:
+ * cancellation only stops a durable write from waiting for its fsync, in
+ * which case the client cannot tell whether the write was made durable.
+ */
+var ErrorRequestTimeout = errors.New("Request timed out")
+
+// deadlineExempt lists the routes that stream and run without a deadline.
+var deadlineExempt = map[string]bool{
+	"snapshot":             true,
+	"restore":              true,
+	"export":               true,
+	"import":               true,
+	"watch":                true,
+	"watch_prefix":         true,
+	"events":               true,
+	"replication":          true,
+	"replication_snapshot": true,
+	"pprof":                true, // Профилирование CPU и трассировка длятся ?seconds=
+	"verify_log":           true, // Читает весь журнал
+}
+
+// withDeadline bounds the requests it serves, reading the body included,
+// by timeout; 0 disables the bound. Exempt routes are also freed from the
+// read and write timeouts of the server.
+func withDeadline(timeout time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if route := currentRoute(r); route != nil && deadlineExempt[route.name] {
+				rc := http.NewResponseController(w)
+				rc.SetReadDeadline(time.Time{})
+				rc.SetWriteDeadline(time.Time{})
+
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if timeout <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+
+			deadline, _ := ctx.Deadline()
+			http.NewResponseController(w).SetReadDeadline(deadline) // Медленная передача тела тоже ограничена
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// serverError reports a failure of the store, the transaction logger or
+// the connection. A request that ran out of time or was canceled, or a
+// write the failing log refused, gets 503, a write past the memory limit
+// 507 and one past a bucket quota 403.
+func serverError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded):
+		err, status = ErrorRequestTimeout, http.StatusServiceUnavailable
+	case errors.Is(err, context.Canceled):
+		status = http.StatusServiceUnavailable // Клиент, скорее всего, уже отключился
+	case errors.Is(err, ErrorLogFailing):
+		status = http.StatusServiceUnavailable
+	case errors.Is(err, ErrorMemoryFull):
+		status = http.StatusInsufficientStorage
+	case errors.Is(err, ErrorQuotaExceeded):
+		status = http.StatusForbidden
+	case errors.Is(err, ErrorUpstream):
+		status = http.StatusBadGateway
+	}
+
+	http.Error(w, err.Error(), status)
+}
@@ -0,0 +1,138 @@
+package kvs
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+/**
+ * Directory listing.
+ *
+ * Keys can be read as a hierarchy, with "/" separating its levels, as
+ * etcd v2 does: "users/1" is the key "1" in the directory "users/". GET
+ * /v1/dir/{prefix} lists the immediate children of the directory prefix,
+ * the whole key space for an empty one: the keys directly in it and, once
+ * each, the directories holding deeper keys, whose names end in "/".
+ * Children come in lexicographic order and are paged like GET /v1/keys,
+ * with ?limit= and the X-Next-Cursor of the previous page in ?cursor=.
+ * Directories exist only through the keys below them. A key ending in
+ * "/" stands for the directory of the same name: it is listed as that
+ * directory, and not among its children.
+ */
+type dirChild struct {
+	Key      string `json:"key"`                // Полный ключ; у каталога оканчивается на "/"
+	Dir      bool   `json:"dir,omitempty"`      // Каталог с ключами глубже
+	Revision uint64 `json:"revision,omitempty"` // Только у ключей
+}
+
+// dirPath returns the directory a GET /v1/dir/ request names, ending in
+// "/" unless it is the root.
+func dirPath(r *http.Request) string {
+	dir := normalizeBound(strings.TrimPrefix(r.URL.Path, "/v1/dir/"))
+	if dir != "" && !strings.HasSuffix(dir, "/") {
+		dir += "/"
+	}
+
+	return dir
+}
+
+// dirEnd returns the first key past every key in dir, or "" for the root.
+func dirEnd(dir string) string {
+	if dir == "" {
+		return ""
+	}
+
+	return dir[:len(dir)-1] + "0" // "0" следует за "/"
+}
+
+// childOf returns the child of dir that key is, or belongs to.
+func childOf(dir, key string) dirChild {
+	rest := key[len(dir):]
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		return dirChild{Key: dir + rest[:i+1], Dir: true}
+	}
+
+	return dirChild{Key: key}
+}
+
+// listDir returns up to limit children of dir after the child named
+// after, and whether further children remain.
+func listDir(ctx context.Context, dir, after string, limit int) (children []dirChild, more bool, err error) {
+	start, end := dir, dirEnd(dir)
+	if after != "" {
+		start = after + "\x00"
+		if strings.HasSuffix(after, "/") {
+			start = dirEnd(after) // Пропустить ключи каталога
+		}
+	}
+
+	children = []dirChild{}
+
+	for {
+		entries, rest, err := store.Range(ctx, start, end, limit-len(children)+1)
+		if err != nil {
+			return nil, false, err
+		}
+
+		skipped := false
+		for _, e := range entries {
+			if e.Key == dir {
+				start = e.Key + "\x00" // Сам каталог
+				continue
+			}
+
+			if len(children) == limit {
+				return children, true, nil
+			}
+
+			child := childOf(dir, e.Key)
+			if child.Dir {
+				children = append(children, child)
+				start, skipped = dirEnd(child.Key), true
+				break // Остальные ключи каталога не нужны
+			}
+
+			child.Revision = e.Revision
+			children = append(children, child)
+			start = e.Key + "\x00"
+		}
+
+		if !skipped && !rest {
+			return children, false, nil
+		}
+	}
+}
+
+// dirHandler serves GET /v1/dir/{prefix}?limit=&cursor=.
+func dirHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	dir := dirPath(r)
+
+	limit, after, err := listPage(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if after != "" && !strings.HasPrefix(after, dir) {
+		http.Error(w, ErrorCursorListing.Error(), http.StatusBadRequest)
+		return
+	}
+
+	children, more, err := listDir(r.Context(), dir, after, limit)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	if more {
+		last := children[len(children)-1].Key
+		w.Header().Set("X-Next-Cursor", base64.RawURLEncoding.EncodeToString([]byte(last)))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(children)
+}
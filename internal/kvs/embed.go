@@ -0,0 +1,208 @@
+package kvs
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+)
+
+/**
+ * Embedding.
+ *
+ * A DB is a store with its transaction log, opened by OpenDB from a
+ * configuration of its own, for programs that keep their data in process
+ * through the storage package without running the server. Opening it
+ * replays the log into the store; its reaper of expired keys and the
+ * snapshots of its log run until Close. Put and Delete write as the
+ * protocol front ends do: the key normalized and checked, the write logged
+ * ahead of the store and fsynced with durability "sync". A DB shares no
+ * state with the server or with other DBs, so several can be open in one
+ * process on different files. The read-only mode, the scheduled operations,
+ * the migration and the watchers of the server are not part of it: the
+ * events of the first two in its log are skipped.
+ */
+type DB struct {
+	config  *Config
+	pattern *regexp.Regexp // Из keys.pattern
+	store   Store
+	logger  TransactionLogger
+	health  logHealthState
+	log     writeLog
+
+	stop context.CancelFunc
+	wg   sync.WaitGroup
+}
+
+// OpenDB opens the store and the transaction log of c and replays the log
+// into the store. The background work on them runs until ctx is done or
+// Close is called.
+func OpenDB(ctx context.Context, c *Config) (*DB, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	s, err := newLogSealer(c.TransactionLog.Encryption)
+	if err != nil {
+		return nil, err
+	}
+
+	db := &DB{config: c}
+	db.pattern, _ = c.Keys.compile() // Проверен Validate
+
+	if db.store, err = newStore(c.Store); err != nil {
+		return nil, err
+	}
+
+	if db.logger, err = newTransactionLogger(c.TransactionLog, s, &db.health, appliedSequence(db.store)); err != nil {
+		db.closeStore(0)
+		return nil, fmt.Errorf("failed to create event logger: %w", err)
+	}
+
+	err = replayLog(db.logger, db.store, snapshotPath(c.TransactionLog), func(e Event, stored bool) error {
+		if stored {
+			return nil
+		}
+
+		return replayEvent(context.Background(), db.store, e)
+	})
+	if err != nil {
+		db.logger.Close()
+		db.closeStore(0)
+		return nil, err
+	}
+
+	db.logger.Run()
+	go watchLoggerErrors(db.logger, &db.health)
+
+	db.log = writeLog{db.logger, &db.health}
+
+	ctx, db.stop = context.WithCancel(ctx)
+
+	db.runBackground(func() {
+		runReaper(ctx, db.store, c.Store.ReapInterval, func(key string) { db.logger.WriteExpired(key) })
+	})
+
+	if l, ok := db.logger.(*FileTransactionLogger); ok && c.TransactionLog.Snapshot.enabled() {
+		db.runBackground(func() { runSnapshots(ctx, l, db.store, c.TransactionLog.Snapshot, snapshotPath(c.TransactionLog), nil) })
+	}
+
+	return db, nil
+}
+
+// runBackground runs fn in a goroutine that Close waits for.
+func (db *DB) runBackground(fn func()) {
+	db.wg.Add(1)
+
+	go func() {
+		defer db.wg.Done()
+		fn()
+	}()
+}
+
+// Close stops the background work, waits for the writes to be logged and
+// closes the log and the store.
+func (db *DB) Close() error {
+	db.stop()
+	db.wg.Wait() // Ни одно истечение срока не попадёт в закрытый журнал
+
+	if err := db.logger.Close(); err != nil {
+		return fmt.Errorf("failed to close transaction log: %w", err)
+	}
+
+	return db.closeStore(db.logger.LastSequence())
+}
+
+// closeStore closes the store if it persists, recording that it holds the
+// events up to sequence.
+func (db *DB) closeStore(sequence uint64) error {
+	if p, ok := unwrapStore(db.store).(PersistentStore); ok {
+		return p.Close(sequence)
+	}
+
+	return nil
+}
+
+// Get returns the entry of key, repairing its value from the transaction
+// log if it fails its checksum.
+func (db *DB) Get(ctx context.Context, key string) (Entry, error) {
+	return repairedEntry(ctx, db.store, db.logger, snapshotPath(db.config.TransactionLog), db.config.Keys.normalize(key))
+}
+
+// List returns at most limit entries whose keys start with prefix and
+// follow after, in order, and whether more remain.
+func (db *DB) List(ctx context.Context, prefix, after string, limit int) ([]Entry, bool, error) {
+	return db.store.List(ctx, db.config.Keys.normalizeBound(prefix), after, limit)
+}
+
+// Put stores value under key, expiring after ttl unless it is 0, and
+// returns its revision.
+func (db *DB) Put(ctx context.Context, key, value string, ttl time.Duration) (uint64, error) {
+	key = db.config.Keys.normalize(key)
+
+	if err := checkKey(key, db.config, db.pattern); err != nil {
+		return 0, err
+	}
+
+	if int64(len(value)) > db.config.Limits.MaxValueBytes {
+		return 0, ErrorValueTooLarge
+	}
+
+	revision, err := db.store.Put(db.log.put(ctx, key, value, "", expiry(ttl)), key, value)
+	if err != nil {
+		return 0, err
+	}
+
+	return revision, db.sync(ctx)
+}
+
+// Delete deletes key, keeping a tombstone of it as store.tombstone_retention
+// requires.
+func (db *DB) Delete(ctx context.Context, key string) error {
+	key = db.config.Keys.normalize(key)
+
+	if _, err := db.store.Get(ctx, key); err != nil {
+		return err
+	}
+
+	if retention := db.config.Store.TombstoneRetention; retention > 0 {
+		until := time.Now().Add(retention)
+
+		if err := db.store.SoftDelete(db.log.delete(ctx, key, until), key, until); err != nil {
+			return err
+		}
+	} else if err := db.store.Delete(db.log.delete(ctx, key, time.Time{}), key); err != nil {
+		return err
+	}
+
+	return db.sync(ctx)
+}
+
+// sync waits for the log to persist the writes made so far if the
+// durability is "sync".
+func (db *DB) sync(ctx context.Context) error {
+	if db.config.TransactionLog.Durability == "sync" {
+		return db.logger.Sync(ctx)
+	}
+
+	return nil
+}
+
+// NewStore builds the store c selects on its own, without a transaction
+// log: its writes are kept only as long as the backend keeps them.
+func NewStore(c StoreConfig) (Store, error) {
+	return newStore(c)
+}
+
+// NewTransactionLogger builds the logger c selects, with the encryption
+// c configures. Its events are replayed with ReadEvents before Run starts
+// logging new ones.
+func NewTransactionLogger(c TransactionLogConfig) (TransactionLogger, error) {
+	s, err := newLogSealer(c.Encryption)
+	if err != nil {
+		return nil, err
+	}
+
+	return newTransactionLogger(c, s, new(logHealthState), 0)
+}
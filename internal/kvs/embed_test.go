@@ -0,0 +1,64 @@
+package kvs
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func openTestDB(t *testing.T, filename string) *DB {
+	t.Helper()
+
+	c := DefaultConfig()
+	c.TransactionLog.File = filename
+
+	db, err := OpenDB(context.Background(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func TestOpenDBs(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	a := openTestDB(t, filepath.Join(dir, "a.log"))
+	b := openTestDB(t, filepath.Join(dir, "b.log"))
+
+	if _, err := a.Put(ctx, "key", "a", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := b.Put(ctx, "key", "b", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Delete(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	a = openTestDB(t, filepath.Join(dir, "a.log"))
+	defer a.Close()
+
+	if entry, err := a.Get(ctx, "key"); err != nil || entry.Value != "a" {
+		t.Fatalf("reopened a has %+v (%v), want the value a", entry, err)
+	}
+
+	b = openTestDB(t, filepath.Join(dir, "b.log"))
+	defer b.Close()
+
+	if _, err := b.Get(ctx, "key"); !errors.Is(err, ErrorNoSuchKey) {
+		t.Fatalf("reopened b has the deleted key (%v)", err)
+	}
+}
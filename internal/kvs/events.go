@@ -0,0 +1,349 @@
+package kvs
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+/**
+ * Change stream.
+ *
+ * GET /v1/events?since=N streams, as Server-Sent Events, the events of
+ * the transaction log after sequence number N, then follows the new ones
+ * as they are logged. Every message carries its sequence number as its
+ * SSE id, so a consumer resumes right after the last event it processed
+ * with ?since= or the Last-Event-ID header that EventSource sends; without
+ * either the stream starts at the end of the log. Recent events come from
+ * the replication feed, older ones are read back from the file log and its
+ * segments. A compacted log only holds the events needed to rebuild its
+ * state: a consumer starting from since=0 gets those, but one resuming
+ * from a point after which compaction dropped events gets 410 Gone, as
+ * does one asking for events that neither holds any more.
+ */
+var errEventsGone = errors.New("events after the requested sequence are no longer available")
+
+// EventReader is implemented by transaction loggers that can read back
+// the events they logged.
+type EventReader interface {
+	ReadSince(after uint64, fn func(Event) error) error
+}
+
+// eventTypeNames names the event types in change stream messages.
+var eventTypeNames = map[EventType]string{
+	EventPut:         "put",
+	EventDelete:      "delete",
+	EventExpire:      "expire",
+	EventIncrement:   "increment",
+	EventTxn:         "txn",
+	EventContentType: "content_type",
+	EventReadOnly:    "read_only",
+	EventExpired:     "expired",
+	EventTombstone:   "tombstone",
+	EventSchedule:    "schedule",
+	EventSequence:    "sequence",
+}
+
+// logMessage is the data of one change stream message.
+type logMessage struct {
+	Sequence uint64       `json:"sequence,omitempty"`
+	Type     string       `json:"type"`
+	Key      string       `json:"key,omitempty"`
+	Value    string       `json:"value,omitempty"`
+	Revision uint64       `json:"revision,omitempty"`
+	Until    *time.Time   `json:"until,omitempty"` // Срок действия или хранения удалённого ключа
+	Ops      []logMessage `json:"ops,omitempty"`   // Записи транзакции
+}
+
+func newLogMessage(e Event) (logMessage, error) {
+	m := logMessage{Sequence: e.Sequence, Type: eventTypeNames[e.EventType], Key: e.Key, Value: e.Value, Revision: e.Revision}
+
+	switch e.EventType {
+	case EventExpire, EventTombstone:
+		nanos, err := strconv.ParseInt(e.Value, 10, 64)
+		if err != nil {
+			return m, fmt.Errorf("invalid deadline: %w", err)
+		}
+
+		until := time.Unix(0, nanos).UTC()
+		m.Value, m.Until = "", &until
+
+	case EventSchedule:
+		op, at, err := parseScheduleValue(e.Value)
+		if err != nil {
+			return m, err
+		}
+
+		m.Value = op // Пустая операция: отмена
+		if op != "" {
+			at = at.UTC()
+			m.Until = &at
+		}
+
+	case EventTxn:
+		ops, err := decodeTxnEvents(e.Value)
+		if err != nil {
+			return m, err
+		}
+
+		m.Value, m.Ops = "", make([]logMessage, len(ops))
+		for i, op := range ops {
+			if m.Ops[i], err = newLogMessage(op); err != nil { // Срок записи - как у отдельного события
+				return m, err
+			}
+		}
+	}
+
+	return m, nil
+}
+
+// ReadSince calls fn with the events after the given sequence number that
+// the segments and the active file hold, in order, EventSequence markers
+// included. An event being written at the end of the active file is left
+// for the next call. Resuming after a sequence number that is followed by
+// a gap, where compaction or a snapshot dropped events, fails with
+// errEventsGone.
+func (l *FileTransactionLogger) ReadSince(after uint64, fn func(Event) error) error {
+	resuming := after > 0 // С начала журнала свёрнутое состояние заменяет удалённые события
+
+	read := func(e Event) error {
+		if e.Sequence <= after {
+			return nil
+		}
+
+		if resuming && (e.Sequence != after+1 || e.EventType == EventSequence) {
+			return errEventsGone // Событий между after и e в журнале больше нет
+		}
+
+		after = e.Sequence
+		return fn(e)
+	}
+
+	for {
+		segments, last, err := listSegments(l.filename)
+		if err != nil {
+			return err
+		}
+
+		for _, filename := range segments {
+			if err := readLogFileSince(filename, l.sealer, read); err != nil {
+				return err
+			}
+		}
+
+		file, err := os.Open(l.filename)
+		if err != nil {
+			return err
+		}
+
+		_, rotated, err := listSegments(l.filename)
+		if err == nil && rotated != last {
+			file.Close()
+			continue // Файл переименован в сегмент, пока его открывали: прочитать заново
+		}
+
+		if err == nil {
+			err = readLogSince(file, l.sealer, read)
+		}
+
+		file.Close()
+
+		if err != nil {
+			return fmt.Errorf("%s: %w", l.filename, err)
+		}
+
+		return nil
+	}
+}
+
+func readLogFileSince(filename string, sealer *Sealer, fn func(Event) error) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	if err := readLogSince(file, sealer, fn); err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+
+	return nil
+}
+
+// readLogSince calls fn with every complete event in file.
+func readLogSince(file *os.File, sealer *Sealer, fn func(Event) error) error {
+	reader := bufio.NewReader(file)
+
+	header, err := reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("transaction log read failure: %w", err)
+	}
+
+	format, err := checkLogHeader(header, sealer)
+	if err != nil {
+		return err
+	}
+
+	for {
+		record, err := format.read(reader)
+		if err == io.EOF {
+			return nil // Неполная запись ещё пишется
+		}
+
+		if err != nil {
+			return fmt.Errorf("transaction log read failure: %w", err)
+		}
+
+		e, err := format.decode(record)
+		if err == nil {
+			e, err = sealer.openEvent(e)
+		}
+
+		if err == nil {
+			e, err = inflateEvent(e)
+		}
+
+		if err != nil {
+			return fmt.Errorf("input parse error: %w", err)
+		}
+
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+}
+
+// eventsHandler serves GET /v1/events?since=N.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	_, last := feed.position()
+	head := feed.base + last // Последнее событие журнала
+
+	since := head
+	if raw := r.URL.Query().Get("since"); raw != "" {
+		var err error
+		if since, err = strconv.ParseUint(raw, 10, 64); err != nil {
+			http.Error(w, "Invalid since", http.StatusBadRequest)
+			return
+		}
+	} else if raw := r.Header.Get("Last-Event-ID"); raw != "" {
+		var err error
+		if since, err = strconv.ParseUint(raw, 10, 64); err != nil {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if since > head {
+		http.Error(w, fmt.Sprintf("Invalid since: the log ends at %d", head), http.StatusBadRequest)
+		return
+	}
+
+	started := false
+	start := func() {
+		if !started {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+	}
+
+	send := func(e Event) error {
+		if e.EventType == EventSequence {
+			since = e.Sequence // Только место удалённых сжатием событий
+			return nil
+		}
+
+		m, err := newLogMessage(e)
+		if err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+
+		start()
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Sequence, m.Type, data)
+		since = e.Sequence
+
+		return err
+	}
+
+	keepAlive := time.NewTicker(config.Watch.KeepAlive) // Не даёт прокси закрыть простаивающий поток
+	defer keepAlive.Stop()
+
+	for {
+		var events []feedEvent
+		var notify <-chan struct{}
+
+		ok := since >= feed.base
+		if ok {
+			events, _, notify, ok = feed.since(since - feed.base)
+		}
+
+		if !ok { // Событий уже нет в буфере: прочитать их из журнала
+			err := errEventsGone
+
+			if h, readable := unwrapLogger(logger).(EventReader); readable {
+				before := since
+				if err = h.ReadSince(since, send); err == nil && since == before {
+					err = errEventsGone
+				}
+			}
+
+			if errors.Is(err, errEventsGone) && !started {
+				http.Error(w, err.Error(), http.StatusGone)
+				return
+			}
+
+			if err != nil {
+				if !errors.Is(err, errEventsGone) && r.Context().Err() == nil {
+					slog.Warn("change stream ended", "error", err)
+				}
+				return
+			}
+
+			flusher.Flush()
+			continue
+		}
+
+		for _, fe := range events {
+			e := fe.event
+			e.Sequence = feed.base + fe.sequence
+
+			if err := send(e); err != nil {
+				return
+			}
+		}
+
+		start()
+		flusher.Flush()
+
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+
+		case <-notify:
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package kvs
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestLog opens and replays the log at filename, the way the server
+// does at startup, and makes it the logger of the change stream.
+func startTestLog(t *testing.T, filename string) *FileTransactionLogger {
+	t.Helper()
+
+	l := openTestLog(t, filename)
+	replayTestLog(t, l)
+	l.Run()
+
+	feed = NewReplicationFeed(config.Replication.BufferEvents, l.LastSequence())
+	logger = feed.wrap(l)
+
+	return l
+}
+
+// requestEvents requests the change stream after since and returns the
+// status and the ids of the events it got before the stream was cut.
+func requestEvents(t *testing.T, since uint64) (int, []string) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/events?since="+strconv.FormatUint(since, 10), nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+	eventsHandler(w, r)
+
+	var ids []string
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if id, ok := strings.CutPrefix(line, "id: "); ok {
+			ids = append(ids, id)
+		}
+	}
+
+	return w.Code, ids
+}
+
+func TestEventsResumeAcrossCompaction(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "transaction.log")
+
+	l := startTestLog(t, filename)
+	logger.WritePut("a", "1", 1)
+	logger.WritePut("b", "1", 1)
+	logger.WriteDelete("b")
+
+	if err := l.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	l = startTestLog(t, filename) // Перезапуск
+	defer l.Close()
+
+	logger.WritePut("c", "1", 1)
+
+	if err := l.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		since  uint64
+		status int
+		ids    []string
+	}{
+		{0, http.StatusOK, []string{"1", "4"}}, // Свёрнутое состояние, затем новые события
+		{1, http.StatusGone, nil},              // Запись b и её удаление сжаты
+		{2, http.StatusGone, nil},              // Удаление b сжато
+		{3, http.StatusOK, []string{"4"}},
+		{4, http.StatusOK, nil},
+		{5, http.StatusBadRequest, nil},
+	}
+
+	for _, tt := range tests {
+		status, ids := requestEvents(t, tt.since)
+		if status != tt.status || strings.Join(ids, ",") != strings.Join(tt.ids, ",") {
+			t.Errorf("since=%d: got %d with events %v, want %d with %v", tt.since, status, ids, tt.status, tt.ids)
+		}
+	}
+}
@@ -0,0 +1,449 @@
+package kvs
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+ * Memory-bounded cache mode.
+ *
+ * EvictingStore wraps a Store and keeps it within a maximum number of keys
+ * and a maximum size (key plus value bytes), evicting the least recently
+ * used keys once a write exceeds a bound. Reads and writes mark a key as
+ * used; listings, snapshots and TTL queries do not.
+ *
+ * It also tracks the approximate memory the keys take: their key and value
+ * bytes plus a fixed overhead per key for the maps and bookkeeping around
+ * them. Past the maximum memory, the "evict" policy evicts like the other
+ * bounds, and the "reject" policy fails client writes that would take more
+ * with ErrorMemoryFull, while deletes, and the events replayed or
+ * replicated, still apply.
+ */
+const memoryOverhead = 160 // Примерно байт на ключ сверх ключа и значения
+
+var ErrorMemoryFull = errors.New("Memory limit reached")
+
+type EvictingStore struct {
+	Store
+
+	maxKeys   int   // 0: без ограничения
+	maxBytes  int64 // 0: без ограничения
+	maxMemory int64 // 0: без ограничения
+	reject    bool  // Отклонять записи сверх maxMemory вместо вытеснения
+	onEvict   func(key string)
+
+	mu        sync.Mutex // Упорядочивает записи с учётом ключей
+	order     *list.List // От недавно использованных к давно использованным
+	elems     map[string]*list.Element
+	bytes     int64
+	evictions uint64 // Атомарный счётчик вытеснений
+}
+
+type lruEntry struct {
+	key  string
+	size int64
+}
+
+// NewEvictingStore bounds s by the max keys, bytes and memory of c; a zero
+// bound is not enforced. onEvict, if not nil, is called for every evicted
+// key.
+func NewEvictingStore(s Store, c StoreConfig, onEvict func(key string)) *EvictingStore {
+	return &EvictingStore{
+		Store:     s,
+		maxKeys:   c.MaxKeys,
+		maxBytes:  c.MaxBytes,
+		maxMemory: c.MaxMemory,
+		reject:    c.MemoryPolicy == "reject",
+		onEvict:   onEvict,
+		order:     list.New(),
+		elems:     make(map[string]*list.Element),
+	}
+}
+
+// evictingStore returns the store that bounds the keys, or nil without
+// cache limits.
+func evictingStore() *EvictingStore {
+	s := store
+	if m, ok := s.(*MigratingStore); ok {
+		s = m.Store
+	}
+
+	if t, ok := s.(TracingStore); ok {
+		s = t.Store
+	}
+
+	if u, ok := s.(*UpstreamStore); ok {
+		s = u.Store
+	}
+
+	e, _ := s.(*EvictingStore)
+
+	return e
+}
+
+// Evictions returns the number of keys evicted so far.
+func (s *EvictingStore) Evictions() uint64 {
+	return atomic.LoadUint64(&s.evictions)
+}
+
+// Memory returns the approximate memory the keys take.
+func (s *EvictingStore) Memory() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.memory()
+}
+
+func (s *EvictingStore) memory() int64 {
+	return s.bytes + int64(s.order.Len())*memoryOverhead
+}
+
+// growth returns how much memory writing value to key would add; s.mu
+// must be held.
+func (s *EvictingStore) growth(key, value string) int64 {
+	size := int64(len(key) + len(value))
+
+	if elem, ok := s.elems[key]; ok {
+		return size - elem.Value.(*lruEntry).size
+	}
+
+	return size + memoryOverhead
+}
+
+// admit fails with ErrorMemoryFull if the policy rejects writes and grow
+// more bytes would exceed the maximum memory; s.mu must be held.
+func (s *EvictingStore) admit(grow int64) error {
+	if s.reject && s.maxMemory > 0 && grow > 0 && s.memory()+grow > s.maxMemory {
+		return ErrorMemoryFull
+	}
+
+	return nil
+}
+
+// opsGrowth returns how much memory the puts of ops would add; s.mu must
+// be held.
+func (s *EvictingStore) opsGrowth(ops []BatchOp) int64 {
+	var grow int64
+	for _, op := range ops {
+		if op.Op == BatchPut {
+			grow += s.growth(op.Key, op.Value)
+		}
+	}
+
+	return grow
+}
+
+func (s *EvictingStore) Get(ctx context.Context, key string) (string, error) {
+	entry, err := s.GetEntry(ctx, key)
+
+	return entry.Value, err
+}
+
+func (s *EvictingStore) GetEntry(ctx context.Context, key string) (Entry, error) {
+	entry, err := s.Store.GetEntry(ctx, key)
+	if err == nil {
+		s.mu.Lock()
+		if elem, ok := s.elems[key]; ok {
+			s.order.MoveToFront(elem)
+		}
+		s.mu.Unlock()
+	}
+
+	return entry, err
+}
+
+func (s *EvictingStore) Put(ctx context.Context, key, value string) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.admit(s.growth(key, value)); err != nil {
+		return 0, err
+	}
+
+	revision, err := s.Store.Put(ctx, key, value)
+	if err == nil {
+		s.track(key, value)
+		s.evict()
+	}
+
+	return revision, err
+}
+
+func (s *EvictingStore) CompareAndPut(ctx context.Context, key, value string, revision uint64) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.admit(s.growth(key, value)); err != nil {
+		return 0, err
+	}
+
+	revision, err := s.Store.CompareAndPut(ctx, key, value, revision)
+	if err == nil {
+		s.track(key, value)
+		s.evict()
+	}
+
+	return revision, err
+}
+
+func (s *EvictingStore) Restore(ctx context.Context, key, value string, revision uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.Store.Restore(ctx, key, value, revision)
+	if err == nil {
+		s.track(key, value)
+		s.evict()
+	}
+
+	return err
+}
+
+func (s *EvictingStore) Increment(ctx context.Context, key string, by int64) (int64, uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.admit(s.growth(key, "")); err != nil { // Только новый ключ заметно занимает память
+		return 0, 0, err
+	}
+
+	value, revision, err := s.Store.Increment(ctx, key, by)
+	if err == nil {
+		s.track(key, strconv.FormatInt(value, 10))
+		s.evict()
+	}
+
+	return value, revision, err
+}
+
+func (s *EvictingStore) Append(ctx context.Context, key, suffix string, limit int64) (string, uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	grow := int64(len(suffix))
+	if _, ok := s.elems[key]; !ok {
+		grow = s.growth(key, suffix)
+	}
+
+	if err := s.admit(grow); err != nil {
+		return "", 0, err
+	}
+
+	value, revision, err := s.Store.Append(ctx, key, suffix, limit)
+	if err == nil {
+		s.track(key, value)
+		s.evict()
+	}
+
+	return value, revision, err
+}
+
+func (s *EvictingStore) Update(ctx context.Context, key, value string, revision uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.Store.Update(ctx, key, value, revision)
+	if err == nil {
+		s.track(key, value)
+		s.evict()
+	}
+
+	return err
+}
+
+func (s *EvictingStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.Store.Delete(ctx, key)
+	if err == nil {
+		s.untrack(key)
+	}
+
+	return err
+}
+
+func (s *EvictingStore) DeleteMatching(ctx context.Context, match func(key string) bool) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed, err := s.Store.DeleteMatching(ctx, match)
+	for _, key := range removed {
+		s.untrack(key)
+	}
+
+	return removed, err
+}
+
+func (s *EvictingStore) SoftDelete(ctx context.Context, key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.Store.SoftDelete(ctx, key, until)
+	if err == nil {
+		s.untrack(key)
+	}
+
+	return err
+}
+
+func (s *EvictingStore) Undelete(ctx context.Context, key string) (Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, err := s.Store.Undelete(ctx, key)
+	if err == nil {
+		s.track(key, entry.Value)
+		s.evict()
+	}
+
+	return entry, err
+}
+
+func (s *EvictingStore) ReapExpired(ctx context.Context, now time.Time) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reaped := s.Store.ReapExpired(ctx, now)
+	for _, key := range reaped {
+		s.untrack(key)
+	}
+
+	return reaped
+}
+
+func (s *EvictingStore) Batch(ctx context.Context, ops []BatchOp) ([]BatchResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.admit(s.opsGrowth(ops)); err != nil {
+		return nil, err
+	}
+
+	results, err := s.Store.Batch(ctx, ops)
+	if err == nil {
+		s.trackResults(ops, results)
+		s.evict()
+	}
+
+	return results, err
+}
+
+func (s *EvictingStore) Txn(ctx context.Context, t Txn) (TxnResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.admit(max(s.opsGrowth(t.Success), s.opsGrowth(t.Failure))); err != nil {
+		return TxnResult{}, err
+	}
+
+	result, err := s.Store.Txn(ctx, t)
+	if err != nil {
+		return result, err
+	}
+
+	ops := t.Failure
+	if result.Succeeded {
+		ops = t.Success
+	}
+
+	s.trackResults(ops, result.Results)
+	s.evict()
+
+	return result, nil
+}
+
+// trackResults records the outcome of applied batch operations; s.mu must
+// be held.
+func (s *EvictingStore) trackResults(ops []BatchOp, results []BatchResult) {
+	for i, result := range results {
+		if !result.OK {
+			continue
+		}
+
+		switch result.Op {
+		case BatchGet:
+			if elem, ok := s.elems[result.Key]; ok {
+				s.order.MoveToFront(elem)
+			}
+		case BatchPut:
+			s.track(result.Key, ops[i].Value)
+		case BatchDelete:
+			s.untrack(result.Key)
+		}
+	}
+}
+
+func (s *EvictingStore) ReplaceAll(ctx context.Context, entries []Entry) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed, err := s.Store.ReplaceAll(ctx, entries)
+	if err != nil {
+		return nil, err
+	}
+
+	s.order.Init()
+	s.elems = make(map[string]*list.Element, len(entries))
+	s.bytes = 0
+
+	for _, e := range entries {
+		s.track(e.Key, e.Value)
+	}
+	s.evict()
+
+	return removed, nil
+}
+
+// track records a write of key; s.mu must be held.
+func (s *EvictingStore) track(key, value string) {
+	size := int64(len(key) + len(value))
+
+	if elem, ok := s.elems[key]; ok {
+		entry := elem.Value.(*lruEntry)
+		s.bytes += size - entry.size
+		entry.size = size
+		s.order.MoveToFront(elem)
+		return
+	}
+
+	s.elems[key] = s.order.PushFront(&lruEntry{key: key, size: size})
+	s.bytes += size
+}
+
+// untrack forgets a removed key; s.mu must be held.
+func (s *EvictingStore) untrack(key string) {
+	if elem, ok := s.elems[key]; ok {
+		s.bytes -= elem.Value.(*lruEntry).size
+		s.order.Remove(elem)
+		delete(s.elems, key)
+	}
+}
+
+// evict removes least recently used keys until both bounds hold; s.mu
+// must be held. The most recently written key is never evicted, even if
+// it alone exceeds maxBytes.
+func (s *EvictingStore) evict() {
+	for s.order.Len() > 1 && s.overLimit() {
+		key := s.order.Back().Value.(*lruEntry).key
+
+		s.Store.Delete(context.Background(), key) // Вытеснение завершает уже применённую запись
+		s.untrack(key)
+		atomic.AddUint64(&s.evictions, 1)
+
+		if s.onEvict != nil {
+			s.onEvict(key)
+		}
+	}
+}
+
+func (s *EvictingStore) overLimit() bool {
+	return (s.maxKeys > 0 && s.order.Len() > s.maxKeys) || (s.maxBytes > 0 && s.bytes > s.maxBytes) ||
+		(s.maxMemory > 0 && !s.reject && s.memory() > s.maxMemory)
+}
@@ -0,0 +1,58 @@
+package kvs
+
+import (
+	"fmt"
+	"time"
+)
+
+/**
+ * File Transaction log fsync policy.
+ *
+ * Like Redis appendfsync, the policy trades durability for throughput:
+ * the file logger fsyncs after every event, after every Events events,
+ * every Interval, or never, leaving write-back to the operating system.
+ * Flush and Sync fsync immediately under any policy.
+ */
+const (
+	FsyncAlways   = "always"
+	FsyncEvents   = "events"
+	FsyncInterval = "interval"
+	FsyncNever    = "never"
+)
+
+type FsyncPolicy struct {
+	Mode     string        `yaml:"mode"`
+	Events   uint64        `yaml:"events"`   // Для режима "events"
+	Interval time.Duration `yaml:"interval"` // Для режима "interval"
+}
+
+func (p FsyncPolicy) Validate() error {
+	switch p.Mode {
+	case FsyncAlways, FsyncNever:
+	case FsyncEvents:
+		if p.Events < 1 {
+			return fmt.Errorf("fsync policy %q needs a positive event count", p.Mode)
+		}
+	case FsyncInterval:
+		if p.Interval <= 0 {
+			return fmt.Errorf("fsync policy %q needs a positive interval", p.Mode)
+		}
+	default:
+		return fmt.Errorf("unknown fsync policy %q", p.Mode)
+	}
+
+	return nil
+}
+
+// due reports whether the log must be fsynced after unsynced events have
+// been written since the last fsync.
+func (p FsyncPolicy) due(unsynced uint64) bool {
+	switch p.Mode {
+	case FsyncAlways:
+		return unsynced > 0
+	case FsyncEvents:
+		return unsynced >= p.Events
+	default:
+		return false
+	}
+}
@@ -0,0 +1,123 @@
+package kvs
+
+import "strings"
+
+/**
+ * Glob patterns.
+ *
+ * Watch subscriptions and the Redis KEYS command select keys by
+ * Redis-style glob patterns: '*' matches any run of bytes, '?' a single
+ * byte, [abc], [a-z] and [^abc] a byte of a class, and '\' makes the next
+ * character literal. An unclosed '[' stands for itself. Matching is
+ * linear in the pattern times the key: on a mismatch only the most
+ * recent '*' is retried, one byte further on.
+ */
+
+// matchGlob reports whether s matches the glob pattern.
+func matchGlob(pattern, s string) bool {
+	p, i := 0, 0
+	starP, starI := -1, 0 // Позиции после последней '*' в pattern и s
+
+	for i < len(s) {
+		if p < len(pattern) && pattern[p] == '*' {
+			for p < len(pattern) && pattern[p] == '*' {
+				p++
+			}
+
+			if p == len(pattern) {
+				return true
+			}
+
+			starP, starI = p, i
+			continue
+		}
+
+		if p < len(pattern) {
+			if width, ok := matchByte(pattern[p:], s[i]); ok {
+				p, i = p+width, i+1
+				continue
+			}
+		}
+
+		if starP < 0 {
+			return false
+		}
+
+		starI++ // '*' захватывает ещё один байт
+		p, i = starP, starI
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+
+	return p == len(pattern)
+}
+
+// matchByte reports whether b matches the element of pattern, other than
+// '*', at its start, and returns the width of that element.
+func matchByte(pattern string, b byte) (width int, ok bool) {
+	switch pattern[0] {
+	case '?':
+		return 1, true
+
+	case '[':
+		end := strings.IndexByte(pattern[1:], ']') + 1
+		if end <= 0 {
+			return 1, b == '[' // Незакрытая скобка сравнивается буквально
+		}
+
+		return end + 1, matchClass(pattern[1:end], b)
+
+	case '\\':
+		if len(pattern) > 1 {
+			return 2, b == pattern[1]
+		}
+		return 1, b == '\\'
+
+	default:
+		return 1, b == pattern[0]
+	}
+}
+
+// matchClass reports whether b belongs to a glob character class given
+// without its brackets.
+func matchClass(class string, b byte) bool {
+	negate := len(class) > 0 && class[0] == '^'
+	if negate {
+		class = class[1:]
+	}
+
+	matched := false
+
+	for i := 0; i < len(class); i++ {
+		if i+2 < len(class) && class[i+1] == '-' {
+			lo, hi := class[i], class[i+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+
+			if lo <= b && b <= hi {
+				matched = true
+			}
+			i += 2
+			continue
+		}
+
+		if class[i] == b {
+			matched = true
+		}
+	}
+
+	return matched != negate
+}
+
+// globPrefix returns the literal start of pattern, which every key it
+// matches begins with.
+func globPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		return pattern[:i]
+	}
+
+	return pattern
+}
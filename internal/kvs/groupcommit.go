@@ -0,0 +1,151 @@
+package kvs
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+/**
+ * File Transaction log group commit.
+ *
+ * The logger goroutine takes every event already queued behind the one it
+ * has received, up to MaxEvents, and waits up to Window for more. The
+ * batch is written with a single write call and fsynced at most once, so
+ * concurrent writers waiting for durability share one fsync. A zero
+ * Window only coalesces events that are already queued and adds no
+ * latency.
+ */
+type BatchPolicy struct {
+	Window    time.Duration `yaml:"window"`
+	MaxEvents int           `yaml:"max_events"`
+}
+
+func (p BatchPolicy) Validate() error {
+	if p.Window < 0 || p.MaxEvents < 1 {
+		return fmt.Errorf("batch window must not be negative and max events must be at least 1")
+	}
+
+	return nil
+}
+
+// collect returns first with the events that follow it within the batch
+// window. open is false once events has been closed.
+func (l *FileTransactionLogger) collect(first Event, events <-chan Event) (batch []Event, open bool) {
+	batch = []Event{first}
+
+	var window <-chan time.Time
+	if l.batching.Window > 0 {
+		timer := time.NewTimer(l.batching.Window)
+		defer timer.Stop()
+		window = timer.C
+	}
+
+	for len(batch) < l.batching.MaxEvents {
+		var e Event
+		var ok bool
+
+		if window == nil {
+			select {
+			case e, ok = <-events:
+			default:
+				return batch, true // Очередь пуста
+			}
+		} else {
+			select {
+			case e, ok = <-events:
+			case <-window:
+				return batch, true
+			}
+		}
+
+		if !ok {
+			return batch, false
+		}
+		batch = append(batch, e)
+	}
+
+	return batch, true
+}
+
+// writeBatch writes the events of batch and fsyncs the log if the fsync
+// policy or a Sync marker in the batch asks for it, then answers the
+// markers. A failed fsync only fails the markers unless the policy
+// required it.
+func (l *FileTransactionLogger) writeBatch(batch []Event) (err error) {
+	l.buf.Reset()
+
+	var markers []chan<- error
+	var waiting []*Span // Спаны трассируемых Sync, ждущих пакета
+	var written uint64
+
+	for _, e := range batch {
+		if e.synced != nil { // Ответить после записи всего пакета
+			markers = append(markers, e.synced)
+			if e.span != nil {
+				waiting = append(waiting, e.span)
+			}
+			continue
+		}
+
+		e = compressEvent(e, l.compressAbove)
+
+		e.Sequence = atomic.AddUint64(&l.lastSequence, 1) // Увеличить порядковый номер
+		l.buf.WriteString(encodeEvent(l.sealer.sealEvent(e)))
+		written++
+	}
+
+	span := batchSpan(waiting)
+	span.SetInt("tlog.events", int64(written))
+	defer func() { span.End(err) }()
+
+	if l.buf.Len() > 0 {
+		span.SetInt("tlog.bytes", int64(l.buf.Len()))
+
+		n, err := l.appendRetrying(l.buf.Bytes()) // Записать пакет в журнал одним вызовом
+		if err != nil {
+			return err
+		}
+
+		l.compaction.size += int64(n)
+		l.compaction.events += written
+		l.unsynced += written
+	}
+
+	required := l.fsync.due(l.unsynced)
+
+	var fsyncErr error
+	if required || len(markers) > 0 {
+		fsync := span.child("tlog.Fsync")
+		if fsyncErr = l.file.Sync(); fsyncErr == nil {
+			l.unsynced = 0
+		}
+		fsync.End(fsyncErr)
+	}
+
+	for _, synced := range markers {
+		synced <- fsyncErr
+	}
+
+	if required {
+		return fsyncErr
+	}
+
+	return nil
+}
+
+// batchSpan starts the span of writing a batch under the first traced
+// Sync waiting for it, linked to the others. A batch no traced Sync waits
+// for gets none.
+func batchSpan(waiting []*Span) *Span {
+	if len(waiting) == 0 {
+		return nil
+	}
+
+	span := waiting[0].child("tlog.WriteBatch")
+	for _, s := range waiting[1:] {
+		span.Link(s)
+	}
+
+	return span
+}
@@ -0,0 +1,99 @@
+package kvs
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWriteBatchSpan(t *testing.T) {
+	var mu sync.Mutex
+	spans := make(map[string][]otlpSpan) // Имя -> спаны
+
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var export otlpExport
+		if err := json.NewDecoder(r.Body).Decode(&export); err != nil {
+			t.Error(err)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		for _, rs := range export.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, span := range ss.Spans {
+					spans[span.Name] = append(spans[span.Name], span)
+				}
+			}
+		}
+	}))
+	defer collector.Close()
+
+	defer func(t *Tracer) { tracer = t }(tracer)
+	tracer = NewTracer(TracingConfig{Endpoint: collector.URL, ServiceName: "kvs", SampleRatio: 1})
+
+	tl, err := NewFileTransactionLogger(filepath.Join(t.TempDir(), "transaction.log"), FileLogOptions{
+		Fsync:  FsyncPolicy{Mode: FsyncAlways},
+		Batch:  BatchPolicy{Window: 200 * time.Millisecond, MaxEvents: 16},
+		Strict: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := tl.(*FileTransactionLogger)
+	replayTestLog(t, l)
+	l.Run()
+	defer l.Close()
+
+	var wg sync.WaitGroup
+	for _, key := range []string{"a", "b"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx, request := tracer.StartRequest(context.Background(), "PUT /v1/key/{key}", "")
+			l.WritePut(key, "1", 1)
+			request.End(l.Sync(ctx))
+		}()
+	}
+	wg.Wait()
+
+	tracer.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	syncs, batches, fsyncs := spans["tlog.Sync"], spans["tlog.WriteBatch"], spans["tlog.Fsync"]
+	if len(syncs) != 2 || len(batches) != 1 || len(fsyncs) != 1 {
+		t.Fatalf("got %d sync, %d batch and %d fsync spans, want 2, 1 and 1", len(syncs), len(batches), len(fsyncs))
+	}
+
+	batch := batches[0]
+	if fsyncs[0].ParentSpanID != batch.SpanID {
+		t.Fatalf("fsync span is under %s, want the batch span %s", fsyncs[0].ParentSpanID, batch.SpanID)
+	}
+
+	if len(batch.Links) != 1 {
+		t.Fatalf("batch span has links %+v, want one", batch.Links)
+	}
+
+	parent, linked := syncs[0], syncs[1]
+	if batch.ParentSpanID != parent.SpanID {
+		parent, linked = linked, parent
+	}
+
+	if batch.ParentSpanID != parent.SpanID || batch.TraceID != parent.TraceID {
+		t.Fatalf("batch span is under %s, want one of the sync spans", batch.ParentSpanID)
+	}
+
+	if link := batch.Links[0]; link.SpanID != linked.SpanID || link.TraceID != linked.TraceID {
+		t.Fatalf("batch span links to %+v, want the other sync span %s", link, linked.SpanID)
+	}
+}
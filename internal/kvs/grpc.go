@@ -0,0 +1,526 @@
+//go:build grpc
+
+package kvs
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+/**
+ * gRPC listener.
+ *
+ * The kvs.v1.KeyValue service of kvs.proto is served on a listener of its
+ * own, for initial data loads: the client-streaming BulkPut writes the
+ * entries it receives grpcBatchEntries at a time, each batch applied to
+ * the store at once, as POST /v1/batch does, and logged as one transaction
+ * record instead of one record per key; a load is thus bounded by the
+ * network rather than by the round trip and log write of every PUT. The
+ * entries are published to watchers as ordinary puts. With durability
+ * sync, or the x-durability metadata set to "sync", the log is fsynced
+ * before the summary is returned.
+ *
+ * Callers authenticate with the x-api-key metadata or a bearer token in
+ * authorization, and are checked against the ACLs like a PUT of every
+ * key. Writes are refused with Unavailable while the server is read-only,
+ * a replica or falling behind on its log, keys of other cluster nodes
+ * with FailedPrecondition, and writes past the memory limit or a quota
+ * with ResourceExhausted. An error ends the stream; the batches written
+ * before it stay written.
+ *
+ * The listener also serves the standard grpc.health.v1.Health service,
+ * without authentication, for load balancers: the server as a whole, named
+ * "", is SERVING while /readyz would answer 200, and kvs.v1.KeyValue while
+ * it also accepts writes; both turn NOT_SERVING when the server shuts
+ * down. With grpc.reflection, server reflection lets tools such as grpcurl
+ * list and call the services.
+ *
+ * The messages are encoded with protowire, so the server needs no code
+ * generated from kvs.proto; the descriptor reflection serves is built in
+ * kvsFileDescriptor, which follows kvs.proto. Built only with the grpc
+ * tag: go build -tags grpc.
+ */
+const grpcBatchEntries = 1000 // Записей в одном пакете и событии журнала
+
+const grpcHealthInterval = time.Second // Как часто обновляется состояние для health
+
+type GRPCServer struct {
+	server *grpc.Server
+	health *health.Server
+	done   chan struct{}
+}
+
+// ListenGRPC starts serving the gRPC service on addr, over TLS when
+// tlsConfig is not nil.
+func ListenGRPC(addr string, tlsConfig *tls.Config, auth *Authenticator) (*GRPCServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for gRPC: %w", err)
+	}
+
+	opts := []grpc.ServerOption{
+		grpc.ForceServerCodec(grpcCodec{}),
+		grpc.MaxRecvMsgSize(int(config.Limits.MaxValueBytes) + config.Limits.MaxKeyBytes + 1024), // Запас на тип содержимого и поля
+	}
+
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	s := &GRPCServer{server: grpc.NewServer(opts...), health: health.NewServer(), done: make(chan struct{})}
+	s.server.RegisterService(&keyValueServiceDesc, &grpcService{auth: auth})
+	healthpb.RegisterHealthServer(s.server, s.health)
+
+	if config.GRPC.Reflection {
+		if err := registerKVSDescriptor(); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("failed to describe the gRPC service: %w", err)
+		}
+
+		reflection.Register(s.server)
+	}
+
+	s.updateHealth()
+	go s.watchHealth()
+
+	go func() {
+		if err := s.server.Serve(listener); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+			slog.Error("grpc server failed", "error", err)
+		}
+	}()
+
+	return s, nil
+}
+
+// Close stops accepting streams and waits for the open ones to finish,
+// or cuts them off once ctx is done.
+func (s *GRPCServer) Close(ctx context.Context) error {
+	close(s.done)
+	s.health.Shutdown() // Балансировщики перестают направлять новые вызовы
+
+	stopped := make(chan struct{})
+	go func() {
+		s.server.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		s.server.Stop()
+		return ctx.Err()
+	}
+}
+
+// watchHealth keeps the health statuses up to date until Close.
+func (s *GRPCServer) watchHealth() {
+	ticker := time.NewTicker(grpcHealthInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.updateHealth()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *GRPCServer) updateHealth() {
+	server, keyValue := healthpb.HealthCheckResponse_NOT_SERVING, healthpb.HealthCheckResponse_NOT_SERVING
+
+	if _, ok := readiness(); ok {
+		server = healthpb.HealthCheckResponse_SERVING
+
+		if writesRefused() == nil {
+			keyValue = healthpb.HealthCheckResponse_SERVING
+		}
+	}
+
+	s.health.SetServingStatus("", server)
+	s.health.SetServingStatus(keyValueServiceDesc.ServiceName, keyValue)
+}
+
+// keyValueServer is the kvs.v1.KeyValue service.
+type keyValueServer interface {
+	BulkPut(stream grpc.ServerStream) error
+}
+
+var keyValueServiceDesc = grpc.ServiceDesc{
+	ServiceName: "kvs.v1.KeyValue",
+	HandlerType: (*keyValueServer)(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "BulkPut",
+		ClientStreams: true,
+		Handler: func(srv any, stream grpc.ServerStream) error {
+			return srv.(keyValueServer).BulkPut(stream)
+		},
+	}},
+	Metadata: "kvs.proto",
+}
+
+type grpcService struct {
+	auth *Authenticator
+}
+
+// grpcEntry is a received entry ready to be written.
+type grpcEntry struct {
+	key         string
+	value       string
+	contentType string
+	deadline    time.Time
+}
+
+func (s *grpcService) BulkPut(stream grpc.ServerStream) error {
+	ctx, span := tracer.StartRequest(stream.Context(), "gRPC BulkPut", "")
+	defer span.End(nil)
+
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	p, err := s.authenticate(ctx, md)
+	if err != nil {
+		return err
+	}
+
+	durable := config.TransactionLog.Durability == "sync"
+	if mode := md.Get("x-durability"); len(mode) > 0 {
+		durable = mode[0] == "sync"
+	}
+
+	var summary grpcSummary
+	batch := make([]grpcEntry, 0, grpcBatchEntries)
+
+	for {
+		var m grpcKeyValue
+		err := stream.RecvMsg(&m)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		entry, err := newGRPCEntry(m)
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "entry %d: %v", summary.written+uint64(len(batch))+1, err)
+		}
+
+		if c := keyCheck(aclWrite, entry.key); acl != nil && !acl.allows(p, c.permission, c.prefix) {
+			return status.Errorf(codes.PermissionDenied, "%s on %q", ErrorForbidden.Error(), entry.key)
+		}
+
+		if batch = append(batch, entry); len(batch) == grpcBatchEntries {
+			if err := writeGRPCBatch(ctx, batch); err != nil {
+				return err
+			}
+
+			summary.written += uint64(len(batch))
+			summary.batches++
+			batch = batch[:0]
+		}
+	}
+
+	if len(batch) > 0 {
+		if err := writeGRPCBatch(ctx, batch); err != nil {
+			return err
+		}
+
+		summary.written += uint64(len(batch))
+		summary.batches++
+	}
+
+	if durable {
+		if err := logger.Sync(ctx); err != nil {
+			return grpcError(err)
+		}
+	}
+
+	slog.Info("bulk load finished", "principal", p.Name, "written", summary.written, "batches", summary.batches)
+
+	return stream.SendMsg(&summary)
+}
+
+// authenticate identifies the caller by its metadata, if authentication
+// is configured, and checks that it may write.
+func (s *grpcService) authenticate(ctx context.Context, md metadata.MD) (Principal, error) {
+	if s.auth == nil {
+		return Principal{Permission: PermReadWrite}, nil
+	}
+
+	token := ""
+	if keys := md.Get("x-api-key"); len(keys) > 0 {
+		token = keys[0]
+	} else if values := md.Get("authorization"); len(values) > 0 {
+		if scheme, credentials, _ := strings.Cut(values[0], " "); strings.EqualFold(scheme, "Bearer") {
+			token = credentials
+		}
+	}
+
+	if token == "" {
+		return Principal{}, status.Error(codes.Unauthenticated, ErrorUnauthenticated.Error())
+	}
+
+	p, err := s.auth.AuthenticateToken(ctx, token)
+	if err != nil {
+		return Principal{}, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	if p.Permission < PermReadWrite {
+		return Principal{}, status.Error(codes.PermissionDenied, ErrorForbidden.Error())
+	}
+
+	return p, nil
+}
+
+// newGRPCEntry validates a received entry.
+func newGRPCEntry(m grpcKeyValue) (grpcEntry, error) {
+	switch {
+	case m.key == "":
+		return grpcEntry{}, errors.New("empty key")
+	case int64(len(m.value)) > config.Limits.MaxValueBytes:
+		return grpcEntry{}, ErrorValueTooLarge
+	case m.ttlMillis < 0:
+		return grpcEntry{}, errors.New("negative ttl_ms")
+	}
+
+	key := normalizeKey(m.key)
+	if err := validateKey(key); err != nil {
+		return grpcEntry{}, err
+	}
+
+	contentType, err := parseContentType(m.contentType)
+	if err != nil {
+		return grpcEntry{}, err
+	}
+
+	return grpcEntry{
+		key:         key,
+		value:       m.value,
+		contentType: contentType,
+		deadline:    expiry(time.Duration(m.ttlMillis) * time.Millisecond),
+	}, nil
+}
+
+// writeGRPCBatch logs a batch of entries as one transaction, applies it
+// to the store with their content types and deadlines, and publishes its
+// puts.
+func writeGRPCBatch(ctx context.Context, batch []grpcEntry) error {
+	if err := writesRefused(); err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+
+	release, err := admitWrite(ctx)
+	if err != nil {
+		return grpcError(err)
+	}
+	defer release()
+
+	ops := make([]BatchOp, len(batch))
+	for i, e := range batch {
+		ops[i] = BatchOp{Op: BatchPut, Key: e.key, Value: e.value, contentType: e.contentType, deadline: e.deadline}
+	}
+
+	if owner, ok := foreignOwner(batchKeys(ops)...); ok {
+		return status.Errorf(codes.FailedPrecondition, "Keys of node %s belong at %s", owner.ID, owner.URL)
+	}
+
+	results, err := store.Batch(loggedOps(ctx), ops)
+	if err != nil {
+		return grpcError(err)
+	}
+
+	recordTxn(ops, results)
+
+	return nil
+}
+
+// grpcError maps a failure of the store or the logger to a status.
+func grpcError(err error) error {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return status.FromContextError(err).Err()
+	case errors.Is(err, ErrorLogFailing), errors.Is(err, ErrorLogBackpressure):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, ErrorMemoryFull), errors.Is(err, ErrorQuotaExceeded):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+/**
+ * Message encoding.
+ */
+
+// grpcCodec encodes the messages of kvs.proto in the protobuf wire format,
+// and those of the health and reflection services with proto. It is named
+// "proto" to serve clients using the standard codec.
+type grpcCodec struct{}
+
+type grpcKeyValue struct {
+	key         string
+	value       string
+	ttlMillis   int64
+	contentType string
+}
+
+type grpcSummary struct {
+	written uint64
+	batches uint64
+}
+
+func (grpcCodec) Name() string {
+	return "proto"
+}
+
+func (grpcCodec) Marshal(v any) ([]byte, error) {
+	if m, ok := v.(proto.Message); ok {
+		return proto.Marshal(m)
+	}
+
+	s, ok := v.(*grpcSummary)
+	if !ok {
+		return nil, fmt.Errorf("cannot marshal %T", v)
+	}
+
+	var b []byte
+	if s.written != 0 {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, s.written)
+	}
+
+	if s.batches != 0 {
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, s.batches)
+	}
+
+	return b, nil
+}
+
+func (grpcCodec) Unmarshal(data []byte, v any) error {
+	if m, ok := v.(proto.Message); ok {
+		return proto.Unmarshal(data, m)
+	}
+
+	m, ok := v.(*grpcKeyValue)
+	if !ok {
+		return fmt.Errorf("cannot unmarshal into %T", v)
+	}
+
+	*m = grpcKeyValue{}
+
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(data)
+			m.key = string(v)
+		case num == 2 && typ == protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(data)
+			m.value = string(v)
+		case num == 3 && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(data)
+			m.ttlMillis = int64(v)
+		case num == 4 && typ == protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(data)
+			m.contentType = string(v)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data) // Неизвестные поля пропускаются
+		}
+
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+	}
+
+	return nil
+}
+
+/**
+ * Reflection descriptor.
+ */
+
+// kvsFileDescriptor describes kvs.proto for server reflection.
+var kvsFileDescriptor = &descriptorpb.FileDescriptorProto{
+	Name:    proto.String("kvs.proto"),
+	Package: proto.String("kvs.v1"),
+	Syntax:  proto.String("proto3"),
+	Options: &descriptorpb.FileOptions{GoPackage: proto.String("example.com/gorilla/kvs/v1;kvs")},
+	MessageType: []*descriptorpb.DescriptorProto{{
+		Name: proto.String("Entry"),
+		Field: []*descriptorpb.FieldDescriptorProto{
+			descriptorField("key", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+			descriptorField("value", 2, descriptorpb.FieldDescriptorProto_TYPE_BYTES),
+			descriptorField("ttl_ms", 3, descriptorpb.FieldDescriptorProto_TYPE_INT64),
+			descriptorField("content_type", 4, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+		},
+	}, {
+		Name: proto.String("Summary"),
+		Field: []*descriptorpb.FieldDescriptorProto{
+			descriptorField("written", 1, descriptorpb.FieldDescriptorProto_TYPE_UINT64),
+			descriptorField("batches", 2, descriptorpb.FieldDescriptorProto_TYPE_UINT64),
+		},
+	}},
+	Service: []*descriptorpb.ServiceDescriptorProto{{
+		Name: proto.String("KeyValue"),
+		Method: []*descriptorpb.MethodDescriptorProto{{
+			Name:            proto.String("BulkPut"),
+			InputType:       proto.String(".kvs.v1.Entry"),
+			OutputType:      proto.String(".kvs.v1.Summary"),
+			ClientStreaming: proto.Bool(true),
+		}},
+	}},
+}
+
+func descriptorField(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+	return &descriptorpb.FieldDescriptorProto{
+		Name:   proto.String(name),
+		Number: proto.Int32(number),
+		Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+		Type:   typ.Enum(),
+	}
+}
+
+var registerKVSDescriptor = sync.OnceValue(func() error {
+	fd, err := protodesc.NewFile(kvsFileDescriptor, protoregistry.GlobalFiles)
+	if err != nil {
+		return err
+	}
+
+	return protoregistry.GlobalFiles.RegisterFile(fd)
+})
@@ -0,0 +1,21 @@
+//go:build !grpc
+
+package kvs
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+)
+
+type GRPCServer struct{}
+
+// ListenGRPC fails in builds without the grpc tag, which leave the gRPC
+// module out.
+func ListenGRPC(addr string, tlsConfig *tls.Config, auth *Authenticator) (*GRPCServer, error) {
+	return nil, errors.New("the gRPC listener is not built in; build with -tags grpc")
+}
+
+func (s *GRPCServer) Close(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,83 @@
+//go:build grpc
+
+package kvs
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// testBulkPutStream is a BulkPut stream receiving entries.
+type testBulkPutStream struct {
+	grpc.ServerStream
+	entries []grpcKeyValue
+}
+
+func (s *testBulkPutStream) Context() context.Context {
+	return context.Background()
+}
+
+func (s *testBulkPutStream) RecvMsg(m any) error {
+	if len(s.entries) == 0 {
+		return io.EOF
+	}
+
+	*m.(*grpcKeyValue), s.entries = s.entries[0], s.entries[1:]
+
+	return nil
+}
+
+func (s *testBulkPutStream) SendMsg(any) error {
+	return nil
+}
+
+func TestBulkPutNeedsAdminForACLKeys(t *testing.T) {
+	acl = newACL(ACLConfig{})
+	acl.grants = map[string][]aclGrant{aclEveryone: {{prefix: "", granted: aclWrite}}}
+	defer func() { acl = nil }()
+
+	stream := &testBulkPutStream{entries: []grpcKeyValue{{key: aclPrefix + "someone", value: `[{"prefix":"","permissions":["admin"]}]`}}}
+
+	err := (&grpcService{}).BulkPut(stream)
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("BulkPut of an ACL key without admin returned %v, want PermissionDenied", err)
+	}
+}
+
+func TestBulkPutAppliesContentTypeAndDeadline(t *testing.T) {
+	defer func(s Store, b *Broker) { store, broker = s, b }(store, broker)
+	store = NewShardedStore(4, 0, 0, false)
+	broker = NewBroker(config.Watch.BufferSize)
+
+	l := startTestLog(t, filepath.Join(t.TempDir(), "transaction.log"))
+	defer l.Close()
+
+	stream := &testBulkPutStream{entries: []grpcKeyValue{{key: "a", value: "{}", ttlMillis: 60000, contentType: "application/json"}}}
+
+	if err := (&grpcService{}).BulkPut(stream); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := store.GetEntry(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if entry.ContentType != "application/json" || entry.Expires.IsZero() {
+		t.Fatalf("a is %+v, want a JSON value with a deadline", entry)
+	}
+
+	if err := l.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := l.LastSequence(); got != 1 {
+		t.Fatalf("logged up to %d, want the batch as one event", got)
+	}
+}
@@ -0,0 +1,108 @@
+package kvs
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+/**
+ * Health and readiness probes.
+ *
+ * The HTTP listener starts before the transaction log is replayed, so
+ * /healthz answers as soon as the process is up while /readyz and the API
+ * return 503 until replay has completed, unless reads of keys are served
+ * during replay. Once ready, /readyz also checks
+ * that the transaction logger is still running and can write and, on a
+ * replica, that the first snapshot of the primary has been loaded.
+ */
+var ready atomic.Bool // Журнал транзакций воспроизведён
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	checks, ok := readiness()
+
+	status := http.StatusOK
+	if !ok {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(checks)
+}
+
+// readiness returns the checks of /readyz and whether they all pass.
+func readiness() (map[string]string, bool) {
+	checks := map[string]string{"replay": "ok", "transaction_log": "ok"}
+	ok := true
+
+	if !ready.Load() {
+		checks["replay"] = "in progress"
+		checks["transaction_log"] = "not started"
+		ok = false
+	} else if err := logHealth.Err(); err != nil {
+		checks["transaction_log"] = err.Error()
+		ok = false
+	} else if err := logger.Check(); err != nil {
+		checks["transaction_log"] = err.Error()
+		ok = false
+	}
+
+	if replica != nil {
+		checks["replication"] = "ok"
+		if !replica.isSynced() {
+			checks["replication"] = "loading snapshot"
+			ok = false
+		}
+	}
+
+	return checks, ok
+}
+
+// readinessGate rejects API requests with 503 until the store has been
+// rebuilt from the transaction log, except the profiles and, if they are
+// to be served during replay, reads of keys.
+func readinessGate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ready.Load() && strings.HasPrefix(r.URL.Path, "/debug/pprof/") {
+			next.ServeHTTP(w, r) // Профили нужны и при медленном воспроизведении
+			return
+		}
+
+		if !ready.Load() && config.ServeDuringReplay && replayReadable(r) {
+			w.Header().Set("X-Replay-In-Progress", "true")
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !ready.Load() {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Transaction log replay in progress", http.StatusServiceUnavailable)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withProbes serves the probes ahead of api, outside its middleware, so
+// that they need no credentials.
+func withProbes(api http.Handler) http.Handler {
+	gated := readinessGate(api)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz":
+			healthzHandler(w, r)
+		case "/readyz":
+			readyzHandler(w, r)
+		default:
+			gated.ServeHTTP(w, r)
+		}
+	})
+}
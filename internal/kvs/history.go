@@ -0,0 +1,56 @@
+package kvs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+/**
+ * Revision history.
+ *
+ * With store history enabled, GET /v1/key/{key}?rev=N returns a previous
+ * revision of the key as long as it is still kept, and
+ * GET /v1/key/{key}/history lists the kept revisions, oldest first and
+ * ending with the current value. The history lives only in memory: it
+ * starts over when the server restarts and replays the transaction log,
+ * and is not part of snapshots.
+ */
+var ErrorNoSuchRevision = errors.New("No such revision")
+
+// entryAtRevision returns the entry of key at revision.
+func entryAtRevision(ctx context.Context, key string, revision uint64) (Entry, error) {
+	entries, err := store.History(ctx, key)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	for _, entry := range entries {
+		if entry.Revision == revision {
+			return entry, nil
+		}
+	}
+
+	return Entry{}, ErrorNoSuchRevision
+}
+
+// keyHistoryHandler serves GET /v1/key/{key}/history.
+func keyHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	vars := pathVars(r)
+	key := vars["key"]
+
+	entries, err := store.History(r.Context(), key)
+	if errors.Is(err, ErrorNoSuchKey) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
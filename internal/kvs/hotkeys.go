@@ -0,0 +1,191 @@
+package kvs
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/**
+ * Hot keys.
+ *
+ * Every request naming a key in its path counts as an access to the key
+ * in a count-min sketch: a few rows of counters indexed by different
+ * hashes of the key, whose smallest counter estimates how often the key
+ * was accessed, never below the true count, in a fixed amount of memory
+ * however many keys there are. Alongside, the hot_keys.tracked keys of
+ * highest estimate are kept by name.
+ *
+ * All counts halve every hot_keys.decay, so the estimates follow the
+ * recent load rather than the whole uptime. GET /v1/stats/hotkeys?top=20
+ * on the admin listener lists the hottest keys with their estimates, to
+ * find the hotspots to cache, split or spread around.
+ */
+const (
+	sketchDepth = 4    // Строк счётчиков: независимых хешей ключа
+	sketchWidth = 4096 // Счётчиков в строке
+)
+
+const defaultHotKeysTop = 20
+
+type hotKey struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"` // Оценка сверху
+}
+
+type HotKeys struct {
+	mu      sync.Mutex
+	sketch  [sketchDepth][sketchWidth]uint32
+	top     map[string]uint64 // Самые частые ключи и их оценки
+	tracked int               // Сколько ключей хранить в top
+	floor   uint64            // Не больше наименьшей оценки в полном top
+}
+
+var hotKeys *HotKeys // nil - учёт отключён
+
+// NewHotKeys returns a tracker keeping the tracked hottest keys.
+func NewHotKeys(tracked int) *HotKeys {
+	return &HotKeys{top: make(map[string]uint64, tracked), tracked: tracked}
+}
+
+// Record counts an access to key.
+func (h *HotKeys) Record(key string) {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	sum := hash.Sum64()
+	lo, hi := uint32(sum), uint32(sum>>32)|1
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	estimate := uint32(math.MaxUint32)
+	for i := range h.sketch {
+		c := &h.sketch[i][(lo+uint32(i)*hi)%sketchWidth]
+		if *c < math.MaxUint32 {
+			*c++
+		}
+		estimate = min(estimate, *c)
+	}
+
+	h.admit(key, uint64(estimate))
+}
+
+// admit keeps key in top with its estimate n if it is among the hottest;
+// h.mu must be held.
+func (h *HotKeys) admit(key string, n uint64) {
+	if _, ok := h.top[key]; ok || len(h.top) < h.tracked {
+		h.top[key] = n
+		return
+	}
+
+	if n <= h.floor {
+		return
+	}
+
+	coldest, least := "", uint64(math.MaxUint64)
+	for k, c := range h.top {
+		if c < least {
+			coldest, least = k, c
+		}
+	}
+
+	if n <= least {
+		h.floor = least
+		return
+	}
+
+	delete(h.top, coldest)
+	h.top[key] = n
+	h.floor = least // Меньше или равно новой наименьшей оценке
+}
+
+// decay halves every count, forgetting the keys whose count drops to 0.
+func (h *HotKeys) decay() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i := range h.sketch {
+		for j := range h.sketch[i] {
+			h.sketch[i][j] /= 2
+		}
+	}
+
+	for key, n := range h.top {
+		if n /= 2; n == 0 {
+			delete(h.top, key)
+		} else {
+			h.top[key] = n
+		}
+	}
+
+	h.floor /= 2
+}
+
+// runDecay halves the counts every interval.
+func (h *HotKeys) runDecay(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		h.decay()
+	}
+}
+
+// Top returns up to n of the hottest keys, the hottest first.
+func (h *HotKeys) Top(n int) []hotKey {
+	h.mu.Lock()
+	keys := make([]hotKey, 0, len(h.top))
+	for key, count := range h.top {
+		keys = append(keys, hotKey{key, count})
+	}
+	h.mu.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Count != keys[j].Count {
+			return keys[i].Count > keys[j].Count
+		}
+		return keys[i].Key < keys[j].Key
+	})
+
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+
+	return keys
+}
+
+// Middleware counts the key of every request that names one.
+func (h *HotKeys) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if key, ok := pathVars(r)["key"]; ok {
+			h.Record(key)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// hotKeysHandler serves GET /v1/stats/hotkeys?top=N.
+func hotKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if hotKeys == nil {
+		http.Error(w, "Hot key tracking is not enabled", http.StatusNotFound)
+		return
+	}
+
+	top := defaultHotKeysTop
+	if raw := r.URL.Query().Get("top"); raw != "" {
+		var err error
+		if top, err = strconv.Atoi(raw); err != nil || top <= 0 {
+			http.Error(w, "Invalid top", http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hotKeys.Top(top))
+}
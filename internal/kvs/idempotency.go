@@ -0,0 +1,206 @@
+package kvs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/**
+ * Idempotency keys.
+ *
+ * A write carrying an Idempotency-Key header is applied at most once per
+ * client and key within the configured window: its response is kept and
+ * sent again, marked by Idempotent-Replayed, to retries with the same key,
+ * method, URL and body. A retry that differs from the original gets 422,
+ * and one that arrives while the original is still being served gets
+ * 409. Server errors and responses over maxIdempotentResponse bytes are
+ * not kept, so such requests are applied again when retried. The keys
+ * live in memory only and the oldest are forgotten once maxKeys are held.
+ */
+const (
+	maxIdempotencyKeyLength = 255
+	maxIdempotentResponse   = 16 << 10
+)
+
+type idempotentResponse struct {
+	fingerprint [sha256.Size]byte
+	expires     time.Time
+	done        bool // false, пока запрос обслуживается
+
+	status int
+	header http.Header
+	body   []byte
+}
+
+type IdempotencyCache struct {
+	window  time.Duration
+	maxKeys int
+
+	mu        sync.Mutex
+	responses map[string]*idempotentResponse
+	order     []idempotentKey // В порядке появления, то есть истечения
+}
+
+type idempotentKey struct {
+	scope    string
+	response *idempotentResponse
+}
+
+// newIdempotencyCache returns nil when the window is 0, which disables
+// idempotency keys.
+func newIdempotencyCache(c IdempotencyConfig) *IdempotencyCache {
+	if c.Window <= 0 {
+		return nil
+	}
+
+	return &IdempotencyCache{window: c.Window, maxKeys: c.MaxKeys, responses: make(map[string]*idempotentResponse)}
+}
+
+// begin returns the response kept for scope, or registers a new one in
+// progress and reports it as fresh.
+func (c *IdempotencyCache) begin(scope string, fingerprint [sha256.Size]byte, now time.Time) (response idempotentResponse, fresh *idempotentResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.order) > 0 && (len(c.order) >= c.maxKeys || !now.Before(c.order[0].response.expires)) {
+		oldest := c.order[0]
+		if c.responses[oldest.scope] == oldest.response {
+			delete(c.responses, oldest.scope)
+		}
+		c.order = c.order[1:]
+	}
+
+	if kept, ok := c.responses[scope]; ok {
+		return *kept, nil
+	}
+
+	fresh = &idempotentResponse{fingerprint: fingerprint, expires: now.Add(c.window)}
+	c.responses[scope] = fresh
+	c.order = append(c.order, idempotentKey{scope, fresh})
+
+	return idempotentResponse{}, fresh
+}
+
+// finish keeps the recorded response of a fresh request, or forgets the
+// request if its response is not to be kept.
+func (c *IdempotencyCache) finish(scope string, response *idempotentResponse, recorder *idempotencyRecorder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if recorder.status == 0 || recorder.status >= 500 || recorder.overflow {
+		if c.responses[scope] == response {
+			delete(c.responses, scope)
+		}
+		return
+	}
+
+	response.status, response.header, response.body = recorder.status, recorder.header, recorder.body.Bytes()
+	response.done = true
+}
+
+// Middleware applies idempotency keys to requests that are not reads.
+func (c *IdempotencyCache) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" || requiredPermission(r) == PermRead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > maxIdempotencyKeyLength || !validRequestID(key) {
+			http.Error(w, "Invalid Idempotency-Key", http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, config.Limits.MaxBodyBytes))
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		hash := sha256.New()
+		io.WriteString(hash, r.Method+" "+r.URL.RequestURI()+"\n")
+		hash.Write(body)
+
+		var fingerprint [sha256.Size]byte
+		hash.Sum(fingerprint[:0])
+
+		scope := clientID(r) + "\x00" + key
+
+		kept, fresh := c.begin(scope, fingerprint, time.Now())
+
+		switch {
+		case fresh != nil:
+			recorder := &idempotencyRecorder{ResponseWriter: w}
+			defer c.finish(scope, fresh, recorder) // И при панике обработчика
+
+			next.ServeHTTP(recorder, r)
+
+		case kept.fingerprint != fingerprint:
+			http.Error(w, "Idempotency-Key was used for a different request", http.StatusUnprocessableEntity)
+
+		case !kept.done:
+			http.Error(w, "A request with this Idempotency-Key is in progress", http.StatusConflict)
+
+		default:
+			for name, values := range kept.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.Header().Set("Content-Length", strconv.Itoa(len(kept.body)))
+			w.WriteHeader(kept.status)
+			w.Write(kept.body)
+		}
+	})
+}
+
+// idempotencyRecorder copies a response as it is written, up to
+// maxIdempotentResponse bytes of body.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (r *idempotencyRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+		r.header = r.ResponseWriter.Header().Clone()
+		r.header.Del("X-Request-ID") // У повтора свой идентификатор
+		r.header.Del("Content-Length")
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *idempotencyRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+
+	if r.body.Len()+len(p) > maxIdempotentResponse {
+		r.overflow = true
+	} else if !r.overflow {
+		r.body.Write(p)
+	}
+
+	return r.ResponseWriter.Write(p)
+}
+
+func (r *idempotencyRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *idempotencyRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
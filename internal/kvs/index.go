@@ -0,0 +1,108 @@
+package kvs
+
+/**
+ * Ordered key index.
+ *
+ * Every shard of the sharded store keeps its keys in a skip list beside
+ * its map, under the shard lock, so that ranges and prefixes are read in
+ * key order without sorting the whole store. A key is indexed from its
+ * first write until it is removed; expired keys stay indexed until the
+ * reaper removes them. Range and List merge the indexes of the shards.
+ */
+const (
+	indexMaxLevel = 16 // Хватает на 4^16 ключей в шарде
+	indexBranch   = 4  // Узел поднимается на уровень выше с вероятностью 1/4
+)
+
+type keyIndex struct {
+	head  indexNode
+	level int    // Число используемых уровней
+	seed  uint64 // Состояние xorshift для высоты узлов
+}
+
+type indexNode struct {
+	key  string
+	next []*indexNode
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{head: indexNode{next: make([]*indexNode, indexMaxLevel)}, level: 1, seed: 0x9e3779b97f4a7c15}
+}
+
+// randomLevel returns the height of a new node.
+func (x *keyIndex) randomLevel() int {
+	x.seed ^= x.seed << 13
+	x.seed ^= x.seed >> 7
+	x.seed ^= x.seed << 17
+
+	level := 1
+	for r := x.seed; level < indexMaxLevel && r%indexBranch == 0; r /= indexBranch {
+		level++
+	}
+
+	return level
+}
+
+// path fills update with the last node before key on every level and
+// returns the first node at or after key, or nil.
+func (x *keyIndex) path(key string, update *[indexMaxLevel]*indexNode) *indexNode {
+	node := &x.head
+	for i := x.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].key < key {
+			node = node.next[i]
+		}
+		update[i] = node
+	}
+
+	return node.next[0]
+}
+
+// insert adds key if it is not indexed yet.
+func (x *keyIndex) insert(key string) {
+	var update [indexMaxLevel]*indexNode
+
+	if next := x.path(key, &update); next != nil && next.key == key {
+		return
+	}
+
+	level := x.randomLevel()
+	for ; x.level < level; x.level++ {
+		update[x.level] = &x.head
+	}
+
+	node := &indexNode{key: key, next: make([]*indexNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+}
+
+// remove drops key if it is indexed.
+func (x *keyIndex) remove(key string) {
+	var update [indexMaxLevel]*indexNode
+
+	node := x.path(key, &update)
+	if node == nil || node.key != key {
+		return
+	}
+
+	for i := 0; i < len(node.next); i++ {
+		update[i].next[i] = node.next[i]
+	}
+
+	for x.level > 1 && x.head.next[x.level-1] == nil {
+		x.level--
+	}
+}
+
+// seek returns the first node whose key is not before key, or nil.
+func (x *keyIndex) seek(key string) *indexNode {
+	node := &x.head
+	for i := x.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].key < key {
+			node = node.next[i]
+		}
+	}
+
+	return node.next[0]
+}
@@ -0,0 +1,377 @@
+//go:build kafka
+
+package kvs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+/**
+ * Kafka Transaction logger.
+ *
+ * Events are produced to the first partition of a Kafka topic, one
+ * message per event in the file log format, with the log header in the
+ * "format" message header; acknowledged by all in-sync replicas before
+ * Sync returns. Replay consumes the partition from the beginning up to
+ * its end at startup, so instances started from the same topic rebuild
+ * the same state, and other systems can consume the changes as they are
+ * written. Only one instance should write to a topic at a time.
+ *
+ * With an offset file, Close records the end of the partition and the
+ * last sequence number. A persistent store that reflects that sequence
+ * resumes the replay from the recorded offset instead of the beginning.
+ * Built only with the kafka tag: go build -tags kafka.
+ */
+const kafkaBatchEvents = 100 // Событий в одном запросе к брокеру
+
+type KafkaTransactionLogger struct {
+	eventQueue              // Очередь событий сопрограммы Run и её завершение
+	errors     <-chan error // Канал только для чтения; для приема ошибок
+	wg         sync.WaitGroup
+
+	brokers       []string
+	topic         string
+	offsetFile    string
+	applied       uint64 // Последовательность, отражённая в хранилище
+	writer        *kafka.Writer
+	sealer        *Sealer
+	compressAbove int // Сжимать значения не короче; 0 отключает сжатие
+	queueSize     int // Событий в очереди
+
+	mu       sync.Mutex
+	writeErr error // Ошибка последней записи, для Check
+
+	lastSequence uint64 // Последний использованный порядковый номер
+}
+
+// firstPartition sends every message to partition 0, which keeps the
+// events in order.
+type firstPartition struct{}
+
+func (firstPartition) Balance(msg kafka.Message, partitions ...int) int {
+	return 0
+}
+
+func NewKafkaTransactionLogger(c KafkaConfig, applied uint64, o LogOptions) (TransactionLogger, error) {
+	if len(c.Brokers) == 0 || c.Topic == "" {
+		return nil, errors.New("the kafka backend needs brokers and a topic")
+	}
+
+	return &KafkaTransactionLogger{
+		brokers:    c.Brokers,
+		topic:      c.Topic,
+		offsetFile: c.OffsetFile,
+		applied:    applied,
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(c.Brokers...),
+			Topic:        c.Topic,
+			Balancer:     firstPartition{},
+			RequiredAcks: kafka.RequireAll,
+			BatchSize:    kafkaBatchEvents,
+			BatchTimeout: time.Millisecond, // Запрос уходит, как только собран пакет
+		},
+		sealer:        o.Sealer,
+		compressAbove: o.CompressAbove,
+		queueSize:     o.QueueSize,
+	}, nil
+}
+
+func (l *KafkaTransactionLogger) Run() {
+	events := make(chan Event, l.queueSize) // Создать канал событий
+	l.events = events
+
+	errors := make(chan error, 1) // Создать канал ошибок
+	l.errors = errors
+
+	l.stopped = make(chan struct{})
+
+	l.wg.Add(1)
+
+	go func() {
+		defer l.wg.Done()
+		defer close(l.stopped)
+		defer close(errors) // Завершает наблюдателей Err
+
+		var batch []kafka.Message
+
+		for e := range events { // Извлечь следующее событие Event
+			if e.synced == nil {
+				e.Sequence = atomic.AddUint64(&l.lastSequence, 1)
+				batch = append(batch, l.message(e))
+			}
+
+			if len(events) > 0 && len(batch) < kafkaBatchEvents && e.synced == nil {
+				continue // Собрать пакет из уже ожидающих событий
+			}
+
+			err := l.produce(batch)
+			batch = batch[:0]
+
+			if e.synced != nil { // Всё записанное до Sync подтверждено брокерами
+				e.synced <- err
+			}
+
+			if err != nil {
+				errors <- err
+				return
+			}
+		}
+	}()
+}
+
+func (l *KafkaTransactionLogger) message(e Event) kafka.Message {
+	line := encodeEvent(l.sealer.sealEvent(compressEvent(e, l.compressAbove)))
+
+	return kafka.Message{
+		Value:   []byte(line),
+		Headers: []kafka.Header{{Key: "format", Value: []byte(l.sealer.logHeader())}},
+	}
+}
+
+func (l *KafkaTransactionLogger) produce(batch []kafka.Message) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	err := l.writer.WriteMessages(context.Background(), batch...)
+	if err != nil {
+		err = fmt.Errorf("failed to produce events: %w", err)
+	}
+
+	l.mu.Lock()
+	l.writeErr = err
+	l.mu.Unlock()
+
+	return err
+}
+
+// offsets returns the offset of the first message of the partition still
+// kept and the offset past its last message.
+func (l *KafkaTransactionLogger) offsets(ctx context.Context) (first, end int64, err error) {
+	conn, err := kafka.DialLeader(ctx, "tcp", l.brokers[0], l.topic, 0)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to reach kafka: %w", err)
+	}
+
+	defer conn.Close()
+
+	return conn.ReadOffsets()
+}
+
+// readOffsetFile returns the offset and sequence recorded by Close.
+func (l *KafkaTransactionLogger) readOffsetFile() (offset int64, sequence uint64, ok bool) {
+	if l.offsetFile == "" {
+		return 0, 0, false
+	}
+
+	data, err := os.ReadFile(l.offsetFile)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	rawOffset, rawSequence, _ := strings.Cut(strings.TrimSpace(string(data)), " ")
+
+	offset, err = strconv.ParseInt(rawOffset, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	sequence, err = strconv.ParseUint(rawSequence, 10, 64)
+
+	return offset, sequence, err == nil
+}
+
+func (l *KafkaTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
+	outEvent := make(chan Event)    // Небуферизованный канал событий
+	outError := make(chan error, 1) // Буферизованный канал ошибок
+
+	go func() {
+		defer close(outEvent) // Закрыть каналы
+		defer close(outError) // по завершении сопрограммы
+
+		ctx := context.Background()
+
+		start, end, err := l.offsets(ctx)
+		if err != nil {
+			outError <- err
+			return
+		}
+
+		if offset, sequence, ok := l.readOffsetFile(); ok && sequence <= l.applied && offset >= start && offset <= end {
+			start = offset // Всё до offset уже в хранилище
+			atomic.StoreUint64(&l.lastSequence, sequence)
+		}
+
+		if start >= end {
+			return
+		}
+
+		reader := kafka.NewReader(kafka.ReaderConfig{Brokers: l.brokers, Topic: l.topic, Partition: 0})
+		defer reader.Close()
+
+		if err := reader.SetOffset(start); err != nil {
+			outError <- fmt.Errorf("failed to seek kafka partition: %w", err)
+			return
+		}
+
+		for {
+			msg, err := reader.ReadMessage(ctx)
+			if err != nil {
+				outError <- fmt.Errorf("transaction log read failure: %w", err)
+				return
+			}
+
+			e, err := l.decodeMessage(msg)
+			if err != nil {
+				outError <- fmt.Errorf("offset %d: input parse error: %w", msg.Offset, err)
+				return
+			}
+
+			if e.Sequence > l.lastSequence {
+				atomic.StoreUint64(&l.lastSequence, e.Sequence)
+				outEvent <- e
+			}
+
+			if msg.Offset >= end-1 {
+				return
+			}
+		}
+	}()
+
+	return outEvent, outError
+}
+
+func (l *KafkaTransactionLogger) decodeMessage(msg kafka.Message) (Event, error) {
+	format := logFormats[fileLogHeader]
+
+	for _, h := range msg.Headers {
+		if h.Key == "format" {
+			var err error
+			if format, err = checkLogHeader(string(h.Value)+"\n", l.sealer); err != nil {
+				return Event{}, err
+			}
+		}
+	}
+
+	e, err := format.decode(string(msg.Value))
+	if err != nil {
+		return Event{}, err
+	}
+
+	return l.sealer.openEvent(e)
+}
+
+func (l *KafkaTransactionLogger) WritePut(key, value string, revision uint64) error {
+	return l.send(Event{EventType: EventPut, Key: key, Value: value, Revision: revision})
+}
+
+func (l *KafkaTransactionLogger) WriteDelete(key string) error {
+	return l.send(Event{EventType: EventDelete, Key: key})
+}
+
+func (l *KafkaTransactionLogger) WriteExpire(key string, deadline time.Time) error {
+	return l.send(Event{EventType: EventExpire, Key: key, Value: strconv.FormatInt(deadline.UnixNano(), 10)})
+}
+
+func (l *KafkaTransactionLogger) WriteExpired(key string) error {
+	return l.send(Event{EventType: EventExpired, Key: key})
+}
+
+func (l *KafkaTransactionLogger) WriteTombstone(key string, until time.Time) error {
+	return l.send(Event{EventType: EventTombstone, Key: key, Value: strconv.FormatInt(until.UnixNano(), 10)})
+}
+
+func (l *KafkaTransactionLogger) WriteSchedule(key, op string, at time.Time) error {
+	return l.send(Event{EventType: EventSchedule, Key: key, Value: scheduleValue(op, at)})
+}
+
+func (l *KafkaTransactionLogger) WriteContentType(key, contentType string) error {
+	return l.send(Event{EventType: EventContentType, Key: key, Value: contentType})
+}
+
+func (l *KafkaTransactionLogger) WriteReadOnly(enabled bool) error {
+	return l.send(Event{EventType: EventReadOnly, Value: strconv.FormatBool(enabled)})
+}
+
+func (l *KafkaTransactionLogger) WriteTxn(ops []Event) error {
+	return l.send(Event{EventType: EventTxn, Value: encodeTxnEvents(ops)})
+}
+
+func (l *KafkaTransactionLogger) WriteIncrement(key, value string, revision uint64) error {
+	return l.send(Event{EventType: EventIncrement, Key: key, Value: value, Revision: revision})
+}
+
+// Sync blocks until every event written before the call is acknowledged.
+func (l *KafkaTransactionLogger) Sync(ctx context.Context) error {
+	return l.syncEvents(ctx)
+}
+
+// Check reports whether the logger goroutine is running and the last
+// write succeeded.
+func (l *KafkaTransactionLogger) Check() error {
+	select {
+	case <-l.stopped:
+		return ErrorLoggerStopped
+	default:
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.writeErr
+}
+
+func (l *KafkaTransactionLogger) Err() <-chan error {
+	return l.errors
+}
+
+func (l *KafkaTransactionLogger) Queue() (int, int) {
+	return len(l.events), cap(l.events)
+}
+
+func (l *KafkaTransactionLogger) LastSequence() uint64 {
+	return atomic.LoadUint64(&l.lastSequence)
+}
+
+// Close stops accepting events, waits until the buffered ones are
+// produced and records the end of the partition in the offset file.
+func (l *KafkaTransactionLogger) Close() error {
+	if l.events != nil {
+		l.closeEvents()
+	}
+
+	l.wg.Wait()
+
+	var err error
+	select {
+	case err = <-l.errors:
+	default:
+	}
+
+	if cerr := l.writer.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil || l.offsetFile == "" {
+		return err
+	}
+
+	_, end, err := l.offsets(context.Background())
+	if err != nil {
+		return err
+	}
+
+	record := fmt.Sprintf("%d %d\n", end, l.LastSequence())
+
+	return os.WriteFile(l.offsetFile, []byte(record), 0644)
+}
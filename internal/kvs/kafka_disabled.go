@@ -0,0 +1,11 @@
+//go:build !kafka
+
+package kvs
+
+import "errors"
+
+// NewKafkaTransactionLogger fails in builds without the kafka tag, which
+// leave the Kafka client out.
+func NewKafkaTransactionLogger(c KafkaConfig, applied uint64, o LogOptions) (TransactionLogger, error) {
+	return nil, errors.New("the kafka transaction log backend is not built in; build with -tags kafka")
+}
@@ -0,0 +1,178 @@
+package kvs
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+/**
+ * Key rules.
+ *
+ * Every key a client names, in a URL, a query, a body or a RESP,
+ * memcached or gRPC command, is first normalized as keys.lowercase and
+ * keys.trim require, so that "User-1 " and "user-1" name the same key;
+ * the prefixes, bounds and patterns of listings are lowercased too. A
+ * write that creates or changes a key then checks it against the rules:
+ * at most limits.max_key_bytes bytes (413), and with keys.printable valid
+ * UTF-8 without control characters, with keys.reject_traversal no "." or
+ * ".." segment between slashes, which clients and proxies resolve in
+ * URLs, and with keys.pattern a match of the whole key. A key refused gets
+ * 400 with the rule it breaks. Reads and deletes are not checked, so that
+ * the keys written before a rule was set stay reachable.
+ */
+var ErrorInvalidKey = errors.New("Invalid key")
+
+type KeysConfig struct {
+	Pattern         string `yaml:"pattern"`          // Регулярное выражение для всего ключа; пустое допускает любой
+	Printable       bool   `yaml:"printable"`        // Только UTF-8 без управляющих символов
+	RejectTraversal bool   `yaml:"reject_traversal"` // Без сегментов "." и ".."
+	Lowercase       bool   `yaml:"lowercase"`
+	Trim            bool   `yaml:"trim"` // Убирать пробелы по краям
+}
+
+// compile returns the pattern anchored to the whole key, or nil without
+// one.
+func (c KeysConfig) compile() (*regexp.Regexp, error) {
+	if c.Pattern == "" {
+		return nil, nil
+	}
+
+	return regexp.Compile(`^(?:` + c.Pattern + `)$`)
+}
+
+var keyPattern *regexp.Regexp // Из keys.pattern
+
+// normalize returns key as it is stored under the rules of c.
+func (c KeysConfig) normalize(key string) string {
+	if c.Trim {
+		key = strings.TrimSpace(key)
+	}
+
+	if c.Lowercase {
+		key = strings.ToLower(key)
+	}
+
+	return key
+}
+
+// normalizeBound returns the prefix or range bound of a listing as it
+// compares with the keys stored under the rules of c. Spaces are kept:
+// they may be inside a key.
+func (c KeysConfig) normalizeBound(bound string) string {
+	if c.Lowercase {
+		return strings.ToLower(bound)
+	}
+
+	return bound
+}
+
+// normalizeKey returns key as it is stored.
+func normalizeKey(key string) string {
+	return config.Keys.normalize(key)
+}
+
+// normalizeBound returns the prefix or range bound of a listing as it
+// compares with the stored keys.
+func normalizeBound(bound string) string {
+	return config.Keys.normalizeBound(bound)
+}
+
+// normalizeKeys normalizes keys in place.
+func normalizeKeys(keys []string) {
+	for i, key := range keys {
+		keys[i] = normalizeKey(key)
+	}
+}
+
+// validateKey checks a normalized key a write is about to create or
+// change.
+func validateKey(key string) error {
+	return checkKey(key, config, keyPattern)
+}
+
+// checkKey checks key against the rules of c, pattern being the compiled
+// keys.pattern of c.
+func checkKey(key string, c *Config, pattern *regexp.Regexp) error {
+	if len(key) > c.Limits.MaxKeyBytes {
+		return ErrorKeyTooLong
+	}
+
+	if key == "" {
+		return fmt.Errorf("%w: empty", ErrorInvalidKey)
+	}
+
+	if c.Keys.Printable {
+		if !utf8.ValidString(key) {
+			return fmt.Errorf("%w: not valid UTF-8", ErrorInvalidKey)
+		}
+
+		if i := strings.IndexFunc(key, unicode.IsControl); i >= 0 {
+			r, _ := utf8.DecodeRuneInString(key[i:])
+			return fmt.Errorf("%w: control character %U at byte %d", ErrorInvalidKey, r, i)
+		}
+	}
+
+	if c.Keys.RejectTraversal {
+		for _, segment := range strings.Split(key, "/") {
+			if segment == "." || segment == ".." {
+				return fmt.Errorf("%w: %q path segment", ErrorInvalidKey, segment)
+			}
+		}
+	}
+
+	if pattern != nil && !pattern.MatchString(key) {
+		return fmt.Errorf("%w: does not match %s", ErrorInvalidKey, c.Keys.Pattern)
+	}
+
+	return nil
+}
+
+// keyError replies to a write whose key validateKey refused.
+func keyError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	if errors.Is(err, ErrorKeyTooLong) {
+		status = http.StatusRequestEntityTooLarge
+	}
+
+	http.Error(w, err.Error(), status)
+}
+
+// normalizeRequestKeys normalizes the key in the path of a request and
+// the prefix, bounds and pattern in its query, before the layers that
+// check or route by them.
+func normalizeRequestKeys(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if key, ok := pathVars(r)["key"]; ok {
+			if normalized := normalizeKey(key); normalized != key {
+				r = withPathVar(r, "key", normalized)
+			}
+		}
+
+		if config.Keys.Lowercase && r.URL.RawQuery != "" {
+			query, changed := r.URL.Query(), false
+
+			for _, name := range []string{"prefix", "start", "end", "pattern"} {
+				if values, ok := query[name]; ok {
+					for i, v := range values {
+						values[i] = normalizeBound(v)
+					}
+					changed = true
+				}
+			}
+
+			if changed {
+				u := *r.URL
+				u.RawQuery = query.Encode()
+				r = r.Clone(r.Context())
+				r.URL = &u
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
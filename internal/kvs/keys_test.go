@@ -0,0 +1,52 @@
+package kvs
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDeleteNormalizesKey(t *testing.T) {
+	defer func(c *Config, s Store, b *Broker) { config, store, broker = c, s, b }(config, store, broker)
+
+	config = DefaultConfig()
+	config.Keys.Lowercase = true
+	store = NewShardedStore(4, 0, 0, false)
+	broker = NewBroker(config.Watch.BufferSize)
+
+	l := startTestLog(t, filepath.Join(t.TempDir(), "transaction.log"))
+	defer l.Close()
+
+	if _, err := store.Put(context.Background(), "foo", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	router := NewRouter() // Без normalizeRequestKeys
+	router.HandleFunc("/v1/key/{key}", keyValueDeleteHandler).Methods("DELETE").Name("delete")
+
+	tests := []struct {
+		key    string
+		status int
+	}{
+		{"Foo", http.StatusOK},
+		{"FOO", http.StatusNotFound},
+		{strings.Repeat("a", config.Limits.MaxKeyBytes+1), http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/v1/key/"+tt.key, nil))
+
+		if w.Code != tt.status {
+			t.Errorf("DELETE %.10s: got %d, want %d", tt.key, w.Code, tt.status)
+		}
+	}
+
+	if _, err := store.Get(context.Background(), "foo"); !errors.Is(err, ErrorNoSuchKey) {
+		t.Fatalf("foo survives DELETE Foo (%v)", err)
+	}
+}
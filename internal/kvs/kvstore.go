@@ -0,0 +1,1344 @@
+package kvs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"time"
+)
+
+/**
+ * Store on an embedded key-value database.
+ *
+ * Keeps the keys in an ordered key-value database on disk instead of
+ * memory, so the data set does not have to fit in RAM and a restart does
+ * not replay the whole transaction log: the store records the sequence
+ * number it reflects at shutdown (see PersistentStore). Every method runs
+ * in one database transaction, which makes Batch, Txn, DeleteMatching and
+ * ReplaceAll atomic, and every write is on disk when it returns.
+ *
+ * The database holds the records of the keys in the "keys" bucket, their
+ * deadlines ordered by time in "expires" for the reaper, the previous
+ * revisions in "history", the tombstones in "tombstones" and the recorded
+ * sequence number in "meta". Compression, history depth and tombstones
+ * behave as in the sharded store; modification and creation times, and
+ * the checksums of the values, survive restarts.
+ *
+ * The databases themselves - bbolt, Badger and SQLite - are behind kvDB,
+ * each in its own file built only with its tag, such as go build -tags
+ * bbolt.
+ */
+var (
+	kvKeys       = []byte("keys")
+	kvExpires    = []byte("expires")
+	kvHistory    = []byte("history")
+	kvTombstones = []byte("tombstones")
+	kvMeta       = []byte("meta")
+
+	kvBuckets = [][]byte{kvKeys, kvExpires, kvHistory, kvTombstones, kvMeta}
+
+	kvSequence = []byte("sequence")
+)
+
+var ErrorCorruptRecord = errors.New("Corrupt store record")
+
+// errStopScan ends a kvTx.Scan early without an error.
+var errStopScan = errors.New("stop scan")
+
+// kvDB is an ordered key-value database with the buckets of kvBuckets.
+type kvDB interface {
+	View(fn func(tx kvTx) error) error
+	Update(fn func(tx kvTx) error) error // Повторяет fn при конфликте транзакций
+	Close() error
+}
+
+// kvTx is a database transaction. Slices it hands out are only valid
+// until the transaction ends.
+type kvTx interface {
+	Get(bucket, key []byte) ([]byte, error) // nil для отсутствующего ключа
+	Put(bucket, key, value []byte) error
+	Delete(bucket, key []byte) error
+	Clear(bucket []byte) error
+
+	// Scan calls fn for each key of the bucket that starts with prefix, in
+	// order, starting at from if it is not nil. fn ends the scan by
+	// returning an error; errStopScan ends it without one.
+	Scan(bucket, prefix, from []byte, fn func(k, v []byte) error) error
+}
+
+type KVStore struct {
+	db            kvDB
+	compressAbove int  // Сжимать значения не короче; 0 отключает сжатие
+	historyDepth  int  // 0 отключает историю
+	checksums     bool // Хранить SHA-256 значений
+	applied       uint64
+}
+
+// NewKVStore returns a store on db that keeps values of at least
+// compressAbove bytes compressed, unless compressAbove is 0, and up to
+// historyDepth previous revisions of each key, with the checksums of the
+// values if checksums is set.
+func NewKVStore(db kvDB, compressAbove, historyDepth int, checksums bool) (*KVStore, error) {
+	s := &KVStore{db: db, compressAbove: compressAbove, historyDepth: historyDepth, checksums: checksums}
+
+	err := db.View(func(tx kvTx) error {
+		raw, err := tx.Get(kvMeta, kvSequence)
+		if len(raw) == 8 {
+			s.applied = binary.BigEndian.Uint64(raw)
+		}
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// AppliedSequence returns the sequence number recorded at the last clean
+// shutdown.
+func (s *KVStore) AppliedSequence() uint64 {
+	return s.applied
+}
+
+// Close records sequence as the last event the store reflects and closes
+// the database.
+func (s *KVStore) Close(sequence uint64) error {
+	err := s.db.Update(func(tx kvTx) error {
+		return tx.Put(kvMeta, kvSequence, binary.BigEndian.AppendUint64(nil, sequence))
+	})
+
+	if cerr := s.db.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// record is an item as stored in the keys and tombstones buckets.
+type record struct {
+	item
+	expires time.Time // Нулевой - без срока действия
+	until   time.Time // Только у надгробий
+}
+
+// Flags of an encoded record.
+const (
+	recordCompressed = 1 << iota
+	recordCreated    // За флагами следует время создания; нет в записях старых версий
+	recordChecksum   // За временем создания следует SHA-256 значения
+)
+
+// encode lays out the record as the revision, the deadlines and the
+// modification time, the flags, the creation time, the checksum, the
+// content type and the value.
+func (r record) encode() []byte {
+	flags := byte(recordCreated)
+	if r.compressed {
+		flags |= recordCompressed
+	}
+
+	if r.sum != nil {
+		flags |= recordChecksum
+	}
+
+	buf := binary.AppendUvarint(nil, r.revision)
+	buf = binary.AppendVarint(buf, unixNanos(r.expires))
+	buf = binary.AppendVarint(buf, unixNanos(r.until))
+	buf = binary.AppendVarint(buf, unixNanos(r.modified))
+	buf = append(buf, flags)
+	buf = binary.AppendVarint(buf, unixNanos(r.created))
+	if r.sum != nil {
+		buf = append(buf, r.sum[:]...)
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(r.contentType)))
+	buf = append(buf, r.contentType...)
+
+	return append(buf, r.value...)
+}
+
+func decodeRecord(raw []byte) (record, error) {
+	var r record
+	var nanos [3]int64
+	var n int
+
+	if r.revision, n = binary.Uvarint(raw); n <= 0 {
+		return record{}, ErrorCorruptRecord
+	}
+	raw = raw[n:]
+
+	for i := range nanos {
+		if nanos[i], n = binary.Varint(raw); n <= 0 {
+			return record{}, ErrorCorruptRecord
+		}
+		raw = raw[n:]
+	}
+
+	if len(raw) < 1 {
+		return record{}, ErrorCorruptRecord
+	}
+	flags := raw[0]
+	r.compressed = flags&recordCompressed != 0
+	raw = raw[1:]
+
+	if flags&recordCreated != 0 {
+		created, n := binary.Varint(raw)
+		if n <= 0 {
+			return record{}, ErrorCorruptRecord
+		}
+		r.created = fromUnixNanos(created)
+		raw = raw[n:]
+	}
+
+	if flags&recordChecksum != 0 {
+		if len(raw) < sha256.Size {
+			return record{}, ErrorCorruptRecord
+		}
+		r.sum = new([sha256.Size]byte)
+		raw = raw[copy(r.sum[:], raw):]
+	}
+
+	length, n := binary.Uvarint(raw)
+	if n <= 0 || uint64(len(raw)-n) < length {
+		return record{}, ErrorCorruptRecord
+	}
+
+	r.contentType = string(raw[n : n+int(length)])
+	r.value = string(raw[n+int(length):]) // Копия: срез действителен только в транзакции
+	r.expires, r.until, r.modified = fromUnixNanos(nanos[0]), fromUnixNanos(nanos[1]), fromUnixNanos(nanos[2])
+
+	return r, nil
+}
+
+func unixNanos(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.UnixNano()
+}
+
+func fromUnixNanos(nanos int64) time.Time {
+	if nanos == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, nanos)
+}
+
+// expiryKey orders the expires bucket by deadline, then by key.
+func expiryKey(key string, deadline time.Time) []byte {
+	return append(binary.BigEndian.AppendUint64(nil, uint64(deadline.UnixNano())), key...)
+}
+
+// historyPrefix starts the history keys of key; the revision follows in
+// big-endian order, so the revisions of a key are ordered oldest first.
+func historyPrefix(key string) []byte {
+	return append(binary.AppendUvarint(nil, uint64(len(key))), key...)
+}
+
+// newItem builds the item for value, compressing it if it reaches the
+// store's threshold, with its checksum if the store keeps them.
+func (s *KVStore) newItem(value string, revision uint64, contentType string) item {
+	it := item{value: value, revision: revision, contentType: contentType}
+	if s.checksums {
+		it.sum = checksum(value)
+	}
+
+	if s.compressAbove > 0 && len(value) >= s.compressAbove {
+		it.value, it.compressed = deflateValue(value)
+	}
+
+	return it
+}
+
+// load returns the record of key, expired or not.
+func (s *KVStore) load(tx kvTx, key string) (record, bool, error) {
+	raw, err := tx.Get(kvKeys, []byte(key))
+	if err != nil || raw == nil {
+		return record{}, false, err
+	}
+
+	r, err := decodeRecord(raw)
+
+	return r, err == nil, err
+}
+
+// live returns the record of key, or the zero record if it is absent or
+// expired.
+func (s *KVStore) live(tx kvTx, key string, now time.Time) (record, error) {
+	r, ok, err := s.load(tx, key)
+	if !ok || (!r.expires.IsZero() && !now.Before(r.expires)) {
+		return record{}, err
+	}
+
+	return r, nil
+}
+
+// write writes the record of key and keeps the expires bucket in step
+// with its deadline.
+func (s *KVStore) write(tx kvTx, key string, r record) error {
+	previous, _, err := s.load(tx, key)
+	if err != nil {
+		return err
+	}
+
+	if !previous.expires.IsZero() {
+		if err := tx.Delete(kvExpires, expiryKey(key, previous.expires)); err != nil {
+			return err
+		}
+	}
+
+	if !r.expires.IsZero() {
+		if err := tx.Put(kvExpires, expiryKey(key, r.expires), []byte{}); err != nil {
+			return err
+		}
+	}
+
+	return tx.Put(kvKeys, []byte(key), r.encode())
+}
+
+// replace stores it under key with the given deadline and moves the item
+// it replaces to the key's history, unless that item is not live or it
+// starts the key over.
+func (s *KVStore) replace(tx kvTx, key string, it item, expires, now time.Time) error {
+	previous, err := s.live(tx, key, now)
+	if err != nil {
+		return err
+	}
+
+	if s.historyDepth > 0 {
+		if previous.revision == 0 || previous.revision >= it.revision {
+			err = s.dropHistory(tx, key)
+		} else {
+			err = s.addHistory(tx, key, previous.item)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Delete(kvTombstones, []byte(key)); err != nil {
+		return err
+	}
+
+	it.modified, it.created = now, it.createdOver(previous.item, now)
+
+	return s.write(tx, key, record{item: it, expires: expires})
+}
+
+// historyKeys returns the history keys of key, oldest first.
+func (s *KVStore) historyKeys(tx kvTx, key string) ([][]byte, error) {
+	prefix := historyPrefix(key)
+
+	var keys [][]byte
+
+	err := tx.Scan(kvHistory, prefix, nil, func(k, v []byte) error {
+		if len(k) == len(prefix)+8 {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		return nil
+	})
+
+	return keys, err
+}
+
+// addHistory appends it to the history of key and drops the revisions
+// beyond the history depth.
+func (s *KVStore) addHistory(tx kvTx, key string, it item) error {
+	if err := tx.Put(kvHistory, binary.BigEndian.AppendUint64(historyPrefix(key), it.revision), record{item: it}.encode()); err != nil {
+		return err
+	}
+
+	keys, err := s.historyKeys(tx, key)
+	if err != nil {
+		return err
+	}
+
+	for len(keys) > s.historyDepth {
+		if err := tx.Delete(kvHistory, keys[0]); err != nil {
+			return err
+		}
+		keys = keys[1:]
+	}
+
+	return nil
+}
+
+func (s *KVStore) dropHistory(tx kvTx, key string) error {
+	keys, err := s.historyKeys(tx, key)
+	if err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		if err := tx.Delete(kvHistory, k); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// forget removes key with its deadline, history and tombstone.
+func (s *KVStore) forget(tx kvTx, key string) error {
+	r, ok, err := s.load(tx, key)
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		if !r.expires.IsZero() {
+			if err := tx.Delete(kvExpires, expiryKey(key, r.expires)); err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Delete(kvKeys, []byte(key)); err != nil {
+			return err
+		}
+	}
+
+	if err := s.dropHistory(tx, key); err != nil {
+		return err
+	}
+
+	return tx.Delete(kvTombstones, []byte(key))
+}
+
+// put stores value under key without a deadline and returns the key's
+// new revision.
+func (s *KVStore) put(tx kvTx, key, value, contentType string, deadline, now time.Time) (uint64, error) {
+	r, err := s.live(tx, key, now)
+	if err != nil {
+		return 0, err
+	}
+
+	revision := r.revision + 1
+
+	return revision, s.replace(tx, key, s.newItem(value, revision, contentType), deadline, now)
+}
+
+func (r record) entry(key string) Entry {
+	return Entry{Key: key, Value: r.text(), Revision: r.revision, ContentType: r.contentType, Expires: r.expires, Modified: r.modified, Created: r.created, Checksum: formatChecksum(r.sum)}
+}
+
+func (s *KVStore) Get(ctx context.Context, key string) (string, error) {
+	entry, err := s.GetEntry(ctx, key)
+
+	return entry.Value, err
+}
+
+func (s *KVStore) GetEntry(ctx context.Context, key string) (Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return Entry{}, err
+	}
+
+	var entry Entry
+
+	err := s.db.View(func(tx kvTx) error {
+		r, err := s.live(tx, key, time.Now())
+		if err != nil {
+			return err
+		}
+
+		if r.revision == 0 {
+			return ErrorNoSuchKey
+		}
+
+		entry = r.entry(key)
+
+		return verifyChecksum(key, entry.Value, r.sum)
+	})
+
+	return entry, err
+}
+
+// Repair replaces the value of key with value if the key is at revision
+// and value has the checksum kept with it.
+func (s *KVStore) Repair(ctx context.Context, key, value string, revision uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx kvTx) error {
+		r, err := s.live(tx, key, time.Now())
+		if err != nil {
+			return err
+		}
+
+		if r.revision == 0 {
+			return ErrorNoSuchKey
+		}
+
+		if r.revision != revision {
+			return ErrorRevisionMismatch
+		}
+
+		if r.sum == nil || verifyChecksum(key, value, r.sum) != nil {
+			return fmt.Errorf("%w: %s", ErrorValueChecksum, key)
+		}
+
+		repaired := s.newItem(value, revision, r.contentType)
+		r.value, r.compressed = repaired.value, repaired.compressed
+
+		return s.write(tx, key, r)
+	})
+}
+
+// Put stores value under key and returns the key's new revision. The
+// commit of ctx, if any, runs once the transaction has (see withCommit);
+// the content type and deadline it carries are given to the key in the
+// transaction (see putAttributes).
+func (s *KVStore) Put(ctx context.Context, key string, value string) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	var previous record
+	var revision uint64
+
+	contentType, deadline := putAttributes(ctx)
+
+	err := s.db.Update(func(tx kvTx) (err error) {
+		now := time.Now()
+
+		if previous, err = s.live(tx, key, now); err != nil {
+			return err
+		}
+
+		revision, err = s.put(tx, key, value, contentType, deadline, now)
+		return err
+	})
+
+	if err == nil {
+		err = commitWrite(ctx, revision, func() bool { return previous.revision == 0 || previous.text() != value })
+	}
+
+	return revision, err
+}
+
+// CompareAndPut stores value only if the key currently has the given
+// revision, otherwise it fails with ErrorRevisionMismatch.
+func (s *KVStore) CompareAndPut(ctx context.Context, key, value string, revision uint64) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	var previous record
+	var next uint64
+
+	contentType, deadline := putAttributes(ctx)
+
+	err := s.db.Update(func(tx kvTx) (err error) {
+		now := time.Now()
+
+		if previous, err = s.live(tx, key, now); err != nil {
+			return err
+		}
+
+		if previous.revision != revision {
+			return ErrorRevisionMismatch
+		}
+
+		next, err = s.put(tx, key, value, contentType, deadline, now)
+		return err
+	})
+
+	if err == nil {
+		err = commitWrite(ctx, next, func() bool { return previous.revision == 0 || previous.text() != value })
+	}
+
+	return next, err
+}
+
+// Restore stores value with an explicit revision, as recorded in the
+// transaction log.
+func (s *KVStore) Restore(ctx context.Context, key, value string, revision uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx kvTx) error {
+		return s.replace(tx, key, s.newItem(value, revision, ""), time.Time{}, time.Now())
+	})
+}
+
+// Increment atomically adds by to the integer value of key, creating it
+// at 0 if it does not exist. An existing deadline and content type are
+// kept. The commit of ctx, if any, runs once the transaction has.
+func (s *KVStore) Increment(ctx context.Context, key string, by int64) (int64, uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	var value int64
+	var revision uint64
+
+	err := s.db.Update(func(tx kvTx) error {
+		now := time.Now()
+
+		r, err := s.live(tx, key, now)
+		if err != nil {
+			return err
+		}
+
+		var current int64
+		if r.revision != 0 {
+			if current, err = strconv.ParseInt(r.text(), 10, 64); err != nil {
+				return ErrorNotInteger
+			}
+		}
+
+		if (by > 0 && current > math.MaxInt64-by) || (by < 0 && current < math.MinInt64-by) {
+			return ErrorOverflow
+		}
+
+		value, revision = current+by, r.revision+1
+
+		return s.replace(tx, key, s.newItem(strconv.FormatInt(value, 10), revision, r.contentType), r.expires, now)
+	})
+
+	if err == nil {
+		err = commitIncrement(ctx, strconv.FormatInt(value, 10), revision)
+	}
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return value, revision, nil
+}
+
+// Append atomically appends suffix to the value of key, creating it if it
+// does not exist, and returns the new value, which may not exceed limit
+// bytes. An existing deadline and content type are kept. The commit of
+// ctx, if any, runs once the transaction has.
+func (s *KVStore) Append(ctx context.Context, key, suffix string, limit int64) (string, uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return "", 0, err
+	}
+
+	var value string
+	var revision uint64
+
+	err := s.db.Update(func(tx kvTx) error {
+		now := time.Now()
+
+		r, err := s.live(tx, key, now)
+		if err != nil {
+			return err
+		}
+
+		var current string
+		if r.revision != 0 {
+			current = r.text()
+		}
+
+		if int64(len(current)+len(suffix)) > limit {
+			return ErrorValueTooLarge
+		}
+
+		value, revision = current+suffix, r.revision+1
+
+		return s.replace(tx, key, s.newItem(value, revision, r.contentType), r.expires, now)
+	})
+
+	if err == nil {
+		err = commitIncrement(ctx, value, revision)
+	}
+
+	if err != nil {
+		return "", 0, err
+	}
+
+	return value, revision, nil
+}
+
+// Update stores value with an explicit revision and keeps the key's
+// deadline and content type, as recorded for increments in the
+// transaction log.
+func (s *KVStore) Update(ctx context.Context, key, value string, revision uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx kvTx) error {
+		r, _, err := s.load(tx, key)
+		if err != nil {
+			return err
+		}
+
+		return s.replace(tx, key, s.newItem(value, revision, r.contentType), r.expires, time.Now())
+	})
+}
+
+func (s *KVStore) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	err := s.db.Update(func(tx kvTx) error {
+		return s.forget(tx, key)
+	})
+
+	if err == nil {
+		err = commitWrite(ctx, 0, nil)
+	}
+
+	return err
+}
+
+// SoftDelete removes key like Delete, but keeps its value, content type
+// and deadline in a tombstone until the given moment. A key that is not
+// live is removed without one.
+func (s *KVStore) SoftDelete(ctx context.Context, key string, until time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	err := s.db.Update(func(tx kvTx) error {
+		now := time.Now()
+
+		r, err := s.live(tx, key, now)
+		if err != nil {
+			return err
+		}
+
+		if err := s.forget(tx, key); err != nil {
+			return err
+		}
+
+		if r.revision == 0 || !now.Before(until) {
+			return nil
+		}
+
+		r.until = until
+
+		return tx.Put(kvTombstones, []byte(key), r.encode())
+	})
+
+	if err == nil {
+		err = commitWrite(ctx, 0, nil)
+	}
+
+	return err
+}
+
+// Undelete brings back the value of a soft-deleted key as its next
+// revision, with the content type and deadline it had. It fails with
+// ErrorNoSuchKey if the key has no tombstone or the tombstone or the
+// key's deadline has run out. The commit of ctx, if any, runs as for a
+// batch of one put once the transaction has.
+func (s *KVStore) Undelete(ctx context.Context, key string) (Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return Entry{}, err
+	}
+
+	var entry Entry
+
+	err := s.db.Update(func(tx kvTx) error {
+		now := time.Now()
+
+		raw, err := tx.Get(kvTombstones, []byte(key))
+		if err != nil {
+			return err
+		}
+
+		if raw == nil {
+			return ErrorNoSuchKey
+		}
+
+		t, err := decodeRecord(raw)
+		if err != nil {
+			return err
+		}
+
+		if !now.Before(t.until) || (!t.expires.IsZero() && !now.Before(t.expires)) {
+			return ErrorNoSuchKey
+		}
+
+		it := t.item
+		it.revision++
+
+		if err := s.replace(tx, key, it, t.expires, now); err != nil {
+			return err
+		}
+
+		entry = Entry{Key: key, Value: it.text(), Revision: it.revision, ContentType: it.contentType, Expires: t.expires}
+
+		return nil
+	})
+
+	if err == nil {
+		ops, results := replaceOps(nil, []Entry{entry})
+		err = commitOps(ctx, ops, results)
+	}
+
+	return entry, err
+}
+
+// DeleteMatching removes every key for which match returns true in one
+// transaction and returns the removed live keys in order. The commit of
+// ctx, if any, runs as for a batch of their deletes once the transaction
+// has.
+func (s *KVStore) DeleteMatching(ctx context.Context, match func(key string) bool) (removed []string, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	err = s.db.Update(func(tx kvTx) error {
+		removed = nil
+		now := time.Now()
+
+		var matched []string
+
+		err := tx.Scan(kvKeys, nil, nil, func(k, v []byte) error {
+			if key := string(k); match(key) {
+				matched = append(matched, key)
+			}
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		for _, key := range matched { // Удаление после обхода: курсор не переживает изменений
+			r, err := s.live(tx, key, now)
+			if err != nil {
+				return err
+			}
+
+			if r.revision != 0 {
+				removed = append(removed, key)
+			}
+
+			if err := s.forget(tx, key); err != nil { // Истёкшие тоже, без записи в журнал
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err == nil {
+		ops, results := deleteOps(removed)
+		err = commitOps(ctx, ops, results)
+	}
+
+	return removed, err
+}
+
+// Expire sets the moment after which key is no longer visible and gets
+// evicted by the reaper.
+func (s *KVStore) Expire(ctx context.Context, key string, deadline time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx kvTx) error {
+		r, ok, err := s.load(tx, key)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			return ErrorNoSuchKey
+		}
+
+		r.expires = deadline
+
+		return s.write(tx, key, r)
+	})
+}
+
+// SetContentType records the media type of the key's value. It is
+// cleared by the next write that replaces the value.
+func (s *KVStore) SetContentType(ctx context.Context, key, contentType string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx kvTx) error {
+		r, ok, err := s.load(tx, key)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			return ErrorNoSuchKey
+		}
+
+		r.contentType = contentType
+
+		return s.write(tx, key, r)
+	})
+}
+
+// TTL returns the time left before key expires, or NoExpiration if it
+// has no deadline.
+func (s *KVStore) TTL(ctx context.Context, key string) (time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	var r record
+	var ok bool
+
+	err := s.db.View(func(tx kvTx) (err error) {
+		r, ok, err = s.load(tx, key)
+		return err
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	if !ok {
+		return 0, ErrorNoSuchKey
+	}
+
+	if r.expires.IsZero() {
+		return NoExpiration, nil
+	}
+
+	ttl := time.Until(r.expires)
+	if ttl <= 0 {
+		return 0, ErrorNoSuchKey
+	}
+
+	return ttl, nil
+}
+
+// List returns up to limit live entries whose keys start with prefix and
+// sort after the given key, ordered by key, from one read transaction.
+// Only the matching range of keys is read. more reports whether further
+// entries remain.
+func (s *KVStore) List(ctx context.Context, prefix, after string, limit int) (entries []Entry, more bool, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+
+	start := []byte(prefix)
+	if after >= prefix {
+		start = append([]byte(after), 0) // Первый ключ после after
+	}
+
+	err = s.db.View(func(tx kvTx) error {
+		now := time.Now()
+		entries = []Entry{}
+
+		return tx.Scan(kvKeys, []byte(prefix), start, func(k, v []byte) error {
+			r, err := decodeRecord(v)
+			if err != nil {
+				return err
+			}
+
+			if !r.expires.IsZero() && !now.Before(r.expires) {
+				return nil
+			}
+
+			if len(entries) == limit {
+				more = true
+				return errStopScan
+			}
+
+			entries = append(entries, Entry{Key: string(k), Value: r.text(), Revision: r.revision, ContentType: r.contentType})
+
+			return nil
+		})
+	})
+
+	return entries, more, err
+}
+
+// Range returns up to limit live entries whose keys sort from start up
+// to, but not including, end, ordered by key, from one read transaction;
+// an empty end leaves the range open. more reports whether further
+// entries remain.
+func (s *KVStore) Range(ctx context.Context, start, end string, limit int) (entries []Entry, more bool, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+
+	err = s.db.View(func(tx kvTx) error {
+		now := time.Now()
+		entries = []Entry{}
+
+		return tx.Scan(kvKeys, nil, []byte(start), func(k, v []byte) error {
+			if end != "" && string(k) >= end {
+				return errStopScan
+			}
+
+			r, err := decodeRecord(v)
+			if err != nil {
+				return err
+			}
+
+			if !r.expires.IsZero() && !now.Before(r.expires) {
+				return nil
+			}
+
+			if len(entries) == limit {
+				more = true
+				return errStopScan
+			}
+
+			entries = append(entries, Entry{Key: string(k), Value: r.text(), Revision: r.revision, ContentType: r.contentType})
+
+			return nil
+		})
+	})
+
+	return entries, more, err
+}
+
+// Stats returns the number of live keys and the total size of their
+// values as stored, after compression. It reads every key.
+func (s *KVStore) Stats(ctx context.Context) (keys int, bytes int64, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	err = s.db.View(func(tx kvTx) error {
+		now := time.Now()
+		keys, bytes = 0, 0
+
+		return tx.Scan(kvKeys, nil, nil, func(k, v []byte) error {
+			r, err := decodeRecord(v)
+			if err != nil {
+				return err
+			}
+
+			if r.expires.IsZero() || now.Before(r.expires) {
+				keys++
+				bytes += int64(len(r.value))
+			}
+
+			return nil
+		})
+	})
+
+	return keys, bytes, err
+}
+
+// ReapExpired removes every key whose deadline is not after now and
+// returns the removed keys. It also purges the tombstones that have run
+// out, without returning them. The due keys are found in a read
+// transaction first, so that a reap with nothing to do writes nothing.
+func (s *KVStore) ReapExpired(ctx context.Context, now time.Time) (reaped []string) {
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	var due []string
+	var expiredTombstones [][]byte
+
+	s.db.View(func(tx kvTx) error {
+		err := tx.Scan(kvExpires, nil, nil, func(k, v []byte) error {
+			if len(k) < 8 || int64(binary.BigEndian.Uint64(k)) > now.UnixNano() {
+				return errStopScan
+			}
+
+			due = append(due, string(k[8:]))
+
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		return tx.Scan(kvTombstones, nil, nil, func(k, v []byte) error {
+			t, err := decodeRecord(v)
+			if err != nil || !now.Before(t.until) || (!t.expires.IsZero() && !now.Before(t.expires)) {
+				expiredTombstones = append(expiredTombstones, append([]byte(nil), k...))
+			}
+			return nil
+		})
+	})
+
+	if len(due) == 0 && len(expiredTombstones) == 0 {
+		return nil
+	}
+
+	err := s.db.Update(func(tx kvTx) error {
+		reaped = nil
+
+		for _, key := range due {
+			r, ok, err := s.load(tx, key)
+			if err != nil {
+				return err
+			}
+
+			if !ok || r.expires.IsZero() || now.Before(r.expires) {
+				continue // Записан заново после чтения
+			}
+
+			if err := s.forget(tx, key); err != nil {
+				return err
+			}
+			reaped = append(reaped, key)
+		}
+
+		for _, k := range expiredTombstones {
+			if err := tx.Delete(kvTombstones, k); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		slog.Error("failed to reap expired keys", "error", err)
+		return nil
+	}
+
+	return reaped
+}
+
+// Batch applies ops in order in one transaction, so no other operation
+// observes a partially applied batch. The commit of ctx, if any, runs once
+// the transaction has.
+func (s *KVStore) Batch(ctx context.Context, ops []BatchOp) ([]BatchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var results []BatchResult
+
+	err := s.db.Update(func(tx kvTx) (err error) {
+		results, err = s.applyOps(tx, ops, time.Now())
+		return err
+	})
+
+	if err == nil {
+		err = commitOps(ctx, ops, results)
+	}
+
+	return results, err
+}
+
+// Txn evaluates t.Compare and applies t.Success if every comparison holds,
+// t.Failure otherwise, all in one transaction. The commit of ctx, if any,
+// runs once the transaction has.
+func (s *KVStore) Txn(ctx context.Context, t Txn) (TxnResult, error) {
+	if err := ctx.Err(); err != nil {
+		return TxnResult{}, err
+	}
+
+	var result TxnResult
+	var ops []BatchOp
+
+	err := s.db.Update(func(tx kvTx) error {
+		now := time.Now()
+		succeeded := true
+
+		for _, c := range t.Compare {
+			r, err := s.live(tx, c.Key, now)
+			if err != nil {
+				return err
+			}
+
+			if !c.holds(r.text(), r.revision) {
+				succeeded = false
+				break
+			}
+		}
+
+		ops = t.Failure
+		if succeeded {
+			ops = t.Success
+		}
+
+		results, err := s.applyOps(tx, ops, now)
+		result = TxnResult{Succeeded: succeeded, Results: results}
+
+		return err
+	})
+
+	if err == nil {
+		err = commitOps(ctx, ops, result.Results)
+	}
+
+	return result, err
+}
+
+func (s *KVStore) applyOps(tx kvTx, ops []BatchOp, now time.Time) ([]BatchResult, error) {
+	results := make([]BatchResult, len(ops))
+
+	for i, op := range ops {
+		result := BatchResult{Op: op.Op, Key: op.Key}
+
+		r, err := s.live(tx, op.Key, now)
+		if err != nil {
+			return nil, err
+		}
+
+		switch op.Op {
+		case BatchGet:
+			if r.revision != 0 {
+				result.Value, result.Revision, result.OK = r.text(), r.revision, true
+			}
+		case BatchPut:
+			result.Revision, result.OK = r.revision+1, true
+			if err := s.replace(tx, op.Key, s.newItem(op.Value, result.Revision, op.contentType), op.deadline, now); err != nil {
+				return nil, err
+			}
+		case BatchDelete:
+			if r.revision != 0 {
+				if err := s.forget(tx, op.Key); err != nil {
+					return nil, err
+				}
+				result.OK = true
+			}
+		}
+
+		results[i] = result
+	}
+
+	return results, nil
+}
+
+// Snapshot returns every live entry, including its deadline, from one
+// read transaction.
+func (s *KVStore) Snapshot(ctx context.Context) ([]Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+
+	err := s.db.View(func(tx kvTx) error {
+		now := time.Now()
+		entries = nil
+
+		return tx.Scan(kvKeys, nil, nil, func(k, v []byte) error {
+			r, err := decodeRecord(v)
+			if err != nil {
+				return err
+			}
+
+			if r.expires.IsZero() || now.Before(r.expires) {
+				entries = append(entries, Entry{Key: string(k), Value: r.text(), Revision: r.revision, ContentType: r.contentType, Expires: r.expires, Modified: r.modified, Created: r.created})
+			}
+
+			return nil
+		})
+	})
+
+	return entries, err
+}
+
+// ReplaceAll atomically swaps the whole content of the store for entries
+// and returns the keys that were present before but are not in entries.
+// The commit of ctx, if any, runs for the deletes of those keys and the
+// puts of entries once the transaction has (see replaceOps).
+func (s *KVStore) ReplaceAll(ctx context.Context, entries []Entry) (removed []string, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	incoming := make(map[string]struct{}, len(entries))
+	for _, e := range entries {
+		incoming[e.Key] = struct{}{}
+	}
+
+	err = s.db.Update(func(tx kvTx) error {
+		removed = nil
+
+		err := tx.Scan(kvKeys, nil, nil, func(k, v []byte) error {
+			if _, ok := incoming[string(k)]; !ok {
+				removed = append(removed, string(k))
+			}
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		for _, name := range [][]byte{kvKeys, kvExpires, kvHistory, kvTombstones} {
+			if err := tx.Clear(name); err != nil {
+				return err
+			}
+		}
+
+		now := time.Now()
+
+		for _, e := range entries {
+			it := s.newItem(e.Value, e.Revision, e.ContentType)
+			it.modified, it.created = restoredTimes(e, now)
+
+			if err := s.write(tx, e.Key, record{item: it, expires: e.Expires}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err == nil {
+		ops, results := replaceOps(removed, entries)
+		err = commitOps(ctx, ops, results)
+	}
+
+	return removed, err
+}
+
+// History returns the kept previous revisions of key followed by its
+// current value, oldest first.
+func (s *KVStore) History(ctx context.Context, key string) ([]Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+
+	err := s.db.View(func(tx kvTx) error {
+		current, err := s.live(tx, key, time.Now())
+		if err != nil {
+			return err
+		}
+
+		if current.revision == 0 {
+			return ErrorNoSuchKey
+		}
+
+		keys, err := s.historyKeys(tx, key)
+		if err != nil {
+			return err
+		}
+
+		entries = nil
+
+		for _, k := range keys {
+			raw, err := tx.Get(kvHistory, k)
+			if err != nil {
+				return err
+			}
+
+			r, err := decodeRecord(raw)
+			if err != nil {
+				return err
+			}
+
+			entries = append(entries, Entry{Key: key, Value: r.text(), Revision: r.revision, ContentType: r.contentType, Modified: r.modified, Created: r.created, Checksum: formatChecksum(r.sum)})
+		}
+
+		entries = append(entries, current.entry(key))
+
+		return nil
+	})
+
+	return entries, err
+}
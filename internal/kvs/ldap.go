@@ -0,0 +1,101 @@
+//go:build ldap
+
+package kvs
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+/**
+ * LDAP authentication.
+ *
+ * A user name and password are checked by binding to the directory as the
+ * user, whose DN is the configured template with the escaped name in
+ * place of %s. Every user may read; with a write group, only the users
+ * that the group lists as a member may write, and otherwise all of them.
+ * The members of the admin group, if one is set, have admin permission.
+ * Every check opens its own connection.
+ */
+const ldapTimeout = 10 * time.Second // Соединение и каждый запрос к каталогу
+
+type ldapProvider struct {
+	config LDAPConfig
+}
+
+func newLDAPProvider(c LDAPConfig) (AuthProvider, error) {
+	return &ldapProvider{config: c}, nil
+}
+
+func (p *ldapProvider) Authenticate(ctx context.Context, c Credentials) (Principal, error) {
+	if c.User == "" || c.Password == "" { // Пустой пароль - анонимная привязка, она всегда удаётся
+		return Principal{}, ErrorUnauthenticated
+	}
+
+	conn, err := ldap.DialURL(p.config.URL, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}))
+	if err != nil {
+		return Principal{}, fmt.Errorf("failed to connect to LDAP: %w", err)
+	}
+
+	defer conn.Close()
+
+	conn.SetTimeout(ldapTimeout)
+
+	dn := fmt.Sprintf(p.config.UserDN, ldap.EscapeDN(c.User))
+
+	if err := conn.Bind(dn, c.Password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return Principal{}, ErrorUnauthenticated
+		}
+		return Principal{}, fmt.Errorf("LDAP bind failed: %w", err)
+	}
+
+	principal := Principal{Name: "ldap:" + c.User, Permission: PermReadWrite}
+
+	if p.config.AdminGroup != "" {
+		admin, err := inLDAPGroup(conn, p.config.AdminGroup, dn)
+		if err != nil {
+			return Principal{}, err
+		}
+
+		if admin {
+			principal.Permission = PermAdmin
+			return principal, nil
+		}
+	}
+
+	if p.config.WriteGroup != "" {
+		writer, err := inLDAPGroup(conn, p.config.WriteGroup, dn)
+		if err != nil {
+			return Principal{}, err
+		}
+
+		if !writer {
+			principal.Permission = PermRead
+		}
+	}
+
+	return principal, nil
+}
+
+// inLDAPGroup reports whether the group with the DN group lists dn as a
+// member; a group that does not exist lists no one.
+func inLDAPGroup(conn *ldap.Conn, group, dn string) (bool, error) {
+	search := ldap.NewSearchRequest(group, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, int(ldapTimeout.Seconds()), false,
+		fmt.Sprintf("(|(member=%s)(uniqueMember=%s))", ldap.EscapeFilter(dn), ldap.EscapeFilter(dn)), []string{"dn"}, nil)
+
+	result, err := conn.Search(search)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, fmt.Errorf("LDAP group search failed: %w", err)
+	}
+
+	return len(result.Entries) > 0, nil
+}
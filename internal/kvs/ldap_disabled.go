@@ -0,0 +1,11 @@
+//go:build !ldap
+
+package kvs
+
+import "errors"
+
+// newLDAPProvider fails in builds without the ldap tag, which leave the
+// LDAP client out.
+func newLDAPProvider(c LDAPConfig) (AuthProvider, error) {
+	return nil, errors.New("LDAP authentication is not built in; build with -tags ldap")
+}
@@ -0,0 +1,246 @@
+package kvs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/**
+ * Locks.
+ *
+ * POST /v1/lock/{name}?ttl= acquires a named lock for a lease of ttl, or
+ * the configured default, unless another lease holds it, which is
+ * answered with 423 Locked and Retry-After. The holder renews the lease
+ * with POST /v1/lock/{name}/renew?lease=&ttl= and releases it with
+ * DELETE /v1/lock/{name}?lease=; both answer 410 Gone once the lease has
+ * run out or been released. Every acquisition gets a fencing token
+ * greater than any handed out before, so a resource guarded by the lock
+ * can refuse a holder whose lease has since passed to another.
+ *
+ * Locks live in memory only: a restart releases all of them, and tokens
+ * start from the clock so they still grow across restarts. In cluster
+ * mode a lock lives on the node that owns its name.
+ */
+const lockSweepInterval = time.Minute // Как часто удалять истёкшие аренды
+
+var ErrorLockHeld = errors.New("Lock is held by another lease")
+
+var ErrorLeaseLost = errors.New("Lease has expired or been released")
+
+type lease struct {
+	id      string
+	token   uint64
+	expires time.Time
+}
+
+type LockTable struct {
+	mu      sync.Mutex
+	leases  map[string]lease
+	fencing uint64 // Последний выданный маркер
+	swept   time.Time
+}
+
+var locks = NewLockTable()
+
+// NewLockTable returns a table with no locks held.
+func NewLockTable() *LockTable {
+	now := time.Now()
+
+	return &LockTable{leases: make(map[string]lease), fencing: uint64(now.UnixNano()), swept: now}
+}
+
+// Acquire takes the lock name for ttl, or fails with ErrorLockHeld and
+// the lease holding it.
+func (t *LockTable) Acquire(name string, ttl time.Duration, now time.Time) (lease, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if now.Sub(t.swept) > lockSweepInterval {
+		t.sweep(now)
+	}
+
+	if held, ok := t.leases[name]; ok && now.Before(held.expires) {
+		return held, ErrorLockHeld
+	}
+
+	var id [16]byte
+	rand.Read(id[:])
+
+	t.fencing++
+	l := lease{id: hex.EncodeToString(id[:]), token: t.fencing, expires: now.Add(ttl)}
+	t.leases[name] = l
+
+	return l, nil
+}
+
+// Renew extends the lease id on the lock name to ttl from now.
+func (t *LockTable) Renew(name, id string, ttl time.Duration, now time.Time) (lease, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	l, ok := t.leases[name]
+	if !ok || l.id != id || !now.Before(l.expires) {
+		return lease{}, ErrorLeaseLost
+	}
+
+	l.expires = now.Add(ttl)
+	t.leases[name] = l
+
+	return l, nil
+}
+
+// Release frees the lock name held by the lease id.
+func (t *LockTable) Release(name, id string, now time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	l, ok := t.leases[name]
+	if !ok || l.id != id || !now.Before(l.expires) {
+		return ErrorLeaseLost
+	}
+
+	delete(t.leases, name)
+
+	return nil
+}
+
+// Holder returns the live lease on the lock name.
+func (t *LockTable) Holder(name string, now time.Time) (lease, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	l, ok := t.leases[name]
+
+	return l, ok && now.Before(l.expires)
+}
+
+// sweep drops the leases that have run out. The caller must hold t.mu.
+func (t *LockTable) sweep(now time.Time) {
+	for name, l := range t.leases {
+		if !now.Before(l.expires) {
+			delete(t.leases, name)
+		}
+	}
+
+	t.swept = now
+}
+
+type lockInfo struct {
+	Name         string `json:"name"`
+	Lease        string `json:"lease,omitempty"` // Только держателю
+	FencingToken uint64 `json:"fencing_token"`
+	TTL          int64  `json:"ttl"` // Секунды до окончания аренды
+}
+
+// lockTTL returns the lease duration requested by the ttl query
+// parameter.
+func lockTTL(r *http.Request) (time.Duration, bool) {
+	raw := r.URL.Query().Get("ttl")
+	if raw == "" {
+		return current.Load().Locks.DefaultTTL, true
+	}
+
+	ttl, err := time.ParseDuration(raw)
+
+	return ttl, err == nil && ttl > 0 && ttl <= current.Load().Locks.MaxTTL
+}
+
+// writeLease replies with the lease on the lock name, naming the lease
+// only to its holder.
+func writeLease(w http.ResponseWriter, name string, l lease, withID bool, now time.Time) {
+	info := lockInfo{Name: name, FencingToken: l.token, TTL: ttlSeconds(l.expires.Sub(now))}
+	if withID {
+		info.Lease = l.id
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// lockAcquireHandler serves POST /v1/lock/{name}?ttl=.
+func lockAcquireHandler(w http.ResponseWriter, r *http.Request) {
+	name := pathVars(r)["name"]
+
+	ttl, ok := lockTTL(r)
+	if !ok {
+		http.Error(w, "Invalid ttl", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+
+	l, err := locks.Acquire(name, ttl, now)
+	if errors.Is(err, ErrorLockHeld) {
+		w.Header().Set("Retry-After", strconv.FormatInt(ttlSeconds(l.expires.Sub(now)), 10))
+		http.Error(w, err.Error(), http.StatusLocked)
+		return
+	}
+
+	writeLease(w, name, l, true, now)
+}
+
+// lockRenewHandler serves POST /v1/lock/{name}/renew?lease=&ttl=.
+func lockRenewHandler(w http.ResponseWriter, r *http.Request) {
+	name := pathVars(r)["name"]
+
+	id := r.URL.Query().Get("lease")
+	if id == "" {
+		http.Error(w, "Missing lease", http.StatusBadRequest)
+		return
+	}
+
+	ttl, ok := lockTTL(r)
+	if !ok {
+		http.Error(w, "Invalid ttl", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+
+	l, err := locks.Renew(name, id, ttl, now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+
+	writeLease(w, name, l, true, now)
+}
+
+// lockReleaseHandler serves DELETE /v1/lock/{name}?lease=.
+func lockReleaseHandler(w http.ResponseWriter, r *http.Request) {
+	name := pathVars(r)["name"]
+
+	id := r.URL.Query().Get("lease")
+	if id == "" {
+		http.Error(w, "Missing lease", http.StatusBadRequest)
+		return
+	}
+
+	if err := locks.Release(name, id, time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// lockGetHandler serves GET /v1/lock/{name}: the fencing token and time
+// left of the lease holding the lock, without its ID.
+func lockGetHandler(w http.ResponseWriter, r *http.Request) {
+	name := pathVars(r)["name"]
+	now := time.Now()
+
+	l, ok := locks.Holder(name, now)
+	if !ok {
+		http.Error(w, "Lock is not held", http.StatusNotFound)
+		return
+	}
+
+	writeLease(w, name, l, false, now)
+}
@@ -0,0 +1,515 @@
+package kvs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/**
+ * File Transaction log format.
+ *
+ * The log starts with a fileLogHeader line, which names the format and its
+ * version, followed by one binary record per event: the uvarint length of
+ * the payload, the payload and its big-endian IEEE CRC-32. The payload
+ * holds the uvarint sequence, the event type byte, the uvarint revision,
+ * the uvarint length of the key and the key, a flags byte and the value,
+ * all raw bytes, so replay needs no parsing or base64 decoding and any
+ * key or value survives. Kafka and NATS messages carry one record each.
+ *
+ * Logs in an older format are rewritten by migrateLog on startup, which
+ * is the converter from the text formats. S3 segments and messages are
+ * not migrated, so those in the text formats of textLogHeader and
+ * readableLogHeader are still read as is.
+ */
+const fileLogHeader = "#kvs-tlog v6"
+
+// textLogHeader is the previous format, with one event per line:
+// "sequence\ttype\trevision\tbase64(key)\tbase64(value)\tcrc32\n", the
+// last field being the hex IEEE CRC-32 of the rest of the line and a
+// compressed value having compressedPrefix before its base64.
+const textLogHeader = "#kvs-tlog v5"
+
+// readableLogHeader is the line format before textLogHeader, which only
+// differs in the events it may hold.
+const readableLogHeader = "#kvs-tlog v4"
+
+const eventCompressed byte = 1 << 0 // Флаг записи: значение сжато compressEvent
+
+var ErrorChecksumMismatch = errors.New("Event checksum mismatch")
+
+// logFormat describes how to read the records of a log format.
+type logFormat struct {
+	decode     func(record string) (Event, error)
+	revisions  bool // Формат хранит версии ключей
+	binary     bool // Записи с префиксом длины вместо строк
+	replayable bool // Читается без миграции
+}
+
+// logFormats maps the headers of known log formats, without the
+// encryption suffix. A log without any header is in the original
+// plain-text format.
+var logFormats = map[string]logFormat{
+	fileLogHeader:     {decodeEvent, true, true, true},
+	textLogHeader:     {decodeEventV5, true, false, true},
+	readableLogHeader: {decodeEventV5, true, false, true},
+	"#kvs-tlog v3":    {decodeEventV3, true, false, false},
+	"#kvs-tlog v2":    {decodeEventV2, false, false, false},
+}
+
+// read returns the next record of a log in the format. Like ReadString,
+// it returns io.EOF after the last record, together with a record cut
+// short by the end of the log, if any.
+func (f logFormat) read(r *bufio.Reader) (string, error) {
+	if f.binary {
+		return readRecord(r)
+	}
+
+	return r.ReadString('\n')
+}
+
+// encodeEvent renders e as a binary record.
+func encodeEvent(e Event) string {
+	payload := make([]byte, 0, 3*binary.MaxVarintLen64+len(e.Key)+len(e.Value)+2)
+	payload = binary.AppendUvarint(payload, e.Sequence)
+	payload = append(payload, byte(e.EventType))
+	payload = binary.AppendUvarint(payload, e.Revision)
+	payload = binary.AppendUvarint(payload, uint64(len(e.Key)))
+	payload = append(payload, e.Key...)
+
+	var flags byte
+	if e.compressed {
+		flags |= eventCompressed
+	}
+
+	payload = append(payload, flags)
+	payload = append(payload, e.Value...)
+
+	record := make([]byte, 0, binary.MaxVarintLen64+len(payload)+4)
+	record = binary.AppendUvarint(record, uint64(len(payload)))
+	record = append(record, payload...)
+	record = binary.BigEndian.AppendUint32(record, crc32.ChecksumIEEE(payload))
+
+	return string(record)
+}
+
+// readRecord reads the next binary record from r.
+func readRecord(r *bufio.Reader) (string, error) {
+	var head []byte
+	var size uint64
+
+	for shift := 0; ; shift += 7 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return string(head), err
+		}
+
+		head = append(head, b)
+		size |= uint64(b&0x7f) << shift
+
+		if b < 0x80 {
+			break
+		}
+
+		if len(head) == binary.MaxVarintLen64 {
+			return string(head), nil // Повреждённая длина; decodeEvent отвергнет запись
+		}
+	}
+
+	if size > math.MaxInt32 {
+		return string(head), nil
+	}
+
+	var buf bytes.Buffer
+	buf.Write(head)
+
+	_, err := io.CopyN(&buf, r, int64(size)+4) // Буфер растёт по мере чтения, даже при повреждённой длине
+
+	return buf.String(), err
+}
+
+// decodeEvent parses a binary record.
+func decodeEvent(record string) (Event, error) {
+	var e Event
+
+	size, n := binary.Uvarint([]byte(record[:min(len(record), binary.MaxVarintLen64)]))
+	if n <= 0 {
+		return e, fmt.Errorf("invalid record length")
+	}
+
+	if size > uint64(len(record)-n) || uint64(len(record)-n)-size != 4 {
+		return e, fmt.Errorf("record length %d does not match %d bytes", size, len(record)-n-4)
+	}
+
+	payload, sum := record[n:len(record)-4], record[len(record)-4:]
+	if binary.BigEndian.Uint32([]byte(sum)) != crc32.ChecksumIEEE([]byte(payload)) {
+		return e, ErrorChecksumMismatch
+	}
+
+	var ok bool
+	if e.Sequence, payload, ok = cutUvarint(payload); !ok || payload == "" {
+		return e, fmt.Errorf("invalid sequence")
+	}
+
+	e.EventType, payload = EventType(payload[0]), payload[1:]
+
+	if e.Revision, payload, ok = cutUvarint(payload); !ok {
+		return e, fmt.Errorf("invalid revision")
+	}
+
+	keySize, payload, ok := cutUvarint(payload)
+	if !ok || keySize >= uint64(len(payload)) { // За ключом следует байт флагов
+		return e, fmt.Errorf("invalid key length")
+	}
+
+	e.Key, payload = payload[:keySize], payload[keySize:]
+	e.compressed, e.Value = payload[0]&eventCompressed != 0, payload[1:]
+
+	return e, nil
+}
+
+// cutUvarint decodes the uvarint at the start of s and returns the rest.
+func cutUvarint(s string) (uint64, string, bool) {
+	v, n := binary.Uvarint([]byte(s[:min(len(s), binary.MaxVarintLen64)]))
+	if n <= 0 {
+		return 0, s, false
+	}
+
+	return v, s[n:], true
+}
+
+// decodeEventV5 parses a line of the textLogHeader format.
+func decodeEventV5(line string) (Event, error) {
+	line = strings.TrimSuffix(line, "\n")
+
+	i := strings.LastIndexByte(line, '\t')
+	if i < 0 {
+		return Event{}, fmt.Errorf("missing checksum")
+	}
+
+	sum, err := strconv.ParseUint(line[i+1:], 16, 32)
+	if err != nil {
+		return Event{}, fmt.Errorf("invalid checksum: %w", err)
+	}
+
+	if uint32(sum) != crc32.ChecksumIEEE([]byte(line[:i])) {
+		return Event{}, ErrorChecksumMismatch
+	}
+
+	return decodeEventV3(line[:i])
+}
+
+// decodeEventV3 parses a "sequence\ttype\trevision\tbase64(key)\tbase64(value)"
+// line written before events were checksummed.
+func decodeEventV3(line string) (Event, error) {
+	var e Event
+
+	fields := strings.Split(strings.TrimSuffix(line, "\n"), "\t")
+	if len(fields) != 5 {
+		return e, fmt.Errorf("expected 5 fields, got %d", len(fields))
+	}
+
+	e, err := decodeEventHead(fields[0], fields[1])
+	if err != nil {
+		return e, err
+	}
+
+	if e.Revision, err = strconv.ParseUint(fields[2], 10, 64); err != nil {
+		return e, fmt.Errorf("invalid revision: %w", err)
+	}
+
+	value, compressed := strings.CutPrefix(fields[4], compressedPrefix)
+
+	if e.Key, e.Value, err = decodeKeyValue(fields[3], value); err != nil {
+		return e, err
+	}
+
+	e.compressed = compressed
+
+	return e, nil
+}
+
+// checkLogHeader verifies that a log starting with the header line can be
+// read with s and returns its format. An empty header belongs to a new,
+// empty log.
+func checkLogHeader(header string, s *Sealer) (logFormat, error) {
+	if header == "" {
+		return logFormats[fileLogHeader], nil
+	}
+
+	line, complete := strings.CutSuffix(header, "\n")
+	base, sealed := strings.CutSuffix(line, encryptionSuffix)
+	format, ok := logFormats[base]
+
+	if ok && sealed && s == nil {
+		return logFormat{}, ErrorNoEncryptionKey
+	}
+
+	if !complete || !ok || !format.replayable || sealed != (s != nil) {
+		return logFormat{}, fmt.Errorf("unrecognized transaction log format")
+	}
+
+	return format, nil
+}
+
+// txnRecord is one write of an EventTxn event. Keys and values are byte
+// slices so that encoding/json base64-encodes them and binary data
+// survives.
+type txnRecord struct {
+	Type     EventType `json:"t"`
+	Key      []byte    `json:"k"`
+	Value    []byte    `json:"v,omitempty"`
+	Revision uint64    `json:"r,omitempty"`
+}
+
+func encodeTxnEvents(ops []Event) string {
+	records := make([]txnRecord, len(ops))
+	for i, op := range ops {
+		records[i] = txnRecord{Type: op.EventType, Key: []byte(op.Key), Value: []byte(op.Value), Revision: op.Revision}
+	}
+
+	data, _ := json.Marshal(records)
+
+	return string(data)
+}
+
+func decodeTxnEvents(value string) ([]Event, error) {
+	var records []txnRecord
+	if err := json.Unmarshal([]byte(value), &records); err != nil {
+		return nil, fmt.Errorf("invalid transaction event: %w", err)
+	}
+
+	ops := make([]Event, len(records))
+	for i, r := range records {
+		if r.Type != EventPut && r.Type != EventDelete && r.Type != EventContentType && r.Type != EventExpire {
+			return nil, fmt.Errorf("invalid transaction event: unexpected event type %d", r.Type)
+		}
+
+		ops[i] = Event{EventType: r.Type, Key: string(r.Key), Value: string(r.Value), Revision: r.Revision}
+	}
+
+	return ops, nil
+}
+
+// decodeEventV2 parses a "sequence\ttype\tbase64(key)\tbase64(value)" line
+// written before revisions were recorded.
+func decodeEventV2(line string) (Event, error) {
+	e, err := decodeLegacyEvent(line)
+	if err != nil {
+		return e, err
+	}
+
+	if e.Key, e.Value, err = decodeKeyValue(e.Key, e.Value); err != nil {
+		return e, err
+	}
+
+	return e, nil
+}
+
+// decodeLegacyEvent parses a "sequence\ttype\tkey\tvalue" line with the
+// key and value taken verbatim.
+func decodeLegacyEvent(line string) (Event, error) {
+	var e Event
+
+	fields := strings.SplitN(strings.TrimSuffix(line, "\n"), "\t", 4)
+	if len(fields) != 4 {
+		return e, fmt.Errorf("expected 4 fields, got %d", len(fields))
+	}
+
+	e, err := decodeEventHead(fields[0], fields[1])
+	if err != nil {
+		return e, err
+	}
+
+	e.Key, e.Value = fields[2], fields[3]
+
+	return e, nil
+}
+
+func decodeEventHead(sequence, eventType string) (Event, error) {
+	var e Event
+
+	seq, err := strconv.ParseUint(sequence, 10, 64)
+	if err != nil {
+		return e, fmt.Errorf("invalid sequence: %w", err)
+	}
+
+	typ, err := strconv.ParseUint(eventType, 10, 8)
+	if err != nil {
+		return e, fmt.Errorf("invalid event type: %w", err)
+	}
+
+	e.Sequence, e.EventType = seq, EventType(typ)
+
+	return e, nil
+}
+
+func decodeKeyValue(encodedKey, encodedValue string) (string, string, error) {
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid key encoding: %w", err)
+	}
+
+	value, err := base64.StdEncoding.DecodeString(encodedValue)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid value encoding: %w", err)
+	}
+
+	return string(key), string(value), nil
+}
+
+// migrateLog rewrites a log in any previous format in the current one,
+// encrypting it with s unless s is nil. An encrypted log is decrypted with
+// s. Revisions missing from older formats are recomputed by counting PUTs
+// per key. The new log is written next to the old one and atomically
+// renamed over it.
+//
+// As on replay, a corrupt record, including a torn last line of a text
+// log, ends the log: it is dropped with everything after it, or, in strict
+// mode, fails the migration.
+func migrateLog(filename string, s *Sealer, strict bool) error {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+
+	first, err := reader.Peek(1)
+	if len(first) == 0 {
+		return nil // Пустой файл
+	}
+
+	if err != nil {
+		return err
+	}
+
+	format := logFormat{decode: decodeLegacyEvent}
+	recompute := true // Восстановить версии ключей
+
+	if first[0] == '#' {
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+
+		header = strings.TrimSuffix(header, "\n")
+		if header == s.logHeader() {
+			return nil // Уже текущий формат
+		}
+
+		sealed := strings.HasSuffix(header, encryptionSuffix)
+		if sealed && s == nil {
+			return ErrorNoEncryptionKey
+		}
+
+		var ok bool
+		if format, ok = logFormats[strings.TrimSuffix(header, encryptionSuffix)]; !ok {
+			return fmt.Errorf("unrecognized transaction log format %q", header)
+		}
+
+		recompute = !format.revisions
+		if decode := format.decode; sealed {
+			format.decode = func(record string) (Event, error) {
+				e, err := decode(record)
+				if err != nil {
+					return e, err
+				}
+				return s.openEvent(e)
+			}
+		}
+	}
+
+	tmp, err := os.OpenFile(filename+".migrate", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	writer := bufio.NewWriter(tmp)
+	writer.WriteString(s.logHeader() + "\n")
+
+	revisions := make(map[string]uint64)
+	var last uint64 // Последний порядковый номер
+
+	for {
+		record, err := format.read(reader)
+		if err == io.EOF && record == "" {
+			break
+		}
+
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		e, err := format.decode(record)
+		if err != nil {
+			err = fmt.Errorf("input parse error: %w", err)
+		} else if !format.binary && !strings.HasSuffix(record, "\n") {
+			err = fmt.Errorf("input parse error: torn last line") // Оборванная строка разбирается, но значение в ней неполное
+		} else if last >= e.Sequence {
+			err = fmt.Errorf("transaction numbers out of sequence")
+		}
+
+		if err != nil {
+			if strict {
+				return err
+			}
+
+			slog.Warn("truncating corrupt transaction log while migrating it", "file", filename, "last_sequence", last, "error", err)
+			break
+		}
+
+		last = e.Sequence
+
+		switch e.EventType {
+		case EventPut:
+			revisions[e.Key]++
+			if recompute {
+				e.Revision = revisions[e.Key]
+			}
+		case EventDelete:
+			delete(revisions, e.Key)
+		}
+
+		if _, err := writer.WriteString(encodeEvent(s.sealEvent(e))); err != nil {
+			return err
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+
+	slog.Info("migrated transaction log", "file", filename, "format", s.logHeader())
+
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(filename))
+}
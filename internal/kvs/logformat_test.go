@@ -0,0 +1,146 @@
+package kvs
+
+import (
+	"encoding/base64"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// v5Line renders an event as a line of the textLogHeader format.
+func v5Line(sequence uint64, eventType EventType, revision uint64, key, value string) string {
+	line := fmt.Sprintf("%d\t%d\t%d\t%s\t%s", sequence, eventType, revision,
+		base64.StdEncoding.EncodeToString([]byte(key)), base64.StdEncoding.EncodeToString([]byte(value)))
+
+	return fmt.Sprintf("%s\t%08x\n", line, crc32.ChecksumIEEE([]byte(line)))
+}
+
+func writeTestLog(t *testing.T, content string) string {
+	t.Helper()
+
+	filename := filepath.Join(t.TempDir(), "transaction.log")
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return filename
+}
+
+func TestMigrateLogTruncatesCorruptRecord(t *testing.T) {
+	torn := v5Line(3, EventPut, 1, "c", "3")
+	filename := writeTestLog(t, textLogHeader+"\n"+
+		v5Line(1, EventPut, 1, "a", "1")+
+		v5Line(2, EventPut, 2, "a", "2")+
+		torn[:len(torn)-4]) // Обрыв посреди контрольной суммы
+
+	if err := migrateLog(filename, nil, false); err != nil {
+		t.Fatal(err)
+	}
+
+	events := replayTestLog(t, openTestLog(t, filename))
+	if len(events) != 2 || events[1].Key != "a" || events[1].Value != "2" || events[1].Revision != 2 {
+		t.Fatalf("replayed %+v, want the two puts of a", events)
+	}
+}
+
+func TestMigrateLogStrict(t *testing.T) {
+	content := textLogHeader + "\n" + v5Line(1, EventPut, 1, "a", "1") + "2\t1\t1\tYg==\tMg==\t0\n"
+	filename := writeTestLog(t, content)
+
+	if err := migrateLog(filename, nil, true); err == nil {
+		t.Fatal("strict migration of a corrupt log succeeded")
+	}
+
+	if got, err := os.ReadFile(filename); err != nil || string(got) != content {
+		t.Fatalf("log is %q (%v) after a failed migration, want it unchanged", got, err)
+	}
+}
+
+func TestMigrateLegacyLog(t *testing.T) {
+	filename := writeTestLog(t, "1\t2\ta\tfirst\n2\t2\ta\tsecond\n3\t1\ta\t\n4\t2\ta\tthird\n5\t2\tb\tcut sh")
+
+	if err := migrateLog(filename, nil, false); err != nil {
+		t.Fatal(err)
+	}
+
+	events := replayTestLog(t, openTestLog(t, filename))
+	if len(events) != 4 {
+		t.Fatalf("replayed %d events, want 4 without the torn line", len(events))
+	}
+
+	// Версии пересчитываются заново после удаления
+	for i, want := range []uint64{1, 2, 0, 1} {
+		if events[i].Revision != want {
+			t.Fatalf("event %d has revision %d, want %d", i, events[i].Revision, want)
+		}
+	}
+
+	if e := events[3]; e.Key != "a" || e.Value != "third" {
+		t.Fatalf("last event is %+v, want the put of third", e)
+	}
+}
+
+// corruptLastByte flips the last byte of a file, in the checksum of its
+// last record.
+func corruptLastByte(t *testing.T, filename string) {
+	t.Helper()
+
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content[len(content)-1] ^= 0xff
+
+	if err := os.WriteFile(filename, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadEventsTruncatesCorruptRecord(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "transaction.log")
+
+	l := openTestLog(t, filename)
+	replayTestLog(t, l)
+	l.Run()
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err := l.WritePut(key, "1", 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	corruptLastByte(t, filename)
+
+	strict := openTestLog(t, filename)
+	events, errs := strict.ReadEvents()
+	for range events {
+	}
+
+	if err := <-errs; err == nil {
+		t.Fatal("strict replay of a corrupt log succeeded")
+	}
+	strict.Close()
+
+	lenient, err := NewFileTransactionLogger(filename, FileLogOptions{Fsync: FsyncPolicy{Mode: FsyncAlways}, Batch: BatchPolicy{MaxEvents: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replayed := replayTestLog(t, lenient.(*FileTransactionLogger))
+	if len(replayed) != 2 || replayed[1].Key != "b" {
+		t.Fatalf("replayed %+v, want the puts of a and b", replayed)
+	}
+	lenient.Close()
+
+	// Усечённый журнал читается и в строгом режиме
+	if replayed := replayTestLog(t, openTestLog(t, filename)); len(replayed) != 2 {
+		t.Fatalf("replayed %d events after the truncation, want 2", len(replayed))
+	}
+}
@@ -0,0 +1,147 @@
+package kvs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+/**
+ * Structured logging.
+ *
+ * Everything is logged through the default slog logger, as JSON unless
+ * the text format is configured. Every HTTP request gets an ID, taken
+ * from the X-Request-ID header when the client sends a usable one, which
+ * is echoed in the response and attached to the request's log line.
+ */
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+var logLevel = new(slog.LevelVar) // Меняется при перезагрузке настроек
+
+// newLogger builds the process logger described by c.
+func newLogger(c LogConfig) (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", c.Level)
+	}
+
+	logLevel.Set(level)
+
+	options := &slog.HandlerOptions{Level: logLevel}
+
+	switch c.Format {
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, options)), nil
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, options)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", c.Format)
+	}
+}
+
+// fatal logs msg at error level and exits, like log.Fatal.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// RequestIDFrom returns the ID assigned to the request by requestLogger.
+func RequestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+
+	return hex.EncodeToString(b[:])
+}
+
+// validRequestID accepts client IDs of printable ASCII without spaces so
+// that they cannot forge log records or response headers.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	return strings.IndexFunc(id, func(r rune) bool { return r <= ' ' || r > '~' }) < 0
+}
+
+// responseRecorder captures the status code and body size of a response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+
+	n, err := r.ResponseWriter.Write(p)
+	r.size += int64(n)
+
+	return n, err
+}
+
+// Flush keeps watch streams working through the recorder.
+func (r *responseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection.
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// requestLogger assigns the request ID and logs every request once it has
+// been served.
+func requestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		recorder := &responseRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		slog.Info("request",
+			"request_id", id,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"key", pathVars(r)["key"],
+			"status", recorder.status,
+			"duration_ms", float64(time.Since(started).Microseconds())/1000,
+			"bytes", recorder.size,
+			"remote", r.RemoteAddr,
+		)
+	})
+}
@@ -0,0 +1,127 @@
+package kvs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+ * Transaction log health.
+ *
+ * A write to the log file that fails, on a full disk for instance, is
+ * retried with a backoff doubling from logRetryBackoff up to
+ * logRetryMaxBackoff; the events keep their order and none is dropped.
+ * A partial write is cut off the file before the retry. While the log is
+ * failing, writes are refused with 503 as in read-only mode, so that no
+ * client is told a change was stored that may never reach the log,
+ * /readyz reports the error and /v1/stats counts the failures. Writes are
+ * accepted again once a retry succeeds. A logger that stops on an error it
+ * cannot retry, such as a failed fsync, reports it on its Err channel and
+ * leaves writes refused until the server is restarted.
+ */
+const (
+	logRetryBackoff    = 100 * time.Millisecond
+	logRetryMaxBackoff = 10 * time.Second
+)
+
+var ErrorLogFailing = errors.New("Transaction log is failing, writes are suspended")
+
+var logHealth logHealthState
+
+type logHealthState struct {
+	failing  atomic.Bool
+	failures atomic.Uint64 // Неудачных записей с запуска
+
+	mu    sync.Mutex
+	err   error     // Последняя ошибка, пока журнал не пишет
+	since time.Time // Начало отказа
+}
+
+// fail records a failed write.
+func (h *logHealthState) fail(err error) {
+	h.failures.Add(1)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.failing.Load() {
+		h.since = time.Now()
+	}
+
+	h.err = err
+	h.failing.Store(true)
+}
+
+// recovered records a successful write after failed ones.
+func (h *logHealthState) recovered() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.failing.Load() {
+		return
+	}
+
+	slog.Info("transaction log recovered", "outage", time.Since(h.since).String(), "failures", h.failures.Load())
+	h.err = nil
+	h.failing.Store(false)
+}
+
+// Err returns the last error while the log is failing, or nil.
+func (h *logHealthState) Err() error {
+	if !h.failing.Load() {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.err
+}
+
+// watchLoggerErrors keeps the writes to l refused, as h records, once l
+// reports an error it stopped on.
+func watchLoggerErrors(l TransactionLogger, h *logHealthState) {
+	for err := range l.Err() {
+		slog.Error("transaction logger stopped", "error", err)
+		h.fail(err)
+	}
+}
+
+// appendRetrying writes data to the end of the log file, retrying until
+// it succeeds or the logger is closed.
+func (l *FileTransactionLogger) appendRetrying(data []byte) (int, error) {
+	backoff := logRetryBackoff
+
+	for {
+		offset, err := l.file.Seek(0, io.SeekEnd)
+		if err == nil {
+			var n int
+			if n, err = l.file.Write(data); err == nil {
+				l.health.recovered()
+				return n, nil
+			}
+
+			if n > 0 { // Не оставлять неполную запись перед повтором
+				if terr := l.file.Truncate(offset); terr != nil {
+					return 0, fmt.Errorf("%w; cutting off the partial write failed: %v", err, terr)
+				}
+			}
+		}
+
+		l.health.fail(err)
+		slog.Error("transaction log write failed", "error", err, "retry_in", backoff.String())
+
+		select {
+		case <-l.closing:
+			return 0, err
+		case <-time.After(backoff):
+		}
+
+		backoff = min(2*backoff, logRetryMaxBackoff)
+	}
+}
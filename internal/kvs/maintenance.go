@@ -0,0 +1,112 @@
+package kvs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+)
+
+/**
+ * Read-only mode.
+ *
+ * In read-only mode every write is rejected with 503 while reads keep
+ * working, for migrations, compaction or a failing disk. The mode is
+ * switched through /v1/read-only and recorded in the transaction log so
+ * that it survives a restart; the read-only setting forces it on at
+ * startup regardless of the log.
+ */
+var readOnly atomic.Bool
+
+var ErrorReadOnly = errors.New("Server is in read-only mode")
+
+// readOnlyExempt lists the write endpoints that stay available in
+// read-only mode.
+var readOnlyExempt = map[string]bool{
+	"/v1/read-only": true,
+	"/v1/compact":   true,
+	"/v1/reload":    true,
+	"/v1/slowlog":   true,
+
+	"/v1/migration/cutover": true,
+}
+
+type readOnlyState struct {
+	ReadOnly bool `json:"read_only"`
+}
+
+// setReadOnly switches the mode and records it in the transaction log.
+func setReadOnly(ctx context.Context, enabled bool) error {
+	if readOnly.Swap(enabled) == enabled {
+		return nil // Режим не изменился
+	}
+
+	if err := logger.WriteReadOnly(enabled); err != nil {
+		readOnly.Store(!enabled)
+		return err
+	}
+
+	return logger.Sync(ctx)
+}
+
+// readOnlyHandler serves GET and PUT /v1/read-only.
+func readOnlyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		var state readOnlyState
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&state); err != nil {
+			http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := setReadOnly(r.Context(), state.ReadOnly); err != nil {
+			serverError(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(readOnlyState{ReadOnly: readOnly.Load()})
+}
+
+// writesRefused returns why writes are rejected, or nil if they are not.
+func writesRefused() error {
+	switch {
+	case replica != nil:
+		return ErrorReplica
+	case readOnly.Load():
+		return ErrorReadOnly
+	case logHealth.failing.Load():
+		return ErrorLogFailing
+	default:
+		return nil
+	}
+}
+
+// readOnlyGate rejects writes with 503 while the server is read-only, a
+// replica or unable to write its transaction log, or while the log queue
+// has no slot for them.
+func readOnlyGate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requiredPermission(r) >= PermReadWrite && !readOnlyExempt[r.URL.Path] {
+			if err := writesRefused(); err != nil {
+				if errors.Is(err, ErrorLogFailing) {
+					w.Header().Set("Retry-After", "1")
+				}
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+
+			release, err := admitWrite(r.Context())
+			if err != nil {
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+
+			defer release()
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,506 @@
+package kvs
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * Memcached text protocol listener.
+ *
+ * The storage commands set, add, replace and cas, the retrieval commands
+ * get and gets, and delete, version and quit are served on a third
+ * listener, so memcached clients can use the store unchanged and keep
+ * their data across restarts. Writes go through the same store,
+ * transaction log and watch broker as the HTTP API. The key's revision
+ * serves as its CAS value. Client flags are kept as the parameter of an
+ * application/x-memcached content type, which the HTTP API reports too.
+ * The text protocol has no authentication, so the listener cannot be
+ * enabled together with it.
+ */
+const (
+	memcachedContentType = "application/x-memcached"
+	memcachedMaxRelative = 30 * 24 * 60 * 60 // Больший exptime - время Unix, как в memcached
+)
+
+type MemcachedServer struct {
+	listener net.Listener
+	ctx      context.Context // Отменяется при закрытии сервера
+	cancel   context.CancelFunc
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// ListenMemcached starts serving the memcached text protocol on addr,
+// over TLS when tlsConfig is not nil.
+func ListenMemcached(addr string, tlsConfig *tls.Config) (*MemcachedServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for memcached: %w", err)
+	}
+
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &MemcachedServer{listener: listener, ctx: ctx, cancel: cancel, conns: make(map[net.Conn]struct{})}
+
+	s.wg.Add(1)
+	go s.serve()
+
+	return s, nil
+}
+
+func (s *MemcachedServer) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+
+			if !closed {
+				slog.Error("memcached accept failed", "error", err)
+			}
+			return
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go s.handle(conn)
+	}
+}
+
+// Close stops accepting connections, closes the open ones and waits for
+// their commands to finish.
+func (s *MemcachedServer) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.cancel()
+	err := s.listener.Close()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+
+	return err
+}
+
+type memcachedConn struct {
+	r    *bufio.Reader
+	w    *bufio.Writer
+	quit bool
+}
+
+func (s *MemcachedServer) handle(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+
+		conn.Close()
+		s.wg.Done()
+	}()
+
+	c := &memcachedConn{r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+
+	for !c.quit {
+		line, err := readRESPLine(c.r) // Строки команд устроены так же
+		if errors.Is(err, ErrorProtocol) {
+			c.w.WriteString("CLIENT_ERROR line too long\r\n")
+			c.w.Flush()
+			return
+		}
+
+		if err != nil {
+			return
+		}
+
+		if fields := strings.Fields(line); len(fields) > 0 {
+			if err := s.dispatch(c, fields); err != nil {
+				c.w.Flush()
+				return // Поток данных рассогласован
+			}
+		}
+
+		if c.r.Buffered() == 0 {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+
+	c.w.Flush()
+}
+
+// dispatch runs one command. It returns an error only if the connection
+// has to be closed.
+func (s *MemcachedServer) dispatch(c *memcachedConn, fields []string) error {
+	ctx, cancel := s.ctx, context.CancelFunc(func() {})
+	if config.RequestTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, config.RequestTimeout)
+	}
+	defer cancel()
+
+	ctx, timer := slowLog.Start(ctx)
+	defer func() {
+		var key string
+		if len(fields) > 1 {
+			key = fields[1]
+		}
+
+		slowLog.Finish(timer, slowRequest{Operation: "memcached " + fields[0], Key: key})
+	}()
+
+	ctx, span := tracer.StartRequest(ctx, "memcached "+fields[0], "")
+	defer span.End(nil)
+
+	switch fields[0] {
+	case "get", "gets":
+		memcachedGet(ctx, c, fields)
+	case "set", "add", "replace", "cas":
+		return memcachedStore(ctx, c, fields)
+	case "delete":
+		memcachedDelete(ctx, c, fields)
+	case "version":
+		c.w.WriteString("VERSION kvs\r\n")
+	case "quit":
+		c.quit = true
+	default:
+		c.w.WriteString("ERROR\r\n")
+	}
+
+	return nil
+}
+
+// checkKeys replies with an error and returns false if one of keys is
+// too long or belongs to another cluster node.
+func (c *memcachedConn) checkKeys(keys []string) bool {
+	for _, key := range keys {
+		if len(key) > config.Limits.MaxKeyBytes {
+			c.w.WriteString("CLIENT_ERROR " + ErrorKeyTooLong.Error() + "\r\n")
+			return false
+		}
+	}
+
+	if owner, ok := foreignOwner(keys...); ok {
+		c.w.WriteString(fmt.Sprintf("SERVER_ERROR MOVED %s %s\r\n", owner.ID, owner.URL))
+		return false
+	}
+
+	return true
+}
+
+// memcachedGet implements get and gets, which also reports the CAS
+// value of each key.
+func memcachedGet(ctx context.Context, c *memcachedConn, fields []string) {
+	keys := fields[1:]
+	if len(keys) == 0 {
+		c.w.WriteString("ERROR\r\n")
+		return
+	}
+
+	normalizeKeys(keys)
+
+	if !c.checkKeys(keys) {
+		return
+	}
+
+	for _, key := range keys {
+		entry, err := store.GetEntry(ctx, key)
+		if errors.Is(err, ErrorNoSuchKey) {
+			continue
+		}
+
+		if err != nil {
+			c.w.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
+			return
+		}
+
+		fmt.Fprintf(c.w, "VALUE %s %d %d", key, memcachedFlags(entry.ContentType), len(entry.Value))
+		if fields[0] == "gets" {
+			fmt.Fprintf(c.w, " %d", entry.Revision)
+		}
+		c.w.WriteString("\r\n" + entry.Value + "\r\n")
+	}
+
+	c.w.WriteString("END\r\n")
+}
+
+// memcachedStore implements
+//
+//	<set|add|replace> <key> <flags> <exptime> <bytes> [noreply]
+//	cas <key> <flags> <exptime> <bytes> <cas unique> [noreply]
+//
+// followed by a data block of bytes.
+func memcachedStore(ctx context.Context, c *memcachedConn, fields []string) error {
+	name := fields[0]
+
+	args := 5
+	if name == "cas" {
+		args = 6
+	}
+
+	noreply := len(fields) == args+1 && fields[args] == "noreply"
+	if len(fields) != args && !noreply {
+		c.w.WriteString("ERROR\r\n")
+		return nil
+	}
+
+	key := normalizeKey(fields[1])
+	flags, err1 := strconv.ParseUint(fields[2], 10, 32)
+	exptime, err2 := strconv.ParseInt(fields[3], 10, 64)
+	size, err3 := strconv.ParseInt(fields[4], 10, 64)
+
+	var unique uint64
+	var err4 error
+	if name == "cas" {
+		unique, err4 = strconv.ParseUint(fields[5], 10, 64)
+	}
+
+	if err := errors.Join(err1, err2, err3, err4); err != nil || size < 0 {
+		c.w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return errors.New("bad command line format") // Размер блока данных неизвестен
+	}
+
+	if size > config.Limits.MaxValueBytes {
+		if _, err := io.CopyN(io.Discard, c.r, size+2); err != nil {
+			return err
+		}
+
+		c.w.WriteString("SERVER_ERROR object too large for cache\r\n")
+		return nil
+	}
+
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return err
+	}
+
+	if string(data[size:]) != "\r\n" {
+		c.w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return errors.New("bad data chunk")
+	}
+
+	value := string(data[:size])
+
+	reply := func(s string) {
+		if !noreply {
+			c.w.WriteString(s + "\r\n")
+		}
+	}
+
+	if !c.checkKeys([]string{key}) {
+		return nil
+	}
+
+	if err := validateKey(key); err != nil {
+		c.w.WriteString("CLIENT_ERROR " + err.Error() + "\r\n")
+		return nil
+	}
+
+	if err := writesRefused(); err != nil {
+		reply("SERVER_ERROR " + err.Error())
+		return nil
+	}
+
+	release, err := admitWrite(ctx)
+	if err != nil {
+		reply("SERVER_ERROR " + err.Error())
+		return nil
+	}
+	defer release()
+
+	ttl, expired := memcachedTTL(exptime, time.Now())
+	deadline := expiry(ttl)
+
+	contentType := ""
+	if flags != 0 {
+		contentType = mime.FormatMediaType(memcachedContentType, map[string]string{"flags": strconv.FormatUint(flags, 10)})
+	}
+
+	putCtx := loggedPut(ctx, key, value, contentType, deadline)
+
+	_, result, err := memcachedWrite(putCtx, name, key, value, unique)
+	if errors.Is(err, ErrorMemoryFull) {
+		reply("SERVER_ERROR out of memory storing object")
+		return nil
+	}
+
+	if err != nil {
+		reply("SERVER_ERROR " + err.Error())
+		return nil
+	}
+
+	if result != "STORED" {
+		reply(result)
+		return nil
+	}
+
+	recordPut(putCtx, key, value, contentType, deadline)
+
+	if expired { // Срок уже истёк: ключ сразу удаляется, как в memcached
+		if err = store.Delete(loggedDelete(context.WithoutCancel(ctx), key, time.Time{}), key); err == nil {
+			recordDelete(key)
+		}
+	}
+
+	if err == nil && config.TransactionLog.Durability == "sync" {
+		err = logger.Sync(ctx)
+	}
+
+	if err != nil {
+		reply("SERVER_ERROR " + err.Error())
+		return nil
+	}
+
+	reply("STORED")
+
+	return nil
+}
+
+// memcachedWrite applies a storage command to the store. result is
+// "STORED", or the reply of a command whose condition did not hold.
+func memcachedWrite(ctx context.Context, name, key, value string, unique uint64) (revision uint64, result string, err error) {
+	switch name {
+	case "set":
+		revision, err = store.Put(ctx, key, value)
+
+	case "add":
+		revision, err = store.CompareAndPut(ctx, key, value, 0)
+		if errors.Is(err, ErrorRevisionMismatch) {
+			return 0, "NOT_STORED", nil
+		}
+
+	case "replace":
+		revision, err = putExisting(ctx, key, value)
+		if errors.Is(err, ErrorNoSuchKey) {
+			return 0, "NOT_STORED", nil
+		}
+
+	case "cas":
+		revision, err = store.CompareAndPut(ctx, key, value, unique)
+		if errors.Is(err, ErrorRevisionMismatch) {
+			if _, err := store.GetEntry(ctx, key); errors.Is(err, ErrorNoSuchKey) {
+				return 0, "NOT_FOUND", nil
+			}
+			return 0, "EXISTS", nil
+		}
+	}
+
+	if err != nil {
+		return 0, "", err
+	}
+
+	return revision, "STORED", nil
+}
+
+// memcachedDelete implements delete <key> [noreply].
+func memcachedDelete(ctx context.Context, c *memcachedConn, fields []string) {
+	noreply := len(fields) == 3 && fields[2] == "noreply"
+	if len(fields) != 2 && !noreply {
+		c.w.WriteString("ERROR\r\n")
+		return
+	}
+
+	reply := func(s string) {
+		if !noreply {
+			c.w.WriteString(s + "\r\n")
+		}
+	}
+
+	key := normalizeKey(fields[1])
+	if !c.checkKeys([]string{key}) {
+		return
+	}
+
+	if err := writesRefused(); err != nil {
+		reply("SERVER_ERROR " + err.Error())
+		return
+	}
+
+	release, err := admitWrite(ctx)
+	if err != nil {
+		reply("SERVER_ERROR " + err.Error())
+		return
+	}
+	defer release()
+
+	if _, err := store.Get(ctx, key); err != nil {
+		reply("NOT_FOUND")
+		return
+	}
+
+	if err := store.Delete(loggedDelete(ctx, key, time.Time{}), key); err != nil {
+		reply("SERVER_ERROR " + err.Error())
+		return
+	}
+
+	recordDelete(key)
+
+	if config.TransactionLog.Durability == "sync" {
+		if err := logger.Sync(ctx); err != nil {
+			reply("SERVER_ERROR " + err.Error())
+			return
+		}
+	}
+
+	reply("DELETED")
+}
+
+// memcachedTTL interprets an exptime: 0 for no expiration, seconds from
+// now up to 30 days, a Unix time beyond that, and a negative value or a
+// past Unix time for an item that is already expired.
+func memcachedTTL(exptime int64, now time.Time) (ttl time.Duration, expired bool) {
+	switch {
+	case exptime == 0:
+		return 0, false
+	case exptime < 0:
+		return 0, true
+	case exptime <= memcachedMaxRelative:
+		return time.Duration(exptime) * time.Second, false
+	}
+
+	ttl = time.Unix(exptime, 0).Sub(now)
+
+	return ttl, ttl <= 0
+}
+
+// memcachedFlags returns the client flags recorded in contentType.
+func memcachedFlags(contentType string) uint32 {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != memcachedContentType {
+		return 0
+	}
+
+	flags, _ := strconv.ParseUint(params["flags"], 10, 32)
+
+	return uint32(flags)
+}
@@ -0,0 +1,625 @@
+package kvs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+ * Backend migration.
+ *
+ * With migration.store or migration.transaction_log set, the server
+ * writes to a second backend alongside the configured one, so that it can
+ * be moved to the new backend without downtime. At startup, once the log
+ * has been replayed, the content of the store is copied to the target
+ * store, a bbolt, badger or sqlite one, and written as events to the target log,
+ * which must be empty. From then on every write is applied to the store
+ * first and the resulting state of the keys it changed is copied to the
+ * target store, and every event is logged to both logs. Reads are served
+ * from the store.
+ *
+ * POST /v1/migration/cutover, on the admin listener, moves the reads to
+ * the target store; writes still go to both, so the old backend stays
+ * complete until the server is restarted with the target as its
+ * configured backend. GET /v1/migration reports the progress. A copy
+ * that fails, leaving the target behind, is counted, and a target that
+ * has fallen behind cannot be cut over to; restart the server to copy it
+ * again. Tombstones are copied as they are made, but the history of the
+ * keys is not, and the log is seeded with the live keys only.
+ */
+const migrationStripes = 64 // Замков на ключи копирования
+
+var (
+	ErrorNoMigration       = errors.New("No backend migration is configured")
+	ErrorMigrationDiverged = errors.New("Migration target has fallen behind")
+)
+
+// migration is nil unless the server is migrating to other backends.
+var migration *Migration
+
+// MigrationConfig names the backends to migrate to; an empty backend is
+// not migrated.
+type MigrationConfig struct {
+	Store          StoreConfig          `yaml:"store"`           // Только "bbolt", "badger" или "sqlite"
+	TransactionLog TransactionLogConfig `yaml:"transaction_log"` // Должен быть пуст при запуске
+}
+
+type Migration struct {
+	target    Store             // nil: хранилище не переносится
+	targetLog TransactionLogger // nil: журнал не переносится
+
+	mirroring atomic.Bool // Записи копируются: журнал воспроизведён
+	cutOver   atomic.Bool // Чтение из целевого хранилища
+	copied    atomic.Int64
+	failures  atomic.Uint64
+	lastErr   atomic.Value // string
+
+	mu      sync.RWMutex // Копирование всего хранилища исключает копирование ключей
+	stripes [migrationStripes]sync.Mutex
+	logMu   sync.Mutex // Оба журнала получают события в одном порядке
+}
+
+// migrationStatus is the progress reported by GET /v1/migration.
+type migrationStatus struct {
+	Store          string `json:"store,omitempty"`
+	TransactionLog string `json:"transaction_log,omitempty"`
+	CutOver        bool   `json:"cut_over"`
+	Copied         int64  `json:"copied_keys"` // Ключей скопировано при запуске
+	Failures       uint64 `json:"failures"`
+	LastError      string `json:"last_error,omitempty"`
+}
+
+// newMigration opens the target backends of c, or returns nil if none is
+// configured.
+func newMigration(c MigrationConfig) (*Migration, error) {
+	if c.Store.Backend == "" && c.TransactionLog.Backend == "" {
+		return nil, nil
+	}
+
+	m := &Migration{}
+
+	if c.Store.Backend != "" {
+		target, err := newStore(c.Store)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open the migration store: %w", err)
+		}
+		m.target = target
+	}
+
+	if c.TransactionLog.Backend != "" {
+		targetLog, err := newTransactionLogger(c.TransactionLog, sealer, nil, appliedSequence(store))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open the migration transaction log: %w", err)
+		}
+		m.targetLog = targetLog
+	}
+
+	return m, nil
+}
+
+// wrap returns s with its writes copied to the target store once the
+// migration has started.
+func (m *Migration) wrap(s Store) Store {
+	if m.target == nil {
+		return s
+	}
+
+	return &MigratingStore{Store: s, migration: m}
+}
+
+// start copies the content of the store to the targets and starts
+// copying the writes to them. It is called once the log has been
+// replayed, before the server is ready and so before any write.
+func (m *Migration) start(ctx context.Context) error {
+	entries, err := store.Snapshot(ctx)
+	if err != nil {
+		return err
+	}
+
+	if m.target != nil {
+		_, err := m.target.ReplaceAll(ctx, entries)
+		if err != nil {
+			return fmt.Errorf("failed to copy the store: %w", err)
+		}
+
+		m.copied.Store(int64(len(entries)))
+		m.mirroring.Store(true)
+	}
+
+	if m.targetLog != nil {
+		if err := m.seedLog(entries); err != nil {
+			return err
+		}
+
+		logger = &migrationLogger{TransactionLogger: logger, migration: m}
+	}
+
+	slog.Info("backend migration started", "keys", len(entries), "store", m.target != nil, "transaction_log", m.targetLog != nil)
+
+	return nil
+}
+
+// seedLog checks that the target log is empty and logs entries to it.
+func (m *Migration) seedLog(entries []Entry) error {
+	events, errs := m.targetLog.ReadEvents()
+
+	found := false
+	for range events {
+		found = true
+	}
+
+	if err := <-errs; err != nil {
+		return fmt.Errorf("failed to read the migration transaction log: %w", err)
+	}
+
+	if found {
+		return errors.New("the migration transaction log is not empty")
+	}
+
+	m.targetLog.Run()
+	go func() {
+		for err := range m.targetLog.Err() {
+			m.fail("", err)
+		}
+	}()
+
+	for _, e := range entries {
+		m.targetLog.WritePut(e.Key, e.Value, e.Revision)
+
+		if e.ContentType != "" {
+			m.targetLog.WriteContentType(e.Key, e.ContentType)
+		}
+
+		if !e.Expires.IsZero() {
+			m.targetLog.WriteExpire(e.Key, e.Expires)
+		}
+	}
+
+	scheduler.logTo(m.targetLog)
+
+	return nil
+}
+
+// close closes the targets. The target store records the sequence of the
+// log it will be used with: the target log, if it is migrated too.
+func (m *Migration) close(sequence uint64) error {
+	if m.targetLog != nil {
+		sequence = m.targetLog.LastSequence()
+	}
+
+	if p, ok := unwrapStore(m.target).(PersistentStore); ok && m.target != nil {
+		return p.Close(sequence)
+	}
+
+	return nil
+}
+
+func (m *Migration) fail(key string, err error) {
+	m.failures.Add(1)
+	m.lastErr.Store(err.Error())
+
+	slog.Error("migration copy failed", "key", key, "error", err)
+}
+
+func (m *Migration) status() migrationStatus {
+	s := migrationStatus{
+		CutOver:  m.cutOver.Load(),
+		Copied:   m.copied.Load(),
+		Failures: m.failures.Load(),
+	}
+
+	if m.target != nil {
+		s.Store = config.Migration.Store.Backend
+	}
+
+	if m.targetLog != nil {
+		s.TransactionLog = config.Migration.TransactionLog.Backend
+	}
+
+	s.LastError, _ = m.lastErr.Load().(string)
+
+	return s
+}
+
+// copyKeys copies the state of keys from the store s to the target store.
+func (m *Migration) copyKeys(ctx context.Context, s Store, keys ...string) {
+	if !m.mirroring.Load() {
+		return // Воспроизведение журнала: копия будет сделана при запуске
+	}
+
+	ctx = unlogged(ctx) // Запись уже применена и записана в журнал: копия не должна ни прерываться, ни писаться снова
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, key := range keys {
+		stripe := &m.stripes[fnvStripe(key)]
+
+		stripe.Lock()
+		err := copyEntry(ctx, s, m.target, key)
+		stripe.Unlock()
+
+		if err != nil {
+			m.fail(key, err)
+		}
+	}
+}
+
+// copyAll replaces the content of the target store with that of s.
+func (m *Migration) copyAll(ctx context.Context, s Store) {
+	if !m.mirroring.Load() {
+		return
+	}
+
+	ctx = unlogged(ctx)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entries, err := s.Snapshot(ctx)
+	if err == nil {
+		_, err = m.target.ReplaceAll(ctx, entries)
+	}
+
+	if err != nil {
+		m.fail("", err)
+	}
+}
+
+func fnvStripe(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+
+	return h.Sum32() % migrationStripes
+}
+
+// copyEntry sets key in to as it is in from, or deletes it if from does
+// not hold it.
+func copyEntry(ctx context.Context, from, to Store, key string) error {
+	e, err := from.GetEntry(ctx, key)
+	if errors.Is(err, ErrorNoSuchKey) {
+		if err := to.Delete(ctx, key); err != nil && !errors.Is(err, ErrorNoSuchKey) {
+			return err
+		}
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err := to.Restore(ctx, key, e.Value, e.Revision); err != nil {
+		return err
+	}
+
+	if e.ContentType != "" {
+		if err := to.SetContentType(ctx, key, e.ContentType); err != nil {
+			return err
+		}
+	}
+
+	if !e.Expires.IsZero() {
+		return to.Expire(ctx, key, e.Expires)
+	}
+
+	return nil
+}
+
+/**
+ * Migrating store.
+ */
+
+// MigratingStore serves the reads from the store or, once cut over, from
+// the target store, and copies the keys every write changes to the target.
+type MigratingStore struct {
+	Store
+	migration *Migration
+}
+
+func (s *MigratingStore) reads() Store {
+	if s.migration.cutOver.Load() {
+		return s.migration.target
+	}
+
+	return s.Store
+}
+
+func (s *MigratingStore) Get(ctx context.Context, key string) (string, error) {
+	return s.reads().Get(ctx, key)
+}
+
+func (s *MigratingStore) GetEntry(ctx context.Context, key string) (Entry, error) {
+	return s.reads().GetEntry(ctx, key)
+}
+
+func (s *MigratingStore) TTL(ctx context.Context, key string) (time.Duration, error) {
+	return s.reads().TTL(ctx, key)
+}
+
+func (s *MigratingStore) List(ctx context.Context, prefix, after string, limit int) ([]Entry, bool, error) {
+	return s.reads().List(ctx, prefix, after, limit)
+}
+
+func (s *MigratingStore) Range(ctx context.Context, start, end string, limit int) ([]Entry, bool, error) {
+	return s.reads().Range(ctx, start, end, limit)
+}
+
+func (s *MigratingStore) Stats(ctx context.Context) (int, int64, error) {
+	return s.reads().Stats(ctx)
+}
+
+func (s *MigratingStore) Snapshot(ctx context.Context) ([]Entry, error) {
+	return s.reads().Snapshot(ctx)
+}
+
+func (s *MigratingStore) History(ctx context.Context, key string) ([]Entry, error) {
+	return s.reads().History(ctx, key)
+}
+
+func (s *MigratingStore) Put(ctx context.Context, key string, value string) (uint64, error) {
+	revision, err := s.Store.Put(ctx, key, value)
+	if err == nil {
+		s.migration.copyKeys(ctx, s.Store, key)
+	}
+
+	return revision, err
+}
+
+func (s *MigratingStore) CompareAndPut(ctx context.Context, key, value string, revision uint64) (uint64, error) {
+	revision, err := s.Store.CompareAndPut(ctx, key, value, revision)
+	if err == nil {
+		s.migration.copyKeys(ctx, s.Store, key)
+	}
+
+	return revision, err
+}
+
+func (s *MigratingStore) Restore(ctx context.Context, key, value string, revision uint64) error {
+	err := s.Store.Restore(ctx, key, value, revision)
+	if err == nil {
+		s.migration.copyKeys(ctx, s.Store, key)
+	}
+
+	return err
+}
+
+func (s *MigratingStore) Increment(ctx context.Context, key string, by int64) (int64, uint64, error) {
+	value, revision, err := s.Store.Increment(ctx, key, by)
+	if err == nil {
+		s.migration.copyKeys(ctx, s.Store, key)
+	}
+
+	return value, revision, err
+}
+
+func (s *MigratingStore) Append(ctx context.Context, key, suffix string, limit int64) (string, uint64, error) {
+	value, revision, err := s.Store.Append(ctx, key, suffix, limit)
+	if err == nil {
+		s.migration.copyKeys(ctx, s.Store, key)
+	}
+
+	return value, revision, err
+}
+
+func (s *MigratingStore) Update(ctx context.Context, key, value string, revision uint64) error {
+	err := s.Store.Update(ctx, key, value, revision)
+	if err == nil {
+		s.migration.copyKeys(ctx, s.Store, key)
+	}
+
+	return err
+}
+
+func (s *MigratingStore) Delete(ctx context.Context, key string) error {
+	err := s.Store.Delete(ctx, key)
+	if err == nil {
+		s.migration.copyKeys(ctx, s.Store, key)
+	}
+
+	return err
+}
+
+func (s *MigratingStore) SoftDelete(ctx context.Context, key string, until time.Time) error {
+	err := s.Store.SoftDelete(ctx, key, until)
+	if err != nil || !s.migration.mirroring.Load() {
+		return err
+	}
+
+	// Надгробие переносится как есть, чтобы ключ можно было восстановить.
+	if err := s.migration.target.SoftDelete(unlogged(ctx), key, until); err != nil && !errors.Is(err, ErrorNoSuchKey) {
+		s.migration.fail(key, err)
+	}
+
+	return nil
+}
+
+func (s *MigratingStore) Undelete(ctx context.Context, key string) (Entry, error) {
+	e, err := s.Store.Undelete(ctx, key)
+	if err == nil {
+		s.migration.copyKeys(ctx, s.Store, key)
+	}
+
+	return e, err
+}
+
+func (s *MigratingStore) DeleteMatching(ctx context.Context, match func(key string) bool) ([]string, error) {
+	removed, err := s.Store.DeleteMatching(ctx, match)
+	s.migration.copyKeys(ctx, s.Store, removed...) // Удалённые до ошибки
+
+	return removed, err
+}
+
+func (s *MigratingStore) Expire(ctx context.Context, key string, deadline time.Time) error {
+	err := s.Store.Expire(ctx, key, deadline)
+	if err == nil {
+		s.migration.copyKeys(ctx, s.Store, key)
+	}
+
+	return err
+}
+
+func (s *MigratingStore) SetContentType(ctx context.Context, key, contentType string) error {
+	err := s.Store.SetContentType(ctx, key, contentType)
+	if err == nil {
+		s.migration.copyKeys(ctx, s.Store, key)
+	}
+
+	return err
+}
+
+func (s *MigratingStore) ReapExpired(ctx context.Context, now time.Time) []string {
+	reaped := s.Store.ReapExpired(ctx, now)
+	s.migration.copyKeys(ctx, s.Store, reaped...)
+
+	return reaped
+}
+
+func (s *MigratingStore) Batch(ctx context.Context, ops []BatchOp) ([]BatchResult, error) {
+	results, err := s.Store.Batch(ctx, ops)
+	if err == nil {
+		s.migration.copyKeys(ctx, s.Store, batchKeys(ops)...)
+	}
+
+	return results, err
+}
+
+func (s *MigratingStore) Txn(ctx context.Context, t Txn) (TxnResult, error) {
+	result, err := s.Store.Txn(ctx, t)
+	if err == nil {
+		s.migration.copyKeys(ctx, s.Store, batchKeys(append(t.Success, t.Failure...))...)
+	}
+
+	return result, err
+}
+
+func (s *MigratingStore) ReplaceAll(ctx context.Context, entries []Entry) ([]string, error) {
+	removed, err := s.Store.ReplaceAll(ctx, entries)
+	if err == nil {
+		s.migration.copyAll(ctx, s.Store)
+	}
+
+	return removed, err
+}
+
+/**
+ * Migrating logger.
+ */
+
+// migrationLogger logs every event to the target log too.
+type migrationLogger struct {
+	TransactionLogger
+	migration *Migration
+}
+
+func (l *migrationLogger) record(write func(TransactionLogger) error) error {
+	l.migration.logMu.Lock()
+	defer l.migration.logMu.Unlock()
+
+	if err := write(l.TransactionLogger); err != nil {
+		return err
+	}
+
+	write(l.migration.targetLog) // Событие уже в основном журнале: запись не отменяется
+	return nil
+}
+
+func (l *migrationLogger) WritePut(key, value string, revision uint64) error {
+	return l.record(func(t TransactionLogger) error { return t.WritePut(key, value, revision) })
+}
+
+func (l *migrationLogger) WriteDelete(key string) error {
+	return l.record(func(t TransactionLogger) error { return t.WriteDelete(key) })
+}
+
+func (l *migrationLogger) WriteExpire(key string, deadline time.Time) error {
+	return l.record(func(t TransactionLogger) error { return t.WriteExpire(key, deadline) })
+}
+
+func (l *migrationLogger) WriteExpired(key string) error {
+	return l.record(func(t TransactionLogger) error { return t.WriteExpired(key) })
+}
+
+func (l *migrationLogger) WriteTombstone(key string, until time.Time) error {
+	return l.record(func(t TransactionLogger) error { return t.WriteTombstone(key, until) })
+}
+
+func (l *migrationLogger) WriteSchedule(key, op string, at time.Time) error {
+	return l.record(func(t TransactionLogger) error { return t.WriteSchedule(key, op, at) })
+}
+
+func (l *migrationLogger) WriteContentType(key, contentType string) error {
+	return l.record(func(t TransactionLogger) error { return t.WriteContentType(key, contentType) })
+}
+
+func (l *migrationLogger) WriteReadOnly(enabled bool) error {
+	return l.record(func(t TransactionLogger) error { return t.WriteReadOnly(enabled) })
+}
+
+func (l *migrationLogger) WriteIncrement(key, value string, revision uint64) error {
+	return l.record(func(t TransactionLogger) error { return t.WriteIncrement(key, value, revision) })
+}
+
+func (l *migrationLogger) WriteTxn(ops []Event) error {
+	return l.record(func(t TransactionLogger) error { return t.WriteTxn(ops) })
+}
+
+// Sync waits for the events to be durable in both logs.
+func (l *migrationLogger) Sync(ctx context.Context) error {
+	if err := l.TransactionLogger.Sync(ctx); err != nil {
+		return err
+	}
+
+	return l.migration.targetLog.Sync(ctx)
+}
+
+func (l *migrationLogger) Close() error {
+	err := l.TransactionLogger.Close()
+
+	if err := l.migration.targetLog.Close(); err != nil {
+		slog.Error("failed to close the migration transaction log", "error", err)
+	}
+
+	return err
+}
+
+/**
+ * Migration endpoints.
+ */
+
+// migrationHandler serves GET /v1/migration.
+func migrationHandler(w http.ResponseWriter, r *http.Request) {
+	if migration == nil {
+		http.Error(w, ErrorNoMigration.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(migration.status())
+}
+
+// cutoverHandler serves POST /v1/migration/cutover.
+func cutoverHandler(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case migration == nil || migration.target == nil:
+		http.Error(w, ErrorNoMigration.Error(), http.StatusConflict)
+		return
+	case migration.failures.Load() > 0:
+		http.Error(w, fmt.Sprintf("%s: %d failed copies", ErrorMigrationDiverged.Error(), migration.failures.Load()), http.StatusConflict)
+		return
+	}
+
+	if !migration.cutOver.Swap(true) {
+		slog.Info("reads cut over to the migration store", "store", config.Migration.Store.Backend)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(migration.status())
+}
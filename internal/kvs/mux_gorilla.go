@@ -0,0 +1,47 @@
+//go:build !stdmux
+
+package kvs
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// routeMux matches routes with gorilla/mux.
+type routeMux struct {
+	*mux.Router
+}
+
+func newRouteMux() routeMux {
+	return routeMux{mux.NewRouter()}
+}
+
+func (m routeMux) handle(route *Route, h http.Handler) {
+	var r *mux.Route
+	if route.prefix() {
+		r = m.PathPrefix(route.template).Handler(h)
+	} else {
+		r = m.Handle(route.template, h)
+	}
+
+	if len(route.methods) > 0 {
+		r.Methods(route.methods...)
+	}
+}
+
+// pathVars returns the path variables of the route a request matched.
+func pathVars(r *http.Request) map[string]string {
+	return mux.Vars(r)
+}
+
+// withPathVar returns r with the path variable name set to value.
+func withPathVar(r *http.Request, name, value string) *http.Request {
+	vars := make(map[string]string)
+	for k, v := range mux.Vars(r) {
+		vars[k] = v
+	}
+	vars[name] = value
+
+	return mux.SetURLVars(r, vars)
+}
@@ -0,0 +1,80 @@
+//go:build stdmux
+
+package kvs
+
+import "net/http"
+
+// routeMux matches routes with the pattern routing of http.ServeMux. The
+// patterns carry no method: the routes of a template share one, and the
+// method picks among them, so that other methods get 405 as with
+// gorilla/mux.
+type routeMux struct {
+	*http.ServeMux
+	templates map[string]*methodRoutes
+}
+
+type methodRoutes struct {
+	routes   []*Route
+	handlers []http.Handler
+}
+
+func newRouteMux() routeMux {
+	return routeMux{ServeMux: http.NewServeMux(), templates: make(map[string]*methodRoutes)}
+}
+
+func (m routeMux) handle(route *Route, h http.Handler) {
+	mr, ok := m.templates[route.template]
+	if !ok {
+		mr = &methodRoutes{}
+		m.templates[route.template] = mr
+		m.ServeMux.Handle(route.template, mr)
+	}
+
+	mr.routes = append(mr.routes, route)
+	mr.handlers = append(mr.handlers, h)
+}
+
+func (m routeMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.RawPath != "" { // Сопоставлять, как gorilla/mux, раскодированный путь
+		u := *r.URL
+		u.RawPath = ""
+		r = r.Clone(r.Context())
+		r.URL = &u
+	}
+
+	m.ServeMux.ServeHTTP(w, r)
+}
+
+func (mr *methodRoutes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for i, route := range mr.routes {
+		if route.allows(r.Method) {
+			mr.handlers[i].ServeHTTP(w, r)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
+
+// pathVars returns the path variables of the route a request matched.
+func pathVars(r *http.Request) map[string]string {
+	route := currentRoute(r)
+	if route == nil {
+		return nil
+	}
+
+	vars := make(map[string]string)
+	for _, name := range route.variables() {
+		vars[name] = r.PathValue(name)
+	}
+
+	return vars
+}
+
+// withPathVar returns r with the path variable name set to value.
+func withPathVar(r *http.Request, name, value string) *http.Request {
+	r = r.Clone(r.Context())
+	r.SetPathValue(name, value)
+
+	return r
+}
@@ -0,0 +1,372 @@
+//go:build nats
+
+package kvs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+/**
+ * NATS JetStream Transaction logger.
+ *
+ * Events are published to a subject of a JetStream stream, one message per
+ * event in the file log format, with the log header in the "Kvs-Format"
+ * message header; acknowledged by the stream before Sync returns. The
+ * stream is created at startup if missing. Replay reads the stream from
+ * its first message up to its last one at startup, so instances started
+ * from the same stream rebuild the same state, and any number of other
+ * consumers can follow the changes as they are written. Only one instance
+ * should publish to a stream at a time.
+ *
+ * With a persistent store the events it already holds are read and
+ * skipped. Built only with the nats tag: go build -tags nats.
+ */
+const natsBatchEvents = 100 // Событий, ожидающих подтверждения одновременно
+
+type NATSTransactionLogger struct {
+	eventQueue              // Очередь событий сопрограммы Run и её завершение
+	errors     <-chan error // Канал только для чтения; для приема ошибок
+	wg         sync.WaitGroup
+
+	conn    *nats.Conn
+	js      jetstream.JetStream
+	stream  jetstream.Stream
+	subject string
+
+	sealer        *Sealer
+	compressAbove int // Сжимать значения не короче; 0 отключает сжатие
+	queueSize     int // Событий в очереди
+
+	mu       sync.Mutex
+	writeErr error // Ошибка последней публикации, для Check
+
+	lastSequence uint64 // Последний использованный порядковый номер
+}
+
+func NewNATSTransactionLogger(c NATSConfig, o LogOptions) (TransactionLogger, error) {
+	if c.URL == "" || c.Stream == "" || c.Subject == "" {
+		return nil, errors.New("the nats backend needs a URL, a stream and a subject")
+	}
+
+	opts := []nats.Option{nats.Name("kvs"), nats.MaxReconnects(-1)} // Переподключаться без ограничения
+	if c.Credentials != "" {
+		opts = append(opts, nats.UserCredentials(c.Credentials))
+	}
+
+	conn, err := nats.Connect(c.URL, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach nats: %w", err)
+	}
+
+	js, err := jetstream.New(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to open jetstream: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:     c.Stream,
+		Subjects: []string{c.Subject},
+		Storage:  jetstream.FileStorage,
+		Replicas: c.Replicas,
+	})
+
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create stream %s: %w", c.Stream, err)
+	}
+
+	return &NATSTransactionLogger{
+		conn:          conn,
+		js:            js,
+		stream:        stream,
+		subject:       c.Subject,
+		sealer:        o.Sealer,
+		compressAbove: o.CompressAbove,
+		queueSize:     o.QueueSize,
+	}, nil
+}
+
+func (l *NATSTransactionLogger) Run() {
+	events := make(chan Event, l.queueSize) // Создать канал событий
+	l.events = events
+
+	errors := make(chan error, 1) // Создать канал ошибок
+	l.errors = errors
+
+	l.stopped = make(chan struct{})
+
+	l.wg.Add(1)
+
+	go func() {
+		defer l.wg.Done()
+		defer close(l.stopped)
+		defer close(errors) // Завершает наблюдателей Err
+
+		var pending []jetstream.PubAckFuture
+
+		for e := range events { // Извлечь следующее событие Event
+			var err error
+
+			if e.synced == nil {
+				e.Sequence = atomic.AddUint64(&l.lastSequence, 1)
+
+				var f jetstream.PubAckFuture
+				if f, err = l.js.PublishMsgAsync(l.message(e)); err == nil {
+					pending = append(pending, f)
+				}
+			}
+
+			if err == nil && len(events) > 0 && len(pending) < natsBatchEvents && e.synced == nil {
+				continue // Публиковать уже ожидающие события, не дожидаясь подтверждений
+			}
+
+			if err == nil {
+				err = l.await(pending)
+			} else {
+				err = fmt.Errorf("failed to publish events: %w", err)
+			}
+
+			pending = pending[:0]
+
+			l.mu.Lock()
+			l.writeErr = err
+			l.mu.Unlock()
+
+			if e.synced != nil { // Всё опубликованное до Sync подтверждено потоком
+				e.synced <- err
+			}
+
+			if err != nil {
+				errors <- err
+				return
+			}
+		}
+	}()
+}
+
+func (l *NATSTransactionLogger) message(e Event) *nats.Msg {
+	line := encodeEvent(l.sealer.sealEvent(compressEvent(e, l.compressAbove)))
+
+	msg := nats.NewMsg(l.subject)
+	msg.Data = []byte(line)
+	msg.Header.Set("Kvs-Format", l.sealer.logHeader())
+	msg.Header.Set(jetstream.MsgIDHeader, strconv.FormatUint(e.Sequence, 10)) // Поток отбросит повтор
+
+	return msg
+}
+
+// await waits for the stream to acknowledge every pending publication.
+func (l *NATSTransactionLogger) await(pending []jetstream.PubAckFuture) error {
+	for _, f := range pending {
+		select {
+		case <-f.Ok():
+		case err := <-f.Err():
+			return fmt.Errorf("failed to publish events: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (l *NATSTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
+	outEvent := make(chan Event)    // Небуферизованный канал событий
+	outError := make(chan error, 1) // Буферизованный канал ошибок
+
+	go func() {
+		defer close(outEvent) // Закрыть каналы
+		defer close(outError) // по завершении сопрограммы
+
+		ctx := context.Background()
+
+		info, err := l.stream.Info(ctx)
+		if err != nil {
+			outError <- fmt.Errorf("failed to read stream info: %w", err)
+			return
+		}
+
+		last := info.State.LastSeq
+		if info.State.Msgs == 0 {
+			return
+		}
+
+		consumer, err := l.stream.OrderedConsumer(ctx, jetstream.OrderedConsumerConfig{
+			FilterSubjects: []string{l.subject},
+			DeliverPolicy:  jetstream.DeliverAllPolicy,
+		})
+
+		if err != nil {
+			outError <- fmt.Errorf("failed to consume stream: %w", err)
+			return
+		}
+
+		msgs, err := consumer.Messages()
+		if err != nil {
+			outError <- fmt.Errorf("failed to consume stream: %w", err)
+			return
+		}
+
+		defer msgs.Stop()
+
+		for {
+			msg, err := msgs.Next()
+			if err != nil {
+				outError <- fmt.Errorf("transaction log read failure: %w", err)
+				return
+			}
+
+			meta, err := msg.Metadata()
+			if err != nil {
+				outError <- fmt.Errorf("transaction log read failure: %w", err)
+				return
+			}
+
+			e, err := l.decodeMessage(msg)
+			if err != nil {
+				outError <- fmt.Errorf("stream sequence %d: input parse error: %w", meta.Sequence.Stream, err)
+				return
+			}
+
+			if e.Sequence > l.lastSequence {
+				atomic.StoreUint64(&l.lastSequence, e.Sequence)
+				outEvent <- e
+			}
+
+			if meta.Sequence.Stream >= last {
+				return
+			}
+		}
+	}()
+
+	return outEvent, outError
+}
+
+func (l *NATSTransactionLogger) decodeMessage(msg jetstream.Msg) (Event, error) {
+	format := logFormats[fileLogHeader]
+
+	if header := msg.Headers().Get("Kvs-Format"); header != "" {
+		var err error
+		if format, err = checkLogHeader(header+"\n", l.sealer); err != nil {
+			return Event{}, err
+		}
+	}
+
+	e, err := format.decode(string(msg.Data()))
+	if err != nil {
+		return Event{}, err
+	}
+
+	return l.sealer.openEvent(e)
+}
+
+func (l *NATSTransactionLogger) WritePut(key, value string, revision uint64) error {
+	return l.send(Event{EventType: EventPut, Key: key, Value: value, Revision: revision})
+}
+
+func (l *NATSTransactionLogger) WriteDelete(key string) error {
+	return l.send(Event{EventType: EventDelete, Key: key})
+}
+
+func (l *NATSTransactionLogger) WriteExpire(key string, deadline time.Time) error {
+	return l.send(Event{EventType: EventExpire, Key: key, Value: strconv.FormatInt(deadline.UnixNano(), 10)})
+}
+
+func (l *NATSTransactionLogger) WriteExpired(key string) error {
+	return l.send(Event{EventType: EventExpired, Key: key})
+}
+
+func (l *NATSTransactionLogger) WriteTombstone(key string, until time.Time) error {
+	return l.send(Event{EventType: EventTombstone, Key: key, Value: strconv.FormatInt(until.UnixNano(), 10)})
+}
+
+func (l *NATSTransactionLogger) WriteSchedule(key, op string, at time.Time) error {
+	return l.send(Event{EventType: EventSchedule, Key: key, Value: scheduleValue(op, at)})
+}
+
+func (l *NATSTransactionLogger) WriteContentType(key, contentType string) error {
+	return l.send(Event{EventType: EventContentType, Key: key, Value: contentType})
+}
+
+func (l *NATSTransactionLogger) WriteReadOnly(enabled bool) error {
+	return l.send(Event{EventType: EventReadOnly, Value: strconv.FormatBool(enabled)})
+}
+
+func (l *NATSTransactionLogger) WriteTxn(ops []Event) error {
+	return l.send(Event{EventType: EventTxn, Value: encodeTxnEvents(ops)})
+}
+
+func (l *NATSTransactionLogger) WriteIncrement(key, value string, revision uint64) error {
+	return l.send(Event{EventType: EventIncrement, Key: key, Value: value, Revision: revision})
+}
+
+// Sync blocks until every event written before the call is acknowledged.
+func (l *NATSTransactionLogger) Sync(ctx context.Context) error {
+	return l.syncEvents(ctx)
+}
+
+// Check reports whether the logger goroutine is running, the connection
+// is up and the last publication succeeded.
+func (l *NATSTransactionLogger) Check() error {
+	select {
+	case <-l.stopped:
+		return ErrorLoggerStopped
+	default:
+	}
+
+	if !l.conn.IsConnected() {
+		return fmt.Errorf("nats connection %s", l.conn.Status())
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.writeErr
+}
+
+func (l *NATSTransactionLogger) Err() <-chan error {
+	return l.errors
+}
+
+func (l *NATSTransactionLogger) Queue() (int, int) {
+	return len(l.events), cap(l.events)
+}
+
+func (l *NATSTransactionLogger) LastSequence() uint64 {
+	return atomic.LoadUint64(&l.lastSequence)
+}
+
+// Close stops accepting events and waits until the buffered ones are
+// acknowledged.
+func (l *NATSTransactionLogger) Close() error {
+	if l.events != nil {
+		l.closeEvents()
+	}
+
+	l.wg.Wait()
+
+	var err error
+	select {
+	case err = <-l.errors:
+	default:
+	}
+
+	if err == nil {
+		err = l.conn.Drain()
+	} else {
+		l.conn.Close()
+	}
+
+	return err
+}
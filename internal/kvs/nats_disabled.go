@@ -0,0 +1,11 @@
+//go:build !nats
+
+package kvs
+
+import "errors"
+
+// NewNATSTransactionLogger fails in builds without the nats tag, which
+// leave the NATS client out.
+func NewNATSTransactionLogger(c NATSConfig, o LogOptions) (TransactionLogger, error) {
+	return nil, errors.New("the nats transaction log backend is not built in; build with -tags nats")
+}
@@ -0,0 +1,329 @@
+package kvs
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * OpenID Connect authentication.
+ *
+ * Bearer tokens issued by the configured identity provider are verified
+ * against the keys it publishes: the JWKS URI comes from the issuer's
+ * /.well-known/openid-configuration, and the key set is fetched again when
+ * a token names a key it lacks, at most once per oidcRefreshInterval, so
+ * key rotation needs no restart. RS256 and ES256 signatures are accepted.
+ * A token must come from the issuer, carry the audience if one is
+ * configured and be within its exp and nbf claims; the scopes listed in
+ * the scope claim grant read or write permission.
+ */
+const (
+	oidcRefreshInterval = time.Minute      // Реже не перечитывать ключи ради неизвестного kid
+	oidcFetchTimeout    = 10 * time.Second // Запрос к провайдеру при проверке токена
+)
+
+var errOIDCUnknownKey = errors.New("token signed with an unknown key")
+
+type oidcProvider struct {
+	config OIDCConfig
+	client *http.Client
+
+	mu      sync.Mutex
+	jwksURI string
+	keys    map[string]crypto.PublicKey // kid -> ключ
+	fetched time.Time
+}
+
+func newOIDCProvider(c OIDCConfig) *oidcProvider {
+	return &oidcProvider{config: c, client: &http.Client{Timeout: oidcFetchTimeout}}
+}
+
+// oidcClaims are the claims of an OIDC token; the scope claim is named by
+// the configuration and read separately.
+type oidcClaims struct {
+	Issuer    string          `json:"iss"`
+	Subject   string          `json:"sub"`
+	Audience  json.RawMessage `json:"aud"` // Строка или массив строк
+	ExpiresAt int64           `json:"exp"`
+	NotBefore int64           `json:"nbf"`
+}
+
+func (o *oidcProvider) Authenticate(ctx context.Context, c Credentials) (Principal, error) {
+	parts := strings.Split(c.Token, ".")
+	if len(parts) != 3 {
+		return Principal{}, ErrorUnauthenticated
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	if err := decodeJWTPart(parts[0], &header); err != nil || (header.Alg != "RS256" && header.Alg != "ES256") {
+		return Principal{}, ErrorUnauthenticated
+	}
+
+	var claims oidcClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil || claims.Issuer != o.config.Issuer {
+		return Principal{}, ErrorUnauthenticated // Токен другого издателя
+	}
+
+	key, err := o.key(ctx, header.Kid)
+	if errors.Is(err, errOIDCUnknownKey) {
+		return Principal{}, ErrorUnauthenticated
+	}
+
+	if err != nil {
+		return Principal{}, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature) {
+		return Principal{}, ErrorUnauthenticated
+	}
+
+	times := jwtClaims{ExpiresAt: claims.ExpiresAt, NotBefore: claims.NotBefore}
+	if !times.valid(time.Now()) || !o.audienceValid(claims.Audience) {
+		return Principal{}, ErrorUnauthenticated
+	}
+
+	scopes, err := o.scopes(parts[1])
+	if err != nil {
+		return Principal{}, ErrorUnauthenticated
+	}
+
+	return Principal{Name: "oidc:" + claims.Subject, Permission: scopePermission(scopes, o.config.ReadScope, o.config.WriteScope, o.config.AdminScope)}, nil
+}
+
+// audienceValid reports whether the aud claim names the configured
+// audience.
+func (o *oidcProvider) audienceValid(raw json.RawMessage) bool {
+	if o.config.Audience == "" {
+		return true
+	}
+
+	var audiences []string
+	if json.Unmarshal(raw, &audiences) != nil {
+		var audience string
+		if json.Unmarshal(raw, &audience) != nil {
+			return false
+		}
+		audiences = []string{audience}
+	}
+
+	for _, audience := range audiences {
+		if audience == o.config.Audience {
+			return true
+		}
+	}
+
+	return false
+}
+
+// scopes returns the scopes of the scope claim, a space-separated string
+// or an array of strings.
+func (o *oidcProvider) scopes(payload string) ([]string, error) {
+	var claims map[string]json.RawMessage
+	if err := decodeJWTPart(payload, &claims); err != nil {
+		return nil, err
+	}
+
+	raw, ok := claims[o.config.ScopeClaim]
+	if !ok {
+		return nil, nil
+	}
+
+	var scopes []string
+	if json.Unmarshal(raw, &scopes) == nil {
+		return scopes, nil
+	}
+
+	var scope string
+	if err := json.Unmarshal(raw, &scope); err != nil {
+		return nil, err
+	}
+
+	return strings.Fields(scope), nil
+}
+
+// key returns the signing key kid, fetching the key set if it is missing.
+func (o *oidcProvider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if key, ok := o.keys[kid]; ok {
+		return key, nil
+	}
+
+	if time.Since(o.fetched) < oidcRefreshInterval {
+		return nil, errOIDCUnknownKey
+	}
+
+	if err := o.refresh(ctx); err != nil {
+		return nil, err
+	}
+
+	if key, ok := o.keys[kid]; ok {
+		return key, nil
+	}
+
+	return nil, errOIDCUnknownKey
+}
+
+// refresh fetches the key set, discovering its URI first; o.mu must be
+// held.
+func (o *oidcProvider) refresh(ctx context.Context) error {
+	o.fetched = time.Now() // Отказ провайдера тоже откладывает следующую попытку
+
+	if o.jwksURI == "" {
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+
+		if err := o.fetch(ctx, strings.TrimSuffix(o.config.Issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+			return fmt.Errorf("OIDC discovery failed: %w", err)
+		}
+
+		if discovery.JWKSURI == "" {
+			return errors.New("OIDC discovery failed: no jwks_uri")
+		}
+
+		o.jwksURI = discovery.JWKSURI
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+
+	if err := o.fetch(ctx, o.jwksURI, &set); err != nil {
+		return fmt.Errorf("failed to fetch OIDC keys: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+
+	o.keys = keys
+
+	return nil
+}
+
+func (o *oidcProvider) fetch(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// jsonWebKey is an RSA or P-256 public key of a JWKS.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	number := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, errors.New("invalid key parameter")
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch {
+	case k.Kty == "RSA":
+		n, err := number(k.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := number(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() > 1<<31 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case k.Kty == "EC" && k.Crv == "P-256":
+		x, err := number(k.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := number(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, errors.New("EC key not on curve")
+		}
+
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// verifySignature checks an RS256 or ES256 signature of signed.
+func verifySignature(alg string, key crypto.PublicKey, signed string, signature []byte) bool {
+	digest := sha256.Sum256([]byte(signed))
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return alg == "RS256" && rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil
+
+	case *ecdsa.PublicKey:
+		if alg != "ES256" || len(signature) != 64 {
+			return false
+		}
+
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+
+		return ecdsa.Verify(key, digest[:], r, s)
+
+	default:
+		return false
+	}
+}
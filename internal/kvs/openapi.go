@@ -0,0 +1,884 @@
+package kvs
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+/**
+ * OpenAPI document.
+ *
+ * GET /v1/openapi.json describes the HTTP API as an OpenAPI 3.0 document
+ * for client generators. It is built, on the first request, from the code
+ * rather than kept by hand: the paths, path variables, methods and names
+ * of the operations are those of the router's routes, the schemas of the
+ * JSON bodies are derived by reflection from the Go types the handlers
+ * encode and decode, and the codes of the /v2 errors are those of
+ * errorCodes. What each route takes and answers beyond that is described
+ * in routeDocs, next to which a new route belongs; a route missing there
+ * is still listed, with the responses every route may give. Routes of the
+ * admin listener are tagged "admin".
+ */
+const openAPIVersion = "3.0.3"
+
+// docParam is a query parameter of a route.
+type docParam struct {
+	name        string
+	kind        string // Тип схемы: "string", "integer", "boolean"
+	description string
+}
+
+// docBody is a request or response body: a Go value of the type it
+// encodes, or a schema.
+type docBody struct {
+	media string
+	of    any
+}
+
+type docReply struct {
+	description string
+	bodies      []docBody
+	headers     []string // Из responseHeaders
+}
+
+type routeDoc struct {
+	summary string
+	query   []docParam
+	headers []string // Из requestHeaders
+	bodies  []docBody
+	replies map[int]docReply
+}
+
+var (
+	textBody   = docBody{"text/plain", map[string]any{"type": "string"}}
+	binaryBody = docBody{"application/octet-stream", map[string]any{"type": "string", "format": "binary"}}
+	streamBody = docBody{"text/event-stream", map[string]any{"type": "string"}}
+)
+
+func jsonBody(of any) docBody {
+	return docBody{"application/json", of}
+}
+
+// ndjsonBody is a stream of JSON Lines, one value like of per line.
+func ndjsonBody(of any) docBody {
+	return docBody{"application/x-ndjson", of}
+}
+
+func reply(description string, bodies ...docBody) docReply {
+	return docReply{description: description, bodies: bodies}
+}
+
+func (r docReply) with(headers ...string) docReply {
+	r.headers = headers
+	return r
+}
+
+var (
+	cursorParam   = docParam{"cursor", "string", "X-Next-Cursor of the previous page"}
+	limitParam    = docParam{"limit", "integer", "keys per page, at most limits.list_max"}
+	valuesParam   = docParam{"values", "boolean", "list the entries with their values instead of the keys"}
+	snapshotParam = docParam{"snapshot", "boolean", "serve the scan from a copy taken on its first page"}
+	ttlParam      = docParam{"ttl", "string", `time to live, a Go duration such as "30s"`}
+	prefixParam   = docParam{"prefix", "string", "only the keys starting with it"}
+	patternParam  = docParam{"pattern", "string", "only the keys matching the glob"}
+	afterParam    = docParam{"after", "string", `delete the key after this Go duration, such as "24h", instead of now`}
+	toParam       = docParam{"to", "string", "the destination key, whose value is replaced"}
+)
+
+// requestHeaders are the headers routes take, by name.
+var requestHeaders = map[string]string{
+	"If-Match":          "write only over this ETag, or read only if it matches",
+	"If-None-Match":     `"*" writes only a new key; an ETag answers 304 if it matches`,
+	"If-Modified-Since": "answer 304 unless the key changed since",
+	"X-Durability":      `"sync" answers once the write is fsynced, "async" at once`,
+	"Idempotency-Key":   "replay the response of an earlier request with the same key",
+	"Content-Encoding":  `"gzip" or "zstd" body`,
+	"Accept-Encoding":   "compress values of the response",
+	"Last-Event-ID":     "resume the stream after this event",
+}
+
+// commonHeaders are taken by every route.
+var commonHeaders = map[string]string{
+	"X-Request-ID":    "ID of the request, echoed in the response and the logs",
+	"X-Session-Token": "on a replica, wait until the writes of this session are applied",
+}
+
+// responseHeaders are the headers routes answer with, by name.
+var responseHeaders = map[string]string{
+	"ETag":                "revision of the key",
+	"Last-Modified":       "time of the revision",
+	"X-Next-Cursor":       "cursor of the next page; missing on the last",
+	"X-TTL":               "seconds the key has left",
+	"X-Created":           "time the key was created",
+	"X-Content-SHA256":    "hex SHA-256 of the value, with store checksums",
+	"Retry-After":         "seconds to wait before retrying",
+	"Idempotent-Replayed": `"true" on a replayed response`,
+	"X-Session-Token":     "position of the write for read-your-writes reads",
+	clusterNodeHeader:     "ID of the cluster node that owns the key",
+}
+
+// routeDocs describes the routes by name.
+var routeDocs = map[string]routeDoc{
+	"put": {
+		summary: "Write the value of a key",
+		query:   []docParam{ttlParam},
+		headers: []string{"If-Match", "If-None-Match", "X-Durability", "Idempotency-Key", "Content-Encoding"},
+		bodies:  []docBody{binaryBody},
+		replies: map[int]docReply{
+			201: reply("written").with("ETag", "Last-Modified", "X-Session-Token"),
+			400: reply("invalid key, ttl or body", textBody),
+			412: reply("If-Match or If-None-Match not met", textBody),
+			413: reply("key or value too large", textBody),
+			415: reply("unsupported Content-Encoding", textBody),
+			428: reply("write to an existing key without If-Match", textBody),
+			507: reply("memory full or quota exceeded", textBody),
+		},
+	},
+	"get": {
+		summary: "Read the value of a key",
+		query:   []docParam{{"rev", "integer", "a kept previous revision"}, {"transform", "string", "JSON pointer or filter applied to a JSON value"}},
+		headers: []string{"If-None-Match", "If-Modified-Since", "Accept-Encoding"},
+		replies: map[int]docReply{
+			200: reply("the value", binaryBody).with("ETag", "Last-Modified", "X-TTL", "X-Created", "X-Content-SHA256"),
+			304: reply("not modified"),
+			404: reply("no such key or revision", textBody),
+		},
+	},
+	"delete": {
+		summary: "Delete a key",
+		query:   []docParam{afterParam},
+		headers: []string{"If-Match", "X-Durability", "Idempotency-Key"},
+		replies: map[int]docReply{
+			200: reply("deleted").with("X-Session-Token"),
+			202: reply("the delete scheduled", jsonBody(scheduledOp{})),
+			404: reply("no such key", textBody),
+			412: reply("If-Match not met", textBody),
+		},
+	},
+	"ttl": {
+		summary: "Read the seconds a key has left",
+		replies: map[int]docReply{
+			200: reply("seconds left, -1 without a deadline", textBody),
+			404: reply("no such key", textBody),
+		},
+	},
+	"meta": {
+		summary: "Read the metadata of a key",
+		replies: map[int]docReply{
+			200: reply("the metadata", jsonBody(keyMeta{})),
+			404: reply("no such key", textBody),
+		},
+	},
+	"incr": {
+		summary: "Add to the integer value of a key",
+		query:   []docParam{{"by", "integer", "amount to add, 1 by default"}},
+		headers: []string{"X-Durability", "Idempotency-Key"},
+		replies: map[int]docReply{
+			200: reply("the new value", textBody).with("ETag"),
+			400: reply("invalid key or amount", textBody),
+			409: reply("value not an integer, or overflow", textBody),
+		},
+	},
+	"append": {
+		summary: "Append the body to the value of a key",
+		headers: []string{"X-Durability", "Idempotency-Key"},
+		bodies:  []docBody{binaryBody},
+		replies: map[int]docReply{
+			200: reply("the new length of the value", textBody).with("ETag"),
+			400: reply("invalid key", textBody),
+			413: reply("key or value too large", textBody),
+		},
+	},
+	"rename": {
+		summary: "Move the value of a key to another key",
+		query:   []docParam{toParam},
+		headers: []string{"X-Durability", "Idempotency-Key"},
+		replies: map[int]docReply{
+			201: reply("renamed").with("ETag"),
+			400: reply("invalid or same destination key", textBody),
+			404: reply("no such key", textBody),
+			413: reply("destination key too large", textBody),
+		},
+	},
+	"copy": {
+		summary: "Copy the value of a key to another key",
+		query:   []docParam{toParam},
+		headers: []string{"X-Durability", "Idempotency-Key"},
+		replies: map[int]docReply{
+			201: reply("copied").with("ETag"),
+			400: reply("invalid or same destination key", textBody),
+			404: reply("no such key", textBody),
+			413: reply("destination key too large", textBody),
+		},
+	},
+	"history": {
+		summary: "List the kept revisions of a key",
+		replies: map[int]docReply{
+			200: reply("the revisions, newest first", jsonBody([]Entry{})),
+			404: reply("no such key", textBody),
+		},
+	},
+	"undelete": {
+		summary: "Restore a deleted key",
+		headers: []string{"X-Durability"},
+		replies: map[int]docReply{
+			200: reply("restored").with("ETag"),
+			404: reply("no tombstone for the key", textBody),
+			409: reply("the key exists", textBody),
+		},
+	},
+	"v2_put": {
+		summary: "Write a key as a JSON record",
+		headers: []string{"If-Match", "If-None-Match", "X-Durability", "Idempotency-Key"},
+		bodies:  []docBody{jsonBody(bulkRecord{})},
+		replies: map[int]docReply{
+			201: reply("written", jsonBody(v2Write{})).with("ETag", "X-Session-Token"),
+			400: reply("invalid key or record"),
+			412: reply("If-Match or If-None-Match not met"),
+			413: reply("key or value too large"),
+			428: reply("write to an existing key without If-Match"),
+		},
+	},
+	"v2_get": {
+		summary: "Read a key as a JSON record",
+		query:   []docParam{{"rev", "integer", "a kept previous revision"}},
+		replies: map[int]docReply{
+			200: reply("the record", jsonBody(v2Entry{})).with("ETag", "X-Content-SHA256"),
+			404: reply("no such key or revision"),
+		},
+	},
+	"v2_delete": {
+		summary: "Delete a key",
+		query:   []docParam{afterParam},
+		headers: []string{"If-Match", "X-Durability", "Idempotency-Key"},
+		replies: map[int]docReply{
+			200: reply("deleted"),
+			202: reply("the delete scheduled", jsonBody(scheduledOp{})),
+			404: reply("no such key"),
+			412: reply("If-Match not met"),
+		},
+	},
+	"list": {
+		summary: "List the keys in order",
+		query:   []docParam{prefixParam, cursorParam, limitParam, valuesParam, snapshotParam},
+		replies: map[int]docReply{
+			200: reply("a page of keys, or of entries with values=true", jsonBody([]string{}), jsonBody([]Entry{})).with("X-Next-Cursor"),
+			400: reply("invalid cursor, limit or listing", textBody),
+			410: reply("snapshot cursor expired", textBody),
+			429: reply("too many snapshot cursors", textBody).with("Retry-After"),
+		},
+	},
+	"delete_keys": {
+		summary: "Delete every key with a prefix or matching a glob",
+		query:   []docParam{prefixParam, patternParam},
+		headers: []string{"X-Durability"},
+		replies: map[int]docReply{
+			200: reply("the number of keys deleted", jsonBody(map[string]int{})),
+			400: reply("neither prefix nor pattern", textBody),
+		},
+	},
+	"range": {
+		summary: "List the keys from start, inclusive, to end, exclusive",
+		query:   []docParam{{"start", "string", "first key"}, {"end", "string", "key after the last; empty is unbounded"}, cursorParam, limitParam, valuesParam, snapshotParam},
+		replies: map[int]docReply{
+			200: reply("a page of keys, or of entries with values=true", jsonBody([]string{}), jsonBody([]Entry{})).with("X-Next-Cursor"),
+			400: reply("invalid bounds, cursor or limit", textBody),
+			410: reply("snapshot cursor expired", textBody),
+		},
+	},
+	"dir": {
+		summary: "List the keys and directories directly in a directory",
+		query:   []docParam{cursorParam, limitParam},
+		replies: map[int]docReply{
+			200: reply("a page of children, directories ending in /", jsonBody([]dirChild{})).with("X-Next-Cursor"),
+			400: reply("invalid cursor or limit", textBody),
+		},
+	},
+	"index": {
+		summary: "Look up the keys whose JSON value has a field",
+		query:   []docParam{{"value", "string", "value of the field"}, cursorParam, limitParam, valuesParam},
+		replies: map[int]docReply{
+			200: reply("a page of keys", jsonBody([]string{}), jsonBody([]Entry{})).with("X-Next-Cursor"),
+			404: reply("field not indexed", textBody),
+		},
+	},
+	"batch": {
+		summary: "Run gets, puts and deletes together",
+		headers: []string{"X-Durability", "Idempotency-Key"},
+		bodies:  []docBody{jsonBody([]BatchOp{})},
+		replies: map[int]docReply{
+			200: reply("the result of each operation", jsonBody([]BatchResult{})),
+			400: reply("invalid operation", textBody),
+			413: reply("body, key or value too large", textBody),
+		},
+	},
+	"mget": {
+		summary: "Read several keys at one point in time",
+		bodies:  []docBody{jsonBody(mgetRequest{})},
+		replies: map[int]docReply{
+			200: reply("the values found and the keys missing", jsonBody(mgetResponse{})),
+			400: reply("invalid request", textBody),
+		},
+	},
+	"txn": {
+		summary: "Compare keys and run the success or failure operations",
+		headers: []string{"X-Durability", "Idempotency-Key"},
+		bodies:  []docBody{jsonBody(Txn{})},
+		replies: map[int]docReply{
+			200: reply("the branch taken and its results", jsonBody(TxnResult{})),
+			400: reply("invalid transaction", textBody),
+			413: reply("body, key or value too large", textBody),
+		},
+	},
+	"snapshot": {
+		summary: "Stream a snapshot of the store",
+		replies: map[int]docReply{
+			200: reply("a header line and the entries", ndjsonBody(Entry{})),
+		},
+	},
+	"restore": {
+		summary: "Replace the store with a snapshot",
+		headers: []string{"Content-Encoding"},
+		bodies:  []docBody{ndjsonBody(Entry{})},
+		replies: map[int]docReply{
+			200: reply("the keys restored and removed", jsonBody(map[string]int{})),
+			400: reply("invalid snapshot", textBody),
+		},
+	},
+	"export": {
+		summary: "Stream the keys as JSON Lines or CSV",
+		query:   []docParam{prefixParam, {"format", "string", `"jsonl" or "csv"`}},
+		replies: map[int]docReply{
+			200: reply("the records", ndjsonBody(bulkRecord{}), docBody{"text/csv", map[string]any{"type": "string"}}),
+			400: reply("unsupported format", textBody),
+		},
+	},
+	"import": {
+		summary: "Merge keys from JSON Lines or CSV, or replace the store",
+		query:   []docParam{{"format", "string", `"jsonl" or "csv"`}, {"mode", "string", `"merge" or "replace"`}},
+		headers: []string{"Content-Encoding"},
+		bodies:  []docBody{ndjsonBody(bulkRecord{}), {"text/csv", map[string]any{"type": "string"}}},
+		replies: map[int]docReply{
+			200: reply("the keys imported and removed", jsonBody(map[string]int{})),
+			400: reply("invalid record", textBody),
+		},
+	},
+	"compact": {
+		summary: "Compact the transaction log",
+		replies: map[int]docReply{
+			204: reply("compacted"),
+			409: reply("the log backend cannot be compacted", textBody),
+		},
+	},
+	"read_only": {
+		summary: "Read or switch read-only mode",
+		bodies:  []docBody{jsonBody(readOnlyState{})},
+		replies: map[int]docReply{
+			200: reply("the mode", jsonBody(readOnlyState{})),
+		},
+	},
+	"lock": {
+		summary: "Acquire a lock lease",
+		query:   []docParam{ttlParam},
+		replies: map[int]docReply{
+			200: reply("the lease and its fencing token", jsonBody(lockInfo{})),
+			423: reply("held by another client", textBody).with("Retry-After"),
+		},
+	},
+	"lock_info": {
+		summary: "Read the holder of a lock",
+		replies: map[int]docReply{
+			200: reply("the lock without its lease", jsonBody(lockInfo{})),
+			404: reply("not held", textBody),
+		},
+	},
+	"unlock": {
+		summary: "Release a lock lease",
+		query:   []docParam{{"lease", "string", "lease to release"}},
+		replies: map[int]docReply{
+			204: reply("released"),
+			409: reply("not the current lease", textBody),
+		},
+	},
+	"renew_lock": {
+		summary: "Extend a lock lease",
+		query:   []docParam{{"lease", "string", "lease to renew"}, ttlParam},
+		replies: map[int]docReply{
+			200: reply("the renewed lease", jsonBody(lockInfo{})),
+			410: reply("lease expired or replaced", textBody),
+		},
+	},
+	"watch": {
+		summary: "Stream the changes of a key as server-sent events",
+		query:   []docParam{{"types", "string", "comma-separated event types"}, {"changed", "boolean", "skip writes that keep the value"}},
+		replies: map[int]docReply{200: reply("the events", streamBody)},
+	},
+	"watch_prefix": {
+		summary: "Stream the changes of the keys with a prefix as server-sent events",
+		query:   []docParam{prefixParam, patternParam, {"types", "string", "comma-separated event types"}, {"changed", "boolean", "skip writes that keep the value"}},
+		replies: map[int]docReply{200: reply("the events", streamBody)},
+	},
+	"events": {
+		summary: "Stream the change feed as server-sent events",
+		query:   []docParam{{"since", "integer", "resume after this sequence"}},
+		headers: []string{"Last-Event-ID"},
+		replies: map[int]docReply{
+			200: reply("the events", streamBody),
+			410: reply("position no longer available", textBody),
+		},
+	},
+	"usage": {
+		summary: "Read the usage of the buckets with a quota",
+		replies: map[int]docReply{200: reply("the buckets", jsonBody(struct {
+			Buckets []bucketUsage `json:"buckets"`
+		}{}))},
+	},
+	"stats": {
+		summary: "Read the server statistics",
+		replies: map[int]docReply{200: reply("the statistics", jsonBody(serverStats{}))},
+	},
+	"slowlog": {
+		summary: "List the slow requests, or forget them with DELETE",
+		replies: map[int]docReply{
+			200: reply("the slow requests, the latest first", jsonBody([]slowRequest{})),
+			204: reply("forgotten"),
+			404: reply("slow request log disabled", textBody),
+		},
+	},
+	"hotkeys": {
+		summary: "List the most accessed keys",
+		query:   []docParam{{"top", "integer", "keys to list, 20 by default"}},
+		replies: map[int]docReply{
+			200: reply("the hottest keys with their estimated recent accesses", jsonBody([]hotKey{})),
+			400: reply("invalid top", textBody),
+			404: reply("hot key tracking disabled", textBody),
+		},
+	},
+	"reload": {
+		summary: "Reload the configuration",
+		replies: map[int]docReply{
+			204: reply("reloaded"),
+			400: reply("invalid configuration", textBody),
+		},
+	},
+	"audit": {
+		summary: "Read the audit log",
+		query:   []docParam{{"principal", "string", "only this principal"}, {"key", "string", "only this key"}, {"operation", "string", "only this operation"}, {"limit", "integer", "most recent records"}},
+		replies: map[int]docReply{200: reply("the records", ndjsonBody(map[string]any{"type": "object"}))},
+	},
+	"verify_log": {
+		summary: "Check the transaction log",
+		replies: map[int]docReply{
+			200: reply("the report", jsonBody(logReport{})),
+			409: reply("the log backend cannot be checked", textBody),
+		},
+	},
+	"migration": {
+		summary: "Read the progress of the backend migration",
+		replies: map[int]docReply{
+			200: reply("the migration", jsonBody(migrationStatus{})),
+			404: reply("no migration", textBody),
+		},
+	},
+	"migration_cutover": {
+		summary: "Serve the reads from the store migrated to",
+		replies: map[int]docReply{
+			200: reply("the migration", jsonBody(migrationStatus{})),
+			409: reply("no store migration, or it has fallen behind", textBody),
+		},
+	},
+	"schedule": {
+		summary: "List the scheduled operations",
+		replies: map[int]docReply{
+			200: reply("the pending operations, the soonest first", jsonBody([]scheduledOp{})),
+		},
+	},
+	"unschedule": {
+		summary: "Cancel the scheduled operation of a key",
+		replies: map[int]docReply{
+			204: reply("cancelled"),
+			404: reply("no operation scheduled", textBody),
+		},
+	},
+	"pprof":      {summary: "Read a runtime profile"},
+	"expvar":     {summary: "Read the exported variables", replies: map[int]docReply{200: reply("the variables", jsonBody(map[string]any{"type": "object"}))}},
+	"goroutines": {summary: "Dump the goroutines", replies: map[int]docReply{200: reply("the stacks", textBody)}},
+	"replication": {
+		summary: "Stream the events after a position, for replicas",
+		query:   []docParam{{"after", "integer", "last sequence applied"}, {"epoch", "string", "epoch of the position"}},
+		replies: map[int]docReply{
+			200: reply("the events", ndjsonBody(map[string]any{"type": "object"})),
+			410: reply("position no longer available", textBody),
+		},
+	},
+	"replication_snapshot": {
+		summary: "Stream a snapshot of the store, for replicas",
+		replies: map[int]docReply{200: reply("a header line and the entries", ndjsonBody(Entry{}))},
+	},
+	"cluster": {
+		summary: "Read the cluster nodes",
+		query:   []docParam{{"key", "string", "also report the owner of this key"}},
+		replies: map[int]docReply{200: reply("the nodes", jsonBody(clusterInfo{}))},
+	},
+	"openapi": {
+		summary: "Read this document",
+		replies: map[int]docReply{200: reply("the OpenAPI document", jsonBody(map[string]any{"type": "object"}))},
+	},
+}
+
+/**
+ * Document construction.
+ */
+
+// openAPIHandler serves GET /v1/openapi.json for the routes of rt.
+func openAPIHandler(rt *Router) http.HandlerFunc {
+	var once sync.Once
+	var document []byte
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() {
+			document, _ = json.MarshalIndent(newOpenAPIDocument(rt), "", "  ")
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(document)
+	}
+}
+
+// schemaSet collects the schemas of the named types it is given.
+type schemaSet map[string]any
+
+func newOpenAPIDocument(rt *Router) map[string]any {
+	schemas := schemaSet{}
+	paths := map[string]map[string]any{}
+
+	for _, route := range rt.routes {
+		if route.name == "" {
+			continue
+		}
+
+		path, variables := openAPIPath(route)
+		if paths[path] == nil {
+			paths[path] = map[string]any{}
+		}
+
+		methods := route.methods
+		if len(methods) == 0 {
+			methods = []string{http.MethodGet}
+		}
+
+		for i, method := range methods {
+			id := route.name
+			if i > 0 {
+				id += "_" + strings.ToLower(method)
+			}
+
+			paths[path][strings.ToLower(method)] = schemas.operation(route, id, method, variables)
+		}
+	}
+
+	parameters := map[string]any{}
+	for name, description := range commonHeaders {
+		parameters[name] = map[string]any{"name": name, "in": "header", "description": description, "schema": map[string]any{"type": "string"}}
+	}
+
+	schemas["Error"] = schemas.schema(struct {
+		Error apiError `json:"error"`
+	}{})
+	schemas[schemaName(reflect.TypeOf(apiError{}))].(map[string]any)["properties"].(map[string]any)["code"] = map[string]any{"type": "string", "enum": errorCodeNames()}
+
+	return map[string]any{
+		"openapi": openAPIVersion,
+		"info":    map[string]any{"title": "kvs", "version": "1"},
+		"paths":   paths,
+		"components": map[string]any{
+			"schemas":    schemas,
+			"parameters": parameters,
+			"securitySchemes": map[string]any{
+				"apiKey": map[string]any{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+				"bearer": map[string]any{"type": "http", "scheme": "bearer"},
+				"basic":  map[string]any{"type": "http", "scheme": "basic"},
+			},
+		},
+		"security": []map[string][]string{{"apiKey": {}}, {"bearer": {}}, {"basic": {}}, {}}, // Без аутентификации, если она не настроена
+	}
+}
+
+// openAPIPath returns the path of route in OpenAPI, where a prefix route
+// ends in a variable, and its path variables.
+func openAPIPath(route *Route) (string, []string) {
+	path, variables := route.template, route.variables()
+	if route.prefix() {
+		path += "{path}"
+		variables = append(variables, "path")
+	}
+
+	return path, variables
+}
+
+func (s schemaSet) operation(route *Route, id, method string, variables []string) map[string]any {
+	doc, ok := routeDocs[route.name]
+	if !ok {
+		doc.summary = route.name
+	}
+
+	var parameters []any
+	for _, name := range variables {
+		parameters = append(parameters, map[string]any{"name": name, "in": "path", "required": true, "schema": map[string]any{"type": "string"}})
+	}
+
+	for _, p := range doc.query {
+		parameters = append(parameters, map[string]any{"name": p.name, "in": "query", "description": p.description, "schema": map[string]any{"type": p.kind}})
+	}
+
+	for _, name := range doc.headers {
+		parameters = append(parameters, map[string]any{"name": name, "in": "header", "description": requestHeaders[name], "schema": map[string]any{"type": "string"}})
+	}
+
+	for _, name := range sortedKeys(commonHeaders) {
+		parameters = append(parameters, map[string]any{"$ref": "#/components/parameters/" + name})
+	}
+
+	operation := map[string]any{
+		"operationId": id,
+		"summary":     doc.summary,
+		"parameters":  parameters,
+		"responses":   s.responses(route, doc, method),
+	}
+
+	if adminRoutes[route.name] {
+		operation["tags"] = []string{"admin"}
+	}
+
+	if len(doc.bodies) > 0 && method != http.MethodGet && method != http.MethodHead {
+		operation["requestBody"] = map[string]any{"required": true, "content": s.content(doc.bodies)}
+	}
+
+	return operation
+}
+
+// responses returns the responses of the route, with those of the layers
+// every request goes through.
+func (s schemaSet) responses(route *Route, doc routeDoc, method string) map[string]any {
+	replies := map[int]docReply{}
+	for status, r := range doc.replies {
+		replies[status] = r
+	}
+
+	if len(replies) == 0 {
+		replies[http.StatusOK] = reply("success")
+	}
+
+	common := map[int]docReply{
+		http.StatusUnauthorized:       reply("no valid credentials, with authentication"),
+		http.StatusForbidden:          reply("not permitted"),
+		http.StatusTooManyRequests:    reply("rate limit exceeded").with("Retry-After"),
+		http.StatusServiceUnavailable: reply("not ready, read-only, a replica, or the log failing or falling behind").with("Retry-After"),
+		http.StatusTemporaryRedirect:  reply("the key belongs to another cluster node").with(clusterNodeHeader),
+		http.StatusBadGateway:         reply("the upstream of the cache failed"),
+	}
+
+	for status, r := range common {
+		if _, ok := replies[status]; !ok {
+			replies[status] = r
+		}
+	}
+
+	errorBody := textBody
+	if strings.HasPrefix(route.template, "/v2/") {
+		errorBody = jsonBody(map[string]any{"$ref": "#/components/schemas/Error"})
+	}
+
+	responses := map[string]any{}
+	for status, r := range replies {
+		response := map[string]any{"description": r.description}
+
+		bodies := r.bodies
+		if status >= 400 {
+			bodies = []docBody{errorBody} // Ошибки всегда в формате версии API
+		}
+
+		if len(bodies) > 0 && method != http.MethodHead {
+			response["content"] = s.content(bodies)
+		}
+
+		if len(r.headers) > 0 {
+			headers := map[string]any{}
+			for _, name := range r.headers {
+				headers[name] = map[string]any{"description": responseHeaders[name], "schema": map[string]any{"type": "string"}}
+			}
+			response["headers"] = headers
+		}
+
+		responses[strconv.Itoa(status)] = response
+	}
+
+	return responses
+}
+
+func (s schemaSet) content(bodies []docBody) map[string]any {
+	content := map[string]any{}
+	for _, b := range bodies {
+		if existing, ok := content[b.media]; ok { // Несколько схем одного типа содержимого
+			content[b.media] = map[string]any{"schema": map[string]any{"oneOf": []any{existing.(map[string]any)["schema"], s.schema(b.of)}}}
+			continue
+		}
+
+		content[b.media] = map[string]any{"schema": s.schema(b.of)}
+	}
+
+	return content
+}
+
+// schema returns the schema of v: v itself if it is one, or else that of
+// its type.
+func (s schemaSet) schema(v any) any {
+	if schema, ok := v.(map[string]any); ok {
+		return schema
+	}
+
+	return s.typeSchema(reflect.TypeOf(v))
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// typeSchema returns the schema of the JSON encoding of t, adding the
+// named structs it uses to s and referring to them.
+func (s schemaSet) typeSchema(t reflect.Type) any {
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Pointer:
+		schema := s.typeSchema(t.Elem())
+		if m, ok := schema.(map[string]any); ok && m["$ref"] == nil {
+			m["nullable"] = true
+		}
+		return schema
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer", "format": "int64", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": s.typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": s.typeSchema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.structSchema(t)
+		}
+
+		name := schemaName(t)
+		if _, ok := s[name]; !ok {
+			s[name] = nil // Против бесконечной рекурсии
+			s[name] = s.structSchema(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	default:
+		return map[string]any{}
+	}
+}
+
+// structSchema returns the schema of a struct as encoding/json encodes it,
+// with the fields of embedded structs inlined.
+func (s schemaSet) structSchema(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	var required []string
+
+	var add func(t reflect.Type)
+	add = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+
+			name, options, _ := strings.Cut(tag, ",")
+			if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+				add(f.Type)
+				continue
+			}
+
+			if !f.IsExported() {
+				continue
+			}
+
+			if name == "" {
+				name = f.Name
+			}
+
+			properties[name] = s.typeSchema(f.Type)
+			if !strings.Contains(options, "omitempty") {
+				required = append(required, name)
+			}
+		}
+	}
+	add(t)
+
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+
+	return schema
+}
+
+// schemaName returns the name of the schema of a named type, exported.
+func schemaName(t reflect.Type) string {
+	name := []rune(t.Name())
+	name[0] = unicode.ToUpper(name[0])
+
+	return string(name)
+}
+
+// errorCodeNames returns the codes of the /v2 errors: those of errorCodes
+// and those named after the statuses the API answers with.
+func errorCodeNames() []string {
+	seen := map[string]bool{}
+	for _, code := range errorCodes {
+		seen[code] = true
+	}
+
+	for _, doc := range routeDocs {
+		for status := range doc.replies {
+			if status >= 400 {
+				seen[errorCode(status, "")] = true
+			}
+		}
+	}
+
+	for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests, http.StatusServiceUnavailable} {
+		seen[errorCode(status, "")] = true
+	}
+
+	return sortedKeys(seen)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
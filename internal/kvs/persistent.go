@@ -0,0 +1,132 @@
+package kvs
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+/**
+ * Persistent stores.
+ *
+ * A persistent store keeps its content across restarts by itself. At a
+ * clean shutdown it records the sequence number of the last logged event
+ * it holds, and at the next startup the replay skips the events up to that
+ * number, so only the events logged after it - none, after a clean
+ * shutdown - are applied again. After a crash the recorded number is an
+ * older one, and replaying the events since then over the newer content
+ * yields the same state, since every event sets the key it names.
+ *
+ * With such a store the transaction log is optional: the "none" backend
+ * logs nothing and only counts the events, for the statistics, the
+ * snapshots and the replication feed.
+ */
+type PersistentStore interface {
+	AppliedSequence() uint64     // Последнее событие журнала, отражённое в хранилище
+	Close(sequence uint64) error // Запомнить sequence и закрыть хранилище
+}
+
+// unwrapStore returns the store behind the decorators, for the optional
+// interfaces of the backends.
+func unwrapStore(s Store) Store {
+	for {
+		switch d := s.(type) {
+		case TracingStore:
+			s = d.Store
+		case *EvictingStore:
+			s = d.Store
+		case *UpstreamStore:
+			s = d.Store
+		case *IndexedStore:
+			s = d.Store
+		case *QuotaStore:
+			s = d.Store
+		case *MigratingStore:
+			s = d.Store
+		default:
+			return s
+		}
+	}
+}
+
+// appliedSequence returns the sequence number recorded by a persistent
+// store, or 0 if s keeps nothing across restarts.
+func appliedSequence(s Store) uint64 {
+	if p, ok := unwrapStore(s).(PersistentStore); ok {
+		return p.AppliedSequence()
+	}
+
+	return 0
+}
+
+type NoTransactionLogger struct {
+	lastSequence uint64
+	errors       chan error // Никогда не получает ошибок
+}
+
+// NewNoTransactionLogger returns a logger that records nothing and
+// numbers its events from sequence on.
+func NewNoTransactionLogger(sequence uint64) *NoTransactionLogger {
+	return &NoTransactionLogger{lastSequence: sequence, errors: make(chan error)}
+}
+
+func (l *NoTransactionLogger) write() error {
+	atomic.AddUint64(&l.lastSequence, 1)
+	return nil
+}
+
+func (l *NoTransactionLogger) WritePut(key, value string, revision uint64) error { return l.write() }
+
+func (l *NoTransactionLogger) WriteDelete(key string) error { return l.write() }
+
+func (l *NoTransactionLogger) WriteExpire(key string, deadline time.Time) error { return l.write() }
+
+func (l *NoTransactionLogger) WriteExpired(key string) error { return l.write() }
+
+func (l *NoTransactionLogger) WriteTombstone(key string, until time.Time) error { return l.write() }
+
+func (l *NoTransactionLogger) WriteSchedule(key, op string, at time.Time) error { return l.write() }
+
+func (l *NoTransactionLogger) WriteContentType(key, contentType string) error { return l.write() }
+
+func (l *NoTransactionLogger) WriteReadOnly(enabled bool) error { return l.write() }
+
+func (l *NoTransactionLogger) WriteIncrement(key, value string, revision uint64) error {
+	return l.write()
+}
+
+func (l *NoTransactionLogger) WriteTxn(ops []Event) error { return l.write() }
+
+func (l *NoTransactionLogger) Err() <-chan error {
+	return l.errors
+}
+
+// ReadEvents returns no events: the store already holds them.
+func (l *NoTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
+	events := make(chan Event)
+	errors := make(chan error)
+	close(events)
+	close(errors)
+
+	return events, errors
+}
+
+func (l *NoTransactionLogger) Run() {}
+
+// Sync returns at once: the store writes through to disk by itself.
+func (l *NoTransactionLogger) Sync(ctx context.Context) error {
+	return nil
+}
+
+func (l *NoTransactionLogger) Check() error {
+	return nil
+}
+
+func (l *NoTransactionLogger) Close() error {
+	close(l.errors) // Завершает наблюдателей Err
+	return nil
+}
+
+func (l *NoTransactionLogger) LastSequence() uint64 {
+	return atomic.LoadUint64(&l.lastSequence)
+}
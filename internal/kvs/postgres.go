@@ -0,0 +1,290 @@
+package kvs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	_ "github.com/lib/pq" // Анонимный импорт пакета драйвера
+)
+
+/**
+ * Postgres Transaction logger
+ */
+type PostgresDBParams struct {
+	dbName   string
+	host     string
+	user     string
+	password string
+	sslMode  string
+}
+
+type PostgresTransactionLogger struct {
+	eventQueue              // Очередь событий сопрограммы Run и её завершение
+	errors     <-chan error // Канал только для чтения; для приема ошибок
+	db         *sql.DB      // Интерфейс доступа к базе данных
+	wg         sync.WaitGroup
+
+	queueSize int // Событий в очереди
+
+	lastSequence uint64 // Последний записанный порядковый номер
+}
+
+func (l *PostgresTransactionLogger) Run() {
+	events := make(chan Event, l.queueSize) // Создать канал событий
+	l.events = events
+
+	errors := make(chan error, 1) // Создать канал ошибок
+	l.errors = errors
+
+	l.stopped = make(chan struct{})
+
+	l.wg.Add(1)
+
+	go func() {
+		defer l.wg.Done()
+		defer close(l.stopped)
+		defer close(errors) // Завершает наблюдателей Err
+
+		query := `INSERT INTO transactions
+			(event_type, key, value, revision)
+			VALUES ($1, $2, $3, $4)
+			RETURNING sequence`
+
+		for e := range events { // Извлечь следующее событие Event
+			if e.synced != nil { // Каждый INSERT уже зафиксирован
+				e.synced <- nil
+				continue
+			}
+
+			var sequence uint64
+
+			err := l.db.QueryRow( // Выполнить запрос INSERT
+				query,
+				e.EventType, []byte(e.Key), []byte(e.Value), e.Revision).Scan(&sequence)
+
+			if err != nil {
+				errors <- err
+				return
+			}
+
+			atomic.StoreUint64(&l.lastSequence, sequence)
+		}
+	}()
+}
+
+func (l *PostgresTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
+	outEvent := make(chan Event)    // Небуферизованный канал событий
+	outError := make(chan error, 1) // Буферизованный канал ошибок
+
+	go func() {
+		defer close(outEvent) // Закрыть каналы
+		defer close(outError) // по завершении сопрограммы
+
+		query := `SELECT sequence, event_type, key, value, revision FROM transactions
+			ORDER BY sequence`
+
+		rows, err := l.db.Query(query) // Выполнить запрос; получить набор результатов
+		if err != nil {
+			outError <- fmt.Errorf("sql query error: %w", err)
+			return
+		}
+
+		defer rows.Close() // Это важно!
+
+		e := Event{} // Создать пустой экземпляр Event
+		var key, value []byte
+
+		for rows.Next() { // Цикл по записям
+			err = rows.Scan( // Прочитать значения
+				&e.Sequence, &e.EventType, // из записи в Event.
+				&key, &value, &e.Revision)
+
+			if err != nil {
+				outError <- fmt.Errorf("error reading row: %w", err)
+				return
+			}
+
+			e.Key, e.Value = string(key), string(value)
+			atomic.StoreUint64(&l.lastSequence, e.Sequence)
+
+			outEvent <- e // Отправить e в канал
+		}
+
+		err = rows.Err()
+		if err != nil {
+			outError <- fmt.Errorf("transaction log read failure: %w", err)
+		}
+	}()
+
+	return outEvent, outError
+}
+
+func (l *PostgresTransactionLogger) WritePut(key, value string, revision uint64) error {
+	return l.send(Event{EventType: EventPut, Key: key, Value: value, Revision: revision})
+}
+
+func (l *PostgresTransactionLogger) WriteDelete(key string) error {
+	return l.send(Event{EventType: EventDelete, Key: key})
+}
+
+func (l *PostgresTransactionLogger) WriteExpire(key string, deadline time.Time) error {
+	return l.send(Event{EventType: EventExpire, Key: key, Value: strconv.FormatInt(deadline.UnixNano(), 10)})
+}
+
+func (l *PostgresTransactionLogger) WriteExpired(key string) error {
+	return l.send(Event{EventType: EventExpired, Key: key})
+}
+
+func (l *PostgresTransactionLogger) WriteTombstone(key string, until time.Time) error {
+	return l.send(Event{EventType: EventTombstone, Key: key, Value: strconv.FormatInt(until.UnixNano(), 10)})
+}
+
+func (l *PostgresTransactionLogger) WriteSchedule(key, op string, at time.Time) error {
+	return l.send(Event{EventType: EventSchedule, Key: key, Value: scheduleValue(op, at)})
+}
+
+func (l *PostgresTransactionLogger) WriteContentType(key, contentType string) error {
+	return l.send(Event{EventType: EventContentType, Key: key, Value: contentType})
+}
+
+func (l *PostgresTransactionLogger) WriteReadOnly(enabled bool) error {
+	return l.send(Event{EventType: EventReadOnly, Value: strconv.FormatBool(enabled)})
+}
+
+func (l *PostgresTransactionLogger) WriteTxn(ops []Event) error {
+	return l.send(Event{EventType: EventTxn, Value: encodeTxnEvents(ops)})
+}
+
+func (l *PostgresTransactionLogger) WriteIncrement(key, value string, revision uint64) error {
+	return l.send(Event{EventType: EventIncrement, Key: key, Value: value, Revision: revision})
+}
+
+// Sync blocks until every event written before the call is committed.
+func (l *PostgresTransactionLogger) Sync(ctx context.Context) error {
+	return l.syncEvents(ctx)
+}
+
+// Check reports whether the logger goroutine is running and the database
+// is reachable.
+func (l *PostgresTransactionLogger) Check() error {
+	select {
+	case <-l.stopped:
+		return ErrorLoggerStopped
+	default:
+	}
+
+	return l.db.Ping()
+}
+
+func (l *PostgresTransactionLogger) Err() <-chan error {
+	return l.errors
+}
+
+func (l *PostgresTransactionLogger) LastSequence() uint64 {
+	return atomic.LoadUint64(&l.lastSequence)
+}
+
+// Close stops accepting events, waits until the buffered ones are inserted
+// and closes the database handle.
+func (l *PostgresTransactionLogger) Close() error {
+	if l.events != nil {
+		l.closeEvents()
+	}
+
+	l.wg.Wait()
+
+	return l.db.Close()
+}
+
+func (l *PostgresTransactionLogger) createTableIfMissing() error {
+	query := `CREATE TABLE IF NOT EXISTS transactions (
+		sequence   BIGSERIAL PRIMARY KEY,
+		event_type SMALLINT NOT NULL,
+		key        BYTEA NOT NULL,
+		value      BYTEA NOT NULL DEFAULT '',
+		revision   BIGINT NOT NULL DEFAULT 0
+	)`
+
+	if _, err := l.db.Exec(query); err != nil {
+		return fmt.Errorf("failed to create transactions table: %w", err)
+	}
+
+	// Таблицы, созданные до появления версий ключей
+	query = `ALTER TABLE transactions
+		ADD COLUMN IF NOT EXISTS revision BIGINT NOT NULL DEFAULT 0`
+
+	if _, err := l.db.Exec(query); err != nil {
+		return fmt.Errorf("failed to add transactions.revision: %w", err)
+	}
+
+	return l.migrateTextColumns()
+}
+
+// migrateTextColumns converts key and value columns created as TEXT by
+// earlier versions to BYTEA so binary payloads are stored unchanged.
+func (l *PostgresTransactionLogger) migrateTextColumns() error {
+	for _, column := range []string{"key", "value"} {
+		var dataType string
+
+		err := l.db.QueryRow(`SELECT data_type FROM information_schema.columns
+			WHERE table_schema = current_schema() AND table_name = 'transactions'
+				AND column_name = $1`, column).Scan(&dataType)
+		if err != nil {
+			return fmt.Errorf("failed to inspect transactions table: %w", err)
+		}
+
+		if dataType != "text" {
+			continue
+		}
+
+		query := fmt.Sprintf(`ALTER TABLE transactions
+			ALTER COLUMN %[1]s DROP DEFAULT,
+			ALTER COLUMN %[1]s TYPE BYTEA USING convert_to(%[1]s, 'UTF8')`, column)
+
+		if _, err := l.db.Exec(query); err != nil {
+			return fmt.Errorf("failed to migrate transactions.%s to bytea: %w", column, err)
+		}
+	}
+
+	return nil
+}
+
+func NewPostgresTransactionLogger(config PostgresDBParams, o LogOptions) (TransactionLogger, error) {
+	connStr := fmt.Sprintf("host=%s dbname=%s user=%s password=%s sslmode=%s",
+		conninfoValue(config.host), conninfoValue(config.dbName), conninfoValue(config.user),
+		conninfoValue(config.password), conninfoValue(config.sslMode))
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open db: %w", err)
+	}
+
+	err = db.Ping() // Проверка соединения с базой данных
+	if err != nil {
+		return nil, fmt.Errorf("failed to open db connection: %w", err)
+	}
+
+	logger := &PostgresTransactionLogger{db: db, queueSize: o.QueueSize}
+
+	if err = logger.createTableIfMissing(); err != nil {
+		return nil, err
+	}
+
+	return logger, nil
+}
+
+// conninfoValue quotes v for a keyword=value connection string, so that
+// spaces, quotes and backslashes stay part of the value instead of ending
+// it or starting another parameter.
+func conninfoValue(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `'`, `\'`)
+
+	return "'" + v + "'"
+}
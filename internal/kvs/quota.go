@@ -0,0 +1,508 @@
+package kvs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * Bucket quotas.
+ *
+ * A bucket is a key prefix configured with a maximum number of keys and a
+ * maximum size (key plus value bytes), so that the teams sharing a server,
+ * each under its own prefixes, cannot take it over. QuotaStore wraps a
+ * Store, keeps the usage of every bucket, a key counting towards each
+ * bucket whose prefix starts it, and fails with ErrorQuotaExceeded the
+ * client writes that would take a bucket past a bound: puts, increments
+ * and appends, and batches and transactions as a whole. Deletes, restores,
+ * undeletes and the events replayed or replicated still apply, so a bucket
+ * can end up over its quota and then only accepts writes that do not grow
+ * it. The usage lives in memory and is counted from the content of the
+ * store when it is opened, as the indexes are.
+ *
+ * GET /v1/usage returns the usage and quota of the buckets, those the
+ * caller may read when ACLs are enabled.
+ */
+var ErrorQuotaExceeded = errors.New("Quota exceeded")
+
+type QuotaStore struct {
+	Store
+
+	mu      sync.Mutex // Упорядочивает записи с учётом использования
+	buckets []*quotaBucket
+	sizes   map[string]int64 // Ключи в корзинах -> байт ключа и значения
+}
+
+type quotaBucket struct {
+	prefix   string
+	maxKeys  int   // 0: без ограничения
+	maxBytes int64 // 0: без ограничения
+	keys     int
+	bytes    int64
+}
+
+// quotaGrowth is what a write adds to one bucket.
+type quotaGrowth struct {
+	keys  int
+	bytes int64
+}
+
+// bucketUsage is a bucket as reported by GET /v1/usage.
+type bucketUsage struct {
+	Prefix   string `json:"prefix"`
+	Keys     int    `json:"keys"`
+	Bytes    int64  `json:"bytes"`
+	MaxKeys  int    `json:"max_keys,omitempty"`
+	MaxBytes int64  `json:"max_bytes,omitempty"`
+}
+
+// NewQuotaStore bounds the buckets of quotas over s, starting from its
+// current content.
+func NewQuotaStore(s Store, quotas []string) (*QuotaStore, error) {
+	q := &QuotaStore{Store: s, sizes: make(map[string]int64)}
+
+	for _, entry := range quotas {
+		b, err := parseQuota(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		q.buckets = append(q.buckets, b)
+	}
+
+	entries, err := s.Snapshot(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		q.track(e.Key, e.Value)
+	}
+
+	return q, nil
+}
+
+// parseQuota parses a "prefix:max_keys:max_bytes" entry; the prefix may
+// itself hold colons, and a zero bound is not enforced.
+func parseQuota(entry string) (*quotaBucket, error) {
+	fields := strings.Split(entry, ":")
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("invalid quota %q", entry)
+	}
+
+	n := len(fields)
+	prefix := strings.Join(fields[:n-2], ":")
+
+	maxKeys, err := strconv.Atoi(fields[n-2])
+	if err != nil || maxKeys < 0 {
+		return nil, fmt.Errorf("invalid quota %q: bad max keys", entry)
+	}
+
+	maxBytes, err := strconv.ParseInt(fields[n-1], 10, 64)
+	if err != nil || maxBytes < 0 {
+		return nil, fmt.Errorf("invalid quota %q: bad max bytes", entry)
+	}
+
+	return &quotaBucket{prefix: prefix, maxKeys: maxKeys, maxBytes: maxBytes}, nil
+}
+
+// quotaStore returns the store that keeps the quotas, or nil without them.
+func quotaStore() *QuotaStore {
+	s := store
+	for {
+		switch d := s.(type) {
+		case *QuotaStore:
+			return d
+		case TracingStore:
+			s = d.Store
+		case *EvictingStore:
+			s = d.Store
+		case *UpstreamStore:
+			s = d.Store
+		case *MigratingStore:
+			s = d.Store
+		default:
+			return nil
+		}
+	}
+}
+
+// Usage returns the usage of the buckets.
+func (q *QuotaStore) Usage() []bucketUsage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	usage := make([]bucketUsage, len(q.buckets))
+	for i, b := range q.buckets {
+		usage[i] = bucketUsage{Prefix: b.prefix, Keys: b.keys, Bytes: b.bytes, MaxKeys: b.maxKeys, MaxBytes: b.maxBytes}
+	}
+
+	return usage
+}
+
+// grow adds to growth, one entry per bucket, what leaving key with size
+// key and value bytes adds; q.mu must be held.
+func (q *QuotaStore) grow(growth []quotaGrowth, key string, size int64) {
+	previous, exists := q.sizes[key]
+
+	for i, b := range q.buckets {
+		if !strings.HasPrefix(key, b.prefix) {
+			continue
+		}
+
+		if !exists {
+			growth[i].keys++
+		}
+
+		growth[i].bytes += size - previous
+	}
+}
+
+// putGrowth returns what writing value to key adds; q.mu must be held.
+func (q *QuotaStore) putGrowth(key, value string) []quotaGrowth {
+	growth := make([]quotaGrowth, len(q.buckets))
+	q.grow(growth, key, int64(len(key)+len(value)))
+
+	return growth
+}
+
+// opsGrowth returns what the puts of ops add; q.mu must be held.
+func (q *QuotaStore) opsGrowth(ops []BatchOp) []quotaGrowth {
+	growth := make([]quotaGrowth, len(q.buckets))
+	for _, op := range ops {
+		if op.Op == BatchPut {
+			q.grow(growth, op.Key, int64(len(op.Key)+len(op.Value)))
+		}
+	}
+
+	return growth
+}
+
+// admit fails with ErrorQuotaExceeded if growth takes a bucket past one
+// of its bounds; q.mu must be held.
+func (q *QuotaStore) admit(growth []quotaGrowth) error {
+	for i, b := range q.buckets {
+		g := growth[i]
+
+		if b.maxKeys > 0 && g.keys > 0 && b.keys+g.keys > b.maxKeys {
+			return fmt.Errorf("%w: bucket %q is limited to %d keys", ErrorQuotaExceeded, b.prefix, b.maxKeys)
+		}
+
+		if b.maxBytes > 0 && g.bytes > 0 && b.bytes+g.bytes > b.maxBytes {
+			return fmt.Errorf("%w: bucket %q is limited to %d bytes", ErrorQuotaExceeded, b.prefix, b.maxBytes)
+		}
+	}
+
+	return nil
+}
+
+func (q *QuotaStore) Put(ctx context.Context, key, value string) (uint64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := q.admit(q.putGrowth(key, value)); err != nil {
+		return 0, err
+	}
+
+	revision, err := q.Store.Put(ctx, key, value)
+	if err == nil {
+		q.track(key, value)
+	}
+
+	return revision, err
+}
+
+func (q *QuotaStore) CompareAndPut(ctx context.Context, key, value string, revision uint64) (uint64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := q.admit(q.putGrowth(key, value)); err != nil {
+		return 0, err
+	}
+
+	revision, err := q.Store.CompareAndPut(ctx, key, value, revision)
+	if err == nil {
+		q.track(key, value)
+	}
+
+	return revision, err
+}
+
+func (q *QuotaStore) Restore(ctx context.Context, key, value string, revision uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	err := q.Store.Restore(ctx, key, value, revision)
+	if err == nil {
+		q.track(key, value)
+	}
+
+	return err
+}
+
+func (q *QuotaStore) Increment(ctx context.Context, key string, by int64) (int64, uint64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	growth := make([]quotaGrowth, len(q.buckets))
+	if _, ok := q.sizes[key]; !ok { // Только новый ключ заметно занимает место
+		q.grow(growth, key, int64(len(key)+len(strconv.FormatInt(by, 10))))
+	}
+
+	if err := q.admit(growth); err != nil {
+		return 0, 0, err
+	}
+
+	value, revision, err := q.Store.Increment(ctx, key, by)
+	if err == nil {
+		q.track(key, strconv.FormatInt(value, 10))
+	}
+
+	return value, revision, err
+}
+
+func (q *QuotaStore) Append(ctx context.Context, key, suffix string, limit int64) (string, uint64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	size, ok := q.sizes[key]
+	if !ok {
+		size = int64(len(key))
+	}
+
+	growth := make([]quotaGrowth, len(q.buckets))
+	q.grow(growth, key, size+int64(len(suffix)))
+
+	if err := q.admit(growth); err != nil {
+		return "", 0, err
+	}
+
+	value, revision, err := q.Store.Append(ctx, key, suffix, limit)
+	if err == nil {
+		q.track(key, value)
+	}
+
+	return value, revision, err
+}
+
+func (q *QuotaStore) Update(ctx context.Context, key, value string, revision uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	err := q.Store.Update(ctx, key, value, revision)
+	if err == nil {
+		q.track(key, value)
+	}
+
+	return err
+}
+
+func (q *QuotaStore) Delete(ctx context.Context, key string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	err := q.Store.Delete(ctx, key)
+	if err == nil {
+		q.untrack(key)
+	}
+
+	return err
+}
+
+func (q *QuotaStore) DeleteMatching(ctx context.Context, match func(key string) bool) ([]string, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	removed, err := q.Store.DeleteMatching(ctx, match)
+	for _, key := range removed {
+		q.untrack(key)
+	}
+
+	return removed, err
+}
+
+func (q *QuotaStore) SoftDelete(ctx context.Context, key string, until time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	err := q.Store.SoftDelete(ctx, key, until)
+	if err == nil {
+		q.untrack(key)
+	}
+
+	return err
+}
+
+func (q *QuotaStore) Undelete(ctx context.Context, key string) (Entry, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entry, err := q.Store.Undelete(ctx, key)
+	if err == nil {
+		q.track(key, entry.Value)
+	}
+
+	return entry, err
+}
+
+func (q *QuotaStore) ReapExpired(ctx context.Context, now time.Time) []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	reaped := q.Store.ReapExpired(ctx, now)
+	for _, key := range reaped {
+		q.untrack(key)
+	}
+
+	return reaped
+}
+
+func (q *QuotaStore) Batch(ctx context.Context, ops []BatchOp) ([]BatchResult, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := q.admit(q.opsGrowth(ops)); err != nil {
+		return nil, err
+	}
+
+	results, err := q.Store.Batch(ctx, ops)
+	if err == nil {
+		q.trackResults(ops, results)
+	}
+
+	return results, err
+}
+
+func (q *QuotaStore) Txn(ctx context.Context, t Txn) (TxnResult, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := q.admit(q.opsGrowth(t.Success)); err != nil {
+		return TxnResult{}, err
+	}
+
+	if err := q.admit(q.opsGrowth(t.Failure)); err != nil {
+		return TxnResult{}, err
+	}
+
+	result, err := q.Store.Txn(ctx, t)
+	if err != nil {
+		return result, err
+	}
+
+	ops := t.Failure
+	if result.Succeeded {
+		ops = t.Success
+	}
+
+	q.trackResults(ops, result.Results)
+
+	return result, nil
+}
+
+// trackResults records the outcome of applied batch operations; q.mu must
+// be held.
+func (q *QuotaStore) trackResults(ops []BatchOp, results []BatchResult) {
+	for i, result := range results {
+		if !result.OK {
+			continue
+		}
+
+		switch result.Op {
+		case BatchPut:
+			q.track(result.Key, ops[i].Value)
+		case BatchDelete:
+			q.untrack(result.Key)
+		}
+	}
+}
+
+func (q *QuotaStore) ReplaceAll(ctx context.Context, entries []Entry) ([]string, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	removed, err := q.Store.ReplaceAll(ctx, entries)
+	if err != nil {
+		return nil, err
+	}
+
+	q.sizes = make(map[string]int64)
+	for _, b := range q.buckets {
+		b.keys, b.bytes = 0, 0
+	}
+
+	for _, e := range entries {
+		q.track(e.Key, e.Value)
+	}
+
+	return removed, nil
+}
+
+// track records a write of key to the buckets holding it; q.mu must be
+// held.
+func (q *QuotaStore) track(key, value string) {
+	size := int64(len(key) + len(value))
+	previous, exists := q.sizes[key]
+
+	tracked := false
+	for _, b := range q.buckets {
+		if !strings.HasPrefix(key, b.prefix) {
+			continue
+		}
+
+		if !exists {
+			b.keys++
+		}
+
+		b.bytes += size - previous
+		tracked = true
+	}
+
+	if tracked {
+		q.sizes[key] = size
+	}
+}
+
+// untrack forgets a removed key; q.mu must be held.
+func (q *QuotaStore) untrack(key string) {
+	size, ok := q.sizes[key]
+	if !ok {
+		return
+	}
+
+	for _, b := range q.buckets {
+		if strings.HasPrefix(key, b.prefix) {
+			b.keys--
+			b.bytes -= size
+		}
+	}
+
+	delete(q.sizes, key)
+}
+
+// usageHandler serves GET /v1/usage.
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	usage := []bucketUsage{}
+
+	if q := quotaStore(); q != nil {
+		p, _ := PrincipalFrom(r.Context())
+
+		for _, u := range q.Usage() {
+			if acl == nil || acl.allows(p, aclRead, u.Prefix) {
+				usage = append(usage, u)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Buckets []bucketUsage `json:"buckets"`
+	}{usage})
+}
@@ -0,0 +1,247 @@
+package kvs
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+ * Rate limiting.
+ *
+ * Requests are metered by token buckets: one shared by the whole server,
+ * one per client and, for endpoints listed in the configuration, one per
+ * client and endpoint. A client is its authenticated principal, or its IP
+ * address when authentication is disabled. A request that finds any of
+ * its buckets empty is rejected with 429 and a Retry-After header. The
+ * limits can be changed by a configuration reload; the buckets keep their
+ * tokens, up to the new bursts.
+ */
+const bucketIdleTimeout = 10 * time.Minute // Неиспользуемые корзины клиентов удаляются
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+type rateLimit struct {
+	rate  float64 // Токенов в секунду
+	burst float64
+}
+
+// refill adds the tokens earned since b was last used.
+func (l rateLimit) refill(b *bucket, now time.Time) {
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+	b.updated = now
+}
+
+// wait returns how long until b holds a whole token.
+func (l rateLimit) wait(b *bucket) time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+
+	return time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+var limiter *RateLimiter
+
+type RateLimiter struct {
+	limits atomic.Pointer[rateLimits]
+
+	mu      sync.Mutex
+	buckets map[string]*bucket // "" - общая корзина сервера
+	swept   time.Time
+}
+
+type rateLimits struct {
+	global    *rateLimit
+	client    *rateLimit
+	endpoints map[string]rateLimit // Шаблон пути -> ограничение
+}
+
+// newRateLimiter builds a RateLimiter from c. With no limit configured it
+// lets every request through until a reload sets some.
+func newRateLimiter(c RateLimitConfig) (*RateLimiter, error) {
+	limits, err := newRateLimits(c)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &RateLimiter{buckets: make(map[string]*bucket), swept: time.Now()}
+	l.limits.Store(limits)
+
+	return l, nil
+}
+
+func newRateLimits(c RateLimitConfig) (*rateLimits, error) {
+	limits := &rateLimits{
+		global:    newRateLimit(c.GlobalRate, c.GlobalBurst),
+		client:    newRateLimit(c.ClientRate, c.ClientBurst),
+		endpoints: make(map[string]rateLimit),
+	}
+
+	for _, entry := range c.Endpoints {
+		path, limit, err := parseEndpointLimit(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		limits.endpoints[path] = limit
+	}
+
+	return limits, nil
+}
+
+// empty reports whether no limit is set.
+func (limits *rateLimits) empty() bool {
+	return limits.global == nil && limits.client == nil && len(limits.endpoints) == 0
+}
+
+// newRateLimit returns nil for a zero rate. A zero burst defaults to one
+// second's worth of tokens.
+func newRateLimit(rate float64, burst int) *rateLimit {
+	if rate <= 0 {
+		return nil
+	}
+
+	if burst < 1 {
+		burst = int(math.Ceil(rate))
+	}
+
+	return &rateLimit{rate: rate, burst: float64(burst)}
+}
+
+// parseEndpointLimit parses a "path:rate:burst" entry, path being a route
+// template such as /v1/key/{key}.
+func parseEndpointLimit(entry string) (string, rateLimit, error) {
+	fields := strings.Split(entry, ":")
+	if len(fields) != 3 || !strings.HasPrefix(fields[0], "/") {
+		return "", rateLimit{}, fmt.Errorf("invalid endpoint rate limit %q", entry)
+	}
+
+	rate, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || rate <= 0 {
+		return "", rateLimit{}, fmt.Errorf("invalid endpoint rate limit %q: bad rate", entry)
+	}
+
+	burst, err := strconv.Atoi(fields[2])
+	if err != nil || burst < 0 {
+		return "", rateLimit{}, fmt.Errorf("invalid endpoint rate limit %q: bad burst", entry)
+	}
+
+	return fields[0], *newRateLimit(rate, burst), nil
+}
+
+// allow takes a token from every bucket the request is metered by. It
+// takes none unless all of them have one, and otherwise returns the
+// longest wait.
+func (l *RateLimiter) allow(client, endpoint string, now time.Time) (time.Duration, bool) {
+	type metered struct {
+		limit rateLimit
+		key   string
+	}
+
+	limits := l.limits.Load()
+
+	var checks []metered
+	if limits.global != nil {
+		checks = append(checks, metered{*limits.global, ""})
+	}
+	if limits.client != nil {
+		checks = append(checks, metered{*limits.client, "c\x00" + client})
+	}
+	if limit, ok := limits.endpoints[endpoint]; ok {
+		checks = append(checks, metered{limit, "e\x00" + endpoint + "\x00" + client})
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.swept) > bucketIdleTimeout {
+		l.sweep(now)
+	}
+
+	var wait time.Duration
+	buckets := make([]*bucket, len(checks))
+
+	for i, c := range checks {
+		b, ok := l.buckets[c.key]
+		if !ok {
+			b = &bucket{tokens: c.limit.burst, updated: now}
+			l.buckets[c.key] = b
+		}
+
+		c.limit.refill(b, now)
+		if w := c.limit.wait(b); w > wait {
+			wait = w
+		}
+
+		buckets[i] = b
+	}
+
+	if wait > 0 {
+		return wait, false
+	}
+
+	for _, b := range buckets {
+		b.tokens--
+	}
+
+	return 0, true
+}
+
+// sweep drops client buckets that have not been used for a while; they
+// would be full again anyway. The caller must hold l.mu.
+func (l *RateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if key != "" && now.Sub(b.updated) > bucketIdleTimeout {
+			delete(l.buckets, key)
+		}
+	}
+
+	l.swept = now
+}
+
+// clientID identifies the caller by principal or, failing that, by IP.
+func clientID(r *http.Request) string {
+	if p, ok := PrincipalFrom(r.Context()); ok {
+		return "principal:" + p.Name
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return "ip:" + host
+}
+
+func (l *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.limits.Load().empty() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var endpoint string
+		if route := currentRoute(r); route != nil {
+			endpoint = route.template
+		}
+
+		wait, ok := l.allow(clientID(r), endpoint, time.Now())
+		if !ok {
+			w.Header().Set("Retry-After", strconv.FormatInt(ttlSeconds(wait), 10))
+			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,118 @@
+package kvs
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+/**
+ * Renaming and copying keys.
+ *
+ * POST /v1/key/{key}/rename?to={dst} moves the value of a key to another
+ * key and POST /v1/key/{key}/copy?to={dst} copies it there, replacing the
+ * value dst may have. Each runs as one transaction guarded by the
+ * revision of the source, so no other write comes between the read of
+ * the value and its move, and is logged as one EventTxn. A source written
+ * meanwhile is read again and the transaction retried.
+ *
+ * As with the writes of a transaction, dst gets the value alone: neither
+ * the content type nor the deadline of the source, and a renamed source
+ * is removed outright, without a tombstone.
+ */
+var ErrorSameKey = errors.New("Source and destination are the same key")
+
+// moveKey writes the value of src to dst and, if remove is set, deletes
+// src, under the revision of src it read. It returns the revision of dst.
+func moveKey(ctx context.Context, src, dst string, remove bool) (uint64, error) {
+	for {
+		entry, err := verifiedEntry(ctx, src)
+		if err != nil {
+			return 0, err
+		}
+
+		ops := []BatchOp{{Op: BatchPut, Key: dst, Value: entry.Value}}
+		if remove {
+			ops = append(ops, BatchOp{Op: BatchDelete, Key: src})
+		}
+
+		t := Txn{
+			Compare: []TxnCompare{{Key: src, Target: "revision", Result: "=", Revision: entry.Revision}},
+			Success: ops,
+		}
+
+		result, err := store.Txn(loggedOps(ctx), t)
+		if err != nil {
+			return 0, err
+		}
+
+		if result.Succeeded {
+			recordTxn(ops, result.Results)
+			return result.Results[0].Revision, nil
+		}
+		// Источник изменён после чтения: прочитать заново
+	}
+}
+
+// keyRenameHandler serves POST /v1/key/{key}/rename?to={dst}.
+func keyRenameHandler(w http.ResponseWriter, r *http.Request) {
+	moveKeyHandler(w, r, true)
+}
+
+// keyCopyHandler serves POST /v1/key/{key}/copy?to={dst}.
+func keyCopyHandler(w http.ResponseWriter, r *http.Request) {
+	moveKeyHandler(w, r, false)
+}
+
+// moveKeyHandler renames the key of the request to ?to= if remove is set,
+// and copies it there otherwise. It answers 201 with the revision of the
+// destination in ETag.
+func moveKeyHandler(w http.ResponseWriter, r *http.Request, remove bool) {
+	src, dst := pathVars(r)["key"], destinationKey(r)
+
+	if err := validateKey(dst); err != nil {
+		keyError(w, err)
+		return
+	}
+
+	if src == dst {
+		http.Error(w, ErrorSameKey.Error(), http.StatusBadRequest)
+		return
+	}
+
+	durable, err := syncWrite(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if misdirected(w, src, dst) {
+		return
+	}
+
+	revision, err := moveKey(r.Context(), src, dst, remove)
+	if errors.Is(err, ErrorNoSuchKey) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	if durable {
+		if err := logger.Sync(r.Context()); err != nil {
+			serverError(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("ETag", formatETag(revision))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// destinationKey returns the normalized ?to= key of a rename or copy.
+func destinationKey(r *http.Request) string {
+	return normalizeKey(r.URL.Query().Get("to"))
+}
@@ -0,0 +1,65 @@
+package kvs
+
+import (
+	"log/slog"
+	"math"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/**
+ * Replay progress.
+ *
+ * While the transaction log is replayed at startup, the server logs every
+ * replayProgressInterval how many events it has applied and, with loggers
+ * implementing ReplayReporter, how much of the log that is and how long
+ * the rest should take at the rate so far. /v1/stats reports the time it
+ * took from start to ready. With serve_during_replay set, reads of keys
+ * are served during replay from the store as far as it has been rebuilt,
+ * marked with X-Replay-In-Progress; every other request still waits.
+ */
+const replayProgressInterval = 5 * time.Second
+
+// ReplayReporter is implemented by transaction loggers that can tell how
+// much of their log ReadEvents has read.
+type ReplayReporter interface {
+	ReplayProgress() (read, total int64) // В байтах
+}
+
+var replayedEvents atomic.Uint64
+
+var startupDuration atomic.Int64 // От запуска до готовности; 0, пока сервер не готов
+
+// logReplayProgress logs how far replay has got since started, with the
+// number of events read.
+func logReplayProgress(l TransactionLogger, events uint64, started, now time.Time) {
+	elapsed := now.Sub(started)
+	attrs := []any{"events", events, "elapsed", elapsed.Round(time.Second).String()}
+
+	if r, ok := unwrapLogger(l).(ReplayReporter); ok {
+		if read, total := r.ReplayProgress(); read > 0 && total > 0 {
+			eta := time.Duration(float64(elapsed) * float64(total-read) / float64(read))
+			attrs = append(attrs, "percent", math.Round(float64(read)*1000/float64(total))/10, "eta", eta.Round(time.Second).String())
+		}
+	}
+
+	slog.Info("replaying transaction log", attrs...)
+}
+
+// replayReadable reports whether r only reads keys, and so may be served
+// from the store while it is still being rebuilt.
+func replayReadable(r *http.Request) bool {
+	if requiredPermission(r) != PermRead {
+		return false
+	}
+
+	return strings.HasPrefix(r.URL.Path, "/v1/key/") || strings.HasPrefix(r.URL.Path, "/v2/key/") || r.URL.Path == "/v1/keys" || r.URL.Path == "/v1/range" || strings.HasPrefix(r.URL.Path, "/v1/index/") || r.URL.Path == "/v1/mget"
+}
+
+// ReplayProgress returns how many bytes of the log and its segments
+// ReadEvents has read, and their size when it started.
+func (l *FileTransactionLogger) ReplayProgress() (read, total int64) {
+	return l.replayed.Load(), l.replaySize
+}
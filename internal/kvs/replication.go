@@ -0,0 +1,558 @@
+package kvs
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * Asynchronous replication.
+ *
+ * Every server keeps the events it logs in a ReplicationFeed, numbered
+ * from 1 within an epoch that changes on restart. A replica started with
+ * -replicate-from loads GET /v1/snapshot from its primary, whose
+ * X-Replication-Epoch and X-Replication-Sequence headers give the feed
+ * position the snapshot reflects, then tails GET /v1/replication from
+ * there as JSON Lines. It applies and logs every event as its own, so it
+ * can be promoted by restarting it without -replicate-from, and serves
+ * reads while rejecting writes. When the primary no longer holds the
+ * events a replica needs, it answers 410 Gone and the replica loads a new
+ * snapshot. Watch streams are fed by writes only, so they belong on the
+ * primary.
+ */
+const (
+	replicationHeartbeat = time.Second     // Пульс потока, по нему реплика видит положение первичного
+	replicationRetry     = 2 * time.Second // Пауза перед повторным подключением
+)
+
+var ErrorReplica = errors.New("Server is a read-only replica")
+
+var errReplicationGone = errors.New("replication position no longer available")
+
+var feed *ReplicationFeed
+
+// replica is nil unless this server replicates another.
+var replica *Replica
+
+type feedEvent struct {
+	sequence uint64
+	event    Event
+}
+
+// ReplicationFeed keeps the most recent logged events for replicas.
+type ReplicationFeed struct {
+	mu     sync.Mutex
+	epoch  string
+	size   int
+	base   uint64        // Последний порядковый номер журнала до первого события
+	events []feedEvent   // Не меньше size последних событий, от старых к новым
+	last   uint64        // Номер последнего события
+	notify chan struct{} // Закрывается и заменяется при каждом событии
+	closed bool
+}
+
+// NewReplicationFeed returns a feed of the events logged after the given
+// log sequence number.
+func NewReplicationFeed(size int, base uint64) *ReplicationFeed {
+	var b [8]byte
+	crand.Read(b[:])
+
+	return &ReplicationFeed{epoch: hex.EncodeToString(b[:]), size: size, base: base, notify: make(chan struct{})}
+}
+
+// add must be called with f.mu held.
+func (f *ReplicationFeed) add(e Event) {
+	f.last++
+	f.events = append(f.events, feedEvent{f.last, e})
+
+	if len(f.events) >= 2*f.size {
+		f.events = append([]feedEvent(nil), f.events[len(f.events)-f.size:]...)
+	}
+
+	if !f.closed {
+		close(f.notify)
+		f.notify = make(chan struct{})
+	}
+}
+
+// Close ends the replication streams; it is safe on a nil feed.
+func (f *ReplicationFeed) Close() {
+	if f == nil {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.closed {
+		f.closed = true
+		close(f.notify)
+	}
+}
+
+// position returns the epoch and the sequence of the last event.
+func (f *ReplicationFeed) position() (string, uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.epoch, f.last
+}
+
+// since returns the events after the given sequence and a channel closed
+// when another arrives. ok is false if some of them have been dropped or
+// the feed is closed.
+func (f *ReplicationFeed) since(after uint64) (events []feedEvent, head uint64, notify <-chan struct{}, ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	first := f.last + 1
+	if len(f.events) > 0 {
+		first = f.events[0].sequence
+	}
+
+	if f.closed || after > f.last || after+1 < first {
+		return nil, f.last, nil, false
+	}
+
+	return f.events[len(f.events)-int(f.last-after):], f.last, f.notify, true
+}
+
+// wrap returns a logger that adds what it writes to f. Writes go to
+// logger under the feed lock, so the feed has the order of the log.
+func (f *ReplicationFeed) wrap(logger TransactionLogger) TransactionLogger {
+	return &feedLogger{TransactionLogger: logger, feed: f}
+}
+
+// feedLogger is the transaction logger decorator returned by wrap.
+type feedLogger struct {
+	TransactionLogger
+	feed *ReplicationFeed
+}
+
+// unwrapLogger returns the logger behind the feed and the migration, for
+// the optional interfaces of the backends.
+func unwrapLogger(l TransactionLogger) TransactionLogger {
+	for {
+		switch d := l.(type) {
+		case *feedLogger:
+			l = d.TransactionLogger
+		case *migrationLogger:
+			l = d.TransactionLogger
+		default:
+			return l
+		}
+	}
+}
+
+func (l *feedLogger) record(e Event, write func() error) error {
+	l.feed.mu.Lock()
+	defer l.feed.mu.Unlock()
+
+	if err := write(); err != nil {
+		return err // Реплики не получают событий, которых нет в журнале
+	}
+
+	l.feed.add(e)
+	return nil
+}
+
+func (l *feedLogger) WritePut(key, value string, revision uint64) error {
+	return l.record(Event{EventType: EventPut, Key: key, Value: value, Revision: revision}, func() error {
+		return l.TransactionLogger.WritePut(key, value, revision)
+	})
+}
+
+func (l *feedLogger) WriteDelete(key string) error {
+	return l.record(Event{EventType: EventDelete, Key: key}, func() error {
+		return l.TransactionLogger.WriteDelete(key)
+	})
+}
+
+func (l *feedLogger) WriteExpire(key string, deadline time.Time) error {
+	return l.record(Event{EventType: EventExpire, Key: key, Value: strconv.FormatInt(deadline.UnixNano(), 10)}, func() error {
+		return l.TransactionLogger.WriteExpire(key, deadline)
+	})
+}
+
+func (l *feedLogger) WriteExpired(key string) error {
+	return l.record(Event{EventType: EventExpired, Key: key}, func() error {
+		return l.TransactionLogger.WriteExpired(key)
+	})
+}
+
+func (l *feedLogger) WriteTombstone(key string, until time.Time) error {
+	return l.record(Event{EventType: EventTombstone, Key: key, Value: strconv.FormatInt(until.UnixNano(), 10)}, func() error {
+		return l.TransactionLogger.WriteTombstone(key, until)
+	})
+}
+
+func (l *feedLogger) WriteSchedule(key, op string, at time.Time) error {
+	return l.record(Event{EventType: EventSchedule, Key: key, Value: scheduleValue(op, at)}, func() error {
+		return l.TransactionLogger.WriteSchedule(key, op, at)
+	})
+}
+
+func (l *feedLogger) WriteContentType(key, contentType string) error {
+	return l.record(Event{EventType: EventContentType, Key: key, Value: contentType}, func() error {
+		return l.TransactionLogger.WriteContentType(key, contentType)
+	})
+}
+
+func (l *feedLogger) WriteReadOnly(enabled bool) error {
+	return l.record(Event{EventType: EventReadOnly, Value: strconv.FormatBool(enabled)}, func() error {
+		return l.TransactionLogger.WriteReadOnly(enabled)
+	})
+}
+
+func (l *feedLogger) WriteTxn(ops []Event) error {
+	return l.record(Event{EventType: EventTxn, Value: encodeTxnEvents(ops)}, func() error {
+		return l.TransactionLogger.WriteTxn(ops)
+	})
+}
+
+func (l *feedLogger) WriteIncrement(key, value string, revision uint64) error {
+	return l.record(Event{EventType: EventIncrement, Key: key, Value: value, Revision: revision}, func() error {
+		return l.TransactionLogger.WriteIncrement(key, value, revision)
+	})
+}
+
+// replicationMessage is one line of the replication stream: an event, or
+// a heartbeat without one.
+type replicationMessage struct {
+	Sequence uint64    `json:"sequence,omitempty"`
+	Head     uint64    `json:"head"` // Последнее событие первичного сервера
+	Type     EventType `json:"type,omitempty"`
+	Key      []byte    `json:"key,omitempty"`
+	Value    []byte    `json:"value,omitempty"`
+	Revision uint64    `json:"revision,omitempty"`
+}
+
+// replicationHandler serves GET /v1/replication?epoch=E&after=N, streaming
+// the events of the feed after N until the client disconnects or falls
+// too far behind.
+func replicationHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	after, err := strconv.ParseUint(query.Get("after"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid after", http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	if epoch, _ := feed.position(); query.Get("epoch") != epoch {
+		http.Error(w, errReplicationGone.Error(), http.StatusGone)
+		return
+	}
+
+	events, head, notify, ok := feed.since(after)
+	if !ok {
+		http.Error(w, errReplicationGone.Error(), http.StatusGone)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(w)
+
+	heartbeat := time.NewTicker(replicationHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		for _, fe := range events {
+			e := fe.event
+			err := encoder.Encode(replicationMessage{
+				Sequence: fe.sequence, Head: head,
+				Type: e.EventType, Key: []byte(e.Key), Value: []byte(e.Value), Revision: e.Revision,
+			})
+			if err != nil {
+				return
+			}
+			after = fe.sequence
+		}
+		flusher.Flush()
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			_, head = feed.position()
+			if err := encoder.Encode(replicationMessage{Head: head}); err != nil {
+				return
+			}
+		case <-notify:
+		}
+
+		if events, head, notify, ok = feed.since(after); !ok {
+			return // Реплика отстала, при переподключении получит 410
+		}
+	}
+}
+
+// Replica follows a primary server.
+type Replica struct {
+	primary string
+	apiKey  string
+	client  *http.Client
+
+	mu        sync.Mutex
+	epoch     string // Пусто, пока не загружен снимок
+	sequence  uint64 // Последнее применённое событие первичного сервера
+	head      uint64 // Последнее событие первичного сервера, о котором известно
+	connected bool
+	synced    bool          // Первый снимок загружен
+	caughtUp  time.Time     // Когда реплика последний раз догнала первичный сервер
+	advanced  chan struct{} // Закрывается и заменяется при каждом применённом событии
+}
+
+type replicationStats struct {
+	Primary    string  `json:"primary"`
+	Connected  bool    `json:"connected"`
+	Sequence   uint64  `json:"sequence"`
+	LagEvents  uint64  `json:"lag_events"`
+	LagSeconds float64 `json:"lag_seconds"` // С момента, когда реплика последний раз догнала первичный сервер
+}
+
+func NewReplica(c ReplicationConfig) *Replica {
+	return &Replica{primary: strings.TrimSuffix(c.Primary, "/"), apiKey: c.APIKey, client: &http.Client{}, advanced: make(chan struct{})}
+}
+
+// run replicates until ctx is done, reconnecting after failures.
+func (r *Replica) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		r.mu.Lock()
+		epoch := r.epoch
+		r.mu.Unlock()
+
+		var err error
+		if epoch == "" {
+			err = r.sync(ctx)
+		}
+
+		if err == nil {
+			err = r.follow(ctx)
+		}
+
+		r.mu.Lock()
+		r.connected = false
+		r.mu.Unlock()
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if errors.Is(err, errReplicationGone) {
+			slog.Info("replication position lost, loading a new snapshot", "primary", r.primary)
+
+			r.mu.Lock()
+			r.epoch = ""
+			r.mu.Unlock()
+			continue
+		}
+
+		slog.Warn("replication interrupted, will retry", "primary", r.primary, "error", err)
+
+		select {
+		case <-time.After(replicationRetry):
+		case <-ctx.Done():
+		}
+	}
+}
+
+func (r *Replica) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.primary+path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+r.apiKey)
+	}
+
+	return r.client.Do(req)
+}
+
+// sync replaces the store with a snapshot of the primary.
+func (r *Replica) sync(ctx context.Context) error {
+	resp, err := r.get(ctx, "/v1/replication/snapshot")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("snapshot request failed: %s", resp.Status)
+	}
+
+	epoch := resp.Header.Get("X-Replication-Epoch")
+	sequence, err := strconv.ParseUint(resp.Header.Get("X-Replication-Sequence"), 10, 64)
+	if epoch == "" || err != nil {
+		return fmt.Errorf("snapshot has no replication position")
+	}
+
+	_, entries, err := readSnapshot(resp.Body, sealer)
+	if err != nil {
+		return err
+	}
+
+	removed, err := store.ReplaceAll(loggedReplace(ctx), entries)
+	if err != nil {
+		return err
+	}
+
+	recordReplaceAll(removed, entries)
+
+	r.mu.Lock()
+	r.advance(epoch, sequence)
+	r.head = sequence
+	r.synced, r.caughtUp = true, time.Now()
+	r.mu.Unlock()
+
+	slog.Info("loaded snapshot from primary", "primary", r.primary, "keys", len(entries), "sequence", sequence)
+
+	return nil
+}
+
+// follow applies the primary's events until the stream ends.
+func (r *Replica) follow(ctx context.Context) error {
+	r.mu.Lock()
+	path := fmt.Sprintf("/v1/replication?epoch=%s&after=%d", r.epoch, r.sequence)
+	r.mu.Unlock()
+
+	resp, err := r.get(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusGone:
+		return errReplicationGone
+	default:
+		return fmt.Errorf("replication request failed: %s", resp.Status)
+	}
+
+	r.mu.Lock()
+	r.connected = true
+	r.mu.Unlock()
+
+	decoder := json.NewDecoder(resp.Body)
+
+	for {
+		var m replicationMessage
+		if err := decoder.Decode(&m); err != nil {
+			return err
+		}
+
+		if m.Sequence != 0 {
+			e := Event{EventType: m.Type, Key: string(m.Key), Value: string(m.Value), Revision: m.Revision}
+			if err := applyEvent(ctx, e); err != nil {
+				return fmt.Errorf("failed to apply event %d: %w", m.Sequence, err)
+			}
+
+			if err := logEvent(e); err != nil {
+				return fmt.Errorf("failed to log event %d: %w", m.Sequence, err)
+			}
+		}
+
+		r.mu.Lock()
+		if m.Sequence != 0 {
+			r.advance(r.epoch, m.Sequence)
+		}
+		r.head = m.Head
+		if r.sequence >= r.head {
+			r.caughtUp = time.Now()
+		}
+		r.mu.Unlock()
+	}
+}
+
+func (r *Replica) stats() replicationStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := replicationStats{Primary: r.primary, Connected: r.connected, Sequence: r.sequence}
+
+	if r.head > r.sequence {
+		stats.LagEvents = r.head - r.sequence
+	}
+
+	if !r.connected || stats.LagEvents > 0 {
+		stats.LagSeconds = time.Since(r.caughtUp).Seconds()
+	}
+
+	return stats
+}
+
+func (r *Replica) isSynced() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.synced
+}
+
+// logEvent records an event received from the primary in the local
+// transaction log.
+func logEvent(e Event) error {
+	switch e.EventType {
+	case EventPut:
+		return logger.WritePut(e.Key, e.Value, e.Revision)
+	case EventDelete:
+		return logger.WriteDelete(e.Key)
+	case EventIncrement:
+		return logger.WriteIncrement(e.Key, e.Value, e.Revision)
+	case EventContentType:
+		return logger.WriteContentType(e.Key, e.Value)
+	case EventExpire:
+		nanos, err := strconv.ParseInt(e.Value, 10, 64)
+		if err != nil {
+			return err
+		}
+		return logger.WriteExpire(e.Key, time.Unix(0, nanos))
+	case EventExpired:
+		return logger.WriteExpired(e.Key)
+	case EventTombstone:
+		nanos, err := strconv.ParseInt(e.Value, 10, 64)
+		if err != nil {
+			return err
+		}
+		return logger.WriteTombstone(e.Key, time.Unix(0, nanos))
+	case EventSchedule:
+		op, at, err := parseScheduleValue(e.Value)
+		if err != nil {
+			return err
+		}
+		return logger.WriteSchedule(e.Key, op, at)
+	case EventReadOnly:
+		enabled, err := strconv.ParseBool(e.Value)
+		if err != nil {
+			return err
+		}
+		return logger.WriteReadOnly(enabled)
+	case EventTxn:
+		ops, err := decodeTxnEvents(e.Value)
+		if err != nil {
+			return err
+		}
+		return logger.WriteTxn(ops)
+	default:
+		return fmt.Errorf("unexpected event type %d", e.EventType)
+	}
+}
@@ -0,0 +1,674 @@
+package kvs
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * Redis protocol (RESP) listener.
+ *
+ * A subset of Redis commands is served on a second listener so that
+ * redis-cli and existing Redis clients can use the store unchanged:
+ * PING, ECHO, AUTH, GET, SET (with EX/PX), DEL, INCR, DECR, INCRBY,
+ * DECRBY, EXISTS, KEYS, TTL, PTTL, COMMAND and QUIT. Writes go through the same store, transaction log and
+ * watch broker as the HTTP API. When authentication is configured,
+ * clients must AUTH with an API key or JWT first.
+ */
+var ErrorProtocol = errors.New("Protocol error")
+
+const (
+	respMaxArgs   = 1024 * 1024 // Как proto-max-multibulk-len в Redis
+	respPageLimit = 1000        // Размер страницы List для KEYS
+)
+
+type respCommand struct {
+	arity   int // Число аргументов с именем команды; отрицательное - минимум
+	write   bool
+	keys    int // Аргументов-ключей после имени; -1 - все
+	handler func(ctx context.Context, c *respConn, args []string)
+}
+
+var respCommands = map[string]respCommand{
+	"PING":    {-1, false, 0, respPing},
+	"ECHO":    {2, false, 0, respEcho},
+	"AUTH":    {-2, false, 0, respAuth},
+	"QUIT":    {1, false, 0, respQuit},
+	"COMMAND": {-1, false, 0, respCommandInfo},
+	"GET":     {2, false, 1, respGet},
+	"SET":     {-3, true, 1, respSet},
+	"DEL":     {-2, true, -1, respDel},
+	"INCR":    {2, true, 1, respIncr},
+	"DECR":    {2, true, 1, respIncr},
+	"INCRBY":  {3, true, 1, respIncr},
+	"DECRBY":  {3, true, 1, respIncr},
+	"EXISTS":  {-2, false, -1, respExists},
+	"KEYS":    {2, false, 0, respKeys},
+	"TTL":     {2, false, 1, respTTL},
+	"PTTL":    {2, false, 1, respPTTL},
+}
+
+type RESPServer struct {
+	auth     *Authenticator
+	listener net.Listener
+	ctx      context.Context // Отменяется при закрытии сервера
+	cancel   context.CancelFunc
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// ListenRESP starts serving the Redis protocol on addr, over TLS when
+// tlsConfig is not nil.
+func ListenRESP(addr string, tlsConfig *tls.Config, auth *Authenticator) (*RESPServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for RESP: %w", err)
+	}
+
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &RESPServer{auth: auth, listener: listener, ctx: ctx, cancel: cancel, conns: make(map[net.Conn]struct{})}
+
+	s.wg.Add(1)
+	go s.serve()
+
+	return s, nil
+}
+
+func (s *RESPServer) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+
+			if !closed {
+				slog.Error("resp accept failed", "error", err)
+			}
+			return
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go s.handle(conn)
+	}
+}
+
+// Close stops accepting connections, closes the open ones and waits for
+// their commands to finish.
+func (s *RESPServer) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.cancel()
+	err := s.listener.Close()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+
+	return err
+}
+
+type respConn struct {
+	server    *RESPServer
+	r         *bufio.Reader
+	w         *bufio.Writer
+	remote    string
+	principal Principal
+	authed    bool
+	failed    bool // Последняя команда ответила ошибкой
+	quit      bool
+}
+
+func (s *RESPServer) handle(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+
+		conn.Close()
+		s.wg.Done()
+	}()
+
+	c := &respConn{
+		server:    s,
+		r:         bufio.NewReader(conn),
+		w:         bufio.NewWriter(conn),
+		remote:    conn.RemoteAddr().String(),
+		principal: Principal{Permission: PermReadWrite},
+		authed:    s.auth == nil,
+	}
+
+	for !c.quit {
+		args, err := readRESPCommand(c.r)
+		if errors.Is(err, ErrorProtocol) {
+			c.writeError("ERR " + err.Error())
+			c.w.Flush()
+			return
+		}
+
+		if err != nil {
+			return
+		}
+
+		if len(args) > 0 {
+			s.dispatch(c, args)
+		}
+
+		// Ответы на конвейер команд отправляются одним пакетом.
+		if c.r.Buffered() == 0 {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+
+	c.w.Flush()
+}
+
+func (s *RESPServer) dispatch(c *respConn, args []string) {
+	name := strings.ToUpper(args[0])
+
+	cmd, ok := respCommands[name]
+	if !ok {
+		c.writeError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return
+	}
+
+	if (cmd.arity > 0 && len(args) != cmd.arity) || len(args) < -cmd.arity {
+		c.writeError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return
+	}
+
+	if !c.authed && name != "AUTH" && name != "PING" && name != "QUIT" {
+		c.writeError("NOAUTH Authentication required.")
+		return
+	}
+
+	normalizeKeys(commandKeys(cmd, args)) // На месте: до проверок прав и владельца
+
+	if cmd.write && audit != nil {
+		c.failed = false
+		defer func() { audit.recordRESP(c, name, commandKeys(cmd, args), !c.failed) }()
+	}
+
+	if cmd.write && c.principal.Permission < PermReadWrite {
+		c.writeError("NOPERM " + ErrorForbidden.Error())
+		return
+	}
+
+	if acl != nil {
+		for _, check := range respChecks(name, cmd, args) {
+			if !acl.allows(c.principal, check.permission, check.prefix) {
+				c.writeError(fmt.Sprintf("NOPERM %s on %q", ErrorForbidden.Error(), check.prefix))
+				return
+			}
+		}
+	}
+
+	if cmd.keys != 0 {
+		if owner, ok := foreignOwner(commandKeys(cmd, args)...); ok {
+			c.writeError(fmt.Sprintf("MOVED %s %s", owner.ID, owner.URL)) // Как MOVED Redis Cluster, но с ID и URL узла
+			return
+		}
+	}
+
+	if err := writesRefused(); cmd.write && err != nil {
+		c.writeError("READONLY " + err.Error())
+		return
+	}
+
+	ctx, cancel := s.ctx, context.CancelFunc(func() {})
+	if config.RequestTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, config.RequestTimeout)
+	}
+	defer cancel()
+
+	ctx, timer := slowLog.Start(ctx)
+	defer func() {
+		var key string
+		if keys := commandKeys(cmd, args); len(keys) > 0 {
+			key = keys[0]
+		}
+
+		slowLog.Finish(timer, slowRequest{Operation: "RESP " + name, Key: key})
+	}()
+
+	if cmd.write {
+		release, err := admitWrite(ctx)
+		if err != nil {
+			c.writeError("ERR " + err.Error())
+			return
+		}
+		defer release()
+	}
+
+	ctx, span := tracer.StartRequest(ctx, "RESP "+name, "")
+	cmd.handler(ctx, c, args)
+	span.End(nil)
+}
+
+// commandKeys returns the keys named by the arguments of a command.
+func commandKeys(cmd respCommand, args []string) []string {
+	if cmd.keys > 0 {
+		return args[1 : 1+cmd.keys]
+	}
+
+	if cmd.keys < 0 {
+		return args[1:]
+	}
+
+	return nil
+}
+
+/**
+ * RESP parser and serializer.
+ */
+
+// readRESPCommand reads one command, either as an array of bulk strings
+// or as an inline command line.
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readRESPLine(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) == 0 || line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > respMaxArgs {
+		return nil, fmt.Errorf("%w: invalid multibulk length", ErrorProtocol)
+	}
+
+	args := make([]string, 0, n)
+
+	for i := 0; i < n; i++ {
+		line, err := readRESPLine(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("%w: expected '$', got '%.1s'", ErrorProtocol, line)
+		}
+
+		size, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil || size < 0 || size > config.Limits.MaxValueBytes+int64(config.Limits.MaxKeyBytes) {
+			return nil, fmt.Errorf("%w: invalid bulk length", ErrorProtocol)
+		}
+
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+
+		if data[size] != '\r' || data[size+1] != '\n' {
+			return nil, fmt.Errorf("%w: bulk string not terminated by CRLF", ErrorProtocol)
+		}
+
+		args = append(args, string(data[:size]))
+	}
+
+	return args, nil
+}
+
+// readRESPLine reads a CRLF-terminated line and returns it without the
+// terminator.
+func readRESPLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return "", fmt.Errorf("%w: line too long", ErrorProtocol)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+func (c *respConn) writeSimple(s string) {
+	c.w.WriteString("+" + s + "\r\n")
+}
+
+func (c *respConn) writeError(s string) {
+	c.failed = true
+	c.w.WriteString("-" + s + "\r\n")
+}
+
+func (c *respConn) writeInteger(n int64) {
+	c.w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (c *respConn) writeBulk(s string) {
+	c.w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+func (c *respConn) writeNull() {
+	c.w.WriteString("$-1\r\n")
+}
+
+func (c *respConn) writeArray(n int) {
+	c.w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+/**
+ * RESP commands.
+ */
+func respPing(ctx context.Context, c *respConn, args []string) {
+	switch len(args) {
+	case 1:
+		c.writeSimple("PONG")
+	case 2:
+		c.writeBulk(args[1])
+	default:
+		c.writeError("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+func respEcho(ctx context.Context, c *respConn, args []string) {
+	c.writeBulk(args[1])
+}
+
+// respAuth implements AUTH [username] password. The password is checked
+// as the password of the user, if one is given, then as an API key or JWT.
+func respAuth(ctx context.Context, c *respConn, args []string) {
+	if len(args) > 3 {
+		c.writeError("ERR syntax error")
+		return
+	}
+
+	if c.server.auth == nil {
+		c.writeError("ERR AUTH called without any password configured")
+		return
+	}
+
+	var p Principal
+	err := ErrorUnauthenticated
+	if len(args) == 3 {
+		p, err = c.server.auth.AuthenticatePassword(ctx, args[1], args[2])
+	}
+
+	if err != nil {
+		p, err = c.server.auth.AuthenticateToken(ctx, args[len(args)-1])
+	}
+
+	if err != nil {
+		c.writeError("WRONGPASS invalid username-password pair or user is disabled.")
+		return
+	}
+
+	c.principal, c.authed = p, true
+	c.writeSimple("OK")
+}
+
+func respQuit(ctx context.Context, c *respConn, args []string) {
+	c.writeSimple("OK")
+	c.quit = true
+}
+
+// respCommandInfo answers the COMMAND introspection redis-cli sends on
+// connect with an empty list.
+func respCommandInfo(ctx context.Context, c *respConn, args []string) {
+	c.writeArray(0)
+}
+
+func respGet(ctx context.Context, c *respConn, args []string) {
+	value, err := store.Get(ctx, args[1])
+	if errors.Is(err, ErrorNoSuchKey) {
+		c.writeNull()
+		return
+	}
+
+	if err != nil {
+		c.writeError("ERR " + err.Error())
+		return
+	}
+
+	c.writeBulk(value)
+}
+
+// respSet implements SET key value [EX seconds | PX milliseconds].
+func respSet(ctx context.Context, c *respConn, args []string) {
+	key, value := args[1], args[2]
+
+	var ttl time.Duration
+
+	for i := 3; i < len(args); i++ {
+		option := strings.ToUpper(args[i])
+		if (option != "EX" && option != "PX") || ttl != 0 || i+1 == len(args) {
+			c.writeError("ERR syntax error")
+			return
+		}
+
+		i++
+		n, err := strconv.ParseInt(args[i], 10, 64)
+		if err != nil || n <= 0 {
+			c.writeError("ERR invalid expire time in 'set' command")
+			return
+		}
+
+		ttl = time.Duration(n) * time.Millisecond
+		if option == "EX" {
+			ttl = time.Duration(n) * time.Second
+		}
+	}
+
+	if err := validateKey(key); err != nil {
+		c.writeError("ERR " + err.Error())
+		return
+	}
+
+	if int64(len(value)) > config.Limits.MaxValueBytes {
+		c.writeError("ERR " + ErrorValueTooLarge.Error())
+		return
+	}
+
+	deadline := expiry(ttl)
+
+	putCtx := loggedPut(ctx, key, value, "", deadline)
+
+	_, err := store.Put(putCtx, key, value)
+	if errors.Is(err, ErrorMemoryFull) {
+		c.writeError("OOM " + err.Error()) // Как Redis при превышении maxmemory
+		return
+	}
+
+	if err == nil {
+		recordPut(putCtx, key, value, "", deadline)
+	}
+
+	if err == nil && config.TransactionLog.Durability == "sync" {
+		err = logger.Sync(ctx)
+	}
+
+	if err != nil {
+		c.writeError("ERR " + err.Error())
+		return
+	}
+
+	c.writeSimple("OK")
+}
+
+func respDel(ctx context.Context, c *respConn, args []string) {
+	var deleted int64
+
+	for _, key := range args[1:] {
+		if _, err := store.Get(ctx, key); err != nil {
+			continue
+		}
+
+		if err := store.Delete(loggedDelete(ctx, key, time.Time{}), key); err != nil {
+			c.writeError("ERR " + err.Error())
+			return
+		}
+
+		recordDelete(key)
+		deleted++
+	}
+
+	if deleted > 0 && config.TransactionLog.Durability == "sync" {
+		if err := logger.Sync(ctx); err != nil {
+			c.writeError("ERR " + err.Error())
+			return
+		}
+	}
+
+	c.writeInteger(deleted)
+}
+
+// respIncr implements INCR, DECR, INCRBY and DECRBY.
+func respIncr(ctx context.Context, c *respConn, args []string) {
+	name, key := strings.ToUpper(args[0]), args[1]
+
+	by := int64(1)
+	if len(args) == 3 {
+		var err error
+		if by, err = strconv.ParseInt(args[2], 10, 64); err != nil {
+			c.writeError("ERR value is not an integer or out of range")
+			return
+		}
+	}
+
+	if name == "DECR" || name == "DECRBY" {
+		if by == math.MinInt64 {
+			c.writeError("ERR decrement would overflow")
+			return
+		}
+		by = -by
+	}
+
+	if err := validateKey(key); err != nil {
+		c.writeError("ERR " + err.Error())
+		return
+	}
+
+	value, _, err := store.Increment(loggedIncrement(ctx, key), key, by)
+	if errors.Is(err, ErrorNotInteger) {
+		c.writeError("ERR value is not an integer or out of range")
+		return
+	}
+
+	if err != nil {
+		c.writeError("ERR " + err.Error())
+		return
+	}
+
+	recordIncrement(key, strconv.FormatInt(value, 10))
+
+	if config.TransactionLog.Durability == "sync" {
+		if err := logger.Sync(ctx); err != nil {
+			c.writeError("ERR " + err.Error())
+			return
+		}
+	}
+
+	c.writeInteger(value)
+}
+
+func respExists(ctx context.Context, c *respConn, args []string) {
+	var found int64
+
+	for _, key := range args[1:] {
+		if _, err := store.Get(ctx, key); err == nil {
+			found++
+		}
+	}
+
+	c.writeInteger(found)
+}
+
+// respKeys implements KEYS pattern. Only keys sharing the pattern's
+// literal prefix are scanned.
+func respKeys(ctx context.Context, c *respConn, args []string) {
+	pattern := normalizeBound(args[1])
+	prefix := globPrefix(pattern)
+
+	var keys []string
+
+	for after := ""; ; {
+		entries, more, err := store.List(ctx, prefix, after, respPageLimit)
+		if err != nil {
+			c.writeError("ERR " + err.Error())
+			return
+		}
+
+		for _, e := range entries {
+			if matchGlob(pattern, e.Key) {
+				keys = append(keys, e.Key)
+			}
+		}
+
+		if !more {
+			break
+		}
+		after = entries[len(entries)-1].Key
+	}
+
+	c.writeArray(len(keys))
+	for _, key := range keys {
+		c.writeBulk(key)
+	}
+}
+
+func respTTL(ctx context.Context, c *respConn, args []string) {
+	respExpiry(ctx, c, args[1], time.Second)
+}
+
+func respPTTL(ctx context.Context, c *respConn, args []string) {
+	respExpiry(ctx, c, args[1], time.Millisecond)
+}
+
+// respExpiry replies with the time left before key expires in units,
+// -1 if it has no deadline and -2 if it does not exist.
+func respExpiry(ctx context.Context, c *respConn, key string, unit time.Duration) {
+	ttl, err := store.TTL(ctx, key)
+	if errors.Is(err, ErrorNoSuchKey) {
+		c.writeInteger(-2)
+		return
+	}
+
+	if err != nil {
+		c.writeError("ERR " + err.Error())
+		return
+	}
+
+	if ttl == NoExpiration {
+		c.writeInteger(-1)
+		return
+	}
+
+	c.writeInteger(int64((ttl + unit - 1) / unit))
+}
@@ -0,0 +1,149 @@
+package kvs
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+ * File Transaction log rotation.
+ *
+ * The file logger appends to the active log file and, once it reaches
+ * MaxSize bytes or every Interval, renames it to the next numbered segment
+ * (transaction.000001.log, transaction.000002.log, ...) and starts a fresh
+ * one. A segment is never written again; it is compacted once right after
+ * rotation, keeping the events that act on keys from earlier segments.
+ * Replay reads the segments in order, then the active file.
+ */
+const segmentDigits = 6
+
+// RotationPolicy decides when the file logger starts a new segment. A zero
+// field disables the corresponding trigger.
+type RotationPolicy struct {
+	MaxSize  int64         `yaml:"max_size"` // Размер активного файла журнала в байтах
+	Interval time.Duration `yaml:"interval"`
+}
+
+func (p RotationPolicy) due(size int64) bool {
+	return p.MaxSize > 0 && size >= p.MaxSize
+}
+
+// segmentName returns the file name of the n-th segment of the log at
+// filename: transaction.log becomes transaction.000001.log.
+func segmentName(filename string, n int) string {
+	ext := filepath.Ext(filename)
+
+	return fmt.Sprintf("%s.%0*d%s", strings.TrimSuffix(filename, ext), segmentDigits, n, ext)
+}
+
+// listSegments returns the segments of the log at filename in replay order
+// and the number of the last one, or 0 if there are none.
+func listSegments(filename string) ([]string, int, error) {
+	dir, base := filepath.Dir(filename), filepath.Base(filename)
+	ext := filepath.Ext(base)
+	prefix := strings.TrimSuffix(base, ext) + "."
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	numbers := make(map[string]int)
+	var names []string
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+			continue
+		}
+
+		digits := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext)
+		n, err := strconv.Atoi(digits)
+		if err != nil || n < 1 || len(digits) < segmentDigits {
+			continue
+		}
+
+		path := filepath.Join(dir, name)
+		numbers[path] = n
+		names = append(names, path)
+	}
+
+	sort.Slice(names, func(i, j int) bool { return numbers[names[i]] < numbers[names[j]] })
+
+	if len(names) == 0 {
+		return nil, 0, nil
+	}
+
+	return names, numbers[names[len(names)-1]], nil
+}
+
+// rotate is run by the logger goroutine between event writes. It renames
+// the active file to the next segment, starts a new active file and
+// compacts the segment it has just closed. An empty active file is kept.
+func (l *FileTransactionLogger) rotate() error {
+	segment, err := l.closeSegment()
+	if err != nil || segment == "" {
+		return err
+	}
+
+	// Первому сегменту не предшествуют ни другие, ни снимок; его можно сжать полностью.
+	if err := compactLogFile(segment, l.sealer, l.segment > 1 || l.floor.Load() > 0); err != nil {
+		slog.Error("segment compaction failed", "segment", segment, "error", err)
+	}
+
+	return nil
+}
+
+// closeSegment renames the active file to the next segment and starts a
+// new active file. It returns the name of the segment, or "" if the active
+// file held no events and was kept.
+func (l *FileTransactionLogger) closeSegment() (string, error) {
+	header := l.sealer.logHeader() + "\n"
+	if l.compaction.size <= int64(len(header)) {
+		return "", nil // Нет событий
+	}
+
+	if err := l.file.Sync(); err != nil {
+		return "", fmt.Errorf("failed to sync transaction log: %w", err)
+	}
+	l.unsynced = 0
+
+	segment := segmentName(l.filename, l.segment+1)
+
+	if err := os.Rename(l.filename, segment); err != nil {
+		return "", fmt.Errorf("failed to rotate transaction log: %w", err)
+	}
+
+	file, err := os.OpenFile(l.filename, os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0755)
+	if err == nil {
+		if _, err = io.WriteString(file, header); err != nil {
+			file.Close()
+			os.Remove(l.filename)
+		}
+	}
+
+	if err != nil {
+		os.Rename(segment, l.filename) // Продолжить писать в прежний файл
+		return "", fmt.Errorf("failed to start new transaction log: %w", err)
+	}
+
+	if err := syncDir(filepath.Dir(l.filename)); err != nil {
+		slog.Warn("failed to sync transaction log directory", "error", err)
+	}
+
+	l.file.Close()
+	l.file = file
+	l.segment++
+	l.compaction = l.policy.reset(int64(len(header)))
+
+	slog.Info("rotated transaction log", "file", l.filename, "segment", segment)
+
+	return segment, nil
+}
@@ -0,0 +1,146 @@
+package kvs
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+/**
+ * Routing.
+ *
+ * Routes are declared on a Router, which serves them over one of two
+ * multiplexers: gorilla/mux by default, or the pattern routing of the
+ * standard library's http.ServeMux in builds with the stdmux tag
+ * (go build -tags stdmux), which do not depend on gorilla/mux. Both match
+ * the same requests the same way: a path variable {name} matches one
+ * non-empty segment of the decoded path, a template ending in / matches
+ * every path it starts, a request for a known path with another method
+ * gets 405 and any other one 404.
+ *
+ * Middleware added with Use runs, in the order it was added, only for the
+ * requests that match a route; currentRoute and pathVars give it the
+ * route and its path variables.
+ */
+type Router struct {
+	routes     []*Route
+	middleware []func(http.Handler) http.Handler
+
+	once    sync.Once
+	handler http.Handler // Собирается при первом запросе
+}
+
+// Route is a named handler for a path template and its methods.
+type Route struct {
+	name     string
+	template string // Путь с переменными {name}; на конце / - префикс
+	methods  []string
+	handler  http.Handler
+}
+
+type routeKey struct{}
+
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// HandleFunc adds a route serving the path template with h.
+func (rt *Router) HandleFunc(template string, h http.HandlerFunc) *Route {
+	route := &Route{template: template, handler: h}
+	rt.routes = append(rt.routes, route)
+
+	return route
+}
+
+// Use adds middleware run for every matched request; it must be added
+// before the router serves its first request.
+func (rt *Router) Use(mw func(http.Handler) http.Handler) {
+	rt.middleware = append(rt.middleware, mw)
+}
+
+// Names returns the names of the named routes.
+func (rt *Router) Names() []string {
+	var names []string
+	for _, route := range rt.routes {
+		if route.name != "" {
+			names = append(names, route.name)
+		}
+	}
+
+	return names
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt.once.Do(func() {
+		m := newRouteMux()
+		for _, route := range rt.routes {
+			m.handle(route, rt.chain(route))
+		}
+		rt.handler = m
+	})
+
+	rt.handler.ServeHTTP(w, r)
+}
+
+// chain wraps the handler of route in the middleware, with the route in
+// the request context.
+func (rt *Router) chain(route *Route) http.Handler {
+	h := route.handler
+	for i := len(rt.middleware) - 1; i >= 0; i-- {
+		h = rt.middleware[i](h)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), routeKey{}, route)))
+	})
+}
+
+// Methods restricts the route to the given methods.
+func (route *Route) Methods(methods ...string) *Route {
+	route.methods = methods
+	return route
+}
+
+func (route *Route) Name(name string) *Route {
+	route.name = name
+	return route
+}
+
+// prefix reports whether the route matches every path its template starts.
+func (route *Route) prefix() bool {
+	return strings.HasSuffix(route.template, "/")
+}
+
+// allows reports whether the route serves method.
+func (route *Route) allows(method string) bool {
+	if len(route.methods) == 0 {
+		return true
+	}
+
+	for _, m := range route.methods {
+		if m == method {
+			return true
+		}
+	}
+
+	return false
+}
+
+// variables returns the names of the path variables of the template.
+func (route *Route) variables() []string {
+	var names []string
+	for _, segment := range strings.Split(route.template, "/") {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			names = append(names, segment[1:len(segment)-1])
+		}
+	}
+
+	return names
+}
+
+// currentRoute returns the route a request matched, or nil.
+func currentRoute(r *http.Request) *Route {
+	route, _ := r.Context().Value(routeKey{}).(*Route)
+	return route
+}
@@ -0,0 +1,95 @@
+package kvs
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// TestRouterMatches runs in both the default build and the stdmux one
+// (go test -tags stdmux), so the two multiplexers answer the same table.
+func TestRouterMatches(t *testing.T) {
+	router := NewRouter()
+
+	for _, route := range []struct {
+		template string
+		methods  []string
+		name     string
+	}{
+		{"/v1/key/{key}", []string{"PUT"}, "put"},
+		{"/v1/key/{key}", []string{"GET", "HEAD"}, "get"},
+		{"/v1/key/{key}", []string{"DELETE"}, "delete"},
+		{"/v1/key/{key}/incr", []string{"POST"}, "incr"},
+		{"/v1/keys", []string{"GET"}, "list"},
+		{"/v1/dir/", []string{"GET"}, "dir"},
+		{"/v1/lock/{name}/renew", []string{"POST"}, "renew_lock"},
+		{"/debug/pprof/", []string{"GET", "POST"}, "pprof"},
+	} {
+		router.HandleFunc(route.template, func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, currentRoute(r).name, formatPathVars(pathVars(r)))
+		}).Methods(route.methods...).Name(route.name)
+	}
+
+	tests := []struct {
+		method string
+		target string
+		status int
+		body   string // Имя маршрута и переменные пути
+	}{
+		{"PUT", "/v1/key/a", http.StatusOK, "put key=a"},
+		{"GET", "/v1/key/a", http.StatusOK, "get key=a"},
+		{"HEAD", "/v1/key/a", http.StatusOK, "get key=a"},
+		{"DELETE", "/v1/key/a", http.StatusOK, "delete key=a"},
+		{"POST", "/v1/key/a", http.StatusMethodNotAllowed, ""},
+		{"GET", "/v1/key/a%20b", http.StatusOK, "get key=a b"},
+		{"GET", "/v1/key/caf%C3%A9", http.StatusOK, "get key=café"},
+		{"GET", "/v1/key/", http.StatusNotFound, ""},
+		{"POST", "/v1/key/a/incr", http.StatusOK, "incr key=a"},
+		{"GET", "/v1/key/a/incr", http.StatusMethodNotAllowed, ""},
+		{"GET", "/v1/key/a/b", http.StatusNotFound, ""},
+		{"GET", "/v1/key/a%2Fb", http.StatusNotFound, ""}, // Сопоставляется раскодированный путь
+		{"GET", "/v1/keys", http.StatusOK, "list"},
+		{"GET", "/v1/keys?prefix=a", http.StatusOK, "list"},
+		{"POST", "/v1/keys", http.StatusMethodNotAllowed, ""},
+		{"GET", "/v1/dir/", http.StatusOK, "dir"},
+		{"GET", "/v1/dir/a/b", http.StatusOK, "dir"},
+		{"PUT", "/v1/dir/a", http.StatusMethodNotAllowed, ""},
+		{"POST", "/v1/lock/l1/renew", http.StatusOK, "renew_lock name=l1"},
+		{"GET", "/debug/pprof/heap", http.StatusOK, "pprof"},
+		{"GET", "/v1/unknown", http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, nil))
+
+		body := ""
+		if w.Code == http.StatusOK {
+			body = w.Body.String()
+		}
+
+		if w.Code != tt.status || body != tt.body {
+			t.Errorf("%s %s: got %d %q, want %d %q", tt.method, tt.target, w.Code, body, tt.status, tt.body)
+		}
+	}
+}
+
+// formatPathVars formats path variables as " name=value", sorted by name.
+func formatPathVars(vars map[string]string) string {
+	var b strings.Builder
+
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(&b, " %s=%s", name, vars[name])
+	}
+
+	return b.String()
+}
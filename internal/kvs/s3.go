@@ -0,0 +1,678 @@
+package kvs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+ * S3 Transaction logger.
+ *
+ * Events are buffered in memory and uploaded to S3-compatible object
+ * storage as segment objects, every segment interval and whenever a write
+ * must be durable. A segment uses the file log format and is named after
+ * its last sequence number, so listing the prefix yields the segments in
+ * replay order. Compaction folds all segments into a single one that acts
+ * as a snapshot of the store, so a stateless container recovers its state
+ * from the bucket alone.
+ */
+const s3SegmentSuffix = ".log"
+
+type S3TransactionLogger struct {
+	eventQueue              // Очередь событий сопрограммы Run и её завершение
+	errors     <-chan error // Канал только для чтения; для приема ошибок
+	wg         sync.WaitGroup
+
+	client          *s3Client
+	prefix          string
+	interval        time.Duration
+	compactSegments int
+	sealer          *Sealer
+	compressAbove   int // Сжимать значения не короче; 0 отключает сжатие
+	queueSize       int // Событий в очереди
+
+	compactions chan chan error // Запросы сжатия по требованию
+
+	pending  []Event // События, ещё не выгруженные в сегмент
+	segments int     // Сегментов выгружено с последнего сжатия
+
+	mu        sync.Mutex
+	uploadErr error // Ошибка последней выгрузки, для Check
+
+	lastSequence uint64 // Последний использованный порядковый номер
+}
+
+func NewS3TransactionLogger(c S3Config, o LogOptions) (TransactionLogger, error) {
+	client, err := newS3Client(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return &S3TransactionLogger{
+		client:          client,
+		prefix:          c.Prefix,
+		interval:        c.SegmentInterval,
+		compactSegments: c.CompactSegments,
+		sealer:          o.Sealer,
+		compressAbove:   o.CompressAbove,
+		queueSize:       o.QueueSize,
+	}, nil
+}
+
+func (l *S3TransactionLogger) Run() {
+	events := make(chan Event, l.queueSize) // Создать канал событий
+	l.events = events
+
+	errors := make(chan error, 1) // Создать канал ошибок
+	l.errors = errors
+
+	l.compactions = make(chan chan error)
+	l.stopped = make(chan struct{})
+
+	l.wg.Add(1)
+
+	go func() {
+		defer l.wg.Done()
+		defer close(l.stopped)
+		defer close(errors) // Завершает наблюдателей Err
+
+		ticker := time.NewTicker(l.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case e, ok := <-events: // Извлечь следующее событие Event
+				if !ok {
+					if err := l.upload(); err != nil {
+						errors <- err
+					}
+					return
+				}
+
+				if e.synced != nil { // Выгрузить всё накопленное немедленно
+					e.synced <- l.upload()
+					continue
+				}
+
+				e.Sequence = atomic.AddUint64(&l.lastSequence, 1)
+				l.pending = append(l.pending, e)
+
+			case <-ticker.C:
+				if err := l.upload(); err != nil {
+					slog.Warn("segment upload failed, will retry", "error", err)
+					continue
+				}
+
+				if l.compactSegments > 0 && l.segments >= l.compactSegments {
+					if err := l.compact(); err != nil {
+						slog.Error("compaction failed", "error", err)
+					}
+				}
+
+			case reply := <-l.compactions:
+				reply <- l.compact()
+			}
+		}
+	}()
+}
+
+// segmentKey names the segment whose last event has the given sequence.
+func (l *S3TransactionLogger) segmentKey(sequence uint64) string {
+	return fmt.Sprintf("%s%020d%s", l.prefix, sequence, s3SegmentSuffix)
+}
+
+// segmentSequence parses the sequence number out of a segment key.
+func (l *S3TransactionLogger) segmentSequence(key string) (uint64, bool) {
+	name := strings.TrimSuffix(strings.TrimPrefix(key, l.prefix), s3SegmentSuffix)
+
+	sequence, err := strconv.ParseUint(name, 10, 64)
+	return sequence, err == nil
+}
+
+func (l *S3TransactionLogger) encodeSegment(events []Event) []byte {
+	var buf bytes.Buffer
+
+	buf.WriteString(l.sealer.logHeader() + "\n")
+	for _, e := range events {
+		buf.WriteString(encodeEvent(l.sealer.sealEvent(compressEvent(e, l.compressAbove))))
+	}
+
+	return buf.Bytes()
+}
+
+// upload writes the pending events as a new segment. On failure they stay
+// pending and go into the next attempt.
+func (l *S3TransactionLogger) upload() error {
+	if len(l.pending) == 0 {
+		return nil
+	}
+
+	key := l.segmentKey(l.pending[len(l.pending)-1].Sequence)
+
+	err := l.client.put(key, l.encodeSegment(l.pending))
+
+	l.mu.Lock()
+	l.uploadErr = err
+	l.mu.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("segment upload failed: %w", err)
+	}
+
+	l.pending = l.pending[:0]
+	l.segments++
+
+	return nil
+}
+
+// Compact folds every segment into one. It is serialized with event
+// writes by the logger goroutine, so Run must have been called.
+func (l *S3TransactionLogger) Compact() error {
+	reply := make(chan error)
+	l.compactions <- reply
+
+	return <-reply
+}
+
+// compact is run by the logger goroutine. The folded segment replaces the
+// newest one under the same key before the older ones are deleted; if
+// compaction is interrupted in between, replay skips the events it has
+// already seen.
+func (l *S3TransactionLogger) compact() error {
+	started := time.Now()
+
+	if err := l.upload(); err != nil {
+		return err
+	}
+
+	keys, err := l.client.list(l.prefix)
+	if err != nil {
+		return fmt.Errorf("failed to list segments: %w", err)
+	}
+
+	keys = l.segmentKeys(keys)
+	if len(keys) < 2 {
+		l.segments = 0
+		return nil
+	}
+
+	folder := newLogFolder(false)
+	var last uint64
+
+	for _, key := range keys {
+		err := l.readSegment(key, func(e Event) error {
+			if e.Sequence <= last {
+				return nil
+			}
+
+			last = e.Sequence
+			return folder.add(e)
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	newest := keys[len(keys)-1]
+	if err := l.client.put(newest, l.encodeSegment(folder.events())); err != nil {
+		return fmt.Errorf("failed to upload compacted segment: %w", err)
+	}
+
+	for _, key := range keys[:len(keys)-1] {
+		if err := l.client.delete(key); err != nil {
+			return fmt.Errorf("failed to delete compacted segment: %w", err)
+		}
+	}
+
+	l.segments = 0
+
+	slog.Info("compacted transaction log", "bucket", l.client.bucket, "prefix", l.prefix,
+		"segments", len(keys), "duration", time.Since(started))
+
+	return nil
+}
+
+// segmentKeys filters keys down to segments, in replay order.
+func (l *S3TransactionLogger) segmentKeys(keys []string) []string {
+	segments := keys[:0]
+	for _, key := range keys {
+		if _, ok := l.segmentSequence(key); ok {
+			segments = append(segments, key)
+		}
+	}
+
+	sort.Strings(segments) // Номера дополнены нулями до одинаковой длины
+
+	return segments
+}
+
+// readSegment downloads a segment and passes its events to fn in order.
+func (l *S3TransactionLogger) readSegment(key string, fn func(Event) error) error {
+	body, err := l.client.get(key)
+	if err != nil {
+		return fmt.Errorf("failed to download segment %s: %w", key, err)
+	}
+
+	defer body.Close()
+
+	reader := bufio.NewReader(body)
+
+	header, err := reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("segment %s: transaction log read failure: %w", key, err)
+	}
+
+	format, err := checkLogHeader(header, l.sealer)
+	if err != nil {
+		return fmt.Errorf("segment %s: %w", key, err)
+	}
+
+	for {
+		record, err := format.read(reader)
+		if err == io.EOF && record == "" {
+			return nil
+		}
+
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("segment %s: transaction log read failure: %w", key, err)
+		}
+
+		e, err := format.decode(record)
+		if err == nil {
+			e, err = l.sealer.openEvent(e)
+		}
+
+		if err != nil {
+			return fmt.Errorf("segment %s: input parse error: %w", key, err)
+		}
+
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+}
+
+func (l *S3TransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
+	outEvent := make(chan Event)    // Небуферизованный канал событий
+	outError := make(chan error, 1) // Буферизованный канал ошибок
+
+	go func() {
+		defer close(outEvent) // Закрыть каналы
+		defer close(outError) // по завершении сопрограммы
+
+		keys, err := l.client.list(l.prefix)
+		if err != nil {
+			outError <- fmt.Errorf("failed to list segments: %w", err)
+			return
+		}
+
+		for _, key := range l.segmentKeys(keys) {
+			err := l.readSegment(key, func(e Event) error {
+				if e.Sequence <= l.lastSequence {
+					return nil // Уже прочитано из сегмента, сжатие которого прервалось
+				}
+
+				atomic.StoreUint64(&l.lastSequence, e.Sequence)
+				if e.EventType != EventSequence {
+					outEvent <- e
+				}
+
+				return nil
+			})
+
+			if err != nil {
+				outError <- err
+				return
+			}
+
+			// Сжатый сегмент может не содержать своего последнего события.
+			if sequence, _ := l.segmentSequence(key); sequence > l.lastSequence {
+				atomic.StoreUint64(&l.lastSequence, sequence)
+			}
+		}
+	}()
+
+	return outEvent, outError
+}
+
+func (l *S3TransactionLogger) WritePut(key, value string, revision uint64) error {
+	return l.send(Event{EventType: EventPut, Key: key, Value: value, Revision: revision})
+}
+
+func (l *S3TransactionLogger) WriteDelete(key string) error {
+	return l.send(Event{EventType: EventDelete, Key: key})
+}
+
+func (l *S3TransactionLogger) WriteExpire(key string, deadline time.Time) error {
+	return l.send(Event{EventType: EventExpire, Key: key, Value: strconv.FormatInt(deadline.UnixNano(), 10)})
+}
+
+func (l *S3TransactionLogger) WriteExpired(key string) error {
+	return l.send(Event{EventType: EventExpired, Key: key})
+}
+
+func (l *S3TransactionLogger) WriteTombstone(key string, until time.Time) error {
+	return l.send(Event{EventType: EventTombstone, Key: key, Value: strconv.FormatInt(until.UnixNano(), 10)})
+}
+
+func (l *S3TransactionLogger) WriteSchedule(key, op string, at time.Time) error {
+	return l.send(Event{EventType: EventSchedule, Key: key, Value: scheduleValue(op, at)})
+}
+
+func (l *S3TransactionLogger) WriteContentType(key, contentType string) error {
+	return l.send(Event{EventType: EventContentType, Key: key, Value: contentType})
+}
+
+func (l *S3TransactionLogger) WriteReadOnly(enabled bool) error {
+	return l.send(Event{EventType: EventReadOnly, Value: strconv.FormatBool(enabled)})
+}
+
+func (l *S3TransactionLogger) WriteTxn(ops []Event) error {
+	return l.send(Event{EventType: EventTxn, Value: encodeTxnEvents(ops)})
+}
+
+func (l *S3TransactionLogger) WriteIncrement(key, value string, revision uint64) error {
+	return l.send(Event{EventType: EventIncrement, Key: key, Value: value, Revision: revision})
+}
+
+// Sync uploads every event written before the call.
+func (l *S3TransactionLogger) Sync(ctx context.Context) error {
+	return l.syncEvents(ctx)
+}
+
+// Check reports whether the logger goroutine is running and the last
+// segment upload succeeded.
+func (l *S3TransactionLogger) Check() error {
+	select {
+	case <-l.stopped:
+		return ErrorLoggerStopped
+	default:
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.uploadErr
+}
+
+func (l *S3TransactionLogger) Err() <-chan error {
+	return l.errors
+}
+
+func (l *S3TransactionLogger) LastSequence() uint64 {
+	return atomic.LoadUint64(&l.lastSequence)
+}
+
+// Close stops accepting events and uploads the pending ones.
+func (l *S3TransactionLogger) Close() error {
+	if l.events != nil {
+		l.closeEvents()
+	}
+
+	l.wg.Wait()
+
+	select {
+	case err := <-l.errors:
+		return err
+	default:
+		return nil
+	}
+}
+
+/**
+ * Minimal S3 client.
+ *
+ * Only the calls the logger needs, with path-style addressing so that it
+ * works against MinIO and other S3-compatible stores, and requests signed
+ * with AWS Signature Version 4.
+ */
+type s3Client struct {
+	endpoint  string // Схема и адрес, без завершающей косой черты
+	host      string
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+
+	http *http.Client
+}
+
+func newS3Client(c S3Config) (*s3Client, error) {
+	u, err := url.Parse(c.Endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", c.Endpoint)
+	}
+
+	client := &s3Client{
+		endpoint:  strings.TrimSuffix(c.Endpoint, "/"),
+		host:      u.Host,
+		region:    c.Region,
+		bucket:    c.Bucket,
+		accessKey: c.AccessKey,
+		secretKey: c.SecretKey,
+		http:      &http.Client{Timeout: 30 * time.Second},
+	}
+
+	if client.accessKey == "" && client.secretKey == "" { // Стандартные переменные окружения AWS
+		client.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		client.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+
+	return client, nil
+}
+
+func (c *s3Client) put(key string, data []byte) error {
+	resp, err := c.do(http.MethodPut, key, nil, data)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+func (c *s3Client) get(key string) (io.ReadCloser, error) {
+	resp, err := c.do(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+func (c *s3Client) delete(key string) error {
+	resp, err := c.do(http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// list returns the keys of all objects under prefix.
+func (c *s3Client) list(prefix string) ([]string, error) {
+	var keys []string
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+
+	for {
+		resp, err := c.do(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid list response: %w", err)
+		}
+
+		for _, object := range result.Contents {
+			keys = append(keys, object.Key)
+		}
+
+		if !result.IsTruncated {
+			return keys, nil
+		}
+
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// do sends a signed request for key, or for the bucket itself if key is
+// empty, and fails on any non-2xx response.
+func (c *s3Client) do(method, key string, query url.Values, body []byte) (*http.Response, error) {
+	path := "/" + s3Escape(c.bucket, false)
+	if key != "" {
+		path += "/" + s3Escape(key, false)
+	}
+
+	rawQuery := s3CanonicalQuery(query)
+
+	target := c.endpoint + path
+	if rawQuery != "" {
+		target += "?" + rawQuery
+	}
+
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	c.sign(req, path, rawQuery, body, time.Now().UTC())
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+
+		return nil, fmt.Errorf("S3 %s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(message))
+	}
+
+	return resp, nil
+}
+
+// sign adds the Signature Version 4 Authorization header, covering the
+// host and every header already set on req.
+func (c *s3Client) sign(req *http.Request, path, rawQuery string, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payloadHash := hex.EncodeToString(sha256Sum(body))
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": c.host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method, path, rawQuery, canonicalHeaders.String(), signedHeaders, payloadHash,
+	}, "\n")
+
+	scope := day + "/" + c.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		hex.EncodeToString(sha256Sum([]byte(canonicalRequest)))
+
+	key := hmacSum([]byte("AWS4"+c.secretKey), day)
+	key = hmacSum(key, c.region)
+	key = hmacSum(key, "s3")
+	key = hmacSum(key, "aws4_request")
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, hex.EncodeToString(hmacSum(key, stringToSign))))
+}
+
+func sha256Sum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+func hmacSum(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes everything but unreserved characters, and the
+// slash too unless it separates path segments.
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case 'A' <= ch && ch <= 'Z', 'a' <= ch && ch <= 'z', '0' <= ch && ch <= '9',
+			ch == '-', ch == '_', ch == '.', ch == '~':
+			b.WriteByte(ch)
+		case ch == '/' && !escapeSlash:
+			b.WriteByte(ch)
+		default:
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+
+	return b.String()
+}
+
+// s3CanonicalQuery encodes query sorted by name, as signing requires.
+func s3CanonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var pairs []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			pairs = append(pairs, s3Escape(name, true)+"="+s3Escape(value, true))
+		}
+	}
+
+	return strings.Join(pairs, "&")
+}
@@ -0,0 +1,280 @@
+package kvs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * Scheduled operations.
+ *
+ * DELETE /v1/key/{key}?after=24h schedules the delete of the key instead
+ * of deleting it at once and answers 202 Accepted with the operation.
+ * Each key has at most one pending operation; scheduling another replaces
+ * it. Operations are recorded in the transaction log as EventSchedule
+ * events, replayed at startup whatever the store keeps, and logged again
+ * after every snapshot, so they survive restarts.
+ *
+ * The scheduler checks for due operations every second and runs them as
+ * the request they stand for would, tombstone included, then logs an
+ * event with an empty value that clears them. While the server refuses
+ * writes - in read-only mode, on a replica or with the log failing - due
+ * operations wait. A key that is gone by then is left alone. Replicas
+ * keep the operations of their primary without running them: the deletes
+ * of the primary reach them through the log.
+ *
+ * GET /v1/schedule on the admin listener lists the pending operations,
+ * and DELETE /v1/schedule/{key} cancels one.
+ */
+const scheduleInterval = time.Second // Как часто проверяются наступившие операции
+
+var ErrorNotScheduled = errors.New("No operation scheduled")
+
+type scheduledOp struct {
+	Key string    `json:"key"`
+	Op  string    `json:"op"` // "delete"
+	At  time.Time `json:"at"`
+}
+
+type Scheduler struct {
+	mu  sync.Mutex // Упорядочивает изменения с их записью в журнал
+	ops map[string]scheduledOp
+}
+
+var scheduler = NewScheduler()
+
+// NewScheduler returns a scheduler with no pending operations.
+func NewScheduler() *Scheduler {
+	return &Scheduler{ops: make(map[string]scheduledOp)}
+}
+
+// scheduleValue encodes op at the given time as the value of an
+// EventSchedule; an empty op cancels.
+func scheduleValue(op string, at time.Time) string {
+	if op == "" {
+		return ""
+	}
+
+	return op + " " + strconv.FormatInt(at.UnixNano(), 10)
+}
+
+// parseScheduleValue decodes the value of an EventSchedule.
+func parseScheduleValue(value string) (op string, at time.Time, err error) {
+	if value == "" {
+		return "", time.Time{}, nil
+	}
+
+	op, raw, ok := strings.Cut(value, " ")
+	if !ok {
+		return "", time.Time{}, fmt.Errorf("invalid scheduled operation %q", value)
+	}
+
+	nanos, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("invalid scheduled operation %q", value)
+	}
+
+	return op, time.Unix(0, nanos), nil
+}
+
+// Schedule records op on key at the given time in place of the key's
+// pending operation, if any, and logs it.
+func (s *Scheduler) Schedule(key, op string, at time.Time) scheduledOp {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o := scheduledOp{Key: key, Op: op, At: at}
+	s.ops[key] = o
+	logger.WriteSchedule(key, op, at)
+
+	return o
+}
+
+// Cancel drops the pending operation of key, if any, and logs it.
+func (s *Scheduler) Cancel(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.ops[key]; !ok {
+		return ErrorNotScheduled
+	}
+
+	delete(s.ops, key)
+	logger.WriteSchedule(key, "", time.Time{})
+
+	return nil
+}
+
+// finish drops o once it has run, unless it has been replaced since.
+func (s *Scheduler) finish(o scheduledOp) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if current, ok := s.ops[o.Key]; ok && current == o {
+		delete(s.ops, o.Key)
+		logger.WriteSchedule(o.Key, "", time.Time{})
+	}
+}
+
+// apply replays an EventSchedule.
+func (s *Scheduler) apply(e Event) error {
+	op, at, err := parseScheduleValue(e.Value)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if op == "" {
+		delete(s.ops, e.Key)
+	} else {
+		s.ops[e.Key] = scheduledOp{Key: e.Key, Op: op, At: at}
+	}
+
+	return nil
+}
+
+// logTo logs the pending operations again to l, for a log that no longer
+// holds their events, and returns how many it logged.
+func (s *Scheduler) logTo(l TransactionLogger) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, o := range s.ops {
+		l.WriteSchedule(o.Key, o.Op, o.At)
+	}
+
+	return len(s.ops)
+}
+
+// Pending returns the pending operations, the soonest first.
+func (s *Scheduler) Pending() []scheduledOp {
+	s.mu.Lock()
+	ops := make([]scheduledOp, 0, len(s.ops))
+	for _, o := range s.ops {
+		ops = append(ops, o)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(ops, func(i, j int) bool {
+		if !ops[i].At.Equal(ops[j].At) {
+			return ops[i].At.Before(ops[j].At)
+		}
+		return ops[i].Key < ops[j].Key
+	})
+
+	return ops
+}
+
+// due returns the operations whose time has come at now.
+func (s *Scheduler) due(now time.Time) []scheduledOp {
+	var due []scheduledOp
+	for _, o := range s.Pending() {
+		if o.At.After(now) {
+			break
+		}
+		due = append(due, o)
+	}
+
+	return due
+}
+
+// run runs the operations as they fall due, until ctx is done.
+func (s *Scheduler) run(ctx context.Context) {
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			if writesRefused() != nil {
+				continue // Операции ждут, пока сервер не начнёт принимать записи
+			}
+
+			for _, o := range s.due(now) {
+				s.runOp(ctx, o)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// runOp runs o and drops it, unless it fails and is to be retried.
+func (s *Scheduler) runOp(ctx context.Context, o scheduledOp) {
+	var err error
+
+	switch o.Op {
+	case "delete":
+		err = deleteKey(ctx, o.Key)
+	default:
+		err = fmt.Errorf("unknown scheduled operation %q", o.Op)
+	}
+
+	if err != nil && !errors.Is(err, ErrorNoSuchKey) {
+		slog.Warn("scheduled operation failed", "key", o.Key, "op", o.Op, "error", err)
+		return
+	}
+
+	slog.Info("scheduled operation done", "key", o.Key, "op", o.Op, "deleted", err == nil)
+	s.finish(o)
+}
+
+// deleteKey deletes key from the store of the server, keeping a tombstone
+// of it as store.tombstone_retention requires.
+func deleteKey(ctx context.Context, key string) error {
+	if _, err := store.Get(ctx, key); err != nil {
+		return err
+	}
+
+	if retention := config.Store.TombstoneRetention; retention > 0 {
+		until := time.Now().Add(retention)
+
+		if err := store.SoftDelete(loggedDelete(ctx, key, until), key, until); err != nil {
+			return err
+		}
+	} else if err := store.Delete(loggedDelete(ctx, key, time.Time{}), key); err != nil {
+		return err
+	}
+
+	recordDelete(key)
+
+	if config.TransactionLog.Durability == "sync" {
+		return logger.Sync(ctx)
+	}
+
+	return nil
+}
+
+// scheduleHandler serves GET /v1/schedule.
+func scheduleHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(scheduler.Pending())
+}
+
+// unscheduleHandler serves DELETE /v1/schedule/{key}.
+func unscheduleHandler(w http.ResponseWriter, r *http.Request) {
+	key := pathVars(r)["key"]
+
+	if err := scheduler.Cancel(key); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err := logger.Sync(r.Context()); err != nil {
+		serverError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
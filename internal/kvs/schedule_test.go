@@ -0,0 +1,79 @@
+package kvs
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSchedulerReplay(t *testing.T) {
+	defer func(l TransactionLogger) { logger = l }(logger)
+
+	filename := filepath.Join(t.TempDir(), "transaction.log")
+	at := time.Now().Add(time.Hour).Round(0)
+
+	l := startTestLog(t, filename)
+
+	s := NewScheduler()
+	s.Schedule("a", "delete", at)
+	s.Schedule("b", "delete", at)
+	s.Schedule("a", "delete", at.Add(time.Minute)) // Заменяет прежнюю операцию
+	if err := s.Cancel("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	replayed := NewScheduler()
+	for _, e := range replayTestLog(t, openTestLog(t, filename)) {
+		if e.EventType == EventSchedule {
+			if err := replayed.apply(e); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	want := []scheduledOp{{Key: "a", Op: "delete", At: at.Add(time.Minute)}}
+	if got := replayed.Pending(); len(got) != 1 || got[0].Key != "a" || !got[0].At.Equal(want[0].At) {
+		t.Fatalf("replayed operations %+v, want %+v", got, want)
+	}
+}
+
+func TestScheduleRouteChecks(t *testing.T) {
+	router := NewRouter()
+
+	var checks []aclCheck
+	capture := func(w http.ResponseWriter, r *http.Request) { checks = requestChecks(r) }
+
+	router.HandleFunc("/v1/schedule", capture).Methods("GET").Name("schedule")
+	router.HandleFunc("/v1/schedule/{key}", capture).Methods("DELETE").Name("unschedule")
+
+	tests := []struct {
+		method string
+		target string
+		want   []aclCheck
+	}{
+		{"GET", "/v1/schedule", []aclCheck{{aclRead, ""}}},
+		{"DELETE", "/v1/schedule/a", []aclCheck{{aclDelete, "a"}}},
+		{"DELETE", "/v1/schedule/" + aclPrefix + "a", []aclCheck{{aclAdmin, aclPrefix + "a"}}},
+	}
+
+	for _, tt := range tests {
+		checks = nil
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(tt.method, tt.target, nil))
+
+		if !reflect.DeepEqual(checks, tt.want) {
+			t.Errorf("%s %s needs %+v, want %+v", tt.method, tt.target, checks, tt.want)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package kvs
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+)
+
+/**
+ * HTTP server.
+ *
+ * The server bounds how long a client may take to send the headers of a
+ * request and the whole of it and to read the response, and how long an
+ * idle keep-alive connection stays open, so that slow clients cannot tie
+ * connections up indefinitely. The streaming routes in deadlineExempt run
+ * without read and write timeouts. With a connection limit set, further
+ * connections wait in the listen backlog until open ones close.
+ */
+func newHTTPServer(c HTTPConfig, addr string, handler http.Handler, tlsConfig *tls.Config) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: c.ReadHeaderTimeout,
+		ReadTimeout:       c.ReadTimeout,
+		WriteTimeout:      c.WriteTimeout,
+		IdleTimeout:       c.IdleTimeout,
+		MaxHeaderBytes:    c.MaxHeaderBytes,
+	}
+}
+
+// listenHTTP listens on addr, accepting up to maxConnections connections
+// at a time unless it is 0.
+func listenHTTP(addr string, maxConnections int) (net.Listener, error) {
+	if addr == "" {
+		addr = ":http"
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil || maxConnections <= 0 {
+		return l, err
+	}
+
+	return &limitListener{Listener: l, slots: make(chan struct{}, maxConnections), done: make(chan struct{})}, nil
+}
+
+// limitListener holds a slot for every connection it has accepted until
+// the connection is closed.
+type limitListener struct {
+	net.Listener
+	slots chan struct{}
+
+	done      chan struct{} // Закрывается вместе со слушателем
+	closeOnce sync.Once
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case l.slots <- struct{}{}:
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.slots
+		return nil, err
+	}
+
+	return &limitConn{Conn: conn, release: func() { <-l.slots }}, nil
+}
+
+func (l *limitListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+
+	return l.Listener.Close()
+}
+
+type limitConn struct {
+	net.Conn
+	release   func()
+	closeOnce sync.Once
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(c.release) // Соединение могут закрыть дважды
+
+	return err
+}
@@ -0,0 +1,145 @@
+package kvs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+ * Read-your-writes sessions.
+ *
+ * A primary answers every successful write with an X-Session-Token
+ * header, "<epoch>:<sequence>", the position of its replication feed once
+ * the write was logged. A client that wants to read its own writes from a
+ * replica sends the last token it got back in X-Session-Token; the replica
+ * serves the request only once it has applied the primary's events up to
+ * that position, waiting for at most replication.session_wait, and
+ * otherwise refuses it with 503 and Retry-After, so that the client can
+ * retry or read from the primary. A token of another epoch, from before
+ * the primary or the replica restarted, cannot be compared with the
+ * position of the replica and is refused at once. The primary ignores the
+ * tokens it is sent, since it has every write.
+ */
+const sessionHeader = "X-Session-Token"
+
+var ErrorSessionBehind = errors.New("Replica has not caught up with the session")
+
+var ErrorSessionEpoch = errors.New("Session token is of another replication epoch")
+
+// formatSessionToken returns the token of a feed position.
+func formatSessionToken(epoch string, sequence uint64) string {
+	return epoch + ":" + strconv.FormatUint(sequence, 10)
+}
+
+func parseSessionToken(token string) (epoch string, sequence uint64, err error) {
+	epoch, seq, ok := strings.Cut(token, ":")
+	if ok && epoch != "" {
+		sequence, err = strconv.ParseUint(seq, 10, 64)
+	}
+
+	if !ok || epoch == "" || err != nil {
+		return "", 0, fmt.Errorf("Invalid %s %q", sessionHeader, token)
+	}
+
+	return epoch, sequence, nil
+}
+
+// sessionConsistency hands out session tokens on a primary and holds back
+// the requests that carry one on a replica until it has caught up.
+func sessionConsistency(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get(sessionHeader)
+
+		switch {
+		case replica != nil && token != "":
+			epoch, sequence, err := parseSessionToken(token)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			if err := replica.waitFor(r.Context(), epoch, sequence, config.Replication.SessionWait); err != nil {
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+
+		case replica == nil && feed != nil && requiredPermission(r) >= PermReadWrite:
+			w = &sessionWriter{ResponseWriter: w}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sessionWriter adds the session token to the response of a successful
+// write, as the handler sends its header.
+type sessionWriter struct {
+	http.ResponseWriter
+	wrote bool
+}
+
+func (w *sessionWriter) WriteHeader(status int) {
+	if !w.wrote && status < 300 {
+		w.Header().Set(sessionHeader, formatSessionToken(feed.position()))
+	}
+
+	w.wrote = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *sessionWriter) Write(p []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the connection.
+func (w *sessionWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// waitFor waits, for at most wait, until the replica has applied the
+// events of its primary up to sequence in epoch.
+func (r *Replica) waitFor(ctx context.Context, epoch string, sequence uint64, wait time.Duration) error {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		r.mu.Lock()
+		current, applied, advanced := r.epoch, r.sequence, r.advanced
+		r.mu.Unlock()
+
+		if current == epoch && applied >= sequence {
+			return nil
+		}
+
+		if current != "" && current != epoch {
+			return ErrorSessionEpoch
+		}
+
+		select {
+		case <-advanced:
+		case <-timer.C:
+			return ErrorSessionBehind
+		case <-ctx.Done():
+			return ErrorSessionBehind
+		}
+	}
+}
+
+// advance records the position the replica has applied; r.mu must be
+// held.
+func (r *Replica) advance(epoch string, sequence uint64) {
+	r.epoch, r.sequence = epoch, sequence
+
+	close(r.advanced)
+	r.advanced = make(chan struct{})
+}
@@ -0,0 +1,201 @@
+package kvs
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * Slow request log.
+ *
+ * With slow_log.threshold set, every HTTP request, RESP command and
+ * memcached command that takes longer is recorded with its key and the
+ * time spent in each phase: waiting for room in the full transaction log
+ * queue before the write is admitted ("log_queue"), each store
+ * operation, which covers waiting for and holding its locks ("store.Put"
+ * and so on), and waiting for the log to reach disk ("tlog.Sync"). The
+ * time a request took beyond its phases went to its handler itself, or
+ * to the client reading the response. Without a queue timeout, a write
+ * waits for room when it queues its event, in the time of its handler.
+ *
+ * The last slow_log.entries records are kept in memory. GET /v1/slowlog
+ * on the admin listener lists them, the latest first, and DELETE
+ * /v1/slowlog forgets them.
+ */
+type slowRequest struct {
+	Time       time.Time          `json:"time"` // Начало запроса
+	RequestID  string             `json:"request_id,omitempty"`
+	Operation  string             `json:"operation"` // Метод и маршрут или команда
+	Key        string             `json:"key,omitempty"`
+	Status     int                `json:"status,omitempty"` // Только для HTTP
+	DurationMS float64            `json:"duration_ms"`
+	Phases     map[string]float64 `json:"phases_ms"`
+}
+
+type SlowLog struct {
+	threshold time.Duration
+
+	mu      sync.Mutex
+	entries []slowRequest // Кольцевой буфер
+	next    int           // Куда записать следующую запись
+	full    bool
+}
+
+var slowLog *SlowLog // nil, если журнал медленных запросов отключён
+
+type timerKey struct{}
+
+// requestTimer adds up the time a request spends in each phase.
+type requestTimer struct {
+	started time.Time
+
+	mu     sync.Mutex
+	phases map[string]time.Duration
+}
+
+// NewSlowLog returns the slow request log configured by c, or nil when
+// no threshold is set. Start, Finish and Middleware accept nil.
+func NewSlowLog(c SlowLogConfig) *SlowLog {
+	if c.Threshold <= 0 {
+		return nil
+	}
+
+	return &SlowLog{threshold: c.Threshold, entries: make([]slowRequest, c.Entries)}
+}
+
+// Start begins timing a request or command.
+func (s *SlowLog) Start(ctx context.Context) (context.Context, *requestTimer) {
+	if s == nil {
+		return ctx, nil
+	}
+
+	t := &requestTimer{started: time.Now(), phases: make(map[string]time.Duration)}
+
+	return context.WithValue(ctx, timerKey{}, t), t
+}
+
+// timePhase starts timing the phase name of the request in ctx and
+// returns the function ending it. Outside a timed request it does nothing.
+func timePhase(ctx context.Context, name string) func() {
+	t, _ := ctx.Value(timerKey{}).(*requestTimer)
+	if t == nil {
+		return func() {}
+	}
+
+	started := time.Now()
+
+	return func() {
+		elapsed := time.Since(started)
+
+		t.mu.Lock()
+		t.phases[name] += elapsed
+		t.mu.Unlock()
+	}
+}
+
+// Finish records the request timed by t if it took longer than the
+// threshold.
+func (s *SlowLog) Finish(t *requestTimer, r slowRequest) {
+	if s == nil || t == nil {
+		return
+	}
+
+	elapsed := time.Since(t.started)
+	if elapsed <= s.threshold {
+		return
+	}
+
+	r.Time, r.DurationMS = t.started, milliseconds(elapsed)
+	r.Phases = make(map[string]float64, len(t.phases))
+
+	t.mu.Lock()
+	for name, d := range t.phases {
+		r.Phases[name] = milliseconds(d)
+	}
+	t.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[s.next] = r
+	s.next = (s.next + 1) % len(s.entries)
+	s.full = s.full || s.next == 0
+}
+
+// Entries returns the kept records, the latest first.
+func (s *SlowLog) Entries() []slowRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := s.next
+	if s.full {
+		n = len(s.entries)
+	}
+
+	entries := make([]slowRequest, 0, n)
+	for i := 1; i <= n; i++ {
+		entries = append(entries, s.entries[(s.next-i+len(s.entries))%len(s.entries)])
+	}
+
+	return entries
+}
+
+// Reset forgets the kept records.
+func (s *SlowLog) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	clear(s.entries)
+	s.next, s.full = 0, false
+}
+
+// Middleware times every API request.
+func (s *SlowLog) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, t := s.Start(r.Context())
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		var template string
+		if route := currentRoute(r); route != nil {
+			template = route.template
+		}
+
+		s.Finish(t, slowRequest{
+			RequestID: RequestIDFrom(r.Context()),
+			Operation: strings.TrimSpace(r.Method + " " + template),
+			Key:       pathVars(r)["key"],
+			Status:    rec.status,
+		})
+	})
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// slowLogHandler serves GET and DELETE /v1/slowlog.
+func slowLogHandler(w http.ResponseWriter, r *http.Request) {
+	if slowLog == nil {
+		http.Error(w, "Slow request log is not enabled", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		slowLog.Reset()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(slowLog.Entries())
+}
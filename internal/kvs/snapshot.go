@@ -0,0 +1,264 @@
+package kvs
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/**
+ * Snapshots.
+ *
+ * A snapshot is a JSON Lines stream: a snapshotHeader line followed by
+ * one snapshotRecord per key. Values are base64-encoded by encoding/json,
+ * so binary payloads survive. Records keep the modification and creation
+ * times of the keys, which a restore brings back. With encryption
+ * configured, keys and values are sealed and the key moves to the binary
+ * sealed_key field.
+ */
+const snapshotFormat = "kvs-snapshot/1"
+
+const snapshotEncryption = "aes-256-gcm"
+
+var (
+	snapshotKeyAD   = []byte("snapshot key")
+	snapshotValueAD = []byte("snapshot value")
+)
+
+type snapshotHeader struct {
+	Format   string    `json:"format"`
+	Sequence uint64    `json:"sequence"` // Последнее событие журнала, вошедшее в снимок
+	Created  time.Time `json:"created"`
+	Keys     int       `json:"keys"`
+
+	Encryption string `json:"encryption,omitempty"` // "aes-256-gcm" для зашифрованных снимков
+}
+
+type snapshotRecord struct {
+	Key       string     `json:"key"`
+	SealedKey []byte     `json:"sealed_key,omitempty"`
+	Value     []byte     `json:"value"`
+	Revision  uint64     `json:"revision"`
+	Expires   *time.Time `json:"expires,omitempty"`
+
+	ContentType string     `json:"content_type,omitempty"`
+	Modified    *time.Time `json:"modified,omitempty"`
+	Created     *time.Time `json:"created,omitempty"` // Нет в снимках старых версий
+}
+
+func writeSnapshot(w io.Writer, sequence uint64, entries []Entry, s *Sealer) error {
+	buffered := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buffered)
+
+	header := snapshotHeader{
+		Format:   snapshotFormat,
+		Sequence: sequence,
+		Created:  time.Now().UTC(),
+		Keys:     len(entries),
+	}
+
+	if s != nil {
+		header.Encryption = snapshotEncryption
+	}
+
+	if err := encoder.Encode(header); err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		record := snapshotRecord{
+			Key:         e.Key,
+			Value:       []byte(e.Value),
+			Revision:    e.Revision,
+			ContentType: e.ContentType,
+			Modified:    optionalTime(e.Modified),
+			Created:     optionalTime(e.Created),
+		}
+
+		if s != nil {
+			record.Key = ""
+			record.SealedKey = s.Seal([]byte(e.Key), snapshotKeyAD)
+			record.Value = s.Seal(record.Value, snapshotValueAD)
+		}
+
+		if !e.Expires.IsZero() {
+			expires := e.Expires.UTC()
+			record.Expires = &expires
+		}
+
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+
+	return buffered.Flush()
+}
+
+// readSnapshot decodes a snapshot made by writeSnapshot, skipping entries
+// that have expired since it was taken. Encrypted snapshots require s.
+func readSnapshot(r io.Reader, s *Sealer) (snapshotHeader, []Entry, error) {
+	decoder := json.NewDecoder(r)
+
+	var header snapshotHeader
+	if err := decoder.Decode(&header); err != nil {
+		return header, nil, fmt.Errorf("invalid snapshot header: %w", err)
+	}
+
+	if header.Format != snapshotFormat {
+		return header, nil, fmt.Errorf("unsupported snapshot format %q", header.Format)
+	}
+
+	switch header.Encryption {
+	case "":
+		s = nil // Снимок в открытом виде читается и при настроенном ключе
+	case snapshotEncryption:
+		if s == nil {
+			return header, nil, ErrorNoEncryptionKey
+		}
+	default:
+		return header, nil, fmt.Errorf("unsupported snapshot encryption %q", header.Encryption)
+	}
+
+	now := time.Now()
+	entries := make([]Entry, 0, header.Keys)
+
+	for {
+		var record snapshotRecord
+
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return header, nil, fmt.Errorf("invalid snapshot record %d: %w", len(entries)+1, err)
+		}
+
+		if s != nil {
+			key, err := s.Open(record.SealedKey, snapshotKeyAD)
+			if err != nil {
+				return header, nil, fmt.Errorf("invalid snapshot record %d: %w", len(entries)+1, err)
+			}
+
+			value, err := s.Open(record.Value, snapshotValueAD)
+			if err != nil {
+				return header, nil, fmt.Errorf("invalid snapshot record %d: %w", len(entries)+1, err)
+			}
+
+			record.Key, record.Value = string(key), value
+		}
+
+		entry := Entry{Key: record.Key, Value: string(record.Value), Revision: record.Revision, ContentType: record.ContentType}
+		if record.Modified != nil {
+			entry.Modified = *record.Modified
+		}
+
+		if record.Created != nil {
+			entry.Created = *record.Created
+		}
+
+		if record.Expires != nil {
+			if !now.Before(*record.Expires) {
+				continue
+			}
+			entry.Expires = *record.Expires
+		}
+
+		if entry.Revision == 0 {
+			entry.Revision = 1
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return header, entries, nil
+}
+
+// snapshotHandler serves GET /v1/snapshot. The sequence number is read
+// before the store is copied, so every logged event up to it is reflected
+// in the dump; replaying the log after that sequence over the snapshot
+// yields the current state. The same holds for the replication feed
+// position sent in the X-Replication headers.
+func snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	epoch, position := feed.position()
+	sequence := logger.LastSequence()
+	entries, err := store.Snapshot(r.Context())
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	w.Header().Set("X-Replication-Epoch", epoch)
+	w.Header().Set("X-Replication-Sequence", strconv.FormatUint(position, 10))
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="kvs-snapshot.jsonl"`)
+
+	writeSnapshot(w, sequence, entries, sealer)
+}
+
+// restoreHandler serves POST /v1/restore: it replaces the whole store
+// with the snapshot in the request body and records the change in the
+// transaction log so that it survives a restart.
+func restoreHandler(w http.ResponseWriter, r *http.Request) {
+	durable, err := syncWrite(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tooLarge := limitBody(w, r, config.Limits.MaxBodyBytes)
+	defer r.Body.Close()
+
+	_, entries, err := readSnapshot(r.Body, sealer)
+	if err != nil && tooLarge() {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	removed, err := store.ReplaceAll(loggedReplace(r.Context()), entries)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	recordReplaceAll(removed, entries)
+
+	if durable {
+		if err := logger.Sync(r.Context()); err != nil {
+			serverError(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"keys": len(entries), "removed": len(removed)})
+}
+
+// recordReplaceAll publishes the replacement of the store's contents
+// with entries, which the store has logged under a loggedReplace context,
+// removed being the keys it deleted.
+func recordReplaceAll(removed []string, entries []Entry) {
+	for _, key := range removed {
+		broker.Publish(ChangeEvent{Type: "delete", Key: key})
+	}
+
+	for _, e := range entries {
+		change := ChangeEvent{Type: "put", Key: e.Key, Value: e.Value, ContentType: e.ContentType}
+
+		if !e.Expires.IsZero() {
+			expires := e.Expires
+			change.Expires = &expires
+		}
+
+		broker.Publish(change)
+	}
+}
@@ -0,0 +1,199 @@
+//go:build sqlite
+
+package kvs
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	_ "modernc.org/sqlite"
+)
+
+/**
+ * SQLite database.
+ *
+ * A single file with one table holding every bucket, its rows ordered by
+ * bucket and key so that a scan is a range of the primary key. The file is
+ * in WAL mode, so that reads do not wait for writes, with synchronous=FULL
+ * so that every update commits with an fsync; updates take the write lock
+ * when they begin rather than when they first write, and wait up to
+ * sqliteBusyTimeout for another process holding it. Built only with the
+ * sqlite tag: go build -tags sqlite; the driver is pure Go and needs no cgo.
+ */
+const sqliteBusyTimeout = 5000 // Миллисекунд ожидания блокировки файла
+
+const sqliteScanPage = 256 // Строк одного запроса Scan
+
+type sqliteDB struct {
+	db *sql.DB
+}
+
+type sqliteTx struct {
+	conn *sql.Conn
+}
+
+// OpenSQLiteStore opens or creates the SQLite database at path and
+// returns the store on it.
+func OpenSQLiteStore(path string, compressAbove, historyDepth int, checksums bool) (*KVStore, error) {
+	dsn := fmt.Sprintf("%s?_pragma=busy_timeout(%d)&_pragma=journal_mode(WAL)&_pragma=synchronous(FULL)", path, sqliteBusyTimeout)
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store %s: %w", path, err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS kv (
+		bucket TEXT NOT NULL,
+		key    BLOB NOT NULL,
+		value  BLOB NOT NULL,
+		PRIMARY KEY (bucket, key)
+	) WITHOUT ROWID`)
+
+	var s *KVStore
+	if err == nil {
+		s, err = NewKVStore(sqliteDB{db}, compressAbove, historyDepth, checksums)
+	}
+
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open store %s: %w", path, err)
+	}
+
+	return s, nil
+}
+
+func (d sqliteDB) View(fn func(tx kvTx) error) error {
+	return d.run("BEGIN", fn, false)
+}
+
+func (d sqliteDB) Update(fn func(tx kvTx) error) error {
+	return d.run("BEGIN IMMEDIATE", fn, true)
+}
+
+// run calls fn in a transaction begun with begin on a connection of its
+// own, and commits it if commit is set and fn succeeds.
+func (d sqliteDB) run(begin string, fn func(tx kvTx) error, commit bool) error {
+	ctx := context.Background()
+
+	conn, err := d.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, begin); err != nil {
+		return err
+	}
+
+	if err := fn(sqliteTx{conn}); err != nil || !commit {
+		if _, rerr := conn.ExecContext(ctx, "ROLLBACK"); rerr != nil && err == nil {
+			err = rerr
+		}
+		return err
+	}
+
+	_, err = conn.ExecContext(ctx, "COMMIT")
+
+	return err
+}
+
+func (d sqliteDB) Close() error {
+	return d.db.Close()
+}
+
+func (t sqliteTx) Get(bucket, key []byte) ([]byte, error) {
+	var value []byte
+
+	err := t.conn.QueryRowContext(context.Background(), "SELECT value FROM kv WHERE bucket = ? AND key = ?", string(bucket), key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+
+	if err == nil && value == nil {
+		value = []byte{} // Пустое значение - не отсутствующий ключ
+	}
+
+	return value, err
+}
+
+func (t sqliteTx) Put(bucket, key, value []byte) error {
+	if value == nil {
+		value = []byte{}
+	}
+
+	_, err := t.conn.ExecContext(context.Background(), "INSERT OR REPLACE INTO kv (bucket, key, value) VALUES (?, ?, ?)", string(bucket), key, value)
+
+	return err
+}
+
+func (t sqliteTx) Delete(bucket, key []byte) error {
+	_, err := t.conn.ExecContext(context.Background(), "DELETE FROM kv WHERE bucket = ? AND key = ?", string(bucket), key)
+	return err
+}
+
+func (t sqliteTx) Clear(bucket []byte) error {
+	_, err := t.conn.ExecContext(context.Background(), "DELETE FROM kv WHERE bucket = ?", string(bucket))
+	return err
+}
+
+// Scan reads the rows a page at a time, so that fn may write to the
+// database between pages without a query open on the connection.
+func (t sqliteTx) Scan(bucket, prefix, from []byte, fn func(k, v []byte) error) error {
+	if from == nil {
+		from = append([]byte{}, prefix...) // Не nil: NULL не сравнивается ни с одним ключом
+	}
+
+	for {
+		page, err := t.scanPage(bucket, from)
+		if err != nil {
+			return err
+		}
+
+		for _, row := range page {
+			if !bytes.HasPrefix(row[0], prefix) {
+				return nil
+			}
+
+			if err := fn(row[0], row[1]); errors.Is(err, errStopScan) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+
+		if len(page) < sqliteScanPage {
+			return nil
+		}
+
+		from = append(page[len(page)-1][0], 0) // Следующий ключ после последнего
+	}
+}
+
+// scanPage returns up to sqliteScanPage rows of the bucket from the key
+// from on, as key and value pairs.
+func (t sqliteTx) scanPage(bucket, from []byte) ([][2][]byte, error) {
+	rows, err := t.conn.QueryContext(context.Background(), "SELECT key, value FROM kv WHERE bucket = ? AND key >= ? ORDER BY key LIMIT ?", string(bucket), from, sqliteScanPage)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var page [][2][]byte
+	for rows.Next() {
+		var k, v []byte
+		if err := rows.Scan(&k, &v); err != nil {
+			return nil, err
+		}
+
+		if v == nil {
+			v = []byte{}
+		}
+
+		page = append(page, [2][]byte{k, v})
+	}
+
+	return page, rows.Err()
+}
@@ -0,0 +1,11 @@
+//go:build !sqlite
+
+package kvs
+
+import "errors"
+
+// OpenSQLiteStore fails in builds without the sqlite tag, which leave the
+// SQLite driver out.
+func OpenSQLiteStore(path string, compressAbove, historyDepth int, checksums bool) (Store, error) {
+	return nil, errors.New("the sqlite store backend is not built in; build with -tags sqlite")
+}
@@ -0,0 +1,68 @@
+//go:build sqlite
+
+package kvs
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestSQLiteStore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "store.db")
+
+	s, err := OpenSQLiteStore(path, 0, 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2*sqliteScanPage; i++ {
+		if _, err := s.Put(ctx, "k"+strconv.Itoa(1000+i), strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := s.Put(ctx, "empty", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Delete(ctx, "k1000"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Close(7); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = OpenSQLiteStore(path, 0, 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close(0)
+
+	if got := s.AppliedSequence(); got != 7 {
+		t.Fatalf("AppliedSequence after reopening = %d, want 7", got)
+	}
+
+	if value, err := s.Get(ctx, "empty"); err != nil || value != "" {
+		t.Fatalf("empty is %q (%v), want an empty value", value, err)
+	}
+
+	if _, err := s.Get(ctx, "k1000"); !errors.Is(err, ErrorNoSuchKey) {
+		t.Fatalf("deleted key returned %v, want ErrorNoSuchKey", err)
+	}
+
+	entries, more, err := s.List(ctx, "k", "", 4*sqliteScanPage)
+	if err != nil || more || len(entries) != 2*sqliteScanPage-1 {
+		t.Fatalf("listed %d keys (more %v, %v), want %d", len(entries), more, err, 2*sqliteScanPage-1)
+	}
+
+	for i, e := range entries {
+		if want := "k" + strconv.Itoa(1001+i); e.Key != want {
+			t.Fatalf("key %d is %q, want %q", i, e.Key, want)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package kvs
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+ * Server statistics.
+ *
+ * GET /v1/stats reports the size of the store, the state of the
+ * transaction log and how many requests each API operation has served,
+ * on a replica its replication lag and with webhooks their deliveries,
+ * as a single JSON document for dashboards that do not scrape Prometheus.
+ * The memory of the keys is tracked as they are written in cache mode or
+ * with a memory limit, and estimated from the key count otherwise.
+ * The event rate is averaged over the last minute from sequence numbers
+ * sampled in the background.
+ */
+const (
+	statsSampleInterval = 5 * time.Second
+	statsRateWindow     = time.Minute
+)
+
+var startTime = time.Now()
+
+var operations operationCounter
+
+var eventSamples eventRate
+
+type serverStats struct {
+	Keys           int               `json:"keys"`
+	ValueBytes     int64             `json:"value_bytes"`
+	MemoryBytes    int64             `json:"memory_bytes"`               // Примерная память ключей
+	MaxMemory      int64             `json:"max_memory_bytes,omitempty"` // Только с ограничением памяти
+	Evictions      uint64            `json:"evictions,omitempty"`
+	LastSequence   uint64            `json:"last_sequence"`
+	UptimeSeconds  int64             `json:"uptime_seconds"`
+	StartupMillis  int64             `json:"startup_ms"`          // От запуска до окончания воспроизведения журнала
+	ReplayedEvents uint64            `json:"replayed_events"`     // Событий воспроизведено при запуске
+	LogBytes       int64             `json:"log_bytes,omitempty"` // Только для журналов, реализующих LogSizer
+	EventsPerSec   float64           `json:"events_per_sec"`
+	LogFailures    uint64            `json:"log_write_failures"`  // Неудачных записей в журнал с запуска
+	LogError       string            `json:"log_error,omitempty"` // Пока журнал не пишет
+	LogQueueDepth  int               `json:"log_queue_depth"`
+	LogQueueCap    int               `json:"log_queue_capacity,omitempty"` // Только для журналов, реализующих LogQueue
+	LogRejections  uint64            `json:"log_queue_rejections"`         // Записей отклонено из-за полной очереди
+	Operations     map[string]uint64 `json:"operations"`
+
+	ChecksumMismatches uint64 `json:"checksum_mismatches,omitempty"` // Значений с неверной контрольной суммой при чтении
+	ChecksumRepairs    uint64 `json:"checksum_repairs,omitempty"`    // Из них восстановлено из журнала
+
+	Replication *replicationStats `json:"replication,omitempty"` // Только на репликах
+	Webhooks    *webhookStats     `json:"webhooks,omitempty"`    // Только с настроенными целями
+	Upstream    *upstreamStats    `json:"upstream,omitempty"`    // Только в режиме кэша источника
+}
+
+// LogSizer is implemented by transaction loggers that can tell how much
+// space their log takes.
+type LogSizer interface {
+	LogSize() (int64, error)
+}
+
+// statsHandler serves GET /v1/stats.
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	sequence := logger.LastSequence()
+
+	stats := serverStats{
+		LastSequence:   sequence,
+		UptimeSeconds:  int64(now.Sub(startTime).Seconds()),
+		StartupMillis:  time.Duration(startupDuration.Load()).Milliseconds(),
+		ReplayedEvents: replayedEvents.Load(),
+		EventsPerSec:   eventSamples.rate(now, sequence),
+		LogFailures:    logHealth.failures.Load(),
+		LogRejections:  logQueueRejections.Load(),
+		Operations:     operations.counts(),
+
+		ChecksumMismatches: checksumMismatches.Load(),
+		ChecksumRepairs:    checksumRepairs.Load(),
+	}
+
+	if err := logHealth.Err(); err != nil {
+		stats.LogError = err.Error()
+	}
+
+	if replica != nil {
+		replication := replica.stats()
+		stats.Replication = &replication
+	}
+
+	stats.LogQueueDepth, stats.LogQueueCap = logQueue()
+
+	if webhooks != nil {
+		delivery := webhooks.stats()
+		stats.Webhooks = &delivery
+	}
+
+	if u := upstreamStore(); u != nil {
+		cache := u.stats()
+		stats.Upstream = &cache
+	}
+
+	var err error
+	if stats.Keys, stats.ValueBytes, err = store.Stats(r.Context()); err != nil {
+		serverError(w, err)
+		return
+	}
+
+	stats.MemoryBytes = stats.ValueBytes + int64(stats.Keys)*memoryOverhead
+	stats.MaxMemory = config.Store.MaxMemory
+
+	if e := evictingStore(); e != nil {
+		stats.MemoryBytes = e.Memory()
+		stats.Evictions = e.Evictions()
+	}
+
+	if s, ok := unwrapLogger(logger).(LogSizer); ok {
+		size, err := s.LogSize()
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+		stats.LogBytes = size
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// LogSize returns the size of the active log file and its segments.
+func (l *FileTransactionLogger) LogSize() (int64, error) {
+	segments, _, err := listSegments(l.filename)
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for _, name := range append(segments, l.filename) {
+		info, err := os.Stat(name)
+		if err != nil {
+			return 0, err
+		}
+		size += info.Size()
+	}
+
+	return size, nil
+}
+
+// operationCounter counts requests by the name of the route they match.
+// The counters are created up front from the named routes, so the map is
+// only read while serving.
+type operationCounter map[string]*atomic.Uint64
+
+func newOperationCounter(router *Router) operationCounter {
+	c := make(operationCounter)
+
+	for _, name := range router.Names() {
+		c[name] = new(atomic.Uint64)
+	}
+
+	return c
+}
+
+func (c operationCounter) counts() map[string]uint64 {
+	counts := make(map[string]uint64, len(c))
+	for name, n := range c {
+		counts[name] = n.Load()
+	}
+
+	return counts
+}
+
+func (c operationCounter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := currentRoute(r); route != nil {
+			if n, ok := c[route.name]; ok {
+				n.Add(1)
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+type sequenceSample struct {
+	at       time.Time
+	sequence uint64
+}
+
+// eventRate keeps the sequence numbers sampled during the rate window.
+type eventRate struct {
+	mu      sync.Mutex
+	samples []sequenceSample // От старых к новым
+}
+
+func (e *eventRate) record(now time.Time, sequence uint64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.samples = append(e.samples, sequenceSample{now, sequence})
+
+	for len(e.samples) > 1 && now.Sub(e.samples[0].at) > statsRateWindow {
+		e.samples = e.samples[1:]
+	}
+}
+
+// rate returns the events logged per second since the oldest sample.
+func (e *eventRate) rate(now time.Time, sequence uint64) float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(e.samples) == 0 {
+		return 0
+	}
+
+	oldest := e.samples[0]
+	elapsed := now.Sub(oldest.at).Seconds()
+	if elapsed <= 0 || sequence < oldest.sequence {
+		return 0
+	}
+
+	return float64(sequence-oldest.sequence) / elapsed
+}
+
+// runStatsSampler samples the last sequence number of the transaction log
+// every interval. It is started once replay has completed.
+func runStatsSampler(interval time.Duration) {
+	eventSamples.record(time.Now(), logger.LastSequence())
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		eventSamples.record(now, logger.LastSequence())
+	}
+}
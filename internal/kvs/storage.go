@@ -0,0 +1,2238 @@
+package kvs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var config = DefaultConfig()
+
+// args are the command line arguments reloadConfig resolves the
+// configuration from again.
+var args []string
+
+// current is the configuration the settings that can be reloaded are read
+// from; reloadConfig swaps in a new one.
+var current atomic.Pointer[Config]
+
+var logger TransactionLogger
+
+var store Store
+
+// background stops and waits for the goroutines startLog runs on the store
+// and the log, which closeStore ends before it closes the log they write.
+var background struct {
+	stop context.CancelFunc
+	wg   sync.WaitGroup
+}
+
+var ErrorNoSuchKey = errors.New("No such key")
+
+var ErrorRevisionMismatch = errors.New("Revision mismatch")
+
+var ErrorKeyExists = errors.New("Key already exists")
+
+var ErrorInvalidIfMatch = errors.New("Invalid If-Match")
+
+var ErrorRevisionRequired = errors.New("Write to an existing key needs If-Match with its revision")
+
+var ErrorKeyTooLong = errors.New("Key too long")
+
+var ErrorValueTooLarge = errors.New("Value too large")
+
+var ErrorNotInteger = errors.New("Value is not an integer")
+
+var ErrorOverflow = errors.New("Increment would overflow")
+
+var ErrorLoggerStopped = errors.New("Transaction logger stopped")
+
+// NoExpiration is reported by TTL for keys that never expire.
+const NoExpiration time.Duration = -1
+
+// maxContentTypeLength bounds the Content-Type recorded with a value.
+const maxContentTypeLength = 255
+
+// Main runs the server with the command line arguments, without the name
+// of the program, until SIGINT or SIGTERM. It exits the process if the
+// server cannot start or stop cleanly.
+func Main(arguments []string) {
+	c, err := LoadConfig(arguments)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+
+	if err != nil {
+		fatal("invalid configuration", err)
+	}
+
+	args = arguments
+
+	logs, err := newLogger(c.Log)
+	if err != nil {
+		fatal("invalid log configuration", err)
+	}
+
+	slog.SetDefault(logs)
+
+	if c.VerifyLog {
+		useConfig(c)
+
+		if err := loadSealer(c.TransactionLog.Encryption); err != nil {
+			fatal("invalid encryption configuration", err)
+		}
+
+		os.Exit(runLogVerification(c.TransactionLog, c.RepairLog))
+	}
+
+	server, err := NewServer(c)
+	if err != nil {
+		fatal("failed to start the server", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	context.AfterFunc(ctx, stop) // Повторный сигнал завершит процесс немедленно
+
+	if err := server.Run(ctx); err != nil {
+		fatal("server failed", err)
+	}
+}
+
+/**
+ * Server.
+ *
+ * A Server is built by NewServer from its configuration: the store and
+ * what is built on it, the cluster, the router with its middleware, the
+ * authentication, audit log, ACLs and rate limits. Run then listens,
+ * replays the transaction log and serves until its context is done. The
+ * handlers share the state of the process, which the server sets up, so
+ * there can be only one Server in a process; the storage package opens
+ * stores of its own without one.
+ */
+type Server struct {
+	config    *Config
+	router    *Router
+	tlsConfig *tls.Config
+}
+
+var ErrorServerExists = errors.New("Server already created in this process")
+
+var serverCreated atomic.Bool
+
+// NewServer builds the server of c. It returns ErrorServerExists if the
+// process already has one.
+func NewServer(c *Config) (*Server, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	if !serverCreated.CompareAndSwap(false, true) {
+		return nil, ErrorServerExists
+	}
+
+	useConfig(c)
+
+	if err := loadSealer(config.TransactionLog.Encryption); err != nil {
+		return nil, fmt.Errorf("invalid encryption configuration: %w", err)
+	}
+
+	if err := openStore(config); err != nil {
+		return nil, fmt.Errorf("invalid store configuration: %w", err)
+	}
+
+	if err := initializeCluster(config.Cluster); err != nil {
+		return nil, fmt.Errorf("invalid cluster configuration: %w", err)
+	}
+
+	var err error
+
+	router := NewRouter()
+	router.Use(requestLogger)
+	router.Use(separateAdmin)
+	router.Use(normalizeRequestKeys) // До слоёв, которые проверяют ключ или маршрутизируют по нему
+
+	router.HandleFunc("/v1/key/{key}", keyValuePutHandler).Methods("PUT").Name("put")
+	router.HandleFunc("/v1/key/{key}", keyValueGetHandler).Methods("GET", "HEAD").Name("get")
+	router.HandleFunc("/v1/key/{key}", keyValueDeleteHandler).Methods("DELETE").Name("delete")
+	router.HandleFunc("/v1/key/{key}/ttl", keyValueTTLHandler).Methods("GET").Name("ttl")
+	router.HandleFunc("/v1/key/{key}/meta", keyMetaHandler).Methods("GET").Name("meta")
+	router.HandleFunc("/v1/key/{key}/incr", keyValueIncrHandler).Methods("POST").Name("incr")
+	router.HandleFunc("/v1/key/{key}/append", keyValueAppendHandler).Methods("POST").Name("append")
+	router.HandleFunc("/v1/key/{key}/rename", keyRenameHandler).Methods("POST").Name("rename")
+	router.HandleFunc("/v1/key/{key}/copy", keyCopyHandler).Methods("POST").Name("copy")
+	router.HandleFunc("/v1/key/{key}/history", keyHistoryHandler).Methods("GET").Name("history")
+	router.HandleFunc("/v1/key/{key}/undelete", keyUndeleteHandler).Methods("POST").Name("undelete")
+	router.HandleFunc("/v2/key/{key}", v2PutHandler).Methods("PUT").Name("v2_put")
+	router.HandleFunc("/v2/key/{key}", v2GetHandler).Methods("GET").Name("v2_get")
+	router.HandleFunc("/v2/key/{key}", keyValueDeleteHandler).Methods("DELETE").Name("v2_delete")
+	router.HandleFunc("/v1/keys", keysListHandler).Methods("GET").Name("list")
+	router.HandleFunc("/v1/keys", keysDeleteHandler).Methods("DELETE").Name("delete_keys")
+	router.HandleFunc("/v1/range", rangeHandler).Methods("GET").Name("range")
+	router.HandleFunc("/v1/dir/", dirHandler).Methods("GET").Name("dir")
+	router.HandleFunc("/v1/index/{field}", indexLookupHandler).Methods("GET").Name("index")
+	router.HandleFunc("/v1/batch", batchHandler).Methods("POST").Name("batch")
+	router.HandleFunc("/v1/mget", mgetHandler).Methods("POST").Name("mget")
+	router.HandleFunc("/v1/txn", txnHandler).Methods("POST").Name("txn")
+	router.HandleFunc("/v1/snapshot", snapshotHandler).Methods("GET").Name("snapshot")
+	router.HandleFunc("/v1/restore", restoreHandler).Methods("POST").Name("restore")
+	router.HandleFunc("/v1/export", exportHandler).Methods("GET").Name("export")
+	router.HandleFunc("/v1/import", importHandler).Methods("POST").Name("import")
+	router.HandleFunc("/v1/compact", compactHandler).Methods("POST").Name("compact")
+	router.HandleFunc("/v1/read-only", readOnlyHandler).Methods("GET", "PUT").Name("read_only")
+	router.HandleFunc("/v1/lock/{name}", lockAcquireHandler).Methods("POST").Name("lock")
+	router.HandleFunc("/v1/lock/{name}", lockGetHandler).Methods("GET").Name("lock_info")
+	router.HandleFunc("/v1/lock/{name}", lockReleaseHandler).Methods("DELETE").Name("unlock")
+	router.HandleFunc("/v1/lock/{name}/renew", lockRenewHandler).Methods("POST").Name("renew_lock")
+	router.HandleFunc("/v1/watch/{key}", keyWatchHandler).Methods("GET").Name("watch")
+	router.HandleFunc("/v1/watch", prefixWatchHandler).Methods("GET").Name("watch_prefix")
+	router.HandleFunc("/v1/events", eventsHandler).Methods("GET").Name("events")
+	router.HandleFunc("/v1/usage", usageHandler).Methods("GET").Name("usage")
+	router.HandleFunc("/v1/stats", statsHandler).Methods("GET").Name("stats")
+	router.HandleFunc("/v1/stats/hotkeys", hotKeysHandler).Methods("GET").Name("hotkeys")
+	router.HandleFunc("/v1/slowlog", slowLogHandler).Methods("GET", "DELETE").Name("slowlog")
+	router.HandleFunc("/v1/reload", reloadHandler).Methods("POST").Name("reload")
+	router.HandleFunc("/v1/audit", auditHandler).Methods("GET").Name("audit")
+	router.HandleFunc("/v1/verify-log", verifyLogHandler).Methods("GET").Name("verify_log")
+	router.HandleFunc("/v1/migration", migrationHandler).Methods("GET").Name("migration")
+	router.HandleFunc("/v1/migration/cutover", cutoverHandler).Methods("POST").Name("migration_cutover")
+	router.HandleFunc("/v1/schedule", scheduleHandler).Methods("GET").Name("schedule")
+	router.HandleFunc("/v1/schedule/{key}", unscheduleHandler).Methods("DELETE").Name("unschedule")
+	router.HandleFunc("/debug/pprof/", pprofHandler).Methods("GET", "POST").Name("pprof")
+	router.HandleFunc("/debug/vars", expvar.Handler().ServeHTTP).Methods("GET").Name("expvar")
+	router.HandleFunc("/debug/goroutines", goroutinesHandler).Methods("GET").Name("goroutines")
+	router.HandleFunc("/v1/replication", replicationHandler).Methods("GET").Name("replication")
+	router.HandleFunc("/v1/replication/snapshot", snapshotHandler).Methods("GET").Name("replication_snapshot")
+	router.HandleFunc("/v1/cluster", clusterHandler).Methods("GET").Name("cluster")
+	router.HandleFunc("/v1/openapi.json", openAPIHandler(router)).Methods("GET").Name("openapi")
+
+	operations = newOperationCounter(router)
+	publishVars()
+	router.Use(operations.Middleware)
+
+	if config.HotKeys.Tracked > 0 {
+		hotKeys = NewHotKeys(config.HotKeys.Tracked)
+		router.Use(hotKeys.Middleware)
+
+		if config.HotKeys.Decay > 0 {
+			go hotKeys.runDecay(config.HotKeys.Decay)
+		}
+	}
+
+	router.Use(withDeadline(config.RequestTimeout))
+
+	if tracer != nil {
+		router.Use(tracer.Middleware)
+	}
+
+	if slowLog != nil {
+		router.Use(slowLog.Middleware) // До readOnlyGate: ожидание очереди журнала тоже учитывается
+	}
+
+	if auth, err = newAuthenticator(config.Auth); err != nil {
+		return nil, fmt.Errorf("invalid authentication configuration: %w", err)
+	}
+
+	if auth != nil {
+		router.Use(auth.Middleware)
+	}
+
+	if config.Audit.File != "" {
+		if audit, err = OpenAuditLog(config.Audit); err != nil {
+			return nil, fmt.Errorf("failed to open the audit log: %w", err)
+		}
+
+		router.Use(audit.Middleware) // До проверки прав: отказы тоже записываются
+	}
+
+	if auth != nil {
+		router.Use(requirePermission)
+	}
+
+	if config.Auth.ACL.Enabled {
+		acl = newACL(config.Auth.ACL)
+		router.Use(acl.Middleware)
+	}
+
+	if limiter, err = newRateLimiter(config.RateLimit); err != nil {
+		return nil, fmt.Errorf("invalid rate limit configuration: %w", err)
+	}
+
+	router.Use(limiter.Middleware) // После аутентификации: клиент известен
+
+	router.Use(clusterRedirect) // До readOnlyGate: запись на чужой узел перенаправляется
+	router.Use(readOnlyGate)
+	router.Use(sessionConsistency) // После readOnlyGate: реплика сразу отклоняет запись
+
+	if idempotency := newIdempotencyCache(config.Idempotency); idempotency != nil {
+		router.Use(idempotency.Middleware) // Последним: отказы предыдущих слоёв не запоминаются
+	}
+
+	tlsConfig, err := newTLSConfig(config.TLS)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLS configuration: %w", err)
+	}
+
+	return &Server{config: c, router: router, tlsConfig: tlsConfig}, nil
+}
+
+// Run listens on the addresses of the configuration, replays the
+// transaction log and serves until ctx is done, then shuts the listeners
+// down and closes the store. It returns the error that stopped it.
+func (s *Server) Run(ctx context.Context) error {
+	c, router, tlsConfig := s.config, s.router, s.tlsConfig
+
+	failed := make(chan error, 2) // Отказы основного и административного серверов
+
+	server := newHTTPServer(c.HTTP, c.Listen, withCORS(c.CORS, withJSONErrors(withProbes(router))), tlsConfig)
+	server.RegisterOnShutdown(broker.Close)            // Завершить открытые потоки watch
+	server.RegisterOnShutdown(func() { feed.Close() }) // feed создаётся после воспроизведения журнала
+
+	listener, err := listenHTTP(c.Listen, c.HTTP.MaxConnections)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+
+	go serveHTTP(server, listener, failed)
+
+	var admin *http.Server
+	if c.Admin.Listen != "" {
+		admin = newHTTPServer(c.HTTP, c.Admin.Listen, withProbes(onAdminListener(router)), tlsConfig)
+
+		adminListener, err := listenHTTP(c.Admin.Listen, 0) // Без предела: доступен и при исчерпании основного
+		if err != nil {
+			server.Close()
+			return fmt.Errorf("failed to listen on the admin address: %w", err)
+		}
+
+		go serveHTTP(admin, adminListener, failed)
+	}
+
+	go reloadOnSignal()
+
+	// Пока журнал воспроизводится, API отвечает 503 (кроме чтения ключей
+	// с serve_during_replay), а /healthz - 200.
+	if err := startLog(ctx, c); err != nil {
+		return fmt.Errorf("failed to initialize transaction log: %w", err)
+	}
+
+	if c.Replication.Primary != "" {
+		replica = NewReplica(c.Replication)
+		go replica.run(ctx)
+	}
+
+	if acl != nil {
+		if err := acl.load(ctx); err != nil {
+			return fmt.Errorf("failed to load ACLs: %w", err)
+		}
+
+		go acl.run(ctx)
+	}
+
+	go runStatsSampler(statsSampleInterval)
+
+	var resp *RESPServer
+	if c.RESP.Listen != "" {
+		if resp, err = ListenRESP(c.RESP.Listen, tlsConfig, auth); err != nil {
+			return fmt.Errorf("failed to start RESP listener: %w", err)
+		}
+	}
+
+	var memcached *MemcachedServer
+	if c.Memcached.Listen != "" {
+		if memcached, err = ListenMemcached(c.Memcached.Listen, tlsConfig); err != nil {
+			return fmt.Errorf("failed to start memcached listener: %w", err)
+		}
+	}
+
+	var grpcServer *GRPCServer
+	if c.GRPC.Listen != "" {
+		if grpcServer, err = ListenGRPC(c.GRPC.Listen, tlsConfig, auth); err != nil {
+			return fmt.Errorf("failed to start gRPC listener: %w", err)
+		}
+	}
+
+	startupDuration.Store(int64(time.Since(startTime)))
+	ready.Store(true)
+	slog.Info("ready", "sequence", logger.LastSequence(), "startup", time.Duration(startupDuration.Load()).String())
+
+	var failure error
+
+	select {
+	case <-ctx.Done():
+	case err := <-failed:
+		failure = fmt.Errorf("http server failed: %w", err)
+	}
+
+	slog.Info("shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), c.ShutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("http server shutdown failed", "error", err)
+	}
+
+	if admin != nil {
+		if err := admin.Shutdown(shutdownCtx); err != nil {
+			slog.Error("admin server shutdown failed", "error", err)
+		}
+	}
+
+	if resp != nil {
+		if err := resp.Close(); err != nil {
+			slog.Error("resp server shutdown failed", "error", err)
+		}
+	}
+
+	if memcached != nil {
+		if err := memcached.Close(); err != nil {
+			slog.Error("memcached server shutdown failed", "error", err)
+		}
+	}
+
+	if grpcServer != nil {
+		if err := grpcServer.Close(shutdownCtx); err != nil {
+			slog.Error("grpc server shutdown failed", "error", err)
+		}
+	}
+
+	if audit != nil {
+		if err := audit.Close(); err != nil {
+			slog.Error("audit log close failed", "error", err)
+		}
+	}
+
+	if err := closeStore(); err != nil {
+		return fmt.Errorf("failed to close the store: %w", err)
+	}
+
+	return failure
+}
+
+// serveHTTP serves server on l, with TLS if it is configured, and sends
+// the error that stops it to failed unless it was shut down.
+func serveHTTP(server *http.Server, l net.Listener, failed chan<- error) {
+	var err error
+	if server.TLSConfig != nil {
+		err = server.ServeTLS(l, "", "") // Сертификаты заданы в TLSConfig
+	} else {
+		err = server.Serve(l)
+	}
+
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		failed <- err
+	}
+}
+
+// useConfig makes c the configuration of the process.
+func useConfig(c *Config) {
+	config = c
+	current.Store(c)
+
+	keyPattern, _ = c.Keys.compile() // Проверен при загрузке
+}
+
+// loadSealer sets up the encryption of the transaction log, if c
+// configures it.
+func loadSealer(c EncryptionConfig) error {
+	var err error
+
+	sealer, err = newLogSealer(c)
+	return err
+}
+
+// newLogSealer returns the sealer of the encryption c configures, or nil
+// without one.
+func newLogSealer(c EncryptionConfig) (*Sealer, error) {
+	key, err := loadEncryptionKey(c)
+	if err != nil || key == nil {
+		return nil, err
+	}
+
+	return NewSealer(key)
+}
+
+// openStore creates the store of c and what is built on it: the tracer of
+// its calls, the slow request log timing them, the migration to another
+// backend, and the broker of changes with the webhooks it notifies.
+func openStore(c *Config) error {
+	var err error
+
+	tracer = NewTracer(c.Tracing)
+	slowLog = NewSlowLog(c.SlowLog)
+
+	if store, err = newStore(c.Store); err != nil {
+		return err
+	}
+
+	if migration, err = newMigration(c.Migration); err != nil {
+		return fmt.Errorf("invalid migration configuration: %w", err)
+	}
+
+	if migration != nil {
+		store = migration.wrap(store)
+	}
+
+	broker = NewBroker(c.Watch.BufferSize)
+
+	if webhooks, err = newWebhooks(c.Webhooks); err != nil {
+		return fmt.Errorf("invalid webhook configuration: %w", err)
+	}
+
+	if webhooks != nil {
+		broker.Listen(webhooks.Notify)
+	}
+
+	return nil
+}
+
+// startLog replays the transaction log into the store, starts the
+// migration, and runs the reaper of expired keys, the scheduled operations
+// and the snapshots of the log until ctx is done or closeStore is called.
+func startLog(ctx context.Context, c *Config) error {
+	if err := initializeTransactionLog(); err != nil {
+		return err
+	}
+
+	if migration != nil {
+		if err := migration.start(ctx); err != nil {
+			return fmt.Errorf("failed to start migration: %w", err)
+		}
+	}
+
+	if c.ReadOnly {
+		readOnly.Store(true) // Настройка важнее состояния из журнала
+	}
+
+	ctx, background.stop = context.WithCancel(ctx)
+
+	runBackground(func() { runReaper(ctx, store, c.Store.ReapInterval, recordExpiration) })
+	runBackground(func() { scheduler.run(ctx) })
+
+	if l, ok := unwrapLogger(logger).(*FileTransactionLogger); ok && c.TransactionLog.Snapshot.enabled() {
+		relog := func() int { return scheduler.logTo(logger) }
+		runBackground(func() { runSnapshots(ctx, l, store, c.TransactionLog.Snapshot, snapshotPath(c.TransactionLog), relog) })
+	}
+
+	return nil
+}
+
+// runBackground runs fn in a goroutine that closeStore waits for.
+func runBackground(fn func()) {
+	background.wg.Add(1)
+
+	go func() {
+		defer background.wg.Done()
+		fn()
+	}()
+}
+
+// closeStore stops the background work of startLog, flushes and closes
+// the transaction log, then the store and the store migrated to, which
+// record the last sequence they hold.
+func closeStore() error {
+	if background.stop != nil {
+		background.stop()
+	}
+
+	background.wg.Wait() // Ни одно истечение срока не попадёт в закрытый журнал
+
+	if webhooks != nil {
+		webhooks.Close()
+	}
+
+	defer tracer.Close()
+
+	if err := logger.Close(); err != nil {
+		return fmt.Errorf("failed to close transaction log: %w", err)
+	}
+
+	if p, ok := unwrapStore(store).(PersistentStore); ok {
+		if err := p.Close(logger.LastSequence()); err != nil {
+			return err
+		}
+	}
+
+	if migration != nil {
+		if err := migration.close(logger.LastSequence()); err != nil {
+			return fmt.Errorf("failed to close migration store: %w", err)
+		}
+	}
+
+	return nil
+}
+
+/**
+ * Http handlers.
+ */
+func keyValuePutHandler(w http.ResponseWriter, r *http.Request) {
+	vars := pathVars(r)
+	key := vars["key"]
+
+	if err := validateKey(key); err != nil {
+		keyError(w, err)
+		return
+	}
+
+	durable, err := syncWrite(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	contentType, err := parseContentType(r.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ttl := current.Load().Store.DefaultTTL // Без ?ttl= действует срок по умолчанию
+	if raw := r.URL.Query().Get("ttl"); raw != "" {
+		ttl, err = time.ParseDuration(raw)
+		if err != nil || ttl <= 0 {
+			http.Error(w, "Invalid ttl", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tooLarge := limitBody(w, r, config.Limits.MaxValueBytes)
+	defer r.Body.Close()
+
+	encoding := r.Header.Get("Content-Encoding")
+
+	body, err := decodeContent(r.Body, encoding)
+	if errors.Is(err, ErrorUnsupportedEncoding) {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var value []byte
+	if err == nil {
+		value, err = io.ReadAll(io.LimitReader(body, config.Limits.MaxValueBytes+1)) // Предел после распаковки
+	}
+
+	if (err != nil && tooLarge()) || int64(len(value)) > config.Limits.MaxValueBytes {
+		http.Error(w, ErrorValueTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if err != nil && body != r.Body { // Повреждённое сжатое тело
+		http.Error(w, fmt.Sprintf("Invalid %s body: %v", encoding, err), http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	deadline := expiry(ttl)
+
+	ctx := loggedPut(r.Context(), key, string(value), contentType, deadline)
+
+	revision, err := conditionalPut(r.WithContext(ctx), key, string(value))
+	if status := preconditionStatus(err); status != 0 {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	recordPut(ctx, key, string(value), contentType, deadline)
+
+	if durable {
+		if err := logger.Sync(r.Context()); err != nil {
+			serverError(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("ETag", formatETag(revision))
+	w.Header().Set("Last-Modified", writeTime(r.Context(), key, revision).UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// conditionalPut stores value under key as the preconditions of r allow:
+// with If-None-Match: * only if the key does not exist, failing with
+// ErrorKeyExists; with If-Match: * only if it exists, failing with
+// ErrorNoSuchKey; and with If-Match: "<revision>" only if it has that
+// revision, failing with ErrorRevisionMismatch. With conflicts set to
+// "reject", a write without a revision to base it on, whether without
+// If-Match or with If-Match: *, only creates the key, failing with
+// ErrorRevisionRequired if it exists, so that no writer replaces a
+// revision it has not seen.
+func conditionalPut(r *http.Request, key, value string) (uint64, error) {
+	ctx := r.Context()
+
+	if r.Header.Get("If-None-Match") == "*" {
+		revision, err := store.CompareAndPut(ctx, key, value, 0) // Версия 0: ключа нет
+		if errors.Is(err, ErrorRevisionMismatch) {
+			return 0, ErrorKeyExists
+		}
+		return revision, err
+	}
+
+	ifMatch := r.Header.Get("If-Match")
+
+	if config.Store.Conflicts == "reject" && (ifMatch == "" || ifMatch == "*") {
+		revision, err := store.CompareAndPut(ctx, key, value, 0)
+		if errors.Is(err, ErrorRevisionMismatch) {
+			return 0, ErrorRevisionRequired
+		}
+		return revision, err
+	}
+
+	switch ifMatch {
+	case "":
+		return store.Put(ctx, key, value)
+	case "*":
+		return putExisting(ctx, key, value)
+	default:
+		expected, ok := parseETag(ifMatch)
+		if !ok {
+			return 0, ErrorInvalidIfMatch
+		}
+		return store.CompareAndPut(ctx, key, value, expected)
+	}
+}
+
+const putExistingRetries = 16 // Попыток записи при одновременном изменении ключа
+
+// putExisting stores value under key only if the key exists, otherwise it
+// fails with ErrorNoSuchKey.
+func putExisting(ctx context.Context, key, value string) (uint64, error) {
+	var err error
+
+	for i := 0; i < putExistingRetries; i++ {
+		var entry Entry
+		if entry, err = store.GetEntry(ctx, key); err != nil {
+			return 0, err
+		}
+
+		var revision uint64
+		if revision, err = store.CompareAndPut(ctx, key, value, entry.Revision); !errors.Is(err, ErrorRevisionMismatch) {
+			return revision, err // Иначе ключ изменился между чтением и записью
+		}
+	}
+
+	return 0, err
+}
+
+// preconditionStatus returns the status of a conditional write that
+// failed with err, or 0 if err is not a failed precondition.
+func preconditionStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrorInvalidIfMatch):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrorNoSuchKey):
+		return http.StatusNotFound
+	case errors.Is(err, ErrorKeyExists):
+		return http.StatusConflict
+	case errors.Is(err, ErrorRevisionMismatch):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, ErrorRevisionRequired):
+		return http.StatusPreconditionRequired
+	default:
+		return 0
+	}
+}
+
+// writeTime returns when the store wrote the given revision of key, or
+// the current time if the key has changed since.
+func writeTime(ctx context.Context, key string, revision uint64) time.Time {
+	entry, err := store.GetEntry(context.WithoutCancel(ctx), key)
+	if err != nil || entry.Revision != revision || entry.Modified.IsZero() {
+		return time.Now()
+	}
+
+	return entry.Modified
+}
+
+// syncWrite reports whether a write must be fsynced to the transaction
+// log before it is acknowledged. The X-Durability request header, "sync"
+// or "async", overrides the configured default.
+func syncWrite(r *http.Request) (bool, error) {
+	mode := r.Header.Get("X-Durability")
+	if mode == "" {
+		mode = config.TransactionLog.Durability
+	}
+
+	switch mode {
+	case "sync":
+		return true, nil
+	case "async":
+		return false, nil
+	default:
+		return false, fmt.Errorf("Invalid X-Durability %q", mode)
+	}
+}
+
+// recordPut publishes a put the store has applied under the loggedPut
+// context ctx, which logged it and set its content type and deadline
+// under the same lock. Every protocol front end goes through it and
+// recordDelete.
+func recordPut(ctx context.Context, key, value, contentType string, deadline time.Time) {
+	change := ChangeEvent{Type: "put", Key: key, Value: value, ContentType: contentType, unchanged: !valueChanged(ctx)}
+
+	if !deadline.IsZero() {
+		change.Expires = &deadline
+	}
+
+	broker.Publish(change)
+}
+
+// recordIncrement publishes an increment or append the store has applied
+// under a loggedIncrement context, which logged it. Both keep the deadline
+// and content type of the key.
+func recordIncrement(key, value string) {
+	broker.Publish(ChangeEvent{Type: "put", Key: key, Value: value})
+}
+
+// recordExpiration logs and publishes a key the reaper removed once its
+// deadline passed. Keys that expire during replay are not logged.
+func recordExpiration(key string) {
+	if !ready.Load() {
+		return
+	}
+
+	logger.WriteExpired(key)
+
+	broker.Publish(ChangeEvent{Type: "expire", Key: key})
+}
+
+// recordEviction publishes a key evicted in cache mode and, if configured,
+// logs it. Evictions during replay are not logged again.
+func recordEviction(key string) {
+	if !ready.Load() {
+		return
+	}
+
+	if config.Store.LogEvictions {
+		logger.WriteDelete(key)
+	}
+
+	broker.Publish(ChangeEvent{Type: "evict", Key: key})
+}
+
+// recordDelete publishes a delete the store has applied under a
+// loggedDelete context.
+func recordDelete(key string) {
+	broker.Publish(ChangeEvent{Type: "delete", Key: key})
+}
+
+// keyValueGetHandler serves GET and HEAD /v1/key/{key}. Both report the
+// revision in ETag, when it was written in Last-Modified, when the key was
+// created in X-Created, the value size in Content-Length, with store
+// checksums the SHA-256 of the value in X-Content-SHA256 and, for expiring
+// keys, the seconds left in X-TTL; HEAD omits the value itself. With ?rev=N they describe that revision of
+// the key instead, if it is kept, and with ?transform= they return a value
+// derived from it. Requests whose If-None-Match or If-Modified-Since shows
+// the client already has the revision get 304.
+func keyValueGetHandler(w http.ResponseWriter, r *http.Request) {
+	vars := pathVars(r)
+	key := vars["key"]
+
+	var entry Entry
+	var err error
+
+	var derive transform
+	if raw := r.URL.Query().Get("transform"); raw != "" {
+		if derive, err = parseTransform(raw); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if raw := r.URL.Query().Get("rev"); raw != "" {
+		var revision uint64
+		if revision, err = strconv.ParseUint(raw, 10, 64); err != nil || revision == 0 {
+			http.Error(w, "Invalid revision", http.StatusBadRequest)
+			return
+		}
+
+		entry, err = entryAtRevision(r.Context(), key, revision)
+	} else {
+		entry, err = verifiedEntry(r.Context(), key)
+	}
+
+	if errors.Is(err, ErrorNoSuchKey) || errors.Is(err, ErrorNoSuchRevision) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	etag := formatETag(entry.Revision)
+
+	w.Header().Add("Vary", "Accept-Encoding")
+	w.Header().Set("ETag", etag)
+	if !entry.Modified.IsZero() {
+		w.Header().Set("Last-Modified", entry.Modified.UTC().Format(http.TimeFormat))
+	}
+
+	if !entry.Created.IsZero() {
+		w.Header().Set("X-Created", entry.Created.UTC().Format(http.TimeFormat))
+	}
+
+	if entry.Checksum != "" && derive == nil {
+		w.Header().Set("X-Content-SHA256", entry.Checksum) // Сумма хранимого значения, а не производного
+	}
+
+	if notModified(r, etag, entry.Modified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	value, contentType := entry.Value, entry.ContentType
+
+	if derive != nil {
+		if value, contentType, err = derive(value); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	if encoding := acceptedEncoding(r.Header.Get("Accept-Encoding")); encoding != "" && len(value) >= minEncodedValue {
+		value = encodeContent(encoding, value)
+		w.Header().Set("Content-Encoding", encoding)
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(value)))
+
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+
+	if !entry.Expires.IsZero() {
+		w.Header().Set("X-TTL", strconv.FormatInt(ttlSeconds(time.Until(entry.Expires)), 10))
+	}
+
+	if r.Method == http.MethodHead { // Только метаданные
+		return
+	}
+
+	w.Write([]byte(value))
+}
+
+// parseContentType validates the Content-Type of a PUT request and
+// returns it in canonical form; an absent header yields "".
+func parseContentType(header string) (string, error) {
+	if header == "" {
+		return "", nil
+	}
+
+	if len(header) > maxContentTypeLength {
+		return "", fmt.Errorf("Content-Type too long")
+	}
+
+	mediaType, params, err := mime.ParseMediaType(header)
+	if err != nil {
+		return "", fmt.Errorf("Invalid Content-Type: %w", err)
+	}
+
+	return mime.FormatMediaType(mediaType, params), nil
+}
+
+// ttlSeconds rounds the time left before a deadline up to whole seconds.
+func ttlSeconds(ttl time.Duration) int64 {
+	return int64((ttl + time.Second - 1) / time.Second)
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+
+	return n, err
+}
+
+// limitBody caps the request body at limit bytes with http.MaxBytesReader.
+// After a read error, tooLarge reports whether the limit caused it.
+func limitBody(w http.ResponseWriter, r *http.Request, limit int64) (tooLarge func() bool) {
+	body := &countingReader{ReadCloser: http.MaxBytesReader(w, r.Body, limit)}
+	r.Body = body
+
+	return func() bool { return r.ContentLength > limit || body.n >= limit }
+}
+
+// formatETag renders a key revision as a strong entity tag.
+func formatETag(revision uint64) string {
+	return `"` + strconv.FormatUint(revision, 10) + `"`
+}
+
+// notModified evaluates the If-None-Match and, without it, the
+// If-Modified-Since header of r against the revision with the given tag,
+// written at modified. Revisions replayed from the transaction log count
+// as written at replay, which can only turn a 304 into a full response.
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		for _, tag := range strings.Split(header, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/") // Слабое сравнение
+			if tag == "*" || tag == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+
+	return err == nil && !modified.IsZero() && !modified.Truncate(time.Second).After(since)
+}
+
+// parseETag extracts the revision from an entity tag made by formatETag.
+func parseETag(tag string) (uint64, bool) {
+	tag = strings.TrimSpace(tag)
+	if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+		return 0, false
+	}
+
+	revision, err := strconv.ParseUint(tag[1:len(tag)-1], 10, 64)
+
+	return revision, err == nil
+}
+
+// keyValueDeleteHandler serves DELETE /v1/key/{key}, or schedules the
+// delete with ?after=D.
+func keyValueDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	vars := pathVars(r)
+	key := normalizeKey(vars["key"]) // Обработчик может быть вызван без normalizeRequestKeys
+
+	if err := validateKey(key); err != nil {
+		keyError(w, err)
+		return
+	}
+
+	durable, err := syncWrite(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, notFoundErr := store.Get(r.Context(), key)
+	if errors.Is(notFoundErr, ErrorNoSuchKey) {
+		http.Error(w, notFoundErr.Error(), http.StatusNotFound)
+		return
+	}
+
+	if raw := r.URL.Query().Get("after"); raw != "" {
+		after, err := time.ParseDuration(raw)
+		if err != nil || after <= 0 {
+			http.Error(w, "Invalid after", http.StatusBadRequest)
+			return
+		}
+
+		op := scheduler.Schedule(key, "delete", time.Now().Add(after))
+
+		if durable {
+			if err := logger.Sync(r.Context()); err != nil {
+				serverError(w, err)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(op)
+		return
+	}
+
+	if retention := config.Store.TombstoneRetention; retention > 0 {
+		until := time.Now().Add(retention)
+
+		if err := store.SoftDelete(loggedDelete(r.Context(), key, until), key, until); err != nil {
+			serverError(w, err)
+			return
+		}
+	} else if err := store.Delete(loggedDelete(r.Context(), key, time.Time{}), key); err != nil {
+		serverError(w, err)
+		return
+	}
+
+	recordDelete(key)
+
+	if durable {
+		if err := logger.Sync(r.Context()); err != nil {
+			serverError(w, err)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// keyValueIncrHandler serves POST /v1/key/{key}/incr?by=N. It adds N,
+// 1 by default and possibly negative, to the integer value of the key and
+// returns the new value.
+func keyValueIncrHandler(w http.ResponseWriter, r *http.Request) {
+	vars := pathVars(r)
+	key := vars["key"]
+
+	if err := validateKey(key); err != nil {
+		keyError(w, err)
+		return
+	}
+
+	durable, err := syncWrite(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	by := int64(1)
+	if raw := r.URL.Query().Get("by"); raw != "" {
+		by, err = strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid by", http.StatusBadRequest)
+			return
+		}
+	}
+
+	value, revision, err := store.Increment(loggedIncrement(r.Context(), key), key, by)
+	if errors.Is(err, ErrorNotInteger) || errors.Is(err, ErrorOverflow) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	recordIncrement(key, strconv.FormatInt(value, 10))
+
+	if durable {
+		if err := logger.Sync(r.Context()); err != nil {
+			serverError(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("ETag", formatETag(revision))
+	w.Write([]byte(strconv.FormatInt(value, 10)))
+}
+
+// keyValueAppendHandler serves POST /v1/key/{key}/append. It appends the
+// body to the value of the key, creating it if it does not exist, and
+// returns the new length of the value.
+func keyValueAppendHandler(w http.ResponseWriter, r *http.Request) {
+	vars := pathVars(r)
+	key := vars["key"]
+
+	if err := validateKey(key); err != nil {
+		keyError(w, err)
+		return
+	}
+
+	durable, err := syncWrite(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tooLarge := limitBody(w, r, config.Limits.MaxValueBytes)
+	defer r.Body.Close()
+
+	suffix, err := io.ReadAll(r.Body)
+	if err != nil && tooLarge() {
+		http.Error(w, ErrorValueTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	value, revision, err := store.Append(loggedIncrement(r.Context(), key), key, string(suffix), config.Limits.MaxValueBytes)
+	if errors.Is(err, ErrorValueTooLarge) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	recordIncrement(key, value)
+
+	if durable {
+		if err := logger.Sync(r.Context()); err != nil {
+			serverError(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("ETag", formatETag(revision))
+	w.Write([]byte(strconv.Itoa(len(value))))
+}
+
+func keyValueTTLHandler(w http.ResponseWriter, r *http.Request) {
+	vars := pathVars(r)
+	key := vars["key"]
+
+	ttl, err := store.TTL(r.Context(), key)
+	if errors.Is(err, ErrorNoSuchKey) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	seconds := int64(-1)
+	if ttl != NoExpiration {
+		seconds = ttlSeconds(ttl)
+	}
+
+	w.Write([]byte(strconv.FormatInt(seconds, 10)))
+}
+
+type keyMeta struct {
+	Key         string     `json:"key"`
+	Revision    uint64     `json:"revision"`
+	Size        int        `json:"size"`
+	ContentType string     `json:"content_type,omitempty"`
+	Created     *time.Time `json:"created_at,omitempty"`
+	Updated     *time.Time `json:"updated_at,omitempty"`
+	Expires     *time.Time `json:"expires_at,omitempty"`
+}
+
+// keyMetaHandler serves GET /v1/key/{key}/meta: the metadata of the key
+// without its value. Times are those of this process for keys replayed
+// from the transaction log, and kept across restarts by the persistent
+// stores and snapshots.
+func keyMetaHandler(w http.ResponseWriter, r *http.Request) {
+	key := pathVars(r)["key"]
+
+	entry, err := store.GetEntry(r.Context(), key)
+	if errors.Is(err, ErrorNoSuchKey) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	meta := keyMeta{
+		Key:         key,
+		Revision:    entry.Revision,
+		Size:        len(entry.Value),
+		ContentType: entry.ContentType,
+		Created:     optionalTime(entry.Created),
+		Updated:     optionalTime(entry.Modified),
+		Expires:     optionalTime(entry.Expires),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(meta)
+}
+
+// optionalTime returns t in UTC, or nil if it is zero.
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+
+	t = t.UTC()
+
+	return &t
+}
+
+// keysListHandler serves GET /v1/keys?prefix=&limit=&cursor=&values=&snapshot=.
+// Keys are returned in lexicographic order; when more remain, the cursor
+// for the next page is sent in the X-Next-Cursor header.
+func keysListHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+
+	if serveSnapshotPage(w, r, "keys:"+prefix, func(max int) ([]Entry, bool, error) {
+		return store.List(r.Context(), prefix, "", max)
+	}) {
+		return
+	}
+
+	limit, after, err := listPage(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if after != "" && !strings.HasPrefix(after, prefix) {
+		http.Error(w, ErrorCursorListing.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entries, more, err := store.List(r.Context(), prefix, after, limit)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	writeListPage(w, query, entries, more)
+}
+
+// rangeHandler serves GET /v1/range?start=&end=&limit=&cursor=&values=&snapshot=:
+// the keys from start up to, but not including, end in lexicographic
+// order, paged like GET /v1/keys. An empty start begins at the first key
+// and an empty end leaves the range open.
+func rangeHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	start, end := query.Get("start"), query.Get("end")
+	if end != "" && end < start {
+		http.Error(w, "Invalid range: end before start", http.StatusBadRequest)
+		return
+	}
+
+	if serveSnapshotPage(w, r, "range:"+strconv.Quote(start)+":"+strconv.Quote(end), func(max int) ([]Entry, bool, error) {
+		return store.Range(r.Context(), start, end, max)
+	}) {
+		return
+	}
+
+	limit, after, err := listPage(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if after != "" && (after < start || end != "" && after >= end) {
+		http.Error(w, ErrorCursorListing.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if after != "" {
+		start = after + "\x00" // Первый ключ после курсора
+	}
+
+	entries, more, err := store.Range(r.Context(), start, end, limit)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	writeListPage(w, query, entries, more)
+}
+
+// listPage parses the limit and the cursor of a listing request.
+func listPage(query url.Values) (limit int, after string, err error) {
+	if limit, err = pageLimit(query); err != nil {
+		return 0, "", err
+	}
+
+	cursor, err := base64.RawURLEncoding.DecodeString(query.Get("cursor"))
+	if err != nil {
+		return 0, "", errors.New("Invalid cursor")
+	}
+
+	return limit, string(cursor), nil
+}
+
+// pageLimit parses the page size of a listing request.
+func pageLimit(query url.Values) (int, error) {
+	limit := config.Limits.ListDefault
+	if raw := query.Get("limit"); raw != "" {
+		var err error
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit <= 0 || limit > config.Limits.ListMax {
+			return 0, errors.New("Invalid limit")
+		}
+	}
+
+	return limit, nil
+}
+
+// writeListPage sends one page of a listing: the keys, or the entries with
+// ?values=true, and the cursor of the next page in X-Next-Cursor.
+func writeListPage(w http.ResponseWriter, query url.Values, entries []Entry, more bool) {
+	withValues, _ := strconv.ParseBool(query.Get("values"))
+
+	if more {
+		last := entries[len(entries)-1].Key
+		w.Header().Set("X-Next-Cursor", base64.RawURLEncoding.EncodeToString([]byte(last)))
+	}
+
+	var body interface{}
+	if withValues {
+		body = entries
+	} else {
+		keys := make([]string, len(entries))
+		for i, entry := range entries {
+			keys[i] = entry.Key
+		}
+		body = keys
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+/**
+ * Transaction logger
+ */
+type EventType byte
+
+const (
+	_                     = iota
+	EventDelete EventType = iota
+	EventPut
+	EventExpire      // Value holds the deadline in Unix nanoseconds
+	EventIncrement   // Value holds the new value of an increment or append; revision 1 means the key was created
+	EventTxn         // Value holds the encoded writes of one transaction
+	EventContentType // Value holds the media type of the key's value
+	EventReadOnly    // Value is "true" or "false"; no key
+	EventExpired     // No value; removes the key if its deadline has passed
+	EventTombstone   // Value holds the Unix nanoseconds until which the deleted key can be undeleted
+	EventSchedule    // Value holds the operation scheduled on the key and its Unix nanoseconds, as "delete 1700000000000000000"; empty cancels it
+	EventSequence    // No key or value; ends a compacted log whose last events were dropped, keeping their sequence number
+)
+
+type Event struct {
+	Sequence  uint64
+	EventType EventType
+	Key       string
+	Value     string
+	Revision  uint64 // Версия ключа после PUT
+
+	compressed bool         // Value сжато compressEvent
+	synced     chan<- error // Маркер Sync вместо события; получает результат fsync
+	span       *Span        // Спан Sync маркера; nil вне трассируемого запроса
+}
+
+type TransactionLogger interface {
+	WritePut(key, value string, revision uint64) error
+	WriteDelete(key string) error
+	WriteExpire(key string, deadline time.Time) error
+	WriteExpired(key string) error                    // Ключ удалён по истечении срока
+	WriteTombstone(key string, until time.Time) error // Ключ удалён, но его можно восстановить до until
+	WriteSchedule(key, op string, at time.Time) error // Операция над ключом в момент at; пустая op отменяет запланированную
+	WriteContentType(key, contentType string) error
+	WriteReadOnly(enabled bool) error
+	WriteIncrement(key, value string, revision uint64) error
+	WriteTxn(ops []Event) error // Записи транзакции одним событием
+	Err() <-chan error
+	ReadEvents() (<-chan Event, <-chan error)
+	Run()
+	Sync(ctx context.Context) error // Дождаться сохранности всех ранее записанных событий
+	Check() error                   // Работает ли журнал и может ли он писать
+	Close() error                   // Дождаться записи всех событий и освободить ресурсы
+	LastSequence() uint64           // Порядковый номер последнего записанного события
+}
+
+// newTransactionLogger builds the logger selected by the configured
+// backend: "file", "postgres", "s3", "kafka", "nats" or "none", encrypting
+// its events with s unless s is nil, for a store holding the events up to
+// applied. A file log reports its failed writes to h, or to the state of
+// the server's log if h is nil.
+func newTransactionLogger(c TransactionLogConfig, s *Sealer, h *logHealthState, applied uint64) (TransactionLogger, error) {
+	o := LogOptions{QueueSize: c.Queue.Size, Sealer: s, CompressAbove: c.CompressThreshold}
+
+	switch c.Backend {
+	case "file":
+		fo := fileLogOptions(c, o)
+		if fo.health = h; h == nil {
+			fo.health = &logHealth
+		}
+
+		return NewFileTransactionLogger(c.File, fo)
+	case "postgres":
+		return NewPostgresTransactionLogger(PostgresDBParams{
+			host:     c.Postgres.Host,
+			dbName:   c.Postgres.DBName,
+			user:     c.Postgres.User,
+			password: c.Postgres.Password,
+			sslMode:  c.Postgres.SSLMode,
+		}, o)
+	case "s3":
+		return NewS3TransactionLogger(c.S3, o)
+	case "kafka":
+		return NewKafkaTransactionLogger(c.Kafka, applied, o)
+	case "nats":
+		return NewNATSTransactionLogger(c.NATS, o)
+	case "none":
+		return NewNoTransactionLogger(applied), nil
+	default:
+		return nil, fmt.Errorf("unknown transaction logger backend: %s", c.Backend)
+	}
+}
+
+func initializeTransactionLog() error {
+	var err error
+
+	logger, err = newTransactionLogger(config.TransactionLog, sealer, nil, appliedSequence(store))
+	if err != nil {
+		return fmt.Errorf("failed to create event logger: %w", err)
+	}
+
+	writeSlots = make(chan struct{}, config.TransactionLog.Queue.Size)
+
+	err = replayLog(logger, store, snapshotPath(config.TransactionLog), func(e Event, stored bool) error {
+		if stored && e.EventType != EventReadOnly && e.EventType != EventSchedule { // Режим и расписание не хранятся в хранилище
+			return nil
+		}
+
+		replayedEvents.Add(1)
+		return applyEvent(context.Background(), e)
+	})
+
+	logger.Run()
+	go watchLoggerErrors(logger, &logHealth)
+
+	feed = NewReplicationFeed(config.Replication.BufferEvents, logger.LastSequence())
+	logger = feed.wrap(logger) // Реплики получают события после воспроизведения
+
+	return err
+}
+
+// replayLog loads the snapshot of the file logger l at snapshot, if there
+// is one, into s and replays the events of l with apply, telling it
+// whether s already holds each of them. It returns the error that ended
+// replay, if any.
+func replayLog(l TransactionLogger, s Store, snapshot string, apply func(e Event, stored bool) error) error {
+	applied := appliedSequence(s) // События до него уже в хранилище
+
+	if fl, ok := l.(*FileTransactionLogger); ok {
+		sequence, err := loadLogSnapshot(fl, s, snapshot)
+		if err != nil {
+			return fmt.Errorf("failed to load snapshot: %w", err)
+		}
+
+		applied = max(applied, sequence)
+	}
+
+	events, errs := l.ReadEvents()
+	e, ok := Event{}, true
+
+	progress := time.NewTicker(replayProgressInterval)
+	defer progress.Stop()
+
+	started := time.Now()
+	read := uint64(0)
+
+	var err error
+	for ok && err == nil {
+		select {
+		case err, ok = <-errs: // Получает ошибки
+		case e, ok = <-events:
+			if ok {
+				read++
+				err = apply(e, e.Sequence <= applied)
+			}
+		case now := <-progress.C:
+			logReplayProgress(l, read, started, now)
+		}
+	}
+
+	slog.Info("transaction log replayed", "events", read, "duration", time.Since(started).String())
+
+	if last := l.LastSequence(); err == nil && last < applied {
+		slog.Warn("transaction log ends before the sequence recorded by the store", "last_sequence", last, "store_sequence", applied)
+	}
+
+	return err
+}
+
+// applyEvent replays one transaction log event into the store and the
+// state of the process: its read-only mode and scheduled operations.
+func applyEvent(ctx context.Context, e Event) error {
+	switch e.EventType {
+	case EventReadOnly:
+		enabled, err := strconv.ParseBool(e.Value)
+		if err != nil {
+			return err
+		}
+
+		readOnly.Store(enabled)
+		return nil
+
+	case EventSchedule:
+		return scheduler.apply(e)
+	}
+
+	return replayEvent(ctx, store, e)
+}
+
+// replayEvent replays one transaction log event into s. The events that
+// do not change keys are left to the caller.
+func replayEvent(ctx context.Context, s Store, e Event) error {
+	e, err := inflateEvent(e)
+	if err != nil {
+		return err
+	}
+
+	switch e.EventType {
+	case EventDelete: // Получено событие DELETE!
+		return s.Delete(ctx, e.Key)
+
+	case EventPut: // Получено событие PUT!
+		if e.Revision == 0 { // Журнал без версий
+			_, err := s.Put(ctx, e.Key, e.Value)
+			return err
+		}
+		return s.Restore(ctx, e.Key, e.Value, e.Revision)
+
+	case EventIncrement:
+		if e.Revision == 1 { // Ключ создан заново, без срока действия
+			return s.Restore(ctx, e.Key, e.Value, e.Revision)
+		}
+		return s.Update(ctx, e.Key, e.Value, e.Revision)
+
+	case EventExpire:
+		nanos, err := strconv.ParseInt(e.Value, 10, 64)
+		if err != nil {
+			return err
+		}
+
+		err = s.Expire(ctx, e.Key, time.Unix(0, nanos))
+		if errors.Is(err, ErrorNoSuchKey) {
+			return nil // Ключ уже удалён
+		}
+		return err
+
+	case EventExpired:
+		if _, err := s.TTL(ctx, e.Key); !errors.Is(err, ErrorNoSuchKey) {
+			return err // Ключ записан заново после удаления
+		}
+		return s.Delete(ctx, e.Key)
+
+	case EventTombstone:
+		nanos, err := strconv.ParseInt(e.Value, 10, 64)
+		if err != nil {
+			return err
+		}
+		return s.SoftDelete(ctx, e.Key, time.Unix(0, nanos))
+
+	case EventContentType:
+		err := s.SetContentType(ctx, e.Key, e.Value)
+		if errors.Is(err, ErrorNoSuchKey) {
+			return nil // Ключ уже удалён
+		}
+		return err
+
+	case EventTxn:
+		ops, err := decodeTxnEvents(e.Value)
+		if err != nil {
+			return err
+		}
+
+		for _, op := range ops {
+			if err := replayEvent(ctx, s, op); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+/**
+ * File Transaction logger
+ */
+type FileTransactionLogger struct {
+	eventQueue                // Очередь событий сопрограммы Run и её завершение
+	errors       <-chan error // Канал только для чтения; для приема ошибок
+	lastSequence uint64       // Последний использованный порядковый номер
+	file         *os.File     // Местоположение файла журнала
+	filename     string       // Путь к файлу журнала
+	wg           sync.WaitGroup
+
+	policy      CompactionPolicy
+	compaction  compactionState
+	compactions chan chan error      // Запросы на сжатие от Compact
+	checkpoints chan chan checkpoint // Запросы на новый сегмент от Checkpoint
+	closing     chan struct{}        // Закрывается в Close: прекратить повторы записи
+
+	fsync    FsyncPolicy
+	unsynced uint64 // Событий записано с последнего fsync
+
+	batching BatchPolicy
+	buf      bytes.Buffer // Закодированные события пакета
+
+	sealer        *Sealer // Шифрует события; nil - журнал в открытом виде
+	strict        bool    // Не запускаться с повреждённым журналом вместо его усечения
+	compressAbove int     // Сжимать значения не короче; 0 отключает сжатие
+	queueSize     int     // Событий в очереди; не меньше пакета
+
+	health *logHealthState // Отказы и восстановление записи
+
+	rotation RotationPolicy
+	segments []string      // Закрытые сегменты на момент запуска, в порядке воспроизведения
+	segment  int           // Номер последнего сегмента
+	floor    atomic.Uint64 // Последнее событие в снимке; журнал начинается после него
+
+	replayed   atomic.Int64 // Байт прочитано ReadEvents
+	replaySize int64        // Размер журнала с сегментами перед воспроизведением
+}
+
+func (l *FileTransactionLogger) Run() {
+	events := make(chan Event, max(l.queueSize, l.batching.MaxEvents)) // Создать канал событий, вмещающий пакет
+	l.events = events
+
+	errors := make(chan error, 1) // Создать канал ошибок
+	l.errors = errors
+
+	l.compactions = make(chan chan error)
+	l.checkpoints = make(chan chan checkpoint)
+	l.stopped = make(chan struct{})
+	l.closing = make(chan struct{})
+
+	l.wg.Add(1)
+
+	go func() {
+		defer l.wg.Done()
+		defer close(l.stopped)
+		defer close(errors) // Завершает наблюдателей Err
+
+		var schedule <-chan time.Time
+		if l.policy.Interval > 0 {
+			ticker := time.NewTicker(l.policy.Interval)
+			defer ticker.Stop()
+			schedule = ticker.C
+		}
+
+		var rotateTick <-chan time.Time
+		if l.rotation.Interval > 0 {
+			ticker := time.NewTicker(l.rotation.Interval)
+			defer ticker.Stop()
+			rotateTick = ticker.C
+		}
+
+		var fsyncTick <-chan time.Time
+		if l.fsync.Mode == FsyncInterval {
+			ticker := time.NewTicker(l.fsync.Interval)
+			defer ticker.Stop()
+			fsyncTick = ticker.C
+		}
+
+		for {
+			select {
+			case e, ok := <-events: // Извлечь следующее событие Event
+				if !ok {
+					return
+				}
+
+				batch, open := l.collect(e, events) // Вместе с событиями, ждущими в очереди
+
+				if err := l.writeBatch(batch); err != nil {
+					errors <- err
+					return
+				}
+
+				if !open {
+					return
+				}
+
+				if l.rotation.due(l.compaction.size) {
+					if err := l.rotate(); err != nil {
+						slog.Error("rotation failed", "error", err)
+					}
+				} else if l.policy.due(l.compaction) {
+					if err := l.compact(); err != nil {
+						slog.Error("compaction failed", "error", err)
+					}
+				}
+
+			case <-fsyncTick:
+				if l.unsynced > 0 {
+					if err := l.file.Sync(); err != nil {
+						errors <- err
+						return
+					}
+					l.unsynced = 0
+				}
+
+			case <-rotateTick: // Ротация по расписанию
+				if err := l.rotate(); err != nil {
+					slog.Error("rotation failed", "error", err)
+				}
+
+			case <-schedule: // Сжатие по расписанию
+				if err := l.compact(); err != nil {
+					slog.Error("compaction failed", "error", err)
+				}
+
+			case reply := <-l.compactions: // Сжатие по запросу
+				reply <- l.compact()
+
+			case reply := <-l.checkpoints: // Новый сегмент для снимка
+				reply <- l.checkpoint()
+			}
+		}
+	}()
+}
+
+func (l *FileTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
+	reader := bufio.NewReader(l.file) // Создать Reader для чтения l.file
+	outEvent := make(chan Event)      // Небуферизованный канал событий
+	outError := make(chan error, 1)   // Буферизованный канал ошибок
+
+	l.replaySize, _ = l.LogSize() // Только для отчёта о ходе воспроизведения
+
+	go func() {
+		defer close(outEvent) // Закрыть каналы
+		defer close(outError) // по завершении сопрограммы
+		defer l.resume()
+
+		for _, segment := range l.segments { // Сначала закрытые сегменты
+			if err := l.readSegment(segment, outEvent); err != nil {
+				outError <- fmt.Errorf("segment %s: %w", segment, err)
+				return
+			}
+		}
+
+		header, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			outError <- fmt.Errorf("transaction log read failure: %w", err)
+			return
+		}
+
+		format, err := checkLogHeader(header, l.sealer)
+		if err != nil {
+			outError <- err
+			return
+		}
+
+		offset := int64(len(header)) // Конец последнего целого события
+		l.replayed.Add(offset)
+
+		for {
+			record, err := format.read(reader)
+			if err == io.EOF && record == "" {
+				break
+			}
+
+			if err != nil && err != io.EOF {
+				outError <- fmt.Errorf("transaction log read failure: %w", err)
+				return
+			}
+
+			e, err := format.decode(record)
+			if err == nil {
+				e, err = l.sealer.openEvent(e)
+			}
+
+			if err != nil {
+				err = fmt.Errorf("input parse error: %w", err)
+			} else if l.lastSequence >= e.Sequence { // Проверка целостности! Порядковые номера последовательно увеличиваются?
+				err = fmt.Errorf("transaction numbers out of sequence")
+			}
+
+			if err != nil {
+				if l.strict {
+					outError <- err
+					return
+				}
+
+				if err := l.truncate(offset, err); err != nil {
+					outError <- err
+				}
+				return
+			}
+
+			offset += int64(len(record))
+			l.replayed.Add(int64(len(record)))
+
+			atomic.StoreUint64(&l.lastSequence, e.Sequence) // Запомнить последний использованный порядковый номер
+			if e.EventType != EventSequence {
+				outEvent <- e // Отправить событие along
+			}
+		}
+	}()
+
+	return outEvent, outError
+}
+
+// readSegment replays a closed segment. Segments are fsynced when they are
+// closed, so a corrupt one is an error even outside strict mode.
+func (l *FileTransactionLogger) readSegment(filename string, out chan<- Event) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+
+	header, err := reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("transaction log read failure: %w", err)
+	}
+
+	format, err := checkLogHeader(header, l.sealer)
+	if err != nil {
+		return err
+	}
+
+	l.replayed.Add(int64(len(header)))
+
+	for {
+		record, err := format.read(reader)
+		if err == io.EOF && record == "" {
+			return nil
+		}
+
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("transaction log read failure: %w", err)
+		}
+
+		e, err := format.decode(record)
+		if err == nil {
+			e, err = l.sealer.openEvent(e)
+		}
+
+		if err != nil {
+			return fmt.Errorf("input parse error: %w", err)
+		}
+
+		if l.lastSequence >= e.Sequence {
+			return fmt.Errorf("transaction numbers out of sequence")
+		}
+
+		l.replayed.Add(int64(len(record)))
+
+		atomic.StoreUint64(&l.lastSequence, e.Sequence)
+		if e.EventType != EventSequence {
+			out <- e
+		}
+	}
+}
+
+// truncate discards the log from the corrupt record at offset onwards,
+// together with every event after it.
+func (l *FileTransactionLogger) truncate(offset int64, cause error) error {
+	slog.Warn("truncating corrupt transaction log",
+		"file", l.filename,
+		"offset", offset,
+		"discarded_bytes", l.compaction.size-offset,
+		"last_sequence", l.lastSequence,
+		"error", cause)
+
+	if err := l.file.Truncate(offset); err != nil {
+		return fmt.Errorf("failed to truncate transaction log: %w", err)
+	}
+
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("failed to truncate transaction log: %w", err)
+	}
+
+	l.compaction.size = offset
+
+	return nil
+}
+
+func (l *FileTransactionLogger) WritePut(key, value string, revision uint64) error {
+	return l.send(Event{EventType: EventPut, Key: key, Value: value, Revision: revision})
+}
+
+func (l *FileTransactionLogger) WriteDelete(key string) error {
+	return l.send(Event{EventType: EventDelete, Key: key})
+}
+
+func (l *FileTransactionLogger) WriteExpire(key string, deadline time.Time) error {
+	return l.send(Event{EventType: EventExpire, Key: key, Value: strconv.FormatInt(deadline.UnixNano(), 10)})
+}
+
+func (l *FileTransactionLogger) WriteExpired(key string) error {
+	return l.send(Event{EventType: EventExpired, Key: key})
+}
+
+func (l *FileTransactionLogger) WriteTombstone(key string, until time.Time) error {
+	return l.send(Event{EventType: EventTombstone, Key: key, Value: strconv.FormatInt(until.UnixNano(), 10)})
+}
+
+func (l *FileTransactionLogger) WriteSchedule(key, op string, at time.Time) error {
+	return l.send(Event{EventType: EventSchedule, Key: key, Value: scheduleValue(op, at)})
+}
+
+func (l *FileTransactionLogger) WriteContentType(key, contentType string) error {
+	return l.send(Event{EventType: EventContentType, Key: key, Value: contentType})
+}
+
+func (l *FileTransactionLogger) WriteReadOnly(enabled bool) error {
+	return l.send(Event{EventType: EventReadOnly, Value: strconv.FormatBool(enabled)})
+}
+
+func (l *FileTransactionLogger) WriteTxn(ops []Event) error {
+	return l.send(Event{EventType: EventTxn, Value: encodeTxnEvents(ops)})
+}
+
+func (l *FileTransactionLogger) WriteIncrement(key, value string, revision uint64) error {
+	return l.send(Event{EventType: EventIncrement, Key: key, Value: value, Revision: revision})
+}
+
+// Flush writes every event queued before the call and fsyncs the log
+// file, whatever the fsync policy.
+func (l *FileTransactionLogger) Flush(ctx context.Context) error {
+	return l.syncEvents(ctx)
+}
+
+// Sync blocks until every event written before the call is fsynced.
+func (l *FileTransactionLogger) Sync(ctx context.Context) error {
+	return l.Flush(ctx)
+}
+
+// eventQueue is the channel the Write methods of a logger queue events in
+// for its Run goroutine. Close closes it while writes may still come: the
+// writes after it, or after the goroutine stopped on an error, fail with
+// ErrorLoggerStopped.
+type eventQueue struct {
+	events  chan<- Event  // Канал только для записи; для передачи событий
+	stopped chan struct{} // Закрывается при завершении сопрограммы Run
+
+	mu     sync.RWMutex // Отправки - под чтением, закрытие - под записью
+	closed bool
+}
+
+// send queues e, or fails if Run has not started or stopped or the queue
+// is closed.
+func (q *eventQueue) send(e Event) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed || q.events == nil {
+		return ErrorLoggerStopped
+	}
+
+	select {
+	case q.events <- e:
+		return nil
+	case <-q.stopped:
+		return ErrorLoggerStopped
+	}
+}
+
+// closeEvents closes the queue once the sends in progress are done.
+func (q *eventQueue) closeEvents() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.closed {
+		q.closed = true
+		close(q.events)
+	}
+}
+
+// syncEvents queues a Sync marker behind the pending events and waits for
+// the logger goroutine to reach it, or for ctx to be done. The events are
+// written either way; only the wait is abandoned.
+func (q *eventQueue) syncEvents(ctx context.Context) (err error) {
+	done := timePhase(ctx, "tlog.Sync")
+	_, span := tracer.Start(ctx, "tlog.Sync")
+	defer func() { done(); span.End(err) }()
+
+	synced := make(chan error, 1) // Буфер: горутина журнала не ждёт ушедшего клиента
+
+	if err := q.queueSync(ctx, Event{synced: synced, span: span}); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-synced:
+		return err
+	case <-q.stopped:
+		return ErrorLoggerStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// queueSync queues the Sync marker e unless the queue is closed, the
+// logger stopped or ctx done first.
+func (q *eventQueue) queueSync(ctx context.Context, e Event) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed || q.events == nil {
+		return ErrorLoggerStopped
+	}
+
+	select {
+	case q.events <- e:
+		return nil
+	case <-q.stopped:
+		return ErrorLoggerStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Check reports whether the logger goroutine is running and the log
+// directory is writable.
+func (l *FileTransactionLogger) Check() error {
+	select {
+	case <-l.stopped:
+		return ErrorLoggerStopped
+	default:
+	}
+
+	probe, err := os.CreateTemp(filepath.Dir(l.filename), ".kvs-probe-*")
+	if err != nil {
+		return fmt.Errorf("transaction log directory not writable: %w", err)
+	}
+
+	probe.Close()
+
+	return os.Remove(probe.Name())
+}
+
+func (l *FileTransactionLogger) Err() <-chan error {
+	return l.errors
+}
+
+func (l *FileTransactionLogger) LastSequence() uint64 {
+	return atomic.LoadUint64(&l.lastSequence)
+}
+
+// Close stops accepting events, waits until the buffered ones are written
+// and fsyncs the log file before closing it.
+func (l *FileTransactionLogger) Close() error {
+	if l.events != nil {
+		close(l.closing)
+		l.closeEvents()
+	}
+
+	l.wg.Wait()
+
+	if err := l.file.Sync(); err != nil {
+		l.file.Close()
+		return fmt.Errorf("failed to sync transaction log: %w", err)
+	}
+
+	return l.file.Close()
+}
+
+// LogOptions are the settings the transaction loggers share.
+type LogOptions struct {
+	QueueSize     int     // Событий в очереди логгера
+	Sealer        *Sealer // Шифрует события; nil - журнал в открытом виде
+	CompressAbove int     // Сжимать значения не короче; 0 отключает сжатие
+}
+
+// FileLogOptions configure a FileTransactionLogger.
+type FileLogOptions struct {
+	LogOptions
+
+	Compaction CompactionPolicy
+	Rotation   RotationPolicy
+	Fsync      FsyncPolicy
+	Batch      BatchPolicy
+	Strict     bool // Не запускаться с повреждённым журналом вместо его усечения
+
+	health *logHealthState // Куда сообщать об ошибках записи; nil - своё состояние
+}
+
+// fileLogOptions returns the options of the file log c configures.
+func fileLogOptions(c TransactionLogConfig, o LogOptions) FileLogOptions {
+	return FileLogOptions{LogOptions: o, Compaction: c.Compaction, Rotation: c.Rotation, Fsync: c.Fsync, Batch: c.Batch, Strict: c.Strict}
+}
+
+func NewFileTransactionLogger(filename string, o FileLogOptions) (TransactionLogger, error) {
+	if err := o.Fsync.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := o.Batch.Validate(); err != nil {
+		return nil, err
+	}
+
+	if o.health == nil {
+		o.health = new(logHealthState)
+	}
+
+	sealer := o.Sealer
+
+	segments, last, err := listSegments(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot list transaction log segments: %w", err)
+	}
+
+	for _, segment := range segments {
+		if err := migrateLog(segment, sealer, true); err != nil { // Закрытые сегменты не усекаются, как и при воспроизведении
+			return nil, fmt.Errorf("Cannot migrate transaction log segment %s: %w", segment, err)
+		}
+	}
+
+	if err := migrateLog(filename, sealer, o.Strict); err != nil {
+		return nil, fmt.Errorf("Cannot migrate transaction log file: %w", err)
+	}
+
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0755)
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot open transaction log file: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot stat transaction log file: %w", err)
+	}
+
+	size := info.Size()
+	if size == 0 {
+		n, err := io.WriteString(file, sealer.logHeader()+"\n")
+		if err != nil {
+			return nil, fmt.Errorf("Cannot write transaction log header: %w", err)
+		}
+		size = int64(n)
+	}
+
+	return &FileTransactionLogger{
+		file:       file,
+		filename:   filename,
+		policy:     o.Compaction,
+		fsync:      o.Fsync,
+		batching:   o.Batch,
+		sealer:     sealer,
+		strict:     o.Strict,
+		rotation:   o.Rotation,
+		segments:   segments,
+		segment:    last,
+		compaction: compactionState{size: size, sizeTrigger: o.Compaction.MaxSize},
+		queueSize:  o.QueueSize,
+		health:     o.health,
+
+		compressAbove: o.CompressAbove,
+	}, nil
+}
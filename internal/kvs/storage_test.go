@@ -0,0 +1,113 @@
+package kvs
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConditionalPut(t *testing.T) {
+	defer func(c *Config, s Store, b *Broker) { config, store, broker = c, s, b; current.Store(c) }(config, store, broker)
+
+	config = DefaultConfig()
+	current.Store(config)
+	store = NewShardedStore(4, 0, 0, false)
+	broker = NewBroker(config.Watch.BufferSize)
+
+	filename := filepath.Join(t.TempDir(), "transaction.log")
+	l := startTestLog(t, filename)
+
+	router := NewRouter()
+	router.HandleFunc("/v1/key/{key}", keyValuePutHandler).Methods("PUT").Name("put")
+
+	tests := []struct {
+		header string
+		value  string
+		status int
+		etag   string
+	}{
+		{"If-Match: *", "0", http.StatusNotFound, ""},
+		{"If-None-Match: *", "1", http.StatusCreated, `"1"`},
+		{"If-None-Match: *", "x", http.StatusConflict, ""},
+		{`If-Match: "1"`, "2", http.StatusCreated, `"2"`},
+		{`If-Match: "1"`, "x", http.StatusPreconditionFailed, ""},
+		{"If-Match: 2", "x", http.StatusBadRequest, ""},
+		{"If-Match: *", "3", http.StatusCreated, `"3"`},
+		{"", "4", http.StatusCreated, `"4"`},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPut, "/v1/key/a", strings.NewReader(tt.value))
+		if name, value, ok := strings.Cut(tt.header, ": "); ok {
+			r.Header.Set(name, value)
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		if w.Code != tt.status || w.Header().Get("ETag") != tt.etag {
+			t.Errorf("PUT %s with %q: got %d and ETag %s, want %d and ETag %s", tt.value, tt.header, w.Code, w.Header().Get("ETag"), tt.status, tt.etag)
+		}
+	}
+
+	if value, err := store.Get(context.Background(), "a"); err != nil || value != "4" {
+		t.Fatalf("a is %q (%v), want 4", value, err)
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Журнал хранит версию каждой записи
+	var revisions []uint64
+	for _, e := range replayTestLog(t, openTestLog(t, filename)) {
+		if e.EventType == EventPut {
+			revisions = append(revisions, e.Revision)
+		}
+	}
+
+	if len(revisions) != 4 || revisions[0] != 1 || revisions[3] != 4 {
+		t.Fatalf("log has put revisions %v, want 1 to 4", revisions)
+	}
+}
+
+func TestConditionalPutRejectsConflicts(t *testing.T) {
+	defer func(c *Config, s Store, b *Broker) { config, store, broker = c, s, b; current.Store(c) }(config, store, broker)
+
+	config = DefaultConfig()
+	config.Store.Conflicts = "reject"
+	current.Store(config)
+	store = NewShardedStore(4, 0, 0, false)
+	broker = NewBroker(config.Watch.BufferSize)
+
+	l := startTestLog(t, filepath.Join(t.TempDir(), "transaction.log"))
+	defer l.Close()
+
+	router := NewRouter()
+	router.HandleFunc("/v1/key/{key}", keyValuePutHandler).Methods("PUT").Name("put")
+
+	for _, tt := range []struct {
+		ifMatch string
+		status  int
+	}{
+		{"", http.StatusCreated},
+		{"", http.StatusPreconditionRequired},
+		{"*", http.StatusPreconditionRequired},
+		{`"1"`, http.StatusCreated},
+	} {
+		r := httptest.NewRequest(http.MethodPut, "/v1/key/a", strings.NewReader("v"))
+		if tt.ifMatch != "" {
+			r.Header.Set("If-Match", tt.ifMatch)
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		if w.Code != tt.status {
+			t.Errorf("PUT with If-Match %q: got %d, want %d", tt.ifMatch, w.Code, tt.status)
+		}
+	}
+}
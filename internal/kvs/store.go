@@ -0,0 +1,1199 @@
+package kvs
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * Storage.
+ */
+type Store interface {
+	Get(ctx context.Context, key string) (string, error)
+	GetEntry(ctx context.Context, key string) (Entry, error)
+	Put(ctx context.Context, key string, value string) (uint64, error)
+	CompareAndPut(ctx context.Context, key, value string, revision uint64) (uint64, error)
+	Restore(ctx context.Context, key, value string, revision uint64) error
+	Increment(ctx context.Context, key string, by int64) (value int64, revision uint64, err error)
+	Append(ctx context.Context, key, suffix string, limit int64) (value string, revision uint64, err error)
+	Update(ctx context.Context, key, value string, revision uint64) error
+	Delete(ctx context.Context, key string) error
+	SoftDelete(ctx context.Context, key string, until time.Time) error
+	Undelete(ctx context.Context, key string) (Entry, error)
+	DeleteMatching(ctx context.Context, match func(key string) bool) (removed []string, err error)
+	Expire(ctx context.Context, key string, deadline time.Time) error
+	SetContentType(ctx context.Context, key, contentType string) error
+	TTL(ctx context.Context, key string) (time.Duration, error)
+	List(ctx context.Context, prefix, after string, limit int) (entries []Entry, more bool, err error)
+	Range(ctx context.Context, start, end string, limit int) (entries []Entry, more bool, err error)
+	Stats(ctx context.Context) (keys int, bytes int64, err error)
+	ReapExpired(ctx context.Context, now time.Time) (reaped []string)
+	Batch(ctx context.Context, ops []BatchOp) ([]BatchResult, error)
+	Txn(ctx context.Context, t Txn) (TxnResult, error)
+	Snapshot(ctx context.Context) ([]Entry, error)
+	ReplaceAll(ctx context.Context, entries []Entry) (removed []string, err error)
+	History(ctx context.Context, key string) ([]Entry, error)
+}
+
+// newStore builds the store selected by the configured backend, indexes
+// the configured value fields, keeps the bucket quotas, bounds it when
+// cache limits are set and caches an upstream when one is set. The
+// in-memory "memory" backend is rebuilt from the transaction log at
+// startup; the "bbolt", "badger" and "sqlite" backends keep their keys on
+// disk and need a build with the tag of the same name.
+func newStore(c StoreConfig) (Store, error) {
+	var s Store
+
+	switch c.Backend {
+	case "memory":
+		s = NewShardedStore(c.Shards, c.CompressThreshold, c.HistoryDepth, c.Checksums)
+	case "bbolt":
+		var err error
+		if s, err = OpenBoltStore(c.Path, c.CompressThreshold, c.HistoryDepth, c.Checksums); err != nil {
+			return nil, err
+		}
+	case "badger":
+		var err error
+		if s, err = OpenBadgerStore(c.Path, c.Badger, c.CompressThreshold, c.HistoryDepth, c.Checksums); err != nil {
+			return nil, err
+		}
+	case "sqlite":
+		var err error
+		if s, err = OpenSQLiteStore(c.Path, c.CompressThreshold, c.HistoryDepth, c.Checksums); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown store backend: %s", c.Backend)
+	}
+
+	if len(c.Indexes) > 0 {
+		x, err := NewIndexedStore(s, c.Indexes)
+		if err != nil {
+			return nil, err
+		}
+
+		s = x // Ниже EvictingStore: вытеснения тоже снимаются с индекса
+	}
+
+	if len(c.Quotas) > 0 {
+		q, err := NewQuotaStore(s, c.Quotas)
+		if err != nil {
+			return nil, err
+		}
+
+		s = q // Ниже EvictingStore: вытесненные ключи освобождают квоту
+	}
+
+	if c.MaxKeys > 0 || c.MaxBytes > 0 || c.MaxMemory > 0 {
+		s = NewEvictingStore(s, c, recordEviction)
+	}
+
+	if c.Upstream.URL != "" {
+		s = NewUpstreamStore(s, c.Upstream) // Выше EvictingStore: вытеснения не доходят до источника
+	}
+
+	if tracer != nil || slowLog != nil {
+		s = TracingStore{s}
+	}
+
+	return s, nil
+}
+
+type Entry struct {
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Revision uint64 `json:"revision"` // Номер версии ключа; 1 при создании
+
+	ContentType string    `json:"content_type,omitempty"`
+	Expires     time.Time `json:"-"` // Нулевое значение: без срока действия
+	Modified    time.Time `json:"-"` // Время записи версии в этом процессе
+	Created     time.Time `json:"-"` // Время создания ключа; нулевое - неизвестно
+	Checksum    string    `json:"-"` // SHA-256 значения в hex; пустой - без контрольной суммы
+}
+
+// restoredTimes returns the modification and creation times of a key
+// restored from e at now: those recorded in e, or now.
+func restoredTimes(e Entry, now time.Time) (modified, created time.Time) {
+	modified, created = e.Modified, e.Created
+	if modified.IsZero() {
+		modified = now
+	}
+
+	if created.IsZero() {
+		created = modified
+	}
+
+	return modified, created
+}
+
+/**
+ * Sharded in-memory store.
+ *
+ * Keys are spread over a fixed number of shards by FNV-1a hash, each with
+ * its own lock, so writers to different shards do not contend. Methods
+ * give up with the context's error if it is done before they take a
+ * lock; once they hold it, they complete.
+ *
+ * With a history depth set, each shard also keeps up to that many
+ * previous revisions of every key, oldest first. The history is dropped
+ * with the key, since its revisions start over at 1 when it is created
+ * again.
+ *
+ * Keys removed by SoftDelete leave a tombstone holding their last value
+ * until a given moment, from which Undelete can bring them back. Any
+ * write of the key drops its tombstone, and the reaper purges those that
+ * have run out.
+ *
+ * With checksums, every item also keeps the SHA-256 of its value, which
+ * GetEntry checks (see RepairableStore).
+ */
+type shard struct {
+	sync.RWMutex
+	data          map[string]item
+	expires       map[string]time.Time
+	compressAbove int  // Сжимать значения не короче; 0 отключает сжатие
+	checksums     bool // Хранить SHA-256 значений
+
+	history      map[string][]item // Предыдущие версии ключей, от старых к новым
+	historyDepth int               // 0 отключает историю
+
+	tombstones map[string]tombstone
+
+	index *keyIndex // Ключи data по порядку
+}
+
+type tombstone struct {
+	item
+	expires time.Time // Срок действия удалённого ключа; нулевой - без срока
+	until   time.Time // До какого момента ключ можно восстановить
+}
+
+type item struct {
+	value       string
+	revision    uint64
+	contentType string // Content-Type значения из запроса PUT
+	compressed  bool   // value сжато deflateValue
+
+	sum *[sha256.Size]byte // SHA-256 несжатого значения; nil - без контрольной суммы
+
+	modified time.Time // Время записи; после перезапуска - время воспроизведения журнала
+	created  time.Time // Время создания ключа (версии 1), с той же оговоркой
+}
+
+// newItem builds the item for value, compressing it if it reaches the
+// shard's threshold, with its checksum if the shard keeps them.
+func (sh *shard) newItem(value string, revision uint64, contentType string) item {
+	it := item{value: value, revision: revision, contentType: contentType}
+	if sh.checksums {
+		it.sum = checksum(value)
+	}
+
+	if sh.compressAbove > 0 && len(value) >= sh.compressAbove {
+		it.value, it.compressed = deflateValue(value)
+	}
+
+	return it
+}
+
+// createdOver returns the creation time of it written over previous at
+// now: that of previous if it continues the same key, otherwise its own,
+// as kept by a tombstone, or now.
+func (it item) createdOver(previous item, now time.Time) time.Time {
+	switch {
+	case previous.revision != 0 && previous.revision < it.revision:
+		return previous.created
+	case !it.created.IsZero():
+		return it.created
+	default:
+		return now
+	}
+}
+
+// text returns the uncompressed value of the item.
+func (it item) text() string {
+	if !it.compressed {
+		return it.value
+	}
+
+	value, err := inflateValue(it.value)
+	if err != nil {
+		panic(err) // Сжато этим же процессом
+	}
+
+	return value
+}
+
+type ShardedStore struct {
+	shards []*shard
+}
+
+// NewShardedStore creates a store with the given number of shards that
+// keeps values of at least compressAbove bytes compressed, unless
+// compressAbove is 0, and up to historyDepth previous revisions of each
+// key, with the checksums of the values if checksums is set.
+func NewShardedStore(shards, compressAbove, historyDepth int, checksums bool) *ShardedStore {
+	if shards < 1 {
+		shards = 1
+	}
+
+	s := &ShardedStore{shards: make([]*shard, shards)}
+	for i := range s.shards {
+		s.shards[i] = &shard{
+			data:          make(map[string]item),
+			expires:       make(map[string]time.Time),
+			compressAbove: compressAbove,
+			checksums:     checksums,
+			history:       make(map[string][]item),
+			historyDepth:  historyDepth,
+			tombstones:    make(map[string]tombstone),
+			index:         newKeyIndex(),
+		}
+	}
+
+	return s
+}
+
+func (s *ShardedStore) shardIndex(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+
+	return int(h.Sum32() % uint32(len(s.shards)))
+}
+
+func (s *ShardedStore) shard(key string) *shard {
+	return s.shards[s.shardIndex(key)]
+}
+
+// lockKeys write-locks every shard holding one of keys, in shard order so
+// that concurrent multi-key operations cannot deadlock, and returns the
+// matching unlock function.
+func (s *ShardedStore) lockKeys(keys []string) (unlock func()) {
+	locked := make([]bool, len(s.shards))
+	for _, key := range keys {
+		locked[s.shardIndex(key)] = true
+	}
+
+	for i, sh := range s.shards {
+		if locked[i] {
+			sh.Lock()
+		}
+	}
+
+	return func() {
+		for i, sh := range s.shards {
+			if locked[i] {
+				sh.Unlock()
+			}
+		}
+	}
+}
+
+func (s *ShardedStore) Get(ctx context.Context, key string) (string, error) {
+	entry, err := s.GetEntry(ctx, key)
+
+	return entry.Value, err
+}
+
+func (s *ShardedStore) GetEntry(ctx context.Context, key string) (Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return Entry{}, err
+	}
+
+	sh := s.shard(key)
+
+	sh.RLock()
+	it, ok := sh.data[key]
+	deadline, expiring := sh.expires[key]
+	sh.RUnlock()
+
+	if !ok || (expiring && !time.Now().Before(deadline)) {
+		return Entry{}, ErrorNoSuchKey
+	}
+
+	entry := Entry{Key: key, Value: it.text(), Revision: it.revision, ContentType: it.contentType, Modified: it.modified, Created: it.created, Checksum: formatChecksum(it.sum)}
+	if expiring {
+		entry.Expires = deadline
+	}
+
+	return entry, verifyChecksum(key, entry.Value, it.sum)
+}
+
+// Put stores value under key and returns the key's new revision. The
+// commit of ctx, if any, runs before the key changes (see withCommit) and
+// gives the key its content type and deadline (see putAttributes).
+func (s *ShardedStore) Put(ctx context.Context, key string, value string) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	sh := s.shard(key)
+
+	sh.Lock()
+	defer sh.Unlock()
+
+	previous := sh.live(key, time.Now())
+	if err := commitWrite(ctx, previous.revision+1, func() bool { return previous.revision == 0 || previous.text() != value }); err != nil {
+		return 0, err
+	}
+
+	contentType, deadline := putAttributes(ctx)
+
+	return sh.put(key, value, contentType, deadline), nil
+}
+
+// CompareAndPut stores value only if the key currently has the given
+// revision, otherwise it fails with ErrorRevisionMismatch.
+func (s *ShardedStore) CompareAndPut(ctx context.Context, key, value string, revision uint64) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	sh := s.shard(key)
+
+	sh.Lock()
+	defer sh.Unlock()
+
+	previous := sh.live(key, time.Now())
+	if previous.revision != revision {
+		return 0, ErrorRevisionMismatch
+	}
+
+	if err := commitWrite(ctx, revision+1, func() bool { return previous.revision == 0 || previous.text() != value }); err != nil {
+		return 0, err
+	}
+
+	contentType, deadline := putAttributes(ctx)
+
+	return sh.put(key, value, contentType, deadline), nil
+}
+
+// Restore stores value with an explicit revision, as recorded in the
+// transaction log.
+func (s *ShardedStore) Restore(ctx context.Context, key, value string, revision uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	sh := s.shard(key)
+
+	sh.Lock()
+	sh.replace(key, sh.newItem(value, revision, ""), time.Now())
+	delete(sh.expires, key)
+	sh.Unlock()
+
+	return nil
+}
+
+// Repair replaces the value of key with value if the key is at revision
+// and value has the checksum kept with it.
+func (s *ShardedStore) Repair(ctx context.Context, key, value string, revision uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	sh := s.shard(key)
+
+	sh.Lock()
+	defer sh.Unlock()
+
+	it := sh.live(key, time.Now())
+	if it.revision == 0 {
+		return ErrorNoSuchKey
+	}
+
+	if it.revision != revision {
+		return ErrorRevisionMismatch
+	}
+
+	if it.sum == nil || verifyChecksum(key, value, it.sum) != nil {
+		return fmt.Errorf("%w: %s", ErrorValueChecksum, key)
+	}
+
+	repaired := sh.newItem(value, revision, it.contentType)
+	it.value, it.compressed = repaired.value, repaired.compressed
+	sh.data[key] = it
+
+	return nil
+}
+
+// live returns the key's item, or the zero item if it is absent or
+// expired. The caller must hold the shard lock.
+func (sh *shard) live(key string, now time.Time) item {
+	if deadline, ok := sh.expires[key]; ok && !now.Before(deadline) {
+		return item{}
+	}
+
+	return sh.data[key]
+}
+
+// replace stores it under key and moves the item it replaces to the key's
+// history, unless that item is not live or it starts the key over. The
+// caller must hold the shard write lock.
+func (sh *shard) replace(key string, it item, now time.Time) {
+	previous := sh.live(key, now)
+
+	if sh.historyDepth > 0 {
+		if previous.revision == 0 || previous.revision >= it.revision {
+			delete(sh.history, key)
+		} else {
+			history := append(sh.history[key], previous)
+			if len(history) > sh.historyDepth {
+				history = append(history[:0:0], history[len(history)-sh.historyDepth:]...) // Не держать вытесненные версии
+			}
+			sh.history[key] = history
+		}
+	}
+
+	if previous.revision == 0 {
+		sh.index.insert(key) // Ключ новый или истёк и уже в индексе
+	}
+
+	it.modified, it.created = now, it.createdOver(previous, now)
+	sh.data[key] = it
+	delete(sh.tombstones, key)
+}
+
+// forget removes key with its deadline, history and tombstone. The caller
+// must hold the shard write lock.
+func (sh *shard) forget(key string) {
+	if _, ok := sh.data[key]; ok {
+		sh.index.remove(key)
+	}
+
+	delete(sh.data, key)
+	delete(sh.expires, key)
+	delete(sh.history, key)
+	delete(sh.tombstones, key)
+}
+
+// put stores value under key with the given content type and deadline,
+// which replace those the key had. It must be called with the shard write
+// lock held.
+func (sh *shard) put(key, value, contentType string, deadline time.Time) uint64 {
+	now := time.Now()
+	revision := sh.live(key, now).revision + 1
+
+	sh.replace(key, sh.newItem(value, revision, contentType), now)
+	if deadline.IsZero() {
+		delete(sh.expires, key)
+	} else {
+		sh.expires[key] = deadline
+	}
+
+	return revision
+}
+
+// Increment atomically adds by to the integer value of key, creating it
+// at 0 if it does not exist. An existing deadline and content type are
+// kept. The commit of ctx, if any, runs before the key changes (see
+// withCommit).
+func (s *ShardedStore) Increment(ctx context.Context, key string, by int64) (int64, uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	sh := s.shard(key)
+
+	sh.Lock()
+	defer sh.Unlock()
+
+	now := time.Now()
+	it := sh.live(key, now)
+
+	var current int64
+	if it.revision != 0 {
+		var err error
+		if current, err = strconv.ParseInt(it.text(), 10, 64); err != nil {
+			return 0, 0, ErrorNotInteger
+		}
+	}
+
+	if (by > 0 && current > math.MaxInt64-by) || (by < 0 && current < math.MinInt64-by) {
+		return 0, 0, ErrorOverflow
+	}
+
+	value := current + by
+	if err := commitIncrement(ctx, strconv.FormatInt(value, 10), it.revision+1); err != nil {
+		return 0, 0, err
+	}
+
+	if it.revision == 0 {
+		delete(sh.expires, key) // Срок истёкшего, но не удалённого ключа
+	}
+
+	sh.replace(key, sh.newItem(strconv.FormatInt(value, 10), it.revision+1, it.contentType), now)
+
+	return value, it.revision + 1, nil
+}
+
+// Append atomically appends suffix to the value of key, creating it if it
+// does not exist, and returns the new value, which may not exceed limit
+// bytes. An existing deadline and content type are kept. The commit of
+// ctx, if any, runs before the key changes (see withCommit).
+func (s *ShardedStore) Append(ctx context.Context, key, suffix string, limit int64) (string, uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return "", 0, err
+	}
+
+	sh := s.shard(key)
+
+	sh.Lock()
+	defer sh.Unlock()
+
+	now := time.Now()
+	it := sh.live(key, now)
+
+	var current string
+	if it.revision != 0 {
+		current = it.text()
+	}
+
+	if int64(len(current)+len(suffix)) > limit {
+		return "", 0, ErrorValueTooLarge
+	}
+
+	value := current + suffix
+	if err := commitIncrement(ctx, value, it.revision+1); err != nil {
+		return "", 0, err
+	}
+
+	if it.revision == 0 {
+		delete(sh.expires, key) // Срок истёкшего, но не удалённого ключа
+	}
+
+	sh.replace(key, sh.newItem(value, it.revision+1, it.contentType), now)
+
+	return value, it.revision + 1, nil
+}
+
+// Update stores value with an explicit revision and keeps the key's
+// deadline and content type, as recorded for increments in the
+// transaction log.
+func (s *ShardedStore) Update(ctx context.Context, key, value string, revision uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	sh := s.shard(key)
+
+	sh.Lock()
+	sh.replace(key, sh.newItem(value, revision, sh.data[key].contentType), time.Now())
+	sh.Unlock()
+
+	return nil
+}
+
+func (s *ShardedStore) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	sh := s.shard(key)
+
+	sh.Lock()
+	defer sh.Unlock()
+
+	if err := commitWrite(ctx, 0, nil); err != nil {
+		return err
+	}
+
+	sh.forget(key)
+
+	return nil
+}
+
+// SoftDelete removes key like Delete, but keeps its value, content type
+// and deadline in a tombstone until the given moment. A key that is not
+// live is removed without one.
+func (s *ShardedStore) SoftDelete(ctx context.Context, key string, until time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	sh := s.shard(key)
+
+	sh.Lock()
+	defer sh.Unlock()
+
+	if err := commitWrite(ctx, 0, nil); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	it := sh.live(key, now)
+	deadline := sh.expires[key]
+
+	sh.forget(key)
+
+	if it.revision != 0 && now.Before(until) {
+		sh.tombstones[key] = tombstone{item: it, expires: deadline, until: until}
+	}
+
+	return nil
+}
+
+// Undelete brings back the value of a soft-deleted key as its next
+// revision, with the content type and deadline it had. It fails with
+// ErrorNoSuchKey if the key has no tombstone or the tombstone or the
+// key's deadline has run out. The commit of ctx, if any, runs as for a
+// batch of one put before the key changes.
+func (s *ShardedStore) Undelete(ctx context.Context, key string) (Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return Entry{}, err
+	}
+
+	sh := s.shard(key)
+
+	sh.Lock()
+	defer sh.Unlock()
+
+	now := time.Now()
+
+	t, ok := sh.tombstones[key]
+	if !ok || !now.Before(t.until) || (!t.expires.IsZero() && !now.Before(t.expires)) {
+		return Entry{}, ErrorNoSuchKey
+	}
+
+	it := t.item
+	it.revision++
+
+	op := BatchOp{Op: BatchPut, Key: key, Value: it.text(), contentType: it.contentType, deadline: t.expires}
+	if err := commitOps(ctx, []BatchOp{op}, []BatchResult{{Op: BatchPut, Key: key, OK: true, Revision: it.revision}}); err != nil {
+		return Entry{}, err
+	}
+
+	sh.replace(key, it, now)
+	if !t.expires.IsZero() {
+		sh.expires[key] = t.expires
+	}
+
+	return Entry{Key: key, Value: it.text(), Revision: it.revision, ContentType: it.contentType, Expires: t.expires}, nil
+}
+
+// DeleteMatching removes every key for which match returns true, with all
+// shards write-locked so that no other operation observes some of them
+// removed, and returns the removed live keys in order. The commit of ctx,
+// if any, runs as for a batch of their deletes before any key changes.
+func (s *ShardedStore) DeleteMatching(ctx context.Context, match func(key string) bool) (removed []string, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	for _, sh := range s.shards {
+		sh.Lock()
+		defer sh.Unlock()
+	}
+
+	var matched []string
+	for _, sh := range s.shards {
+		for key := range sh.data {
+			if !match(key) {
+				continue
+			}
+
+			if sh.live(key, now).revision != 0 {
+				removed = append(removed, key)
+			}
+			matched = append(matched, key) // Истёкшие тоже, без записи в журнал
+		}
+	}
+
+	sort.Strings(removed)
+
+	ops, results := deleteOps(removed)
+	if err := commitOps(ctx, ops, results); err != nil {
+		return nil, err
+	}
+
+	for _, key := range matched {
+		s.shard(key).forget(key)
+	}
+
+	return removed, nil
+}
+
+// Expire sets the moment after which key is no longer visible and gets
+// evicted by the reaper.
+func (s *ShardedStore) Expire(ctx context.Context, key string, deadline time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	sh := s.shard(key)
+
+	sh.Lock()
+	defer sh.Unlock()
+
+	if _, ok := sh.data[key]; !ok {
+		return ErrorNoSuchKey
+	}
+
+	sh.expires[key] = deadline
+
+	return nil
+}
+
+// SetContentType records the media type of the key's value. It is
+// cleared by the next write that replaces the value.
+func (s *ShardedStore) SetContentType(ctx context.Context, key, contentType string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	sh := s.shard(key)
+
+	sh.Lock()
+	defer sh.Unlock()
+
+	it, ok := sh.data[key]
+	if !ok {
+		return ErrorNoSuchKey
+	}
+
+	it.contentType = contentType
+	sh.data[key] = it
+
+	return nil
+}
+
+// TTL returns the time left before key expires, or NoExpiration if it
+// has no deadline.
+func (s *ShardedStore) TTL(ctx context.Context, key string) (time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	sh := s.shard(key)
+
+	sh.RLock()
+	_, ok := sh.data[key]
+	deadline, expiring := sh.expires[key]
+	sh.RUnlock()
+
+	if !ok {
+		return 0, ErrorNoSuchKey
+	}
+
+	if !expiring {
+		return NoExpiration, nil
+	}
+
+	ttl := time.Until(deadline)
+	if ttl <= 0 {
+		return 0, ErrorNoSuchKey
+	}
+
+	return ttl, nil
+}
+
+// List returns up to limit live entries whose keys start with prefix and
+// sort after the given key, ordered by key. more reports whether further
+// entries remain.
+func (s *ShardedStore) List(ctx context.Context, prefix, after string, limit int) (entries []Entry, more bool, err error) {
+	start := prefix
+	if after >= prefix {
+		start = after + "\x00" // Первый ключ после after
+	}
+
+	return s.scan(ctx, start, func(key string) bool { return strings.HasPrefix(key, prefix) }, limit)
+}
+
+// Range returns up to limit live entries whose keys sort from start up
+// to, but not including, end, ordered by key; an empty end leaves the
+// range open. more reports whether further entries remain.
+func (s *ShardedStore) Range(ctx context.Context, start, end string, limit int) (entries []Entry, more bool, err error) {
+	return s.scan(ctx, start, func(key string) bool { return end == "" || key < end }, limit)
+}
+
+// scan merges the key indexes of the shards from start on, collecting up
+// to limit live entries until a key is not within. All shards are
+// read-locked meanwhile, so a page reflects one consistent state of the
+// store.
+func (s *ShardedStore) scan(ctx context.Context, start string, within func(key string) bool, limit int) (entries []Entry, more bool, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+
+	now := time.Now()
+	entries = []Entry{}
+
+	for _, sh := range s.shards {
+		sh.RLock()
+	}
+
+	defer func() {
+		for _, sh := range s.shards {
+			sh.RUnlock()
+		}
+	}()
+
+	cursors := make([]*indexNode, len(s.shards))
+	for i, sh := range s.shards {
+		cursors[i] = sh.index.seek(start)
+	}
+
+	for {
+		next := -1
+		for i, node := range cursors {
+			if node != nil && (next < 0 || node.key < cursors[next].key) {
+				next = i
+			}
+		}
+
+		if next < 0 || !within(cursors[next].key) {
+			return entries, false, nil
+		}
+
+		key, sh := cursors[next].key, s.shards[next]
+		cursors[next] = cursors[next].next[0]
+
+		it := sh.live(key, now)
+		if it.revision == 0 {
+			continue
+		}
+
+		if len(entries) == limit {
+			return entries, true, nil
+		}
+
+		entries = append(entries, Entry{Key: key, Value: it.text(), Revision: it.revision, ContentType: it.contentType})
+	}
+}
+
+// Stats returns the number of live keys and the total size of their
+// values as held in memory, after compression. It walks every shard, one
+// at a time.
+func (s *ShardedStore) Stats(ctx context.Context) (keys int, bytes int64, err error) {
+	now := time.Now()
+
+	for _, sh := range s.shards {
+		if err := ctx.Err(); err != nil {
+			return 0, 0, err
+		}
+
+		sh.RLock()
+		for key, it := range sh.data {
+			if deadline, ok := sh.expires[key]; ok && !now.Before(deadline) {
+				continue
+			}
+
+			keys++
+			bytes += int64(len(it.value))
+		}
+		sh.RUnlock()
+	}
+
+	return keys, bytes, nil
+}
+
+// ReapExpired removes every key whose deadline is not after now, one
+// shard at a time, and returns the removed keys. It also purges the
+// tombstones that have run out, without returning them. It stops at the
+// next shard once ctx is done.
+func (s *ShardedStore) ReapExpired(ctx context.Context, now time.Time) (reaped []string) {
+	for _, sh := range s.shards {
+		if ctx.Err() != nil {
+			break
+		}
+
+		sh.Lock()
+		for key, deadline := range sh.expires {
+			if !now.Before(deadline) {
+				sh.forget(key)
+				reaped = append(reaped, key)
+			}
+		}
+
+		for key, t := range sh.tombstones {
+			if !now.Before(t.until) || (!t.expires.IsZero() && !now.Before(t.expires)) {
+				delete(sh.tombstones, key)
+			}
+		}
+		sh.Unlock()
+	}
+
+	return reaped
+}
+
+// Batch applies ops in order while holding the write locks of every shard
+// they touch, so no other operation observes a partially applied batch.
+// The commit of ctx, if any, runs before any key changes (see withCommit).
+func (s *ShardedStore) Batch(ctx context.Context, ops []BatchOp) ([]BatchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, len(ops))
+	for i, op := range ops {
+		keys[i] = op.Key
+	}
+
+	unlock := s.lockKeys(keys)
+	defer unlock()
+
+	return s.applyOps(ctx, ops, time.Now())
+}
+
+// Txn evaluates t.Compare and applies t.Success if every comparison holds,
+// t.Failure otherwise. Like Batch, it holds the write locks of every shard
+// involved throughout.
+func (s *ShardedStore) Txn(ctx context.Context, t Txn) (TxnResult, error) {
+	if err := ctx.Err(); err != nil {
+		return TxnResult{}, err
+	}
+
+	var keys []string
+	for _, c := range t.Compare {
+		keys = append(keys, c.Key)
+	}
+	for _, op := range append(t.Success, t.Failure...) {
+		keys = append(keys, op.Key)
+	}
+
+	unlock := s.lockKeys(keys)
+	defer unlock()
+
+	now := time.Now()
+	succeeded := true
+
+	for _, c := range t.Compare {
+		it := s.shard(c.Key).live(c.Key, now)
+		if !c.holds(it.text(), it.revision) {
+			succeeded = false
+			break
+		}
+	}
+
+	ops := t.Failure
+	if succeeded {
+		ops = t.Success
+	}
+
+	results, err := s.applyOps(ctx, ops, now)
+	if err != nil {
+		return TxnResult{}, err
+	}
+
+	return TxnResult{Succeeded: succeeded, Results: results}, nil
+}
+
+// applyOps works out the results of ops first, as the keys will be after
+// each of them, then runs the commit of ctx and applies them only if it
+// succeeds. It must be called with the write locks of every shard ops
+// touch.
+func (s *ShardedStore) applyOps(ctx context.Context, ops []BatchOp, now time.Time) ([]BatchResult, error) {
+	type state struct {
+		value    string
+		revision uint64 // 0: ключ удалён
+	}
+
+	planned := make(map[string]state) // Ключи, изменённые предыдущими операциями
+	current := func(key string) state {
+		if st, ok := planned[key]; ok {
+			return st
+		}
+
+		it := s.shard(key).live(key, now)
+		if it.revision == 0 {
+			return state{}
+		}
+
+		return state{it.text(), it.revision}
+	}
+
+	results := make([]BatchResult, len(ops))
+
+	for i, op := range ops {
+		st := current(op.Key)
+		result := BatchResult{Op: op.Op, Key: op.Key}
+
+		switch op.Op {
+		case BatchGet:
+			if st.revision != 0 {
+				result.Value, result.Revision, result.OK = st.value, st.revision, true
+			}
+		case BatchPut:
+			result.Revision, result.OK = st.revision+1, true
+			planned[op.Key] = state{op.Value, st.revision + 1}
+		case BatchDelete:
+			if st.revision != 0 {
+				result.OK = true
+				planned[op.Key] = state{}
+			}
+		}
+
+		results[i] = result
+	}
+
+	if err := commitOps(ctx, ops, results); err != nil {
+		return nil, err
+	}
+
+	for i, op := range ops {
+		sh := s.shard(op.Key)
+
+		switch {
+		case op.Op == BatchPut:
+			sh.replace(op.Key, sh.newItem(op.Value, results[i].Revision, op.contentType), now)
+			if op.deadline.IsZero() {
+				delete(sh.expires, op.Key)
+			} else {
+				sh.expires[op.Key] = op.deadline
+			}
+		case op.Op == BatchDelete && results[i].OK:
+			sh.forget(op.Key)
+		}
+	}
+
+	return results, nil
+}
+
+// Snapshot returns every live entry, including its deadline, as of one
+// moment: all shards are read-locked while the entries are copied.
+func (s *ShardedStore) Snapshot(ctx context.Context) ([]Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	for _, sh := range s.shards {
+		sh.RLock()
+	}
+
+	var entries []Entry
+
+	for _, sh := range s.shards {
+		for key, it := range sh.data {
+			deadline, expiring := sh.expires[key]
+			if expiring && !now.Before(deadline) {
+				continue
+			}
+
+			entries = append(entries, Entry{Key: key, Value: it.text(), Revision: it.revision, ContentType: it.contentType, Expires: deadline, Modified: it.modified, Created: it.created})
+		}
+	}
+
+	for _, sh := range s.shards {
+		sh.RUnlock()
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+
+	return entries, nil
+}
+
+// ReplaceAll atomically swaps the whole content of the store for entries
+// and returns the keys that were present before but are not in entries.
+// The commit of ctx, if any, runs for the deletes of those keys and the
+// puts of entries before the store changes (see replaceOps).
+func (s *ShardedStore) ReplaceAll(ctx context.Context, entries []Entry) (removed []string, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, sh := range s.shards {
+		sh.Lock()
+		defer sh.Unlock()
+	}
+
+	incoming := make(map[string]struct{}, len(entries))
+	for _, e := range entries {
+		incoming[e.Key] = struct{}{}
+	}
+
+	for _, sh := range s.shards {
+		for key := range sh.data {
+			if _, ok := incoming[key]; !ok {
+				removed = append(removed, key)
+			}
+		}
+	}
+
+	sort.Strings(removed)
+
+	ops, results := replaceOps(removed, entries)
+	if err := commitOps(ctx, ops, results); err != nil {
+		return nil, err
+	}
+
+	for _, sh := range s.shards {
+		sh.data = make(map[string]item)
+		sh.expires = make(map[string]time.Time)
+		sh.history = make(map[string][]item)
+		sh.tombstones = make(map[string]tombstone)
+		sh.index = newKeyIndex()
+	}
+
+	now := time.Now()
+
+	for _, e := range entries {
+		sh := s.shard(e.Key)
+		it := sh.newItem(e.Value, e.Revision, e.ContentType)
+		it.modified, it.created = restoredTimes(e, now)
+		sh.data[e.Key] = it
+		sh.index.insert(e.Key)
+
+		if !e.Expires.IsZero() {
+			sh.expires[e.Key] = e.Expires
+		}
+	}
+
+	return removed, nil
+}
+
+// History returns the kept previous revisions of key followed by its
+// current value, oldest first.
+func (s *ShardedStore) History(ctx context.Context, key string) ([]Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	sh := s.shard(key)
+
+	sh.RLock()
+	defer sh.RUnlock()
+
+	current := sh.live(key, time.Now())
+	if current.revision == 0 {
+		return nil, ErrorNoSuchKey
+	}
+
+	history := sh.history[key]
+
+	entries := make([]Entry, 0, len(history)+1)
+	for _, it := range append(history[:len(history):len(history)], current) {
+		entries = append(entries, Entry{Key: key, Value: it.text(), Revision: it.revision, ContentType: it.contentType, Modified: it.modified, Created: it.created, Checksum: formatChecksum(it.sum)})
+	}
+	entries[len(entries)-1].Expires = sh.expires[key]
+
+	return entries, nil
+}
+
+// runReaper evicts expired keys every interval and calls onExpire with
+// each of them, until ctx is done.
+func runReaper(ctx context.Context, s Store, interval time.Duration, onExpire func(key string)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, key := range s.ReapExpired(ctx, now) {
+				onExpire(key)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package kvs
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShardedStoreRevisions(t *testing.T) {
+	ctx := context.Background()
+	s := NewShardedStore(4, 0, 0, false)
+
+	for want := uint64(1); want <= 3; want++ {
+		revision, err := s.Put(ctx, "a", strconv.FormatUint(want, 10))
+		if err != nil || revision != want {
+			t.Fatalf("put %d got revision %d (%v)", want, revision, err)
+		}
+	}
+
+	if _, err := s.CompareAndPut(ctx, "a", "x", 2); !errors.Is(err, ErrorRevisionMismatch) {
+		t.Fatalf("CompareAndPut at a stale revision returned %v, want ErrorRevisionMismatch", err)
+	}
+
+	if revision, err := s.CompareAndPut(ctx, "a", "x", 3); err != nil || revision != 4 {
+		t.Fatalf("CompareAndPut at the current revision got %d (%v), want 4", revision, err)
+	}
+
+	if err := s.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Get(ctx, "a"); !errors.Is(err, ErrorNoSuchKey) {
+		t.Fatalf("Get after Delete returned %v, want ErrorNoSuchKey", err)
+	}
+}
+
+func TestShardedStoreListsAcrossShards(t *testing.T) {
+	ctx := context.Background()
+	s := NewShardedStore(8, 0, 0, false)
+
+	for i := 0; i < 100; i++ {
+		if _, err := s.Put(ctx, "k"+strconv.Itoa(100+i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, more, err := s.List(ctx, "k", "", 1000)
+	if err != nil || more || len(entries) != 100 {
+		t.Fatalf("listed %d keys (more %v, %v), want 100", len(entries), more, err)
+	}
+
+	for i, e := range entries {
+		if want := "k" + strconv.Itoa(100+i); e.Key != want {
+			t.Fatalf("key %d is %q, want %q", i, e.Key, want)
+		}
+	}
+}
+
+func TestShardedStoreConcurrentIncrements(t *testing.T) {
+	ctx := context.Background()
+	s := NewShardedStore(4, 0, 0, false)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < 100; i++ {
+				if _, _, err := s.Increment(ctx, "n", 1); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if value, err := s.Get(ctx, "n"); err != nil || value != "800" {
+		t.Fatalf("n is %q (%v), want 800", value, err)
+	}
+}
+
+func TestShardedStoreReapsExpiredKeys(t *testing.T) {
+	ctx := context.Background()
+	s := NewShardedStore(4, 0, 0, false)
+	now := time.Now()
+
+	for _, key := range []string{"a", "b"} {
+		if _, err := s.Put(ctx, key, "1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.Expire(ctx, "a", now); err != nil {
+		t.Fatal(err)
+	}
+
+	s.ReapExpired(ctx, now)
+
+	if _, err := s.Get(ctx, "a"); !errors.Is(err, ErrorNoSuchKey) {
+		t.Fatalf("a survives its deadline (%v)", err)
+	}
+
+	if value, err := s.Get(ctx, "b"); err != nil || value != "1" {
+		t.Fatalf("b is %q (%v), want 1", value, err)
+	}
+}
+
+func TestReaperStopsWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewShardedStore(4, 0, 0, false)
+
+	if _, err := s.Put(ctx, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Expire(ctx, "a", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	expired := make(chan string, 1)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		runReaper(ctx, s, time.Millisecond, func(key string) { expired <- key })
+	}()
+
+	if key := <-expired; key != "a" {
+		t.Fatalf("reaped %q, want a", key)
+	}
+
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("reaper still running after its context was cancelled")
+	}
+}
+
+// BenchmarkPut compares parallel puts of distinct keys on one shard, the
+// single-mutex store the sharded one replaced, with puts on 32 shards.
+func BenchmarkPut(b *testing.B) {
+	for _, shards := range []int{1, 32} {
+		b.Run("shards="+strconv.Itoa(shards), func(b *testing.B) {
+			ctx := context.Background()
+			s := NewShardedStore(shards, 0, 0, false)
+
+			var next atomic.Int64
+
+			b.RunParallel(func(pb *testing.PB) {
+				prefix := "k" + strconv.FormatInt(next.Add(1), 10) + ":"
+
+				for i := 0; pb.Next(); i++ {
+					if _, err := s.Put(ctx, prefix+strconv.Itoa(i%1024), "value"); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
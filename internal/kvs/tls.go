@@ -0,0 +1,73 @@
+package kvs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+/**
+ * TLS.
+ *
+ * TLS is enabled either with a static certificate and key or with
+ * certificates obtained from Let's Encrypt for the autocert hosts. Setting
+ * a client CA file additionally requires clients to present a certificate
+ * signed by one of the CAs in that PEM file.
+ */
+
+// newTLSConfig returns the server TLS configuration, or nil when TLS is
+// not configured.
+func newTLSConfig(c TLSConfig) (*tls.Config, error) {
+	var config *tls.Config
+
+	switch {
+	case c.CertFile != "" && len(c.AutocertHosts) > 0:
+		return nil, fmt.Errorf("TLS certificate file and autocert hosts are mutually exclusive")
+
+	case c.CertFile != "" || c.KeyFile != "":
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+
+		config = &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	case len(c.AutocertHosts) > 0:
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(c.AutocertHosts...),
+			Cache:      autocert.DirCache(c.AutocertCache),
+		}
+
+		config = manager.TLSConfig()
+
+	default:
+		if c.ClientCAFile != "" {
+			return nil, fmt.Errorf("TLS client CA file requires a server certificate")
+		}
+
+		return nil, nil
+	}
+
+	config.MinVersion = tls.VersionTLS12
+
+	if caFile := c.ClientCAFile; caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA file: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
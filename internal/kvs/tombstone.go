@@ -0,0 +1,59 @@
+package kvs
+
+import (
+	"errors"
+	"net/http"
+)
+
+/**
+ * Soft delete.
+ *
+ * With a tombstone retention set, DELETE /v1/key/{key} keeps the deleted
+ * value for that long, and POST /v1/key/{key}/undelete brings it back as
+ * the key's next revision, with its content type and deadline, until the
+ * key is written again or the retention runs out. Tombstones are recorded
+ * in the transaction log and dropped by compaction once they run out, but
+ * are not part of snapshots. Deletes in batches and transactions, by
+ * prefix or pattern and through the Redis and memcached protocols remain
+ * final.
+ */
+
+// keyUndeleteHandler serves POST /v1/key/{key}/undelete.
+func keyUndeleteHandler(w http.ResponseWriter, r *http.Request) {
+	vars := pathVars(r)
+	key := vars["key"]
+
+	if config.Store.TombstoneRetention <= 0 {
+		http.Error(w, "Soft delete is not enabled", http.StatusNotFound)
+		return
+	}
+
+	durable, err := syncWrite(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entry, err := store.Undelete(loggedOps(r.Context()), key)
+	if errors.Is(err, ErrorNoSuchKey) {
+		http.Error(w, "No deleted value to restore", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	recordPut(r.Context(), key, entry.Value, entry.ContentType, entry.Expires)
+
+	if durable {
+		if err := logger.Sync(r.Context()); err != nil {
+			serverError(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("ETag", formatETag(entry.Revision))
+	w.WriteHeader(http.StatusOK)
+}
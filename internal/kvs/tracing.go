@@ -0,0 +1,650 @@
+package kvs
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/**
+ * Tracing.
+ *
+ * With an OTLP endpoint configured, HTTP requests and RESP commands are
+ * recorded as OpenTelemetry spans, with child spans for the store
+ * operations and transaction log syncs they perform, and exported in
+ * batches over OTLP/HTTP with JSON encoding. A store span covers waiting
+ * for and holding its locks; a sync span covers waiting for the log to
+ * reach disk. The file log records the write of a batch that traced syncs
+ * wait for as a tlog.WriteBatch span, with a tlog.Fsync child, under the
+ * first of those syncs and linked to the others, so every request that
+ * waited finds the batch that persisted its events. Other log writes are
+ * only queued, and batches no traced sync waits for get no span.
+ * A request continues the trace of its W3C traceparent header and keeps
+ * its sampling decision; new traces are sampled at the configured ratio.
+ */
+const (
+	traceBatchSize      = 512
+	traceQueueSize      = 4096 // Спаны сверх очереди отбрасываются
+	traceExportInterval = 5 * time.Second
+	traceExportTimeout  = 10 * time.Second
+)
+
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+
+	spanStatusError = 2
+)
+
+var tracer *Tracer // nil, если трассировка не настроена
+
+type spanKey struct{}
+
+type Tracer struct {
+	endpoint string
+	resource otlpResource
+	ratio    float64
+	client   *http.Client
+
+	spans   chan otlpSpan
+	dropped atomic.Uint64
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewTracer starts exporting spans as configured by c. It returns nil
+// when no endpoint is set, and every Tracer and Span method accepts nil.
+func NewTracer(c TracingConfig) *Tracer {
+	if c.Endpoint == "" {
+		return nil
+	}
+
+	t := &Tracer{
+		endpoint: c.Endpoint,
+		resource: otlpResource{Attributes: []otlpKeyValue{stringAttribute("service.name", c.ServiceName)}},
+		ratio:    c.SampleRatio,
+		client:   &http.Client{Timeout: traceExportTimeout},
+		spans:    make(chan otlpSpan, traceQueueSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	go t.run()
+
+	return t
+}
+
+// StartRequest begins the server span of a request or command. It joins
+// the trace of traceparent when that is a valid header and otherwise
+// starts a new trace if sampled.
+func (t *Tracer) StartRequest(ctx context.Context, name, traceparent string) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	span := &Span{tracer: t, name: name, kind: spanKindServer, start: time.Now()}
+
+	if traceID, parentID, sampled, ok := parseTraceparent(traceparent); ok {
+		if !sampled {
+			return ctx, nil
+		}
+		span.traceID, span.parentID = traceID, parentID
+	} else {
+		if rand.Float64() >= t.ratio {
+			return ctx, nil
+		}
+		crand.Read(span.traceID[:])
+	}
+
+	crand.Read(span.spanID[:])
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// Start begins a child of the span in ctx. Nothing is recorded outside a
+// sampled request, so background work such as reaping leaves no traces.
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	parent, _ := ctx.Value(spanKey{}).(*Span)
+	if t == nil || parent == nil {
+		return ctx, nil
+	}
+
+	span := parent.child(name)
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// Close exports the spans still queued and stops the exporter.
+func (t *Tracer) Close() {
+	if t == nil {
+		return
+	}
+
+	close(t.stop)
+	<-t.done
+}
+
+func (t *Tracer) enqueue(span otlpSpan) {
+	select {
+	case t.spans <- span:
+	default:
+		t.dropped.Add(1) // Экспорт не успевает; запрос не ждёт
+	}
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(traceExportInterval)
+	defer ticker.Stop()
+
+	var batch []otlpSpan
+
+	for {
+		select {
+		case span := <-t.spans:
+			if batch = append(batch, span); len(batch) >= traceBatchSize {
+				batch = t.flush(batch)
+			}
+
+		case <-ticker.C:
+			batch = t.flush(batch)
+
+		case <-t.stop:
+			for {
+				select {
+				case span := <-t.spans:
+					batch = append(batch, span)
+				default:
+					t.flush(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// flush exports batch and returns it emptied for reuse.
+func (t *Tracer) flush(batch []otlpSpan) []otlpSpan {
+	if n := t.dropped.Swap(0); n > 0 {
+		slog.Warn("trace spans dropped", "spans", n)
+	}
+
+	if len(batch) == 0 {
+		return batch
+	}
+
+	if err := t.export(batch); err != nil {
+		slog.Warn("trace export failed", "spans", len(batch), "error", err)
+	}
+
+	return batch[:0]
+}
+
+func (t *Tracer) export(spans []otlpSpan) error {
+	body, err := json.Marshal(otlpExport{ResourceSpans: []otlpResourceSpans{{
+		Resource:   t.resource,
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "kvs"}, Spans: spans}},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+
+	return nil
+}
+
+// Middleware records the server span of every API request.
+func (t *Tracer) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var template string
+		if route := currentRoute(r); route != nil {
+			template = route.template
+		}
+
+		ctx, span := t.StartRequest(r.Context(), strings.TrimSpace(r.Method+" "+template), r.Header.Get("traceparent"))
+		if span == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		span.SetString("http.request.method", r.Method)
+		span.SetString("http.route", template)
+		span.SetString("kvs.request_id", RequestIDFrom(r.Context()))
+		span.SetInt("http.response.status_code", int64(rec.status))
+
+		if rec.status >= 500 {
+			span.End(errors.New(http.StatusText(rec.status)))
+			return
+		}
+
+		span.End(nil)
+	})
+}
+
+// parseTraceparent parses a version 00 W3C traceparent header.
+func parseTraceparent(header string) (traceID [16]byte, parentID [8]byte, sampled, ok bool) {
+	fields := strings.Split(strings.TrimSpace(header), "-")
+	if len(fields) < 4 || len(fields[0]) != 2 || fields[0] == "ff" || (fields[0] == "00" && len(fields) != 4) ||
+		len(fields[1]) != 2*len(traceID) || len(fields[2]) != 2*len(parentID) {
+		return traceID, parentID, false, false
+	}
+
+	flags, err := hex.DecodeString(fields[3])
+	if err != nil || len(flags) != 1 {
+		return traceID, parentID, false, false
+	}
+
+	if _, err := hex.Decode(traceID[:], []byte(fields[1])); err != nil || traceID == [16]byte{} {
+		return traceID, parentID, false, false
+	}
+
+	if _, err := hex.Decode(parentID[:], []byte(fields[2])); err != nil || parentID == [8]byte{} {
+		return traceID, parentID, false, false
+	}
+
+	return traceID, parentID, flags[0]&1 == 1, true
+}
+
+// Span is a recorded operation. It belongs to the goroutine that started it.
+type Span struct {
+	tracer   *Tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+
+	attributes []otlpKeyValue
+	links      []otlpLink
+}
+
+// child begins a child of s, or returns nil if s is nil.
+func (s *Span) child(name string) *Span {
+	if s == nil {
+		return nil
+	}
+
+	span := &Span{tracer: s.tracer, name: name, kind: spanKindInternal, start: time.Now(), traceID: s.traceID, parentID: s.spanID}
+	crand.Read(span.spanID[:])
+
+	return span
+}
+
+// Link relates s to other, a span of another operation it serves, such as
+// a log batch to a request waiting for it.
+func (s *Span) Link(other *Span) {
+	if s != nil && other != nil {
+		s.links = append(s.links, otlpLink{TraceID: hex.EncodeToString(other.traceID[:]), SpanID: hex.EncodeToString(other.spanID[:])})
+	}
+}
+
+func (s *Span) SetString(key, value string) {
+	if s != nil {
+		s.attributes = append(s.attributes, stringAttribute(key, value))
+	}
+}
+
+func (s *Span) SetInt(key string, value int64) {
+	if s != nil {
+		n := strconv.FormatInt(value, 10)
+		s.attributes = append(s.attributes, otlpKeyValue{Key: key, Value: otlpAnyValue{IntValue: &n}})
+	}
+}
+
+// End completes the span and queues it for export. A non-nil err marks
+// it as failed, unless err only reports an ordinary outcome such as a
+// missing key.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+
+	span := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(time.Now().UnixNano(), 10),
+		Attributes:        s.attributes,
+		Links:             s.links,
+	}
+
+	if s.parentID != [8]byte{} {
+		span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+
+	if err != nil && !expectedError(err) {
+		span.Status = otlpStatus{Code: spanStatusError, Message: err.Error()}
+	}
+
+	s.tracer.enqueue(span)
+}
+
+func expectedError(err error) bool {
+	for _, expected := range []error{ErrorNoSuchKey, ErrorRevisionMismatch, ErrorNotInteger, ErrorOverflow} {
+		if errors.Is(err, expected) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/**
+ * OTLP/JSON encoding of spans.
+ */
+type otlpExport struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"` // В OTLP/JSON идентификаторы в hex, а не base64
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Links             []otlpLink     `json:"links,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpLink struct {
+	TraceID string `json:"traceId"`
+	SpanID  string `json:"spanId"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"` // int64 кодируется строкой
+}
+
+func stringAttribute(key, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: &value}}
+}
+
+/**
+ * Traced store.
+ *
+ * TracingStore wraps a Store and records a span for every operation
+ * performed inside a traced request, and its time as a phase of a
+ * request timed for the slow log.
+ */
+type TracingStore struct {
+	Store
+}
+
+// storeSpan is the span of a store operation and its slow log phase.
+type storeSpan struct {
+	*Span
+	done func()
+}
+
+func startStoreSpan(ctx context.Context, name string) (context.Context, storeSpan) {
+	done := timePhase(ctx, name)
+	ctx, span := tracer.Start(ctx, name)
+
+	return ctx, storeSpan{span, done}
+}
+
+func (s storeSpan) End(err error) {
+	s.done()
+	s.Span.End(err)
+}
+
+func (s TracingStore) Get(ctx context.Context, key string) (string, error) {
+	ctx, span := startStoreSpan(ctx, "store.Get")
+	value, err := s.Store.Get(ctx, key)
+	span.End(err)
+
+	return value, err
+}
+
+func (s TracingStore) GetEntry(ctx context.Context, key string) (Entry, error) {
+	ctx, span := startStoreSpan(ctx, "store.GetEntry")
+	entry, err := s.Store.GetEntry(ctx, key)
+	span.End(err)
+
+	return entry, err
+}
+
+func (s TracingStore) Put(ctx context.Context, key string, value string) (uint64, error) {
+	ctx, span := startStoreSpan(ctx, "store.Put")
+	revision, err := s.Store.Put(ctx, key, value)
+	span.End(err)
+
+	return revision, err
+}
+
+func (s TracingStore) CompareAndPut(ctx context.Context, key, value string, revision uint64) (uint64, error) {
+	ctx, span := startStoreSpan(ctx, "store.CompareAndPut")
+	revision, err := s.Store.CompareAndPut(ctx, key, value, revision)
+	span.End(err)
+
+	return revision, err
+}
+
+func (s TracingStore) Restore(ctx context.Context, key, value string, revision uint64) error {
+	ctx, span := startStoreSpan(ctx, "store.Restore")
+	err := s.Store.Restore(ctx, key, value, revision)
+	span.End(err)
+
+	return err
+}
+
+func (s TracingStore) Increment(ctx context.Context, key string, by int64) (int64, uint64, error) {
+	ctx, span := startStoreSpan(ctx, "store.Increment")
+	value, revision, err := s.Store.Increment(ctx, key, by)
+	span.End(err)
+
+	return value, revision, err
+}
+
+func (s TracingStore) Append(ctx context.Context, key, suffix string, limit int64) (string, uint64, error) {
+	ctx, span := startStoreSpan(ctx, "store.Append")
+	value, revision, err := s.Store.Append(ctx, key, suffix, limit)
+	span.End(err)
+
+	return value, revision, err
+}
+
+func (s TracingStore) Update(ctx context.Context, key, value string, revision uint64) error {
+	ctx, span := startStoreSpan(ctx, "store.Update")
+	err := s.Store.Update(ctx, key, value, revision)
+	span.End(err)
+
+	return err
+}
+
+func (s TracingStore) Delete(ctx context.Context, key string) error {
+	ctx, span := startStoreSpan(ctx, "store.Delete")
+	err := s.Store.Delete(ctx, key)
+	span.End(err)
+
+	return err
+}
+
+func (s TracingStore) DeleteMatching(ctx context.Context, match func(key string) bool) ([]string, error) {
+	ctx, span := startStoreSpan(ctx, "store.DeleteMatching")
+	removed, err := s.Store.DeleteMatching(ctx, match)
+	span.SetInt("kvs.removed", int64(len(removed)))
+	span.End(err)
+
+	return removed, err
+}
+
+func (s TracingStore) SoftDelete(ctx context.Context, key string, until time.Time) error {
+	ctx, span := startStoreSpan(ctx, "store.SoftDelete")
+	err := s.Store.SoftDelete(ctx, key, until)
+	span.End(err)
+
+	return err
+}
+
+func (s TracingStore) Undelete(ctx context.Context, key string) (Entry, error) {
+	ctx, span := startStoreSpan(ctx, "store.Undelete")
+	entry, err := s.Store.Undelete(ctx, key)
+	span.End(err)
+
+	return entry, err
+}
+
+func (s TracingStore) Expire(ctx context.Context, key string, deadline time.Time) error {
+	ctx, span := startStoreSpan(ctx, "store.Expire")
+	err := s.Store.Expire(ctx, key, deadline)
+	span.End(err)
+
+	return err
+}
+
+func (s TracingStore) SetContentType(ctx context.Context, key, contentType string) error {
+	ctx, span := startStoreSpan(ctx, "store.SetContentType")
+	err := s.Store.SetContentType(ctx, key, contentType)
+	span.End(err)
+
+	return err
+}
+
+func (s TracingStore) TTL(ctx context.Context, key string) (time.Duration, error) {
+	ctx, span := startStoreSpan(ctx, "store.TTL")
+	ttl, err := s.Store.TTL(ctx, key)
+	span.End(err)
+
+	return ttl, err
+}
+
+func (s TracingStore) List(ctx context.Context, prefix, after string, limit int) ([]Entry, bool, error) {
+	ctx, span := startStoreSpan(ctx, "store.List")
+	entries, more, err := s.Store.List(ctx, prefix, after, limit)
+	span.SetInt("kvs.entries", int64(len(entries)))
+	span.End(err)
+
+	return entries, more, err
+}
+
+func (s TracingStore) Range(ctx context.Context, start, end string, limit int) ([]Entry, bool, error) {
+	ctx, span := startStoreSpan(ctx, "store.Range")
+	entries, more, err := s.Store.Range(ctx, start, end, limit)
+	span.SetInt("kvs.entries", int64(len(entries)))
+	span.End(err)
+
+	return entries, more, err
+}
+
+func (s TracingStore) Stats(ctx context.Context) (int, int64, error) {
+	ctx, span := startStoreSpan(ctx, "store.Stats")
+	keys, bytes, err := s.Store.Stats(ctx)
+	span.End(err)
+
+	return keys, bytes, err
+}
+
+func (s TracingStore) ReapExpired(ctx context.Context, now time.Time) []string {
+	ctx, span := startStoreSpan(ctx, "store.ReapExpired")
+	reaped := s.Store.ReapExpired(ctx, now)
+	span.End(nil)
+
+	return reaped
+}
+
+func (s TracingStore) Batch(ctx context.Context, ops []BatchOp) ([]BatchResult, error) {
+	ctx, span := startStoreSpan(ctx, "store.Batch")
+	results, err := s.Store.Batch(ctx, ops)
+	span.SetInt("kvs.ops", int64(len(ops)))
+	span.End(err)
+
+	return results, err
+}
+
+func (s TracingStore) Txn(ctx context.Context, t Txn) (TxnResult, error) {
+	ctx, span := startStoreSpan(ctx, "store.Txn")
+	result, err := s.Store.Txn(ctx, t)
+	span.End(err)
+
+	return result, err
+}
+
+func (s TracingStore) Snapshot(ctx context.Context) ([]Entry, error) {
+	ctx, span := startStoreSpan(ctx, "store.Snapshot")
+	entries, err := s.Store.Snapshot(ctx)
+	span.SetInt("kvs.entries", int64(len(entries)))
+	span.End(err)
+
+	return entries, err
+}
+
+func (s TracingStore) ReplaceAll(ctx context.Context, entries []Entry) ([]string, error) {
+	ctx, span := startStoreSpan(ctx, "store.ReplaceAll")
+	removed, err := s.Store.ReplaceAll(ctx, entries)
+	span.SetInt("kvs.entries", int64(len(entries)))
+	span.End(err)
+
+	return removed, err
+}
+
+func (s TracingStore) History(ctx context.Context, key string) ([]Entry, error) {
+	ctx, span := startStoreSpan(ctx, "store.History")
+	entries, err := s.Store.History(ctx, key)
+	span.End(err)
+
+	return entries, err
+}
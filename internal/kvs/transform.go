@@ -0,0 +1,143 @@
+package kvs
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/**
+ * Server-side value transformations.
+ *
+ * GET /v1/key/{key}?transform= returns a value derived from the stored one
+ * instead of the value itself: "sha256" its hex SHA-256 digest, "base64"
+ * its standard base64 encoding, and "jsonpath:$.a.b[0]" one member of a
+ * JSON value, selected by object names and array indexes, as written in
+ * the value. The other headers still describe the stored value, except for
+ * Content-Type and Content-Length.
+ */
+var ErrorNotJSON = errors.New("Value is not JSON")
+
+var ErrorNoSuchField = errors.New("No such field")
+
+// transform derives a representation of a value and its media type.
+type transform func(value string) (result, contentType string, err error)
+
+// jsonStep selects an object member by name, or an array element if index
+// is not negative.
+type jsonStep struct {
+	name  string
+	index int
+}
+
+// parseTransform returns the transform named by the transform query
+// parameter.
+func parseTransform(spec string) (transform, error) {
+	switch {
+	case spec == "sha256":
+		return func(value string) (string, string, error) {
+			sum := sha256.Sum256([]byte(value))
+			return hex.EncodeToString(sum[:]), "text/plain; charset=utf-8", nil
+		}, nil
+
+	case spec == "base64":
+		return func(value string) (string, string, error) {
+			return base64.StdEncoding.EncodeToString([]byte(value)), "text/plain; charset=utf-8", nil
+		}, nil
+
+	case strings.HasPrefix(spec, "jsonpath:"):
+		path, err := parseJSONPath(strings.TrimPrefix(spec, "jsonpath:"))
+		if err != nil {
+			return nil, err
+		}
+
+		return func(value string) (string, string, error) {
+			member, err := extractJSON(value, path)
+			return member, "application/json", err
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("Invalid transform %q: want sha256, base64 or jsonpath:$.field", spec)
+	}
+}
+
+// parseJSONPath parses a path such as $.user.emails[0] into its steps.
+func parseJSONPath(path string) ([]jsonStep, error) {
+	rest, ok := strings.CutPrefix(path, "$")
+	if !ok {
+		return nil, fmt.Errorf("Invalid JSON path %q: must start with $", path)
+	}
+
+	var steps []jsonStep
+
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[") + 1
+			if end == 0 {
+				end = len(rest)
+			}
+
+			if end == 1 {
+				return nil, fmt.Errorf("Invalid JSON path %q: empty name", path)
+			}
+
+			steps = append(steps, jsonStep{name: rest[1:end], index: -1})
+			rest = rest[end:]
+
+		case '[':
+			raw, after, ok := strings.Cut(rest[1:], "]")
+			index, err := strconv.Atoi(raw)
+			if !ok || err != nil || index < 0 {
+				return nil, fmt.Errorf("Invalid JSON path %q: bad index", path)
+			}
+
+			steps = append(steps, jsonStep{index: index})
+			rest = after
+
+		default:
+			return nil, fmt.Errorf("Invalid JSON path %q: expected . or [", path)
+		}
+	}
+
+	return steps, nil
+}
+
+// extractJSON returns the member of the JSON value at path, as written in
+// the value.
+func extractJSON(value string, path []jsonStep) (string, error) {
+	member := json.RawMessage(value)
+	if !json.Valid(member) {
+		return "", ErrorNotJSON
+	}
+
+	for _, step := range path {
+		if step.index < 0 {
+			var object map[string]json.RawMessage
+			if json.Unmarshal(member, &object) != nil {
+				return "", ErrorNoSuchField
+			}
+
+			var ok bool
+			if member, ok = object[step.name]; !ok {
+				return "", ErrorNoSuchField
+			}
+
+			continue
+		}
+
+		var array []json.RawMessage
+		if json.Unmarshal(member, &array) != nil || step.index >= len(array) {
+			return "", ErrorNoSuchField
+		}
+
+		member = array[step.index]
+	}
+
+	return string(member), nil
+}
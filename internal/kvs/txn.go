@@ -0,0 +1,223 @@
+package kvs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+/**
+ * Transactions.
+ *
+ * A transaction is a list of comparisons guarding two lists of batch
+ * operations, as in etcd: if every comparison holds, the success
+ * operations are applied, otherwise the failure ones. The whole
+ * transaction is atomic and its writes are logged as one EventTxn.
+ */
+type TxnCompare struct {
+	Key      string `json:"key"`
+	Target   string `json:"target"` // "revision" или "value"
+	Result   string `json:"result"` // "=", "!=", "<" или ">"
+	Revision uint64 `json:"revision,omitempty"`
+	Value    string `json:"value,omitempty"`
+}
+
+type Txn struct {
+	Compare []TxnCompare `json:"compare"`
+	Success []BatchOp    `json:"success"`
+	Failure []BatchOp    `json:"failure"`
+}
+
+type TxnResult struct {
+	Succeeded bool          `json:"succeeded"`
+	Results   []BatchResult `json:"results"`
+}
+
+// holds evaluates the comparison against the current value and revision of
+// its key; a missing key has revision 0 and an empty value.
+func (c TxnCompare) holds(value string, revision uint64) bool {
+	var cmp int
+
+	if c.Target == "revision" {
+		switch {
+		case revision < c.Revision:
+			cmp = -1
+		case revision > c.Revision:
+			cmp = 1
+		}
+	} else {
+		switch {
+		case value < c.Value:
+			cmp = -1
+		case value > c.Value:
+			cmp = 1
+		}
+	}
+
+	switch c.Result {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	default: // ">"
+		return cmp > 0
+	}
+}
+
+func validateTxn(t Txn) error {
+	if n := len(t.Compare) + len(t.Success) + len(t.Failure); n == 0 || n > config.Limits.BatchMaxOps {
+		return fmt.Errorf("transaction must contain 1 to %d comparisons and operations", config.Limits.BatchMaxOps)
+	}
+
+	for i, c := range t.Compare {
+		t.Compare[i].Key = normalizeKey(c.Key)
+
+		if c.Target != "revision" && c.Target != "value" {
+			return fmt.Errorf("comparison %d: unknown target %q", i, c.Target)
+		}
+
+		switch c.Result {
+		case "=", "!=", "<", ">":
+		default:
+			return fmt.Errorf("comparison %d: unknown result %q", i, c.Result)
+		}
+	}
+
+	if err := validateOps(t.Success); err != nil {
+		return fmt.Errorf("success %w", err)
+	}
+
+	if err := validateOps(t.Failure); err != nil {
+		return fmt.Errorf("failure %w", err)
+	}
+
+	return nil
+}
+
+// txnHandler serves POST /v1/txn. The body is a JSON Txn; the response
+// tells which branch was taken and holds one result per applied operation.
+func txnHandler(w http.ResponseWriter, r *http.Request) {
+	var t Txn
+
+	durable, err := syncWrite(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tooLarge := limitBody(w, r, config.Limits.MaxBodyBytes)
+	defer r.Body.Close()
+
+	if err = json.NewDecoder(r.Body).Decode(&t); err != nil {
+		if tooLarge() {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		http.Error(w, "Invalid transaction: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err = validateTxn(t); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrorKeyTooLong) || errors.Is(err, ErrorValueTooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	keys := append(batchKeys(t.Success), batchKeys(t.Failure)...)
+	for _, c := range t.Compare {
+		keys = append(keys, c.Key)
+	}
+
+	if misdirected(w, keys...) {
+		return
+	}
+
+	result, err := store.Txn(loggedOps(r.Context()), t)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	ops := t.Failure
+	if result.Succeeded {
+		ops = t.Success
+	}
+
+	if recordTxn(ops, result.Results) && durable {
+		if err := logger.Sync(r.Context()); err != nil {
+			serverError(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// opsEvents returns the events of the writes among ops, to be logged as
+// one EventTxn: a put with its content type and deadline if it has them,
+// and the delete of a key that existed.
+func opsEvents(ops []BatchOp, results []BatchResult) []Event {
+	var writes []Event
+
+	for i, res := range results {
+		if !res.OK {
+			continue
+		}
+
+		switch op := ops[i]; res.Op {
+		case BatchPut:
+			writes = append(writes, Event{EventType: EventPut, Key: res.Key, Value: op.Value, Revision: res.Revision})
+
+			if op.contentType != "" {
+				writes = append(writes, Event{EventType: EventContentType, Key: res.Key, Value: op.contentType})
+			}
+
+			if !op.deadline.IsZero() {
+				writes = append(writes, Event{EventType: EventExpire, Key: res.Key, Value: strconv.FormatInt(op.deadline.UnixNano(), 10)})
+			}
+		case BatchDelete:
+			writes = append(writes, Event{EventType: EventDelete, Key: res.Key})
+		}
+	}
+
+	return writes
+}
+
+// recordTxn publishes the writes among the applied ops of a batch or
+// transaction, which the loggedOps context they were applied under has
+// logged. It reports whether there were any.
+func recordTxn(ops []BatchOp, results []BatchResult) bool {
+	written := false
+
+	for i, res := range results {
+		if !res.OK {
+			continue
+		}
+
+		switch op := ops[i]; res.Op {
+		case BatchPut:
+			change := ChangeEvent{Type: "put", Key: res.Key, Value: op.Value, ContentType: op.contentType}
+			if !op.deadline.IsZero() {
+				change.Expires = &op.deadline
+			}
+
+			broker.Publish(change)
+			written = true
+		case BatchDelete:
+			broker.Publish(ChangeEvent{Type: "delete", Key: res.Key})
+			written = true
+		}
+	}
+
+	return written
+}
@@ -0,0 +1,124 @@
+package kvs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTxnCompareHolds(t *testing.T) {
+	tests := []struct {
+		compare  TxnCompare
+		value    string
+		revision uint64
+		want     bool
+	}{
+		{TxnCompare{Target: "revision", Result: "=", Revision: 2}, "", 2, true},
+		{TxnCompare{Target: "revision", Result: "=", Revision: 0}, "", 0, true}, // Ключа нет
+		{TxnCompare{Target: "revision", Result: "!=", Revision: 2}, "", 3, true},
+		{TxnCompare{Target: "revision", Result: "<", Revision: 2}, "", 2, false},
+		{TxnCompare{Target: "revision", Result: ">", Revision: 2}, "", 3, true},
+		{TxnCompare{Target: "value", Result: "=", Value: "a"}, "a", 1, true},
+		{TxnCompare{Target: "value", Result: "<", Value: "b"}, "a", 1, true},
+		{TxnCompare{Target: "value", Result: ">", Value: "b"}, "a", 1, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.compare.holds(tt.value, tt.revision); got != tt.want {
+			t.Errorf("%+v holds for %q at revision %d: got %v, want %v", tt.compare, tt.value, tt.revision, got, tt.want)
+		}
+	}
+}
+
+// postTxn serves a POST /v1/txn of txn and returns its result.
+func postTxn(t *testing.T, txn Txn) TxnResult {
+	t.Helper()
+
+	body, err := json.Marshal(txn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	txnHandler(w, httptest.NewRequest(http.MethodPost, "/v1/txn", bytes.NewReader(body)))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("transaction got %d: %s", w.Code, w.Body)
+	}
+
+	var result TxnResult
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+
+	return result
+}
+
+func TestTxn(t *testing.T) {
+	defer func(s Store, b *Broker) { store, broker = s, b }(store, broker)
+
+	ctx := context.Background()
+	store = NewShardedStore(4, 0, 0, false)
+	broker = NewBroker(config.Watch.BufferSize)
+
+	filename := filepath.Join(t.TempDir(), "transaction.log")
+	l := startTestLog(t, filename)
+
+	if _, err := store.Put(loggedPut(ctx, "a", "1", "", time.Time{}), "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	txn := Txn{
+		Compare: []TxnCompare{{Key: "a", Target: "value", Result: "=", Value: "1"}},
+		Success: []BatchOp{{Op: BatchPut, Key: "a", Value: "2"}, {Op: BatchPut, Key: "b", Value: "1"}},
+		Failure: []BatchOp{{Op: BatchDelete, Key: "a"}},
+	}
+
+	if result := postTxn(t, txn); !result.Succeeded || len(result.Results) != 2 || result.Results[0].Revision != 2 {
+		t.Fatalf("first transaction got %+v, want the success branch with a at revision 2", result)
+	}
+
+	// a больше не равен 1: применяется ветвь failure
+	if result := postTxn(t, txn); result.Succeeded || len(result.Results) != 1 || !result.Results[0].OK {
+		t.Fatalf("second transaction got %+v, want the failure branch deleting a", result)
+	}
+
+	if _, err := store.Get(ctx, "a"); !errors.Is(err, ErrorNoSuchKey) {
+		t.Fatalf("a exists after the failure branch (%v)", err)
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var txns int
+	replayed := NewShardedStore(4, 0, 0, false)
+
+	for _, e := range replayTestLog(t, openTestLog(t, filename)) {
+		if e.EventType == EventTxn {
+			txns++
+		}
+
+		if err := replayEvent(ctx, replayed, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if txns != 2 {
+		t.Fatalf("log has %d transaction events, want one per transaction", txns)
+	}
+
+	if value, err := replayed.Get(ctx, "b"); err != nil || value != "1" {
+		t.Fatalf("replayed b is %q (%v), want 1", value, err)
+	}
+
+	if _, err := replayed.Get(ctx, "a"); !errors.Is(err, ErrorNoSuchKey) {
+		t.Fatalf("replayed a exists (%v)", err)
+	}
+}
@@ -0,0 +1,542 @@
+package kvs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+ * Upstream cache mode.
+ *
+ * With store.upstream.url set, the store caches the keys of a slower
+ * upstream key-value HTTP API, such as another kvs at
+ * "http://db:8080/v1/key/": a key is read with GET <url><key>, written
+ * with PUT and the value as the body, and deleted with DELETE, a 404
+ * meaning the upstream does not hold it. A read of a key the store does
+ * not hold fetches it from the upstream and keeps it, expiring after its
+ * TTL: store.upstream.ttl, or less if the upstream answers with X-TTL or
+ * Cache-Control: max-age for the key. A miss of the upstream too is not
+ * kept, and concurrent reads of a key share one fetch.
+ *
+ * Writes go through: once the store has applied a write, the keys it
+ * changed are written to the upstream as they are then, under a lock of
+ * the key so that the upstream ends up with the last write. A write the
+ * upstream refuses fails with ErrorUpstream, and its keys are dropped
+ * from the cache so that the next read fetches them again. Expirations
+ * and evictions only drop keys from the cache, and the TTL of a write
+ * applies to its cached copy only. Listings and snapshots see the cached
+ * keys. Nothing goes upstream while the transaction log is replayed, nor
+ * on a replica, whose primary writes through itself.
+ */
+var ErrorUpstream = errors.New("Upstream failed")
+
+const upstreamLocks = 256 // Полос блокировок ключей
+
+type UpstreamConfig struct {
+	URL     string        `yaml:"url"`     // Префикс URL ключей; пустой отключает режим
+	APIKey  string        `yaml:"api_key"` // Bearer-токен для запросов
+	TTL     time.Duration `yaml:"ttl"`     // Срок хранения полученных ключей; 0 - до вытеснения
+	Timeout time.Duration `yaml:"timeout"` // Предел одного запроса
+}
+
+type UpstreamStore struct {
+	Store
+
+	url    string
+	apiKey string
+	ttl    time.Duration
+	client *http.Client
+
+	locks [upstreamLocks]sync.Mutex
+
+	hits     atomic.Uint64
+	misses   atomic.Uint64 // Ключ запрошен у источника
+	failures atomic.Uint64 // Запросов к источнику не удалось
+}
+
+type upstreamStats struct {
+	Hits     uint64 `json:"hits"`
+	Misses   uint64 `json:"misses"`
+	Failures uint64 `json:"failures"`
+}
+
+func NewUpstreamStore(s Store, c UpstreamConfig) *UpstreamStore {
+	return &UpstreamStore{Store: s, url: c.URL, apiKey: c.APIKey, ttl: c.TTL, client: &http.Client{Timeout: c.Timeout}}
+}
+
+// upstreamStore returns the store that caches the upstream, or nil
+// without one.
+func upstreamStore() *UpstreamStore {
+	s := store
+	for {
+		switch d := s.(type) {
+		case *UpstreamStore:
+			return d
+		case *MigratingStore:
+			s = d.Store
+		case TracingStore:
+			s = d.Store
+		default:
+			return nil
+		}
+	}
+}
+
+func (s *UpstreamStore) stats() upstreamStats {
+	return upstreamStats{Hits: s.hits.Load(), Misses: s.misses.Load(), Failures: s.failures.Load()}
+}
+
+// active reports whether reads and writes go to the upstream.
+func (s *UpstreamStore) active() bool {
+	return ready.Load() && replica == nil
+}
+
+func (s *UpstreamStore) lock(key string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+
+	return &s.locks[h.Sum32()%upstreamLocks]
+}
+
+// unlogged returns ctx without the commit of a write, for the writes
+// that only change the cache.
+func unlogged(ctx context.Context) context.Context {
+	return context.WithValue(context.WithoutCancel(ctx), commitKey{}, nil)
+}
+
+/**
+ * Upstream requests.
+ */
+
+func (s *UpstreamStore) request(ctx context.Context, method, key, body, contentType string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.url+url.PathEscape(key), strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	if s.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+s.apiKey)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		s.failures.Add(1)
+		return nil, fmt.Errorf("%w: %v", ErrorUpstream, err)
+	}
+
+	return resp, nil
+}
+
+// fetch reads key from the upstream, with the deadline of its cached copy.
+func (s *UpstreamStore) fetch(ctx context.Context, key string) (Entry, error) {
+	resp, err := s.request(ctx, http.MethodGet, key, "", "")
+	if err != nil {
+		return Entry{}, err
+	}
+
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return Entry{}, ErrorNoSuchKey
+	case resp.StatusCode != http.StatusOK:
+		s.failures.Add(1)
+		return Entry{}, fmt.Errorf("%w: GET %s: %s", ErrorUpstream, key, resp.Status)
+	}
+
+	value, err := io.ReadAll(io.LimitReader(resp.Body, config.Limits.MaxValueBytes+1))
+	if err != nil {
+		s.failures.Add(1)
+		return Entry{}, fmt.Errorf("%w: GET %s: %v", ErrorUpstream, key, err)
+	}
+
+	if int64(len(value)) > config.Limits.MaxValueBytes {
+		return Entry{}, fmt.Errorf("%w: GET %s: %v", ErrorUpstream, key, ErrorValueTooLarge)
+	}
+
+	e := Entry{Key: key, Value: string(value)}
+	if contentType, err := parseContentType(resp.Header.Get("Content-Type")); err == nil {
+		e.ContentType = contentType
+	}
+
+	ttl := s.ttl
+	if left, ok := upstreamTTL(resp.Header); ok && (ttl == 0 || left < ttl) {
+		ttl = left
+	}
+
+	e.Expires = expiry(ttl)
+
+	return e, nil
+}
+
+// upstreamTTL returns the time the upstream keeps a key for, from X-TTL
+// or Cache-Control: max-age.
+func upstreamTTL(h http.Header) (time.Duration, bool) {
+	if seconds, err := strconv.ParseInt(h.Get("X-TTL"), 10, 64); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if seconds, err := strconv.ParseInt(value, 10, 64); strings.EqualFold(name, "max-age") && err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+
+	return 0, false
+}
+
+// send writes key to the upstream as the cache holds it, or deletes it
+// there if the cache does not.
+func (s *UpstreamStore) send(ctx context.Context, key string) error {
+	method, body, contentType := http.MethodDelete, "", ""
+
+	e, err := s.Store.GetEntry(ctx, key)
+	switch {
+	case err == nil:
+		method, body, contentType = http.MethodPut, e.Value, e.ContentType
+	case !errors.Is(err, ErrorNoSuchKey):
+		return err
+	}
+
+	resp, err := s.request(ctx, method, key, body, contentType)
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 && !(method == http.MethodDelete && resp.StatusCode == http.StatusNotFound) {
+		s.failures.Add(1)
+		return fmt.Errorf("%w: %s %s: %s", ErrorUpstream, method, key, resp.Status)
+	}
+
+	return nil
+}
+
+/**
+ * Cache.
+ */
+
+// fill caches key from the upstream if the cache does not hold it.
+func (s *UpstreamStore) fill(ctx context.Context, key string) error {
+	if !s.active() {
+		return nil
+	}
+
+	if _, err := s.Store.GetEntry(ctx, key); !errors.Is(err, ErrorNoSuchKey) {
+		s.hits.Add(1)
+		return err
+	}
+
+	mu := s.lock(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, err := s.Store.GetEntry(ctx, key); !errors.Is(err, ErrorNoSuchKey) {
+		return err // Получен, пока ожидалась блокировка
+	}
+
+	s.misses.Add(1)
+
+	e, err := s.fetch(ctx, key)
+	if errors.Is(err, ErrorNoSuchKey) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	ctx = unlogged(ctx)
+
+	// Только если ключ не записан с тех пор: запись клиента новее.
+	if _, err := s.Store.CompareAndPut(ctx, key, e.Value, 0); err != nil {
+		if errors.Is(err, ErrorRevisionMismatch) || errors.Is(err, ErrorMemoryFull) {
+			return nil
+		}
+		return err
+	}
+
+	if e.ContentType != "" {
+		if err := s.Store.SetContentType(ctx, key, e.ContentType); err != nil {
+			return err
+		}
+	}
+
+	if !e.Expires.IsZero() {
+		return s.Store.Expire(ctx, key, e.Expires)
+	}
+
+	return nil
+}
+
+// fillAll caches the keys from the upstream.
+func (s *UpstreamStore) fillAll(ctx context.Context, keys []string) error {
+	for _, key := range keys {
+		if err := s.fill(ctx, key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeThrough writes the keys a write changed to the upstream, and drops
+// from the cache those it refuses.
+func (s *UpstreamStore) writeThrough(ctx context.Context, keys ...string) error {
+	if !s.active() {
+		return nil
+	}
+
+	ctx = context.WithoutCancel(ctx) // Запись уже применена
+
+	var failed error
+	for _, key := range keys {
+		mu := s.lock(key)
+		mu.Lock()
+
+		if err := s.send(ctx, key); err != nil {
+			failed = errors.Join(failed, err)
+
+			if err := s.Store.Delete(unlogged(ctx), key); err != nil && !errors.Is(err, ErrorNoSuchKey) {
+				failed = errors.Join(failed, err)
+			}
+		}
+
+		mu.Unlock()
+	}
+
+	return failed
+}
+
+/**
+ * Upstream store.
+ */
+
+func (s *UpstreamStore) Get(ctx context.Context, key string) (string, error) {
+	if err := s.fill(ctx, key); err != nil {
+		return "", err
+	}
+
+	return s.Store.Get(ctx, key)
+}
+
+func (s *UpstreamStore) GetEntry(ctx context.Context, key string) (Entry, error) {
+	if err := s.fill(ctx, key); err != nil {
+		return Entry{}, err
+	}
+
+	return s.Store.GetEntry(ctx, key)
+}
+
+func (s *UpstreamStore) TTL(ctx context.Context, key string) (time.Duration, error) {
+	if err := s.fill(ctx, key); err != nil {
+		return 0, err
+	}
+
+	return s.Store.TTL(ctx, key)
+}
+
+func (s *UpstreamStore) Put(ctx context.Context, key string, value string) (uint64, error) {
+	revision, err := s.Store.Put(ctx, key, value)
+	if err == nil {
+		err = s.writeThrough(ctx, key)
+	}
+
+	return revision, err
+}
+
+func (s *UpstreamStore) CompareAndPut(ctx context.Context, key, value string, revision uint64) (uint64, error) {
+	if err := s.fill(ctx, key); err != nil {
+		return 0, err
+	}
+
+	revision, err := s.Store.CompareAndPut(ctx, key, value, revision)
+	if err == nil {
+		err = s.writeThrough(ctx, key)
+	}
+
+	return revision, err
+}
+
+func (s *UpstreamStore) Restore(ctx context.Context, key, value string, revision uint64) error {
+	err := s.Store.Restore(ctx, key, value, revision)
+	if err == nil {
+		err = s.writeThrough(ctx, key)
+	}
+
+	return err
+}
+
+func (s *UpstreamStore) Increment(ctx context.Context, key string, by int64) (int64, uint64, error) {
+	if err := s.fill(ctx, key); err != nil {
+		return 0, 0, err
+	}
+
+	value, revision, err := s.Store.Increment(ctx, key, by)
+	if err == nil {
+		err = s.writeThrough(ctx, key)
+	}
+
+	return value, revision, err
+}
+
+func (s *UpstreamStore) Append(ctx context.Context, key, suffix string, limit int64) (string, uint64, error) {
+	if err := s.fill(ctx, key); err != nil {
+		return "", 0, err
+	}
+
+	value, revision, err := s.Store.Append(ctx, key, suffix, limit)
+	if err == nil {
+		err = s.writeThrough(ctx, key)
+	}
+
+	return value, revision, err
+}
+
+func (s *UpstreamStore) Update(ctx context.Context, key, value string, revision uint64) error {
+	if err := s.fill(ctx, key); err != nil {
+		return err
+	}
+
+	err := s.Store.Update(ctx, key, value, revision)
+	if err == nil {
+		err = s.writeThrough(ctx, key)
+	}
+
+	return err
+}
+
+func (s *UpstreamStore) Delete(ctx context.Context, key string) error {
+	if err := s.fill(ctx, key); err != nil {
+		return err
+	}
+
+	err := s.Store.Delete(ctx, key)
+	if err == nil {
+		err = s.writeThrough(ctx, key)
+	}
+
+	return err
+}
+
+func (s *UpstreamStore) SoftDelete(ctx context.Context, key string, until time.Time) error {
+	if err := s.fill(ctx, key); err != nil {
+		return err
+	}
+
+	err := s.Store.SoftDelete(ctx, key, until)
+	if err == nil {
+		err = s.writeThrough(ctx, key)
+	}
+
+	return err
+}
+
+func (s *UpstreamStore) Undelete(ctx context.Context, key string) (Entry, error) {
+	e, err := s.Store.Undelete(ctx, key)
+	if err == nil {
+		err = s.writeThrough(ctx, key)
+	}
+
+	return e, err
+}
+
+func (s *UpstreamStore) DeleteMatching(ctx context.Context, match func(key string) bool) ([]string, error) {
+	removed, err := s.Store.DeleteMatching(ctx, match)
+
+	return removed, errors.Join(err, s.writeThrough(ctx, removed...)) // Удалённые до ошибки
+}
+
+func (s *UpstreamStore) Expire(ctx context.Context, key string, deadline time.Time) error {
+	if err := s.fill(ctx, key); err != nil {
+		return err
+	}
+
+	return s.Store.Expire(ctx, key, deadline) // Срок только у копии в кэше
+}
+
+func (s *UpstreamStore) SetContentType(ctx context.Context, key, contentType string) error {
+	err := s.Store.SetContentType(ctx, key, contentType)
+	if err == nil {
+		err = s.writeThrough(ctx, key)
+	}
+
+	return err
+}
+
+func (s *UpstreamStore) Batch(ctx context.Context, ops []BatchOp) ([]BatchResult, error) {
+	if err := s.fillAll(ctx, batchKeys(ops)); err != nil {
+		return nil, err
+	}
+
+	results, err := s.Store.Batch(ctx, ops)
+	if err == nil {
+		err = s.writeThrough(ctx, writtenKeys(ops)...)
+	}
+
+	return results, err
+}
+
+func (s *UpstreamStore) Txn(ctx context.Context, t Txn) (TxnResult, error) {
+	keys := batchKeys(append(t.Success, t.Failure...))
+	for _, c := range t.Compare {
+		keys = append(keys, c.Key)
+	}
+
+	if err := s.fillAll(ctx, keys); err != nil {
+		return TxnResult{}, err
+	}
+
+	result, err := s.Store.Txn(ctx, t)
+	if err == nil {
+		ops := t.Failure
+		if result.Succeeded {
+			ops = t.Success
+		}
+		err = s.writeThrough(ctx, writtenKeys(ops)...)
+	}
+
+	return result, err
+}
+
+func (s *UpstreamStore) ReplaceAll(ctx context.Context, entries []Entry) ([]string, error) {
+	removed, err := s.Store.ReplaceAll(ctx, entries)
+	if err != nil {
+		return removed, err
+	}
+
+	keys := removed
+	for _, e := range entries {
+		keys = append(keys, e.Key)
+	}
+
+	return removed, s.writeThrough(ctx, keys...)
+}
+
+// writtenKeys returns the keys of the operations that put or delete.
+func writtenKeys(ops []BatchOp) []string {
+	var keys []string
+	for _, op := range ops {
+		if op.Op != BatchGet {
+			keys = append(keys, op.Key)
+		}
+	}
+
+	return keys
+}
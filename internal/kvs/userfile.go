@@ -0,0 +1,105 @@
+package kvs
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+/**
+ * User file authentication.
+ *
+ * The users file lists one user per line as "name:hash", the format
+ * htpasswd -B writes, optionally followed by ":ro", ":rw" or ":admin";
+ * users without one may only read. Only bcrypt hashes are accepted. Blank lines and
+ * lines starting with # are skipped. Clients sign in with HTTP Basic
+ * authentication, or AUTH name password over RESP. Checking a bcrypt hash
+ * is slow by design, so the last password verified for every user is
+ * remembered by its SHA-256 digest.
+ */
+type userFile struct {
+	users map[string]fileUser
+
+	mu       sync.Mutex
+	verified map[string][sha256.Size]byte // Пользователь -> дайджест проверенного пароля
+}
+
+type fileUser struct {
+	hash       []byte
+	permission Permission
+}
+
+// loadUserFile reads the users file at path.
+func loadUserFile(path string) (*userFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read users file: %w", err)
+	}
+
+	defer file.Close()
+
+	u := &userFile{users: make(map[string]fileUser), verified: make(map[string][sha256.Size]byte)}
+
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, ":")
+		if len(fields) < 2 || len(fields) > 3 || fields[0] == "" {
+			return nil, fmt.Errorf("%s:%d: want name:hash[:ro|rw|admin]", path, n)
+		}
+
+		if _, err := bcrypt.Cost([]byte(fields[1])); err != nil {
+			return nil, fmt.Errorf("%s:%d: not a bcrypt hash; create it with htpasswd -B", path, n)
+		}
+
+		user := fileUser{hash: []byte(fields[1]), permission: PermRead}
+		if len(fields) == 3 {
+			if user.permission, err = parsePermission(fields[2]); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+			}
+		}
+
+		u.users[fields[0]] = user
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read users file: %w", err)
+	}
+
+	return u, nil
+}
+
+func (u *userFile) Authenticate(ctx context.Context, c Credentials) (Principal, error) {
+	user, ok := u.users[c.User]
+	if !ok || c.User == "" {
+		return Principal{}, ErrorUnauthenticated
+	}
+
+	digest := sha256.Sum256([]byte(c.Password))
+
+	u.mu.Lock()
+	known := u.verified[c.User] == digest
+	u.mu.Unlock()
+
+	if !known {
+		if bcrypt.CompareHashAndPassword(user.hash, []byte(c.Password)) != nil {
+			return Principal{}, ErrorUnauthenticated
+		}
+
+		u.mu.Lock()
+		u.verified[c.User] = digest
+		u.mu.Unlock()
+	}
+
+	return Principal{Name: c.User, Permission: user.permission}, nil
+}
@@ -0,0 +1,271 @@
+package kvs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+ * JSON API.
+ *
+ * /v2/key/{key} reads, writes and deletes keys like /v1/key/{key}, but
+ * with values wrapped in JSON: GET answers with the key, value, revision,
+ * ttl in seconds and content type, and PUT takes the value, ttl, content
+ * type and encoding in its body, in the records of /v1/export and
+ * /v1/import; DELETE answers as in /v1. Values that are not valid UTF-8
+ * travel base64-encoded with encoding "base64". Errors on /v2 paths,
+ * whether from the handlers, the middleware or the readiness gate, are
+ * JSON objects with a stable code and a message, instead of plain text.
+ */
+type v2Entry struct {
+	bulkRecord
+	Revision uint64 `json:"revision"`
+}
+
+type v2Write struct {
+	Key      string    `json:"key"`
+	Revision uint64    `json:"revision"`
+	Updated  time.Time `json:"updated_at"` // Время записи версии
+}
+
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// errorCodes names the errors /v2 reports by their message, or by the
+// start of it for the errors wrapped with details. The others are named
+// after their status.
+var errorCodes = map[error]string{
+	ErrorNoSuchKey:           "no_such_key",
+	ErrorNoSuchRevision:      "no_such_revision",
+	ErrorRevisionMismatch:    "revision_mismatch",
+	ErrorKeyExists:           "key_exists",
+	ErrorRevisionRequired:    "revision_required",
+	ErrorKeyTooLong:          "key_too_long",
+	ErrorInvalidKey:          "invalid_key",
+	ErrorValueTooLarge:       "value_too_large",
+	ErrorReadOnly:            "read_only",
+	ErrorReplica:             "replica",
+	ErrorRequestTimeout:      "timeout",
+	ErrorUnauthenticated:     "unauthenticated",
+	ErrorForbidden:           "forbidden",
+	ErrorUnsupportedEncoding: "unsupported_encoding",
+	ErrorLoggerStopped:       "logger_stopped",
+	ErrorMemoryFull:          "memory_full",
+	ErrorQuotaExceeded:       "quota_exceeded",
+	ErrorSessionBehind:       "session_behind",
+	ErrorSessionEpoch:        "session_epoch",
+	ErrorLogBackpressure:     "log_backpressure",
+	ErrorCursorExpired:       "cursor_expired",
+	ErrorCursorListing:       "cursor_listing",
+	ErrorTooManyCursors:      "too_many_cursors",
+	ErrorListingTooLong:      "listing_too_long",
+	ErrorUpstream:            "upstream_failed",
+	ErrorValueChecksum:       "checksum_mismatch",
+}
+
+// errorCode returns the code of the error response with the given status
+// and message.
+func errorCode(status int, message string) string {
+	for err, code := range errorCodes {
+		if message == err.Error() || strings.HasPrefix(message, err.Error()+": ") {
+			return code
+		}
+	}
+
+	return strings.ToLower(strings.ReplaceAll(http.StatusText(status), " ", "_"))
+}
+
+// withJSONErrors turns the plain-text error responses to /v2 requests
+// into JSON error objects.
+func withJSONErrors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/v2/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		jw := &jsonErrorWriter{ResponseWriter: w}
+		next.ServeHTTP(jw, r)
+
+		if jw.status == 0 {
+			return
+		}
+
+		message := strings.TrimSpace(jw.message.String())
+		if message == "" {
+			message = http.StatusText(jw.status)
+		}
+
+		w.Header().Del("Content-Length")
+		w.Header().Del("X-Content-Type-Options")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(jw.status)
+		json.NewEncoder(w).Encode(map[string]apiError{"error": {Code: errorCode(jw.status, message), Message: message}})
+	})
+}
+
+// jsonErrorWriter holds back error responses written as plain text, or
+// with no body at all.
+type jsonErrorWriter struct {
+	http.ResponseWriter
+	status  int // Перехваченный код ошибки; 0 - ответ передан как есть
+	message bytes.Buffer
+}
+
+func (w *jsonErrorWriter) WriteHeader(status int) {
+	if contentType := w.Header().Get("Content-Type"); status >= 400 && (contentType == "" || strings.HasPrefix(contentType, "text/plain")) {
+		w.status = status
+		return
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *jsonErrorWriter) Write(p []byte) (int, error) {
+	if w.status != 0 {
+		return w.message.Write(p)
+	}
+
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *jsonErrorWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// v2GetHandler serves GET /v2/key/{key}, with ?rev=N and conditional
+// requests as in /v1.
+func v2GetHandler(w http.ResponseWriter, r *http.Request) {
+	key := pathVars(r)["key"]
+
+	var entry Entry
+	var err error
+
+	if raw := r.URL.Query().Get("rev"); raw != "" {
+		var revision uint64
+		if revision, err = strconv.ParseUint(raw, 10, 64); err != nil || revision == 0 {
+			http.Error(w, "Invalid revision", http.StatusBadRequest)
+			return
+		}
+
+		entry, err = entryAtRevision(r.Context(), key, revision)
+	} else {
+		entry, err = verifiedEntry(r.Context(), key)
+	}
+
+	if errors.Is(err, ErrorNoSuchKey) || errors.Is(err, ErrorNoSuchRevision) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	etag := formatETag(entry.Revision)
+
+	w.Header().Set("ETag", etag)
+	if entry.Checksum != "" {
+		w.Header().Set("X-Content-SHA256", entry.Checksum)
+	}
+
+	if !entry.Modified.IsZero() {
+		w.Header().Set("Last-Modified", entry.Modified.UTC().Format(http.TimeFormat))
+	}
+
+	if notModified(r, etag, entry.Modified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v2Entry{bulkRecord: newBulkRecord(entry), Revision: entry.Revision})
+}
+
+// v2PutHandler serves PUT /v2/key/{key}. The body is a record without a
+// key, or with the key of the URL; If-Match and If-None-Match make the
+// write conditional as in /v1.
+func v2PutHandler(w http.ResponseWriter, r *http.Request) {
+	key := pathVars(r)["key"]
+
+	durable, err := syncWrite(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tooLarge := limitBody(w, r, config.Limits.MaxBodyBytes)
+	defer r.Body.Close()
+
+	var record bulkRecord
+	if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
+		if tooLarge() {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if record.Key != "" && normalizeKey(record.Key) != key {
+		http.Error(w, "Key in the body does not match the URL", http.StatusBadRequest)
+		return
+	}
+	record.Key = key
+
+	value, contentType, ttl, err := record.decode()
+	if errors.Is(err, ErrorKeyTooLong) || errors.Is(err, ErrorValueTooLarge) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if ttl == 0 {
+		ttl = current.Load().Store.DefaultTTL
+	}
+
+	deadline := expiry(ttl)
+
+	ctx := loggedPut(r.Context(), key, value, contentType, deadline)
+
+	revision, err := conditionalPut(r.WithContext(ctx), key, value)
+	if status := preconditionStatus(err); status != 0 {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	recordPut(ctx, key, value, contentType, deadline)
+
+	if durable {
+		if err := logger.Sync(r.Context()); err != nil {
+			serverError(w, err)
+			return
+		}
+	}
+
+	updated := writeTime(r.Context(), key, revision).UTC()
+
+	w.Header().Set("ETag", formatETag(revision))
+	w.Header().Set("Last-Modified", updated.Format(http.TimeFormat))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(v2Write{Key: key, Revision: revision, Updated: updated})
+}
@@ -0,0 +1,500 @@
+package kvs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * Secondary indexes on JSON value fields.
+ *
+ * IndexedStore wraps a Store and indexes the configured fields of the
+ * values that are JSON objects, named by dotted paths such as
+ * "user.email". Strings, numbers and booleans are indexed by their text,
+ * and arrays by each such element; other values, and keys whose value
+ * lacks the field, are not indexed under it. Writes update the index with
+ * the store under one lock, so a lookup always matches the store. The
+ * index lives in memory: it fills during replay for the memory store and
+ * is rebuilt from the content of a persistent store when it is opened.
+ *
+ * GET /v1/index/{field}?value= returns the keys whose value has the field
+ * equal to value, in key order, paged like GET /v1/keys.
+ */
+var ErrorNoSuchIndex = errors.New("No such index")
+
+type IndexedStore struct {
+	Store
+
+	fields []string
+
+	mu       sync.RWMutex
+	postings map[string]map[string]map[string]struct{} // Поле -> значение -> ключи
+	indexed  map[string]map[string][]string            // Ключ -> поле -> значения, для удаления из индекса
+}
+
+// NewIndexedStore indexes fields over s, starting from its current
+// content.
+func NewIndexedStore(s Store, fields []string) (*IndexedStore, error) {
+	x := &IndexedStore{
+		Store:    s,
+		fields:   fields,
+		postings: make(map[string]map[string]map[string]struct{}, len(fields)),
+		indexed:  make(map[string]map[string][]string),
+	}
+
+	for _, field := range fields {
+		x.postings[field] = make(map[string]map[string]struct{})
+	}
+
+	entries, err := s.Snapshot(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		x.index(e.Key, e.Value)
+	}
+
+	return x, nil
+}
+
+// fieldValues returns the values of the field at path in a JSON value.
+func fieldValues(doc interface{}, path []string) []string {
+	for _, name := range path {
+		object, ok := doc.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+
+		if doc, ok = object[name]; !ok {
+			return nil
+		}
+	}
+
+	if array, ok := doc.([]interface{}); ok {
+		var values []string
+		for _, element := range array {
+			if v, ok := scalarText(element); ok {
+				values = append(values, v)
+			}
+		}
+		return values
+	}
+
+	if v, ok := scalarText(doc); ok {
+		return []string{v}
+	}
+
+	return nil
+}
+
+// scalarText returns the indexed text of a JSON string, number or boolean.
+func scalarText(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return strconv.FormatBool(v), true
+	default:
+		return "", false
+	}
+}
+
+// index replaces the indexed fields of key by those of value; x.mu must
+// be held for writing, or x not yet shared.
+func (x *IndexedStore) index(key, value string) {
+	x.unindex(key)
+
+	if !strings.HasPrefix(strings.TrimSpace(value), "{") { // Не объект JSON - нечего индексировать
+		return
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.UseNumber() // Числа индексируются как записаны
+
+	var doc interface{}
+	if decoder.Decode(&doc) != nil {
+		return
+	}
+
+	var fields map[string][]string
+
+	for _, field := range x.fields {
+		values := fieldValues(doc, strings.Split(field, "."))
+		if len(values) == 0 {
+			continue
+		}
+
+		if fields == nil {
+			fields = make(map[string][]string)
+		}
+		fields[field] = values
+
+		for _, v := range values {
+			keys := x.postings[field][v]
+			if keys == nil {
+				keys = make(map[string]struct{})
+				x.postings[field][v] = keys
+			}
+			keys[key] = struct{}{}
+		}
+	}
+
+	if fields != nil {
+		x.indexed[key] = fields
+	}
+}
+
+// unindex removes key from the index; x.mu must be held for writing.
+func (x *IndexedStore) unindex(key string) {
+	for field, values := range x.indexed[key] {
+		for _, v := range values {
+			keys := x.postings[field][v]
+			delete(keys, key)
+
+			if len(keys) == 0 {
+				delete(x.postings[field], v)
+			}
+		}
+	}
+
+	delete(x.indexed, key)
+}
+
+// Lookup returns up to limit keys sorting after the given key whose value
+// has field equal to value, ordered by key, with their entries. Keys that
+// expired but are not reaped yet are skipped. more reports whether
+// further keys remain.
+func (x *IndexedStore) Lookup(ctx context.Context, field, value, after string, limit int) (entries []Entry, more bool, err error) {
+	x.mu.RLock()
+	postings, ok := x.postings[field]
+
+	var keys []string
+	for key := range postings[value] {
+		if key > after {
+			keys = append(keys, key)
+		}
+	}
+	x.mu.RUnlock()
+
+	if !ok {
+		return nil, false, ErrorNoSuchIndex
+	}
+
+	sort.Strings(keys)
+	entries = []Entry{}
+
+	for _, key := range keys {
+		entry, err := x.Store.GetEntry(ctx, key)
+		if errors.Is(err, ErrorNoSuchKey) {
+			continue // Удалён после чтения индекса или истёк
+		}
+
+		if err != nil {
+			return nil, false, err
+		}
+
+		if len(entries) == limit {
+			return entries, true, nil
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, false, nil
+}
+
+// Cardinality returns the number of distinct values of every indexed
+// field.
+func (x *IndexedStore) Cardinality() map[string]int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	counts := make(map[string]int, len(x.fields))
+	for field, postings := range x.postings {
+		counts[field] = len(postings)
+	}
+
+	return counts
+}
+
+func (x *IndexedStore) Put(ctx context.Context, key, value string) (uint64, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	revision, err := x.Store.Put(ctx, key, value)
+	if err == nil {
+		x.index(key, value)
+	}
+
+	return revision, err
+}
+
+func (x *IndexedStore) CompareAndPut(ctx context.Context, key, value string, revision uint64) (uint64, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	revision, err := x.Store.CompareAndPut(ctx, key, value, revision)
+	if err == nil {
+		x.index(key, value)
+	}
+
+	return revision, err
+}
+
+func (x *IndexedStore) Restore(ctx context.Context, key, value string, revision uint64) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	err := x.Store.Restore(ctx, key, value, revision)
+	if err == nil {
+		x.index(key, value)
+	}
+
+	return err
+}
+
+func (x *IndexedStore) Increment(ctx context.Context, key string, by int64) (int64, uint64, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	value, revision, err := x.Store.Increment(ctx, key, by)
+	if err == nil {
+		x.unindex(key) // Целое число не объект JSON
+	}
+
+	return value, revision, err
+}
+
+func (x *IndexedStore) Append(ctx context.Context, key, suffix string, limit int64) (string, uint64, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	value, revision, err := x.Store.Append(ctx, key, suffix, limit)
+	if err == nil {
+		x.index(key, value)
+	}
+
+	return value, revision, err
+}
+
+func (x *IndexedStore) Update(ctx context.Context, key, value string, revision uint64) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	err := x.Store.Update(ctx, key, value, revision)
+	if err == nil {
+		x.index(key, value)
+	}
+
+	return err
+}
+
+func (x *IndexedStore) Delete(ctx context.Context, key string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	err := x.Store.Delete(ctx, key)
+	if err == nil {
+		x.unindex(key)
+	}
+
+	return err
+}
+
+func (x *IndexedStore) DeleteMatching(ctx context.Context, match func(key string) bool) ([]string, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	removed, err := x.Store.DeleteMatching(ctx, match)
+	for _, key := range removed {
+		x.unindex(key)
+	}
+
+	return removed, err
+}
+
+func (x *IndexedStore) SoftDelete(ctx context.Context, key string, until time.Time) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	err := x.Store.SoftDelete(ctx, key, until)
+	if err == nil {
+		x.unindex(key)
+	}
+
+	return err
+}
+
+func (x *IndexedStore) Undelete(ctx context.Context, key string) (Entry, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	entry, err := x.Store.Undelete(ctx, key)
+	if err == nil {
+		x.index(key, entry.Value)
+	}
+
+	return entry, err
+}
+
+func (x *IndexedStore) ReapExpired(ctx context.Context, now time.Time) []string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	reaped := x.Store.ReapExpired(ctx, now)
+	for _, key := range reaped {
+		x.unindex(key)
+	}
+
+	return reaped
+}
+
+func (x *IndexedStore) Batch(ctx context.Context, ops []BatchOp) ([]BatchResult, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	results, err := x.Store.Batch(ctx, ops)
+	if err == nil {
+		x.indexResults(ops, results)
+	}
+
+	return results, err
+}
+
+func (x *IndexedStore) Txn(ctx context.Context, t Txn) (TxnResult, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	result, err := x.Store.Txn(ctx, t)
+	if err != nil {
+		return result, err
+	}
+
+	ops := t.Failure
+	if result.Succeeded {
+		ops = t.Success
+	}
+
+	x.indexResults(ops, result.Results)
+
+	return result, nil
+}
+
+// indexResults indexes the applied writes of batch operations; x.mu must
+// be held for writing.
+func (x *IndexedStore) indexResults(ops []BatchOp, results []BatchResult) {
+	for i, result := range results {
+		if !result.OK {
+			continue
+		}
+
+		switch result.Op {
+		case BatchPut:
+			x.index(result.Key, ops[i].Value)
+		case BatchDelete:
+			x.unindex(result.Key)
+		}
+	}
+}
+
+func (x *IndexedStore) ReplaceAll(ctx context.Context, entries []Entry) ([]string, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	removed, err := x.Store.ReplaceAll(ctx, entries)
+	if err != nil {
+		return nil, err
+	}
+
+	for field := range x.postings {
+		x.postings[field] = make(map[string]map[string]struct{})
+	}
+	x.indexed = make(map[string]map[string][]string, len(entries))
+
+	for _, e := range entries {
+		x.index(e.Key, e.Value)
+	}
+
+	return removed, nil
+}
+
+// indexedStore returns the store that indexes value fields, or nil
+// without indexes.
+func indexedStore() *IndexedStore {
+	s := store
+	for {
+		switch d := s.(type) {
+		case *IndexedStore:
+			return d
+		case TracingStore:
+			s = d.Store
+		case *EvictingStore:
+			s = d.Store
+		case *UpstreamStore:
+			s = d.Store
+		case *QuotaStore:
+			s = d.Store
+		case *MigratingStore:
+			s = d.Store
+		default:
+			return nil
+		}
+	}
+}
+
+// indexLookupHandler serves GET /v1/index/{field}?value=&limit=&cursor=&values=.
+func indexLookupHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	limit, after, err := listPage(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !query.Has("value") {
+		http.Error(w, "Missing value", http.StatusBadRequest)
+		return
+	}
+
+	x := indexedStore()
+	if x == nil {
+		http.Error(w, ErrorNoSuchIndex.Error(), http.StatusNotFound)
+		return
+	}
+
+	entries, more, err := x.Lookup(r.Context(), pathVars(r)["field"], query.Get("value"), after, limit)
+	if errors.Is(err, ErrorNoSuchIndex) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	writeListPage(w, query, entries, more)
+}
+
+// validIndexField reports whether field is a dotted path of non-empty
+// names.
+func validIndexField(field string) bool {
+	for _, name := range strings.Split(field, ".") {
+		if name == "" {
+			return false
+		}
+	}
+
+	return !strings.ContainsAny(field, "/?#") // Поле входит в путь запроса
+}
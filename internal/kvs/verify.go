@@ -0,0 +1,322 @@
+package kvs
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+/**
+ * Transaction log verification.
+ *
+ * kvs -verify-log checks the file transaction log without starting the
+ * server: the header of its segments and active file, the length and
+ * CRC-32 of every record, that it decrypts and decompresses, and that
+ * sequence numbers increase. It prints a JSON report - the offset of the
+ * first corrupt record of every file and counts of the events by type and
+ * of the keys they touch - and exits with status 1 if the log is corrupt.
+ * With -verify-log-repair a corrupt active file is truncated at its first
+ * corrupt record, as a startup outside strict mode would; a corrupt
+ * segment is only reported, since truncating it would lose the events of
+ * the files after it. GET /v1/verify-log on the admin listener checks the
+ * log of the running server the same way, a record still being written
+ * at the end of the active file aside.
+ */
+type logReport struct {
+	OK            bool              `json:"ok"` // Повреждений нет или все исправлены
+	Files         []logFileReport   `json:"files"`
+	Events        uint64            `json:"events"`
+	EventTypes    map[string]uint64 `json:"event_types"`
+	Keys          int               `json:"distinct_keys"`
+	FirstSequence uint64            `json:"first_sequence,omitempty"`
+	LastSequence  uint64            `json:"last_sequence,omitempty"`
+}
+
+type logFileReport struct {
+	File       string         `json:"file"`
+	Bytes      int64          `json:"bytes"`
+	Events     uint64         `json:"events"`
+	Corruption *logCorruption `json:"corruption,omitempty"`
+}
+
+type logCorruption struct {
+	Offset    int64  `json:"offset"`          // Начало первой повреждённой записи
+	Discarded int64  `json:"discarded_bytes"` // От неё до конца файла
+	Error     string `json:"error"`
+	Repaired  bool   `json:"repaired,omitempty"`
+}
+
+type logVerifier struct {
+	sealer *Sealer
+	live   bool // Журнал работающего сервера: последняя запись может ещё писаться
+	report logReport
+	keys   map[string]struct{}
+	visit  func(e Event) // Получает каждое целое событие; nil - только проверка
+}
+
+func newLogVerifier(sealer *Sealer, live bool, visit func(e Event)) *logVerifier {
+	return &logVerifier{sealer: sealer, live: live, report: logReport{EventTypes: make(map[string]uint64)}, keys: make(map[string]struct{}), visit: visit}
+}
+
+// verifyLog checks the log at filename and its segments, passing every
+// event that is intact to visit unless it is nil. When it checks a live
+// log over again, visit gets the events again from the start.
+func verifyLog(filename string, sealer *Sealer, live bool, visit func(e Event)) (logReport, error) {
+	for {
+		v := newLogVerifier(sealer, live, visit)
+
+		segments, last, err := listSegments(filename)
+		if err != nil {
+			return logReport{}, err
+		}
+
+		restart := false
+		for _, segment := range segments {
+			if err := v.verifyFileNamed(segment, false); err != nil {
+				if live && errors.Is(err, os.ErrNotExist) {
+					restart = true // Сегмент удалён сжатием: проверить заново
+					break
+				}
+				return logReport{}, err
+			}
+		}
+
+		if restart {
+			continue
+		}
+
+		file, err := os.Open(filename)
+		if err != nil {
+			return logReport{}, err
+		}
+
+		if _, rotated, err := listSegments(filename); live && err == nil && rotated != last {
+			file.Close()
+			continue // Файл переименован в сегмент, пока его открывали
+		}
+
+		err = v.verifyFile(file, filename, true)
+		file.Close()
+
+		if err != nil {
+			return logReport{}, err
+		}
+
+		v.report.Keys = len(v.keys)
+		v.report.OK = true
+		for _, f := range v.report.Files {
+			v.report.OK = v.report.OK && f.Corruption == nil
+		}
+
+		return v.report, nil
+	}
+}
+
+func (v *logVerifier) verifyFileNamed(filename string, active bool) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	return v.verifyFile(file, filename, active)
+}
+
+// verifyFile checks the records of one file up to the first corrupt one.
+// An I/O error, or a header that is not of a format the server reads,
+// is returned rather than reported as corruption.
+func (v *logVerifier) verifyFile(file *os.File, filename string, active bool) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	fr := logFileReport{File: filename, Bytes: info.Size()}
+	reader := bufio.NewReader(file)
+
+	header, err := reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("%s: transaction log read failure: %w", filename, err)
+	}
+
+	format, err := checkLogHeader(header, v.sealer)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+
+	offset := int64(len(header))
+
+	for {
+		record, err := format.read(reader)
+		if err == io.EOF && (record == "" || (v.live && active)) {
+			break // Неполная запись работающего сервера ещё пишется
+		}
+
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("%s: transaction log read failure: %w", filename, err)
+		}
+
+		if err := v.check(format, record); err != nil {
+			fr.Corruption = &logCorruption{Offset: offset, Discarded: fr.Bytes - offset, Error: err.Error()}
+			break
+		}
+
+		offset += int64(len(record))
+		fr.Events++
+	}
+
+	v.report.Files = append(v.report.Files, fr)
+
+	return nil
+}
+
+// check decodes one record and counts its event.
+func (v *logVerifier) check(format logFormat, record string) error {
+	e, err := format.decode(record)
+	if err == nil {
+		e, err = v.sealer.openEvent(e)
+	}
+
+	if err == nil {
+		e, err = inflateEvent(e)
+	}
+
+	if err != nil {
+		return fmt.Errorf("input parse error: %w", err)
+	}
+
+	if v.report.LastSequence >= e.Sequence && v.report.Events > 0 {
+		return fmt.Errorf("transaction numbers out of sequence: %d after %d", e.Sequence, v.report.LastSequence)
+	}
+
+	keys := []string{e.Key}
+	if e.EventType == EventTxn {
+		ops, err := decodeTxnEvents(e.Value)
+		if err != nil {
+			return fmt.Errorf("invalid transaction: %w", err)
+		}
+
+		for _, op := range ops {
+			keys = append(keys, op.Key)
+		}
+	}
+
+	for _, key := range keys {
+		if key != "" {
+			v.keys[key] = struct{}{}
+		}
+	}
+
+	if v.report.Events == 0 {
+		v.report.FirstSequence = e.Sequence
+	}
+
+	name, ok := eventTypeNames[e.EventType]
+	if !ok {
+		name = fmt.Sprintf("type_%d", e.EventType)
+	}
+
+	v.report.EventTypes[name]++
+	v.report.Events++
+	v.report.LastSequence = e.Sequence
+
+	if v.visit != nil {
+		v.visit(e)
+	}
+
+	return nil
+}
+
+// repairLog truncates a corrupt active file at its first corrupt record.
+func repairLog(filename string, report *logReport) error {
+	report.OK = true
+
+	for i := range report.Files {
+		c := report.Files[i].Corruption
+		if c == nil {
+			continue
+		}
+
+		if report.Files[i].File != filename {
+			report.OK = false // Сегменты не исправляются
+			continue
+		}
+
+		file, err := os.OpenFile(filename, os.O_RDWR, 0)
+		if err != nil {
+			return err
+		}
+
+		err = file.Truncate(c.Offset)
+		if err == nil {
+			err = file.Sync()
+		}
+
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to truncate transaction log: %w", err)
+		}
+
+		c.Repaired = true
+	}
+
+	return nil
+}
+
+// runLogVerification serves kvs -verify-log and returns the exit status.
+func runLogVerification(c TransactionLogConfig, repair bool) int {
+	if c.Backend != "file" {
+		fatal("cannot verify the transaction log", fmt.Errorf("-verify-log checks the file backend, not %q", c.Backend))
+	}
+
+	if _, err := os.Stat(c.File); err != nil {
+		fatal("cannot verify the transaction log", err)
+	}
+
+	report, err := verifyLog(c.File, sealer, false, nil)
+	if err != nil {
+		fatal("cannot verify the transaction log", err)
+	}
+
+	if repair && !report.OK {
+		if err := repairLog(c.File, &report); err != nil {
+			fatal("cannot repair the transaction log", err)
+		}
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+
+	if !report.OK {
+		return 1
+	}
+
+	return 0
+}
+
+// verifyLogHandler serves GET /v1/verify-log.
+func verifyLogHandler(w http.ResponseWriter, r *http.Request) {
+	l, ok := unwrapLogger(logger).(*FileTransactionLogger)
+	if !ok {
+		http.Error(w, "Log verification needs the file transaction log", http.StatusNotImplemented)
+		return
+	}
+
+	report, err := verifyLog(l.filename, l.sealer, true, nil)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,266 @@
+package kvs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * Watch subsystem.
+ *
+ * Write handlers publish a ChangeEvent to the broker after the store and
+ * the transaction log have been updated; watch handlers subscribe to it
+ * and stream matching events to clients as Server-Sent Events. Each
+ * subscription selects its events by key: a single one, a prefix or a
+ * glob pattern. Listeners, such as the webhooks, get every event.
+ *
+ * Watchers and webhooks may also narrow their events down to some types,
+ * with ?types=delete,expire for instance, and to the puts that change the
+ * value of their key, with ?changed=true: a put of the value the key
+ * already holds, which only gives it a new revision, is then left out.
+ * Only single-key puts are compared; those of batches, transactions and
+ * increments count as changes.
+ */
+
+var broker *Broker
+
+// changeTypes lists the types of ChangeEvent.
+var changeTypes = []string{"put", "delete", "expire", "evict"}
+
+type ChangeEvent struct {
+	Type    string     `json:"type"` // "put", "delete", "expire" или "evict"
+	Key     string     `json:"key"`
+	Value   string     `json:"value,omitempty"`
+	Expires *time.Time `json:"expires,omitempty"`
+
+	ContentType string `json:"content_type,omitempty"`
+
+	unchanged bool // PUT записал то же значение
+}
+
+// changeFilter selects events by type and, for puts, by whether they
+// changed the value.
+type changeFilter struct {
+	types       map[string]bool // nil: все типы
+	changedOnly bool
+}
+
+func newChangeFilter(types []string, changedOnly bool) (changeFilter, error) {
+	f := changeFilter{changedOnly: changedOnly}
+
+	for _, t := range types {
+		if !slices.Contains(changeTypes, t) {
+			return changeFilter{}, fmt.Errorf("Unknown event type %q", t)
+		}
+
+		if f.types == nil {
+			f.types = make(map[string]bool)
+		}
+		f.types[t] = true
+	}
+
+	return f, nil
+}
+
+func (f changeFilter) allows(e ChangeEvent) bool {
+	if f.types != nil && !f.types[e.Type] {
+		return false
+	}
+
+	return !f.changedOnly || !e.unchanged
+}
+
+type Subscription struct {
+	C     <-chan ChangeEvent // Закрывается при отписке или переполнении
+	c     chan ChangeEvent
+	match func(e ChangeEvent) bool
+}
+
+type Broker struct {
+	mu         sync.Mutex
+	subs       map[*Subscription]struct{}
+	closed     bool
+	bufferSize int // Очередь событий подписчика; при переполнении он отключается
+
+	listeners []func(e ChangeEvent) // Вызываются под b.mu, не должны блокироваться
+}
+
+func NewBroker(bufferSize int) *Broker {
+	return &Broker{subs: make(map[*Subscription]struct{}), bufferSize: bufferSize}
+}
+
+// Subscribers returns the number of subscribers.
+func (b *Broker) Subscribers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.subs)
+}
+
+// Subscribe registers a subscriber for the events that satisfy match.
+func (b *Broker) Subscribe(match func(e ChangeEvent) bool) *Subscription {
+	c := make(chan ChangeEvent, b.bufferSize)
+	s := &Subscription{C: c, c: c, match: match}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		close(c)
+		return s
+	}
+
+	b.subs[s] = struct{}{}
+
+	return s
+}
+
+func (b *Broker) Unsubscribe(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subs[s]; ok {
+		delete(b.subs, s)
+		close(s.c)
+	}
+}
+
+// Listen registers fn to be called with every published event, in
+// order. fn must not block.
+func (b *Broker) Listen(fn func(e ChangeEvent)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.listeners = append(b.listeners, fn)
+}
+
+// Publish delivers e to every matching subscriber without blocking the
+// write path; subscribers whose buffer is full are dropped.
+func (b *Broker) Publish(e ChangeEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, fn := range b.listeners {
+		fn(e)
+	}
+
+	for s := range b.subs {
+		if !s.match(e) {
+			continue
+		}
+
+		select {
+		case s.c <- e:
+		default:
+			delete(b.subs, s)
+			close(s.c)
+		}
+	}
+}
+
+// Close ends all subscriptions and rejects new ones.
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for s := range b.subs {
+		delete(b.subs, s)
+		close(s.c)
+	}
+
+	b.closed = true
+}
+
+/**
+ * Watch handlers.
+ */
+func keyWatchHandler(w http.ResponseWriter, r *http.Request) {
+	key := pathVars(r)["key"]
+
+	streamEvents(w, r, func(k string) bool { return k == key })
+}
+
+// prefixWatchHandler serves GET /v1/watch?prefix= and, for keys matching
+// a glob pattern, GET /v1/watch?pattern=.
+func prefixWatchHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+
+	if pattern, ok := query["pattern"]; ok {
+		if prefix != "" || len(pattern) != 1 {
+			http.Error(w, "Give either one pattern or a prefix", http.StatusBadRequest)
+			return
+		}
+
+		prefix := globPrefix(pattern[0])
+		streamEvents(w, r, func(k string) bool { return strings.HasPrefix(k, prefix) && matchGlob(pattern[0], k) })
+		return
+	}
+
+	streamEvents(w, r, func(k string) bool { return strings.HasPrefix(k, prefix) })
+}
+
+// streamEvents streams the events of the keys that satisfy match, of the
+// types given by ?types= and, with ?changed=true, only the puts that
+// change the value.
+func streamEvents(w http.ResponseWriter, r *http.Request, match func(key string) bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	var types []string
+	if raw := r.URL.Query().Get("types"); raw != "" {
+		types = strings.Split(raw, ",")
+	}
+
+	changed, _ := strconv.ParseBool(r.URL.Query().Get("changed"))
+
+	filter, err := newChangeFilter(types, changed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sub := broker.Subscribe(func(e ChangeEvent) bool { return match(e.Key) && filter.allows(e) })
+	defer broker.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(config.Watch.KeepAlive) // Не даёт прокси закрыть простаивающий поток
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+
+		case e, ok := <-sub.C:
+			if !ok {
+				return
+			}
+
+			data, err := json.Marshal(e)
+			if err != nil {
+				return
+			}
+
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+			flusher.Flush()
+		}
+	}
+}
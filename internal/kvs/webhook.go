@@ -0,0 +1,241 @@
+package kvs
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+ * Webhooks.
+ *
+ * Every change published to the broker - a put, delete, expiry or
+ * eviction - is also POSTed as the JSON of its ChangeEvent to each
+ * configured target whose prefix the key starts with. A target has its
+ * own queue and delivers its events in order, one request at a time. A
+ * delivery that fails with a network error, a 5xx or 429 is retried with
+ * exponential backoff up to the configured number of times, then dropped
+ * and logged; other 4xx responses are not retried. A full queue drops new
+ * events, so a slow target never holds up writes, and the events still
+ * queued at shutdown are lost.
+ *
+ * With a secret set, X-Webhook-Signature carries "sha256=" and the hex
+ * HMAC-SHA256 of the body, for targets to check where it comes from.
+ * The configured event types and changed_only filter the events sent to
+ * every target, as ?types= and ?changed= do for watchers.
+ */
+var webhooks *Webhooks
+
+type webhookTarget struct {
+	prefix string
+	url    string
+	queue  chan ChangeEvent
+}
+
+type Webhooks struct {
+	targets []*webhookTarget
+	filter  changeFilter
+	client  *http.Client
+	secret  []byte // nil: без подписи
+
+	retries    int
+	backoff    time.Duration // Пауза перед первым повтором; удваивается
+	maxBackoff time.Duration
+
+	ctx    context.Context // Отменяется при закрытии
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	delivered atomic.Uint64
+	failed    atomic.Uint64 // Отброшены после всех попыток
+	dropped   atomic.Uint64 // Не поместились в очередь
+}
+
+type webhookStats struct {
+	Delivered uint64 `json:"delivered"`
+	Failed    uint64 `json:"failed"`
+	Dropped   uint64 `json:"dropped"`
+}
+
+// newWebhooks starts the delivery to the targets of c, given as
+// "prefix=url". It returns nil if no target is configured.
+func newWebhooks(c WebhooksConfig) (*Webhooks, error) {
+	if len(c.Targets) == 0 {
+		return nil, nil
+	}
+
+	filter, err := newChangeFilter(c.Events, c.ChangedOnly)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook events: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	h := &Webhooks{
+		filter:     filter,
+		client:     &http.Client{Timeout: c.Timeout},
+		retries:    c.Retries,
+		backoff:    c.Backoff,
+		maxBackoff: c.MaxBackoff,
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+
+	if c.Secret != "" {
+		h.secret = []byte(c.Secret)
+	}
+
+	for _, entry := range c.Targets {
+		prefix, raw, ok := strings.Cut(entry, "=")
+		if !ok {
+			cancel()
+			return nil, fmt.Errorf("invalid webhook target %q: want prefix=url", entry)
+		}
+
+		if u, err := url.Parse(raw); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			cancel()
+			return nil, fmt.Errorf("invalid webhook target %q: want an http or https URL", entry)
+		}
+
+		h.targets = append(h.targets, &webhookTarget{prefix: prefix, url: raw, queue: make(chan ChangeEvent, c.QueueSize)})
+	}
+
+	for _, t := range h.targets {
+		h.wg.Add(1)
+		go h.run(t)
+	}
+
+	return h, nil
+}
+
+// Notify queues e, if the filter allows it, for every target whose prefix
+// its key starts with. It never blocks.
+func (h *Webhooks) Notify(e ChangeEvent) {
+	if !h.filter.allows(e) {
+		return
+	}
+
+	for _, t := range h.targets {
+		if !strings.HasPrefix(e.Key, t.prefix) {
+			continue
+		}
+
+		select {
+		case t.queue <- e:
+		default:
+			if n := h.dropped.Add(1); n == 1 || n%1000 == 0 { // Не засорять журнал при долгом отказе
+				slog.Warn("webhook queue full, dropping events", "url", t.url, "dropped", n)
+			}
+		}
+	}
+}
+
+// Close stops the delivery, abandoning the queued events and the retries
+// in progress.
+func (h *Webhooks) Close() {
+	h.cancel()
+	h.wg.Wait()
+}
+
+func (h *Webhooks) stats() webhookStats {
+	return webhookStats{Delivered: h.delivered.Load(), Failed: h.failed.Load(), Dropped: h.dropped.Load()}
+}
+
+func (h *Webhooks) run(t *webhookTarget) {
+	defer h.wg.Done()
+
+	for {
+		select {
+		case <-h.ctx.Done():
+			return
+		case e := <-t.queue:
+			h.deliver(t, e)
+		}
+	}
+}
+
+// deliver posts e to the target, retrying as long as the failure is
+// temporary and attempts remain.
+func (h *Webhooks) deliver(t *webhookTarget, e ChangeEvent) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	backoff := h.backoff
+
+	for attempt := 1; ; attempt++ {
+		retry, err := h.post(t.url, e.Type, body)
+		if err == nil {
+			h.delivered.Add(1)
+			return
+		}
+
+		if h.ctx.Err() != nil {
+			return
+		}
+
+		if !retry || attempt > h.retries {
+			h.failed.Add(1)
+			slog.Error("webhook delivery failed", "url", t.url, "key", e.Key, "type", e.Type, "attempts", attempt, "error", err)
+			return
+		}
+
+		select {
+		case <-h.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > h.maxBackoff {
+			backoff = h.maxBackoff
+		}
+	}
+}
+
+// post sends one delivery and reports whether a failure is worth a
+// retry.
+func (h *Webhooks) post(target, eventType string, body []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(h.ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", eventType)
+
+	if h.secret != nil {
+		mac := hmac.New(sha256.New, h.secret)
+		mac.Write(body)
+		req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+
+	io.Copy(io.Discard, resp.Body) // Вернуть соединение в пул
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("target answered %s", resp.Status)
+	default:
+		return false, fmt.Errorf("target answered %s", resp.Status)
+	}
+}
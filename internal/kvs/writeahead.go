@@ -0,0 +1,293 @@
+package kvs
+
+import (
+	"context"
+	"time"
+)
+
+/**
+ * Write-ahead logging.
+ *
+ * A put or delete of one key is logged before the store changes the key,
+ * not after: the front end hands the store a context made by loggedPut or
+ * loggedDelete, and the in-memory store, once it knows the new revision,
+ * runs its commit under the lock of the key and changes the key only if
+ * the commit succeeds. The commit refuses the write while the log is
+ * failing and otherwise queues its events, in the order the key changes,
+ * so a crash in between leaves an event the next startup replays rather
+ * than a change the log never saw; with X-Durability: sync the events are
+ * fsynced before the write is acknowledged. A put carries its content
+ * type and deadline in its commit, and the store gives them to the key
+ * with the value under the same lock, so that no other write lands
+ * between them.
+ *
+ * Increments and appends commit the same way under loggedIncrement, once
+ * the store has computed the new value, and batches and transactions
+ * under loggedOps, once the store has worked out the results of their
+ * operations under the locks of all their keys. Deleting by prefix
+ * commits under loggedOps too, as a transaction of the deletes, and so
+ * does undeleting, as a put. Replacing the whole store on import or
+ * snapshot restore commits under loggedReplace, which queues the deletes
+ * and puts as events of their own rather than as one record the size of
+ * the store. The disk stores, whose keys are durable on their own and
+ * whose transactions Badger may run more than once, commit once their
+ * transaction has.
+ */
+type commitKey struct{}
+
+// commit logs a write about to change one key or more and keeps whether
+// it changes the value of the key, for the watchers that only want
+// changed values. Only the hook of the kind of write it was made for is
+// set.
+type commit struct {
+	log          func(revision uint64) error                      // Версия ключа после записи; 0 для удаления
+	logIncrement func(value string, revision uint64) error        // Значение и версия после увеличения или дописывания
+	logOps       func(ops []BatchOp, results []BatchResult) error // Результаты операций пакета или транзакции
+	contentType  string                                           // Тип значения, который получает ключ записи
+	deadline     time.Time                                        // Срок действия ключа записи; нулевой - без срока
+	changed      bool
+}
+
+func withCommit(ctx context.Context, log func(revision uint64) error) context.Context {
+	return context.WithValue(ctx, commitKey{}, &commit{log: log, changed: true})
+}
+
+// commitWrite runs the commit of ctx, if it has one, for a write giving
+// the key revision. changed, nil for a delete, reports whether the write
+// changes the value of the key.
+func commitWrite(ctx context.Context, revision uint64, changed func() bool) error {
+	c, ok := ctx.Value(commitKey{}).(*commit)
+	if !ok || c.log == nil {
+		return nil
+	}
+
+	if err := c.log(revision); err != nil {
+		return err
+	}
+
+	c.changed = changed == nil || changed()
+
+	return nil
+}
+
+// commitIncrement runs the commit of ctx, if it has one, for an increment
+// or append giving the key value at revision.
+func commitIncrement(ctx context.Context, value string, revision uint64) error {
+	c, ok := ctx.Value(commitKey{}).(*commit)
+	if !ok || c.logIncrement == nil {
+		return nil
+	}
+
+	return c.logIncrement(value, revision)
+}
+
+// commitOps runs the commit of ctx, if it has one, for a batch or the
+// branch of a transaction about to apply ops with the given results.
+func commitOps(ctx context.Context, ops []BatchOp, results []BatchResult) error {
+	c, ok := ctx.Value(commitKey{}).(*commit)
+	if !ok || c.logOps == nil {
+		return nil
+	}
+
+	return c.logOps(ops, results)
+}
+
+// putAttributes returns the content type and deadline the put committed
+// under ctx gives its key along with the value; a put without a commit
+// clears both.
+func putAttributes(ctx context.Context) (contentType string, deadline time.Time) {
+	c, ok := ctx.Value(commitKey{}).(*commit)
+	if !ok {
+		return "", time.Time{}
+	}
+
+	return c.contentType, c.deadline
+}
+
+// valueChanged reports whether the write committed under ctx changed the
+// value of its key. Writes without a commit count as changes.
+func valueChanged(ctx context.Context) bool {
+	c, ok := ctx.Value(commitKey{}).(*commit)
+	return !ok || c.changed
+}
+
+// writeLog is the transaction log the commits of writes queue their
+// events to, with the health of the log that refuses them while it is
+// failing.
+type writeLog struct {
+	logger TransactionLogger
+	health *logHealthState
+}
+
+// serverLog returns the log of the process, which the protocol front ends
+// write to.
+func serverLog() writeLog {
+	return writeLog{logger, &logHealth}
+}
+
+// loggedPut returns ctx with a commit that logs a put of value under key,
+// with its content type and deadline if they are set, and has the store
+// give them to the key.
+func loggedPut(ctx context.Context, key, value, contentType string, deadline time.Time) context.Context {
+	return serverLog().put(ctx, key, value, contentType, deadline)
+}
+
+// loggedDelete returns ctx with a commit that logs a delete of key, or
+// its soft delete until the given moment if that is set.
+func loggedDelete(ctx context.Context, key string, until time.Time) context.Context {
+	return serverLog().delete(ctx, key, until)
+}
+
+// loggedIncrement returns ctx with a commit that logs an increment or
+// append of key with the value and revision the store works out.
+func loggedIncrement(ctx context.Context, key string) context.Context {
+	return serverLog().increment(ctx, key)
+}
+
+// loggedOps returns ctx with a commit that logs the writes among the
+// operations of a batch or transaction as one event, if there are any.
+func loggedOps(ctx context.Context) context.Context {
+	return serverLog().ops(ctx)
+}
+
+// loggedReplace returns ctx with a commit that logs the deletes and puts
+// replacing the content of the store, one event each.
+func loggedReplace(ctx context.Context) context.Context {
+	return serverLog().replace(ctx)
+}
+
+// check refuses a commit while the log is failing.
+func (l writeLog) check() error {
+	if l.health.failing.Load() {
+		return ErrorLogFailing
+	}
+
+	return nil
+}
+
+func (l writeLog) put(ctx context.Context, key, value, contentType string, deadline time.Time) context.Context {
+	return context.WithValue(ctx, commitKey{}, &commit{changed: true, contentType: contentType, deadline: deadline, log: func(revision uint64) error {
+		if err := l.check(); err != nil {
+			return err
+		}
+
+		return l.logPut(key, value, contentType, revision, deadline)
+	}})
+}
+
+func (l writeLog) delete(ctx context.Context, key string, until time.Time) context.Context {
+	return withCommit(ctx, func(uint64) error {
+		if err := l.check(); err != nil {
+			return err
+		}
+
+		if until.IsZero() {
+			return l.logger.WriteDelete(key)
+		}
+
+		return l.logger.WriteTombstone(key, until)
+	})
+}
+
+func (l writeLog) increment(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, commitKey{}, &commit{changed: true, logIncrement: func(value string, revision uint64) error {
+		if err := l.check(); err != nil {
+			return err
+		}
+
+		return l.logger.WriteIncrement(key, value, revision)
+	}})
+}
+
+func (l writeLog) ops(ctx context.Context) context.Context {
+	return context.WithValue(ctx, commitKey{}, &commit{changed: true, logOps: func(ops []BatchOp, results []BatchResult) error {
+		writes := opsEvents(ops, results)
+		if len(writes) == 0 {
+			return nil
+		}
+
+		if err := l.check(); err != nil {
+			return err
+		}
+
+		return l.logger.WriteTxn(writes)
+	}})
+}
+
+func (l writeLog) replace(ctx context.Context) context.Context {
+	return context.WithValue(ctx, commitKey{}, &commit{changed: true, logOps: func(ops []BatchOp, results []BatchResult) error {
+		if err := l.check(); err != nil {
+			return err
+		}
+
+		for i, op := range ops {
+			var err error
+			if op.Op == BatchDelete {
+				err = l.logger.WriteDelete(op.Key)
+			} else {
+				err = l.logPut(op.Key, op.Value, op.contentType, results[i].Revision, op.deadline)
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}})
+}
+
+// replaceOps returns the deletes of the removed keys and the puts of the
+// entries that replace the content of a store, as operations and their
+// results for its commit.
+func replaceOps(removed []string, entries []Entry) ([]BatchOp, []BatchResult) {
+	ops := make([]BatchOp, 0, len(removed)+len(entries))
+	results := make([]BatchResult, 0, len(removed)+len(entries))
+
+	for _, key := range removed {
+		ops = append(ops, BatchOp{Op: BatchDelete, Key: key})
+		results = append(results, BatchResult{Op: BatchDelete, Key: key, OK: true})
+	}
+
+	for _, e := range entries {
+		ops = append(ops, BatchOp{Op: BatchPut, Key: e.Key, Value: e.Value, contentType: e.ContentType, deadline: e.Expires})
+		results = append(results, BatchResult{Op: BatchPut, Key: e.Key, OK: true, Revision: e.Revision})
+	}
+
+	return ops, results
+}
+
+// deleteOps returns the deletes of keys as operations and their results
+// for a commit.
+func deleteOps(keys []string) ([]BatchOp, []BatchResult) {
+	return replaceOps(keys, nil)
+}
+
+// logPut writes the events of a put to the log.
+func (l writeLog) logPut(key, value, contentType string, revision uint64, deadline time.Time) error {
+	if err := l.logger.WritePut(key, value, revision); err != nil {
+		return err
+	}
+
+	if contentType != "" {
+		if err := l.logger.WriteContentType(key, contentType); err != nil {
+			return err
+		}
+	}
+
+	if !deadline.IsZero() {
+		return l.logger.WriteExpire(key, deadline)
+	}
+
+	return nil
+}
+
+// expiry returns the deadline of a key written now with ttl, or the zero
+// time if ttl is not positive.
+func expiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+
+	return time.Now().Add(ttl)
+}
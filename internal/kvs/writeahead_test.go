@@ -0,0 +1,165 @@
+package kvs
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFailingLogRefusesWrites(t *testing.T) {
+	ctx := context.Background()
+	s := NewShardedStore(4, 0, 0, false)
+
+	if _, err := s.Put(ctx, "n", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	logHealth.failing.Store(true)
+	defer logHealth.failing.Store(false)
+
+	if _, _, err := s.Increment(loggedIncrement(ctx, "n"), "n", 1); !errors.Is(err, ErrorLogFailing) {
+		t.Fatalf("Increment with a failing log returned %v, want ErrorLogFailing", err)
+	}
+
+	if _, _, err := s.Append(loggedIncrement(ctx, "n"), "n", "0", 1024); !errors.Is(err, ErrorLogFailing) {
+		t.Fatalf("Append with a failing log returned %v, want ErrorLogFailing", err)
+	}
+
+	ops := []BatchOp{{Op: BatchPut, Key: "n", Value: "9"}, {Op: BatchPut, Key: "m", Value: "1"}}
+	if _, err := s.Batch(loggedOps(ctx), ops); !errors.Is(err, ErrorLogFailing) {
+		t.Fatalf("Batch with a failing log returned %v, want ErrorLogFailing", err)
+	}
+
+	if value, err := s.Get(ctx, "n"); err != nil || value != "1" {
+		t.Fatalf("n is %q (%v) after refused writes, want 1", value, err)
+	}
+
+	if _, err := s.Get(ctx, "m"); !errors.Is(err, ErrorNoSuchKey) {
+		t.Fatalf("m exists after a refused batch (%v)", err)
+	}
+}
+
+func TestFailingLogRefusesBulkWrites(t *testing.T) {
+	ctx := context.Background()
+	s := NewShardedStore(4, 0, 0, false)
+
+	for _, key := range []string{"a1", "a2", "b"} {
+		if _, err := s.Put(ctx, key, "1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.SoftDelete(ctx, "b", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	logHealth.failing.Store(true)
+	defer logHealth.failing.Store(false)
+
+	match := func(k string) bool { return k[0] == 'a' }
+	if _, err := s.DeleteMatching(loggedOps(ctx), match); !errors.Is(err, ErrorLogFailing) {
+		t.Fatalf("DeleteMatching with a failing log returned %v, want ErrorLogFailing", err)
+	}
+
+	if _, err := s.Undelete(loggedOps(ctx), "b"); !errors.Is(err, ErrorLogFailing) {
+		t.Fatalf("Undelete with a failing log returned %v, want ErrorLogFailing", err)
+	}
+
+	if _, err := s.ReplaceAll(loggedReplace(ctx), []Entry{{Key: "c", Value: "1", Revision: 1}}); !errors.Is(err, ErrorLogFailing) {
+		t.Fatalf("ReplaceAll with a failing log returned %v, want ErrorLogFailing", err)
+	}
+
+	for _, key := range []string{"a1", "a2"} {
+		if value, err := s.Get(ctx, key); err != nil || value != "1" {
+			t.Fatalf("%s is %q (%v) after refused writes, want 1", key, value, err)
+		}
+	}
+
+	if _, err := s.Get(ctx, "b"); !errors.Is(err, ErrorNoSuchKey) {
+		t.Fatalf("b exists after a refused undelete (%v)", err)
+	}
+
+	if _, err := s.Get(ctx, "c"); !errors.Is(err, ErrorNoSuchKey) {
+		t.Fatalf("c exists after a refused replacement (%v)", err)
+	}
+}
+
+func TestLoggedPutAttributes(t *testing.T) {
+	defer func(s Store, l TransactionLogger) { store, logger = s, l }(store, logger)
+
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "transaction.log")
+	deadline := time.Now().Add(time.Hour).Round(0)
+
+	l := startTestLog(t, filename)
+	store = NewShardedStore(4, 0, 0, false)
+
+	if _, err := store.Put(loggedPut(ctx, "k", "v", "text/plain", deadline), "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := store.GetEntry(ctx, "k")
+	if err != nil || entry.ContentType != "text/plain" || !entry.Expires.Equal(deadline) {
+		t.Fatalf("k is %+v (%v), want content type text/plain and deadline %v", entry, err, deadline)
+	}
+
+	if err := l.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var put, contentType, expire bool
+	for _, e := range replayTestLog(t, openTestLog(t, filename)) {
+		switch e.EventType {
+		case EventPut:
+			put = e.Key == "k" && e.Value == "v"
+		case EventContentType:
+			contentType = put && e.Value == "text/plain"
+		case EventExpire:
+			expire = put
+		}
+	}
+
+	if !put || !contentType || !expire {
+		t.Fatalf("log has put %v, content type %v and deadline %v, want all of them after the put", put, contentType, expire)
+	}
+}
+
+func TestWriteAfterClose(t *testing.T) {
+	l := openTestLog(t, filepath.Join(t.TempDir(), "transaction.log"))
+	replayTestLog(t, l)
+	l.Run()
+
+	watched := make(chan struct{})
+	go func() {
+		watchLoggerErrors(l, new(logHealthState))
+		close(watched)
+	}()
+
+	if err := l.WritePut("a", "1", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.WritePut("b", "1", 1); !errors.Is(err, ErrorLoggerStopped) {
+		t.Fatalf("write after close returned %v, want ErrorLoggerStopped", err)
+	}
+
+	if err := l.Sync(context.Background()); !errors.Is(err, ErrorLoggerStopped) {
+		t.Fatalf("sync after close returned %v, want ErrorLoggerStopped", err)
+	}
+
+	select {
+	case <-watched:
+	case <-time.After(time.Second):
+		t.Fatal("error watcher still running after close")
+	}
+}
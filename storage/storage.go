@@ -0,0 +1,61 @@
+// Package storage embeds the key-value store in a Go program, without the
+// HTTP server. Open replays the transaction log of the configuration into
+// the store, and the writes made through the package are logged as the
+// server logs them, so the same files can be served by cmd/server later.
+//
+//	c := storage.DefaultConfig()
+//	c.TransactionLog.File = "/var/lib/app/kvs.log"
+//	db, err := storage.Open(ctx, c)
+//	rev, err := db.Put(ctx, "greeting", "hello", time.Minute)
+//	entry, err := db.Get(ctx, "greeting")
+//
+// A DB shares no state with the server or with other DBs.
+package storage
+
+import (
+	"context"
+
+	"example.com/gorilla/internal/kvs"
+)
+
+type (
+	Config      = kvs.Config
+	StoreConfig = kvs.StoreConfig
+	Store       = kvs.Store
+	Entry       = kvs.Entry
+)
+
+var (
+	ErrorNoSuchKey     = kvs.ErrorNoSuchKey
+	ErrorKeyTooLong    = kvs.ErrorKeyTooLong
+	ErrorInvalidKey    = kvs.ErrorInvalidKey
+	ErrorValueTooLarge = kvs.ErrorValueTooLarge
+	ErrorReadOnly      = kvs.ErrorReadOnly
+	ErrorMemoryFull    = kvs.ErrorMemoryFull
+	ErrorQuotaExceeded = kvs.ErrorQuotaExceeded
+)
+
+// NoExpiration is the TTL of keys that never expire.
+const NoExpiration = kvs.NoExpiration
+
+// DefaultConfig returns the configuration the server starts with when
+// nothing is set.
+func DefaultConfig() *Config {
+	return kvs.DefaultConfig()
+}
+
+// NewStore builds the store c selects, without a transaction log.
+func NewStore(c StoreConfig) (Store, error) {
+	return kvs.NewStore(c)
+}
+
+// DB is a store opened by Open, with its transaction log.
+type DB = kvs.DB
+
+// Open opens the store and the transaction log of c and replays the log.
+// Its background work, the reaping of expired keys and the snapshots of
+// the log, runs until ctx is done or Close is called. Each DB has its own
+// state: several can be open at once on different files.
+func Open(ctx context.Context, c *Config) (*DB, error) {
+	return kvs.OpenDB(ctx, c)
+}
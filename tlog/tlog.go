@@ -0,0 +1,47 @@
+// Package tlog opens the transaction logs of the key-value store, to read
+// or write them from another Go program: the file log, or the PostgreSQL,
+// S3, Kafka or NATS backends of builds with their tags.
+//
+//	l, err := tlog.New(tlog.Config{Backend: "file", File: "kvs.log"})
+//	events, errs := l.ReadEvents()
+//
+// The events are replayed with ReadEvents before Run starts logging new
+// ones; Close waits for them to be written.
+package tlog
+
+import "example.com/gorilla/internal/kvs"
+
+type (
+	Config      = kvs.TransactionLogConfig
+	Options     = kvs.LogOptions
+	FileOptions = kvs.FileLogOptions
+	Logger      = kvs.TransactionLogger
+	Event       = kvs.Event
+	EventType   = kvs.EventType
+)
+
+const (
+	EventDelete      = kvs.EventDelete
+	EventPut         = kvs.EventPut
+	EventExpire      = kvs.EventExpire
+	EventIncrement   = kvs.EventIncrement
+	EventTxn         = kvs.EventTxn
+	EventContentType = kvs.EventContentType
+	EventReadOnly    = kvs.EventReadOnly
+	EventExpired     = kvs.EventExpired
+	EventTombstone   = kvs.EventTombstone
+	EventSchedule    = kvs.EventSchedule
+	EventSequence    = kvs.EventSequence
+)
+
+var ErrorLoggerStopped = kvs.ErrorLoggerStopped
+
+// New opens the log c selects, with the encryption c configures.
+func New(c Config) (Logger, error) {
+	return kvs.NewTransactionLogger(c)
+}
+
+// NewFile opens the file log at filename with o.
+func NewFile(filename string, o FileOptions) (Logger, error) {
+	return kvs.NewFileTransactionLogger(filename, o)
+}